@@ -5,16 +5,20 @@ import (
 	"log"
 	"path"
 	"text/template"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/serverlogger"
+	"github.com/Cloud-Foundations/keymaster/eventmon/alerts"
 	"github.com/Cloud-Foundations/keymaster/eventmon/eventrecorder"
 	"github.com/Cloud-Foundations/keymaster/eventmon/httpd"
 	"github.com/Cloud-Foundations/keymaster/eventmon/monitord"
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
 	"github.com/Cloud-Foundations/keymaster/lib/constants"
-	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
 	"github.com/Cloud-Foundations/tricorder/go/tricorder"
 )
 
+const recordQueueLength = 1024
+
 var (
 	configFile = flag.String("configFile",
 		constants.DefaultKeymasterEventmonConfigFile, "Configuration file")
@@ -25,12 +29,15 @@ var (
 )
 
 type configurationType struct {
-	KeymasterServerHostname   string      `yaml:"keymaster_server_hostname"`
-	KeymasterServerPortNum    uint        `yaml:"keymaster_server_port_num"`
-	SshCertParametersCommand  certCommand `yaml:"ssh_cert_parameters_command"`
-	SshCertRawCommand         string      `yaml:"ssh_cert_raw_command"`
-	X509CertParametersCommand certCommand `yaml:"x509_cert_parameters_command"`
-	X509CertRawCommand        string      `yaml:"x509_cert_raw_command"`
+	AlertRules                []alerts.RuleConfig  `yaml:"alert_rules"`
+	EventStore                eventrecorder.Config `yaml:"event_store"`
+	KeymasterServerHostname   string               `yaml:"keymaster_server_hostname"`
+	KeymasterServerPortNum    uint                 `yaml:"keymaster_server_port_num"`
+	Sinks                     []sinks.Config       `yaml:"sinks"`
+	SshCertParametersCommand  certCommand          `yaml:"ssh_cert_parameters_command"`
+	SshCertRawCommand         string               `yaml:"ssh_cert_raw_command"`
+	X509CertParametersCommand certCommand          `yaml:"x509_cert_parameters_command"`
+	X509CertRawCommand        string               `yaml:"x509_cert_raw_command"`
 }
 
 type certCommand struct {
@@ -47,61 +54,90 @@ func main() {
 	if err != nil {
 		logger.Fatalf("Cannot load configuration: %s\n", err)
 	}
-	recorder, err := eventrecorder.New(path.Join(*stateDir, "events.gob"),
-		logger)
+	recorder, err := eventrecorder.New(path.Join(*stateDir, "events.sqlite3"),
+		configuration.EventStore, logger)
 	if err != nil {
 		logger.Fatalf("Cannot start event recorder: %s\n", err)
 	}
+	err = recorder.ImportLegacyEvents(path.Join(*stateDir, "events.gob"))
+	if err != nil {
+		logger.Printf("Cannot import events.gob: %s\n", err)
+	}
+	alertEngine, err := alerts.New(configuration.AlertRules, logger)
+	if err != nil {
+		logger.Fatalf("Cannot load alert rules: %s\n", err)
+	}
+	if err := learnHistory(alertEngine, recorder); err != nil {
+		logger.Printf("Cannot load event history for alert rules: %s\n", err)
+	}
+	eventSinks, err := sinks.New(configuration.Sinks, logger)
+	if err != nil {
+		logger.Fatalf("Cannot start event sinks: %s\n", err)
+	}
 	monitor, err := monitord.New(configuration.KeymasterServerHostname,
 		configuration.KeymasterServerPortNum, logger)
 	if err != nil {
 		logger.Fatalf("Cannot start monitor: %s\n", err)
 	}
 	httpd.AddHtmlWriter(monitor)
+	httpd.AddHtmlWriter(alertEngine)
 	httpd.AddHtmlWriter(logger)
 	if err = httpd.StartServer(*portNum, recorder, monitor, true); err != nil {
 		logger.Fatalf("Unable to create http server: %s\n", err)
 	}
+	// Record events in the background, so that slow database writes do not
+	// hold up the sinks and alert rules.
+	recordQueue := make(chan *sinks.Event, recordQueueLength)
+	go func() {
+		for event := range recordQueue {
+			if err := recorder.Record(event); err != nil {
+				logger.Println(err)
+			}
+		}
+	}()
 	for {
 		select {
-		case auth := <-monitor.AuthChannel:
-			data := &eventrecorder.AuthInfo{Username: auth.Username}
-			switch auth.AuthType {
-			case eventmon.AuthTypePassword:
-				data.AuthType = eventrecorder.AuthTypePassword
-			case eventmon.AuthTypeSymantecVIP:
-				data.AuthType = eventrecorder.AuthTypeSymantecVIP
-				if auth.VIPAuthType == eventmon.VIPAuthTypeOTP {
-					data.VIPAuthType = eventrecorder.VIPAuthTypeOTP
-				} else if auth.VIPAuthType == eventmon.VIPAuthTypePush {
-					data.VIPAuthType = eventrecorder.VIPAuthTypePush
-				}
-			case eventmon.AuthTypeTOTP:
-				data.AuthType = eventrecorder.AuthTypeTOTP
-			case eventmon.AuthTypeU2F:
-				data.AuthType = eventrecorder.AuthTypeU2F
+		case event := <-monitor.EventChannel:
+			sinkEvent, err := sinks.NewEvent(event, time.Now())
+			if err != nil {
+				logger.Println(err)
+				break
+			}
+			select {
+			case recordQueue <- sinkEvent:
 			default:
-				continue
+				logger.Printf("Record queue full, waiting to queue event %s\n",
+					sinkEvent.ID)
+				recordQueue <- sinkEvent
 			}
-			recorder.AuthChannel <- data
-		case spLogin := <-monitor.ServiceProviderLoginChannel:
-			data := &eventrecorder.SPLoginInfo{
-				URL:      spLogin.URL,
-				Username: spLogin.Username,
+			eventSinks.Send(sinkEvent)
+			for _, alert := range alertEngine.Process(sinkEvent) {
+				eventSinks.Send(alert.SinkEvent())
 			}
-			recorder.ServiceProviderLoginChannel <- data
 		case cert := <-monitor.SshCertChannel:
-			recorder.SshCertChannel <- cert
 			configuration.SshCertParametersCommand.processSshCert(cert)
 		case cert := <-monitor.SshRawCertChannel:
 			processRawCert(configuration.SshCertRawCommand, cert)
-		case username := <-monitor.WebLoginChannel:
-			recorder.WebLoginChannel <- username
 		case cert := <-monitor.X509CertChannel:
-			recorder.X509CertChannel <- cert
 			configuration.X509CertParametersCommand.processX509Cert(cert)
 		case cert := <-monitor.X509RawCertChannel:
 			processRawCert(configuration.X509CertRawCommand, cert)
 		}
 	}
 }
+
+// learnHistory feeds the stored events to the alert rules, oldest first, so
+// that a restart does not forget which users and user agents were seen.
+func learnHistory(alertEngine *alerts.Engine,
+	recorder *eventrecorder.EventRecorder) error {
+	events, err := recorder.Query(eventrecorder.Query{
+		Start: time.Now().Add(-recorder.Retention()),
+	})
+	if err != nil {
+		return err
+	}
+	for index := len(events) - 1; index >= 0; index-- {
+		alertEngine.Learn(events[index])
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/Cloud-Foundations/keymaster/lib/constants"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultSocketMode = 0660
+
+type configurationType struct {
+	// Either unix:///path/to/socket or tcp://host:port. TCP listeners always
+	// use mutual TLS.
+	Listen           string    `yaml:"listen"`
+	SocketMode       string    `yaml:"socket_mode"` // Octal, default 0660.
+	TLSCertFilename  string    `yaml:"tls_cert_filename"`
+	TLSKeyFilename   string    `yaml:"tls_key_filename"`
+	ClientCAFilename string    `yaml:"client_ca_filename"`
+	AllowedClients   []string  `yaml:"allowed_clients"`
+	RateLimit        float64   `yaml:"rate_limit"` // Signatures per second.
+	RateLimitBurst   int       `yaml:"rate_limit_burst"`
+	AuditLogFilename string    `yaml:"audit_log_filename"`
+	Key              keyConfig `yaml:"key"`
+	listenURL        *url.URL
+	socketMode       os.FileMode
+}
+
+type keyConfig struct {
+	Type     string `yaml:"type"` // file|yubipiv|AWS|pkcs11
+	Location string `yaml:"location"`
+	// Only for PGP encrypted key files.
+	PassphraseFilename string `yaml:"passphrase_filename"`
+}
+
+func loadConfig(filename string) (*configurationType, error) {
+	rawConfig, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(rawConfig)
+}
+
+func parseConfig(rawConfig []byte) (*configurationType, error) {
+	config := &configurationType{
+		Listen: constants.DefaultKeymasterSignerdListen,
+	}
+	if err := yaml.Unmarshal(rawConfig, config); err != nil {
+		return nil, err
+	}
+	listenURL, err := url.Parse(config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %s", err)
+	}
+	switch listenURL.Scheme {
+	case "unix":
+		if listenURL.Path == "" {
+			return nil, errors.New("missing socket path")
+		}
+		config.socketMode = defaultSocketMode
+		if config.SocketMode != "" {
+			mode, err := strconv.ParseUint(config.SocketMode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid socket_mode: %s", err)
+			}
+			config.socketMode = os.FileMode(mode)
+		}
+	case "tcp":
+		if listenURL.Host == "" {
+			return nil, errors.New("missing listen address")
+		}
+		if config.TLSCertFilename == "" || config.TLSKeyFilename == "" ||
+			config.ClientCAFilename == "" {
+			return nil, errors.New("tcp listeners require tls_cert_filename, tls_key_filename and client_ca_filename")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported listen scheme: %s",
+			listenURL.Scheme)
+	}
+	config.listenURL = listenURL
+	if config.RateLimit < 0 {
+		return nil, errors.New("rate_limit cannot be negative")
+	}
+	if config.Key.Type == "" || config.Key.Location == "" {
+		return nil, errors.New("key type and location are required")
+	}
+	return config, nil
+}
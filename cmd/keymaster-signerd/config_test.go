@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := parseConfig([]byte(`
+key:
+  type: file
+  location: /etc/keymaster-signerd/ca.key
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.listenURL.Path != "/run/keymaster-signerd/signer.sock" {
+		t.Fatalf("unexpected default listen path: %s", config.listenURL.Path)
+	}
+	if config.socketMode != 0660 {
+		t.Fatalf("unexpected socket mode: %o", config.socketMode)
+	}
+	config, err = parseConfig([]byte(`
+listen: "unix:///tmp/signer.sock"
+socket_mode: "0600"
+key:
+  type: file
+  location: /etc/keymaster-signerd/ca.key
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.socketMode != os.FileMode(0600) {
+		t.Fatalf("unexpected socket mode: %o", config.socketMode)
+	}
+	_, err = parseConfig([]byte(`
+listen: "tcp://:6930"
+tls_cert_filename: /etc/keymaster-signerd/server.pem
+tls_key_filename: /etc/keymaster-signerd/server.key
+client_ca_filename: /etc/keymaster-signerd/clients.pem
+allowed_clients: ["keymasterd"]
+rate_limit: 20
+rate_limit_burst: 40
+key:
+  type: pkcs11
+  location: "pkcs11:token=keymaster;object=ca?module-path=/usr/lib/softhsm/libsofthsm2.so"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badConfigs := []string{
+		// No key.
+		`listen: "unix:///tmp/signer.sock"`,
+		// TCP without mutual TLS.
+		`
+listen: "tcp://:6930"
+key: {type: file, location: /tmp/ca.key}
+`,
+		`
+listen: "http://:6930"
+key: {type: file, location: /tmp/ca.key}
+`,
+		`
+socket_mode: "rw"
+key: {type: file, location: /tmp/ca.key}
+`,
+		`
+rate_limit: -1
+key: {type: file, location: /tmp/ca.key}
+`,
+	}
+	for _, rawConfig := range badConfigs {
+		if _, err := parseConfig([]byte(rawConfig)); err == nil {
+			t.Errorf("config should have failed: %s", rawConfig)
+		}
+	}
+}
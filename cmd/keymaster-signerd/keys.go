@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+	"github.com/Cloud-Foundations/keymaster/lib/signers/kmssigner"
+	"github.com/Cloud-Foundations/keymaster/lib/signers/pkcs11signer"
+	"github.com/Cloud-Foundations/keymaster/lib/signers/yksigner"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+var pgpMessageHeader = []byte("-----BEGIN PGP MESSAGE-----")
+
+// loadFileSigner reads a PEM private key. Keys sealed with keymaster-tool
+// (PGP armored) are decrypted with the passphrase in passphraseFilename.
+func loadFileSigner(filename string, passphraseFilename string) (
+	crypto.Signer, error) {
+	keyData, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(keyData, pgpMessageHeader) {
+		if passphraseFilename == "" {
+			return nil, errors.New(
+				"passphrase_filename is required for encrypted keys")
+		}
+		passphrase, err := os.ReadFile(passphraseFilename)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(passphrase, "\r\n")
+		keyData, err = cryptoutils.PGPDecryptArmoredBytes(keyData, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt key: %s", err)
+		}
+	}
+	return certgen.GetSignerFromPEMBytes(keyData)
+}
+
+func loadSigner(config keyConfig, logger log.DebugLogger) (
+	crypto.Signer, error) {
+	switch config.Type {
+	case "file":
+		return loadFileSigner(config.Location, config.PassphraseFilename)
+	case "yubipiv":
+		serial, pin, publicKey, err := yksigner.ParseYubiPIVURL(
+			config.Location)
+		if err != nil {
+			return nil, err
+		}
+		return yksigner.NewYkPivSigner(serial, pin, publicKey)
+	case "AWS":
+		ctx := context.Background()
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return kmssigner.NewKmsSigner(cfg, ctx, config.Location)
+	case "pkcs11":
+		p11Config, err := pkcs11signer.ParsePKCS11URI(config.Location)
+		if err != nil {
+			return nil, err
+		}
+		return pkcs11signer.NewPkcs11Signer(*p11Config, logger)
+	default:
+		return nil, fmt.Errorf("invalid key type: %s", config.Type)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+func TestLoadFileSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+		Bytes: der})
+	dir := t.TempDir()
+	plainFilename := filepath.Join(dir, "plain.key")
+	if err := os.WriteFile(plainFilename, pemKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := loadSigner(keyConfig{Type: "file",
+		Location: plainFilename}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(signer.Public()) {
+		t.Fatal("public key mismatch")
+	}
+	sealedKey, err := cryptoutils.PGPArmorEncryptBytes(pemKey,
+		[]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedFilename := filepath.Join(dir, "sealed.key")
+	if err := os.WriteFile(sealedFilename, sealedKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	passphraseFilename := filepath.Join(dir, "passphrase")
+	err = os.WriteFile(passphraseFilename, []byte("passphrase\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFileSigner(sealedFilename, ""); err == nil {
+		t.Fatal("sealed key without passphrase should have failed")
+	}
+	signer, err = loadFileSigner(sealedFilename, passphraseFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(signer.Public()) {
+		t.Fatal("public key mismatch")
+	}
+	if _, err := loadSigner(keyConfig{Type: "floppy",
+		Location: plainFilename}, testlogger.New(t)); err == nil {
+		t.Fatal("unknown key type should have failed")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/serverlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/constants"
+	"github.com/Cloud-Foundations/keymaster/lib/signers/remotesigner"
+)
+
+var (
+	configFile = flag.String("configFile",
+		constants.DefaultKeymasterSignerdConfigFile, "Configuration file")
+)
+
+func newListener(config *configurationType) (net.Listener, error) {
+	if config.listenURL.Scheme == "unix" {
+		socketPath := config.listenURL.Path
+		// Remove a stale socket from a previous run, but nothing else.
+		if fi, err := os.Lstat(socketPath); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(socketPath)
+		}
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(socketPath, config.socketMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFilename,
+		config.TLSKeyFilename)
+	if err != nil {
+		return nil, err
+	}
+	caData, err := os.ReadFile(config.ClientCAFilename)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in %s",
+			config.ClientCAFilename)
+	}
+	return tls.Listen("tcp", config.listenURL.Host, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+func main() {
+	flag.Parse()
+	logger := serverlogger.NewWithFlags("", log.LstdFlags|log.Lmicroseconds)
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		logger.Fatalf("Cannot load configuration: %s\n", err)
+	}
+	signer, err := loadSigner(config.Key, logger)
+	if err != nil {
+		logger.Fatalf("Cannot load signing key: %s\n", err)
+	}
+	var auditLog io.Writer
+	if config.AuditLogFilename != "" {
+		auditFile, err := os.OpenFile(config.AuditLogFilename,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			logger.Fatalf("Cannot open audit log: %s\n", err)
+		}
+		defer auditFile.Close()
+		auditLog = auditFile
+	}
+	handler, err := remotesigner.NewHandler(signer, remotesigner.HandlerConfig{
+		RateLimit:      config.RateLimit,
+		Burst:          config.RateLimitBurst,
+		AllowedClients: config.AllowedClients,
+		AuditLog:       auditLog,
+	}, logger)
+	if err != nil {
+		logger.Fatalf("Cannot create handler: %s\n", err)
+	}
+	listener, err := newListener(config)
+	if err != nil {
+		logger.Fatalf("Cannot listen on %s: %s\n", config.Listen, err)
+	}
+	logger.Printf("serving signer on %s\n", config.Listen)
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := server.Serve(listener); err != nil {
+		logger.Fatalf("Serve failed: %s\n", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/archive"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/encryptedstore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/encryptedstore/kmswrapper"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/memstore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/sqlstore"
+)
+
+type StoreFlags struct {
+	StorageUrl     string `help:"Storage URL of the profile DB" default:"sqlite:"`
+	DataDirectory  string `help:"Directory of the SQLite DB for sqlite: URLs without a filename" default:"/var/lib/keymaster"`
+	RaftConfig     string `help:"YAML file with the raft configuration (peers and TLS files) for raft: URLs"`
+	AwsKmsKeyId    string `help:"AWS KMS key of the profile encryption, to read and write encrypted profiles"`
+	CaKeyFilename  string `help:"CA key of keymasterd (PEM or armored), to read and write profiles encrypted with the key derived from it"`
+	CaKeySecretARN string `help:"location of the secret with the passphrase of an armored --ca-key-filename, otherwise it is asked for"`
+}
+
+type BackupCmd struct {
+	StoreFlags
+	SigningKey  string `help:"Encrypted private key made by generate-key to sign the archive with" required:""`
+	NoEncrypt   bool   `help:"Do not encrypt the archive with the passphrase of the signing key"`
+	OutFilename string `help:"File to write the archive to" required:""`
+}
+
+type RestoreCmd struct {
+	StoreFlags
+	PublicKey  string `help:"PEM public key of the signing key, as printed by print-public --print-format=pem" required:""`
+	InFilename string `help:"Archive to restore" required:""`
+	DryRun     bool   `help:"Print the differences between the archive and the DB without changing it"`
+}
+
+// loadCAKeyWrapper returns the KeyWrapper derived from the CA key of
+// keymasterd, as it does when profiles are encrypted with the CA.
+func loadCAKeyWrapper(flags StoreFlags, awsRegion string) (
+	encryptedstore.KeyWrapper, error) {
+	keyData, err := os.ReadFile(flags.CaKeyFilename)
+	if err != nil {
+		return nil, err
+	}
+	var signer crypto.Signer
+	if block, _ := pem.Decode(keyData); block != nil {
+		signer, err = certgen.GetSignerFromPEMBytes(keyData)
+	} else {
+		var passPhrase []byte
+		passPhrase, err = getPassPhrase(flags.CaKeySecretARN, awsRegion)
+		if err != nil {
+			return nil, err
+		}
+		signer, err = decryptDecodeArmoredPrivateKey(keyData, passPhrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA key: %s: %s",
+			flags.CaKeyFilename, err)
+	}
+	return encryptedstore.NewSignerKeyWrapper(signer)
+}
+
+// getKeyWrappers returns the KeyWrappers of the profile encryption. As in
+// keymasterd, new data keys are wrapped with the KMS key if there is one.
+func getKeyWrappers(flags StoreFlags, awsRegion string) (
+	[]encryptedstore.KeyWrapper, error) {
+	var wrappers []encryptedstore.KeyWrapper
+	if flags.AwsKmsKeyId != "" {
+		cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		wrappers = append(wrappers, kmswrapper.New(cfg, flags.AwsKmsKeyId))
+	}
+	if flags.CaKeyFilename != "" {
+		wrapper, err := loadCAKeyWrapper(flags, awsRegion)
+		if err != nil {
+			return nil, err
+		}
+		wrappers = append(wrappers, wrapper)
+	}
+	return wrappers, nil
+}
+
+// hasEncryptedProfiles reports whether any profile in store is encrypted.
+func hasEncryptedProfiles(store profilestore.ProfileStore) (bool, error) {
+	users, _, err := store.GetUsers()
+	if err != nil {
+		return false, err
+	}
+	for _, username := range users {
+		data, ok, _, err := store.LoadProfile(username)
+		if err != nil {
+			return false, err
+		}
+		if ok && encryptedstore.IsEncrypted(data) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// openProfileStore opens the store with the profiles encrypted and decrypted
+// with the KMS key or the CA key if given. Otherwise encrypted profiles
+// cannot be read, and the store can only be opened writable if it has no
+// encrypted profiles: the profiles would be written unencrypted. A store
+// which is not writable is opened read-only: the DB is not migrated and
+// profiles are not re-encrypted when they are loaded.
+func openProfileStore(flags StoreFlags, awsRegion string, writable bool,
+	logger log.DebugLogger) (profilestore.ProfileStore, error) {
+	wrappers, err := getKeyWrappers(flags, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openStore(flags.StorageUrl, flags.DataDirectory,
+		flags.RaftConfig, !writable, logger)
+	if err != nil {
+		return nil, err
+	}
+	if !writable {
+		encryptedStore := encryptedstore.NewReadOnly(store, logger)
+		if len(wrappers) > 0 {
+			encryptedStore.SetKeyWrapper(wrappers[0], wrappers[1:]...)
+		}
+		return encryptedStore, nil
+	}
+	if len(wrappers) > 0 {
+		encryptedStore := encryptedstore.New(store, logger)
+		encryptedStore.SetKeyWrapper(wrappers[0], wrappers[1:]...)
+		return encryptedStore, nil
+	}
+	if encrypted, err := hasEncryptedProfiles(store); err != nil {
+		store.Close()
+		return nil, err
+	} else if encrypted {
+		store.Close()
+		return nil, errors.New(
+			"DB has encrypted profiles: --aws-kms-key-id or --ca-key-filename required")
+	}
+	return store, nil
+}
+
+func readPublicKey(filename string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no PEM public key in: %s", filename)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func writeChanges(writer io.Writer, changes []archive.Change) error {
+	for _, change := range changes {
+		_, err := fmt.Fprintf(writer, "%s %s: %s\n", change.Action,
+			change.Kind, change.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func backup(store profilestore.ProfileStore, signer crypto.Signer,
+	passphrase []byte, outFilename string) (*archive.Archive, error) {
+	data, err := archive.Export(store)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(outFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := archive.Write(file, data, signer, passphrase); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return data, file.Close()
+}
+
+func (cmd *BackupCmd) Run(globals *Globals) error {
+	logger := globals.Logger
+	cipherText, err := os.ReadFile(cmd.SigningKey)
+	if err != nil {
+		return err
+	}
+	passPhrase, err := getPassPhrase(globals.SecretARN, globals.AwsRegion)
+	if err != nil {
+		return err
+	}
+	signer, err := decryptDecodeArmoredPrivateKey(cipherText, passPhrase)
+	if err != nil {
+		return err
+	}
+	if cmd.NoEncrypt {
+		passPhrase = nil
+	}
+	store, err := openProfileStore(cmd.StoreFlags, globals.AwsRegion, false,
+		logger)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	data, err := backup(store, signer, passPhrase, cmd.OutFilename)
+	if err != nil {
+		return err
+	}
+	logger.Printf("backed up %d profiles and %d signed data\n",
+		len(data.Users), len(data.SignedData))
+	return nil
+}
+
+func (cmd *RestoreCmd) Run(globals *Globals) error {
+	logger := globals.Logger
+	publicKey, err := readPublicKey(cmd.PublicKey)
+	if err != nil {
+		return err
+	}
+	archiveData, err := os.ReadFile(cmd.InFilename)
+	if err != nil {
+		return err
+	}
+	var passPhrase []byte
+	if archive.IsEncrypted(archiveData) {
+		passPhrase, err = getPassPhrase(globals.SecretARN, globals.AwsRegion)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := archive.Read(archiveData, publicKey, passPhrase)
+	if err != nil {
+		return err
+	}
+	logger.Printf("verified archive created at %s\n", data.CreatedAt)
+	store, err := openProfileStore(cmd.StoreFlags, globals.AwsRegion,
+		!cmd.DryRun, logger)
+	if cmd.DryRun && err == sqlstore.ErrNoSchema {
+		// A new DB is compared as empty rather than created.
+		store, err = memstore.New(), nil
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if cmd.DryRun {
+		changes, err := archive.Diff(data, store)
+		if err != nil {
+			return err
+		}
+		return writeChanges(os.Stdout, changes)
+	}
+	numProfiles, numSigned, err := archive.Restore(data, store)
+	if err != nil {
+		return fmt.Errorf("restored %d profiles and %d signed data: %s",
+			numProfiles, numSigned, err)
+	}
+	logger.Printf("restored %d profiles and %d signed data\n", numProfiles,
+		numSigned)
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/archive"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/encryptedstore"
+)
+
+// makeTestArchive writes an unencrypted archive with the profile of user1
+// to dir. It returns the filenames of the public key and of the archive, and
+// the profile.
+func makeTestArchive(t *testing.T, dir string) (string, string, []byte) {
+	logger := testlogger.New(t)
+	passPhrase := []byte("passphrase")
+	var keyBuffer bytes.Buffer
+	publicKey, err := generateNewKeyPair(passPhrase, "ed25519", &keyBuffer,
+		logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := decryptDecodeArmoredPrivateKey(keyBuffer.Bytes(),
+		passPhrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyFilename := filepath.Join(dir, "public.pem")
+	publicKeyFile, err := os.Create(publicKeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serializePublic(publicKey, "pem", publicKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	publicKeyFile.Close()
+	fromFlags := StoreFlags{
+		StorageUrl:    "sqlite:" + filepath.Join(dir, "from.sqlite3"),
+		DataDirectory: dir,
+	}
+	source, err := openProfileStore(fromFlags, "", true, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	profileData, err := (&archive.Profile{Username: "user1"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SaveProfile("user1", profileData); err != nil {
+		t.Fatal(err)
+	}
+	archiveFilename := filepath.Join(dir, "backup.json")
+	if _, err := backup(source, signer, nil, archiveFilename); err != nil {
+		t.Fatal(err)
+	}
+	return publicKeyFilename, archiveFilename, profileData
+}
+
+// makeTestCAKey writes a PEM CA key to dir and returns its filename.
+func makeTestCAKey(t *testing.T, dir string) string {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKeyDer, err := x509.MarshalPKCS8PrivateKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKeyFilename := filepath.Join(dir, "ca.key")
+	err = os.WriteFile(caKeyFilename,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: caKeyDer}),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caKeyFilename
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	logger := testlogger.New(t)
+	publicKeyFilename, archiveFilename, profileData := makeTestArchive(t, dir)
+	cmd := RestoreCmd{
+		StoreFlags: StoreFlags{
+			StorageUrl:    "sqlite:" + filepath.Join(dir, "to.sqlite3"),
+			DataDirectory: dir,
+		},
+		PublicKey:  publicKeyFilename,
+		InFilename: archiveFilename,
+		DryRun:     true,
+	}
+	globals := &Globals{Logger: logger}
+	if err := cmd.Run(globals); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "to.sqlite3")); err == nil {
+		t.Fatal("dry run created the DB")
+	}
+	cmd.DryRun = false
+	if err := cmd.Run(globals); err != nil {
+		t.Fatal(err)
+	}
+	destination, err := openProfileStore(cmd.StoreFlags, "", false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.Close()
+	data, ok, _, err := destination.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !bytes.Equal(data, profileData) {
+		t.Fatal("profile not restored")
+	}
+}
+
+func TestRestoreEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	logger := testlogger.New(t)
+	publicKeyFilename, archiveFilename, profileData := makeTestArchive(t, dir)
+	storeFlags := StoreFlags{
+		StorageUrl:    "sqlite:" + filepath.Join(dir, "to.sqlite3"),
+		DataDirectory: dir,
+		CaKeyFilename: makeTestCAKey(t, dir),
+	}
+	destination, err := openProfileStore(storeFlags, "", true, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := destination.SaveProfile("user2", profileData); err != nil {
+		t.Fatal(err)
+	}
+	destination.Close()
+	cmd := RestoreCmd{
+		StoreFlags: StoreFlags{
+			StorageUrl:    storeFlags.StorageUrl,
+			DataDirectory: dir,
+		},
+		PublicKey:  publicKeyFilename,
+		InFilename: archiveFilename,
+	}
+	globals := &Globals{Logger: logger}
+	if err := cmd.Run(globals); err == nil {
+		t.Fatal("restored unencrypted profiles into an encrypted DB")
+	}
+	cmd.StoreFlags = storeFlags
+	if err := cmd.Run(globals); err != nil {
+		t.Fatal(err)
+	}
+	plainStore, err := openStore(storeFlags.StorageUrl, dir, "", false,
+		logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainStore.Close()
+	data, ok, _, err := plainStore.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !encryptedstore.IsEncrypted(data) {
+		t.Fatal("profile not restored encrypted")
+	}
+	destination, err = openProfileStore(storeFlags, "", false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.Close()
+	data, ok, _, err = destination.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !bytes.Equal(data, profileData) {
+		t.Fatal("profile not restored")
+	}
+}
+
+func TestBackupDryRunReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	logger := testlogger.New(t)
+	publicKeyFilename, archiveFilename, profileData := makeTestArchive(t, dir)
+	dbFilename := filepath.Join(dir, "db.sqlite3")
+	storeFlags := StoreFlags{
+		StorageUrl:    "sqlite:" + dbFilename,
+		DataDirectory: dir,
+		CaKeyFilename: makeTestCAKey(t, dir),
+	}
+	plainStore, err := openStore(storeFlags.StorageUrl, dir, "", false,
+		logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Loading the unencrypted profile with a KeyWrapper would re-encrypt it.
+	if err := plainStore.SaveProfile("user2", profileData); err != nil {
+		t.Fatal(err)
+	}
+	plainStore.Close()
+	dbData, err := os.ReadFile(dbFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openProfileStore(storeFlags, "", false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := backup(store, signer, nil, filepath.Join(dir, "db.json"))
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Users) != 1 {
+		t.Fatalf("backed up %d profiles", len(data.Users))
+	}
+	if newData, err := os.ReadFile(dbFilename); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(newData, dbData) {
+		t.Fatal("backup changed the DB")
+	}
+	cmd := RestoreCmd{
+		StoreFlags: storeFlags,
+		PublicKey:  publicKeyFilename,
+		InFilename: archiveFilename,
+		DryRun:     true,
+	}
+	if err := cmd.Run(&Globals{Logger: logger}); err != nil {
+		t.Fatal(err)
+	}
+	if newData, err := os.ReadFile(dbFilename); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(newData, dbData) {
+		t.Fatal("dry run changed the DB")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/sqlstore"
+)
+
+type DBCmd struct {
+	Migrate DBMigrateCmd `cmd:"" help:"Apply the pending schema migrations to the profile DB"`
+	Status  DBStatusCmd  `cmd:"" help:"Print the schema migrations and whether they are applied"`
+}
+
+type DBFlags struct {
+	StorageUrl    string `help:"Storage URL of the profile DB (sqlite: or postgresql:)" default:"sqlite:"`
+	DataDirectory string `help:"Directory of the SQLite DB for sqlite: URLs without a filename" default:"/var/lib/keymaster"`
+}
+
+func (flags DBFlags) config() sqlstore.Config {
+	return sqlstore.Config{
+		StorageUrl:    flags.StorageUrl,
+		DataDirectory: flags.DataDirectory,
+	}
+}
+
+type DBMigrateCmd struct {
+	DBFlags
+}
+
+type DBStatusCmd struct {
+	DBFlags
+}
+
+func (cmd *DBMigrateCmd) Run(globals *Globals) error {
+	numApplied, err := sqlstore.Migrate(cmd.config(), globals.Logger)
+	if err != nil {
+		return err
+	}
+	globals.Logger.Printf("applied %d migrations\n", numApplied)
+	return nil
+}
+
+func (cmd *DBStatusCmd) Run(globals *Globals) error {
+	statuses, err := sqlstore.GetMigrationStatus(cmd.config())
+	if err != nil {
+		return err
+	}
+	return writeMigrationStatus(os.Stdout, statuses)
+}
+
+func writeMigrationStatus(writer io.Writer,
+	statuses []sqlstore.MigrationStatus) error {
+	tw := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, status := range statuses {
+		applied := "pending"
+		if !status.AppliedAt.IsZero() {
+			applied = status.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		description := status.Description
+		if status.Unknown {
+			description += " (unknown to this version)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", status.Version, applied, description)
+	}
+	return tw.Flush()
+}
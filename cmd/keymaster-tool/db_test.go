@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/sqlstore"
+)
+
+func getStatusOutput(t *testing.T, flags DBFlags) string {
+	statuses, err := sqlstore.GetMigrationStatus(flags.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := &bytes.Buffer{}
+	if err := writeMigrationStatus(buffer, statuses); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.String()
+}
+
+func TestDBMigrate(t *testing.T) {
+	flags := DBFlags{StorageUrl: "sqlite:", DataDirectory: t.TempDir()}
+	if output := getStatusOutput(t, flags); !strings.Contains(output,
+		"pending") {
+		t.Fatalf("no pending migrations in: %s", output)
+	}
+	cmd := DBMigrateCmd{DBFlags: flags}
+	if err := cmd.Run(&Globals{Logger: testlogger.New(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if output := getStatusOutput(t, flags); strings.Contains(output,
+		"pending") {
+		t.Fatalf("pending migrations after migrating: %s", output)
+	}
+}
@@ -17,8 +17,13 @@ type Globals struct {
 type CLI struct {
 	Globals
 
-	GenerateKey GenerateCmd    `cmd:"" help:"Genereate a new encrypted keypair to stdout"`
-	PrintPublic PrintPublicCmd `cmd:"" help:"Print public key from encrypted file"`
+	Backup          BackupCmd          `cmd:"" help:"Write a signed archive of the profiles and signed data"`
+	DB              DBCmd              `cmd:"" name:"db" help:"Manage the schema of the profile DB"`
+	GenerateKey     GenerateCmd        `cmd:"" help:"Genereate a new encrypted keypair to stdout"`
+	MigrateStorage  MigrateStorageCmd  `cmd:"" help:"Copy the profiles and signed data between storage backends"`
+	PrintPublic     PrintPublicCmd     `cmd:"" help:"Print public key from encrypted file"`
+	Restore         RestoreCmd         `cmd:"" help:"Restore the profiles and signed data from a signed archive"`
+	SplitPassphrase SplitPassphraseCmd `cmd:"" help:"Split a passphrase into PGP encrypted shares for custodians"`
 }
 
 func main() {
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/raftstore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/sqlstore"
+)
+
+type MigrateStorageCmd struct {
+	From          string `help:"Storage URL to copy from" required:""`
+	To            string `help:"Storage URL to copy to" required:""`
+	DataDirectory string `help:"Directory of the SQLite DB for sqlite: URLs without a filename" default:"/var/lib/keymaster"`
+	RaftConfig    string `help:"YAML file with the raft configuration (peers and TLS files) for raft: URLs"`
+}
+
+// openStore opens the store for a storage URL, as used by keymasterd. For
+// "raft:" the store is reached through one of the peers. A read-only SQL DB
+// is not migrated, and writes to it fail.
+func openStore(storageURL, dataDirectory, raftConfigFilename string,
+	readOnly bool, logger log.DebugLogger) (profilestore.ProfileStore, error) {
+	if storageURL != "raft:" {
+		if strings.HasPrefix(storageURL, "raft:") {
+			return nil, errors.New("raft storage URL must be \"raft:\"")
+		}
+		return sqlstore.New(sqlstore.Config{
+			StorageUrl:    storageURL,
+			DataDirectory: dataDirectory,
+			ReadOnly:      readOnly,
+		}, logger)
+	}
+	if raftConfigFilename == "" {
+		return nil, errors.New("raft-config required for raft storage")
+	}
+	data, err := os.ReadFile(raftConfigFilename)
+	if err != nil {
+		return nil, err
+	}
+	var config raftstore.Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	return raftstore.NewClient(config, logger)
+}
+
+func (cmd *MigrateStorageCmd) Run(globals *Globals) error {
+	logger := globals.Logger
+	if cmd.From == cmd.To {
+		return errors.New("source and destination are the same")
+	}
+	source, err := openStore(cmd.From, cmd.DataDirectory, cmd.RaftConfig,
+		false, logger)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := openStore(cmd.To, cmd.DataDirectory, cmd.RaftConfig,
+		false, logger)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+	numProfiles, numSigned, err := profilestore.Copy(source, destination)
+	if err != nil {
+		return err
+	}
+	logger.Printf("copied %d profiles and %d signed data\n", numProfiles,
+		numSigned)
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func TestMigrateStorage(t *testing.T) {
+	dir := t.TempDir()
+	from := "sqlite:" + filepath.Join(dir, "from.sqlite3")
+	to := "sqlite:" + filepath.Join(dir, "to.sqlite3")
+	logger := testlogger.New(t)
+	source, err := openStore(from, dir, "", false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SaveProfile("user1", []byte("profile1")); err != nil {
+		t.Fatal(err)
+	}
+	source.Close()
+	cmd := MigrateStorageCmd{From: from, To: to, DataDirectory: dir}
+	if err := cmd.Run(&Globals{Logger: logger}); err != nil {
+		t.Fatal(err)
+	}
+	destination, err := openStore(to, dir, "", false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.Close()
+	data, ok, _, err := destination.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(data) != "profile1" {
+		t.Fatalf("profile not copied: %v %q", ok, data)
+	}
+}
+
+func TestMigrateStorageRaftRequiresConfig(t *testing.T) {
+	_, err := openStore("raft:", t.TempDir(), "", false,
+		testlogger.New(t))
+	if err == nil {
+		t.Fatal("opened raft storage without a configuration")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+// /
+type SplitPassphraseCmd struct {
+	Threshold     int      `help:"Number of shares needed to unseal" required:""`
+	RecipientKeys []string `name:"recipient-key" help:"Armored PGP public key file of a custodian, one per share" required:""`
+	OutDirectory  string   `help:"Directory to write the encrypted shares to" default:"."`
+}
+
+func recipientName(armoredKeyRing []byte) string {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armoredKeyRing))
+	if err != nil || len(entities) < 1 {
+		return "unknown"
+	}
+	for name := range entities[0].Identities {
+		return name
+	}
+	return fmt.Sprintf("%X", entities[0].PrimaryKey.Fingerprint)
+}
+
+// splitPassphrase splits passPhrase into one share per recipient key and
+// returns each share encrypted to its recipient.
+func splitPassphrase(passPhrase []byte, threshold int,
+	recipientKeys [][]byte, logger log.DebugLogger) ([][]byte, error) {
+	shares, err := cryptoutils.SplitSecretToUnsealShares(passPhrase,
+		len(recipientKeys), threshold)
+	if err != nil {
+		return nil, err
+	}
+	encryptedShares := make([][]byte, 0, len(shares))
+	for index, share := range shares {
+		encryptedShare, err := cryptoutils.PGPArmorEncryptBytesToKeys(
+			[]byte(share.String()+"\n"), recipientKeys[index])
+		if err != nil {
+			return nil, fmt.Errorf("share %d: %s", index+1, err)
+		}
+		logger.Debugf(0, "share %d encrypted to %s\n", index+1,
+			recipientName(recipientKeys[index]))
+		encryptedShares = append(encryptedShares, encryptedShare)
+	}
+	return encryptedShares, nil
+}
+
+func (cmd *SplitPassphraseCmd) Run(globals *Globals) error {
+	logger := globals.Logger
+	var recipientKeys [][]byte
+	for _, filename := range cmd.RecipientKeys {
+		inFile, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		armoredKey, err := io.ReadAll(inFile)
+		inFile.Close()
+		if err != nil {
+			return err
+		}
+		recipientKeys = append(recipientKeys, armoredKey)
+	}
+	passPhrase, err := getPassPhrase(globals.SecretARN, globals.AwsRegion)
+	if err != nil {
+		return err
+	}
+	encryptedShares, err := splitPassphrase(passPhrase, cmd.Threshold,
+		recipientKeys, logger)
+	if err != nil {
+		return err
+	}
+	for index, encryptedShare := range encryptedShares {
+		filename := filepath.Join(cmd.OutDirectory,
+			fmt.Sprintf("share-%02d.asc", index+1))
+		if err := os.WriteFile(filename, encryptedShare, 0644); err != nil {
+			return err
+		}
+		logger.Printf("wrote %s for %s\n", filename,
+			recipientName(recipientKeys[index]))
+	}
+	return nil
+}
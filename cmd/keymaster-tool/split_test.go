@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+func newTestCustodian(t *testing.T, name string) (*openpgp.Entity, []byte) {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys without hash preferences default to the unavailable RIPEMD160.
+	for id, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		err := identity.SelfSignature.SignUserId(id, entity.PrimaryKey,
+			entity.PrivateKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var publicKeyBuffer bytes.Buffer
+	armoredWriter, err := armor.Encode(&publicKeyBuffer, openpgp.PublicKeyType,
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(armoredWriter); err != nil {
+		t.Fatal(err)
+	}
+	armoredWriter.Close()
+	return entity, publicKeyBuffer.Bytes()
+}
+
+func decryptTestShare(t *testing.T, entity *openpgp.Entity,
+	encryptedShare []byte) *cryptoutils.UnsealShare {
+	armorBlock, err := armor.Decode(bytes.NewReader(encryptedShare))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(armorBlock.Body,
+		openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := cryptoutils.ParseUnsealShare(string(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return share
+}
+
+func TestSplitPassphraseRoundTrip(t *testing.T) {
+	passPhrase := []byte("1234")
+	var custodians []*openpgp.Entity
+	var recipientKeys [][]byte
+	for _, name := range []string{"alice", "bob", "carol"} {
+		entity, publicKey := newTestCustodian(t, name)
+		custodians = append(custodians, entity)
+		recipientKeys = append(recipientKeys, publicKey)
+	}
+	encryptedShares, err := splitPassphrase(passPhrase, 2, recipientKeys,
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encryptedShares) != 3 {
+		t.Fatalf("got %d shares", len(encryptedShares))
+	}
+	first := decryptTestShare(t, custodians[0], encryptedShares[0])
+	third := decryptTestShare(t, custodians[2], encryptedShares[2])
+	if first.SplitID != third.SplitID || first.Threshold != 2 {
+		t.Fatalf("inconsistent shares %+v %+v", first, third)
+	}
+	recovered, err := cryptoutils.CombineUnsealShares(
+		[]cryptoutils.UnsealShare{*first, *third})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered, passPhrase) {
+		t.Fatal("roundtrip fail")
+	}
+	// Shares must only be readable by their own custodian.
+	armorBlock, err := armor.Decode(bytes.NewReader(encryptedShares[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openpgp.ReadMessage(armorBlock.Body,
+		openpgp.EntityList{custodians[0]}, nil, nil)
+	if err == nil {
+		t.Fatal("share decrypted with the wrong key")
+	}
+	if _, err := splitPassphrase(passPhrase, 4, recipientKeys,
+		testlogger.New(t)); err == nil {
+		t.Fatal("threshold above number of recipients should fail")
+	}
+}
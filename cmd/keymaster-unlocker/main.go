@@ -31,6 +31,8 @@ var (
 	keymasterPort = flag.Int("keymasterPort", 6920,
 		"The keymaster control port")
 	retryInterval = flag.Duration("retryInterval", 0, "If > 0: retry")
+	shareMode     = flag.Bool("share", false,
+		"Submit an unseal share (from keymaster-tool split-passphrase) instead of the password")
 )
 
 const maxPasswordLength = 512
@@ -42,7 +44,11 @@ func Usage() {
 
 func getPassword(password string) (string, error) {
 	if password == "" {
-		fmt.Printf("Password for unlocking %s: ", *keymasterHostname)
+		if *shareMode {
+			fmt.Printf("Unseal share for %s: ", *keymasterHostname)
+		} else {
+			fmt.Printf("Password for unlocking %s: ", *keymasterHostname)
+		}
 		passwd, err := term.ReadPassword(int(os.Stdin.Fd()))
 
 		// Add a newline after the password input
@@ -149,9 +155,14 @@ func unseal(addrs []string, clients []*http.Client, password string,
 		if err != nil {
 			logger.Fatal(err)
 		}
+		path := "/admin/inject"
+		values := url.Values{"ssh_ca_password": {password}}
+		if *shareMode {
+			path = "/admin/injectShare"
+			values = url.Values{"unseal_share": {password}}
+		}
 		resp, err := client.PostForm("https://"+*keymasterHostname+":"+
-			strconv.Itoa(*keymasterPort)+"/admin/inject",
-			url.Values{"ssh_ca_password": {password}})
+			strconv.Itoa(*keymasterPort)+path, values)
 		if err != nil {
 			logger.Printf("%s: %s\n", addrs[index], err)
 			continue
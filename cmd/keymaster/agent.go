@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/certagent"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/sshagent"
+)
+
+func getAgentSocketPath(homeDir string) string {
+	if *agentSocket != "" {
+		return *agentSocket
+	}
+	return certagent.DefaultSocketPath(homeDir, FilePrefix)
+}
+
+// getSSHAgentSocketPath puts the default SSH agent socket next to the one of
+// the certificate agent.
+func getSSHAgentSocketPath(homeDir string,
+	agentConfig config.SSHAgentConfig) string {
+	if agentConfig.SocketPath != "" {
+		return agentConfig.SocketPath
+	}
+	return filepath.Join(certagent.DefaultSocketDir(homeDir),
+		FilePrefix+"-ssh-agent.sock")
+}
+
+func writeFileAtomically(filename string, data []byte,
+	perm os.FileMode) error {
+	tmpFilename := filename + "~"
+	if err := os.WriteFile(tmpFilename, data, perm); err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilename)
+	return os.Rename(tmpFilename, filename)
+}
+
+// writeAgentCertificate stores a renewed certificate where the one-shot
+// mode would, so that tools reading the files keep working.
+func writeAgentCertificate(cert *certagent.Certificate,
+	userName string,
+	homeDir string,
+	configContents config.AppConfigFile,
+	sshAgent *sshagent.Agent,
+	logger log.DebugLogger) {
+	sshKeyPath := filepath.Join(homeDir, DefaultSSHKeysLocation, FilePrefix)
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	var err error
+	switch cert.Name {
+	case "ssh", "ssh-ed25519":
+		keySuffix := "-" + configContents.Base.PreferredKeyType
+		if cert.Name == "ssh-ed25519" {
+			keySuffix = "-ed25519"
+		}
+		if sshAgent != nil {
+			err = addCertificateToSSHAgent(sshAgent, cert,
+				FilePrefix+keySuffix, configContents)
+			break
+		}
+		_, err = insertSSHCertIntoAgentORWriteToFilesystem(cert.Data,
+			cert.Signer,
+			FilePrefix+keySuffix,
+			userName,
+			sshKeyPath+keySuffix,
+			configContents.Base.AgentConfirmUse,
+			logger)
+	case "x509":
+		err = writeFileAtomically(tlsKeyPath+".cert", cert.Data, 0644)
+	case "x509-kubernetes":
+		err = writeFileAtomically(tlsKeyPath+"-kubernetes.cert", cert.Data,
+			0644)
+	}
+	if err != nil {
+		logger.Printf("error writing %s certificate: %s", cert.Name, err)
+	}
+}
+
+func addCertificateToSSHAgent(sshAgent *sshagent.Agent,
+	cert *certagent.Certificate,
+	comment string,
+	configContents config.AppConfigFile) error {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(cert.Data)
+	if err != nil {
+		return err
+	}
+	sshCert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("It is not a certificate")
+	}
+	return sshAgent.AddCertificate(agent.AddedKey{
+		PrivateKey:  cert.Signer,
+		Certificate: sshCert,
+		Comment:     comment,
+	}, sshagent.KeyPolicy{AllowedHosts: configContents.SSHAgent.AllowedHosts})
+}
+
+// startSSHAgent serves the built-in SSH agent, if enabled.
+func startSSHAgent(homeDir string,
+	configContents config.AppConfigFile,
+	logger log.DebugLogger) (*sshagent.Agent, error) {
+	agentConfig := configContents.SSHAgent
+	if !agentConfig.Enabled {
+		return nil, nil
+	}
+	socketPath := getSSHAgentSocketPath(homeDir, agentConfig)
+	knownHostsFiles := agentConfig.KnownHostsFiles
+	if len(knownHostsFiles) < 1 {
+		knownHostsFiles = []string{
+			filepath.Join(homeDir, DefaultSSHKeysLocation, "known_hosts")}
+	}
+	params := sshagent.AgentParams{
+		KnownHostsFiles: knownHostsFiles,
+		Logger:          logger,
+	}
+	if agentConfig.ForwardUpstream {
+		upstreamSocket := os.Getenv("SSH_AUTH_SOCK")
+		if upstreamSocket == "" || upstreamSocket == socketPath {
+			return nil, errors.New(
+				"forward_upstream needs SSH_AUTH_SOCK of another agent")
+		}
+		conn, err := net.Dial("unix", upstreamSocket)
+		if err != nil {
+			return nil, err
+		}
+		conn.Close()
+		params.UpstreamSocket = upstreamSocket
+	}
+	listener, err := listenAgentSocket(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	sshAgent := sshagent.NewAgent(params)
+	go func() {
+		if err := sshAgent.Serve(listener); err != nil {
+			logger.Printf("ssh agent failed: %s", err)
+		}
+	}()
+	logger.Printf("ssh agent serving on %s, set SSH_AUTH_SOCK to use it",
+		socketPath)
+	return sshAgent, nil
+}
+
+func listenAgentSocket(socketPath string) (net.Listener, error) {
+	socketDir := filepath.Dir(socketPath)
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		return nil, err
+	}
+	// The socket mode is only set after it is created, so the directory
+	// must keep other users out until then.
+	if err := checkAgentSocketDir(socketDir); err != nil {
+		return nil, err
+	}
+	// Remove a stale socket from a previous run, but nothing else.
+	if fi, err := os.Lstat(socketPath); err == nil &&
+		fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// The socket hands out private keys.
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// runAgent keeps the certificates fresh until it fails.
+func runAgent(userName string,
+	homeDir string,
+	configContents config.AppConfigFile,
+	client *http.Client,
+	logger log.DebugLogger) error {
+	keyType, err := keyPreferenceFromString(configContents.Base.PreferredKeyType)
+	if err != nil {
+		return err
+	}
+	signers := makeSigners(keyType, homeDir, configContents.HardwareKey)
+	targetURLs := strings.Split(configContents.Base.Gen_Cert_URLS, ",")
+	err = backgroundConnectToAnyKeymasterServer(targetURLs, client, logger)
+	if err != nil {
+		return err
+	}
+	if err := makeDirs(homeDir); err != nil {
+		return err
+	}
+	listener, err := listenAgentSocket(getAgentSocketPath(homeDir))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	sshAgent, err := startSSHAgent(homeDir, configContents, logger)
+	if err != nil {
+		return err
+	}
+	if err := signers.Wait(); err != nil {
+		return err
+	}
+	// The X.509 key does not change when renewing.
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	if err := writeX509PrivateKey(tlsKeyPath, signers.X509); err != nil {
+		return err
+	}
+	var certSpecs []certagent.CertSpec
+	// Old agents do not understand sha2 certs, so Ed25519 goes first.
+	if signers.SshEd25519 != nil {
+		certSpecs = append(certSpecs, certagent.CertSpec{
+			Name: "ssh-ed25519", CertType: "ssh",
+			Signer: signers.SshEd25519, Optional: true})
+	}
+	certSpecs = append(certSpecs,
+		certagent.CertSpec{Name: "ssh", CertType: "ssh",
+			Signer: signers.SshMain},
+		certagent.CertSpec{Name: "x509", CertType: "x509",
+			Signer: signers.X509},
+		certagent.CertSpec{Name: "x509-kubernetes",
+			CertType: "x509-kubernetes", Signer: signers.X509, Optional: true})
+	manager, err := certagent.NewManager(certagent.Params{
+		Authenticate: func() (string, error) {
+			return authenticate(userName, homeDir, configContents, targetURLs,
+				client, logger)
+		},
+		CertSpecs:  certSpecs,
+		HttpClient: client,
+		Logger:     logger,
+		UserName:   userName,
+		AddGroups:  configContents.Base.AddGroups,
+		OnRenew: func(cert *certagent.Certificate) {
+			writeAgentCertificate(cert, userName, homeDir, configContents,
+				sshAgent, logger)
+		},
+		UserAgentString: userAgentString,
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("agent serving certificates on %s", listener.Addr())
+	return manager.Serve(listener)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/client/certagent"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+)
+
+func TestListenAgentSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "keymaster", "agent.sock")
+	listener, err := listenAgentSocket(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode: %s", fi.Mode())
+	}
+	// A stale socket is replaced, other files are not.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listenAgentSocket(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	filename := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(filename, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAgentSocket(filename); err == nil {
+		t.Fatal("listening on a regular file should fail")
+	}
+}
+
+func TestListenAgentSocketOpenDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directory modes are not checked on windows")
+	}
+	socketDir := filepath.Join(t.TempDir(), "keymaster")
+	if err := os.Mkdir(socketDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(socketDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	socketPath := filepath.Join(socketDir, "agent.sock")
+	if _, err := listenAgentSocket(socketPath); err == nil {
+		t.Fatal("listening in a world readable directory should fail")
+	}
+	if _, err := os.Lstat(socketPath); err == nil {
+		t.Fatal("socket was created")
+	}
+	linkPath := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(t.TempDir(), linkPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAgentSocket(filepath.Join(linkPath, "agent.sock")); err == nil {
+		t.Fatal("listening in a symlinked directory should fail")
+	}
+}
+
+func TestListenDefaultAgentSockets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directory modes are not checked on windows")
+	}
+	// The client config directory is world readable.
+	homeDir := t.TempDir()
+	configDir := filepath.Join(homeDir, keymasterSubdir)
+	if err := os.Mkdir(configDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(configDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, socketPath := range []string{
+		getAgentSocketPath(homeDir),
+		getSSHAgentSocketPath(homeDir, config.SSHAgentConfig{Enabled: true}),
+	} {
+		listener, err := listenAgentSocket(socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		fi, err := os.Stat(filepath.Dir(socketPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0700 {
+			t.Fatalf("unexpected socket directory mode: %s", fi.Mode())
+		}
+	}
+}
+
+func TestWriteAgentCertificate(t *testing.T) {
+	homeDir := t.TempDir()
+	if err := makeDirs(homeDir); err != nil {
+		t.Fatal(err)
+	}
+	cert := &certagent.Certificate{
+		Name:     "x509-kubernetes",
+		CertType: "x509-kubernetes",
+		Data:     []byte("certificate"),
+	}
+	writeAgentCertificate(cert, "username", homeDir, config.AppConfigFile{},
+		nil, testlogger.New(t))
+	certPath, _ := kubernetesCertPaths(homeDir)
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "certificate" {
+		t.Fatalf("unexpected certificate: %s", data)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkAgentSocketDir makes sure that only the current user can reach the
+// agent socket in dir.
+func checkAgentSocketDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %s), chmod it to 0700",
+			dir, fi.Mode().Perm())
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok &&
+		int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not by uid %d",
+			dir, stat.Uid, os.Getuid())
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/certagent"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/kubeconfig"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// A cached certificate closer to expiration than this is renewed, so that it
+// does not expire in the middle of a kubectl command.
+const kubernetesCredentialMinValidity = time.Minute
+
+// checkKubernetesKeyType fails for hardware keys: kubectl needs the key in
+// the credential.
+func checkKubernetesKeyType(configContents config.AppConfigFile) error {
+	keyType, err := keyPreferenceFromString(configContents.Base.PreferredKeyType)
+	if err == nil && keyType.isHardware() {
+		return fmt.Errorf("kubernetes credentials are not available for %s keys",
+			configContents.Base.PreferredKeyType)
+	}
+	return nil
+}
+
+func kubernetesCertPaths(homeDir string) (string, string) {
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	return tlsKeyPath + "-kubernetes.cert", tlsKeyPath + ".key"
+}
+
+func loadKubernetesCredential(homeDir string, minValidity time.Duration) (
+	*kubeconfig.ExecCredential, error) {
+	certPath, keyPath := kubernetesCertPaths(homeDir)
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	notAfter, err := kubeconfig.CertificateExpiration(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if time.Until(notAfter) < minValidity {
+		return nil, fmt.Errorf("certificate expires at %s", notAfter)
+	}
+	return kubeconfig.NewExecCredential(certPEM, keyPEM)
+}
+
+// getAgentKubernetesCredential asks a running agent for the credential,
+// which avoids prompting.
+func getAgentKubernetesCredential(homeDir string) (
+	*kubeconfig.ExecCredential, error) {
+	response, err := certagent.GetCertificate(getAgentSocketPath(homeDir),
+		"x509-kubernetes", kubernetesCredentialMinValidity)
+	if err != nil {
+		return nil, err
+	}
+	return kubeconfig.NewExecCredential([]byte(response.Certificate),
+		[]byte(response.PrivateKey))
+}
+
+// writeKubernetesCredential writes the credential for the exec plugin of
+// kubectl, authenticating again if the cached certificate is not usable.
+func writeKubernetesCredential(stdout io.Writer,
+	userName string,
+	homeDir string,
+	configContents config.AppConfigFile,
+	client *http.Client,
+	logger log.DebugLogger) error {
+	if err := checkKubernetesKeyType(configContents); err != nil {
+		return err
+	}
+	credential, err := loadKubernetesCredential(homeDir,
+		kubernetesCredentialMinValidity)
+	if err != nil {
+		logger.Debugf(1, "cached kubernetes certificate not usable: %s", err)
+		credential, err = getAgentKubernetesCredential(homeDir)
+		if err == nil {
+			return json.NewEncoder(stdout).Encode(credential)
+		}
+		logger.Debugf(1, "agent not usable: %s", err)
+		// kubectl reads the credential from stdout, the prompts are written
+		// to stderr.
+		err = setupCerts(userName, homeDir, configContents, client,
+			&runReport{}, logger)
+		if err != nil {
+			return err
+		}
+		credential, err = loadKubernetesCredential(homeDir, 0)
+		if err != nil {
+			return fmt.Errorf("kubernetes certificate not available: %s", err)
+		}
+	}
+	return json.NewEncoder(stdout).Encode(credential)
+}
+
+// kubernetesCredentialArgs returns the arguments for kubectl to run this
+// command with the same settings in exec plugin mode.
+func kubernetesCredentialArgs(configContents config.AppConfigFile) ([]string,
+	error) {
+	configPath, err := filepath.Abs(*configFilename)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-config", configPath, "-fileprefix", FilePrefix}
+	if configContents.Profile != "" {
+		args = append(args, "-profile", configContents.Profile)
+	}
+	if *cliUsername != "" {
+		args = append(args, "-username", *cliUsername)
+	}
+	if *rootCAFilename != "" {
+		rootCAPath, err := filepath.Abs(*rootCAFilename)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-rootCAFilename", rootCAPath)
+	}
+	if *webauthBrowser != "" {
+		args = append(args, "-webauthBrowser", *webauthBrowser)
+	}
+	return append(args, "kubernetes-credential"), nil
+}
+
+// generateKubeconfig writes a context for each cluster published by the
+// keymaster server.
+func generateKubeconfig(homeDir string,
+	configContents config.AppConfigFile,
+	client *http.Client,
+	report *runReport,
+	logger log.DebugLogger) error {
+	if err := checkKubernetesKeyType(configContents); err != nil {
+		return err
+	}
+	targetURLs := strings.Split(configContents.Base.Gen_Cert_URLS, ",")
+	var clusters []proto.KubernetesCluster
+	var err error
+	for _, baseURL := range targetURLs {
+		clusters, err = kubeconfig.GetClusters(baseURL, client)
+		if err == nil {
+			break
+		}
+		logger.Debugf(1, "cannot get kubernetes clusters from %s: %s",
+			baseURL, err)
+	}
+	if err != nil {
+		return err
+	}
+	if len(clusters) < 1 {
+		return errors.New("no kubernetes clusters configured in the keymaster server")
+	}
+	command, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args, err := kubernetesCredentialArgs(configContents)
+	if err != nil {
+		return err
+	}
+	filename := *kubeconfigFilename
+	if filename == "" {
+		filename = kubeconfig.DefaultFilename(homeDir)
+	}
+	result, err := kubeconfig.Merge(filename, kubeconfig.Params{
+		Clusters: clusters,
+		UserName: FilePrefix,
+		Exec: kubeconfig.ExecConfig{
+			Command:     command,
+			Args:        args,
+			InstallHint: "keymaster is required to authenticate to this cluster",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	report.Files = append(report.Files, filename)
+	logger.Printf("wrote contexts %s to %s",
+		strings.Join(result.Contexts, ", "), filename)
+	if result.CurrentContext != "" {
+		logger.Printf("current context set to %s", result.CurrentContext)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/kubeconfig"
+)
+
+func writeTestKubernetesCert(t *testing.T, homeDir string,
+	notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "username"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := makeDirs(homeDir); err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := kubernetesCertPaths(homeDir)
+	err = os.WriteFile(certPath,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteKubernetesCredentialCached(t *testing.T) {
+	homeDir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	writeTestKubernetesCert(t, homeDir, notAfter)
+	var stdout bytes.Buffer
+	err := writeKubernetesCredential(&stdout, "username", homeDir,
+		config.AppConfigFile{}, nil, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var credential kubeconfig.ExecCredential
+	if err := json.Unmarshal(stdout.Bytes(), &credential); err != nil {
+		t.Fatal(err)
+	}
+	if credential.APIVersion != kubeconfig.ExecCredentialAPIVersion ||
+		credential.Kind != kubeconfig.ExecCredentialKind {
+		t.Fatalf("bad credential: %s", stdout.String())
+	}
+	expiration, err := time.Parse(time.RFC3339,
+		credential.Status.ExpirationTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiration.Equal(notAfter) {
+		t.Fatalf("expiration %s != %s", expiration, notAfter)
+	}
+}
+
+func TestWriteKubernetesCredentialHardwareKey(t *testing.T) {
+	configContents := config.AppConfigFile{
+		Base: config.BaseConfig{PreferredKeyType: "tpm"},
+	}
+	err := writeKubernetesCredential(io.Discard, "username", t.TempDir(),
+		configContents, nil, testlogger.New(t))
+	if err == nil {
+		t.Fatal("hardware keys should fail")
+	}
+}
+
+func TestLoadKubernetesCredentialExpiring(t *testing.T) {
+	homeDir := t.TempDir()
+	if _, err := loadKubernetesCredential(homeDir, 0); err == nil {
+		t.Fatal("missing certificate should fail")
+	}
+	writeTestKubernetesCert(t, homeDir, time.Now().Add(30*time.Second))
+	_, err := loadKubernetesCredential(homeDir,
+		kubernetesCredentialMinValidity)
+	if err == nil {
+		t.Fatal("expiring certificate should not be used")
+	}
+	if _, err := loadKubernetesCredential(homeDir, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKubernetesCredentialArgs(t *testing.T) {
+	args, err := kubernetesCredentialArgs(config.AppConfigFile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) < 5 || args[len(args)-1] != "kubernetes-credential" {
+		t.Fatalf("unexpected args: %v", args)
+	}
+	if args[0] != "-config" || !filepath.IsAbs(args[1]) {
+		t.Fatalf("config path not absolute: %v", args)
+	}
+	args, err = kubernetesCredentialArgs(
+		config.AppConfigFile{Profile: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args[4:6], " ") != "-profile staging" {
+		t.Fatalf("profile not passed: %v", args)
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -25,6 +25,7 @@ import (
 	"github.com/Cloud-Foundations/golib/pkg/log"
 	"github.com/Cloud-Foundations/keymaster/lib/client/aws_role"
 	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/hwkey"
 	libnet "github.com/Cloud-Foundations/keymaster/lib/client/net"
 	"github.com/Cloud-Foundations/keymaster/lib/client/sshagent"
 	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
@@ -53,6 +54,8 @@ var (
 )
 
 var (
+	agentSocket = flag.String("agentSocket", "",
+		"Socket of the agent (default: ~/.keymaster/agent/<fileprefix>-agent.sock)")
 	checkDevices = flag.Bool("checkDevices", false,
 		"CheckU2F devices in your system")
 	configFilename = flag.String("config",
@@ -60,6 +63,8 @@ var (
 		"The filename of the configuration")
 	configHost = flag.String("configHost", "",
 		"Get a bootstrap config from this host")
+	kubeconfigFilename = flag.String("kubeconfig", "",
+		"kubeconfig file written by the kubeconfig command (default: first in $KUBECONFIG or ~/.kube/config)")
 	cliFilePrefix = flag.String("fileprefix", "",
 		"Prefix for the output files")
 	rootCAFilename = flag.String("rootCAFilename", "",
@@ -67,8 +72,12 @@ var (
 	roundRobinDialer = flag.Bool("roundRobinDialer", false,
 		"If true, use the smart round-robin dialer")
 	cliUsername      = flag.String("username", "", "username for keymaster")
-	preferredKeyType = flag.String("preferredKeyType", "rsa",
-		"Preferred key type for certificates. (rsa|p256|p384)")
+	preferredKeyType = flag.String("preferredKeyType", "",
+		"Preferred key type for certificates. (rsa|p256|p384|piv|tpm) (default: preferred_key_type in the config or rsa)")
+	outputFormat = flag.String("output", "text",
+		"Output format: text or json (a report on stdout)")
+	profileName = flag.String("profile", "",
+		"Profile of the config to use (default: default_profile in the config)")
 	printVersion = flag.Bool("version", false,
 		"Print version and exit")
 	webauthBrowser = flag.String("webauthBrowser", "",
@@ -188,15 +197,18 @@ func backgroundConnectToAnyKeymasterServer(targetUrls []string, client *http.Cli
 
 const rsaKeySize = 3072
 
+// generateAwsRoleCert writes the AWS role certificate, until it is refreshed
+// for the first time, and adds it to report.
 func generateAwsRoleCert(homeDir string,
 	configContents config.AppConfigFile,
 	client *http.Client,
+	report *runReport,
 	logger log.DebugLogger) error {
 	keyType, err := keyPreferenceFromString(configContents.Base.PreferredKeyType)
 	if err != nil {
 		return err
 	}
-	signers := makeSigners(keyType)
+	signers := makeSigners(keyType, homeDir, configContents.HardwareKey)
 	// Initialise the client connection.
 	targetURLs := strings.Split(configContents.Base.Gen_Cert_URLS, ",")
 	err = backgroundConnectToAnyKeymasterServer(targetURLs, client, logger)
@@ -219,18 +231,12 @@ func generateAwsRoleCert(homeDir string,
 	if err != nil {
 		return err
 	}
-	encodedx509Signer, err := x509.MarshalPKCS8PrivateKey(signers.X509)
-	if err != nil {
+	if err := writeX509PrivateKey(tlsKeyPath, signers.X509); err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(
-		tlsKeyPath+".key",
-		pem.EncodeToMemory(&pem.Block{
-			Type:  "PRIVATE KEY",
-			Bytes: encodedx509Signer}),
-		0600)
-	if err != nil {
-		return err
+	var keyFiles []string
+	if !keyType.isHardware() {
+		keyFiles = append(keyFiles, tlsKeyPath+".key")
 	}
 	x509CertPath := tlsKeyPath + ".cert"
 	certPEM, _, err := manager.GetRoleCertificate()
@@ -238,7 +244,12 @@ func generateAwsRoleCert(homeDir string,
 		return err
 	}
 	if err := ioutil.WriteFile(x509CertPath, certPEM, 0644); err != nil {
-		return errors.New("Could not write ssh cert")
+		return fmt.Errorf("cannot write AWS role certificate: %s", err)
+	}
+	err = addX509CertificateReport(report, "aws-role", certPEM,
+		append(keyFiles, x509CertPath), time.Now())
+	if err != nil {
+		return err
 	}
 	for {
 		logger.Println("starting loop waiting for certificate refreshes")
@@ -250,30 +261,44 @@ func generateAwsRoleCert(homeDir string,
 		tempPath := x509CertPath + "~"
 		err = ioutil.WriteFile(tempPath, certPEM, 0644)
 		if err != nil {
-			return errors.New("Could not write ssh cert")
+			return fmt.Errorf("cannot write AWS role certificate: %s", err)
 		}
 		defer os.Remove(tempPath)
-		return os.Rename(tempPath, x509CertPath)
+		if err := os.Rename(tempPath, x509CertPath); err != nil {
+			return err
+		}
+		// Report the certificate left on disk.
+		report.Certificates = nil
+		return addX509CertificateReport(report, "aws-role", certPEM,
+			append(keyFiles, x509CertPath), time.Now())
 	}
 }
 
 // Beware, this function has inverted path.... at the beggining
+// It returns the files written, none if the certificate is in the agent.
 func insertSSHCertIntoAgentORWriteToFilesystem(certText []byte,
 	signer interface{},
 	filePrefix string,
 	userName string,
 	privateKeyPath string,
 	confirmBeforeUse bool,
-	logger log.DebugLogger) (err error) {
+	logger log.DebugLogger) ([]string, error) {
 
 	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certText)
 	if err != nil {
 		logger.Println(err)
-		return err
+		return nil, err
 	}
 	sshCert, ok := pubKey.(*ssh.Certificate)
 	if !ok {
-		return fmt.Errorf("It is not a certificate")
+		return nil, fmt.Errorf("It is not a certificate")
+	}
+	sshCertPath := privateKeyPath + "-cert.pub"
+	if _, ok := signer.(hwkey.Signer); ok {
+		// Other agents cannot use hardware keys, but the certificate is
+		// still useful, i.e. with a PKCS#11 provider.
+		return []string{sshCertPath},
+			ioutil.WriteFile(sshCertPath, certText, 0644)
 	}
 	comment := filePrefix + "-" + userName
 	keyToAdd := agent.AddedKey{
@@ -287,7 +312,7 @@ func insertSSHCertIntoAgentORWriteToFilesystem(certText []byte,
 	//comment should be based on key type?
 	err = sshagent.WithAddedKeyUpsertCertIntoAgent(keyToAdd, logger)
 	if err == nil {
-		return nil
+		return nil, nil
 	}
 	logger.Debugf(1, "Non fatal, failed to insert into agent with expiration")
 	// NOTE: Current Windows ssh (OpenSSH_for_Windows_7.7p1, LibreSSL 2.6.5)
@@ -299,23 +324,43 @@ func insertSSHCertIntoAgentORWriteToFilesystem(certText []byte,
 	// feature we never change the user preference
 	err = sshagent.WithAddedKeyUpsertCertIntoAgent(keyToAdd, logger)
 	if err == nil {
-		return nil
+		return nil, nil
 	}
 	logger.Debugf(1, "Non fatal, failed to insert into agent without expiration")
 	encodedSigner, err := ssh.MarshalPrivateKey(signer, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = ioutil.WriteFile(
 		privateKeyPath,
 		pem.EncodeToMemory(encodedSigner),
 		0600)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// now we need to write the certificate
-	sshCertPath := privateKeyPath + "-cert.pub"
-	return ioutil.WriteFile(sshCertPath, certText, 0644)
+	return []string{privateKeyPath, sshCertPath},
+		ioutil.WriteFile(sshCertPath, certText, 0644)
+}
+
+// writeX509PrivateKey writes the key of the X.509 certificate. Hardware keys
+// cannot be written, so a stale key from a previous run is removed instead.
+func writeX509PrivateKey(tlsKeyPath string, signer crypto.Signer) error {
+	keyPath := tlsKeyPath + ".key"
+	if _, ok := signer.(hwkey.Signer); ok {
+		if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	encodedx509Signer, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(keyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY",
+			Bytes: encodedx509Signer}),
+		0600)
 }
 
 func makeDirs(homeDir string) error {
@@ -332,17 +377,47 @@ func makeDirs(homeDir string) error {
 	return nil
 }
 
+// authenticate authenticates to one of targetURLs, leaving the cookie in the
+// client cookie jar, and returns its URL.
+func authenticate(userName string,
+	homeDir string,
+	configContents config.AppConfigFile,
+	targetURLs []string,
+	client *http.Client,
+	logger log.DebugLogger) (string, error) {
+	_webauthBrowser := configContents.Base.WebauthBrowser
+	if *webauthBrowser != "" {
+		_webauthBrowser = *webauthBrowser
+	}
+	if _webauthBrowser != "" {
+		// Authenticate using web browser.
+		return webauth.Authenticate(userName, _webauthBrowser,
+			filepath.Join(homeDir, keymasterSubdir, FilePrefix+".webtoken"),
+			targetURLs, client, userAgentString, logger)
+	}
+	// Authenticate using password and possible 2nd factor.
+	password, err := util.GetUserCreds(userName)
+	if err != nil {
+		return "", err
+	}
+	return twofa.AuthenticateToTargetUrls(userName, password,
+		targetURLs, false, client,
+		userAgentString, logger)
+}
+
+// setupCerts gets the certificates and adds what was written to report.
 func setupCerts(
 	userName string,
 	homeDir string,
 	configContents config.AppConfigFile,
 	client *http.Client,
+	report *runReport,
 	logger log.DebugLogger) error {
 	keyType, err := keyPreferenceFromString(configContents.Base.PreferredKeyType)
 	if err != nil {
 		return err
 	}
-	signers := makeSigners(keyType)
+	signers := makeSigners(keyType, homeDir, configContents.HardwareKey)
 	//initialize the client connection
 	targetURLs := strings.Split(configContents.Base.Gen_Cert_URLS, ",")
 	err = backgroundConnectToAnyKeymasterServer(targetURLs, client, logger)
@@ -354,32 +429,10 @@ func setupCerts(
 	}
 	sshKeyPath := filepath.Join(homeDir, DefaultSSHKeysLocation, FilePrefix)
 	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
-	var baseUrl string
-	_webauthBrowser := configContents.Base.WebauthBrowser
-	if *webauthBrowser != "" {
-		_webauthBrowser = *webauthBrowser
-	}
-	if _webauthBrowser != "" {
-		// Authenticate using web browser.
-		baseUrl, err = webauth.Authenticate(userName, _webauthBrowser,
-			filepath.Join(homeDir, keymasterSubdir, FilePrefix+".webtoken"),
-			targetURLs, client, userAgentString, logger)
-		if err != nil {
-			return err
-		}
-	} else {
-		// Authenticate using password and possible 2nd factor.
-		password, err := util.GetUserCreds(userName)
-		if err != nil {
-			return err
-		}
-		baseUrl, err = twofa.AuthenticateToTargetUrls(userName, password,
-			targetURLs, false, client,
-			userAgentString, logger)
-		if err != nil {
-			return err
-
-		}
+	baseUrl, err := authenticate(userName, homeDir, configContents, targetURLs,
+		client, logger)
+	if err != nil {
+		return err
 	}
 	logger.Debugf(1, "SetupCerts: authentication Complete")
 	if err := signers.Wait(); err != nil {
@@ -401,12 +454,15 @@ func setupCerts(
 	if err != nil {
 		return err
 	}
-	sshEd25519Cert, err := twofa.DoCertRequest(signers.SshEd25519, client,
-		userName, baseUrl, "ssh", configContents.Base.AddGroups,
-		userAgentString, logger)
-	if err != nil {
-		logger.Debugf(1, "Ed25519 cert not available")
-		sshEd25519Cert = nil
+	var sshEd25519Cert []byte
+	if signers.SshEd25519 != nil {
+		sshEd25519Cert, err = twofa.DoCertRequest(signers.SshEd25519, client,
+			userName, baseUrl, "ssh", configContents.Base.AddGroups,
+			userAgentString, logger)
+		if err != nil {
+			logger.Debugf(1, "Ed25519 cert not available")
+			sshEd25519Cert = nil
+		}
 	}
 	logger.Debugf(0, "certificates successfully generated")
 
@@ -414,8 +470,9 @@ func setupCerts(
 	// Time to write certs and keys
 	// old agents do not understand sha2 certs, so we inject Ed25519 first
 	// if present
+	now := time.Now()
 	if sshEd25519Cert != nil {
-		err = insertSSHCertIntoAgentORWriteToFilesystem(sshEd25519Cert,
+		files, err := insertSSHCertIntoAgentORWriteToFilesystem(sshEd25519Cert,
 			signers.SshEd25519,
 			FilePrefix+"-ed25519",
 			userName,
@@ -425,9 +482,14 @@ func setupCerts(
 		if err != nil {
 			return err
 		}
+		err = addSSHCertificateReport(report, "ssh-ed25519", sshEd25519Cert,
+			files, FilePrefix+"-ed25519-"+userName, now)
+		if err != nil {
+			return err
+		}
 	}
 	keySuffix := "-" + configContents.Base.PreferredKeyType
-	err = insertSSHCertIntoAgentORWriteToFilesystem(sshRsaCert,
+	files, err := insertSSHCertIntoAgentORWriteToFilesystem(sshRsaCert,
 		signers.SshMain,
 		FilePrefix+keySuffix,
 		userName,
@@ -437,30 +499,39 @@ func setupCerts(
 	if err != nil {
 		return err
 	}
-	// Now x509
-	encodedx509Signer, err := x509.MarshalPKCS8PrivateKey(signers.X509)
+	err = addSSHCertificateReport(report, "ssh", sshRsaCert, files,
+		FilePrefix+keySuffix+"-"+userName, now)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(
-		tlsKeyPath+".key",
-		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encodedx509Signer}),
-		0600)
-	if err != nil {
+	// Now x509
+	if err := writeX509PrivateKey(tlsKeyPath, signers.X509); err != nil {
 		return err
 	}
+	var keyFiles []string
+	if !keyType.isHardware() {
+		keyFiles = append(keyFiles, tlsKeyPath+".key")
+	}
 	x509CertPath := tlsKeyPath + ".cert"
 	err = ioutil.WriteFile(x509CertPath, x509Cert, 0644)
 	if err != nil {
-		err := errors.New("Could not write ssh cert")
-		logger.Fatal(err)
+		return fmt.Errorf("cannot write X.509 certificate: %s", err)
+	}
+	err = addX509CertificateReport(report, "x509", x509Cert,
+		append(keyFiles, x509CertPath), now)
+	if err != nil {
+		return err
 	}
 	if kubernetesCert != nil {
 		kubernetesCertPath := tlsKeyPath + "-kubernetes.cert"
 		err = ioutil.WriteFile(kubernetesCertPath, kubernetesCert, 0644)
 		if err != nil {
-			err := errors.New("Could not write ssh cert")
-			logger.Fatal(err)
+			return fmt.Errorf("cannot write Kubernetes certificate: %s", err)
+		}
+		err = addX509CertificateReport(report, "x509-kubernetes",
+			kubernetesCert, append(keyFiles, kubernetesCertPath), now)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -499,17 +570,40 @@ func getHttpClient(rootCAs *x509.CertPool, logger log.DebugLogger) (*http.Client
 }
 
 func Usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [flags...] [aws-role-cert]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags...] [agent|aws-role-cert|kubeconfig|kubernetes-credential|profiles|status]\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "Version: %s\n", Version)
 	flag.PrintDefaults()
 }
 
 // We assume here flags are parsed
-func mainWithError(stdout io.Writer, logger log.DebugLogger) error {
+func mainWithError(stdout io.Writer, logger log.DebugLogger) (err error) {
 	if *printVersion {
 		fmt.Fprintln(stdout, Version)
 		return nil
 	}
+	report := runReport{Command: flag.Arg(0)}
+	if report.Command == "" {
+		report.Command = "certificates"
+	}
+	switch *outputFormat {
+	case "text":
+	case "json":
+		if report.Command == "kubernetes-credential" {
+			break // kubectl reads the credential.
+		}
+		// Prompts are written to stderr, so they do not mix with the report.
+		defer func() {
+			report.Success = err == nil
+			if err != nil {
+				report.Error = err.Error()
+			}
+			if writeErr := writeJSONReport(stdout, report); err == nil {
+				err = writeErr
+			}
+		}()
+	default:
+		return fmt.Errorf("invalid output format: %s", *outputFormat)
+	}
 	rootCAs, err := maybeGetRootCas(*rootCAFilename, logger)
 	if err != nil {
 		return err
@@ -532,6 +626,32 @@ func mainWithError(stdout io.Writer, logger log.DebugLogger) error {
 	}
 	config := loadConfigFile(client, logger)
 	logger.Debugf(3, "loaded Config=%+v", config)
+	if flag.Arg(0) == "profiles" {
+		report.Profiles, err = getProfiles(config)
+		if err != nil || *outputFormat == "json" {
+			return err
+		}
+		return writeProfilesText(stdout, report.Profiles)
+	}
+	config, err = config.GetProfile(*profileName)
+	if err != nil {
+		return err
+	}
+	report.Profile = config.Profile
+	if len(config.Base.Gen_Cert_URLS) < 1 {
+		return fmt.Errorf("no keymaster servers, select one of the profiles: %s",
+			strings.Join(config.ProfileNames(), ", "))
+	}
+	if *rootCAFilename == "" && config.Base.RootCAFilename != "" {
+		rootCAs, err := maybeGetRootCas(config.Base.RootCAFilename, logger)
+		if err != nil {
+			return err
+		}
+		client, err = getHttpClient(rootCAs, logger)
+		if err != nil {
+			return err
+		}
+	}
 	// Adjust user name
 	if len(config.Base.Username) > 0 {
 		userName = config.Base.Username
@@ -543,6 +663,7 @@ func mainWithError(stdout io.Writer, logger log.DebugLogger) error {
 	if len(config.Base.FilePrefix) > 0 {
 		FilePrefix = config.Base.FilePrefix
 	}
+	FilePrefix = profileFilePrefix(FilePrefix, config)
 	if *cliFilePrefix != "" {
 		FilePrefix = *cliFilePrefix
 	}
@@ -554,10 +675,31 @@ func mainWithError(stdout io.Writer, logger log.DebugLogger) error {
 		}
 		config.Base.PreferredKeyType = *preferredKeyType
 	}
-	if flag.Arg(0) == "aws-role-cert" {
-		err = generateAwsRoleCert(homeDir, config, client, logger)
-	} else {
-		err = setupCerts(userName, homeDir, config, client, logger)
+	if config.Base.PreferredKeyType == "" {
+		config.Base.PreferredKeyType = "rsa"
+	}
+	switch flag.Arg(0) {
+	case "agent":
+		err = runAgent(userName, homeDir, config, client, logger)
+	case "aws-role-cert":
+		err = generateAwsRoleCert(homeDir, config, client, &report, logger)
+	case "kubeconfig":
+		err = generateKubeconfig(homeDir, config, client, &report, logger)
+	case "kubernetes-credential":
+		// Only the credential must be written.
+		return writeKubernetesCredential(stdout, userName, homeDir, config,
+			client, logger)
+	case "status":
+		err = getCertificateStatus(userName, homeDir, config, &report)
+		if *outputFormat == "text" {
+			if writeErr := writeStatusText(stdout, report); err == nil {
+				err = writeErr
+			}
+		}
+		// Only the status must be written.
+		return err
+	default:
+		err = setupCerts(userName, homeDir, config, client, &report, logger)
 	}
 	if err != nil {
 		return err
@@ -199,6 +199,7 @@ func TestMost(t *testing.T) {
 		homeDir,
 		appConfig,
 		client,
+		&runReport{},
 		logger)
 
 }
@@ -247,7 +248,7 @@ func TestInsertSSHCertIntoAgentORWriteToFilesystem(t *testing.T) {
 	defer os.RemoveAll(tempDir) // clean up
 	privateKeyPath := filepath.Join(tempDir, "test")
 
-	err = insertSSHCertIntoAgentORWriteToFilesystem([]byte(certString),
+	files, err := insertSSHCertIntoAgentORWriteToFilesystem([]byte(certString),
 		privateKey,
 		"someprefix",
 		"username",
@@ -262,6 +263,9 @@ func TestInsertSSHCertIntoAgentORWriteToFilesystem(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(files) != 2 || files[0] != privateKeyPath {
+		t.Fatalf("unexpected files written: %v", files)
+	}
 	defer os.Remove(privateKeyPath)
 
 	//t.Logf("certString='%s'", certString)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+)
+
+func getProfiles(configContents config.AppConfigFile) ([]profileReport,
+	error) {
+	var profiles []profileReport
+	for _, name := range configContents.ProfileNames() {
+		profile, err := configContents.GetProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profileReport{
+			Name:       name,
+			Default:    name == configContents.DefaultProfile,
+			Servers:    profile.Base.Gen_Cert_URLS,
+			Username:   profile.Base.Username,
+			FilePrefix: configContents.Profiles[name].FilePrefix,
+		})
+	}
+	return profiles, nil
+}
+
+// profileFilePrefix returns the file prefix for the selected profile, keeping
+// the files of each profile apart. The default profile keeps the plain
+// prefix, so that its files do not move when it is set.
+func profileFilePrefix(prefix string,
+	configContents config.AppConfigFile) string {
+	profile := configContents.Profile
+	if profile == "" || profile == configContents.DefaultProfile ||
+		configContents.Profiles[profile].FilePrefix != "" {
+		return prefix
+	}
+	return prefix + "-" + profile
+}
+
+// writeProfilesText writes the profiles, marking the default one with a *.
+func writeProfilesText(stdout io.Writer, profiles []profileReport) error {
+	if len(profiles) < 1 {
+		fmt.Fprintln(stdout, "No profiles in the config")
+		return nil
+	}
+	writer := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	for _, profile := range profiles {
+		marker := " "
+		if profile.Default {
+			marker = "*"
+		}
+		fmt.Fprintf(writer, "%s %s\t%s\t%s\n", marker, profile.Name,
+			profile.Servers, profile.Username)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+)
+
+func listProfiles(stdout *bytes.Buffer,
+	configContents config.AppConfigFile) error {
+	profiles, err := getProfiles(configContents)
+	if err != nil {
+		return err
+	}
+	return writeProfilesText(stdout, profiles)
+}
+
+func TestListProfiles(t *testing.T) {
+	var output bytes.Buffer
+	if err := listProfiles(&output, config.AppConfigFile{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "No profiles") {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+	output.Reset()
+	configContents := config.AppConfigFile{
+		Base: config.BaseConfig{
+			Gen_Cert_URLS: "https://keymaster.example.com/",
+			Username:      "alice",
+		},
+		Profiles: map[string]config.ProfileConfig{
+			"staging": {
+				Gen_Cert_URLS: "https://keymaster.staging.example.com/",
+			},
+			"prod": {Username: "alice-admin"},
+		},
+		DefaultProfile: "prod",
+	}
+	if err := listProfiles(&output, configContents); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+	if !strings.HasPrefix(lines[0], "* prod") ||
+		!strings.Contains(lines[0], "https://keymaster.example.com/") ||
+		!strings.Contains(lines[0], "alice-admin") {
+		t.Fatalf("unexpected prod line: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "  staging") ||
+		!strings.Contains(lines[1], "https://keymaster.staging.example.com/") {
+		t.Fatalf("unexpected staging line: %s", lines[1])
+	}
+}
+
+func TestProfileFilePrefix(t *testing.T) {
+	configContents := config.AppConfigFile{
+		Profiles: map[string]config.ProfileConfig{
+			"prod":    {},
+			"staging": {},
+			"dev":     {FilePrefix: "dev"},
+		},
+		DefaultProfile: "prod",
+	}
+	for profile, expected := range map[string]string{
+		"":        "keymaster",
+		"prod":    "keymaster",
+		"staging": "keymaster-staging",
+		"dev":     "keymaster", // Already applied by GetProfile.
+	} {
+		configContents.Profile = profile
+		if prefix := profileFilePrefix("keymaster", configContents); prefix != expected {
+			t.Errorf("profile %q: got %s, expected %s", profile, prefix, expected)
+		}
+	}
+}
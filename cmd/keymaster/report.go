@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/sshagent"
+)
+
+const (
+	certStatusValid    = "valid"
+	certStatusExpiring = "expiring"
+	certStatusExpired  = "expired"
+	certStatusMissing  = "missing"
+)
+
+// Certificates expiring sooner than this are reported as expiring.
+const certExpiringThreshold = time.Hour
+
+type certificateReport struct {
+	Name         string     `json:"name"`
+	Files        []string   `json:"files,omitempty"`
+	AgentComment string     `json:"agent_comment,omitempty"` // If in the SSH agent.
+	Serial       string     `json:"serial,omitempty"`
+	Principals   []string   `json:"principals,omitempty"`
+	NotAfter     *time.Time `json:"not_after,omitempty"`
+	Status       string     `json:"status"`
+	optional     bool
+}
+
+type sshAgentReport struct {
+	Available bool   `json:"available"`
+	Error     string `json:"error,omitempty"`
+	// The number of certificates held for the user and file prefix.
+	Certificates int `json:"certificates"`
+}
+
+type profileReport struct {
+	Name       string `json:"name"`
+	Default    bool   `json:"default"`
+	Servers    string `json:"servers"`
+	Username   string `json:"username,omitempty"`
+	FilePrefix string `json:"file_prefix,omitempty"`
+}
+
+// runReport is written with -output=json.
+type runReport struct {
+	Command        string              `json:"command"`
+	Profile        string              `json:"profile,omitempty"`
+	Success        bool                `json:"success"`
+	Error          string              `json:"error,omitempty"`
+	Certificates   []certificateReport `json:"certificates,omitempty"`
+	Files          []string            `json:"files,omitempty"` // Other files.
+	SSHAgent       *sshAgentReport     `json:"ssh_agent,omitempty"`
+	KeymasterAgent *bool               `json:"keymaster_agent,omitempty"`
+	Profiles       []profileReport     `json:"profiles,omitempty"`
+}
+
+func certificateStatus(notAfter time.Time, now time.Time) string {
+	if !now.Before(notAfter) {
+		return certStatusExpired
+	}
+	if notAfter.Sub(now) < certExpiringThreshold {
+		return certStatusExpiring
+	}
+	return certStatusValid
+}
+
+func newSSHCertificateReport(name string, certText []byte,
+	now time.Time) (certificateReport, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certText)
+	if err != nil {
+		return certificateReport{}, err
+	}
+	sshCert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return certificateReport{}, errors.New("not an SSH certificate")
+	}
+	return newSSHAgentCertificateReport(name, sshCert, now), nil
+}
+
+func newSSHAgentCertificateReport(name string, sshCert *ssh.Certificate,
+	now time.Time) certificateReport {
+	notAfter := time.Unix(int64(sshCert.ValidBefore), 0)
+	if sshCert.ValidBefore == ssh.CertTimeInfinity {
+		notAfter = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	}
+	return certificateReport{
+		Name:       name,
+		Serial:     strconv.FormatUint(sshCert.Serial, 10),
+		Principals: sshCert.ValidPrincipals,
+		NotAfter:   &notAfter,
+		Status:     certificateStatus(notAfter, now),
+	}
+}
+
+func newX509CertificateReport(name string, certPEM []byte,
+	now time.Time) (certificateReport, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return certificateReport{}, errors.New("cannot decode certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return certificateReport{}, err
+	}
+	return certificateReport{
+		Name:       name,
+		Serial:     cert.SerialNumber.String(),
+		Principals: []string{cert.Subject.CommonName},
+		NotAfter:   &cert.NotAfter,
+		Status:     certificateStatus(cert.NotAfter, now),
+	}, nil
+}
+
+// addSSHCertificateReport adds a certificate written to files or, if there
+// are none, to the SSH agent with the given comment.
+func addSSHCertificateReport(report *runReport, name string, certText []byte,
+	files []string, agentComment string, now time.Time) error {
+	certReport, err := newSSHCertificateReport(name, certText, now)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		certReport.Files = files
+	} else {
+		certReport.AgentComment = agentComment
+	}
+	report.Certificates = append(report.Certificates, certReport)
+	return nil
+}
+
+func addX509CertificateReport(report *runReport, name string, certPEM []byte,
+	files []string, now time.Time) error {
+	certReport, err := newX509CertificateReport(name, certPEM, now)
+	if err != nil {
+		return err
+	}
+	certReport.Files = files
+	report.Certificates = append(report.Certificates, certReport)
+	return nil
+}
+
+func getSSHAgentReport(userName string,
+	sshCertNames map[string]string) (*sshAgentReport,
+	[]certificateReport) {
+	certificates, err := sshagent.ListCertificates()
+	if err != nil {
+		return &sshAgentReport{Error: err.Error()}, nil
+	}
+	report := &sshAgentReport{Available: true}
+	var reports []certificateReport
+	now := time.Now()
+	for _, cert := range certificates {
+		for suffix, name := range sshCertNames {
+			comment := FilePrefix + suffix + "-" + userName
+			if cert.Comment != comment {
+				continue
+			}
+			certReport := newSSHAgentCertificateReport(name, cert.Certificate,
+				now)
+			certReport.AgentComment = comment
+			reports = append(reports, certReport)
+			report.Certificates++
+		}
+	}
+	return report, reports
+}
+
+func isKeymasterAgentRunning(homeDir string) bool {
+	conn, err := net.Dial("unix", getAgentSocketPath(homeDir))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// getCertificateStatus inspects the certificates written by previous runs
+// and those in the SSH agent.
+func getCertificateStatus(userName string,
+	homeDir string,
+	configContents config.AppConfigFile,
+	report *runReport) error {
+	sshKeyPath := filepath.Join(homeDir, DefaultSSHKeysLocation, FilePrefix)
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	keySuffix := "-" + configContents.Base.PreferredKeyType
+	sshCertNames := map[string]string{
+		keySuffix:  "ssh",
+		"-ed25519": "ssh-ed25519",
+	}
+	sshAgent, agentReports := getSSHAgentReport(userName, sshCertNames)
+	report.SSHAgent = sshAgent
+	keymasterAgent := isKeymasterAgentRunning(homeDir)
+	report.KeymasterAgent = &keymasterAgent
+	now := time.Now()
+	for _, spec := range []struct {
+		name     string
+		filename string
+		optional bool
+	}{
+		{"ssh", sshKeyPath + keySuffix + "-cert.pub", false},
+		{"ssh-ed25519", sshKeyPath + "-ed25519-cert.pub", true},
+		{"x509", tlsKeyPath + ".cert", false},
+		{"x509-kubernetes", tlsKeyPath + "-kubernetes.cert", true},
+	} {
+		var found bool
+		for _, agentReport := range agentReports {
+			if agentReport.Name == spec.name {
+				agentReport.optional = spec.optional
+				report.Certificates = append(report.Certificates, agentReport)
+				found = true
+			}
+		}
+		data, err := os.ReadFile(spec.filename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			if !found {
+				report.Certificates = append(report.Certificates,
+					certificateReport{
+						Name:     spec.name,
+						Status:   certStatusMissing,
+						optional: spec.optional,
+					})
+			}
+			continue
+		}
+		var certReport certificateReport
+		if strings.HasPrefix(spec.name, "ssh") {
+			certReport, err = newSSHCertificateReport(spec.name, data, now)
+		} else {
+			certReport, err = newX509CertificateReport(spec.name, data, now)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", spec.filename, err)
+		}
+		certReport.Files = []string{spec.filename}
+		certReport.optional = spec.optional
+		report.Certificates = append(report.Certificates, certReport)
+	}
+	// The required certificates must be usable somewhere.
+	usable := make(map[string]bool)
+	for _, certReport := range report.Certificates {
+		if certReport.Status == certStatusValid ||
+			certReport.Status == certStatusExpiring {
+			usable[certReport.Name] = true
+		}
+	}
+	for _, certReport := range report.Certificates {
+		if !certReport.optional && !usable[certReport.Name] {
+			return fmt.Errorf("%s certificate is %s", certReport.Name,
+				certReport.Status)
+		}
+	}
+	return nil
+}
+
+func writeStatusText(stdout io.Writer, report runReport) error {
+	writer := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	for _, certReport := range report.Certificates {
+		location := strings.Join(certReport.Files, ", ")
+		if certReport.AgentComment != "" {
+			location = "ssh-agent: " + certReport.AgentComment
+		}
+		var notAfter string
+		if certReport.NotAfter != nil {
+			notAfter = certReport.NotAfter.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", certReport.Name,
+			certReport.Status, notAfter, location)
+	}
+	if report.SSHAgent != nil {
+		if report.SSHAgent.Available {
+			fmt.Fprintf(writer, "ssh-agent\tavailable\t\n")
+		} else {
+			fmt.Fprintf(writer, "ssh-agent\tnot available\t%s\n",
+				report.SSHAgent.Error)
+		}
+	}
+	if report.KeymasterAgent != nil {
+		if *report.KeymasterAgent {
+			fmt.Fprintf(writer, "keymaster agent\trunning\t\n")
+		} else {
+			fmt.Fprintf(writer, "keymaster agent\tnot running\t\n")
+		}
+	}
+	return writer.Flush()
+}
+
+func writeJSONReport(stdout io.Writer, report runReport) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
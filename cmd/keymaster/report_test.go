@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+)
+
+func makeTestSSHCert(t *testing.T, validBefore time.Time) []byte {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             sshPub,
+		Serial:          42,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"username"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func TestCertificateStatus(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		notAfter time.Time
+		status   string
+	}{
+		{now.Add(-time.Second), certStatusExpired},
+		{now, certStatusExpired},
+		{now.Add(time.Minute), certStatusExpiring},
+		{now.Add(2 * time.Hour), certStatusValid},
+	} {
+		if status := certificateStatus(test.notAfter, now); status != test.status {
+			t.Errorf("%s: expected %s, got %s", test.notAfter.Sub(now),
+				test.status, status)
+		}
+	}
+}
+
+func TestNewSSHCertificateReport(t *testing.T) {
+	validBefore := time.Now().Add(2 * time.Hour)
+	report, err := newSSHCertificateReport("ssh",
+		makeTestSSHCert(t, validBefore), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Serial != "42" {
+		t.Errorf("bad serial: %s", report.Serial)
+	}
+	if len(report.Principals) != 1 || report.Principals[0] != "username" {
+		t.Errorf("bad principals: %v", report.Principals)
+	}
+	if report.NotAfter.Unix() != validBefore.Unix() {
+		t.Errorf("bad expiry: %s", report.NotAfter)
+	}
+	if report.Status != certStatusValid {
+		t.Errorf("bad status: %s", report.Status)
+	}
+	if _, err := newSSHCertificateReport("ssh", []byte("junk"),
+		time.Now()); err == nil {
+		t.Error("junk certificate did not fail")
+	}
+}
+
+func TestGetCertificateStatus(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	homeDir := t.TempDir()
+	var configContents config.AppConfigFile
+	configContents.Base.PreferredKeyType = "rsa"
+	var report runReport
+	if err := getCertificateStatus("username", homeDir, configContents,
+		&report); err == nil {
+		t.Fatal("missing certificates did not fail")
+	}
+	// The kubernetes certificate is the only x509 one with a helper.
+	writeTestKubernetesCert(t, homeDir, time.Now().Add(2*time.Hour))
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	if err := os.Rename(tlsKeyPath+"-kubernetes.cert",
+		tlsKeyPath+".cert"); err != nil {
+		t.Fatal(err)
+	}
+	sshCertPath := filepath.Join(homeDir, DefaultSSHKeysLocation,
+		FilePrefix+"-rsa-cert.pub")
+	err := os.WriteFile(sshCertPath,
+		makeTestSSHCert(t, time.Now().Add(2*time.Hour)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = runReport{}
+	if err := getCertificateStatus("username", homeDir, configContents,
+		&report); err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]string)
+	for _, certReport := range report.Certificates {
+		statuses[certReport.Name] = certReport.Status
+	}
+	for name, status := range map[string]string{
+		"ssh":             certStatusValid,
+		"ssh-ed25519":     certStatusMissing,
+		"x509":            certStatusValid,
+		"x509-kubernetes": certStatusMissing,
+	} {
+		if statuses[name] != status {
+			t.Errorf("%s: expected %s, got %s", name, status, statuses[name])
+		}
+	}
+	if report.SSHAgent == nil || report.SSHAgent.Available {
+		t.Error("SSH agent reported as available")
+	}
+	if report.KeymasterAgent == nil || *report.KeymasterAgent {
+		t.Error("keymaster agent reported as running")
+	}
+	buffer := &bytes.Buffer{}
+	if err := writeJSONReport(buffer, report); err != nil {
+		t.Fatal(err)
+	}
+	var decoded runReport
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Certificates) != len(report.Certificates) {
+		t.Errorf("expected %d certificates, got %d",
+			len(report.Certificates), len(decoded.Certificates))
+	}
+}
@@ -8,7 +8,14 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
+
+	"golang.org/x/term"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/hwkey"
 )
 
 type KeyPreference int
@@ -17,6 +24,8 @@ const (
 	RSASigner KeyPreference = iota
 	P256Signer
 	P384Signer
+	PIVSigner
+	TPMSigner
 )
 
 // names:
@@ -31,29 +40,131 @@ func keyPreferenceFromString(stringPref string) (KeyPreference, error) {
 		return P256Signer, nil
 	case "p384":
 		return P384Signer, nil
+	case "piv":
+		return PIVSigner, nil
+	case "tpm":
+		return TPMSigner, nil
 	default:
 		return 0, fmt.Errorf("uknown name")
 	}
 }
 
+// isHardware returns true if the keys are generated in hardware, so they
+// cannot be written to disk.
+func (keyPreference KeyPreference) isHardware() bool {
+	return keyPreference == PIVSigner || keyPreference == TPMSigner
+}
+
 type signers struct {
 	mutex      sync.RWMutex
 	err        error
 	X509       crypto.Signer
 	SshMain    crypto.Signer
-	SshEd25519 ed25519.PrivateKey
+	SshEd25519 ed25519.PrivateKey // nil for hardware keys.
 	keyPref    KeyPreference
+	hwConfig   config.HardwareKeyConfig
+	homeDir    string
 }
 
-func makeSigners(keyPreference KeyPreference) *signers {
+func makeSigners(keyPreference KeyPreference, homeDir string,
+	hwConfig config.HardwareKeyConfig) *signers {
 	s := signers{
-		keyPref: keyPreference,
+		keyPref:  keyPreference,
+		hwConfig: hwConfig,
+		homeDir:  homeDir,
 	}
 	s.mutex.Lock()
-	go s.compute()
+	if keyPreference.isHardware() {
+		// The PIN prompt must not mix with the password prompt.
+		s.computeHardware()
+	} else {
+		go s.compute()
+	}
 	return &s
 }
 
+func promptPIVPIN() (string, error) {
+	fmt.Fprint(os.Stderr, "PIN for the security key: ")
+	pin, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read PIN: %w", err)
+	}
+	return string(pin), nil
+}
+
+// loadTPMAuthValue returns the auth value of the TPM key, generating it the
+// first time. Without it other users of the TPM could use the key.
+func loadTPMAuthValue(homeDir string) ([]byte, error) {
+	filename := filepath.Join(homeDir, keymasterSubdir,
+		FilePrefix+"-tpm-auth")
+	authValue, err := os.ReadFile(filename)
+	if err == nil {
+		return authValue, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	authValue = make([]byte, 32)
+	if _, err := rand.Read(authValue); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(authValue); err != nil {
+		file.Close()
+		os.Remove(filename)
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+	return authValue, nil
+}
+
+// computeHardware uses the same hardware key for SSH and X.509. There is no
+// Ed25519 key.
+func (s *signers) computeHardware() {
+	defer s.mutex.Unlock()
+	var signer hwkey.Signer
+	var err error
+	switch s.keyPref {
+	case PIVSigner:
+		signer, err = hwkey.NewPIVSigner(hwkey.PIVParams{
+			Serial:      s.hwConfig.PIVSerial,
+			Slot:        s.hwConfig.PIVSlot,
+			TouchPolicy: s.hwConfig.PIVTouchPolicy,
+			PINPrompt:   promptPIVPIN,
+			ReplaceKey:  s.hwConfig.PIVReplaceKey,
+		})
+	case TPMSigner:
+		var authValue []byte
+		authValue, err = loadTPMAuthValue(s.homeDir)
+		if err != nil {
+			break
+		}
+		signer, err = hwkey.NewTPMSigner(hwkey.TPMParams{
+			Name:      FilePrefix,
+			AuthValue: authValue,
+		})
+	default:
+		err = fmt.Errorf("uknown signer preference")
+	}
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.X509 = signer
+	s.SshMain = signer
+}
+
 func (s *signers) compute() {
 	defer s.mutex.Unlock()
 	var err error
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
 )
 
 func TestSignersGenerate(t *testing.T) {
@@ -11,7 +16,8 @@ func TestSignersGenerate(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		signers := makeSigners(keyType)
+		signers := makeSigners(keyType, t.TempDir(),
+			config.HardwareKeyConfig{})
 		err = signers.Wait()
 		if err != nil {
 			t.Fatal(err)
@@ -21,8 +27,34 @@ func TestSignersGenerate(t *testing.T) {
 	}
 }
 
+func TestLoadTPMAuthValue(t *testing.T) {
+	homeDir := t.TempDir()
+	authValue, err := loadTPMAuthValue(homeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authValue) != 32 {
+		t.Fatalf("unexpected auth value length: %d", len(authValue))
+	}
+	fi, err := os.Stat(filepath.Join(homeDir, keymasterSubdir,
+		FilePrefix+"-tpm-auth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode: %s", fi.Mode())
+	}
+	loaded, err := loadTPMAuthValue(homeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(authValue, loaded) {
+		t.Fatal("auth value changed")
+	}
+}
+
 func TestKeyPreferenceFromString(t *testing.T) {
-	GoodKeyPreferences := []string{"rsa", "p256", "p384"}
+	GoodKeyPreferences := []string{"rsa", "p256", "p384", "piv", "tpm"}
 	for _, keyPref := range GoodKeyPreferences {
 		_, err := keyPreferenceFromString(keyPref)
 		if err != nil {
@@ -37,3 +69,16 @@ func TestKeyPreferenceFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyPreferenceIsHardware(t *testing.T) {
+	for keyPref, isHardware := range map[string]bool{
+		"rsa": false, "p256": false, "piv": true, "tpm": true} {
+		keyType, err := keyPreferenceFromString(keyPref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyType.isHardware() != isHardware {
+			t.Errorf("%s: isHardware() != %v", keyPref, isHardware)
+		}
+	}
+}
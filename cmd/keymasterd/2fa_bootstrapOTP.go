@@ -9,6 +9,7 @@ import (
 
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
 )
 
 const (
@@ -78,6 +79,8 @@ func (state *RuntimeState) BootstrapOtpAuthHandler(w http.ResponseWriter,
 		copy(tmp[:], requiredOtpHash)
 		state.logger.Debugf(4, "  input: \"%v\" required: \"%v\"\n",
 			inputOtpHash, tmp)
+		eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypeBootstrapOTP,
+			authData.Username, eventmon.FailureReasonInvalidOTP)
 		state.writeFailureResponse(w, r, http.StatusUnauthorized,
 			"Invalid Bootstrap OTP")
 		return
@@ -96,8 +99,8 @@ func (state *RuntimeState) BootstrapOtpAuthHandler(w http.ResponseWriter,
 			"Failure when validating Boostrap OTP")
 		return
 	}
-	// eventNotifier.PublishBootstrapOtpAuthEvent(eventmon.AuthTypeBootstrapOTP,
-	// authData.Username)
+	eventNotifier.PublishAuthEvent(r, eventmon.AuthTypeBootstrapOTP,
+		authData.Username)
 	// Now we send the user to the appropriate place
 	returnAcceptType := getPreferredAcceptType(r)
 	// TODO: The cert backend should depend also on per user preferences.
@@ -105,7 +108,7 @@ func (state *RuntimeState) BootstrapOtpAuthHandler(w http.ResponseWriter,
 	switch returnAcceptType {
 	case "text/html":
 		loginDestination := getLoginDestination(r)
-		eventNotifier.PublishWebLoginEvent(authData.Username)
+		eventNotifier.PublishWebLoginEvent(r, authData.Username)
 		state.logger.Debugf(0, "redirecting to: %s\n", loginDestination)
 		http.Redirect(w, r, loginDestination, 302)
 	default:
@@ -8,6 +8,7 @@ import (
 	"github.com/Cloud-Foundations/keymaster/lib/authenticators/okta"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
 )
 
 const okta2FAauthPath = "/api/v0/okta2FAAuth"
@@ -39,6 +40,8 @@ func (state *RuntimeState) Okta2FAuthHandler(w http.ResponseWriter, r *http.Requ
 	metricLogAuthOperation(getClientType(r), proto.AuthTypeOkta2FA, valid)
 	if !valid {
 		logger.Printf("Invalid OTP value login for %s", authUser)
+		eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypeOkta,
+			authUser, eventmon.FailureReasonInvalidOTP)
 		// TODO if client is html then do a redirect back to 2FALoginPage
 		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
 		return
@@ -47,8 +50,7 @@ func (state *RuntimeState) Okta2FAuthHandler(w http.ResponseWriter, r *http.Requ
 	// OTP check was  successful
 	logger.Debugf(1, "Successful Okta OTP auth for user: %s", authUser)
 
-	// TODO ADD okta events to eventmond
-	//eventNotifier.PublishVIPAuthEvent(eventmon.VIPAuthTypeOTP, authUser)
+	eventNotifier.PublishAuthEvent(r, eventmon.AuthTypeOkta, authUser)
 
 	_, err = state.updateAuthCookieAuthlevel(w, r, currentAuthLevel|AuthTypeOkta2FA)
 	if err != nil {
@@ -63,7 +65,7 @@ func (state *RuntimeState) Okta2FAuthHandler(w http.ResponseWriter, r *http.Requ
 	switch returnAcceptType {
 	case "text/html":
 		loginDestination := getLoginDestination(r)
-		eventNotifier.PublishWebLoginEvent(authUser)
+		eventNotifier.PublishWebLoginEvent(r, authUser)
 		http.Redirect(w, r, loginDestination, 302)
 	default:
 		w.WriteHeader(200)
@@ -152,8 +154,9 @@ func (state *RuntimeState) oktaPollCheckHandler(w http.ResponseWriter, r *http.R
 	}
 	switch pushResponse {
 	case okta.PushResponseApproved:
-		// TODO: add notification on eventmond
 		metricLogAuthOperation(getClientType(r), proto.AuthTypeOkta2FA, true)
+		eventNotifier.PublishAuthEvent(r, eventmon.AuthTypeOkta,
+			authData.Username)
 		_, err = state.updateAuthCookieAuthlevel(w, r,
 			authData.AuthType|AuthTypeOkta2FA)
 		if err != nil {
@@ -169,6 +172,8 @@ func (state *RuntimeState) oktaPollCheckHandler(w http.ResponseWriter, r *http.R
 		return
 	case okta.PushResponseRejected:
 		metricLogAuthOperation(getClientType(r), proto.AuthTypeOkta2FA, false)
+		eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypeOkta,
+			authData.Username, eventmon.FailureReasonPushRejected)
 		state.writeFailureResponse(w, r, http.StatusForbidden, "Failure when validating OKTA push")
 		return
 	default:
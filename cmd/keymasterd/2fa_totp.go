@@ -19,6 +19,7 @@ import (
 
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
 	"github.com/pquerna/otp/totp"
 )
 
@@ -228,6 +229,8 @@ func (state *RuntimeState) validateNewTOTP(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
+	eventNotifier.PublishTokenRegistrationEvent(r, eventmon.AuthTypeTOTP,
+		"", authUser, authUser)
 	//redirect to profile page?
 	http.Redirect(w, r, profilePath, 302)
 }
@@ -309,6 +312,7 @@ func (state *RuntimeState) totpTokenManagerHandler(w http.ResponseWriter,
 			"bad index Value")
 		return
 	}
+	var deletedTokenName string
 	actionName := r.Form.Get("action")
 	switch actionName {
 	case "Update":
@@ -325,6 +329,7 @@ func (state *RuntimeState) totpTokenManagerHandler(w http.ResponseWriter,
 	case "Enable":
 		profile.TOTPAuthData[tokenIndex].Enabled = true
 	case "Delete":
+		deletedTokenName = profile.TOTPAuthData[tokenIndex].Name
 		delete(profile.TOTPAuthData, tokenIndex)
 	default:
 		state.writeFailureResponse(w, r, http.StatusBadRequest,
@@ -337,6 +342,10 @@ func (state *RuntimeState) totpTokenManagerHandler(w http.ResponseWriter,
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
+	if actionName == "Delete" {
+		eventNotifier.PublishTokenDeletionEvent(r, eventmon.AuthTypeTOTP,
+			deletedTokenName, assumedUser, authData.Username)
+	}
 
 	// Success!
 	returnAcceptType := getPreferredAcceptType(r)
@@ -538,6 +547,8 @@ func (state *RuntimeState) internalTOTPAuthHandler(w http.ResponseWriter, r *htt
 	}
 	if !valid {
 		logger.Printf("Invalid OTP value login for %s", authUser)
+		eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypeTOTP,
+			authUser, eventmon.FailureReasonInvalidOTP)
 		// TODO if client is html then do a redirect back to vipLoginPage
 		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
 		return
@@ -549,6 +560,7 @@ func (state *RuntimeState) internalTOTPAuthHandler(w http.ResponseWriter, r *htt
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "Failure when validating OTP token")
 		return
 	}
+	eventNotifier.PublishAuthEvent(r, eventmon.AuthTypeTOTP, authUser)
 	returnAcceptType := getPreferredAcceptType(r)
 	switch returnAcceptType {
 	case "text/html":
@@ -127,7 +127,7 @@ func TestGenerateNewTOTPSuccess(t *testing.T) {
 	if valid {
 		t.Fatal("should NOT have been valid")
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 
 }
 
@@ -214,7 +214,7 @@ func TestVerifyTOTPHandlerSuccess(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestAuthTOTPHandlerSuccess(t *testing.T) {
@@ -261,7 +261,7 @@ func TestAuthTOTPHandlerSuccess(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestTOTPTokenManagerHandlerUpdateSuccess(t *testing.T) {
@@ -330,5 +330,5 @@ func TestTOTPTokenManagerHandlerUpdateSuccess(t *testing.T) {
 	if profile.TOTPAuthData[0].Name != newName {
 		t.Fatal("update not successul")
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
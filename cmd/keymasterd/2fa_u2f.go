@@ -230,6 +230,8 @@ func (state *RuntimeState) u2fRegisterResponse(w http.ResponseWriter, r *http.Re
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
+	eventNotifier.PublishTokenRegistrationEvent(r, eventmon.AuthTypeU2F,
+		newReg.Name, assumedUser, authData.Username)
 
 	w.Write([]byte("success"))
 }
@@ -370,10 +372,10 @@ func (state *RuntimeState) u2fSignResponse(w http.ResponseWriter, r *http.Reques
 			//profile.U2fAuthChallenge = nil
 			delete(state.localAuthData, authData.Username)
 
-			eventNotifier.PublishAuthEvent(eventmon.AuthTypeU2F, authData.Username)
+			eventNotifier.PublishAuthEvent(r, eventmon.AuthTypeU2F, authData.Username)
 			_, isXHR := r.Header["X-Requested-With"]
 			if isXHR {
-				eventNotifier.PublishWebLoginEvent(authData.Username)
+				eventNotifier.PublishWebLoginEvent(r, authData.Username)
 			}
 			_, err = state.updateAuthCookieAuthlevel(w, r,
 				authData.AuthType|AuthTypeU2F)
@@ -402,10 +404,10 @@ func (state *RuntimeState) u2fSignResponse(w http.ResponseWriter, r *http.Reques
 		if authErr == nil {
 			metricLogAuthOperation(getClientType(r), proto.AuthTypeU2F, true)
 			logger.Debugf(0, "newCounter: %d", newCounter)
-			eventNotifier.PublishAuthEvent(eventmon.AuthTypeU2F, authData.Username)
+			eventNotifier.PublishAuthEvent(r, eventmon.AuthTypeU2F, authData.Username)
 			_, isXHR := r.Header["X-Requested-With"]
 			if isXHR {
-				eventNotifier.PublishWebLoginEvent(authData.Username)
+				eventNotifier.PublishWebLoginEvent(r, authData.Username)
 			}
 			_, err = state.updateAuthCookieAuthlevel(w, r,
 				authData.AuthType|AuthTypeU2F)
@@ -420,6 +422,8 @@ func (state *RuntimeState) u2fSignResponse(w http.ResponseWriter, r *http.Reques
 		}
 	}
 	metricLogAuthOperation(getClientType(r), proto.AuthTypeU2F, false)
+	eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypeU2F,
+		authData.Username, eventmon.FailureReasonInvalidSignature)
 
 	logger.Printf("VerifySignResponse error: %v", err)
 	http.Error(w, "error verifying response", http.StatusInternalServerError)
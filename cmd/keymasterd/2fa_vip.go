@@ -99,6 +99,8 @@ func (state *RuntimeState) VIPAuthHandler(w http.ResponseWriter, r *http.Request
 	metricLogAuthOperation(getClientType(r), proto.AuthTypeSymantecVIP, valid)
 	if !valid {
 		logger.Printf("Invalid VIP OTP value login for %s", authData.Username)
+		eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypeSymantecVIP,
+			authData.Username, eventmon.FailureReasonInvalidOTP)
 		// TODO if client is html then do a redirect back to vipLoginPage
 		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
 		return
@@ -107,7 +109,7 @@ func (state *RuntimeState) VIPAuthHandler(w http.ResponseWriter, r *http.Request
 
 	// OTP check was  successful
 	logger.Debugf(1, "Successful vipOTP auth for user: %s", authData.Username)
-	eventNotifier.PublishVIPAuthEvent(eventmon.VIPAuthTypeOTP, authData.Username)
+	eventNotifier.PublishVIPAuthEvent(r, eventmon.VIPAuthTypeOTP, authData.Username)
 	_, err = state.updateAuthCookieAuthlevel(w, r,
 		authData.AuthType|AuthTypeSymantecVIP)
 	if err != nil {
@@ -124,7 +126,7 @@ func (state *RuntimeState) VIPAuthHandler(w http.ResponseWriter, r *http.Request
 	switch returnAcceptType {
 	case "text/html":
 		loginDestination := getLoginDestination(r)
-		eventNotifier.PublishWebLoginEvent(authData.Username)
+		eventNotifier.PublishWebLoginEvent(r, authData.Username)
 		http.Redirect(w, r, loginDestination, 302)
 	default:
 		w.WriteHeader(200)
@@ -267,7 +269,7 @@ func (state *RuntimeState) VIPPollCheckHandler(w http.ResponseWriter, r *http.Re
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "Failure when validating VIP token")
 		return
 	}
-	eventNotifier.PublishVIPAuthEvent(eventmon.VIPAuthTypePush,
+	eventNotifier.PublishVIPAuthEvent(r, eventmon.VIPAuthTypePush,
 		authData.Username)
 
 	// TODO make something more fancy: JSON?
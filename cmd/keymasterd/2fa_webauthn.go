@@ -176,6 +176,8 @@ func (state *RuntimeState) webauthnFinishRegistration(w http.ResponseWriter, r *
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
+	eventNotifier.PublishTokenRegistrationEvent(r, eventmon.AuthTypeWebAuthn,
+		"", assumedUser, authData.Username)
 	webauthnJsonResponse(w, "Registration Success", http.StatusOK)
 }
 
@@ -354,6 +356,8 @@ func (state *RuntimeState) webauthnAuthFinish(w http.ResponseWriter, r *http.Req
 		_, err = state.webAuthn.ValidateLogin(profile, *localAuth.WebAuthnChallenge, parsedResponse) // iFinishLogin(profile, *localAuth.WebAuthnChallenge, r)
 		if err != nil {
 			logger.Printf("webauthnAuthFinish: auth failure err=%s", err)
+			eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypeWebAuthn,
+				authData.Username, eventmon.FailureReasonVerificationError)
 			webauthnJsonResponse(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -379,6 +383,8 @@ func (state *RuntimeState) webauthnAuthFinish(w http.ResponseWriter, r *http.Req
 		validError := parsedResponse.Verify(session.Challenge, rpID, rpOrigins, rpTopOrigins, protocol.TopOriginAutoVerificationMode, appID, shouldVerifyUser, verifyUserPresence, loginCredential.PublicKey)
 		if validError != nil {
 			logger.Printf("failed to verify webauthn parsedResponse")
+			eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypeU2F,
+				authData.Username, eventmon.FailureReasonInvalidSignature)
 			state.writeFailureResponse(w, r, http.StatusUnauthorized, "Credential Not Found")
 			return
 		}
@@ -402,11 +408,16 @@ func (state *RuntimeState) webauthnAuthFinish(w http.ResponseWriter, r *http.Req
 	delete(state.localAuthData, authData.Username)
 	state.Mutex.Unlock()
 
-	//TODO: distinguish here u2f vs webauthn
-	eventNotifier.PublishAuthEvent(eventmon.AuthTypeU2F, authData.Username)
+	if verifiedAuth == AuthTypeFIDO2 {
+		eventNotifier.PublishAuthEvent(r, eventmon.AuthTypeWebAuthn,
+			authData.Username)
+	} else {
+		eventNotifier.PublishAuthEvent(r, eventmon.AuthTypeU2F,
+			authData.Username)
+	}
 	_, isXHR := r.Header["X-Requested-With"]
 	if isXHR {
-		eventNotifier.PublishWebLoginEvent(authData.Username)
+		eventNotifier.PublishWebLoginEvent(r, authData.Username)
 	}
 
 	_, err = state.updateAuthCookieAuthlevel(w, r,
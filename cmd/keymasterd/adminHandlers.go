@@ -15,6 +15,8 @@ const usersPath = "/users/"
 const addUserPath = "/admin/addUser"
 const deleteUserPath = "/admin/deleteUser"
 const generateBoostrapOTPPath = "/admin/newBoostrapOTP"
+const idpKillSessionsPath = "/admin/killIdPSessions"
+const rekeyProfilesPath = "/admin/rekeyProfiles"
 
 const defaultBootstrapOTPDuration = 6 * time.Hour
 const maximumBootstrapOTPDuration = 24 * time.Hour
@@ -116,7 +118,8 @@ func (state *RuntimeState) usersHandler(w http.ResponseWriter,
 
 func (state *RuntimeState) addUserHandler(w http.ResponseWriter,
 	r *http.Request) {
-	if failure, _ := state.sendFailureToClientIfNonAdmin(w, r); failure {
+	failure, authData := state.sendFailureToClientIfNonAdmin(w, r)
+	if failure {
 		return
 	}
 	username := state.ensurePostAndGetUsername(w, r)
@@ -145,6 +148,7 @@ func (state *RuntimeState) addUserHandler(w http.ResponseWriter,
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		return
 	}
+	eventNotifier.PublishUserAddEvent(r, username, authData.Username)
 	// If html then redirect to users page, else return json OK.
 	preferredAcceptType := getPreferredAcceptType(r)
 	switch preferredAcceptType {
@@ -158,7 +162,8 @@ func (state *RuntimeState) addUserHandler(w http.ResponseWriter,
 
 func (state *RuntimeState) deleteUserHandler(w http.ResponseWriter,
 	r *http.Request) {
-	if failure, _ := state.sendFailureToClientIfNonAdmin(w, r); failure {
+	failure, authData := state.sendFailureToClientIfNonAdmin(w, r)
+	if failure {
 		return
 	}
 	username := state.ensurePostAndGetUsername(w, r)
@@ -170,6 +175,7 @@ func (state *RuntimeState) deleteUserHandler(w http.ResponseWriter,
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		return
 	}
+	eventNotifier.PublishUserDeleteEvent(r, username, authData.Username)
 	preferredAcceptType := getPreferredAcceptType(r)
 	switch preferredAcceptType {
 	case "text/html":
@@ -279,6 +285,8 @@ func (state *RuntimeState) generateBootstrapOTP(w http.ResponseWriter,
 	state.logger.Debugf(0,
 		"%s: generated bootstrap OTP for: %s, duration: %s, hash: %x\n",
 		authData.Username, username, duration, bootstrapOtpHash)
+	eventNotifier.PublishBootstrapOTPGenerationEvent(r, username,
+		authData.Username)
 	returnAcceptType := getPreferredAcceptType(r)
 	switch returnAcceptType {
 	case "text/html":
@@ -297,3 +305,50 @@ func (state *RuntimeState) generateBootstrapOTP(w http.ResponseWriter,
 	}
 	return
 }
+
+// rekeyProfilesHandler starts re-encrypting all the profiles with new data
+// keys, for example after a data key may have been exposed.
+func (state *RuntimeState) rekeyProfilesHandler(w http.ResponseWriter,
+	r *http.Request) {
+	failure, authData := state.sendFailureToClientIfNonAdmin(w, r)
+	if failure {
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if state.encryptedProfileStore == nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Profile encryption not enabled")
+		return
+	}
+	state.Mutex.Lock()
+	running := state.profileRekeyRunning
+	state.profileRekeyRunning = true
+	state.Mutex.Unlock()
+	if running {
+		state.writeFailureResponse(w, r, http.StatusConflict,
+			"Rekey already running")
+		return
+	}
+	go state.rekeyProfiles(authData.Username)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Rekey started\n")
+}
+
+func (state *RuntimeState) rekeyProfiles(adminUsername string) {
+	defer func() {
+		state.Mutex.Lock()
+		state.profileRekeyRunning = false
+		state.Mutex.Unlock()
+	}()
+	numProfiles, err := state.encryptedProfileStore.Rekey()
+	if err != nil {
+		state.logger.Printf("Rekey by admin=%s failed after %d profiles: %s",
+			adminUsername, numProfiles, err)
+		return
+	}
+	state.logger.Printf("Rekey by admin=%s re-encrypted %d profiles",
+		adminUsername, numProfiles)
+}
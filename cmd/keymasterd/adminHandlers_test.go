@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -105,7 +106,7 @@ func TestAuthNoTLS(t *testing.T) {
 	if authData.Username != "" {
 		t.Errorf("expected no username, got: %s", authData.Username)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestAuthCertAdminUser(t *testing.T) {
@@ -129,7 +130,7 @@ func TestAuthCertAdminUser(t *testing.T) {
 	if authData.Username != "alice" {
 		t.Fatalf("unexpected username: alice, got: %s", authData.Username)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestAuthCertPlainUser(t *testing.T) {
@@ -153,7 +154,7 @@ func TestAuthCertPlainUser(t *testing.T) {
 	if authData != nil {
 		t.Errorf("expected no authData, got: %v", authData)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestAuthCertFakeAdminUser(t *testing.T) {
@@ -177,7 +178,7 @@ func TestAuthCertFakeAdminUser(t *testing.T) {
 	if authData != nil {
 		t.Errorf("expected no authData, got: %v", authData)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestEnsurePostAndGetUsernameNotPost(t *testing.T) {
@@ -201,7 +202,7 @@ func TestEnsurePostAndGetUsernameNotPost(t *testing.T) {
 	if username != "" {
 		t.Errorf("expected no username, got: %s", username)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestEnsurePostAndGetUsernameNoUsername(t *testing.T) {
@@ -225,7 +226,7 @@ func TestEnsurePostAndGetUsernameNoUsername(t *testing.T) {
 	if username != "" {
 		t.Errorf("expected no username, got: %s", username)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestEnsurePostAndGetUsernameBadUsername(t *testing.T) {
@@ -251,7 +252,7 @@ func TestEnsurePostAndGetUsernameBadUsername(t *testing.T) {
 	if username != "" {
 		t.Errorf("expected no username, got: %s", username)
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestGenerateBootstrapOtpNotAdminUser(t *testing.T) {
@@ -274,7 +275,7 @@ func TestGenerateBootstrapOtpNotAdminUser(t *testing.T) {
 		t.Errorf("unexpected status code: %d, status: %s, body: %s",
 			resp.StatusCode, resp.Status, string(body))
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestGenerateBootstrapOtpAdminUser(t *testing.T) {
@@ -314,5 +315,60 @@ func TestGenerateBootstrapOtpAdminUser(t *testing.T) {
 	if len(profile.BootstrapOTP.Sha512Hash) < 1 {
 		t.Error("got empty Bootstrap OTP hash")
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
+}
+
+func TestRekeyProfiles(t *testing.T) {
+	state, tmpdir, err := testCreateRuntimeStateWithBothCAs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer state.profileStore.Close()
+	username := "target"
+	profile := &userProfile{}
+	if err := state.SaveUserProfile(username, profile); err != nil {
+		t.Fatal(err)
+	}
+	plainStore := state.profileStore
+	plainData, _, _, err := plainStore.LoadProfile(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.ProfileStorage.Encryption.Enabled = true
+	if err := state.initProfileEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.setProfileKeyWrapper(); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	w := &instrumentedwriter.LoggingWriter{ResponseWriter: recorder}
+	req := httptest.NewRequest("POST", rekeyProfilesPath, nil)
+	req.TLS, err = testMakeConnectionState("testdata/alice.pem",
+		"testdata/KeymasterCA.pem")
+	state.rekeyProfilesHandler(w, req)
+	if resp := recorder.Result(); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	for running := true; running; {
+		time.Sleep(time.Millisecond * 10)
+		state.Mutex.Lock()
+		running = state.profileRekeyRunning
+		state.Mutex.Unlock()
+	}
+	encryptedData, _, _, err := plainStore.LoadProfile(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(encryptedData, plainData) {
+		t.Fatal("profile not encrypted")
+	}
+	_, ok, _, err := state.LoadUserProfile(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("profile not found")
+	}
 }
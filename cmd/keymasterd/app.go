@@ -6,7 +6,6 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"database/sql"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
@@ -49,6 +48,8 @@ import (
 	"github.com/Cloud-Foundations/keymaster/lib/certgen"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 	"github.com/Cloud-Foundations/keymaster/lib/paths"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/encryptedstore"
 	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
 	"github.com/Cloud-Foundations/keymaster/lib/server/aws_identity_cert"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
@@ -161,6 +162,8 @@ type userProfile struct {
 	DisplayName         string
 	Username            string
 	WebauthnSessionData *webauthn.SessionData
+
+	IdPConsents map[string]*idpConsentData
 }
 
 type localUserData struct {
@@ -199,6 +202,8 @@ type RuntimeState struct {
 	HostIdentity                 string
 	KerberosRealm                *string
 	caCertDer                    [][]byte
+	tenantCAs                    map[string]*tenantCA
+	kubernetesClusters           []proto.KubernetesCluster
 	selfRoleCaCertDer            []byte
 	certManager                  *certmanager.CertificateManager
 	vipPushCookie                map[string]pushPollTransaction
@@ -209,12 +214,12 @@ type RuntimeState struct {
 	Mutex                        sync.Mutex
 	gitDB                        *gitdb.UserInfo
 	pendingOauth2                map[string]pendingAuth2Request
-	storageRWMutex               sync.RWMutex
-	db                           *sql.DB
-	dbType                       string
-	cacheDB                      *sql.DB
-	dbDone                       chan struct{}
-	remoteDBQueryTimeout         time.Duration
+	profileStore                 profilestore.ProfileStore
+	encryptedProfileStore        *encryptedstore.Store
+	profileKMSKeyWrapper         encryptedstore.KeyWrapper
+	profilePreviousKeyWrappers   []encryptedstore.KeyWrapper
+	profileSealedCAKeyFilenames  []string
+	profileRekeyRunning          bool // Protected by Mutex.
 	htmlTemplate                 *htmltemplate.Template
 	passwordChecker              pwauth.PasswordAuthenticator
 	KeymasterPublicKeys          []crypto.PublicKey
@@ -226,6 +231,11 @@ type RuntimeState struct {
 	totpLocalRateLimit           map[string]totpRateLimitInfo
 	totpLocalTateLimitMutex      sync.Mutex
 	websshauthenticator          *sshcertauth.Authenticator
+	idpSessions                  map[string]map[string]idpClientSession
+	idpPairwiseSecret            []byte
+	idpClientJWKS                *jwksCache
+	idpBackChannelLogoutClient   *http.Client
+	unsealShares                 *unsealShareCollector
 	logger                       log.DebugLogger
 }
 
@@ -404,6 +414,7 @@ func (state *RuntimeState) performStateCleanup(secsBetweenCleanup int) {
 			}
 
 		}
+		state.idpCleanupExpiredSessions()
 
 		state.Mutex.Unlock()
 		logger.Debugf(3, "Pending Cookie sizes: before(%d) after(%d)",
@@ -1071,8 +1082,11 @@ func (state *RuntimeState) publicPathHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	target := r.URL.Path[len(publicPath):]
+	if strings.HasPrefix(target, tenantCAPublicPrefix) {
+		state.tenantCAPublicHandler(w, r, target[len(tenantCAPublicPrefix):])
+		return
+	}
 
-	caPubMaxSeconds := 30
 	switch target {
 	case "loginForm":
 		//fmt.Fprintf(w, "%s", loginFormText)
@@ -1080,52 +1094,65 @@ func (state *RuntimeState) publicPathHandler(w http.ResponseWriter, r *http.Requ
 		state.writeHTMLLoginPage(w, r, 200, "", profilePath, "")
 		return
 	case "x509ca":
-		var outCABuf bytes.Buffer
-		for _, derCert := range state.caCertDer {
-			err := pem.Encode(&outCABuf, &pem.Block{Type: "CERTIFICATE", Bytes: derCert})
-			if err != nil {
-				state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
-				logger.Printf("Error computing pemCA")
-				return
-			}
-		}
-		w.Header().Add("Cache-Control",
-			fmt.Sprintf("max-age=%d, public, must-revalidate, proxy-revalidate",
-				caPubMaxSeconds))
-		w.Header().Set("Content-Disposition", `attachment; filename=keymasterx509CA.pem"`)
-		w.WriteHeader(200)
-		outCABuf.WriteTo(w)
+		state.writeX509CAs(w, r, state.caCertDer, "keymasterx509CA.pem")
 	case "sshca":
-		var outCABuf bytes.Buffer
-		for _, pub := range state.KeymasterPublicKeys {
-			sshPub, err := ssh.NewPublicKey(pub)
-			if err != nil {
-				state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
-				logger.Printf("Error computing sshCA")
-				return
-			}
-			pubBytes := ssh.MarshalAuthorizedKey(sshPub)
-			_, err = fmt.Fprintf(&outCABuf, "%s", pubBytes)
-			if err != nil {
-				state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
-				logger.Printf("Error computing sshCA")
-				return
-			}
-
-		}
-		w.Header().Add("Cache-Control",
-			fmt.Sprintf("max-age=%d, public, must-revalidate, proxy-revalidate",
-				caPubMaxSeconds))
-		w.Header().Set("Content-Disposition", `attachment; filename=keymastersshCCA.pub"`)
-		w.WriteHeader(200)
-		outCABuf.WriteTo(w)
-
+		state.writeSSHCAs(w, r, state.KeymasterPublicKeys,
+			"keymastersshCCA.pub")
 	default:
 		state.writeFailureResponse(w, r, http.StatusNotFound, "")
 		return
 	}
 }
 
+const caPubMaxSeconds = 30
+
+func (state *RuntimeState) writeX509CAs(w http.ResponseWriter,
+	r *http.Request, caCertDers [][]byte, filename string) {
+	var outCABuf bytes.Buffer
+	for _, derCert := range caCertDers {
+		err := pem.Encode(&outCABuf, &pem.Block{Type: "CERTIFICATE", Bytes: derCert})
+		if err != nil {
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			logger.Printf("Error computing pemCA")
+			return
+		}
+	}
+	w.Header().Add("Cache-Control",
+		fmt.Sprintf("max-age=%d, public, must-revalidate, proxy-revalidate",
+			caPubMaxSeconds))
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(200)
+	outCABuf.WriteTo(w)
+}
+
+func (state *RuntimeState) writeSSHCAs(w http.ResponseWriter,
+	r *http.Request, publicKeys []crypto.PublicKey, filename string) {
+	var outCABuf bytes.Buffer
+	for _, pub := range publicKeys {
+		sshPub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			logger.Printf("Error computing sshCA")
+			return
+		}
+		pubBytes := ssh.MarshalAuthorizedKey(sshPub)
+		_, err = fmt.Fprintf(&outCABuf, "%s", pubBytes)
+		if err != nil {
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			logger.Printf("Error computing sshCA")
+			return
+		}
+	}
+	w.Header().Add("Cache-Control",
+		fmt.Sprintf("max-age=%d, public, must-revalidate, proxy-revalidate",
+			caPubMaxSeconds))
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(200)
+	outCABuf.WriteTo(w)
+}
+
 func (state *RuntimeState) userHasU2FTokens(username string) (bool, error) {
 	profile, ok, _, err := state.LoadUserProfile(username)
 	if err != nil {
@@ -1258,6 +1285,8 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter,
 		return
 	}
 	if !valid {
+		eventNotifier.PublishAuthFailureEvent(r, eventmon.AuthTypePassword,
+			username, eventmon.FailureReasonInvalidPassword)
 		state.writeFailureResponse(w, r, http.StatusUnauthorized,
 			"Invalid Username/Password")
 		logger.Printf("Invalid login for %s", username)
@@ -1279,7 +1308,7 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter,
 		logger.Println(err)
 		return
 	}
-	eventNotifier.PublishAuthEvent(eventmon.AuthTypePassword, username)
+	eventNotifier.PublishAuthEvent(r, eventmon.AuthTypePassword, username)
 	returnAcceptType := "application/json"
 	acceptHeader, ok := r.Header["Accept"]
 	if ok {
@@ -1298,7 +1327,10 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter,
 		return
 	}
 	if !fromCache {
-		state.trySelfServiceGenerateBootstrapOTP(username, profile)
+		if state.trySelfServiceGenerateBootstrapOTP(username, profile) {
+			eventNotifier.PublishBootstrapOTPGenerationEvent(r, username,
+				username)
+		}
 	}
 	userHasBootstrapOTP := len(state.userBootstrapOtpHash(profile,
 		fromCache)) > 0
@@ -1334,7 +1366,7 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter,
 		loginDestination := getLoginDestination(r)
 		requiredAuth := state.getRequiredWebUIAuthLevel()
 		if (requiredAuth & AuthTypePassword) != 0 {
-			eventNotifier.PublishWebLoginEvent(username)
+			eventNotifier.PublishWebLoginEvent(r, username)
 			http.Redirect(w, r, loginDestination, 302)
 		} else {
 			//Go 2FA
@@ -1389,39 +1421,34 @@ func (state *RuntimeState) logoutHandler(w http.ResponseWriter,
 	if state.sendFailureToClientIfLocked(w, r) {
 		return
 	}
-	//TODO: check for CSRF (simple way: makeit post only)
-	// We first check for cookies
-	var authCookie *http.Cookie
-	for _, cookie := range r.Cookies() {
-		if cookie.Name != authCookieName {
-			continue
-		}
-		authCookie = cookie
+	if err := r.ParseForm(); err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, "Invalid form")
+		return
 	}
-	var loginUser string
-	if authCookie != nil {
-		info, err := state.getAuthInfoFromAuthJWT(authCookie.Value)
-		if err == nil {
-			loginUser = info.Username
+	loginUser := state.getAuthCookieUsername(r)
+	redirectURL := "/"
+	if loginUser != "" {
+		redirectURL = fmt.Sprintf("/?user=%s", loginUser)
+		// Logging out also ends the relying party sessions, so it must be
+		// confirmed with a logout token: otherwise any site could log users
+		// out of all the connected applications.
+		logoutToken := r.Form.Get("logout_token")
+		if r.Method != "POST" || logoutToken == "" {
+			state.idpRenderLogoutConfirmation(w, r, logoutPath, loginUser,
+				redirectURL)
+			return
 		}
-		expiration := time.Unix(0, 0)
-		updatedAuthCookie := http.Cookie{
-			Name:     authCookieName,
-			Value:    "",
-			Expires:  expiration,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteNoneMode,
+		err := state.idpVerifyLogoutToken(logoutToken, loginUser, redirectURL)
+		if err != nil {
+			logger.Debugf(1, "invalid logout token: %s", err)
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid logout token")
+			return
 		}
-		http.SetCookie(w, &updatedAuthCookie)
-	}
-	//redirect to login
-	if loginUser == "" {
-		http.Redirect(w, r, "/", 302)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/?user=%s", loginUser), 302)
 	}
+	state.expireAuthCookie(w, r)
+	//redirect to login, after terminating the relying party sessions
+	state.idpTerminateUserSessions(w, r, loginUser, redirectURL)
 }
 
 func (state *RuntimeState) _IsAdminUser(user string) (bool, error) {
@@ -1580,6 +1607,18 @@ func (state *RuntimeState) profileHandler(w http.ResponseWriter, r *http.Request
 		totpdevices = append(totpdevices, deviceData)
 	}
 	showTOTP := state.Config.Base.EnableLocalTOTP
+	var idpConsents []idpConsentDisplayInfo
+	for clientID, consent := range profile.IdPConsents {
+		idpConsents = append(idpConsents, idpConsentDisplayInfo{
+			ClientID:   clientID,
+			Scopes:     strings.Join(consent.Scopes, " "),
+			Audiences:  strings.Join(consent.Audiences, " "),
+			ApprovedAt: consent.ApprovedAt,
+		})
+	}
+	sort.Slice(idpConsents, func(i, j int) bool {
+		return idpConsents[i].ClientID < idpConsents[j].ClientID
+	})
 
 	displayData := profilePageTemplateData{
 		Username:             assumedUser,
@@ -1594,6 +1633,7 @@ func (state *RuntimeState) profileHandler(w http.ResponseWriter, r *http.Request
 		RegisteredU2FToken:   u2fdevices,
 		ShowTOTP:             showTOTP,
 		RegisteredTOTPDevice: totpdevices,
+		IdPConsents:          idpConsents,
 	}
 	if time.Until(profile.BootstrapOTP.ExpiresAt) > 0 &&
 		len(profile.BootstrapOTP.Sha512Hash) >= 4 {
@@ -1685,6 +1725,7 @@ func (state *RuntimeState) u2fTokenManagerHandler(w http.ResponseWriter, r *http
 
 	}
 
+	var deletedAuthType, deletedTokenName string
 	actionName := r.Form.Get("action")
 	switch actionName {
 	case "Update":
@@ -1714,8 +1755,12 @@ func (state *RuntimeState) u2fTokenManagerHandler(w http.ResponseWriter, r *http
 		}
 	case "Delete":
 		if ok {
+			deletedAuthType = eventmon.AuthTypeU2F
+			deletedTokenName = profile.U2fAuthData[tokenIndex].Name
 			delete(profile.U2fAuthData, tokenIndex)
 		} else {
+			deletedAuthType = eventmon.AuthTypeWebAuthn
+			deletedTokenName = profile.WebauthnData[tokenIndex].Name
 			delete(profile.WebauthnData, tokenIndex)
 		}
 	default:
@@ -1729,6 +1774,10 @@ func (state *RuntimeState) u2fTokenManagerHandler(w http.ResponseWriter, r *http
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
+	if deletedAuthType != "" {
+		eventNotifier.PublishTokenDeletionEvent(r, deletedAuthType,
+			deletedTokenName, assumedUser, authData.Username)
+	}
 
 	// Success!
 	returnAcceptType := getPreferredAcceptType(r)
@@ -1804,6 +1853,9 @@ func (state *RuntimeState) setupServiceMux() (*http.ServeMux, error) {
 	var err error
 	serviceMux := http.NewServeMux()
 	serviceMux.HandleFunc(certgenPath, state.certGenHandler)
+	if len(state.Config.TenantCAs) > 0 {
+		serviceMux.HandleFunc(tenantCAPath, state.certGenHandler)
+	}
 	serviceMux.HandleFunc(publicPath, state.publicPathHandler)
 	serviceMux.HandleFunc(proto.LoginPath, state.loginHandler)
 	serviceMux.HandleFunc(logoutPath, state.logoutHandler)
@@ -1814,6 +1866,8 @@ func (state *RuntimeState) setupServiceMux() (*http.ServeMux, error) {
 	//TODO: should enable only if bootraptop is enabled
 	serviceMux.HandleFunc(generateBoostrapOTPPath,
 		state.generateBootstrapOTP)
+	serviceMux.HandleFunc(idpKillSessionsPath, state.idpKillSessionsHandler)
+	serviceMux.HandleFunc(rekeyProfilesPath, state.rekeyProfilesHandler)
 
 	serviceMux.HandleFunc(idpOpenIDCConfigurationDocumentPath,
 		state.idpOpenIDCDiscoveryHandler)
@@ -1825,6 +1879,10 @@ func (state *RuntimeState) setupServiceMux() (*http.ServeMux, error) {
 		state.idpOpenIDCTokenHandler)
 	serviceMux.HandleFunc(idpOpenIDCUserinfoPath,
 		state.idpOpenIDCUserinfoHandler)
+	serviceMux.HandleFunc(idpOpenIDCEndSessionPath,
+		state.idpOpenIDCEndSessionHandler)
+	serviceMux.HandleFunc(idpConsentManagementPath,
+		state.idpConsentManagerHandler)
 
 	staticFilesPath :=
 		filepath.Join(state.Config.Base.SharedDataDirectory,
@@ -1863,6 +1921,8 @@ func (state *RuntimeState) setupServiceMux() (*http.ServeMux, error) {
 	serviceMux.HandleFunc(redirectPath, state.oauth2RedirectPathHandler)
 	serviceMux.HandleFunc(clientConfHandlerPath,
 		state.serveClientConfHandler)
+	serviceMux.HandleFunc(proto.KubernetesClustersPath,
+		state.kubernetesClustersHandler)
 	serviceMux.HandleFunc(vipPushStartPath, state.vipPushStartHandler)
 	serviceMux.HandleFunc(vipPollCheckPath, state.VIPPollCheckHandler)
 	serviceMux.HandleFunc(totpGeneratNewPath, state.GenerateNewTOTP)
@@ -1952,13 +2012,22 @@ func main() {
 		return
 	}
 
-	// TODO(rgooch): Pass this in rather than use a global variable.
-	eventNotifier = eventnotifier.New(logger)
 	runtimeState, err := loadVerifyConfigFile(*configFilename, logger)
 	if err != nil {
 		logger.Println(err)
 		os.Exit(1)
 	}
+	// TODO(rgooch): Pass this in rather than use a global variable.
+	eventNotifier, err = eventnotifier.New(eventnotifier.Params{
+		Logger:        logger,
+		HistoryLength: runtimeState.Config.Base.EventHistoryLength,
+		StreamIDFilename: filepath.Join(runtimeState.Config.Base.DataDirectory,
+			"eventmon-stream-id"),
+	})
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
 	logger.Debugf(3, "After load verify")
 
 	publicLogs := runtimeState.Config.Base.PublicLogs
@@ -1984,6 +2053,8 @@ func main() {
 	http.Handle("/", adminDashboard)
 	http.Handle("/prometheus_metrics", promhttp.Handler()) //lint:ignore SA1019 TODO: newer prometheus handler
 	http.HandleFunc(secretInjectorPath, runtimeState.secretInjectorHandler)
+	http.HandleFunc(secretShareInjectorPath,
+		runtimeState.secretShareInjectorHandler)
 	http.HandleFunc(readyzPath, runtimeState.readyzHandler)
 
 	serviceMux, err := runtimeState.setupServiceMux()
@@ -2040,6 +2111,9 @@ func main() {
 	if isReady != true {
 		panic("got bad signer ready data")
 	}
+	if err := runtimeState.setProfileKeyWrapper(); err != nil {
+		logger.Fatalf("Cannot encrypt profiles: %s", err)
+	}
 
 	if len(runtimeState.Config.Ldap.LDAPTargetURLs) > 0 && !runtimeState.Config.Ldap.DisablePasswordCache {
 		err = runtimeState.passwordChecker.UpdateStorage(runtimeState)
@@ -2094,6 +2168,7 @@ func main() {
 	}
 
 	http.Handle(eventmon.HttpPath, eventNotifier)
+	http.Handle(eventmon.HttpPathV1, eventNotifier)
 	go func() {
 		time.Sleep(time.Millisecond * 10)
 		healthserver.SetReady()
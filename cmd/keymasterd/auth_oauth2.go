@@ -191,7 +191,7 @@ func (state *RuntimeState) oauth2RedirectPathHandler(w http.ResponseWriter,
 	state.Mutex.Lock()
 	delete(state.pendingOauth2, index)
 	state.Mutex.Unlock()
-	eventNotifier.PublishWebLoginEvent(username)
+	eventNotifier.PublishWebLoginEvent(r, username)
 	loginDestination := pending.loginDestination
 	if loginDestination == "" {
 		// Nowhere else to go: go to profile page.
@@ -40,14 +40,9 @@ func prependGroups(groups []string, prefix string) []string {
 
 func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request) {
 	var signerIsNull bool
-	var keySigner crypto.Signer
 
-	// copy runtime singer if not nil
 	state.Mutex.Lock()
 	signerIsNull = (state.Signer == nil)
-	if !signerIsNull {
-		keySigner = state.Signer
-	}
 	state.Mutex.Unlock()
 
 	//local sanity tests
@@ -117,7 +112,11 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	targetUser := r.URL.Path[len(certgenPath):]
+	requestedCA, targetUser, ok := parseCertgenPath(r.URL.Path)
+	if !ok {
+		state.writeFailureResponse(w, r, http.StatusNotFound, "")
+		return
+	}
 	if authData.Username != targetUser {
 		state.writeFailureResponse(w, r, http.StatusForbidden, "")
 		logger.Debugf(1, "User %s asking for creds for %s",
@@ -173,15 +172,30 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 	}
 	logger.Debugf(1, "cert type =%s", certType)
 
+	if requestedCA == "" {
+		requestedCA = r.Form.Get("ca_profile")
+	}
+	issuer, userErr, err := state.getCertIssuer(targetUser, requestedCA)
+	if err != nil {
+		logger.Printf("Cannot get CA for %s: %s", targetUser, err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if userErr != nil {
+		logger.Debugf(1, "CA selection for %s failed: %s", targetUser, userErr)
+		state.writeFailureResponse(w, r, http.StatusForbidden, userErr.Error())
+		return
+	}
+
 	switch certType {
 	case "ssh":
-		state.postAuthSSHCertHandler(w, r, targetUser, duration)
+		state.postAuthSSHCertHandler(w, r, targetUser, issuer, duration)
 		return
 	case "x509":
-		state.postAuthX509CertHandler(w, r, targetUser, keySigner, duration, false)
+		state.postAuthX509CertHandler(w, r, targetUser, issuer, duration, false)
 		return
 	case "x509-kubernetes":
-		state.postAuthX509CertHandler(w, r, targetUser, keySigner, duration, true)
+		state.postAuthX509CertHandler(w, r, targetUser, issuer, duration, true)
 		return
 	default:
 		state.writeFailureResponse(w, r, http.StatusBadRequest, "Unrecognized cert type")
@@ -251,7 +265,7 @@ func (state *RuntimeState) getSignerX509CAForPublic(pub interface{}) (crypto.Sig
 
 func (state *RuntimeState) postAuthSSHCertHandler(
 	w http.ResponseWriter, r *http.Request, targetUser string,
-	duration time.Duration) {
+	issuer *certIssuer, duration time.Duration) {
 
 	var certString string
 	var cert ssh.Certificate
@@ -285,14 +299,14 @@ func (state *RuntimeState) postAuthSSHCertHandler(
 	var cryptoSigner crypto.Signer
 	switch sshUserPublicKey.Type() {
 	case ssh.KeyAlgoED25519:
-		if state.Ed25519Signer == nil {
+		if issuer.ed25519Signer == nil {
 			logger.Printf("requesting an Ed25519 cert, but no such ca defined")
 			state.writeFailureResponse(w, r, http.StatusUnprocessableEntity, "key type not allowed")
 			return
 		}
-		cryptoSigner = state.Ed25519Signer
+		cryptoSigner = issuer.ed25519Signer
 	default:
-		cryptoSigner = state.Signer
+		cryptoSigner = issuer.signer
 	}
 	signer, err := ssh.NewSignerFromSigner(cryptoSigner)
 	if err != nil {
@@ -313,15 +327,15 @@ func (state *RuntimeState) postAuthSSHCertHandler(
 		return
 	}
 
-	eventNotifier.PublishSSH(cert.Marshal())
+	eventNotifier.PublishSSH(r, cert.Marshal())
 	metricLogCertDuration("ssh", "granted", float64(duration.Seconds()))
 	clientIpAddress := util.GetRequestRealIp(r)
 
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+cert.Type()+"-cert.pub\"")
 	w.WriteHeader(200)
 	fmt.Fprintf(w, "%s", certString)
-	logger.Printf("Generated SSH Certificate for %s (from %s) . Serial: %d",
-		targetUser, clientIpAddress, cert.Serial)
+	logger.Printf("Generated SSH Certificate for %s (from %s)%s. Serial: %d",
+		targetUser, clientIpAddress, issuer.logSuffix(), cert.Serial)
 	go func(username string, certType string) {
 		metricsMutex.Lock()
 		defer metricsMutex.Unlock()
@@ -394,7 +408,7 @@ func (state *RuntimeState) getServiceMethods(username string) (
 
 func (state *RuntimeState) postAuthX509CertHandler(
 	w http.ResponseWriter, r *http.Request, targetUser string,
-	keySigner crypto.Signer, duration time.Duration,
+	issuer *certIssuer, duration time.Duration,
 	kubernetesHack bool) {
 
 	var userGroups, groups []string
@@ -465,13 +479,8 @@ func (state *RuntimeState) postAuthX509CertHandler(
 		logger.Printf("Invalid File, Check Key strength/key type")
 		return
 	}
-	signer, caCertDer, err := state.getSignerX509CAForPublic(userPub)
-	if err != nil {
-		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
-		logger.Printf("Error Finding Cert for public key: %s\n data", err)
-		return
-	}
-	caCert, err := x509.ParseCertificate(caCertDer)
+	signer := issuer.signer
+	caCert, err := x509.ParseCertificate(issuer.caCertDer)
 	if err != nil {
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		logger.Printf("Cannot parse CA Der: %s\n data", err)
@@ -492,7 +501,7 @@ func (state *RuntimeState) postAuthX509CertHandler(
 		return
 	}
 
-	eventNotifier.PublishX509(derCert)
+	eventNotifier.PublishX509(r, derCert)
 	cert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
 		Bytes: derCert}))
 
@@ -503,8 +512,9 @@ func (state *RuntimeState) postAuthX509CertHandler(
 	w.Header().Set("Content-Disposition", `attachment; filename="userCert.pem"`)
 	w.WriteHeader(200)
 	fmt.Fprintf(w, "%s", cert)
-	logger.Printf("Generated x509 Certificate for %s (from %s). Serial: %s",
-		targetUser, clientIpAddress, parsedCert.SerialNumber.String())
+	logger.Printf("Generated x509 Certificate for %s (from %s)%s. Serial: %s",
+		targetUser, clientIpAddress, issuer.logSuffix(),
+		parsedCert.SerialNumber.String())
 	go func(username string, certType string) {
 		metricsMutex.Lock()
 		defer metricsMutex.Unlock()
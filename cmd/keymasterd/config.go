@@ -11,7 +11,6 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -21,7 +20,6 @@ import (
 	"math/big"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -39,11 +37,14 @@ import (
 	"github.com/Cloud-Foundations/keymaster/keymasterd/admincache"
 	"github.com/Cloud-Foundations/keymaster/lib/authenticators/okta"
 	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/raftstore"
 	"github.com/Cloud-Foundations/keymaster/lib/pwauth/command"
 	"github.com/Cloud-Foundations/keymaster/lib/pwauth/htpassword"
 	"github.com/Cloud-Foundations/keymaster/lib/pwauth/ldap"
 	"github.com/Cloud-Foundations/keymaster/lib/server/aws_identity_cert"
 	"github.com/Cloud-Foundations/keymaster/lib/signers/kmssigner"
+	"github.com/Cloud-Foundations/keymaster/lib/signers/pkcs11signer"
+	"github.com/Cloud-Foundations/keymaster/lib/signers/remotesigner"
 	"github.com/Cloud-Foundations/keymaster/lib/signers/yksigner"
 	"github.com/Cloud-Foundations/keymaster/lib/vip"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
@@ -62,6 +63,11 @@ type autoUnseal struct {
 	AwsSecretKey string `yaml:"aws_secret_key"`
 }
 
+type splitKeyUnseal struct {
+	RequiredShares int           `yaml:"required_shares"`
+	ShareTimeout   time.Duration `yaml:"share_timeout"`
+}
+
 type sshExtension struct {
 	Key   string `yaml:"key"`
 	Value string `yaml:"value"`
@@ -81,6 +87,7 @@ type baseConfig struct {
 	SSHCAFilename                   string               `yaml:"ssh_ca_filename"`
 	Ed25519CAFilename               string               `yaml:"ed25519_ca_keyfilename"`
 	AutoUnseal                      autoUnseal           `yaml:"auto_unseal"`
+	SplitKeyUnseal                  splitKeyUnseal       `yaml:"split_key_unseal"`
 	HtpasswdFilename                string               `yaml:"htpasswd_filename"`
 	ExternalAuthCmd                 string               `yaml:"external_auth_command"`
 	ClientCAFilename                string               `yaml:"client_ca_filename"`
@@ -88,6 +95,7 @@ type baseConfig struct {
 	HostIdentity                    string               `yaml:"host_identity"`
 	KerberosRealm                   string               `yaml:"kerberos_realm"`
 	DataDirectory                   string               `yaml:"data_directory"`
+	EventHistoryLength              uint                 `yaml:"event_history_length"`
 	SharedDataDirectory             string               `yaml:"shared_data_directory"`
 	AllowedAuthBackendsForCerts     []string             `yaml:"allowed_auth_backends_for_certs"`
 	AllowedAuthBackendsForWebUI     []string             `yaml:"allowed_auth_backends_for_webui"`
@@ -169,25 +177,45 @@ type Oauth2Config struct {
 }
 
 type OpenIDConnectClientConfig struct {
-	ClientID                   string   `yaml:"client_id"`
-	ClientSecret               string   `yaml:"client_secret"`
-	AllowClientChosenAudiences bool     `yaml:"allow_client_chose_audiences"`
-	AllowedRedirectURLRE       []string `yaml:"allowed_redirect_url_re"`
-	AllowedRedirectDomains     []string `yaml:"allowed_redirect_domains"`
+	ClientID                    string   `yaml:"client_id"`
+	ClientSecret                string   `yaml:"client_secret"`
+	AllowClientChosenAudiences  bool     `yaml:"allow_client_chose_audiences"`
+	AllowedRedirectURLRE        []string `yaml:"allowed_redirect_url_re"`
+	AllowedRedirectDomains      []string `yaml:"allowed_redirect_domains"`
+	AllowedScopes               []string `yaml:"allowed_scopes"`
+	BackChannelLogoutURI        string   `yaml:"backchannel_logout_uri"`
+	FrontChannelLogoutURI       string   `yaml:"frontchannel_logout_uri"`
+	RequireConsent              bool     `yaml:"require_consent"`
+	SectorIdentifier            string   `yaml:"sector_identifier"`
+	SubjectType                 string   `yaml:"subject_type"`
+	AllowTokenExchange          bool     `yaml:"allow_token_exchange"`
+	JWKSURI                     string   `yaml:"jwks_uri"`
+	UserinfoSignedResponseAlg   string   `yaml:"userinfo_signed_response_alg"`
+	IDTokenEncryptedResponseAlg string   `yaml:"id_token_encrypted_response_alg"`
+	IDTokenEncryptedResponseEnc string   `yaml:"id_token_encrypted_response_enc"`
 }
 
 type OpenIDConnectIDPConfig struct {
-	DefaultEmailDomain string                      `yaml:"default_email_domain"`
-	Client             []OpenIDConnectClientConfig `yaml:"clients"`
+	DefaultEmailDomain            string                      `yaml:"default_email_domain"`
+	Client                        []OpenIDConnectClientConfig `yaml:"clients"`
+	PairwiseSubjectSecretFilename string                      `yaml:"pairwise_subject_secret_filename"`
+}
+
+type profileEncryptionConfig struct {
+	AwsKmsKeyId            string   `yaml:"aws_kms_key_id"`
+	Enabled                bool     `yaml:"enabled"`
+	PreviousCAKeyFilenames []string `yaml:"previous_ca_key_filenames"`
 }
 
 type ProfileStorageConfig struct {
-	AwsSecretId         string        `yaml:"aws_secret_id"`
-	ConnectionLifetime  time.Duration `yaml:"connection_lifetime"`
-	StorageUrl          string        `yaml:"storage_url"`
-	SyncDelay           time.Duration `yaml:"sync_delay"`
-	SyncInterval        time.Duration `yaml:"sync_interval"`
-	TLSRootCertFilename string        `yaml:"tls_root_cert_filename"`
+	AwsSecretId         string                  `yaml:"aws_secret_id"`
+	ConnectionLifetime  time.Duration           `yaml:"connection_lifetime"`
+	Encryption          profileEncryptionConfig `yaml:"encryption"`
+	Raft                raftstore.Config        `yaml:"raft"`
+	StorageUrl          string                  `yaml:"storage_url"`
+	SyncDelay           time.Duration           `yaml:"sync_delay"`
+	SyncInterval        time.Duration           `yaml:"sync_interval"`
+	TLSRootCertFilename string                  `yaml:"tls_root_cert_filename"`
 }
 
 type SymantecVIPConfig struct {
@@ -208,19 +236,45 @@ const (
 	ExternalSignerInvalid ExternalSignerType = iota
 	ExternalSignerYubiPIV
 	ExternalSignerAWSKMS
+	ExternalSignerPKCS11
+	ExternalSignerRemote
 )
 
 type ExternalSignerConfig struct {
-	Type     string `yaml:"type"` // AWS|yubipiv
+	Type     string `yaml:"type"` // AWS|yubipiv|pkcs11|remote
 	Location string `yaml:"location"`
 }
 
+// tenantCAConfig describes an additional CA, for a separate trust domain.
+// Certificates are issued by it when it is requested by name or by one of
+// its profiles, or when the user is a member of one of its groups.
+type tenantCAConfig struct {
+	Name               string               `yaml:"name"`
+	SSHCAFilename      string               `yaml:"ssh_ca_filename"`
+	Ed25519CAFilename  string               `yaml:"ed25519_ca_keyfilename"`
+	ExternalSignerConf ExternalSignerConfig `yaml:"external_signer_config"`
+	Profiles           []string             `yaml:"profiles"`
+	// If set, only members of these groups can get certificates from this
+	// CA.
+	Groups []string `yaml:"groups"`
+}
+
+type kubernetesClusterConfig struct {
+	Name   string `yaml:"name"`
+	Server string `yaml:"server"` // https://host:port of the API server.
+	// Empty to use the system roots.
+	CertificateAuthorityFilename string `yaml:"certificate_authority_filename"`
+	Namespace                    string `yaml:"namespace"`
+}
+
 type ParsedExternaSignerConfig struct {
 	Type      ExternalSignerType
 	PIVPin    string
 	PublicKey crypto.PublicKey
 	YKSerial  uint32
 	ARN       string
+	PKCS11    *pkcs11signer.Config
+	Remote    *remotesigner.ClientConfig
 }
 
 type AppConfigFile struct {
@@ -237,6 +291,10 @@ type AppConfigFile struct {
 	SymantecVIP      SymantecVIPConfig
 	ProfileStorage   ProfileStorageConfig
 	DenyTrustData    DenyKeyConfig
+	TenantCAs        []tenantCAConfig `yaml:"tenant_cas"`
+	// Clusters that accept x509-kubernetes certificates, for clients to
+	// generate their kubeconfig.
+	KubernetesClusters []kubernetesClusterConfig `yaml:"kubernetes_clusters"`
 }
 
 const (
@@ -265,7 +323,8 @@ func (state *RuntimeState) loadTemplates() (err error) {
 	// Load the built-in HTML templates.
 	htmlTemplates := []string{footerTemplateText, loginFormText,
 		secondFactorAuthFormText, profileHTML, usersHTML, headerTemplateText,
-		newTOTPHTML, newBootstrapOTPPHTML, showAuthTokenHTML,
+		newTOTPHTML, newBootstrapOTPPHTML, showAuthTokenHTML, idpLogoutHTML,
+		idpLogoutConfirmHTML, idpConsentHTML,
 	}
 	for _, templateString := range htmlTemplates {
 		_, err = state.htmlTemplate.Parse(templateString)
@@ -376,6 +435,9 @@ func (state *RuntimeState) loadSignersFromPemData(signerPem, ed25519Pem []byte)
 	default:
 		return fmt.Errorf("Signer file is a valid Signer key. Type is %T!\n", v)
 	}
+	if err := state.idpValidateSigningAlgs(signer.Public()); err != nil {
+		return err
+	}
 	caCertDer, err := generateCADer(state, signer)
 	if err != nil {
 		state.logger.Printf("Cannot generate CA DER")
@@ -399,33 +461,14 @@ func (sconfig *ExternalSignerConfig) Parse() (*ParsedExternaSignerConfig, error)
 	switch sconfig.Type {
 	case "yubipiv":
 		parsedConfig.Type = ExternalSignerYubiPIV
-		parsedYK, err := url.Parse(sconfig.Location)
-		if err != nil {
-			return nil, fmt.Errorf("Cannot parse url for yubipiv")
-		}
-		serial, err := strconv.ParseUint(parsedYK.Host, 10, 32)
+		serial, pin, publicKey, err := yksigner.ParseYubiPIVURL(
+			sconfig.Location)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid Host name '%s' is not converable to serial", parsedYK.Host)
-		}
-		parsedConfig.YKSerial = uint32(serial)
-		parsedConfig.PIVPin = "123456"
-		if parsedYK.User == nil {
-			parsedConfig.PublicKey = nil
-			return &parsedConfig, nil
-		}
-		b64derPubKey := parsedYK.User.Username()
-		derPubKey, err := base64.URLEncoding.DecodeString(b64derPubKey)
-		if err != nil {
-			return nil, fmt.Errorf("Invalid pub key encoding err=%s", err)
-		}
-		parsedConfig.PublicKey, err = x509.ParsePKIXPublicKey(derPubKey)
-		if err != nil {
-			return nil, fmt.Errorf("Invalid pub key err=%s", err)
-		}
-		pass, ok := parsedYK.User.Password()
-		if ok {
-			parsedConfig.PIVPin = pass
+			return nil, err
 		}
+		parsedConfig.YKSerial = serial
+		parsedConfig.PIVPin = pin
+		parsedConfig.PublicKey = publicKey
 		return &parsedConfig, nil
 	case "AWS":
 		parsedArn, err := arn.Parse(sconfig.Location)
@@ -440,41 +483,72 @@ func (sconfig *ExternalSignerConfig) Parse() (*ParsedExternaSignerConfig, error)
 			return nil, fmt.Errorf("Is not an kms urn for external signer")
 		}
 		return &parsedConfig, nil
+	case "pkcs11":
+		parsedP11, err := pkcs11signer.ParsePKCS11URI(sconfig.Location)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse pkcs11 uri err=%s", err)
+		}
+		if parsedP11.ModulePath == "" {
+			return nil, fmt.Errorf("pkcs11 uri is missing module-path")
+		}
+		if parsedP11.KeyLabel == "" {
+			return nil, fmt.Errorf("pkcs11 uri is missing object")
+		}
+		parsedConfig.Type = ExternalSignerPKCS11
+		parsedConfig.PKCS11 = parsedP11
+		return &parsedConfig, nil
+	case "remote":
+		parsedRemote, err := remotesigner.ParseRemoteSignerURL(
+			sconfig.Location)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse remote signer url err=%s",
+				err)
+		}
+		parsedConfig.Type = ExternalSignerRemote
+		parsedConfig.Remote = parsedRemote
+		return &parsedConfig, nil
 	default:
 		return nil, fmt.Errorf("Invalid External Signer type")
 	}
 }
 
-func (state *RuntimeState) loadExternalSigners() error {
-	state.logger.Debugf(3, "Top of loadExternalSigners")
-	var signer crypto.Signer
-	parsedConfig, err := state.Config.Base.ExternalSignerConf.Parse()
+func (state *RuntimeState) newExternalSigner(
+	sconfig *ExternalSignerConfig) (crypto.Signer, error) {
+	parsedConfig, err := sconfig.Parse()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	switch parsedConfig.Type {
 	case ExternalSignerYubiPIV:
 		state.logger.Debugf(3, "loadExternalSigners yubipiv branch")
 		// TODO: if using default pin and failed we should try to do unsealing.
-		signer, err = yksigner.NewYkPivSigner(
+		return yksigner.NewYkPivSigner(
 			parsedConfig.YKSerial, parsedConfig.PIVPin, parsedConfig.PublicKey)
-		if err != nil {
-			return err
-		}
-		state.logger.Debugf(3, "loadExternalSigners signer created")
 	case ExternalSignerAWSKMS:
 		ctx := context.Background()
 		cfg, err := awsconfig.LoadDefaultConfig(ctx)
 		if err != nil {
-			return err
-		}
-		signer, err = kmssigner.NewKmsSigner(cfg, ctx, parsedConfig.ARN)
-		if err != nil {
-			return err
+			return nil, err
 		}
+		return kmssigner.NewKmsSigner(cfg, ctx, parsedConfig.ARN)
+	case ExternalSignerPKCS11:
+		return pkcs11signer.NewPkcs11Signer(*parsedConfig.PKCS11,
+			state.logger)
+	case ExternalSignerRemote:
+		return remotesigner.NewRemoteSigner(*parsedConfig.Remote,
+			state.logger)
 	default:
-		return fmt.Errorf("unknown external signer type")
+		return nil, fmt.Errorf("unknown external signer type")
 	}
+}
+
+func (state *RuntimeState) loadExternalSigners() error {
+	state.logger.Debugf(3, "Top of loadExternalSigners")
+	signer, err := state.newExternalSigner(&state.Config.Base.ExternalSignerConf)
+	if err != nil {
+		return err
+	}
+	state.logger.Debugf(3, "loadExternalSigners signer created")
 	caCertDer, err := generateCADer(state, signer)
 	if err != nil {
 		state.logger.Printf("Cannot generate CA DER")
@@ -496,6 +570,9 @@ func (state *RuntimeState) loadExternalSigners() error {
 // or starts the autounselaing if encrypted
 func (state *RuntimeState) tryLoadAndVerifySigners() error {
 	state.logger.Debugf(2, "Top of tryLoadAndVerifySigners")
+	if err := state.loadTenantCAs(nil); err != nil {
+		return err
+	}
 
 	if state.SSHCARawFileContent != nil {
 		state.logger.Debugf(2, "tryLoadAndVerifySigners loading file")
@@ -529,13 +606,24 @@ func (state *RuntimeState) tryLoadAndVerifySigners() error {
 		if err != nil {
 			return err
 		}
+		if err := state.checkPairwiseSubjectSecretUnsealed(); err != nil {
+			return err
+		}
 	} else {
 		state.logger.Debugf(2, "tryLoadAndVerifySigners loadingExternalSigners")
 		err := state.loadExternalSigners()
 		if err != nil {
 			return err
 		}
-
+		if err := state.idpValidateSigningAlgs(state.Signer.Public()); err != nil {
+			return err
+		}
+		if err := state.checkProfileKeySigner(state.Signer); err != nil {
+			return err
+		}
+		if err := state.checkPairwiseSubjectSecretUnsealed(); err != nil {
+			return err
+		}
 	}
 	state.signerPublicKeyToKeymasterKeys()
 	state.SignerIsReady <- true
@@ -592,6 +680,7 @@ func loadVerifyConfigFile(configFilename string,
 		}
 	}
 	runtimeState.Config.Base.AutoUnseal.applyDefaults()
+	runtimeState.Config.Base.SplitKeyUnseal.applyDefaults()
 	if err := runtimeState.expandStorageUrl(); err != nil {
 		logger.Println(err)
 	}
@@ -617,6 +706,28 @@ func loadVerifyConfigFile(configFilename string,
 	if err := runtimeState.setupCertificateManager(); err != nil {
 		return nil, err
 	}
+	for _, client := range runtimeState.Config.OpenIDConnectIDP.Client {
+		switch client.SubjectType {
+		case "", idpSubjectTypePublic, idpSubjectTypePairwise:
+		default:
+			return nil, fmt.Errorf("invalid subject_type='%s' for client=%s",
+				client.SubjectType, client.ClientID)
+		}
+		if err := client.validateJOSEConfig(); err != nil {
+			return nil, fmt.Errorf("%s for client=%s", err, client.ClientID)
+		}
+		if err := client.validateLogoutConfig(); err != nil {
+			return nil, fmt.Errorf("%s for client=%s", err, client.ClientID)
+		}
+		if client.AllowTokenExchange && client.ClientSecret == "" {
+			return nil, fmt.Errorf(
+				"allow_token_exchange requires client_secret for client=%s",
+				client.ClientID)
+		}
+	}
+	if err := runtimeState.loadPairwiseSubjectSecret(nil); err != nil {
+		return nil, err
+	}
 	sshCAFilename := runtimeState.Config.Base.SSHCAFilename
 	if sshCAFilename != "" {
 		runtimeState.SSHCARawFileContent, err = exitsAndCanRead(sshCAFilename, "ssh CA File")
@@ -638,6 +749,12 @@ func loadVerifyConfigFile(configFilename string,
 				runtimeState.Config.Base.ExternalSignerConf.Type)
 		}
 	}
+	if err := runtimeState.loadTenantCAConfigs(); err != nil {
+		return nil, err
+	}
+	if err := runtimeState.loadKubernetesClusters(); err != nil {
+		return nil, err
+	}
 
 	if len(runtimeState.Config.Base.ClientCAFilename) > 0 {
 		buffer, err := exitsAndCanRead(
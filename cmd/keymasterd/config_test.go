@@ -99,6 +99,18 @@ func TesrParseExternalSigners(t *testing.T) {
 			Type:     "AWS",
 			Location: "arn:aws:kms:us-west-2:111111111111:key/1aadaaaa-cccc-bbbb-93af-155eb23a92d5",
 		},
+		ExternalSignerConfig{
+			Type:     "pkcs11",
+			Location: "pkcs11:token=keymaster;object=ca?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234",
+		},
+		ExternalSignerConfig{
+			Type:     "remote",
+			Location: "unix:///run/keymaster-signerd/signer.sock",
+		},
+		ExternalSignerConfig{
+			Type:     "remote",
+			Location: "https://signer.example.com:6930?client-cert=/etc/keymaster/signer.pem&client-key=/etc/keymaster/signer.key",
+		},
 	}
 	for _, extConfig := range goodConfigs {
 		config, err := extConfig.Parse()
@@ -128,6 +140,22 @@ func TesrParseExternalSigners(t *testing.T) {
 			Type:     "AWS",
 			Location: "arn:aws:non-kms:us-west-2:111111111111:key/1aadaaaa-cccc-bbbb-93af-155eb23a92d5",
 		},
+		ExternalSignerConfig{
+			Type:     "pkcs11",
+			Location: "pkcs11:token=keymaster;object=ca",
+		},
+		ExternalSignerConfig{
+			Type:     "pkcs11",
+			Location: "pkcs11:token=keymaster?module-path=/usr/lib/softhsm/libsofthsm2.so",
+		},
+		ExternalSignerConfig{
+			Type:     "remote",
+			Location: "https://signer.example.com:6930",
+		},
+		ExternalSignerConfig{
+			Type:     "remote",
+			Location: "tcp://signer.example.com:6930",
+		},
 		ExternalSignerConfig{
 			Type:     "AWS-FOO",
 			Location: "arn://aws:kms:us-west-2:111111111111:key/1aadaaaa-cccc-bbbb-93af-155eb23a92d5",
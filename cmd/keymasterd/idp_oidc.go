@@ -20,7 +20,6 @@ import (
 	"github.com/Cloud-Foundations/keymaster/lib/authutil"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 	"github.com/go-jose/go-jose/v4"
-	"github.com/go-jose/go-jose/v4/cryptosigner"
 	"github.com/go-jose/go-jose/v4/jwt"
 )
 
@@ -36,6 +35,7 @@ const idpOpenIDCJWKSPath = "/idp/oauth2/jwks"
 const idpOpenIDCAuthorizationPath = "/idp/oauth2/authorize"
 const idpOpenIDCTokenPath = "/idp/oauth2/token"
 const idpOpenIDCUserinfoPath = "/idp/oauth2/userinfo"
+const idpOpenIDCEndSessionPath = "/idp/oauth2/logout"
 
 // From: https://openid.net/specs/openid-connect-discovery-1_0.html
 // We only put required OR implemented fields here
@@ -46,21 +46,44 @@ type openIDProviderMetadata struct {
 	UserInfoEndpoint       string   `json:"userinfo_endpoint"`
 	JWKSURI                string   `json:"jwks_uri"`
 	ResponseTypesSupported []string `json:"response_types_supported"`
+	GrantTypesSupported    []string `json:"grant_types_supported"`
 	SubjectTypesSupported  []string `json:"subject_types_supported"`
 	IDTokenSigningAlgValue []string `json:"id_token_signing_alg_values_supported"`
+	// From: https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+	// https://openid.net/specs/openid-connect-frontchannel-1_0.html and
+	// https://openid.net/specs/openid-connect-backchannel-1_0.html
+	EndSessionEndpoint                 string `json:"end_session_endpoint"`
+	FrontChannelLogoutSupported        bool   `json:"frontchannel_logout_supported"`
+	FrontChannelLogoutSessionSupported bool   `json:"frontchannel_logout_session_supported"`
+	BackChannelLogoutSupported         bool   `json:"backchannel_logout_supported"`
+	BackChannelLogoutSessionSupported  bool   `json:"backchannel_logout_session_supported"`
+	// From: https://openid.net/specs/openid-connect-discovery-1_0.html
+	UserinfoSigningAlgValues   []string `json:"userinfo_signing_alg_values_supported"`
+	IDTokenEncryptionAlgValues []string `json:"id_token_encryption_alg_values_supported"`
+	IDTokenEncryptionEncValues []string `json:"id_token_encryption_enc_values_supported"`
 }
 
 func (state *RuntimeState) idpOpenIDCDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
 	issuer := state.idpGetIssuer()
 	metadata := openIDProviderMetadata{
-		Issuer:                 issuer,
-		AuthorizationEndpoint:  issuer + idpOpenIDCAuthorizationPath,
-		TokenEndoint:           issuer + idpOpenIDCTokenPath,
-		UserInfoEndpoint:       issuer + idpOpenIDCUserinfoPath,
-		JWKSURI:                issuer + idpOpenIDCJWKSPath,
-		ResponseTypesSupported: []string{"code"},                    // We only support authorization code flow
-		SubjectTypesSupported:  []string{"pairwise", "public"},      // WHAT is THIS?
-		IDTokenSigningAlgValue: []string{"RS256", "ES256", "ES384"}} // Adding ECDSA even tough we dont use it now
+		Issuer:                             issuer,
+		AuthorizationEndpoint:              issuer + idpOpenIDCAuthorizationPath,
+		TokenEndoint:                       issuer + idpOpenIDCTokenPath,
+		UserInfoEndpoint:                   issuer + idpOpenIDCUserinfoPath,
+		JWKSURI:                            issuer + idpOpenIDCJWKSPath,
+		ResponseTypesSupported:             []string{"code"}, // We only support authorization code flow
+		GrantTypesSupported:                []string{"authorization_code", idpTokenExchangeGrantType},
+		SubjectTypesSupported:              []string{"pairwise", "public"}, // Per client subject_type
+		IDTokenSigningAlgValue:             state.idpSigningAlgValues(),
+		EndSessionEndpoint:                 issuer + idpOpenIDCEndSessionPath,
+		FrontChannelLogoutSupported:        true,
+		FrontChannelLogoutSessionSupported: true,
+		BackChannelLogoutSupported:         true,
+		BackChannelLogoutSessionSupported:  true,
+		UserinfoSigningAlgValues:           state.idpSigningAlgValues(),
+		IDTokenEncryptionAlgValues:         idpIDTokenEncryptionAlgValues,
+		IDTokenEncryptionEncValues:         idpIDTokenEncryptionEncValues,
+	}
 	// "EdDSA" is Ed25519... we need to determine
 	// compatibility before we enable as it may break things for current operators
 	// need to agree on what scopes we will support
@@ -132,6 +155,7 @@ type keymasterdCodeToken struct {
 	Scope            string   `json:"scope"`
 	Type             string   `json:"type"`
 	JWTId            string   `json:"jti,omitEmpty"`
+	SessionID        string   `json:"sid,omitempty"`
 	ProtectedDataKey string   `json:"protected_data_key,omitempty"`
 	ProtectedData    string   `json:"protected_data,omitempty"`
 }
@@ -223,6 +247,20 @@ func (client *OpenIDConnectClientConfig) RequestedAudienceIsAllowed(audience str
 	return client.AllowClientChosenAudiences
 }
 
+// ScopeIsAllowed returns true if the client may request scope. Clients
+// without allowed_scopes may request any scope.
+func (client *OpenIDConnectClientConfig) ScopeIsAllowed(scope string) bool {
+	if len(client.AllowedScopes) < 1 || scope == "openid" {
+		return true
+	}
+	for _, allowedScope := range client.AllowedScopes {
+		if scope == allowedScope {
+			return true
+		}
+	}
+	return false
+}
+
 // This is weak we should be doing hashes
 func (client *OpenIDConnectClientConfig) ValidClientSecret(clientSecret string) bool {
 	return clientSecret == client.ClientSecret
@@ -389,6 +427,13 @@ func (state *RuntimeState) idpOpenIDCAuthorizationHandler(w http.ResponseWriter,
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		return
 	}
+	for _, requestedScope := range strings.Split(scope, " ") {
+		if !oidcClient.ScopeIsAllowed(requestedScope) {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Scope not allowed for client")
+			return
+		}
+	}
 
 	requestRedirectURLString := r.Form.Get("redirect_uri")
 	ok, parsedRedirectURL, err := oidcClient.CanRedirectToURL(requestRedirectURLString)
@@ -467,6 +512,14 @@ func (state *RuntimeState) idpOpenIDCAuthorizationHandler(w http.ResponseWriter,
 		accessAudience = append(accessAudience, requestedAudience)
 	}
 
+	if oidcClient.RequireConsent {
+		if !state.idpCheckConsent(w, r, authData.Username, clientID,
+			strings.Split(scope, " "), accessAudience,
+			requestRedirectURLString) {
+			return
+		}
+	}
+
 	//Dont check for now
 	signer, err := getJoseSignerFromSigner(state.Signer)
 	if err != nil {
@@ -490,6 +543,13 @@ func (state *RuntimeState) idpOpenIDCAuthorizationHandler(w http.ResponseWriter,
 		state.writeFailureResponse(w, r, http.StatusBadRequest, "bad Nonce value...not enough entropy")
 		return
 	}
+	codeToken.SessionID, err = state.idpRecordClientSession(
+		authData.Username, clientID, time.Unix(codeToken.AuthExpiration, 0))
+	if err != nil {
+		logger.Printf("Error recording idp session %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
 	logger.Debugf(3, "auth request is valid, now proceeding to generate redirect")
 
 	raw, err := jwt.Signed(signer).Claims(codeToken).Serialize()
@@ -500,7 +560,8 @@ func (state *RuntimeState) idpOpenIDCAuthorizationHandler(w http.ResponseWriter,
 	redirectPath := fmt.Sprintf("%s?code=%s&state=%s", requestRedirectURLString, raw, url.QueryEscape(r.Form.Get("state")))
 	logger.Debugf(3, "auth request is valid, redirect path=%s", redirectPath)
 	logger.Debugf(0, "IDP: Successful oauth2 authorization:  user=%s redirect url=%s", authData.Username, parsedRedirectURL.Redacted())
-	eventNotifier.PublishServiceProviderLoginEvent(requestRedirectURLString, authData.Username)
+	eventNotifier.PublishServiceProviderLoginEvent(r, requestRedirectURLString, authData.Username)
+	eventNotifier.PublishOIDCCodeIssueEvent(r, clientID, authData.Username)
 	http.Redirect(w, r, redirectPath, 302)
 	//logger.Printf("raw jwt =%v", raw)
 }
@@ -513,6 +574,7 @@ type openIDConnectIDToken struct {
 	IssuedAt   int64    `json:"iat"`
 	AuthTime   int64    `json:"auth_time,omitempty"` //Time of Auth
 	Nonce      string   `json:"nonce,omitempty"`
+	SessionID  string   `json:"sid,omitempty"`
 }
 
 type tokenResponse struct {
@@ -523,13 +585,16 @@ type tokenResponse struct {
 }
 
 type bearerAccessToken struct {
-	Issuer     string   `json:"iss"`
-	Audience   []string `json:"aud,omitempty"`
-	Username   string   `json:"username"`
-	Scope      string   `json:"scope"`
-	Expiration int64    `json:"exp"`
-	IssuedAt   int64    `json:"iat"`
-	Type       string   `json:"type"`
+	Issuer            string   `json:"iss"`
+	Audience          []string `json:"aud,omitempty"`
+	Username          string   `json:"username,omitempty"`
+	Scope             string   `json:"scope"`
+	Expiration        int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Type              string   `json:"type"`
+	ClientID          string   `json:"client_id,omitempty"`
+	JWTId             string   `json:"jti,omitempty"`
+	ProtectedUsername string   `json:"protected_username,omitempty"`
 }
 
 func (state *RuntimeState) idpOpenIDCValidCodeVerifier(clientId string, codeVerifier string, codeToken keymasterdCodeToken) bool {
@@ -575,6 +640,10 @@ func (state *RuntimeState) idpOpenIDCTokenHandler(w http.ResponseWriter, r *http
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		return
 	}
+	if r.Form.Get("grant_type") == idpTokenExchangeGrantType {
+		state.idpOpenIDCTokenExchangeHandler(w, r)
+		return
+	}
 	if r.Form.Get("grant_type") != "authorization_code" {
 		logger.Debugf(1, "invalid grant type='%s'", url.QueryEscape(r.Form.Get("grant_type")))
 		state.writeFailureResponse(w, r, http.StatusBadRequest, "Invalid grant type")
@@ -593,12 +662,6 @@ func (state *RuntimeState) idpOpenIDCTokenHandler(w http.ResponseWriter, r *http
 		return
 
 	}
-	sigAlgo, err := publicToPreferedJoseSigAlgo(state.Signer.Public())
-	if err != nil {
-		logger.Printf("err=%s", err)
-		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
-		return
-	}
 	incomingAlgos, err := state.getJoseKeymastedVerifierList()
 	if err != nil {
 		logger.Printf("err=%s", err)
@@ -735,26 +798,25 @@ func (state *RuntimeState) idpOpenIDCTokenHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	signerOptions := (&jose.SignerOptions{}).WithType("JWT")
-	kid, err := getKeyFingerprint(state.Signer.Public())
+	signer, err := getJoseSignerWithKeyID(state.Signer, "JWT")
 	if err != nil {
-		log.Printf("error getting key fingerprint in idpOpenIDCTokenHandler: %s", err)
+		log.Printf("error creating signer in idpOpenIDCTokenHandler: %s", err)
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "Internal Error")
 		return
 	}
-	signerOptions = signerOptions.WithHeader("kid", kid)
-	internalSigner := cryptosigner.Opaque(state.Signer)
-	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: sigAlgo, Key: internalSigner}, signerOptions)
+	subject, err := state.idpGetSubject(clientID, keymasterToken.Username)
 	if err != nil {
-		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		log.Printf("error getting subject in idpOpenIDCTokenHandler: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "Internal Error")
 		return
 	}
-	idToken := openIDConnectIDToken{Issuer: state.idpGetIssuer(), Subject: keymasterToken.Username, Audience: []string{clientID}}
+	idToken := openIDConnectIDToken{Issuer: state.idpGetIssuer(), Subject: subject, Audience: []string{clientID}}
 	idToken.Nonce = keymasterToken.Nonce
+	idToken.SessionID = keymasterToken.SessionID
 	idToken.Expiration = keymasterToken.AuthExpiration
 	idToken.IssuedAt = time.Now().Unix()
 
-	signedIdToken, err := jwt.Signed(signer).Claims(idToken).Serialize()
+	signedIdToken, err := state.idpSerializeIDToken(signer, clientID, idToken)
 	if err != nil {
 		log.Printf("error signing idToken in idpOpenIDCTokenHandler,: %s", err)
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "Internal Error")
@@ -762,7 +824,14 @@ func (state *RuntimeState) idpOpenIDCTokenHandler(w http.ResponseWriter, r *http
 	}
 	logger.Debugf(2, "raw=%s", signedIdToken)
 	accessToken := bearerAccessToken{Issuer: state.idpGetIssuer(),
-		Username: keymasterToken.Username, Scope: keymasterToken.Scope}
+		Scope: keymasterToken.Scope, ClientID: clientID}
+	err = state.idpSetAccessTokenUsername(&accessToken, oidcClient,
+		keymasterToken.Username)
+	if err != nil {
+		log.Printf("error protecting accessToken in idpOpenIDCTokenHandler: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "Internal Error")
+		return
+	}
 	accessToken.Expiration = idToken.Expiration
 	accessToken.Type = "bearer"
 	accessToken.IssuedAt = time.Now().Unix()
@@ -790,6 +859,8 @@ func (state *RuntimeState) idpOpenIDCTokenHandler(w http.ResponseWriter, r *http
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "Internal Error")
 		return
 	}
+	eventNotifier.PublishOIDCTokenIssueEvent(r, clientID,
+		keymasterToken.Username)
 
 	var out bytes.Buffer
 	json.Indent(&out, b, "", "\t")
@@ -878,7 +949,7 @@ func (state *RuntimeState) getUserAttributes(username string,
 
 type openidConnectUserInfo struct {
 	Subject           string   `json:"sub"`
-	Name              string   `json:"name"`
+	Name              string   `json:"name,omitempty"`
 	Login             string   `json:"login,omitempty"`
 	Username          string   `json:"username,omitempty"`
 	PreferredUsername string   `json:"preferred_username,omitempty"`
@@ -886,6 +957,15 @@ type openidConnectUserInfo struct {
 	Groups            []string `json:"groups,omitempty"`
 }
 
+func userInfoScopeRequested(scope string, wanted string) bool {
+	for _, requestedScope := range strings.Split(scope, " ") {
+		if requestedScope == wanted {
+			return true
+		}
+	}
+	return false
+}
+
 func (state *RuntimeState) idpOpenIDCUserinfoHandler(w http.ResponseWriter,
 	r *http.Request) {
 	if !(r.Method == "GET" || r.Method == "POST" || r.Method == "OPTIONS") {
@@ -989,6 +1069,14 @@ func (state *RuntimeState) idpOpenIDCUserinfoHandler(w http.ResponseWriter,
 			return
 		}
 	}
+	username, err := state.idpGetAccessTokenUsername(&parsedAccessToken)
+	if err != nil {
+		logger.Printf("err=%s", err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"bad access token")
+		return
+	}
+	parsedAccessToken.Username = username
 	// Get email from LDAP if available.
 	defaultEmailDomain := state.HostIdentity
 	if len(state.Config.OpenIDConnectIDP.DefaultEmailDomain) > 3 {
@@ -1022,18 +1110,62 @@ func (state *RuntimeState) idpOpenIDCUserinfoHandler(w http.ResponseWriter,
 		Login:    parsedAccessToken.Username,
 		Groups:   userGroups,
 	}
-	// Write the json output.
-	b, err := json.Marshal(userInfo)
-	if err != nil {
-		log.Printf("error marshaling in idpOpenIDUserinfonHandler: %s", err)
-		state.writeFailureResponse(w, r, http.StatusInternalServerError,
-			"Internal Error")
-		return
+	// Pairwise clients must not learn the username.
+	if parsedAccessToken.ClientID != "" {
+		oidcClient, err := state.idpOpenIDCGetClientConfig(
+			parsedAccessToken.ClientID)
+		if err == nil && oidcClient.usesPairwiseSubject() {
+			subject, err := state.idpGetSubject(parsedAccessToken.ClientID,
+				parsedAccessToken.Username)
+			if err != nil {
+				logger.Printf("error getting subject in userinfo: %s", err)
+				state.writeFailureResponse(w, r,
+					http.StatusInternalServerError, "Internal Error")
+				return
+			}
+			userInfo = openidConnectUserInfo{Subject: subject,
+				Groups: userGroups}
+			if userInfoScopeRequested(parsedAccessToken.Scope, "email") {
+				userInfo.Email = email
+			}
+		}
 	}
-	logger.Debugf(1, "userinfo=%+v\n b=%s", userInfo, b)
+	// Clients can ask for the response to be a signed JWT.
+	var signingClient *OpenIDConnectClientConfig
+	if parsedAccessToken.ClientID != "" {
+		oidcClient, err := state.idpOpenIDCGetClientConfig(
+			parsedAccessToken.ClientID)
+		if err == nil && oidcClient.signsUserinfo() {
+			signingClient = oidcClient
+		}
+	}
+	var b []byte
 	var out bytes.Buffer
-	json.Indent(&out, b, "", "\t")
-	w.Header().Set("Content-Type", "application/json")
+	if signingClient != nil {
+		signedUserInfo, err := state.idpSignUserinfo(signingClient, userInfo)
+		if err != nil {
+			logger.Printf("error signing userinfo for client=%s: %s",
+				signingClient.ClientID, err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError,
+				"Internal Error")
+			return
+		}
+		b = []byte(signedUserInfo)
+		out.Write(b)
+		w.Header().Set("Content-Type", "application/jwt")
+	} else {
+		// Write the json output.
+		b, err = json.Marshal(userInfo)
+		if err != nil {
+			log.Printf("error marshaling in idpOpenIDUserinfonHandler: %s", err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError,
+				"Internal Error")
+			return
+		}
+		json.Indent(&out, b, "", "\t")
+		w.Header().Set("Content-Type", "application/json")
+	}
+	logger.Debugf(1, "userinfo=%+v\n b=%s", userInfo, b)
 
 	originIsValid, err := state.idpOpenIDCGenericIsCorsOriginAllowed(origin)
 	if err != nil {
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+const idpConsentManagementPath = "/api/v0/manageIdPConsent"
+
+// Storage data type for the consent tokens embedded in the consent form.
+const idpConsentDataType = 2
+
+type idpConsentData struct {
+	Scopes     []string
+	Audiences  []string
+	ApprovedAt time.Time
+}
+
+// covers returns true if the approval already includes every requested scope
+// and audience.
+func (consent *idpConsentData) covers(scopes []string,
+	audiences []string) bool {
+	return stringSliceContainsAll(consent.Scopes, scopes) &&
+		stringSliceContainsAll(consent.Audiences, audiences)
+}
+
+func stringSliceContainsAll(haystack []string, needles []string) bool {
+	for _, needle := range needles {
+		found := false
+		for _, value := range haystack {
+			if value == needle {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeStringSlices(a []string, b []string) []string {
+	seen := make(map[string]struct{})
+	var merged []string
+	for _, value := range append(append([]string{}, a...), b...) {
+		if _, ok := seen[value]; ok || value == "" {
+			continue
+		}
+		seen[value] = struct{}{}
+		merged = append(merged, value)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// idpConsentRequestKey binds a consent token to the exact client, scopes and
+// audiences the user was shown.
+func idpConsentRequestKey(clientID string, scopes []string,
+	audiences []string) string {
+	return clientID + "\n" + strings.Join(scopes, " ") + "\n" +
+		strings.Join(audiences, " ")
+}
+
+func (state *RuntimeState) idpVerifyConsentToken(consentToken string,
+	username string, requestKey string) error {
+	storageData, err := state.getStorageDataFromStorageStringDataJWT(
+		consentToken)
+	if err != nil {
+		return err
+	}
+	if storageData.DataType != idpConsentDataType ||
+		storageData.Subject != username ||
+		storageData.Data != requestKey ||
+		storageData.Expiration < time.Now().Unix() {
+		return errors.New("invalid consent token")
+	}
+	return nil
+}
+
+// idpHasConsent returns true if the user has already approved the client for
+// the scopes and audiences.
+func (state *RuntimeState) idpHasConsent(username string, clientID string,
+	scopes []string, audiences []string) (bool, error) {
+	profile, _, _, err := state.LoadUserProfile(username)
+	if err != nil {
+		return false, err
+	}
+	consent, ok := profile.IdPConsents[clientID]
+	return ok && consent.covers(mergeStringSlices(scopes, nil),
+		mergeStringSlices(audiences, nil)), nil
+}
+
+// idpCheckConsent returns true if the user has approved the client for the
+// requested scopes and audiences. If not, it either renders the consent page
+// or processes its answer, and the caller must stop processing the request.
+func (state *RuntimeState) idpCheckConsent(w http.ResponseWriter,
+	r *http.Request, username string, clientID string, scopes []string,
+	audiences []string, redirectURL string) bool {
+	scopes = mergeStringSlices(scopes, nil)
+	audiences = mergeStringSlices(audiences, nil)
+	requestKey := idpConsentRequestKey(clientID, scopes, audiences)
+	if consentToken := r.Form.Get("consent_token"); consentToken != "" {
+		if r.Method != "POST" {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Consent must be POSTed")
+			return false
+		}
+		err := state.idpVerifyConsentToken(consentToken, username,
+			requestKey)
+		if err != nil {
+			logger.Debugf(1, "invalid consent token: %s", err)
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid consent token")
+			return false
+		}
+		switch r.Form.Get("consent") {
+		case "Approve":
+			if err := state.idpSaveConsent(username, clientID, scopes,
+				audiences); err != nil {
+				logger.Printf("Error saving consent: %s", err)
+				state.writeFailureResponse(w, r,
+					http.StatusInternalServerError, "")
+				return false
+			}
+			logger.Debugf(0, "IDP: user=%s approved client=%s scopes=%s",
+				username, clientID, scopes)
+			eventNotifier.PublishServiceProviderConsentEvent(r, redirectURL,
+				username)
+			return true
+		case "Deny":
+			parsedURL, err := url.Parse(redirectURL)
+			if err != nil {
+				logger.Printf("Error parsing redirect URL: %s", err)
+				state.writeFailureResponse(w, r,
+					http.StatusInternalServerError, "")
+				return false
+			}
+			query := parsedURL.Query()
+			query.Set("error", "access_denied")
+			if requestState := r.Form.Get("state"); requestState != "" {
+				query.Set("state", requestState)
+			}
+			parsedURL.RawQuery = query.Encode()
+			http.Redirect(w, r, parsedURL.String(), http.StatusFound)
+			return false
+		default:
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid consent value")
+			return false
+		}
+	}
+	hasConsent, err := state.idpHasConsent(username, clientID, scopes,
+		audiences)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return false
+	}
+	if hasConsent {
+		return true
+	}
+	consentToken, err := state.genNewSerializedStorageStringDataJWT(username,
+		idpConsentDataType, requestKey,
+		time.Now().Unix()+idpOpenIDCMaxAuthProcessMaxDurationSeconds)
+	if err != nil {
+		logger.Printf("Error generating consent token: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return false
+	}
+	formValues := make(url.Values)
+	for key, values := range r.Form {
+		if key == "consent" || key == "consent_token" {
+			continue
+		}
+		formValues[key] = values
+	}
+	displayData := idpConsentPageTemplateData{
+		Title:        "Keymaster Application Access",
+		AuthUsername: username,
+		ClientID:     clientID,
+		Scopes:       scopes,
+		Audiences:    audiences,
+		RedirectHost: redirectURL,
+		FormValues:   formValues,
+		ConsentToken: consentToken,
+	}
+	if parsedURL, err := url.Parse(redirectURL); err == nil {
+		displayData.RedirectHost = parsedURL.Host
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	err = state.htmlTemplate.ExecuteTemplate(w, "idpConsentPage", displayData)
+	if err != nil {
+		logger.Printf("Failed to execute %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+	}
+	return false
+}
+
+func (state *RuntimeState) idpSaveConsent(username string, clientID string,
+	scopes []string, audiences []string) error {
+	profile, _, fromCache, err := state.LoadUserProfile(username)
+	if err != nil {
+		return err
+	}
+	if fromCache {
+		return errors.New("db backend is offline for writes")
+	}
+	if profile.IdPConsents == nil {
+		profile.IdPConsents = make(map[string]*idpConsentData)
+	}
+	consent, ok := profile.IdPConsents[clientID]
+	if !ok {
+		consent = &idpConsentData{}
+		profile.IdPConsents[clientID] = consent
+	}
+	consent.Scopes = mergeStringSlices(consent.Scopes, scopes)
+	consent.Audiences = mergeStringSlices(consent.Audiences, audiences)
+	consent.ApprovedAt = time.Now()
+	return state.SaveUserProfile(username, profile)
+}
+
+// idpConsentManagerHandler lets users (or admins) revoke the approvals given
+// to relying parties from the profile page.
+func (state *RuntimeState) idpConsentManagerHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	authData, err := state.checkAuth(w, r, state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authData.Username)
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	assumedUser := r.Form.Get("username")
+	// Have admin rights = Must be admin + authenticated with U2F
+	hasAdminRights := state.IsAdminUserAndU2F(authData.Username,
+		authData.AuthType)
+	if !hasAdminRights && assumedUser != authData.Username {
+		logger.Printf("bad username authUser=%s requested=%s",
+			authData.Username, assumedUser)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	if r.Form.Get("action") != "Revoke" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid Operation")
+		return
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(assumedUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if fromCache {
+		http.Error(w, "db backend is offline for writes",
+			http.StatusServiceUnavailable)
+		return
+	}
+	clientID := r.Form.Get("client_id")
+	if _, ok := profile.IdPConsents[clientID]; !ok {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"bad client_id Value")
+		return
+	}
+	delete(profile.IdPConsents, clientID)
+	err = state.SaveUserProfile(assumedUser, profile)
+	if err != nil {
+		logger.Printf("Saving profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	logger.Debugf(0, "IDP: consent for client=%s revoked for user=%s by %s",
+		clientID, assumedUser, authData.Username)
+	returnAcceptType := getPreferredAcceptType(r)
+	switch returnAcceptType {
+	case "text/html":
+		http.Redirect(w, r, profileURI(authData.Username, assumedUser),
+			http.StatusFound)
+	default:
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Success!")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// Per client signed userinfo responses and encrypted ID tokens as described
+// in https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
+// Encryption keys are fetched from the jwks_uri of each client.
+
+const idpClientJWKSCacheDuration = time.Hour
+const idpClientJWKSFetchTimeout = 10 * time.Second
+const idpClientJWKSMaxSize = 1 << 20
+
+var idpUserinfoSigningAlgValues = []string{"RS256", "ES256", "ES384"}
+
+var idpIDTokenEncryptionAlgValues = []string{
+	string(jose.RSA_OAEP), string(jose.RSA_OAEP_256), string(jose.ECDH_ES),
+	string(jose.ECDH_ES_A128KW), string(jose.ECDH_ES_A256KW)}
+
+var idpIDTokenEncryptionEncValues = []string{
+	string(jose.A128CBC_HS256), string(jose.A256CBC_HS512),
+	string(jose.A128GCM), string(jose.A256GCM)}
+
+type cachedJWKS struct {
+	keySet    jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+type jwksCache struct {
+	client   *http.Client
+	lifetime time.Duration
+	mutex    sync.Mutex
+	// Protected by lock.
+	entries map[string]cachedJWKS
+}
+
+func newJWKSCache(client *http.Client, lifetime time.Duration) *jwksCache {
+	return &jwksCache{
+		client:   client,
+		lifetime: lifetime,
+		entries:  make(map[string]cachedJWKS),
+	}
+}
+
+func (c *jwksCache) fetch(uri string) (*jose.JSONWebKeySet, error) {
+	parsedURL, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.Scheme != "https" {
+		return nil, fmt.Errorf("jwks_uri must use https: %s", uri)
+	}
+	resp, err := c.client.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching %s: %s", uri, resp.Status)
+	}
+	var keySet jose.JSONWebKeySet
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, idpClientJWKSMaxSize))
+	if err := decoder.Decode(&keySet); err != nil {
+		return nil, err
+	}
+	return &keySet, nil
+}
+
+// GetKeySet returns the key set at uri, fetching it if the cached copy is
+// too old. If fetching fails a stale copy is returned when available.
+func (c *jwksCache) GetKeySet(uri string) (*jose.JSONWebKeySet, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[uri]
+	c.mutex.Unlock()
+	if ok && time.Since(entry.fetchedAt) < c.lifetime {
+		return &entry.keySet, nil
+	}
+	keySet, err := c.fetch(uri)
+	if err != nil {
+		if ok {
+			logger.Printf("using stale jwks for %s: %s", uri, err)
+			return &entry.keySet, nil
+		}
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.entries[uri] = cachedJWKS{keySet: *keySet, fetchedAt: time.Now()}
+	c.mutex.Unlock()
+	return keySet, nil
+}
+
+func (state *RuntimeState) idpGetClientJWKSCache() *jwksCache {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	if state.idpClientJWKS == nil {
+		state.idpClientJWKS = newJWKSCache(
+			&http.Client{Timeout: idpClientJWKSFetchTimeout},
+			idpClientJWKSCacheDuration)
+	}
+	return state.idpClientJWKS
+}
+
+func keyMatchesEncryptionAlgorithm(key jose.JSONWebKey,
+	alg jose.KeyAlgorithm) bool {
+	if key.Use != "" && key.Use != "enc" {
+		return false
+	}
+	if key.Algorithm != "" && key.Algorithm != string(alg) {
+		return false
+	}
+	switch alg {
+	case jose.RSA_OAEP, jose.RSA_OAEP_256:
+		_, ok := key.Key.(*rsa.PublicKey)
+		return ok
+	case jose.ECDH_ES, jose.ECDH_ES_A128KW, jose.ECDH_ES_A256KW:
+		_, ok := key.Key.(*ecdsa.PublicKey)
+		return ok
+	}
+	return false
+}
+
+func (client *OpenIDConnectClientConfig) encryptsIDToken() bool {
+	return client.IDTokenEncryptedResponseAlg != ""
+}
+
+func (client *OpenIDConnectClientConfig) signsUserinfo() bool {
+	return client.UserinfoSignedResponseAlg != "" &&
+		client.UserinfoSignedResponseAlg != "none"
+}
+
+func (client *OpenIDConnectClientConfig) validateJOSEConfig() error {
+	if client.signsUserinfo() && !stringSliceContainsAll(
+		idpUserinfoSigningAlgValues,
+		[]string{client.UserinfoSignedResponseAlg}) {
+		return fmt.Errorf("invalid userinfo_signed_response_alg='%s'",
+			client.UserinfoSignedResponseAlg)
+	}
+	if !client.encryptsIDToken() {
+		if client.IDTokenEncryptedResponseEnc != "" {
+			return errors.New(
+				"id_token_encrypted_response_enc requires id_token_encrypted_response_alg")
+		}
+		return nil
+	}
+	if !stringSliceContainsAll(idpIDTokenEncryptionAlgValues,
+		[]string{client.IDTokenEncryptedResponseAlg}) {
+		return fmt.Errorf("invalid id_token_encrypted_response_alg='%s'",
+			client.IDTokenEncryptedResponseAlg)
+	}
+	if client.IDTokenEncryptedResponseEnc != "" &&
+		!stringSliceContainsAll(idpIDTokenEncryptionEncValues,
+			[]string{client.IDTokenEncryptedResponseEnc}) {
+		return fmt.Errorf("invalid id_token_encrypted_response_enc='%s'",
+			client.IDTokenEncryptedResponseEnc)
+	}
+	if client.JWKSURI == "" {
+		return errors.New("id token encryption requires jwks_uri")
+	}
+	if parsedURL, err := url.Parse(client.JWKSURI); err != nil ||
+		parsedURL.Scheme != "https" {
+		return fmt.Errorf("jwks_uri='%s' must be an https URL",
+			client.JWKSURI)
+	}
+	return nil
+}
+
+// idpSigningAlgValues returns the JWS algorithms the signer can produce. If
+// the signer is still sealed every algorithm keymaster supports is returned.
+func (state *RuntimeState) idpSigningAlgValues() []string {
+	if state.Signer == nil {
+		return idpUserinfoSigningAlgValues
+	}
+	sigAlgo, err := publicToPreferedJoseSigAlgo(state.Signer.Public())
+	if err != nil {
+		return nil
+	}
+	return []string{string(sigAlgo)}
+}
+
+// idpValidateSigningAlgs checks that the signer with publicKey can produce
+// the userinfo signatures the clients ask for.
+func (state *RuntimeState) idpValidateSigningAlgs(
+	publicKey crypto.PublicKey) error {
+	sigAlgo, err := publicToPreferedJoseSigAlgo(publicKey)
+	if err != nil {
+		return err
+	}
+	for _, client := range state.Config.OpenIDConnectIDP.Client {
+		if client.signsUserinfo() &&
+			client.UserinfoSignedResponseAlg != string(sigAlgo) {
+			return fmt.Errorf(
+				"userinfo_signed_response_alg='%s' for client=%s but signer uses %s",
+				client.UserinfoSignedResponseAlg, client.ClientID, sigAlgo)
+		}
+	}
+	return nil
+}
+
+func (state *RuntimeState) idpGetClientEncrypter(
+	client *OpenIDConnectClientConfig) (jose.Encrypter, error) {
+	alg := jose.KeyAlgorithm(client.IDTokenEncryptedResponseAlg)
+	enc := jose.A128CBC_HS256 // The default per the spec.
+	if client.IDTokenEncryptedResponseEnc != "" {
+		enc = jose.ContentEncryption(client.IDTokenEncryptedResponseEnc)
+	}
+	keySet, err := state.idpGetClientJWKSCache().GetKeySet(client.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keySet.Keys {
+		if !keyMatchesEncryptionAlgorithm(key, alg) {
+			continue
+		}
+		options := (&jose.EncrypterOptions{}).WithType("JWT").
+			WithContentType("JWT")
+		return jose.NewEncrypter(enc, jose.Recipient{Algorithm: alg,
+			Key: key.Key, KeyID: key.KeyID}, options)
+	}
+	return nil, fmt.Errorf("no suitable %s key found at %s", alg,
+		client.JWKSURI)
+}
+
+// idpSerializeIDToken signs idToken and, when the client asks for it,
+// encrypts the result with the client's key.
+func (state *RuntimeState) idpSerializeIDToken(signer jose.Signer,
+	clientID string, idToken openIDConnectIDToken) (string, error) {
+	client, err := state.idpOpenIDCGetClientConfig(clientID)
+	if err != nil {
+		return "", err
+	}
+	if !client.encryptsIDToken() {
+		return jwt.Signed(signer).Claims(idToken).Serialize()
+	}
+	encrypter, err := state.idpGetClientEncrypter(client)
+	if err != nil {
+		return "", err
+	}
+	return jwt.SignedAndEncrypted(signer, encrypter).Claims(idToken).
+		Serialize()
+}
+
+// idpSignUserinfo returns the userinfo response as a JWT for clientID.
+func (state *RuntimeState) idpSignUserinfo(client *OpenIDConnectClientConfig,
+	userInfo openidConnectUserInfo) (string, error) {
+	signer, err := getJoseSignerWithKeyID(state.Signer, "JWT")
+	if err != nil {
+		return "", err
+	}
+	sigAlgo, err := publicToPreferedJoseSigAlgo(state.Signer.Public())
+	if err != nil {
+		return "", err
+	}
+	if string(sigAlgo) != client.UserinfoSignedResponseAlg {
+		return "", fmt.Errorf("client wants %s but signer uses %s",
+			client.UserinfoSignedResponseAlg, sigAlgo)
+	}
+	registeredClaims := jwt.Claims{
+		Issuer:   state.idpGetIssuer(),
+		Audience: jwt.Audience{client.ClientID},
+	}
+	return jwt.Signed(signer).Claims(userInfo).Claims(registeredClaims).
+		Serialize()
+}
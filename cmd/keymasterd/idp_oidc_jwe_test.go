@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestIDPOpenIDCClientJOSEConfig(t *testing.T) {
+	validConfigs := []OpenIDConnectClientConfig{
+		{},
+		{UserinfoSignedResponseAlg: "none"},
+		{UserinfoSignedResponseAlg: "RS256"},
+		{IDTokenEncryptedResponseAlg: "RSA-OAEP", JWKSURI: "https://rp/jwks"},
+		{IDTokenEncryptedResponseAlg: "ECDH-ES",
+			IDTokenEncryptedResponseEnc: "A256GCM", JWKSURI: "https://rp/jwks"},
+	}
+	for _, client := range validConfigs {
+		if err := client.validateJOSEConfig(); err != nil {
+			t.Errorf("config %+v should be valid: %s", client, err)
+		}
+	}
+	invalidConfigs := []OpenIDConnectClientConfig{
+		{UserinfoSignedResponseAlg: "HS256"},
+		{IDTokenEncryptedResponseAlg: "RSA-OAEP"},
+		{IDTokenEncryptedResponseAlg: "RSA1_5", JWKSURI: "https://rp/jwks"},
+		{IDTokenEncryptedResponseAlg: "RSA-OAEP",
+			IDTokenEncryptedResponseEnc: "A192GCM", JWKSURI: "https://rp/jwks"},
+		{IDTokenEncryptedResponseEnc: "A128GCM"},
+		{IDTokenEncryptedResponseAlg: "RSA-OAEP", JWKSURI: "http://rp/jwks"},
+	}
+	for _, client := range invalidConfigs {
+		if err := client.validateJOSEConfig(); err == nil {
+			t.Errorf("config %+v should be invalid", client)
+		}
+	}
+}
+
+func TestIDPOpenIDCValidateSigningAlgs(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &RuntimeState{}
+	state.Config.OpenIDConnectIDP.Client = []OpenIDConnectClientConfig{
+		{ClientID: "rsa", UserinfoSignedResponseAlg: "RS256"},
+		{ClientID: "unsigned", UserinfoSignedResponseAlg: "none"},
+	}
+	if err := state.idpValidateSigningAlgs(rsaKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.OpenIDConnectIDP.Client = append(
+		state.Config.OpenIDConnectIDP.Client,
+		OpenIDConnectClientConfig{ClientID: "ecdsa",
+			UserinfoSignedResponseAlg: "ES256"})
+	if err := state.idpValidateSigningAlgs(rsaKey.Public()); err == nil {
+		t.Fatal("ES256 accepted for an RSA signer")
+	}
+}
+
+func TestJWKSCacheRequiresHTTPS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{})
+		}))
+	defer server.Close()
+	cache := newJWKSCache(server.Client(), time.Hour)
+	if _, err := cache.GetKeySet(server.URL); err == nil {
+		t.Fatal("fetched a jwks over http")
+	}
+}
+
+func TestIDPOpenIDCEncryptedIDTokenAndSignedUserinfo(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.Config.Base.AllowedAuthBackendsForWebUI = []string{"password"}
+	state.HostIdentity = "localhost"
+
+	rpKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksRequests := 0
+	rpServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			jwksRequests++
+			keySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: rpKey.Public(), KeyID: "sig", Use: "sig"},
+				{Key: rpKey.Public(), KeyID: "enc", Use: "enc"},
+			}}
+			json.NewEncoder(w).Encode(keySet)
+		}))
+	defer rpServer.Close()
+	state.idpClientJWKS = newJWKSCache(rpServer.Client(), time.Hour)
+
+	sigAlgo, err := publicToPreferedJoseSigAlgo(state.Signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid_client_id := "jwe_client"
+	valid_client_secret := "secret_password"
+	valid_redirect_uri := "https://localhost:12345"
+	state.Config.OpenIDConnectIDP.Client = append(
+		state.Config.OpenIDConnectIDP.Client, OpenIDConnectClientConfig{
+			ClientID: valid_client_id, ClientSecret: valid_client_secret,
+			AllowedRedirectURLRE:        []string{"localhost"},
+			JWKSURI:                     rpServer.URL + "/jwks",
+			UserinfoSignedResponseAlg:   string(sigAlgo),
+			IDTokenEncryptedResponseAlg: string(jose.RSA_OAEP_256),
+			IDTokenEncryptedResponseEnc: string(jose.A256GCM),
+		})
+	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := http.Cookie{Name: authCookieName, Value: cookieVal}
+	getTokens := func() tokenResponse {
+		form := url.Values{}
+		form.Add("scope", "openid")
+		form.Add("response_type", "code")
+		form.Add("client_id", valid_client_id)
+		form.Add("redirect_uri", valid_redirect_uri)
+		form.Add("nonce", "123456789")
+		req, err := http.NewRequest("POST", idpOpenIDCAuthorizationPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&authCookie)
+		rr, err := checkRequestHandlerCode(req,
+			state.idpOpenIDCAuthorizationHandler, http.StatusFound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		location, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenForm := url.Values{}
+		tokenForm.Add("grant_type", "authorization_code")
+		tokenForm.Add("redirect_uri", valid_redirect_uri)
+		tokenForm.Add("code", location.Query().Get("code"))
+		tokenReq, err := http.NewRequest("POST", idpOpenIDCTokenPath,
+			strings.NewReader(tokenForm.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		tokenReq.SetBasicAuth(valid_client_id, valid_client_secret)
+		tokenRR, err := checkRequestHandlerCode(tokenReq,
+			state.idpOpenIDCTokenHandler, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resultToken tokenResponse
+		err = json.NewDecoder(tokenRR.Result().Body).Decode(&resultToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resultToken
+	}
+	resultToken := getTokens()
+	encryptedToken, err := jose.ParseEncrypted(resultToken.IDToken,
+		[]jose.KeyAlgorithm{jose.RSA_OAEP_256},
+		[]jose.ContentEncryption{jose.A256GCM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := encryptedToken.Header.KeyID; kid != "enc" {
+		t.Fatalf("wrong encryption key used kid=%s", kid)
+	}
+	if cty := encryptedToken.Header.ExtraHeaders[jose.HeaderContentType]; cty != "JWT" {
+		t.Fatalf("nested token has bad cty=%v", cty)
+	}
+	payload, err := encryptedToken.Decrypt(rpKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedToken, err := jwt.ParseSigned(string(payload),
+		[]jose.SignatureAlgorithm{sigAlgo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idToken openIDConnectIDToken
+	if err := signedToken.Claims(state.Signer.Public(), &idToken); err != nil {
+		t.Fatal(err)
+	}
+	if idToken.Subject != "username" || idToken.Nonce != "123456789" {
+		t.Fatalf("bad id token %+v", idToken)
+	}
+
+	// The second token must use the cached key set.
+	getTokens()
+	if jwksRequests != 1 {
+		t.Fatalf("jwks fetched %d times, expected once", jwksRequests)
+	}
+
+	userinfoReq, err := http.NewRequest("GET", idpOpenIDCUserinfoPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userinfoReq.Header.Add("Authorization", "Bearer "+resultToken.AccessToken)
+	userinfoRR, err := checkRequestHandlerCode(userinfoReq,
+		state.idpOpenIDCUserinfoHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentType := userinfoRR.Result().Header.Get("Content-Type")
+	if contentType != "application/jwt" {
+		t.Fatalf("bad userinfo content type %s", contentType)
+	}
+	body, err := ioutil.ReadAll(userinfoRR.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedUserinfo, err := jwt.ParseSigned(string(body),
+		[]jose.SignatureAlgorithm{sigAlgo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var userInfo openidConnectUserInfo
+	var registeredClaims jwt.Claims
+	err = signedUserinfo.Claims(state.Signer.Public(), &userInfo,
+		&registeredClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.Subject != "username" {
+		t.Fatalf("bad userinfo %+v", userInfo)
+	}
+	err = registeredClaims.Validate(jwt.Expected{
+		Issuer:      state.idpGetIssuer(),
+		AnyAudience: jwt.Audience{valid_client_id},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+// Pairwise subject identifiers as described in
+// https://openid.net/specs/openid-connect-core-1_0.html#PairwiseAlg
+// The per sector secrets are derived from a secret read from
+// pairwise_subject_secret_filename, so that subjects survive CA rotations and
+// are identical on all the instances sharing the same secret file. The file
+// may be sealed like the CA, in which case pairwise subjects are available
+// once unsealed.
+
+const idpSubjectTypePairwise = "pairwise"
+const idpSubjectTypePublic = "public"
+
+const idpPairwiseSecretInfo = "keymaster pairwise subject identifier"
+const idpAccessTokenKeyInfo = "keymaster access token username"
+
+const idpPairwiseSecretMinLength = 32
+
+const idpPGPMessageHeader = "-----BEGIN PGP MESSAGE-----"
+
+// loadPairwiseSubjectSecret reads the secret for pairwise subjects. It is
+// required if any client uses pairwise subjects. A PGP armored secret is
+// decrypted with password, which is the same as for the default CA, or is
+// left sealed if password is nil. Must be called with the lock held, or
+// before serving.
+func (state *RuntimeState) loadPairwiseSubjectSecret(password []byte) error {
+	needed := false
+	for _, client := range state.Config.OpenIDConnectIDP.Client {
+		if client.usesPairwiseSubject() {
+			needed = true
+			break
+		}
+	}
+	filename := state.Config.OpenIDConnectIDP.PairwiseSubjectSecretFilename
+	if filename == "" {
+		if needed {
+			return errors.New(
+				"pairwise clients require pairwise_subject_secret_filename")
+		}
+		return nil
+	}
+	if state.idpPairwiseSecret != nil {
+		return nil
+	}
+	fileContent, err := exitsAndCanRead(filename, "pairwise subject secret")
+	if err != nil {
+		return err
+	}
+	masterSecret := bytes.TrimSpace(fileContent)
+	if bytes.HasPrefix(masterSecret, []byte(idpPGPMessageHeader)) {
+		if password == nil {
+			return nil
+		}
+		masterSecret, err = cryptoutils.PGPDecryptArmoredBytes(fileContent,
+			password)
+		if err != nil {
+			return fmt.Errorf("cannot unseal pairwise subject secret: %s", err)
+		}
+		masterSecret = bytes.TrimSpace(masterSecret)
+	} else {
+		state.logger.Printf("Warning: %s is not sealed, anyone who can read it can compute the pairwise subjects",
+			filename)
+	}
+	if len(masterSecret) < idpPairwiseSecretMinLength {
+		return fmt.Errorf("pairwise subject secret must be at least %d bytes",
+			idpPairwiseSecretMinLength)
+	}
+	secret, err := hkdf.Key(sha256.New, masterSecret, nil,
+		idpPairwiseSecretInfo, sha256.Size)
+	if err != nil {
+		return err
+	}
+	state.idpPairwiseSecret = secret
+	return nil
+}
+
+// checkPairwiseSubjectSecretUnsealed checks that the pairwise subject secret
+// is not left sealed when the CA is not sealed. Must be called with the lock
+// held, or before serving.
+func (state *RuntimeState) checkPairwiseSubjectSecretUnsealed() error {
+	if state.Config.OpenIDConnectIDP.PairwiseSubjectSecretFilename != "" &&
+		state.idpPairwiseSecret == nil {
+		return errors.New(
+			"pairwise_subject_secret_filename is sealed but the CA is not")
+	}
+	return nil
+}
+
+func (state *RuntimeState) idpGetPairwiseMasterSecret() ([]byte, error) {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	if state.idpPairwiseSecret == nil {
+		if state.Config.OpenIDConnectIDP.PairwiseSubjectSecretFilename != "" {
+			return nil, errors.New("pairwise subject secret is sealed")
+		}
+		return nil, errors.New("pairwise subject secret not configured")
+	}
+	return state.idpPairwiseSecret, nil
+}
+
+// getSectorIdentifier returns the sector the client belongs to. Clients
+// sharing a sector get the same subject for a given user.
+func (client *OpenIDConnectClientConfig) getSectorIdentifier() string {
+	if client.SectorIdentifier != "" {
+		return client.SectorIdentifier
+	}
+	return client.ClientID
+}
+
+func (client *OpenIDConnectClientConfig) usesPairwiseSubject() bool {
+	return client.SubjectType == idpSubjectTypePairwise
+}
+
+func computePairwiseSubject(masterSecret []byte, sector string,
+	username string) (string, error) {
+	sectorSecret, err := hkdf.Key(sha256.New, masterSecret, nil,
+		"sector:"+sector, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, sectorSecret)
+	mac.Write([]byte(username))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// idpGetSubject returns the sub claim to be used for username in tokens and
+// userinfo responses destined to clientID.
+func (state *RuntimeState) idpGetSubject(clientID string,
+	username string) (string, error) {
+	oidcClient, err := state.idpOpenIDCGetClientConfig(clientID)
+	if err != nil {
+		if err == ErrorIDPClientNotFound {
+			return username, nil
+		}
+		return "", err
+	}
+	if !oidcClient.usesPairwiseSubject() {
+		return username, nil
+	}
+	masterSecret, err := state.idpGetPairwiseMasterSecret()
+	if err != nil {
+		return "", fmt.Errorf("cannot get pairwise secret: %s", err)
+	}
+	return computePairwiseSubject(masterSecret,
+		oidcClient.getSectorIdentifier(), username)
+}
+
+// idpSetAccessTokenUsername sets the user of accessToken. Access tokens are
+// only signed, so for pairwise clients the username is encrypted with a key
+// derived from the pairwise secret.
+func (state *RuntimeState) idpSetAccessTokenUsername(
+	accessToken *bearerAccessToken, client *OpenIDConnectClientConfig,
+	username string) error {
+	if client == nil || !client.usesPairwiseSubject() {
+		accessToken.Username = username
+		return nil
+	}
+	key, err := state.idpGetAccessTokenKey()
+	if err != nil {
+		return err
+	}
+	jwtId, err := genRandomString()
+	if err != nil {
+		return err
+	}
+	protectedUsername, err := sealEncodeData([]byte(username), []byte(jwtId),
+		key)
+	if err != nil {
+		return err
+	}
+	accessToken.JWTId = jwtId
+	accessToken.ProtectedUsername = protectedUsername
+	return nil
+}
+
+// idpGetAccessTokenUsername returns the user of a verified access token.
+func (state *RuntimeState) idpGetAccessTokenUsername(
+	accessToken *bearerAccessToken) (string, error) {
+	if accessToken.ProtectedUsername == "" {
+		return accessToken.Username, nil
+	}
+	key, err := state.idpGetAccessTokenKey()
+	if err != nil {
+		return "", err
+	}
+	if len(accessToken.JWTId) < 12 {
+		return "", errors.New("bad access token id")
+	}
+	username, err := decodeOpenData(accessToken.ProtectedUsername,
+		[]byte(accessToken.JWTId), key)
+	if err != nil {
+		return "", err
+	}
+	return string(username), nil
+}
+
+func (state *RuntimeState) idpGetAccessTokenKey() ([]byte, error) {
+	masterSecret, err := state.idpGetPairwiseMasterSecret()
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, masterSecret, nil, idpAccessTokenKeyInfo,
+		32)
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// IdP sessions are kept in memory only. Each keymaster instance knows about
+// the relying parties it issued codes for, which is good enough for the
+// common single-instance and sticky load balancer deployments.
+
+const idpBackChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+const idpBackChannelLogoutTimeout = 10 * time.Second
+const idpLogoutTokenLifetimeSeconds = 120
+
+// idpLogoutDataType is the DataType of the logout confirmation tokens.
+const idpLogoutDataType = 3
+
+type idpClientSession struct {
+	ClientID  string
+	SessionID string
+	ExpiresAt time.Time
+}
+
+// From: https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+type idpLogoutToken struct {
+	Issuer     string                 `json:"iss"`
+	Subject    string                 `json:"sub,omitempty"`
+	Audience   []string               `json:"aud"`
+	IssuedAt   int64                  `json:"iat"`
+	Expiration int64                  `json:"exp"`
+	JWTId      string                 `json:"jti"`
+	SessionID  string                 `json:"sid,omitempty"`
+	Events     map[string]interface{} `json:"events"`
+}
+
+// idpRecordClientSession registers that username has a session with clientID
+// and returns the session id (sid) to be placed in the issued tokens. The
+// same sid is reused while the session is alive so that relying parties see
+// a stable value.
+func (state *RuntimeState) idpRecordClientSession(username string,
+	clientID string, expiresAt time.Time) (string, error) {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	if state.idpSessions == nil {
+		state.idpSessions = make(map[string]map[string]idpClientSession)
+	}
+	userSessions, ok := state.idpSessions[username]
+	if !ok {
+		userSessions = make(map[string]idpClientSession)
+		state.idpSessions[username] = userSessions
+	}
+	session, ok := userSessions[clientID]
+	if !ok || session.ExpiresAt.Before(time.Now()) {
+		sessionID, err := genRandomString()
+		if err != nil {
+			return "", err
+		}
+		session = idpClientSession{ClientID: clientID, SessionID: sessionID}
+	}
+	if expiresAt.After(session.ExpiresAt) {
+		session.ExpiresAt = expiresAt
+	}
+	userSessions[clientID] = session
+	return session.SessionID, nil
+}
+
+// idpGetUserSessions returns the live sessions for username.
+func (state *RuntimeState) idpGetUserSessions(
+	username string) []idpClientSession {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	var sessions []idpClientSession
+	for _, session := range state.idpSessions[username] {
+		if session.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// idpFindSessionUsername returns the user owning the session sessionID with
+// clientID, or the empty string if there is no such session.
+func (state *RuntimeState) idpFindSessionUsername(clientID string,
+	sessionID string) string {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	for username, userSessions := range state.idpSessions {
+		session, ok := userSessions[clientID]
+		if ok && session.SessionID == sessionID {
+			return username
+		}
+	}
+	return ""
+}
+
+// idpEndUserSessions forgets all the sessions of username and returns the
+// ones that were still alive.
+func (state *RuntimeState) idpEndUserSessions(
+	username string) []idpClientSession {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	var sessions []idpClientSession
+	for _, session := range state.idpSessions[username] {
+		if session.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	delete(state.idpSessions, username)
+	return sessions
+}
+
+// idpCleanupExpiredSessions must be called with state.Mutex held.
+func (state *RuntimeState) idpCleanupExpiredSessions() {
+	for username, userSessions := range state.idpSessions {
+		for clientID, session := range userSessions {
+			if session.ExpiresAt.Before(time.Now()) {
+				delete(userSessions, clientID)
+			}
+		}
+		if len(userSessions) == 0 {
+			delete(state.idpSessions, username)
+		}
+	}
+}
+
+func (state *RuntimeState) idpGenLogoutToken(username string,
+	session idpClientSession) (string, error) {
+	signer, err := getJoseSignerWithKeyID(state.Signer, "logout+jwt")
+	if err != nil {
+		return "", err
+	}
+	jwtId, err := genRandomString()
+	if err != nil {
+		return "", err
+	}
+	subject, err := state.idpGetSubject(session.ClientID, username)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	logoutToken := idpLogoutToken{
+		Issuer:     state.idpGetIssuer(),
+		Subject:    subject,
+		Audience:   []string{session.ClientID},
+		IssuedAt:   now,
+		Expiration: now + idpLogoutTokenLifetimeSeconds,
+		JWTId:      jwtId,
+		SessionID:  session.SessionID,
+		Events: map[string]interface{}{
+			idpBackChannelLogoutEvent: map[string]interface{}{},
+		},
+	}
+	return jwt.Signed(signer).Claims(logoutToken).Serialize()
+}
+
+// canRedirectAfterLogout checks a post_logout_redirect_uri like
+// CanRedirectToURL, except that the URI may have a query, which is kept.
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html#RPLogout
+func (client *OpenIDConnectClientConfig) canRedirectAfterLogout(
+	redirectURL string) (bool, *url.URL, error) {
+	parsedURL, err := url.Parse(redirectURL)
+	if err != nil || parsedURL.Fragment != "" {
+		return false, nil, nil
+	}
+	query := parsedURL.RawQuery
+	parsedURL.RawQuery = ""
+	parsedURL.ForceQuery = false
+	ok, parsedURL, err := client.CanRedirectToURL(parsedURL.String())
+	if !ok || err != nil {
+		return ok, nil, err
+	}
+	parsedURL.RawQuery = query
+	return true, parsedURL, nil
+}
+
+// validateLogoutConfig checks that logout tokens are only sent over https.
+func (client *OpenIDConnectClientConfig) validateLogoutConfig() error {
+	if client.BackChannelLogoutURI == "" {
+		return nil
+	}
+	if parsedURL, err := url.Parse(client.BackChannelLogoutURI); err != nil ||
+		parsedURL.Scheme != "https" {
+		return fmt.Errorf("backchannel_logout_uri='%s' must be an https URL",
+			client.BackChannelLogoutURI)
+	}
+	return nil
+}
+
+func (state *RuntimeState) idpGetBackChannelLogoutClient() *http.Client {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	if state.idpBackChannelLogoutClient == nil {
+		state.idpBackChannelLogoutClient = &http.Client{
+			Timeout: idpBackChannelLogoutTimeout}
+	}
+	return state.idpBackChannelLogoutClient
+}
+
+func postBackChannelLogoutToken(client *http.Client, logoutURI string,
+	logoutToken string) error {
+	parsedURL, err := url.Parse(logoutURI)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Scheme != "https" {
+		return fmt.Errorf("backchannel_logout_uri must use https: %s",
+			logoutURI)
+	}
+	form := url.Values{"logout_token": {logoutToken}}
+	resp, err := client.PostForm(logoutURI, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The spec says 200 on success, but 204 is commonly used as well.
+	if resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// idpSendBackChannelLogout notifies every relying party with a registered
+// backchannel_logout_uri that the sessions have ended. Notifications are
+// sent asynchronously and the returned channel is closed once all of them
+// have completed.
+func (state *RuntimeState) idpSendBackChannelLogout(username string,
+	sessions []idpClientSession) <-chan struct{} {
+	done := make(chan struct{})
+	client := state.idpGetBackChannelLogoutClient()
+	pending := 0
+	results := make(chan struct{}, len(sessions))
+	for _, session := range sessions {
+		oidcClient, err := state.idpOpenIDCGetClientConfig(session.ClientID)
+		if err != nil || oidcClient.BackChannelLogoutURI == "" {
+			continue
+		}
+		logoutToken, err := state.idpGenLogoutToken(username, session)
+		if err != nil {
+			logger.Printf("Error generating logout token for client=%s: %s",
+				session.ClientID, err)
+			continue
+		}
+		pending++
+		go func(clientID, logoutURI, logoutToken string) {
+			err := postBackChannelLogoutToken(client, logoutURI, logoutToken)
+			if err != nil {
+				logger.Printf("IDP: backchannel logout failed user=%s client=%s: %s",
+					username, clientID, err)
+			} else {
+				logger.Debugf(1, "IDP: backchannel logout user=%s client=%s",
+					username, clientID)
+			}
+			results <- struct{}{}
+		}(session.ClientID, oidcClient.BackChannelLogoutURI, logoutToken)
+	}
+	go func() {
+		for i := 0; i < pending; i++ {
+			<-results
+		}
+		close(done)
+	}()
+	return done
+}
+
+// idpGetFrontChannelLogoutURLs returns the frontchannel_logout_uri of every
+// relying party in sessions, with the iss and sid parameters added.
+func (state *RuntimeState) idpGetFrontChannelLogoutURLs(
+	sessions []idpClientSession) []string {
+	var logoutURLs []string
+	for _, session := range sessions {
+		oidcClient, err := state.idpOpenIDCGetClientConfig(session.ClientID)
+		if err != nil || oidcClient.FrontChannelLogoutURI == "" {
+			continue
+		}
+		parsedURL, err := url.Parse(oidcClient.FrontChannelLogoutURI)
+		if err != nil || parsedURL.Scheme != "https" {
+			logger.Printf("Invalid frontchannel_logout_uri for client=%s",
+				session.ClientID)
+			continue
+		}
+		query := parsedURL.Query()
+		query.Set("iss", state.idpGetIssuer())
+		query.Set("sid", session.SessionID)
+		parsedURL.RawQuery = query.Encode()
+		logoutURLs = append(logoutURLs, parsedURL.String())
+	}
+	return logoutURLs
+}
+
+// idpTerminateUserSessions ends all relying party sessions of username,
+// sending the backchannel notifications, and then sends the client to
+// redirectURL. If any relying party uses frontchannel logout an intermediate
+// page embedding the logout URLs is rendered instead of a plain redirect.
+func (state *RuntimeState) idpTerminateUserSessions(w http.ResponseWriter,
+	r *http.Request, username string, redirectURL string) {
+	var sessions []idpClientSession
+	if username != "" {
+		sessions = state.idpEndUserSessions(username)
+		state.idpSendBackChannelLogout(username, sessions)
+	}
+	frontChannelURLs := state.idpGetFrontChannelLogoutURLs(sessions)
+	if len(frontChannelURLs) == 0 {
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+		return
+	}
+	var frameSources []string
+	for _, logoutURL := range frontChannelURLs {
+		parsedURL, err := url.Parse(logoutURL)
+		if err != nil {
+			continue
+		}
+		frameSources = append(frameSources,
+			parsedURL.Scheme+"://"+parsedURL.Host)
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'self' ;style-src 'self' fonts.googleapis.com 'unsafe-inline'; font-src fonts.gstatic.com fonts.googleapis.com; frame-src "+strings.Join(frameSources, " "))
+	w.Header().Set("Cache-Control", "no-store")
+	displayData := idpLogoutPageTemplateData{
+		Title:                  "Keymaster Logout",
+		FrontChannelLogoutURLs: frontChannelURLs,
+		RedirectURL:            redirectURL,
+	}
+	err := state.htmlTemplate.ExecuteTemplate(w, "idpLogoutPage", displayData)
+	if err != nil {
+		logger.Printf("Failed to execute %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getAuthCookieUsername returns the user of a valid keymaster auth cookie,
+// or the empty string.
+func (state *RuntimeState) getAuthCookieUsername(r *http.Request) string {
+	authCookie, err := r.Cookie(authCookieName)
+	if err != nil {
+		return ""
+	}
+	info, err := state.getAuthInfoFromAuthJWT(authCookie.Value)
+	if err != nil {
+		return ""
+	}
+	return info.Username
+}
+
+// expireAuthCookie clears the keymaster auth cookie.
+func (state *RuntimeState) expireAuthCookie(w http.ResponseWriter,
+	r *http.Request) {
+	if _, err := r.Cookie(authCookieName); err != nil {
+		return
+	}
+	expiration := time.Unix(0, 0)
+	updatedAuthCookie := http.Cookie{
+		Name:     authCookieName,
+		Value:    "",
+		Expires:  expiration,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	}
+	http.SetCookie(w, &updatedAuthCookie)
+}
+
+func (state *RuntimeState) idpParseIDTokenHint(
+	idTokenHint string) (*openIDConnectIDToken, error) {
+	incomingAlgos, err := state.getJoseKeymastedVerifierList()
+	if err != nil {
+		return nil, err
+	}
+	tok, err := jwt.ParseSigned(idTokenHint, incomingAlgos)
+	if err != nil {
+		return nil, err
+	}
+	var idToken openIDConnectIDToken
+	if err := state.JWTClaims(tok, &idToken); err != nil {
+		return nil, err
+	}
+	// Expired ID tokens are acceptable as hints, but they must be ours.
+	if idToken.Issuer != state.idpGetIssuer() {
+		return nil, errors.New("invalid issuer")
+	}
+	if len(idToken.Audience) != 1 {
+		return nil, errors.New("invalid audience")
+	}
+	return &idToken, nil
+}
+
+// idpVerifyLogoutToken checks the token of a logout confirmation, which is
+// bound to the user of the session cookie and to the redirect URL.
+func (state *RuntimeState) idpVerifyLogoutToken(logoutToken string,
+	username string, redirectURL string) error {
+	storageData, err := state.getStorageDataFromStorageStringDataJWT(
+		logoutToken)
+	if err != nil {
+		return err
+	}
+	if storageData.DataType != idpLogoutDataType ||
+		storageData.Subject != username ||
+		storageData.Data != redirectURL ||
+		storageData.Expiration < time.Now().Unix() {
+		return errors.New("invalid logout token")
+	}
+	return nil
+}
+
+// idpRenderLogoutConfirmation asks the user to confirm the logout with a
+// form posted to action, carrying a logout token.
+func (state *RuntimeState) idpRenderLogoutConfirmation(w http.ResponseWriter,
+	r *http.Request, action string, username string, redirectURL string) {
+	logoutToken, err := state.genNewSerializedStorageStringDataJWT(username,
+		idpLogoutDataType, redirectURL,
+		time.Now().Unix()+idpOpenIDCMaxAuthProcessMaxDurationSeconds)
+	if err != nil {
+		logger.Printf("Error generating logout token: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	formValues := make(url.Values)
+	for key, values := range r.Form {
+		if key == "logout_token" {
+			continue
+		}
+		formValues[key] = values
+	}
+	displayData := idpLogoutConfirmPageTemplateData{
+		Title:        "Keymaster Logout",
+		Action:       action,
+		AuthUsername: username,
+		FormValues:   formValues,
+		LogoutToken:  logoutToken,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	err = state.htmlTemplate.ExecuteTemplate(w, "idpLogoutConfirmPage",
+		displayData)
+	if err != nil {
+		logger.Printf("Failed to execute %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+	}
+}
+
+// idpOpenIDCEndSessionHandler implements RP-initiated logout:
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func (state *RuntimeState) idpOpenIDCEndSessionHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if !(r.Method == "GET" || r.Method == "POST") {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid Method for End Session Handler")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, "Invalid URL")
+		return
+	}
+	clientID := r.Form.Get("client_id")
+	var hintUsername string
+	if idTokenHint := r.Form.Get("id_token_hint"); idTokenHint != "" {
+		idToken, err := state.idpParseIDTokenHint(idTokenHint)
+		if err != nil {
+			logger.Debugf(1, "invalid id_token_hint: %s", err)
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid id_token_hint")
+			return
+		}
+		if clientID != "" && clientID != idToken.Audience[0] {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"client_id does not match id_token_hint")
+			return
+		}
+		clientID = idToken.Audience[0]
+		// The subject may be pairwise, so the session is the reliable way
+		// to find the user. Public subjects are the username itself.
+		if idToken.SessionID != "" {
+			hintUsername = state.idpFindSessionUsername(clientID,
+				idToken.SessionID)
+		}
+		if hintUsername == "" {
+			subject, err := state.idpGetSubject(clientID, idToken.Subject)
+			if err == nil && subject == idToken.Subject {
+				hintUsername = idToken.Subject
+			}
+		}
+	}
+	redirectURL := "/"
+	postLogoutRedirectURI := r.Form.Get("post_logout_redirect_uri")
+	if postLogoutRedirectURI != "" {
+		if clientID == "" {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"post_logout_redirect_uri requires client_id or id_token_hint")
+			return
+		}
+		oidcClient, err := state.idpOpenIDCGetClientConfig(clientID)
+		if err != nil {
+			if err == ErrorIDPClientNotFound {
+				state.writeFailureResponse(w, r, http.StatusBadRequest,
+					"ClientID uknown")
+				return
+			}
+			logger.Printf("%v", err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		ok, parsedRedirectURL, err := oidcClient.canRedirectAfterLogout(
+			postLogoutRedirectURI)
+		if err != nil {
+			logger.Printf("%v", err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if !ok {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"post_logout_redirect_uri not valid")
+			return
+		}
+		if logoutState := r.Form.Get("state"); logoutState != "" {
+			query := parsedRedirectURL.Query()
+			query.Set("state", logoutState)
+			parsedRedirectURL.RawQuery = query.Encode()
+		}
+		redirectURL = parsedRedirectURL.String()
+	}
+	// Only the user of the session cookie is logged out. Unless the request
+	// names that same user in an id_token_hint the user must confirm, so
+	// that other sites and old ID tokens cannot log users out.
+	username := state.getAuthCookieUsername(r)
+	if logoutToken := r.Form.Get("logout_token"); logoutToken != "" {
+		if r.Method != "POST" {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Logout must be POSTed")
+			return
+		}
+		err := state.idpVerifyLogoutToken(logoutToken, username, redirectURL)
+		if err != nil {
+			logger.Debugf(1, "invalid logout token: %s", err)
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid logout token")
+			return
+		}
+	} else if username == "" || username != hintUsername {
+		state.idpRenderLogoutConfirmation(w, r, idpOpenIDCEndSessionPath,
+			username, redirectURL)
+		return
+	}
+	state.expireAuthCookie(w, r)
+	if username != "" {
+		w.(*instrumentedwriter.LoggingWriter).SetUsername(username)
+		logger.Debugf(0, "IDP: end session user=%s client=%s", username,
+			clientID)
+	}
+	state.idpTerminateUserSessions(w, r, username, redirectURL)
+}
+
+// idpKillSessionsHandler lets admins terminate all the relying party sessions
+// of a user.
+func (state *RuntimeState) idpKillSessionsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	failure, authData := state.sendFailureToClientIfNonAdmin(w, r)
+	if failure {
+		return
+	}
+	username := state.ensurePostAndGetUsername(w, r)
+	if username == "" {
+		return
+	}
+	sessions := state.idpEndUserSessions(username)
+	state.idpSendBackChannelLogout(username, sessions)
+	logger.Printf("IDP: admin=%s killed %d sessions of user=%s",
+		authData.Username, len(sessions), username)
+	preferredAcceptType := getPreferredAcceptType(r)
+	switch preferredAcceptType {
+	case "text/html":
+		http.Redirect(w, r, usersPath, http.StatusFound)
+	default:
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "OK\n")
+	}
+}
@@ -2,17 +2,25 @@ package main
 
 import (
 	"crypto/ed25519"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
+	"io/ioutil"
 	stdlog "log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/debuglogger"
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
 	"github.com/go-jose/go-jose/v4/jwt"
 	cv "github.com/nirasan/go-oauth-pkce-code-verifier"
 )
@@ -48,10 +56,24 @@ func TestIDPOpenIDCMetadataHandler(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = checkRequestHandlerCode(req, state.idpOpenIDCDiscoveryHandler, http.StatusOK)
+	rr, err := checkRequestHandlerCode(req, state.idpOpenIDCDiscoveryHandler, http.StatusOK)
 	if err != nil {
 		t.Fatal(err)
 	}
+	var metadata openIDProviderMetadata
+	if err := json.NewDecoder(rr.Result().Body).Decode(&metadata); err != nil {
+		t.Fatal(err)
+	}
+	sigAlgo, err := publicToPreferedJoseSigAlgo(state.Signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, algs := range [][]string{metadata.IDTokenSigningAlgValue,
+		metadata.UserinfoSigningAlgValues} {
+		if len(algs) != 1 || algs[0] != string(sigAlgo) {
+			t.Fatalf("advertised %v but signer uses %s", algs, sigAlgo)
+		}
+	}
 }
 
 func TestIDPOpenIDCJWKSHandler(t *testing.T) {
@@ -633,3 +655,623 @@ func TestIDPOpenIDCPKCEFlowWithAudienceSuccess(t *testing.T) {
 	}
 
 }
+
+func TestIDPOpenIDCEndSessionBackChannelLogout(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.Config.Base.AllowedAuthBackendsForWebUI = []string{"password"}
+	state.signerPublicKeyToKeymasterKeys()
+	state.HostIdentity = "localhost"
+	if err := state.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	logoutTokens := make(chan string, 1)
+	rpServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logoutTokens <- r.FormValue("logout_token")
+		}))
+	defer rpServer.Close()
+	state.idpBackChannelLogoutClient = rpServer.Client()
+
+	valid_client_id := "valid_client_id"
+	clientConfig := OpenIDConnectClientConfig{ClientID: valid_client_id,
+		AllowedRedirectURLRE: []string{"localhost"},
+		BackChannelLogoutURI: rpServer.URL}
+	state.Config.OpenIDConnectIDP.Client = append(state.Config.OpenIDConnectIDP.Client, clientConfig)
+
+	sessionID, err := state.idpRecordClientSession("username",
+		valid_client_id, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same user and client must keep the same sid.
+	secondSessionID, err := state.idpRecordClientSession("username",
+		valid_client_id, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionID != secondSessionID {
+		t.Fatalf("sid changed: %s != %s", sessionID, secondSessionID)
+	}
+
+	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{}
+	form.Add("client_id", valid_client_id)
+	form.Add("post_logout_redirect_uri",
+		"https://localhost:12345/loggedout?from=rp")
+	form.Add("state", "somestate")
+
+	// An ID token alone, without the session cookie, must be confirmed.
+	signer, err := getJoseSignerWithKeyID(state.Signer, "JWT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken, err := state.idpSerializeIDToken(signer, valid_client_id,
+		openIDConnectIDToken{Issuer: state.idpGetIssuer(),
+			Subject: "username", Audience: []string{valid_client_id},
+			SessionID: sessionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hintForm := url.Values{"id_token_hint": {idToken}}
+	req, err := http.NewRequest("GET",
+		idpOpenIDCEndSessionPath+"?"+hintForm.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(req, state.idpOpenIDCEndSessionHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.idpGetUserSessions("username")) != 1 {
+		t.Fatal("sessions terminated without the session cookie")
+	}
+
+	// So must the session cookie alone.
+	req, err = http.NewRequest("GET",
+		idpOpenIDCEndSessionPath+"?"+form.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieVal})
+	rr, err := checkRequestHandlerCode(req, state.idpOpenIDCEndSessionHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.idpGetUserSessions("username")) != 1 {
+		t.Fatal("sessions terminated without confirmation")
+	}
+	match := regexp.MustCompile(`name="logout_token" value="([^"]+)"`).
+		FindStringSubmatch(rr.Body.String())
+	if match == nil {
+		t.Fatal("no logout_token in the confirmation page")
+	}
+	form.Set("logout_token", match[1])
+	// The confirmation cannot be replayed by another user.
+	otherCookieVal, err := state.setNewAuthCookie(nil, "otheruser",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("POST", idpOpenIDCEndSessionPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: otherCookieVal})
+	_, err = checkRequestHandlerCode(req, state.idpOpenIDCEndSessionHandler,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("POST", idpOpenIDCEndSessionPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieVal})
+	rr, err = checkRequestHandlerCode(req, state.idpOpenIDCEndSessionHandler,
+		http.StatusFound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLocation :=
+		"https://localhost:12345/loggedout?from=rp&state=somestate"
+	if location := rr.Header().Get("Location"); location != expectedLocation {
+		t.Fatalf("unexpected location %s", location)
+	}
+	if len(state.idpGetUserSessions("username")) != 0 {
+		t.Fatal("sessions not terminated")
+	}
+	var logoutToken string
+	select {
+	case logoutToken = <-logoutTokens:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for backchannel logout")
+	}
+	incomingAlgos, err := state.getJoseKeymastedVerifierList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := jwt.ParseSigned(logoutToken, incomingAlgos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims idpLogoutToken
+	if err := state.JWTClaims(tok, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.SessionID != sessionID || claims.Subject != "username" {
+		t.Fatalf("unexpected logout token claims %+v", claims)
+	}
+	if _, ok := claims.Events[idpBackChannelLogoutEvent]; !ok {
+		t.Fatalf("missing backchannel logout event %+v", claims)
+	}
+
+	// A redirect uri not allowed for the client must be rejected.
+	form.Del("logout_token")
+	form.Set("post_logout_redirect_uri", "https://evil.example.com/")
+	badReq, err := http.NewRequest("GET",
+		idpOpenIDCEndSessionPath+"?"+form.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(badReq, state.idpOpenIDCEndSessionHandler,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The session cookie with an ID token of the same user needs no
+	// confirmation.
+	sessionID, err = state.idpRecordClientSession("username",
+		valid_client_id, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken, err = state.idpSerializeIDToken(signer, valid_client_id,
+		openIDConnectIDToken{Issuer: state.idpGetIssuer(),
+			Subject: "username", Audience: []string{valid_client_id},
+			SessionID: sessionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hintForm.Set("id_token_hint", idToken)
+	req, err = http.NewRequest("GET",
+		idpOpenIDCEndSessionPath+"?"+hintForm.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieVal})
+	_, err = checkRequestHandlerCode(req, state.idpOpenIDCEndSessionHandler,
+		http.StatusFound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.idpGetUserSessions("username")) != 0 {
+		t.Fatal("sessions not terminated")
+	}
+}
+
+func TestIDPOpenIDCClientLogoutConfig(t *testing.T) {
+	validConfigs := []OpenIDConnectClientConfig{
+		{},
+		{BackChannelLogoutURI: "https://rp/logout"},
+	}
+	for _, client := range validConfigs {
+		if err := client.validateLogoutConfig(); err != nil {
+			t.Errorf("config %+v should be valid: %s", client, err)
+		}
+	}
+	invalidConfigs := []OpenIDConnectClientConfig{
+		{BackChannelLogoutURI: "http://rp/logout"},
+		{BackChannelLogoutURI: "rp/logout"},
+	}
+	for _, client := range invalidConfigs {
+		if err := client.validateLogoutConfig(); err == nil {
+			t.Errorf("config %+v should be invalid", client)
+		}
+	}
+}
+
+func TestLogoutRequiresConfirmation(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.HostIdentity = "localhost"
+	if err := state.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	clientID := "valid_client_id"
+	state.Config.OpenIDConnectIDP.Client = append(
+		state.Config.OpenIDConnectIDP.Client,
+		OpenIDConnectClientConfig{ClientID: clientID,
+			AllowedRedirectURLRE: []string{"localhost"}})
+	_, err = state.idpRecordClientSession("username", clientID,
+		time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A plain GET, as from an image on another site, must be confirmed.
+	req, err := http.NewRequest("GET", logoutPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieVal})
+	rr, err := checkRequestHandlerCode(req, state.logoutHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.idpGetUserSessions("username")) != 1 {
+		t.Fatal("sessions terminated without confirmation")
+	}
+	match := regexp.MustCompile(`name="logout_token" value="([^"]+)"`).
+		FindStringSubmatch(rr.Body.String())
+	if match == nil {
+		t.Fatal("no logout_token in the confirmation page")
+	}
+	form := url.Values{"logout_token": {match[1]}}
+	req, err = http.NewRequest("POST", logoutPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieVal})
+	rr, err = checkRequestHandlerCode(req, state.logoutHandler,
+		http.StatusFound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location := rr.Header().Get("Location"); location != "/?user=username" {
+		t.Fatalf("unexpected location %s", location)
+	}
+	if len(state.idpGetUserSessions("username")) != 0 {
+		t.Fatal("sessions not terminated")
+	}
+}
+
+func TestIDPOpenIDCConsentFlow(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.Config.Base.AllowedAuthBackendsForWebUI = []string{"password"}
+	state.HostIdentity = "localhost"
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	state.Config.Base.DataDirectory = dir
+	err = initDB(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid_client_id := "valid_client_id"
+	valid_redirect_uri := "https://localhost:12345"
+	clientConfig := OpenIDConnectClientConfig{ClientID: valid_client_id,
+		ClientSecret: "secret_password", AllowedRedirectURLRE: []string{"localhost"},
+		RequireConsent: true}
+	state.Config.OpenIDConnectIDP.Client = append(state.Config.OpenIDConnectIDP.Client, clientConfig)
+	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := http.Cookie{Name: authCookieName, Value: cookieVal}
+
+	form := url.Values{}
+	form.Add("scope", "openid")
+	form.Add("response_type", "code")
+	form.Add("client_id", valid_client_id)
+	form.Add("redirect_uri", valid_redirect_uri)
+	form.Add("state", "this is my state")
+	doAuthorize := func(form url.Values, expectedStatus int) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", idpOpenIDCAuthorizationPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&authCookie)
+		rr, err := checkRequestHandlerCode(req,
+			state.idpOpenIDCAuthorizationHandler, expectedStatus)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	// First time we must get the consent page.
+	rr := doAuthorize(form, http.StatusOK)
+	matches := regexp.MustCompile(`name="consent_token" value="([^"]+)"`).FindStringSubmatch(rr.Body.String())
+	if len(matches) != 2 {
+		t.Fatalf("consent token not found in %s", rr.Body.String())
+	}
+	consentForm := url.Values{}
+	for key, values := range form {
+		consentForm[key] = values
+	}
+	consentForm.Set("consent_token", matches[1])
+	// Denying sends the user back with an error.
+	consentForm.Set("consent", "Deny")
+	rr = doAuthorize(consentForm, http.StatusFound)
+	denyLocation, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query := denyLocation.Query(); query.Get("error") != "access_denied" ||
+		query.Get("state") != "this is my state" {
+		t.Fatalf("unexpected location %s", rr.Header().Get("Location"))
+	}
+	// A consent token for a different request must be rejected.
+	tamperedForm := url.Values{}
+	for key, values := range consentForm {
+		tamperedForm[key] = values
+	}
+	tamperedForm.Set("scope", "openid email")
+	doAuthorize(tamperedForm, http.StatusBadRequest)
+	// Approving issues the code.
+	consentForm.Set("consent", "Approve")
+	rr = doAuthorize(consentForm, http.StatusFound)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("code") == "" {
+		t.Fatalf("no code in %s", location)
+	}
+	// The approval is remembered.
+	doAuthorize(form, http.StatusFound)
+	// But not for additional scopes.
+	form.Set("scope", "openid email")
+	doAuthorize(form, http.StatusOK)
+
+	// Now revoke it.
+	revokeForm := url.Values{}
+	revokeForm.Add("username", "username")
+	revokeForm.Add("client_id", valid_client_id)
+	revokeForm.Add("action", "Revoke")
+	revokeReq, err := http.NewRequest("POST", idpConsentManagementPath,
+		strings.NewReader(revokeForm.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	revokeReq.AddCookie(&authCookie)
+	_, err = checkRequestHandlerCode(revokeReq, state.idpConsentManagerHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("scope", "openid")
+	doAuthorize(form, http.StatusOK)
+	state.profileStore.Close()
+}
+
+func TestIDPOpenIDCSealedPairwiseSecret(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.Config.OpenIDConnectIDP.Client = append(
+		state.Config.OpenIDConnectIDP.Client, OpenIDConnectClientConfig{
+			ClientID: "pairwise1", SubjectType: idpSubjectTypePairwise})
+	masterSecret := []byte("0123456789abcdef0123456789abcdef")
+	password := []byte("password")
+	sealedSecret, err := cryptoutils.PGPArmorEncryptBytes(masterSecret,
+		password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFilename := filepath.Join(t.TempDir(), "pairwise.secret")
+	if err := os.WriteFile(secretFilename, sealedSecret, 0600); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.OpenIDConnectIDP.PairwiseSubjectSecretFilename = secretFilename
+	if err := state.loadPairwiseSubjectSecret(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.checkPairwiseSubjectSecretUnsealed(); err == nil {
+		t.Fatal("sealed pairwise secret accepted with an unsealed CA")
+	}
+	if _, err := state.idpGetSubject("pairwise1", "username"); err == nil {
+		t.Fatal("got a pairwise subject while sealed")
+	}
+	if err := state.loadPairwiseSubjectSecret([]byte("wrong")); err == nil {
+		t.Fatal("unsealed pairwise secret with the wrong password")
+	}
+	if err := state.loadPairwiseSubjectSecret(password); err != nil {
+		t.Fatal(err)
+	}
+	subject, err := state.idpGetSubject("pairwise1", "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := hkdf.Key(sha256.New, masterSecret, nil,
+		idpPairwiseSecretInfo, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSubject, err := computePairwiseSubject(secret, "pairwise1",
+		"username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != expectedSubject {
+		t.Fatalf("unexpected subject: %s != %s", subject, expectedSubject)
+	}
+}
+
+func TestIDPOpenIDCPairwiseSubject(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.Config.Base.AllowedAuthBackendsForWebUI = []string{"password"}
+	state.HostIdentity = "localhost"
+
+	valid_client_secret := "secret_password"
+	valid_redirect_uri := "https://localhost:12345"
+	for _, clientID := range []string{"pairwise1", "pairwise2", "pairwise3"} {
+		clientConfig := OpenIDConnectClientConfig{ClientID: clientID,
+			ClientSecret: valid_client_secret, AllowedRedirectURLRE: []string{"localhost"},
+			SubjectType: idpSubjectTypePairwise}
+		if clientID == "pairwise3" {
+			clientConfig.SectorIdentifier = "pairwise1"
+		}
+		state.Config.OpenIDConnectIDP.Client = append(state.Config.OpenIDConnectIDP.Client, clientConfig)
+	}
+	if err := state.loadPairwiseSubjectSecret(nil); err == nil {
+		t.Fatal("pairwise clients accepted without a secret")
+	}
+	secretFilename := filepath.Join(t.TempDir(), "pairwise.secret")
+	err = os.WriteFile(secretFilename,
+		[]byte("0123456789abcdef0123456789abcdef\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.OpenIDConnectIDP.PairwiseSubjectSecretFilename = secretFilename
+	if err := state.loadPairwiseSubjectSecret(nil); err != nil {
+		t.Fatal(err)
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := http.Cookie{Name: authCookieName, Value: cookieVal}
+	getSubjects := func(clientID string) (string, openidConnectUserInfo) {
+		form := url.Values{}
+		form.Add("scope", "openid email")
+		form.Add("response_type", "code")
+		form.Add("client_id", clientID)
+		form.Add("redirect_uri", valid_redirect_uri)
+		req, err := http.NewRequest("POST", idpOpenIDCAuthorizationPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&authCookie)
+		rr, err := checkRequestHandlerCode(req,
+			state.idpOpenIDCAuthorizationHandler, http.StatusFound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		location, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenForm := url.Values{}
+		tokenForm.Add("grant_type", "authorization_code")
+		tokenForm.Add("redirect_uri", valid_redirect_uri)
+		tokenForm.Add("code", location.Query().Get("code"))
+		tokenReq, err := http.NewRequest("POST", idpOpenIDCTokenPath,
+			strings.NewReader(tokenForm.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		tokenReq.SetBasicAuth(clientID, valid_client_secret)
+		tokenRR, err := checkRequestHandlerCode(tokenReq,
+			state.idpOpenIDCTokenHandler, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resultToken tokenResponse
+		err = json.NewDecoder(tokenRR.Result().Body).Decode(&resultToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		incomingAlgos, err := state.getJoseKeymastedVerifierList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := jwt.ParseSigned(resultToken.IDToken, incomingAlgos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idToken openIDConnectIDToken
+		if err := state.JWTClaims(tok, &idToken); err != nil {
+			t.Fatal(err)
+		}
+		tok, err = jwt.ParseSigned(resultToken.AccessToken, incomingAlgos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rawAccessToken map[string]interface{}
+		if err := state.JWTClaims(tok, &rawAccessToken); err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range rawAccessToken {
+			if value == "username" {
+				t.Fatalf("access token leaks username: %v", rawAccessToken)
+			}
+		}
+		userinfoReq, err := http.NewRequest("GET", idpOpenIDCUserinfoPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userinfoReq.Header.Add("Authorization", "Bearer "+resultToken.AccessToken)
+		userinfoRR, err := checkRequestHandlerCode(userinfoReq,
+			state.idpOpenIDCUserinfoHandler, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var userInfo openidConnectUserInfo
+		err = json.NewDecoder(userinfoRR.Result().Body).Decode(&userInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idToken.Subject, userInfo
+	}
+	subject1, userInfo1 := getSubjects("pairwise1")
+	if subject1 == "username" || subject1 != userInfo1.Subject {
+		t.Fatalf("bad pairwise subject id_token=%s userinfo=%s",
+			subject1, userInfo1.Subject)
+	}
+	if userInfo1.Username != "" || userInfo1.Name != "" ||
+		userInfo1.Login != "" {
+		t.Fatalf("userinfo leaks username: %+v", userInfo1)
+	}
+	if userInfo1.Email == "" {
+		t.Fatalf("email scope requested but not returned: %+v", userInfo1)
+	}
+	subject2, _ := getSubjects("pairwise2")
+	if subject2 == subject1 {
+		t.Fatal("different sectors must have different subjects")
+	}
+	subject3, _ := getSubjects("pairwise3")
+	if subject3 != subject1 {
+		t.Fatal("same sector must have the same subject")
+	}
+	subjectAgain, _ := getSubjects("pairwise1")
+	if subjectAgain != subject1 {
+		t.Fatal("pairwise subject is not stable")
+	}
+}
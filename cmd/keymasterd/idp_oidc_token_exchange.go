@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// Token exchange as described in https://www.rfc-editor.org/rfc/rfc8693
+// It lets holders of a keymaster certificate get IdP tokens without going
+// through the browser.
+
+const idpTokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+const idpTokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+const idpTokenTypeIDToken = "urn:ietf:params:oauth:token-type:id_token"
+
+// The subject_token is the base64 encoded DER of the keymaster issued X.509
+// certificate used as TLS client certificate for the request.
+const idpTokenTypeKeymasterX509 = "urn:cloud-foundations:keymaster:token-type:x509-mtls"
+
+// The subject_token is the auth cookie value returned by the SSH certificate
+// challenge login (sshcertauth.DefaultLoginWithChallengePath).
+const idpTokenTypeKeymasterSSHCert = "urn:cloud-foundations:keymaster:token-type:sshcert-challenge"
+
+const idpTokenExchangeMaxLifetime = 12 * time.Hour
+
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	IDToken         string `json:"id_token,omitempty"`
+}
+
+var errorInvalidSubjectToken = errors.New("invalid subject_token")
+
+// idpTokenExchangeGetSubject verifies the subject token and returns the
+// username it belongs to and the time after which tokens must not be valid.
+func (state *RuntimeState) idpTokenExchangeGetSubject(r *http.Request) (
+	string, time.Time, error) {
+	subjectToken := r.Form.Get("subject_token")
+	if subjectToken == "" {
+		return "", time.Time{}, errorInvalidSubjectToken
+	}
+	switch r.Form.Get("subject_token_type") {
+	case idpTokenTypeKeymasterX509:
+		if r.TLS == nil || len(r.TLS.VerifiedChains) < 1 {
+			return "", time.Time{}, errors.New("no client certificate")
+		}
+		certDer, err := base64.StdEncoding.DecodeString(subjectToken)
+		if err != nil {
+			return "", time.Time{}, errorInvalidSubjectToken
+		}
+		username, userCert, err := state.getUsernameIfKeymasterSigned(
+			r.TLS.VerifiedChains)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if username == "" || !bytes.Equal(userCert.Raw, certDer) {
+			return "", time.Time{}, errorInvalidSubjectToken
+		}
+		return username, userCert.NotAfter, nil
+	case idpTokenTypeKeymasterSSHCert:
+		authData, err := state.getAuthInfoFromAuthJWT(subjectToken)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if authData.AuthType&AuthTypeSSHCert == 0 ||
+			authData.ExpiresAt.Before(time.Now()) {
+			return "", time.Time{}, errorInvalidSubjectToken
+		}
+		notAfter := authData.CertNotAfter
+		if authData.ExpiresAt.Before(notAfter) {
+			notAfter = authData.ExpiresAt
+		}
+		return authData.Username, notAfter, nil
+	default:
+		return "", time.Time{}, errors.New("unsupported subject_token_type")
+	}
+}
+
+// idpTokenExchangeAuthenticateClient returns the client making the request.
+// Only confidential clients can exchange tokens and they must present their
+// secret.
+func (state *RuntimeState) idpTokenExchangeAuthenticateClient(
+	r *http.Request) (*OpenIDConnectClientConfig, error) {
+	clientID, pass, ok := r.BasicAuth()
+	if ok {
+		if unescaped, err := url.QueryUnescape(clientID); err == nil {
+			clientID = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(pass); err == nil {
+			pass = unescaped
+		}
+	} else {
+		clientID = r.Form.Get("client_id")
+		pass = r.Form.Get("client_secret")
+	}
+	oidcClient, err := state.idpOpenIDCGetClientConfig(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if oidcClient.ClientSecret == "" {
+		return nil, errors.New("public clients cannot exchange tokens")
+	}
+	if !oidcClient.ValidClientSecret(pass) {
+		return nil, errors.New("invalid client secret")
+	}
+	return oidcClient, nil
+}
+
+func (state *RuntimeState) idpOpenIDCTokenExchangeHandler(
+	w http.ResponseWriter, r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	oidcClient, err := state.idpTokenExchangeAuthenticateClient(r)
+	if err != nil {
+		logger.Debugf(1, "token exchange client auth failed: %s", err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	if !oidcClient.AllowTokenExchange {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Token exchange not allowed for client")
+		return
+	}
+	username, notAfter, err := state.idpTokenExchangeGetSubject(r)
+	if err != nil {
+		logger.Debugf(1, "token exchange invalid subject: %s", err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid subject_token")
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(username)
+	scopes := strings.Fields(r.Form.Get("scope"))
+	hasOpenIDScope := false
+	for _, requestedScope := range scopes {
+		if requestedScope == "openid" {
+			hasOpenIDScope = true
+		}
+		if !oidcClient.ScopeIsAllowed(requestedScope) {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Scope not allowed for client")
+			return
+		}
+	}
+	if !hasOpenIDScope {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid scope value")
+		return
+	}
+	var accessAudience []string
+	for _, requestedAudience := range r.Form["audience"] {
+		if requestedAudience == oidcClient.ClientID {
+			continue
+		}
+		if !oidcClient.RequestedAudienceIsAllowed(requestedAudience) {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid audience")
+			return
+		}
+		validAudience, err := oidcClient.CorsOriginAllowed(requestedAudience)
+		if err != nil {
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if !validAudience {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid audience")
+			return
+		}
+		accessAudience = append(accessAudience, requestedAudience)
+	}
+	if oidcClient.RequireConsent {
+		hasConsent, err := state.idpHasConsent(username, oidcClient.ClientID,
+			scopes, accessAudience)
+		if err != nil {
+			logger.Printf("loading profile error: %v", err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		// There is no browser to ask the user, so consent must have been
+		// given before in the authorization flow.
+		if !hasConsent {
+			state.writeFailureResponse(w, r, http.StatusForbidden,
+				"Consent required")
+			return
+		}
+	}
+	requestedTokenType := r.Form.Get("requested_token_type")
+	switch requestedTokenType {
+	case "", idpTokenTypeAccessToken, idpTokenTypeIDToken:
+	default:
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Unsupported requested_token_type")
+		return
+	}
+	now := time.Now()
+	expiration := now.Add(idpTokenExchangeMaxLifetime)
+	if notAfter.Before(expiration) {
+		expiration = notAfter
+	}
+	if !expiration.After(now) {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Subject token expired")
+		return
+	}
+	subject, err := state.idpGetSubject(oidcClient.ClientID, username)
+	if err != nil {
+		logger.Printf("error getting subject in token exchange: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	signer, err := getJoseSignerWithKeyID(state.Signer, "JWT")
+	if err != nil {
+		logger.Printf("error creating signer in token exchange: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	idToken := openIDConnectIDToken{Issuer: state.idpGetIssuer(),
+		Subject: subject, Audience: []string{oidcClient.ClientID}}
+	idToken.Expiration = expiration.Unix()
+	idToken.IssuedAt = now.Unix()
+	signedIDToken, err := state.idpSerializeIDToken(signer,
+		oidcClient.ClientID, idToken)
+	if err != nil {
+		logger.Printf("error signing idToken in token exchange: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	accessToken := bearerAccessToken{Issuer: state.idpGetIssuer(),
+		Scope: strings.Join(scopes, " "), ClientID: oidcClient.ClientID}
+	err = state.idpSetAccessTokenUsername(&accessToken, oidcClient, username)
+	if err != nil {
+		logger.Printf("error protecting accessToken in token exchange: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	accessToken.Expiration = idToken.Expiration
+	accessToken.Type = "bearer"
+	accessToken.IssuedAt = idToken.IssuedAt
+	if len(accessAudience) > 0 {
+		accessToken.Audience = append(accessAudience,
+			state.idpGetIssuer()+idpOpenIDCUserinfoPath)
+	}
+	signedAccessToken, err := jwt.Signed(signer).Claims(accessToken).Serialize()
+	if err != nil {
+		logger.Printf("error signing accessToken in token exchange: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	outToken := tokenExchangeResponse{
+		AccessToken:     signedAccessToken,
+		IssuedTokenType: idpTokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int(idToken.Expiration - idToken.IssuedAt),
+		IDToken:         signedIDToken,
+	}
+	if requestedTokenType == idpTokenTypeIDToken {
+		outToken.AccessToken = signedIDToken
+		outToken.IssuedTokenType = idpTokenTypeIDToken
+		outToken.TokenType = "N_A"
+		outToken.IDToken = ""
+	}
+	b, err := json.Marshal(outToken)
+	if err != nil {
+		logger.Printf("error marshaling in token exchange: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	logger.Debugf(0, "IDP: token exchange user=%s client=%s type=%s",
+		username, oidcClient.ClientID, r.Form.Get("subject_token_type"))
+	eventNotifier.PublishServiceProviderLoginEvent(r, oidcClient.ClientID,
+		username)
+	eventNotifier.PublishOIDCTokenIssueEvent(r, oidcClient.ClientID, username)
+	var out bytes.Buffer
+	json.Indent(&out, b, "", "\t")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	out.WriteTo(w)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func doTokenExchangeRequest(t *testing.T, state *RuntimeState,
+	form url.Values, prepare func(*http.Request),
+	expectedStatus int) *tokenExchangeResponse {
+	req, err := http.NewRequest("POST", idpOpenIDCTokenPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if prepare != nil {
+		prepare(req)
+	}
+	rr, err := checkRequestHandlerCode(req, state.idpOpenIDCTokenHandler,
+		expectedStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedStatus != http.StatusOK {
+		return nil
+	}
+	var response tokenExchangeResponse
+	if err := json.NewDecoder(rr.Result().Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return &response
+}
+
+func TestIDPOpenIDCTokenExchangeX509(t *testing.T) {
+	state, tmpdir, err := testCreateRuntimeStateWithBothCAs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	state.HostIdentity = "localhost"
+	state.Config.OpenIDConnectIDP.Client = []OpenIDConnectClientConfig{
+		{ClientID: "exchange", ClientSecret: "secret",
+			AllowTokenExchange: true},
+		{ClientID: "noexchange", ClientSecret: "secret"},
+	}
+	connectionState, err := testMakeConnectionState("testdata/alice.pem",
+		"testdata/KeymasterCA.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTLS := func(req *http.Request) {
+		req.TLS = connectionState
+		req.SetBasicAuth("exchange", "secret")
+	}
+	form := url.Values{}
+	form.Add("grant_type", idpTokenExchangeGrantType)
+	form.Add("subject_token_type", idpTokenTypeKeymasterX509)
+	form.Add("scope", "openid")
+	form.Add("subject_token", base64.StdEncoding.EncodeToString(
+		connectionState.VerifiedChains[0][0].Raw))
+	form.Add("requested_token_type", idpTokenTypeIDToken)
+	response := doTokenExchangeRequest(t, state, form, setTLS, http.StatusOK)
+	if response.IssuedTokenType != idpTokenTypeIDToken {
+		t.Fatalf("unexpected issued token type %s", response.IssuedTokenType)
+	}
+	incomingAlgos, err := state.getJoseKeymastedVerifierList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := jwt.ParseSigned(response.AccessToken, incomingAlgos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idToken openIDConnectIDToken
+	if err := state.JWTClaims(tok, &idToken); err != nil {
+		t.Fatal(err)
+	}
+	if idToken.Subject != "alice" || idToken.Audience[0] != "exchange" {
+		t.Fatalf("unexpected id token %+v", idToken)
+	}
+	// The subject token must be the certificate presented.
+	badForm := url.Values{}
+	for key, values := range form {
+		badForm[key] = values
+	}
+	badForm.Set("subject_token", base64.StdEncoding.EncodeToString([]byte("other")))
+	doTokenExchangeRequest(t, state, badForm, setTLS, http.StatusBadRequest)
+	// No TLS, no exchange.
+	doTokenExchangeRequest(t, state, form, func(req *http.Request) {
+		req.SetBasicAuth("exchange", "secret")
+	}, http.StatusBadRequest)
+	// Wrong secret.
+	doTokenExchangeRequest(t, state, form, func(req *http.Request) {
+		req.TLS = connectionState
+		req.SetBasicAuth("exchange", "bad")
+	}, http.StatusUnauthorized)
+	// The openid scope is required.
+	badForm.Set("subject_token", form.Get("subject_token"))
+	badForm.Set("scope", "email")
+	doTokenExchangeRequest(t, state, badForm, setTLS, http.StatusBadRequest)
+	// Client not allowed to exchange.
+	doTokenExchangeRequest(t, state, form, func(req *http.Request) {
+		req.TLS = connectionState
+		req.SetBasicAuth("noexchange", "secret")
+	}, http.StatusBadRequest)
+	state.profileStore.Close()
+}
+
+func TestIDPOpenIDCTokenExchangeSSHCert(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.HostIdentity = "localhost"
+	state.Config.Base.DataDirectory = t.TempDir()
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	defer state.profileStore.Close()
+	state.Config.OpenIDConnectIDP.Client = []OpenIDConnectClientConfig{
+		{ClientID: "exchange", ClientSecret: "secret",
+			AllowTokenExchange: true, AllowedScopes: []string{"email"}},
+		{ClientID: "public", AllowTokenExchange: true},
+		{ClientID: "consent", ClientSecret: "secret",
+			AllowTokenExchange: true, RequireConsent: true},
+	}
+	certNotAfter := time.Now().Add(10 * time.Minute)
+	sshCookie, err := state.genNewSerializedAuthJWTWithCertNotAfter("username",
+		AuthTypeSSHCert, int64(maxCertificateLifetime.Seconds()), certNotAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{}
+	form.Add("grant_type", idpTokenExchangeGrantType)
+	form.Add("client_id", "exchange")
+	form.Add("client_secret", "secret")
+	form.Add("subject_token_type", idpTokenTypeKeymasterSSHCert)
+	form.Add("subject_token", sshCookie)
+	form.Add("scope", "openid email")
+	response := doTokenExchangeRequest(t, state, form, nil, http.StatusOK)
+	if response.ExpiresIn > int(time.Until(certNotAfter).Seconds())+1 {
+		t.Fatalf("lifetime %d not capped by certificate", response.ExpiresIn)
+	}
+	if response.IDToken == "" || response.AccessToken == "" {
+		t.Fatalf("missing tokens %+v", response)
+	}
+	form.Set("scope", "openid profile")
+	doTokenExchangeRequest(t, state, form, nil, http.StatusBadRequest)
+	form.Set("scope", "openid")
+	// Public clients cannot exchange tokens.
+	form.Set("client_id", "public")
+	form.Del("client_secret")
+	doTokenExchangeRequest(t, state, form, nil, http.StatusUnauthorized)
+	// Consent must have been given in the authorization flow.
+	form.Set("client_id", "consent")
+	form.Set("client_secret", "secret")
+	doTokenExchangeRequest(t, state, form, nil, http.StatusForbidden)
+	err = state.idpSaveConsent("username", "consent", []string{"openid"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doTokenExchangeRequest(t, state, form, nil, http.StatusOK)
+	// Password cookies are not proof of certificate possession.
+	passwordCookie, err := state.setNewAuthCookie(nil, "username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("subject_token", passwordCookie)
+	doTokenExchangeRequest(t, state, form, nil, http.StatusBadRequest)
+}
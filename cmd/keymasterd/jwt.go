@@ -235,3 +235,23 @@ func (state *RuntimeState) getStorageDataFromStorageStringDataJWT(serializedToke
 	}
 	return inboundJWT, nil
 }
+
+// getJoseSignerWithKeyID returns a signer that sets the kid header to the
+// fingerprint of the signing key and the typ header to tokenType. This is
+// what relying parties need in order to pick the right key from the JWKS.
+func getJoseSignerWithKeyID(signer crypto.Signer,
+	tokenType string) (jose.Signer, error) {
+	sigAlgo, err := publicToPreferedJoseSigAlgo(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("cannot find preferred lgo err=%s", err)
+	}
+	kid, err := getKeyFingerprint(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	signerOptions := (&jose.SignerOptions{}).WithType(
+		jose.ContentType(tokenType)).WithHeader("kid", kid)
+	internalSigner := cryptosigner.Opaque(signer)
+	return jose.NewSigner(jose.SigningKey{Algorithm: sigAlgo,
+		Key: internalSigner}, signerOptions)
+}
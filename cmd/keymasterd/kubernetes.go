@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// loadKubernetesClusters validates the Kubernetes clusters advertised to
+// clients and reads their CA files.
+func (state *RuntimeState) loadKubernetesClusters() error {
+	state.kubernetesClusters = nil
+	names := make(map[string]struct{})
+	for _, config := range state.Config.KubernetesClusters {
+		if config.Name == "" {
+			return fmt.Errorf("kubernetes cluster without name")
+		}
+		if _, ok := names[config.Name]; ok {
+			return fmt.Errorf("duplicate kubernetes cluster name='%s'",
+				config.Name)
+		}
+		names[config.Name] = struct{}{}
+		serverURL, err := url.Parse(config.Server)
+		if err != nil {
+			return fmt.Errorf("kubernetes cluster %s: %s", config.Name, err)
+		}
+		if serverURL.Scheme != "https" || serverURL.Host == "" {
+			return fmt.Errorf("kubernetes cluster %s: server must be an https URL",
+				config.Name)
+		}
+		cluster := proto.KubernetesCluster{
+			Name:      config.Name,
+			Server:    config.Server,
+			Namespace: config.Namespace,
+		}
+		if config.CertificateAuthorityFilename != "" {
+			caData, err := exitsAndCanRead(config.CertificateAuthorityFilename,
+				"kubernetes CA file")
+			if err != nil {
+				return err
+			}
+			if !x509.NewCertPool().AppendCertsFromPEM(caData) {
+				return fmt.Errorf("kubernetes cluster %s: no certificates in %s",
+					config.Name, config.CertificateAuthorityFilename)
+			}
+			cluster.CertificateAuthorityData = caData
+		}
+		state.kubernetesClusters = append(state.kubernetesClusters, cluster)
+	}
+	return nil
+}
+
+func (state *RuntimeState) kubernetesClustersHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != "GET" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	response := proto.KubernetesClustersResponse{
+		Clusters: state.kubernetesClusters,
+	}
+	if response.Clusters == nil {
+		response.Clusters = []proto.KubernetesCluster{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
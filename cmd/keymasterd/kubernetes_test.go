@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestLoadKubernetesClusters(t *testing.T) {
+	dir := t.TempDir()
+	caFilename := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFilename, []byte(rootCAPem), 0644); err != nil {
+		t.Fatal(err)
+	}
+	notCAFilename := filepath.Join(dir, "notca.pem")
+	if err := os.WriteFile(notCAFilename, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := RuntimeState{}
+	state.Config.KubernetesClusters = []kubernetesClusterConfig{
+		{Name: "prod", Server: "https://prod.example.com:6443",
+			CertificateAuthorityFilename: caFilename, Namespace: "apps"},
+		{Name: "dev", Server: "https://dev.example.com"},
+	}
+	if err := state.loadKubernetesClusters(); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.kubernetesClusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %d", len(state.kubernetesClusters))
+	}
+	if string(state.kubernetesClusters[0].CertificateAuthorityData) != rootCAPem {
+		t.Fatal("CA data not loaded")
+	}
+	badConfigs := [][]kubernetesClusterConfig{
+		{{Server: "https://prod.example.com"}},
+		{{Name: "prod", Server: "http://prod.example.com"}},
+		{{Name: "prod", Server: "prod.example.com"}},
+		{{Name: "prod", Server: "https://prod.example.com",
+			CertificateAuthorityFilename: filepath.Join(dir, "missing")}},
+		{{Name: "prod", Server: "https://prod.example.com",
+			CertificateAuthorityFilename: notCAFilename}},
+		{
+			{Name: "prod", Server: "https://prod.example.com"},
+			{Name: "prod", Server: "https://prod2.example.com"},
+		},
+	}
+	for _, configs := range badConfigs {
+		state := RuntimeState{}
+		state.Config.KubernetesClusters = configs
+		if err := state.loadKubernetesClusters(); err == nil {
+			t.Errorf("config %+v should have failed", configs)
+		}
+	}
+}
+
+func TestKubernetesClustersHandler(t *testing.T) {
+	state := RuntimeState{}
+	state.Config.KubernetesClusters = []kubernetesClusterConfig{
+		{Name: "dev", Server: "https://dev.example.com", Namespace: "apps"},
+	}
+	if err := state.loadKubernetesClusters(); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", proto.KubernetesClustersPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := checkRequestHandlerCode(req, state.kubernetesClustersHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response proto.KubernetesClustersResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Clusters) != 1 || response.Clusters[0].Name != "dev" ||
+		response.Clusters[0].Namespace != "apps" {
+		t.Fatalf("unexpected response: %+v", response)
+	}
+	req, err = http.NewRequest("POST", proto.KubernetesClustersPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkRequestHandlerCode(req, state.kubernetesClustersHandler,
+		http.StatusMethodNotAllowed); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -104,7 +104,11 @@ var loginFailValues = []loginTestVector{
 func init() {
 	slogger := stdlog.New(os.Stderr, "", stdlog.LstdFlags)
 	logger = debuglogger.New(slogger)
-	eventNotifier = eventnotifier.New(logger)
+	var err error
+	eventNotifier, err = eventnotifier.New(eventnotifier.Params{Logger: logger})
+	if err != nil {
+		panic(err)
+	}
 }
 
 func createKeyBodyRequest(method, urlStr, filedata, durationString string) (*http.Request, error) {
@@ -677,7 +681,7 @@ func TestLoginAPIBasicAuth(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestLoginAPIFormAuth(t *testing.T) {
@@ -763,7 +767,7 @@ func TestLoginAPIFormAuth(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestProfileHandlerTemplate(t *testing.T) {
@@ -810,7 +814,7 @@ func TestProfileHandlerTemplate(t *testing.T) {
 	}
 	//TODO: verify HTML output
 
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestU2fTokenManagerHandlerUpdateSuccess(t *testing.T) {
@@ -881,7 +885,7 @@ func TestU2fTokenManagerHandlerUpdateSuccess(t *testing.T) {
 		t.Fatal("update not successul")
 	}
 
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestU2fTokenManagerHandlerDeleteNotAdmin(t *testing.T) {
@@ -949,7 +953,7 @@ func TestU2fTokenManagerHandlerDeleteNotAdmin(t *testing.T) {
 	if len(profile.U2fAuthData) != 2 {
 		t.Fatal("delete should not have succeeded")
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
 
 func TestU2fTokenManagerHandlerDeleteSuccess(t *testing.T) {
@@ -1017,5 +1021,5 @@ func TestU2fTokenManagerHandlerDeleteSuccess(t *testing.T) {
 	if len(profile.U2fAuthData) != 1 {
 		t.Fatal("update not successul")
 	}
-	state.dbDone <- struct{}{}
+	state.profileStore.Close()
 }
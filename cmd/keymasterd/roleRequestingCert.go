@@ -178,6 +178,7 @@ func (state *RuntimeState) roleRequetingCertGenHandler(w http.ResponseWriter, r
 		state.logger.Printf("Error generating cert", err)
 		return
 	}
+	eventNotifier.PublishX509(r, cert.Raw)
 	clientIpAddress := util.GetRequestRealIp(r)
 
 	w.Header().Set("Content-Disposition", `attachment; filename="roleRequstingCert.pem"`)
@@ -206,7 +207,6 @@ func (state *RuntimeState) withParamsGenerateRoleRequestingCert(params *roleRequ
 		return "", nil, fmt.Errorf("Cannot Parse Generated x509cert: %s\n", err)
 	}
 
-	eventNotifier.PublishX509(derCert)
 	cert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
 		Bytes: derCert}))
 	return cert, parsedCert, nil
@@ -337,6 +337,7 @@ func (state *RuntimeState) refreshRoleRequestingCertGenHandler(w http.ResponseWr
 		state.logger.Printf("Error generating cert", err)
 		return
 	}
+	eventNotifier.PublishX509(r, cert.Raw)
 	clientIpAddress := util.GetRequestRealIp(r)
 	w.Header().Set("Content-Disposition", `attachment; filename="roleRequstingCert.pem"`)
 	w.WriteHeader(200)
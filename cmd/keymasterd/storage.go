@@ -2,63 +2,44 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
+	"crypto"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/Cloud-Foundations/golib/pkg/awsutil/metadata"
 	"github.com/Cloud-Foundations/golib/pkg/awsutil/secretsmgr"
-	"github.com/Cloud-Foundations/golib/pkg/log"
-	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/encryptedstore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/encryptedstore/kmswrapper"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/raftstore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/sqlstore"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 )
 
 const (
 	userProfilePrefix = "profile_"
 	userProfileSuffix = ".gob"
-	profileDBFilename = "userProfiles.sqlite3"
 	cachedDBFilename  = "cachedDB.sqlite3"
-
-	dbConnectionLifetimeDefault = time.Minute * 15
-	dbConnectionLifetimeMaximum = time.Hour
-
-	dbSyncDelayDefault = time.Second * 3
-	dbSyncDelayMinimum = time.Second
-	dbSyncDelayMaximum = time.Minute
-
-	dbSyncIntervalDefault = time.Minute * 5
-	dbSyncIntervalMinimum = time.Second * 5
-	dbSyncIntervalMaximum = time.Minute * 15
+	raftDirectoryName = "raft"
 )
 
-func (config *ProfileStorageConfig) setSyncLimits() {
-	if config.SyncDelay < 1 {
-		config.SyncDelay = dbSyncDelayDefault
-	} else if config.SyncDelay < dbSyncDelayMinimum {
-		config.SyncDelay = dbSyncDelayMinimum
-	} else if config.SyncDelay > dbSyncDelayMaximum {
-		config.SyncDelay = dbSyncDelayMaximum
-	}
-	if config.SyncInterval < 1 {
-		config.SyncInterval = dbSyncIntervalDefault
-	} else if config.SyncInterval < dbSyncIntervalMinimum {
-		config.SyncInterval = dbSyncIntervalMinimum
-	} else if config.SyncInterval > dbSyncIntervalMaximum {
-		config.SyncInterval = dbSyncIntervalMaximum
-	}
-	if config.ConnectionLifetime < 1 {
-		config.ConnectionLifetime = dbConnectionLifetimeDefault
-	}
-	if config.ConnectionLifetime < config.SyncInterval {
-		config.ConnectionLifetime = config.SyncInterval
-	} else if config.ConnectionLifetime > dbConnectionLifetimeMaximum {
-		config.ConnectionLifetime = dbConnectionLifetimeMaximum
+// checkProfileKeySigner checks that the profile key can be derived from
+// signer when profiles are encrypted without a KMS key. It cannot be derived
+// from external signers.
+func (state *RuntimeState) checkProfileKeySigner(signer crypto.Signer) error {
+	config := state.Config.ProfileStorage.Encryption
+	if !config.Enabled || config.AwsKmsKeyId != "" {
+		return nil
 	}
+	if !encryptedstore.SignerSupported(signer) {
+		return errors.New(
+			"profile encryption with an external signer requires aws_kms_key_id")
+	}
+	return nil
 }
 
 func (state *RuntimeState) expandStorageUrl() error {
@@ -82,373 +63,165 @@ func (state *RuntimeState) expandStorageUrl() error {
 	return nil
 }
 
+// initDB opens the profile store selected by the storage URL: "raft:" for a
+// store replicated between the keymasterd servers, otherwise an SQL DB with
+// a local cache.
 func initDB(state *RuntimeState) (err error) {
 	state.logger.Debugf(3, "Top of initDB")
-	state.Config.ProfileStorage.setSyncLimits()
-	//open/create cache DB first
-	cacheDBFilename := filepath.Join(state.Config.Base.DataDirectory,
-		cachedDBFilename)
-	state.cacheDB, err = initFileDBSQLite(cacheDBFilename, state.cacheDB)
-	if err != nil {
-		state.logger.Printf("Failure on creation of cacheDB")
-		return err
-	}
-	state.logger.Debugf(3, "storage=%s", state.Config.ProfileStorage.StorageUrl)
-	storageURL := state.Config.ProfileStorage.StorageUrl
-	if storageURL == "" {
-		storageURL = "sqlite:"
-	}
-	splitString := strings.SplitN(storageURL, ":", 2)
-	if len(splitString) < 1 {
-		state.logger.Printf("invalid string")
-		err := errors.New("Bad storage url string")
-		return err
-	}
-	state.remoteDBQueryTimeout = time.Second * 2
-	state.dbDone = make(chan struct{})
-	go state.BackgroundDBCopy(state.Config.ProfileStorage.SyncDelay, state.dbDone, state.logger)
-	switch splitString[0] {
-	case "sqlite":
-		state.logger.Printf("doing sqlite")
-		return initDBSQlite(state)
-	case "postgresql":
-		state.logger.Printf("doing postgres")
-		return initDBPostgres(state)
-	default:
-		state.logger.Printf("invalid storage url string")
-		err := errors.New("Bad storage url string")
-		return err
-	}
-}
-
-func initDBPostgres(state *RuntimeState) (err error) {
-	state.dbType = "postgres"
-	state.db, err = sql.Open("postgres", state.Config.ProfileStorage.StorageUrl)
-	if err != nil {
-		return err
-	}
-	/// This should be changed to take care of DB schema
-	if true {
-		sqlStmt := `create table if not exists user_profile (id serial not null primary key, username text unique, profile_data bytea);`
-		_, err = state.db.Exec(sqlStmt)
-		if err != nil {
-			state.logger.Printf("init postgres err: %s: %q\n", err, sqlStmt)
-			return err
+	config := state.Config.ProfileStorage
+	state.logger.Debugf(3, "storage=%s", config.StorageUrl)
+	if config.StorageUrl == "raft:" {
+		raftConfig := config.Raft
+		if raftConfig.DataDirectory == "" {
+			raftConfig.DataDirectory = filepath.Join(
+				state.Config.Base.DataDirectory, raftDirectoryName)
 		}
-		sqlStmt = `create table if not exists expiring_signed_user_data(id serial not null primary key, username text not null, jws_data text not null, type integer not null, expiration_epoch integer not null, update_epoch integer not null, UNIQUE(username,type));`
-		_, err = state.db.Exec(sqlStmt)
+		state.logger.Printf("doing raft")
+		state.profileStore, err = raftstore.New(raftConfig, state.logger)
 		if err != nil {
-			state.logger.Printf("init postgres err: %s: %q\n", err, sqlStmt)
 			return err
 		}
+		return state.initProfileEncryption()
 	}
-	// Ensure that broken connections are replaced.
-	state.db.SetConnMaxLifetime(state.Config.ProfileStorage.ConnectionLifetime)
-	return nil
-}
-
-// This call initializes the database if it does not exist.
-func initDBSQlite(state *RuntimeState) (err error) {
-	state.dbType = "sqlite"
-	dbFilename := filepath.Join(state.Config.Base.DataDirectory,
-		profileDBFilename)
-	state.db, err = initFileDBSQLite(dbFilename, state.db)
+	state.profileStore, err = sqlstore.New(sqlstore.Config{
+		StorageUrl:    config.StorageUrl,
+		DataDirectory: state.Config.Base.DataDirectory,
+		CacheFilename: filepath.Join(state.Config.Base.DataDirectory,
+			cachedDBFilename),
+		ConnectionLifetime: config.ConnectionLifetime,
+		SyncDelay:          config.SyncDelay,
+		SyncInterval:       config.SyncInterval,
+	}, state.logger)
 	if err != nil {
 		return err
 	}
-	state.db.SetMaxIdleConns(0) // Make the DB NFS-friendly.
-	return nil
+	return state.initProfileEncryption()
 }
 
-var sqliteinitializationStatements = []string{
-	`create table if not exists user_profile (id integer not null primary key, username text unique, profile_data blob);`,
-	`create table if not exists expiring_signed_user_data(id integer not null primary key, username text not null, jws_data text not null, type integer not null, expiration_epoch integer not null, update_epoch integer no null, UNIQUE(username,type));`,
-}
-
-func initializeSQLitetables(db *sql.DB) error {
-	for _, sqlStmt := range sqliteinitializationStatements {
-		logger.Debugf(2, "initializing sqlite, statement =%q", sqlStmt)
-		_, err := db.Exec(sqlStmt)
-		if err != nil {
-			logger.Printf("%s: %q\n", err, sqlStmt)
-			return err
-		}
-	}
-	return nil
-}
-
-// This call initializes the database if it does not exist.
-// TODO: update  to perform auto-updates of the db.
-func initFileDBSQLite(dbFilename string, currentDB *sql.DB) (*sql.DB, error) {
-	if _, err := os.Stat(dbFilename); os.IsNotExist(err) {
-		//CREATE NEW DB
-		fileDB, err := sql.Open("sqlite3", dbFilename)
-		if err != nil {
-			logger.Printf("Failure creating new db: %s", dbFilename)
-			return nil, err
-		}
-		logger.Printf("post DB open")
-		err = initializeSQLitetables(fileDB)
-		if err != nil {
-			return nil, err
-		}
-		return fileDB, nil
-	}
-	// try open the DB
-	if currentDB == nil {
-		fileDB, err := sql.Open("sqlite3", dbFilename)
-		if err != nil {
-			return nil, err
-		}
-		err = initializeSQLitetables(fileDB)
-		if err != nil {
-			return nil, err
-		}
-		return fileDB, nil
-	}
-	return currentDB, nil
-}
-
-func (state *RuntimeState) BackgroundDBCopy(initialSleep time.Duration, done chan struct{}, logger log.DebugLogger) {
-	select {
-	case <-done:
-		//fmt.Println("Received:", v)
-		logger.Debugf(0, "Cancelled before first copy")
-		return
-	case <-time.After(initialSleep):
-		logger.Debugf(1, "BackgroundDBCopy, initial sleep done")
-
-	}
-	for {
-		logger.Debugf(0, "starting db copy")
-		err := copyDBIntoSQLite(state.db, state.cacheDB, "sqlite")
-		if err != nil {
-			logger.Printf("err='%s'", err)
-		} else {
-			logger.Debugf(0, "db copy success")
-		}
-		cleanupDBData(state.db)
-		cleanupDBData(state.cacheDB)
-
-		select {
-		case <-done:
-			//fmt.Println("Received:", v)
-			logger.Debugf(0, "Cancelled after copy")
-			return
-		case <-time.After(state.Config.ProfileStorage.SyncInterval):
-			logger.Debugf(1, "BackgroundDBCopy, sleep complete  sleep done")
-
-		}
-		//time.Sleep(state.Config.ProfileStorage.SyncInterval)
+// initProfileEncryption wraps the profile store so that profiles are
+// encrypted if enabled. With a KMS key profiles can be read and written
+// right away, otherwise only once the CA is unsealed.
+func (state *RuntimeState) initProfileEncryption() error {
+	config := state.Config.ProfileStorage.Encryption
+	if !config.Enabled {
+		return nil
 	}
-}
-
-func cleanupDBData(db *sql.DB) error {
-	if db == nil {
-		err := errors.New("nil database on cleanup")
+	state.encryptedProfileStore = encryptedstore.New(state.profileStore,
+		state.logger)
+	state.profileStore = state.encryptedProfileStore
+	state.profileSealedCAKeyFilenames = config.PreviousCAKeyFilenames
+	if err := state.loadPreviousCAKeys(nil); err != nil {
 		return err
 	}
-	queryStr := fmt.Sprintf(
-		"DELETE from expiring_signed_user_data WHERE expiration_epoch < %d",
-		time.Now().Unix())
-	rows, err := db.Query(queryStr)
+	if config.AwsKmsKeyId == "" {
+		return nil
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background())
 	if err != nil {
-		logger.Printf("err='%s'", err)
 		return err
 	}
-	defer rows.Close()
+	state.profileKMSKeyWrapper = kmswrapper.New(cfg, config.AwsKmsKeyId)
+	state.encryptedProfileStore.SetKeyWrapper(state.profileKMSKeyWrapper,
+		state.profilePreviousKeyWrappers...)
 	return nil
 }
 
-func copyDBIntoSQLite(source, destination *sql.DB,
-	destinationType string) error {
-	if source == nil || destination == nil {
-		err := errors.New("nil databases")
-		return err
-	}
-	// Copy user profiles
-	rows, err := source.Query("SELECT username,profile_data FROM user_profile")
-	if err != nil {
-		logger.Printf("err='%s'", err)
-		return err
-	}
-	defer rows.Close()
-	queryStr := fmt.Sprintf(
-		"SELECT username, type, jws_data, expiration_epoch,update_epoch FROM expiring_signed_user_data WHERE expiration_epoch > %d",
-		time.Now().Unix())
-	genericRows, err := source.Query(queryStr)
-	if err != nil {
-		logger.Printf("err='%s'", err)
-		return err
-	}
-	defer genericRows.Close()
-	tx, err := destination.Begin()
-	if err != nil {
-		logger.Printf("err='%s'", err)
-		return err
-	}
-	defer tx.Rollback()
-	deleteProfilesQueryStr := fmt.Sprintf("DELETE from user_profile ")
-	if rows, err := destination.Query(deleteProfilesQueryStr); err != nil {
-		logger.Printf("err='%s'", err)
-		return err
-	} else {
-		rows.Close()
-	}
-	stmtText := saveUserProfileStmt[destinationType]
-	stmt, err := tx.Prepare(stmtText)
-	if err != nil {
-		logger.Printf("err='%s'", err)
-		return err
-	}
-	defer stmt.Close()
-	for rows.Next() {
-		var (
-			username     string
-			profileBytes []byte
-		)
-		if err := rows.Scan(&username, &profileBytes); err != nil {
-			logger.Printf("err='%s'", err)
-			return err
-		}
-		_, err = stmt.Exec(username, profileBytes)
+// loadPreviousCAKeys loads the previous CA keys not loaded yet, to unwrap the
+// data keys of profiles encrypted before the CA was rotated. Sealed keys are
+// decrypted with password, which is the same as for the current CA, or are
+// left sealed if password is nil. Must be called with the lock held, or
+// before serving.
+func (state *RuntimeState) loadPreviousCAKeys(password []byte) error {
+	var sealedFilenames []string
+	for _, filename := range state.profileSealedCAKeyFilenames {
+		wrapper, err := loadPreviousCAKeyWrapper(filename, password)
 		if err != nil {
-			logger.Printf("err='%s'", err)
 			return err
 		}
+		if wrapper == nil {
+			sealedFilenames = append(sealedFilenames, filename)
+			continue
+		}
+		state.profilePreviousKeyWrappers = append(
+			state.profilePreviousKeyWrappers, wrapper)
 	}
-	if err := rows.Err(); err != nil {
-		logger.Printf("err='%s'", err)
-		return err
+	state.profileSealedCAKeyFilenames = sealedFilenames
+	return nil
+}
+
+// loadPreviousCAKeyWrapper returns the key wrapper derived from a previous CA
+// key, or nil if the key is sealed and password is nil.
+func loadPreviousCAKeyWrapper(filename string, password []byte) (
+	encryptedstore.KeyWrapper, error) {
+	fileContent, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
 	}
-	expiringUpsertText := saveSignedUserDataStmt[destinationType]
-	expiringUpsertStmt, err := tx.Prepare(expiringUpsertText)
+	pemData, err := unsealPEMIfNeeded(fileContent, password)
 	if err != nil {
-		logger.Printf("err='%s'", err)
-		return err
+		return nil, fmt.Errorf("cannot unseal previous CA key: %s: %s",
+			filename, err)
 	}
-	defer expiringUpsertStmt.Close()
-	for genericRows.Next() {
-		var (
-			username        string
-			dataType        int
-			jwsData         string
-			expirationEpoch int64
-			updateEpoch     int64
-		)
-		if err := genericRows.Scan(&username, &dataType, &jwsData,
-			&expirationEpoch, &updateEpoch); err != nil {
-			logger.Printf("err='%s'", err)
-			return err
-		}
-		//username, type, jws_data, expiration_epoch, update_epoch
-		_, err = expiringUpsertStmt.Exec(username, dataType, jwsData,
-			expirationEpoch, updateEpoch)
-		if err != nil {
-			logger.Printf("err='%s'", err)
-			return err
-		}
+	if pemData == nil {
+		return nil, nil
 	}
-	err = tx.Commit()
+	signer, err := getSignerFromPEMBytes(pemData)
 	if err != nil {
-		logger.Printf("err='%s'", err)
-		return err
+		return nil, fmt.Errorf("cannot parse previous CA key: %s: %s",
+			filename, err)
 	}
-	return nil
-}
-
-var getUsersStmt = map[string]string{
-	"sqlite":   "select username from user_profile order by username",
-	"postgres": "select username from user_profile order by username",
+	return encryptedstore.NewSignerKeyWrapper(signer)
 }
 
-type getUsersData struct {
-	Names []string
-	Err   error
-}
-
-func gatherUsers(stmt *sql.Stmt) ([]string, error) {
-	rows, err := stmt.Query()
-	if err != nil {
-		return nil, err
+// setProfileKeyWrapper sets the key wrapper derived from the CA once it is
+// unsealed. With a KMS key it only unwraps the keys of profiles encrypted
+// before the KMS key was configured.
+func (state *RuntimeState) setProfileKeyWrapper() error {
+	if state.encryptedProfileStore == nil {
+		return nil
 	}
-	defer rows.Close()
-	var names []string
-	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			return nil, err
+	if len(state.profileSealedCAKeyFilenames) > 0 {
+		return fmt.Errorf(
+			"previous CA key %s is sealed but the CA is not, unseal it",
+			state.profileSealedCAKeyFilenames[0])
+	}
+	caKeyWrapper, err := encryptedstore.NewSignerKeyWrapper(state.Signer)
+	if state.profileKMSKeyWrapper != nil {
+		if err == nil {
+			state.encryptedProfileStore.SetKeyWrapper(
+				state.profileKMSKeyWrapper,
+				append([]encryptedstore.KeyWrapper{caKeyWrapper},
+					state.profilePreviousKeyWrappers...)...)
 		}
-		names = append(names, name)
+		return nil
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	if err != nil {
+		return fmt.Errorf("cannot derive profile key from CA: %s", err)
 	}
-	return names, nil
+	state.encryptedProfileStore.SetKeyWrapper(caKeyWrapper,
+		state.profilePreviousKeyWrappers...)
+	return nil
 }
 
 func (state *RuntimeState) GetUsers() ([]string, bool, error) {
-	ch := make(chan getUsersData, 1)
 	start := time.Now()
-	go func() {
-		stmtText := getUsersStmt[state.dbType]
-		stmt, err := state.db.Prepare(stmtText)
-		if err != nil {
-			logger.Printf("Error Preparing getUsers statement primary DB: %s",
-				err)
-			return
-		}
-		defer stmt.Close()
-		if state.remoteDBQueryTimeout == 0 {
-			time.Sleep(10 * time.Millisecond)
-		}
-		names, dbErr := gatherUsers(stmt)
-		ch <- getUsersData{Names: names, Err: dbErr}
-		close(ch)
-	}()
-	select {
-	case dbMessage := <-ch:
-		if dbMessage.Err != nil {
-			logger.Printf("Problem with db ='%s'", dbMessage.Err)
-		} else {
-			metricLogExternalServiceDuration("storage-read", time.Since(start))
-		}
-		return dbMessage.Names, false, dbMessage.Err
-	case <-time.After(state.remoteDBQueryTimeout):
-		logger.Println("GetUsers: timed out on primary DB")
-		stmtText := getUsersStmt["sqlite"]
-		stmt, err := state.cacheDB.Prepare(stmtText)
-		if err != nil {
-			logger.Printf("Error Preparing getUsers statement cached DB: %s",
-				err)
-			return nil, false, err
-		}
-		defer stmt.Close()
-		names, dbErr := gatherUsers(stmt)
-		if dbErr != nil {
-			logger.Printf("Problem with db = '%s'", err)
-		} else {
-			logger.Println("GetUsers: got data from DB cache")
-		}
-		return names, true, dbErr
+	names, fromCache, err := state.profileStore.GetUsers()
+	if err != nil {
+		logger.Printf("Problem with db ='%s'", err)
+		return nil, false, err
 	}
-}
-
-var loadUserProfileStmt = map[string]string{
-	"sqlite":   "select profile_data from user_profile where username = ?",
-	"postgres": "select profile_data from user_profile where username = $1",
+	if fromCache {
+		logger.Println("GetUsers: got data from DB cache")
+	} else {
+		metricLogExternalServiceDuration("storage-read", time.Since(start))
+	}
+	return names, fromCache, nil
 }
 
 /// Adding api to be load/save per user
 
 // Notice: each operation load/save should be atomic.
 
-type loadUserProfileData struct {
-	//fromDB       bool
-	ProfileBytes []byte
-	Err          error
-}
-
 // If there a valid user profile returns: profile, true nil
 // If there is NO user profile returns default_object, false, nil
 // Any other case: nil, false, error
@@ -457,70 +230,22 @@ func (state *RuntimeState) LoadUserProfile(username string) (
 	var defaultProfile userProfile
 	defaultProfile.U2fAuthData = make(map[int64]*u2fAuthData)
 	defaultProfile.TOTPAuthData = make(map[int64]*totpAuthData)
-	ch := make(chan loadUserProfileData, 1)
 	start := time.Now()
-	go func(username string) { //loads profile from DB
-		var profileMessage loadUserProfileData
-		stmtText := loadUserProfileStmt[state.dbType]
-		stmt, err := state.db.Prepare(stmtText)
-		if err != nil {
-			logger.Printf("Error Preparing statement LoadUsers primary DB: %s",
-				err)
-			return
-		}
-		defer stmt.Close()
-		// if the remoteDBQueryTimeout == 0 this means we are actuallty trying
-		// to force the cached db. In single core systems, we need to ensure
-		// this goroutine yields to sthis sleep is necesary
-		if state.remoteDBQueryTimeout == 0 {
-			time.Sleep(10 * time.Millisecond)
-		}
-		profileMessage.Err = stmt.QueryRow(username).Scan(
-			&profileMessage.ProfileBytes)
-		ch <- profileMessage
-	}(username)
-	var profileBytes []byte
-	fromCache = false
-	select {
-	case dbMessage := <-ch:
-		err = dbMessage.Err
-		if err != nil {
-			if err.Error() == "sql: no rows in result set" {
-				logger.Printf("err='%s'", err)
-				return &defaultProfile, false, fromCache, nil
-			} else {
-				logger.Printf("Problem with db ='%s'", err)
-				return nil, false, fromCache, err
-			}
-		}
-		metricLogExternalServiceDuration("storage-read", time.Since(start))
-		profileBytes = dbMessage.ProfileBytes
-	case <-time.After(state.remoteDBQueryTimeout):
-		logger.Println("LoadUserProfile: timed out on primary DB")
-		fromCache = true
-		// load from cache
-		stmtText := loadUserProfileStmt["sqlite"]
-		stmt, err := state.cacheDB.Prepare(stmtText)
-		if err != nil {
-			logger.Printf("Error Preparing statement LoadUsers cache DB: %s",
-				err)
-			return nil, false, false, err
-		}
-		defer stmt.Close()
-		err = stmt.QueryRow(username).Scan(&profileBytes)
-		if err != nil {
-			if err.Error() == "sql: no rows in result set" {
-				logger.Printf("err='%s'", err)
-				return &defaultProfile, false, true, nil
-			} else {
-				logger.Printf("Problem with db ='%s'", err)
-				return nil, false, true, err
-			}
-		}
+	profileBytes, ok, fromCache, err := state.profileStore.LoadProfile(
+		username)
+	if err != nil {
+		logger.Printf("Problem with db ='%s'", err)
+		return nil, false, fromCache, err
+	}
+	if fromCache {
 		logger.Println("LoadUserProfile: got data from DB cache")
+	} else {
+		metricLogExternalServiceDuration("storage-read", time.Since(start))
+	}
+	if !ok {
+		return &defaultProfile, false, fromCache, nil
 	}
 	logger.Debugf(10, "profile bytes len=%d", len(profileBytes))
-	//gobReader := bytes.NewReader(fileBytes)
 	gobReader := bytes.NewReader(profileBytes)
 	decoder := gob.NewDecoder(gobReader)
 	err = decoder.Decode(&defaultProfile)
@@ -532,11 +257,6 @@ func (state *RuntimeState) LoadUserProfile(username string) (
 	return &defaultProfile, true, fromCache, nil
 }
 
-var saveUserProfileStmt = map[string]string{
-	"sqlite":   "insert or replace into user_profile(username, profile_data) values(?, ?)",
-	"postgres": "insert into user_profile(username, profile_data) values ($1,$2) on CONFLICT(username) DO UPDATE set  profile_data = excluded.profile_data",
-}
-
 func (state *RuntimeState) SaveUserProfile(username string,
 	profile *userProfile) error {
 	var gobBuffer bytes.Buffer
@@ -545,23 +265,7 @@ func (state *RuntimeState) SaveUserProfile(username string,
 		return err
 	}
 	start := time.Now()
-	//insert into DB
-	tx, err := state.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	stmtText := saveUserProfileStmt[state.dbType]
-	stmt, err := tx.Prepare(stmtText)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(username, gobBuffer.Bytes())
-	if err != nil {
-		return err
-	}
-	err = tx.Commit()
+	err := state.profileStore.SaveProfile(username, gobBuffer.Bytes())
 	if err != nil {
 		return err
 	}
@@ -569,138 +273,25 @@ func (state *RuntimeState) SaveUserProfile(username string,
 	return nil
 }
 
-var deleteUserProfileStmt = map[string]string{
-	"sqlite":   "delete from  user_profile where username = ?",
-	"postgres": "delete from  user_profile where username = $1",
-}
-
 func (state *RuntimeState) DeleteUserProfile(username string) error {
-	//delete from DB
-	tx, err := state.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	stmtText := deleteUserProfileStmt[state.dbType]
-	stmt, err := tx.Prepare(stmtText)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(username)
-	if err != nil {
-		return err
-	}
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-var deleteSignedUserDataStmt = map[string]string{
-	"sqlite":   "delete from expiring_signed_user_data where username = ? and type = ?",
-	"postgres": "delete from expiring_signed_user_data where username = $1 and type = $2",
+	return state.profileStore.DeleteProfile(username)
 }
 
 func (state *RuntimeState) DeleteSigned(username string, dataType int) error {
-	//insert into DB
-	tx, err := state.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	stmtText := deleteSignedUserDataStmt[state.dbType]
-	stmt, err := tx.Prepare(stmtText)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(username, dataType)
-	if err != nil {
-		return err
-	}
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-type getSignedData struct {
-	JWSData string
-	Err     error
-}
-
-var getSignedUserDataStmt = map[string]string{
-	"sqlite":   "select jws_data from expiring_signed_user_data where username = ? and type =? and expiration_epoch > ?",
-	"postgres": "select jws_data from expiring_signed_user_data where username = $1 and type = $2 and expiration_epoch > $3",
+	return state.profileStore.DeleteSigned(username, dataType)
 }
 
 func (state *RuntimeState) GetSigned(username string,
 	dataType int) (bool, string, error) {
-	logger.Printf("top of GetSigned")
-	//var jwsData string
-	ch := make(chan getSignedData, 1)
-	//start := time.Now()
-	go func(username string, dataType int) { //loads profile from DB
-		var signedDataMessage getSignedData
-		stmtText := getSignedUserDataStmt[state.dbType]
-		stmt, err := state.db.Prepare(stmtText)
-		if err != nil {
-			logger.Printf("Error Preparing statement GetSigned Primary DB: %s",
-				err)
-			return
-		}
-		defer stmt.Close()
-		if state.remoteDBQueryTimeout == 0 {
-			time.Sleep(10 * time.Millisecond)
-		}
-		signedDataMessage.Err = stmt.QueryRow(username, dataType,
-			time.Now().Unix()).Scan(&signedDataMessage.JWSData)
-		ch <- signedDataMessage
-	}(username, dataType)
-	var jwsData string
-	select {
-	case dbMessage := <-ch:
-		logger.Debugf(2, "got data from db. dbMessage=%+v", dbMessage)
-		err := dbMessage.Err
-		if err != nil {
-			err = dbMessage.Err
-			if err.Error() == "sql: no rows in result set" {
-				logger.Printf("err='%s'", err)
-				return false, "", nil
-			} else {
-				logger.Printf("Problem with db ='%s'", err)
-				return false, "", err
-			}
-		}
-		jwsData = dbMessage.JWSData
-	case <-time.After(state.remoteDBQueryTimeout):
-		logger.Println("GetSigned: timed out on primary DB")
-		// load from cache
-		stmtText := getSignedUserDataStmt["sqlite"]
-		stmt, err := state.cacheDB.Prepare(stmtText)
-		if err != nil {
-			logger.Printf("Error Preparing statement GetSigned Cache DB: %s",
-				err)
-			return false, "", err
-		}
-		defer stmt.Close()
-		err = stmt.QueryRow(username, dataType, time.Now().Unix()).Scan(
-			&jwsData)
-		if err != nil {
-			if err.Error() == "sql: no rows in result set" {
-				logger.Printf("err='%s'", err)
-				return false, "", nil
-			} else {
-				logger.Printf("Problem with db ='%s'", err)
-				return false, "", err
-			}
-		}
-		logger.Println("GetSigned: got data from DB cache")
+	logger.Debugf(2, "top of GetSigned")
+	ok, jwsData, err := state.profileStore.GetSigned(username, dataType)
+	if err != nil {
+		logger.Printf("Problem with db ='%s'", err)
+		return false, "", err
+	}
+	if !ok {
+		return false, "", nil
 	}
-	logger.Println("GetSigned: got jwsdata")
 	storageJWT, err := state.getStorageDataFromStorageStringDataJWT(jwsData)
 	if err != nil {
 		logger.Debugf(2, "failed to get storage data %s data=%s", err, jwsData)
@@ -713,39 +304,17 @@ func (state *RuntimeState) GetSigned(username string,
 	return true, storageJWT.Data, nil
 }
 
-var saveSignedUserDataStmt = map[string]string{
-	"sqlite":   "insert or replace into expiring_signed_user_data(username, type, jws_data, expiration_epoch, update_epoch) values(?,?, ?, ?, ?)",
-	"postgres": "insert into expiring_signed_user_data(username, type, jws_data, expiration_epoch, update_epoch) values ($1,$2,$3,$4, $5) ON CONFLICT(username,type) DO UPDATE SET  jws_data = excluded.jws_data, expiration_epoch = excluded.expiration_epoch",
-}
-
 func (state *RuntimeState) UpsertSigned(username string, dataType int,
 	expirationEpoch int64, data string) error {
 	logger.Debugf(2, "top of UpsertSigned")
-	//expirationEpoch := expiration.Unix()
 	stringData, err := state.genNewSerializedStorageStringDataJWT(username,
 		dataType, data, expirationEpoch)
 	if err != nil {
 		return err
 	}
 	start := time.Now()
-	//insert into DB
-	tx, err := state.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	stmtText := saveSignedUserDataStmt[state.dbType]
-	stmt, err := tx.Prepare(stmtText)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(username, dataType, stringData, expirationEpoch,
-		time.Now().Unix())
-	if err != nil {
-		return err
-	}
-	err = tx.Commit()
+	err = state.profileStore.UpsertSigned(username, dataType, expirationEpoch,
+		stringData)
 	if err != nil {
 		return err
 	}
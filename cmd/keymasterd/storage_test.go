@@ -1,22 +1,43 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/json"
 	"io/ioutil"
 	stdlog "log"
+	"math/big"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/tstranex/u2f"
 	"golang.org/x/time/rate"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/debuglogger"
 	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
 	"github.com/Cloud-Foundations/keymaster/keymasterd/eventnotifier"
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/archive"
 )
 
 func init() {
 	slogger := stdlog.New(os.Stderr, "", stdlog.LstdFlags)
 	logger = debuglogger.New(slogger)
-	eventNotifier = eventnotifier.New(logger)
+	var err error
+	eventNotifier, err = eventnotifier.New(eventnotifier.Params{Logger: logger})
+	if err != nil {
+		panic(err)
+	}
 }
 
 func newTestingState(t *testing.T) (*RuntimeState, string, error) {
@@ -32,7 +53,7 @@ func newTestingState(t *testing.T) (*RuntimeState, string, error) {
 	return state, tmpdir, nil
 }
 
-func TestDBCopy(t *testing.T) {
+func TestProfileRoundTrip(t *testing.T) {
 	state, tmpdir, err := newTestingState(t)
 	if err != nil {
 		t.Fatal(err)
@@ -42,70 +63,360 @@ func TestDBCopy(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	// copy blank db
-	err = copyDBIntoSQLite(state.db, state.cacheDB, "sqlite")
+	defer state.profileStore.Close()
+	profile, ok, _, err := state.LoadUserProfile("username")
 	if err != nil {
 		t.Fatal(err)
 	}
-	// make a profile and push back to db
-	profile, _, _, err := state.LoadUserProfile("username")
+	if ok {
+		t.Fatal("loaded a profile which was never saved")
+	}
+	profile.TOTPAuthData[1] = &totpAuthData{Name: "totp1"}
+	err = state.SaveUserProfile("username", profile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = state.SaveUserProfile("username", profile)
+	profile, ok, _, err = state.LoadUserProfile("username")
 	if err != nil {
 		t.Fatal(err)
 	}
-	// copy the db now with one user
-	err = copyDBIntoSQLite(state.db, state.cacheDB, "sqlite")
+	if !ok {
+		t.Fatal("did not load saved profile")
+	}
+	if data := profile.TOTPAuthData[1]; data == nil || data.Name != "totp1" {
+		t.Fatalf("unexpected TOTP data: %+v", profile.TOTPAuthData)
+	}
+	users, _, err := state.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0] != "username" {
+		t.Fatalf("unexpected users: %v", users)
+	}
+	if err := state.DeleteUserProfile("username"); err != nil {
+		t.Fatal(err)
+	}
+	_, ok, _, err = state.LoadUserProfile("username")
 	if err != nil {
 		t.Fatal(err)
 	}
-	state.dbDone <- struct{}{}
+	if ok {
+		t.Fatal("loaded a deleted profile")
+	}
+}
+
+func testOpenEncryptedProfileStore(t *testing.T, dataDirectory string,
+	keyFilename string, previousKeyFilenames ...string) *RuntimeState {
+	state := testInitEncryptedProfileStore(t, dataDirectory, keyFilename,
+		previousKeyFilenames...)
+	if err := state.setProfileKeyWrapper(); err != nil {
+		t.Fatal(err)
+	}
+	return state
 }
 
-func TestFetchFromCache(t *testing.T) {
+// testInitEncryptedProfileStore opens the profile store without setting the
+// key wrapper derived from the CA.
+func testInitEncryptedProfileStore(t *testing.T, dataDirectory string,
+	keyFilename string, previousKeyFilenames ...string) *RuntimeState {
 	state, tmpdir, err := newTestingState(t)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(tmpdir)
-	err = initDB(state)
+	os.RemoveAll(tmpdir)
+	state.Config.Base.DataDirectory = dataDirectory
+	state.Config.ProfileStorage.Encryption.Enabled = true
+	state.Config.ProfileStorage.Encryption.PreviousCAKeyFilenames =
+		previousKeyFilenames
+	keyData, err := ioutil.ReadFile(keyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Signer, err = getSignerFromPEMBytes(keyData); err != nil {
+		t.Fatal(err)
+	}
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestProfileEncryptionPreviousCAKey(t *testing.T) {
+	dataDirectory := t.TempDir()
+	state := testOpenEncryptedProfileStore(t, dataDirectory,
+		"testdata/AdminCA.key")
+	profile := &userProfile{
+		TOTPAuthData: map[int64]*totpAuthData{1: {Name: "totp1"}},
+	}
+	if err := state.SaveUserProfile("username", profile); err != nil {
+		t.Fatal(err)
+	}
+	state.profileStore.Close()
+	state = testOpenEncryptedProfileStore(t, dataDirectory,
+		"testdata/KeymasterCA.key")
+	if _, _, _, err := state.LoadUserProfile("username"); err == nil {
+		t.Fatal("loaded a profile encrypted with another CA key")
+	}
+	state.profileStore.Close()
+	state = testOpenEncryptedProfileStore(t, dataDirectory,
+		"testdata/KeymasterCA.key", "testdata/AdminCA.key")
+	defer state.profileStore.Close()
+	profile, ok, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("did not load saved profile")
+	}
+	if data := profile.TOTPAuthData[1]; data == nil || data.Name != "totp1" {
+		t.Fatalf("unexpected TOTP data: %+v", profile.TOTPAuthData)
+	}
+}
+
+func TestProfileEncryptionSealedPreviousCAKey(t *testing.T) {
+	dataDirectory := t.TempDir()
+	state := testOpenEncryptedProfileStore(t, dataDirectory,
+		"testdata/AdminCA.key")
+	profile := &userProfile{
+		TOTPAuthData: map[int64]*totpAuthData{1: {Name: "totp1"}},
+	}
+	if err := state.SaveUserProfile("username", profile); err != nil {
+		t.Fatal(err)
+	}
+	state.profileStore.Close()
+	keyData, err := ioutil.ReadFile("testdata/AdminCA.key")
 	if err != nil {
 		t.Fatal(err)
 	}
-	// make a profile and push back to db
-	profile, _, _, err := state.LoadUserProfile("username")
+	passphrase := []byte("passphrase")
+	sealedKeyData, err := cryptoutils.PGPArmorEncryptBytes(keyData, passphrase)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = state.SaveUserProfile("username", profile)
+	sealedKeyFilename := filepath.Join(t.TempDir(), "AdminCA.key.asc")
+	if err := os.WriteFile(sealedKeyFilename, sealedKeyData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	state = testInitEncryptedProfileStore(t, dataDirectory,
+		"testdata/KeymasterCA.key", sealedKeyFilename)
+	defer state.profileStore.Close()
+	// The sealed key cannot be used until the CA is unsealed.
+	if err := state.setProfileKeyWrapper(); err == nil {
+		t.Fatal("previous CA key used while sealed")
+	}
+	if err := state.loadPreviousCAKeys([]byte("wrong")); err == nil {
+		t.Fatal("previous CA key unsealed with a wrong passphrase")
+	}
+	if err := state.loadPreviousCAKeys(passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.setProfileKeyWrapper(); err != nil {
+		t.Fatal(err)
+	}
+	profile, ok, _, err := state.LoadUserProfile("username")
 	if err != nil {
 		t.Fatal(err)
 	}
-	// copy blank with one user...
-	err = copyDBIntoSQLite(state.db, state.cacheDB, "sqlite")
+	if !ok {
+		t.Fatal("did not load saved profile")
+	}
+	if data := profile.TOTPAuthData[1]; data == nil || data.Name != "totp1" {
+		t.Fatalf("unexpected TOTP data: %+v", profile.TOTPAuthData)
+	}
+}
+
+// externalSigner hides the type of the private key, like a hardware signer.
+type externalSigner struct {
+	crypto.Signer
+}
+
+func TestCheckProfileKeySigner(t *testing.T) {
+	state, tmpdir, err := newTestingState(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	state.Config.ProfileStorage.Encryption.Enabled = true
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	state.remoteDBQueryTimeout = 0
-	_, _, fromCache, err := state.LoadUserProfile("username")
+	if err := state.checkProfileKeySigner(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.checkProfileKeySigner(externalSigner{key}); err == nil {
+		t.Fatal("external signer accepted without aws_kms_key_id")
+	}
+	state.Config.ProfileStorage.Encryption.AwsKmsKeyId = "alias/keymaster"
+	if err := state.checkProfileKeySigner(externalSigner{key}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archiveExcludedFields are the fields of userProfile for pending
+// registrations, which are not kept in archives.
+var archiveExcludedFields = map[string]bool{
+	"RegistrationChallenge": true,
+	"PendingTOTPSecret":     true,
+	"WebauthnSessionData":   true,
+}
+
+// checkArchiveFields checks that archiveType has all the fields of
+// keymasterdType, recursing into the types defined by keymasterd.
+func checkArchiveFields(t *testing.T, name string, keymasterdType,
+	archiveType reflect.Type) {
+	keymasterdType = elemType(keymasterdType)
+	archiveType = elemType(archiveType)
+	if keymasterdType.Kind() != reflect.Struct ||
+		keymasterdType.PkgPath() != reflect.TypeOf(userProfile{}).PkgPath() {
+		return
+	}
+	if archiveType.Kind() != reflect.Struct {
+		t.Errorf("%s: archive type %s is not a struct", name, archiveType)
+		return
+	}
+	for index := 0; index < keymasterdType.NumField(); index++ {
+		field := keymasterdType.Field(index)
+		if !field.IsExported() ||
+			(keymasterdType == reflect.TypeOf(userProfile{}) &&
+				archiveExcludedFields[field.Name]) {
+			continue
+		}
+		archiveField, ok := archiveType.FieldByName(field.Name)
+		if !ok {
+			t.Errorf("%s.%s is not in the archive", name, field.Name)
+			continue
+		}
+		checkArchiveFields(t, name+"."+field.Name, field.Type,
+			archiveField.Type)
+	}
+}
+
+func elemType(typ reflect.Type) reflect.Type {
+	for {
+		switch typ.Kind() {
+		case reflect.Map, reflect.Pointer, reflect.Slice:
+			typ = typ.Elem()
+		default:
+			return typ
+		}
+	}
+}
+
+func makeU2fRegistration(t *testing.T) *u2f.Registration {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !fromCache {
-		t.Fatal("did NOT got data from cache")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "U2F token"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
 	}
-	_, ok, fromCache, err := state.LoadUserProfile("unknown-user")
+	publicKey, err := key.PublicKey.ECDH()
 	if err != nil {
 		t.Fatal(err)
 	}
+	keyHandle := []byte("key handle")
+	raw := append([]byte{0x05}, publicKey.Bytes()...)
+	raw = append(raw, byte(len(keyHandle)))
+	raw = append(raw, keyHandle...)
+	raw = append(raw, certDER...)
+	raw = append(raw, 0x30, 0x00) // An empty signature.
+	var registration u2f.Registration
+	if err := registration.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	return &registration
+}
 
-	if !fromCache {
-		t.Fatal("did NOT got data from cache")
+// TestProfileArchiveCompatible checks that the profiles in backup archives
+// keep all the persistent fields of userProfile.
+func TestProfileArchiveCompatible(t *testing.T) {
+	checkArchiveFields(t, "userProfile", reflect.TypeOf(userProfile{}),
+		reflect.TypeOf(archive.Profile{}))
+	createdAt := time.Unix(1700000000, 0).UTC()
+	profile := &userProfile{
+		U2fAuthData: map[int64]*u2fAuthData{
+			1: {
+				Enabled:      true,
+				CreatedAt:    createdAt,
+				CreatorAddr:  "10.0.0.1",
+				Counter:      3,
+				Name:         "u2f",
+				Registration: makeU2fRegistration(t),
+			},
+		},
+		LastSuccessfullTOTPCounter: 42,
+		TOTPAuthData: map[int64]*totpAuthData{
+			2: {
+				Enabled:         true,
+				CreatedAt:       createdAt,
+				Name:            "totp",
+				EncryptedSecret: [][]byte{[]byte("secret")},
+				TOTPType:        1,
+				ValidatorAddr:   "10.0.0.2",
+			},
+		},
+		BootstrapOTP: bootstrapOTPData{
+			ExpiresAt:  createdAt,
+			Sha512Hash: []byte("hash"),
+		},
+		UserHasRegistered2ndFactor: true,
+		WebauthnData: map[int64]*webauthAuthData{
+			3: {
+				Enabled:   true,
+				CreatedAt: createdAt,
+				Name:      "webauthn",
+				Credential: webauthn.Credential{
+					ID:              []byte{1, 2},
+					PublicKey:       []byte{3, 4},
+					AttestationType: "none",
+				},
+			},
+		},
+		WebauthnID:  7,
+		DisplayName: "User Name",
+		Username:    "username",
+		IdPConsents: map[string]*idpConsentData{
+			"client": {
+				Scopes:     []string{"openid"},
+				Audiences:  []string{"client"},
+				ApprovedAt: createdAt,
+			},
+		},
 	}
-	if ok {
-		t.Fatal("This should have failed for invalid user")
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(profile); err != nil {
+		t.Fatal(err)
+	}
+	archiveProfile, err := archive.DecodeProfile(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := json.Marshal(archiveProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveProfile = &archive.Profile{}
+	if err := json.Unmarshal(jsonData, archiveProfile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := archiveProfile.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored userProfile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&restored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&restored, profile) {
+		t.Fatalf("restored profile: %+v differs from: %+v", restored, profile)
 	}
-	state.dbDone <- struct{}{}
 }
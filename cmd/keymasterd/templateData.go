@@ -268,6 +268,7 @@ const usersHTML = `
        <p><input type="submit" value="Add User" /> </p>
        <p><input type="submit" value="Delete User" formaction="/admin/deleteUser" /> </p>
        <p><input type="submit" value="Generate BootstrapOTP" formaction="/admin/newBoostrapOTP" /> </p>
+       <p><input type="submit" value="Kill IdP Sessions" formaction="/admin/killIdPSessions" /> </p>
     </form>
 
     </div>
@@ -298,6 +299,13 @@ type bootstrapOtpTemplateData struct {
 	Fingerprint [4]byte
 }
 
+type idpConsentDisplayInfo struct {
+	ClientID   string
+	Scopes     string
+	Audiences  string
+	ApprovedAt time.Time
+}
+
 type profilePageTemplateData struct {
 	Title                string
 	AuthUsername         string
@@ -312,6 +320,7 @@ type profilePageTemplateData struct {
 	ShowLegacyRegister   bool
 	RegisteredU2FToken   []registeredU2FTokenDisplayInfo
 	RegisteredTOTPDevice []registeredTOTPTDeviceDisplayInfo
+	IdPConsents          []idpConsentDisplayInfo
 }
 
 const profileHTML = `
@@ -457,6 +466,40 @@ const profileHTML = `
        {{end}}
     {{end}}
     </div> <!-- end of totp div -->
+    {{if .IdPConsents -}}
+    <div id="idp-consents">
+       <h3>Applications</h3>
+       <div style="margin-left: 40px">
+       <p> Applications you have granted access to </p>
+       <table>
+            <tr>
+               <th>Client</th>
+               <th>Scopes</th>
+               <th>Audiences</th>
+               <th>Approved</th>
+               <th>Actions</th>
+            </tr>
+	    {{- range .IdPConsents }}
+	    <tr>
+	       <form enctype="application/x-www-form-urlencoded" action="/api/v0/manageIdPConsent" method="post">
+                  <input type="hidden" name="client_id" value="{{.ClientID}}">
+                  <input type="hidden" name="username" value="{{$top.Username}}">
+                  <td> {{.ClientID}} </td>
+                  <td> {{.Scopes}} </td>
+                  <td> {{.Audiences}} </td>
+                  <td> {{.ApprovedAt.Format "2006-01-02 15:04"}} </td>
+                  <td>
+                  {{if not $top.ReadOnlyMsg}}
+                     <input type="submit" name="action" value="Revoke"/>
+                  {{end}}
+                  </td>
+               </form>
+	    </tr>
+	    {{- end}}
+       </table>
+       </div>
+    </div> <!-- end of idp-consents div -->
+    {{- end}}
     {{end}}
     </div>
     {{template "footer" . }}
@@ -635,3 +678,159 @@ const showAuthTokenHTML = `
 </html>
 {{end}}
 `
+
+type idpLogoutPageTemplateData struct {
+	Title                  string
+	AuthUsername           string
+	SessionExpires         int64
+	JSSources              []string
+	FrontChannelLogoutURLs []string
+	RedirectURL            string
+}
+
+const idpLogoutHTML = `
+{{define "idpLogoutPage"}}
+<!DOCTYPE html>
+<html style="height:100%; padding:0;border:0;margin:0">
+  <head>
+    <title>{{.Title}}</title>
+    <meta http-equiv="refresh" content="3;url={{.RedirectURL}}">
+    <link rel="stylesheet" type="text/css" href="//fonts.googleapis.com/css?family=Droid+Sans" />
+    <link rel="stylesheet" type="text/css" href="/custom_static/customization.css">
+    <link rel="stylesheet" type="text/css" href="/static/keymaster.css">
+  </head>
+  <body>
+    <div style="min-height:100%;position:relative;">
+    {{template "header" .}}
+    <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
+
+    <h1>{{.Title}}</h1>
+    <p>Logging out of connected applications...</p>
+    {{range .FrontChannelLogoutURLs}}
+    <iframe src="{{.}}" style="display:none;"></iframe>
+    {{end}}
+    <p><a href="{{.RedirectURL}}">Continue</a></p>
+
+    </div>
+    {{template "footer" . }}
+    </div>
+  </body>
+</html>
+{{end}}
+`
+
+type idpLogoutConfirmPageTemplateData struct {
+	Title          string
+	Action         string
+	AuthUsername   string
+	SessionExpires int64
+	JSSources      []string
+	FormValues     map[string][]string
+	LogoutToken    string
+}
+
+const idpLogoutConfirmHTML = `
+{{define "idpLogoutConfirmPage"}}
+<!DOCTYPE html>
+<html style="height:100%; padding:0;border:0;margin:0">
+  <head>
+    <title>{{.Title}}</title>
+    <link rel="stylesheet" type="text/css" href="//fonts.googleapis.com/css?family=Droid+Sans" />
+    <link rel="stylesheet" type="text/css" href="/custom_static/customization.css">
+    <link rel="stylesheet" type="text/css" href="/static/keymaster.css">
+  </head>
+  <body>
+    <div style="min-height:100%;position:relative;">
+    {{template "header" .}}
+    <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
+
+    <h1>{{.Title}}</h1>
+    {{if .AuthUsername}}
+    <p>Do you want to log out <b>{{.AuthUsername}}</b> from Keymaster and the connected applications?</p>
+    {{else}}
+    <p>You are not logged in to Keymaster.</p>
+    {{end}}
+    <form enctype="application/x-www-form-urlencoded" action="{{.Action}}" method="post">
+    {{range $key, $values := .FormValues}}
+    {{range $values}}
+       <input type="hidden" name="{{$key}}" value="{{.}}">
+    {{end}}
+    {{end}}
+       <input type="hidden" name="logout_token" value="{{.LogoutToken}}">
+       <p>
+       <input type="submit" value="{{if .AuthUsername}}Log out{{else}}Continue{{end}}" />
+       </p>
+    </form>
+
+    </div>
+    {{template "footer" . }}
+    </div>
+  </body>
+</html>
+{{end}}
+`
+
+type idpConsentPageTemplateData struct {
+	Title          string
+	AuthUsername   string
+	SessionExpires int64
+	JSSources      []string
+	ClientID       string
+	RedirectHost   string
+	Scopes         []string
+	Audiences      []string
+	FormValues     map[string][]string
+	ConsentToken   string
+}
+
+const idpConsentHTML = `
+{{define "idpConsentPage"}}
+<!DOCTYPE html>
+<html style="height:100%; padding:0;border:0;margin:0">
+  <head>
+    <title>{{.Title}}</title>
+    <link rel="stylesheet" type="text/css" href="//fonts.googleapis.com/css?family=Droid+Sans" />
+    <link rel="stylesheet" type="text/css" href="/custom_static/customization.css">
+    <link rel="stylesheet" type="text/css" href="/static/keymaster.css">
+  </head>
+  <body>
+    <div style="min-height:100%;position:relative;">
+    {{template "header" .}}
+    <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
+
+    <h1>{{.Title}}</h1>
+    <p>The application <b>{{.ClientID}}</b> at <b>{{.RedirectHost}}</b> is requesting access to your account.</p>
+    <p>Requested scopes:</p>
+    <ul>
+    {{range .Scopes}}
+       <li>{{.}}</li>
+    {{end}}
+    </ul>
+    {{if .Audiences}}
+    <p>The access token will also be valid for:</p>
+    <ul>
+    {{range .Audiences}}
+       <li>{{.}}</li>
+    {{end}}
+    </ul>
+    {{end}}
+    <form enctype="application/x-www-form-urlencoded" action="/idp/oauth2/authorize" method="post">
+    {{range $key, $values := .FormValues}}
+    {{range $values}}
+       <input type="hidden" name="{{$key}}" value="{{.}}">
+    {{end}}
+    {{end}}
+       <input type="hidden" name="consent_token" value="{{.ConsentToken}}">
+       <p>
+       <input type="submit" name="consent" value="Approve" />
+       <input type="submit" name="consent" value="Deny" />
+       </p>
+    </form>
+
+    </div>
+    {{template "footer" . }}
+    </div>
+  </body>
+</html>
+{{end}}
+`
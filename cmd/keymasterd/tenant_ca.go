@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+// Certificates from a tenant CA can be requested at
+// /ca/<name>/certgen/<username>, and its public material is at
+// /public/ca/<name>/x509ca and /public/ca/<name>/sshca.
+const tenantCAPath = "/ca/"
+const tenantCAPublicPrefix = "ca/"
+
+var tenantCANameRE = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9_-]*$")
+
+type tenantCA struct {
+	config        *tenantCAConfig
+	rawKey        []byte // Nil for external signers.
+	rawEd25519Key []byte
+	// Protected by the state lock once serving.
+	signer           crypto.Signer
+	ed25519Signer    crypto.Signer
+	caCertDer        []byte
+	ed25519CACertDer []byte
+}
+
+// certIssuer has what is needed to issue a certificate from one CA.
+type certIssuer struct {
+	caName        string // Empty for the default CA.
+	signer        crypto.Signer
+	ed25519Signer crypto.Signer
+	caCertDer     []byte
+}
+
+func (issuer *certIssuer) logSuffix() string {
+	if issuer.caName == "" {
+		return ""
+	}
+	return " by CA " + issuer.caName
+}
+
+func (ca *tenantCA) hasGroupMember(userGroups []string) bool {
+	for _, group := range ca.config.Groups {
+		for _, userGroup := range userGroups {
+			if group == userGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadTenantCAConfigs validates the tenant CA configuration and reads the
+// key files.
+func (state *RuntimeState) loadTenantCAConfigs() error {
+	state.tenantCAs = make(map[string]*tenantCA)
+	for i := range state.Config.TenantCAs {
+		config := &state.Config.TenantCAs[i]
+		if !tenantCANameRE.MatchString(config.Name) {
+			return fmt.Errorf("invalid tenant CA name='%s'", config.Name)
+		}
+		if _, ok := state.tenantCAs[config.Name]; ok {
+			return fmt.Errorf("duplicate tenant CA name='%s'", config.Name)
+		}
+		hasFile := config.SSHCAFilename != ""
+		if hasFile == (config.ExternalSignerConf.Type != "") {
+			return fmt.Errorf("tenant CA %s needs exactly one of ssh_ca_filename or external_signer_config",
+				config.Name)
+		}
+		ca := &tenantCA{config: config}
+		if hasFile {
+			var err error
+			ca.rawKey, err = exitsAndCanRead(config.SSHCAFilename,
+				"tenant CA file")
+			if err != nil {
+				return err
+			}
+			if config.Ed25519CAFilename != "" {
+				ca.rawEd25519Key, err = exitsAndCanRead(
+					config.Ed25519CAFilename, "tenant Ed25519 CA file")
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			if config.Ed25519CAFilename != "" {
+				return fmt.Errorf("tenant CA %s: ed25519_ca_keyfilename requires ssh_ca_filename",
+					config.Name)
+			}
+			if _, err := config.ExternalSignerConf.Parse(); err != nil {
+				return fmt.Errorf("tenant CA %s: %s", config.Name, err)
+			}
+		}
+		state.tenantCAs[config.Name] = ca
+	}
+	// Profiles select a single CA, so they cannot be reused nor shadow the
+	// name of another CA.
+	profiles := make(map[string]string)
+	for _, config := range state.Config.TenantCAs {
+		for _, profile := range config.Profiles {
+			if _, ok := state.tenantCAs[profile]; ok && profile != config.Name {
+				return fmt.Errorf("tenant CA %s: profile %s is the name of another CA",
+					config.Name, profile)
+			}
+			if other, ok := profiles[profile]; ok && other != config.Name {
+				return fmt.Errorf("profile %s used by tenant CAs %s and %s",
+					profile, other, config.Name)
+			}
+			profiles[profile] = config.Name
+		}
+	}
+	return nil
+}
+
+// unsealPEMIfNeeded returns pemData unchanged if it is PEM, or decrypts it
+// with password. It returns nil if the data is sealed and there is no
+// password yet.
+func unsealPEMIfNeeded(pemData []byte, password []byte) ([]byte, error) {
+	if block, _ := pem.Decode(pemData); block != nil {
+		return pemData, nil
+	}
+	if password == nil {
+		return nil, nil
+	}
+	return cryptoutils.PGPDecryptArmoredBytes(pemData, password)
+}
+
+// loadTenantCAs loads the signers of the tenant CAs not loaded yet. Sealed
+// keys are decrypted with password, which is the same as for the default CA,
+// or are left sealed if password is nil. Must be called with the lock held,
+// or before serving.
+func (state *RuntimeState) loadTenantCAs(password []byte) error {
+	for _, config := range state.Config.TenantCAs {
+		ca := state.tenantCAs[config.Name]
+		if ca == nil || ca.signer != nil {
+			continue
+		}
+		if err := state.loadTenantCA(ca, password); err != nil {
+			return fmt.Errorf("tenant CA %s: %s", config.Name, err)
+		}
+	}
+	return nil
+}
+
+func (state *RuntimeState) loadTenantCA(ca *tenantCA, password []byte) error {
+	var signer, ed25519Signer crypto.Signer
+	var err error
+	if ca.rawKey == nil {
+		signer, err = state.newExternalSigner(&ca.config.ExternalSignerConf)
+		if err != nil {
+			return err
+		}
+	} else {
+		keyPem, err := unsealPEMIfNeeded(ca.rawKey, password)
+		if err != nil {
+			return err
+		}
+		var ed25519Pem []byte
+		if len(ca.rawEd25519Key) > 0 {
+			ed25519Pem, err = unsealPEMIfNeeded(ca.rawEd25519Key, password)
+			if err != nil {
+				return err
+			}
+		}
+		if keyPem == nil || (len(ca.rawEd25519Key) > 0 && ed25519Pem == nil) {
+			state.logger.Printf("tenant CA %s is sealed", ca.config.Name)
+			return nil
+		}
+		signer, err = getSignerFromPEMBytes(keyPem)
+		if err != nil {
+			return err
+		}
+		if ed25519Pem != nil {
+			ed25519Signer, err = getSignerFromPEMBytes(ed25519Pem)
+			if err != nil {
+				return err
+			}
+			switch ed25519Signer.(type) {
+			case ed25519.PrivateKey, *ed25519.PrivateKey:
+			default:
+				return errors.New("ed25519_ca_keyfilename is not an Ed25519 key")
+			}
+		}
+	}
+	caCertDer, err := generateTenantCADer(state, ca.config.Name, signer)
+	if err != nil {
+		return err
+	}
+	var ed25519CACertDer []byte
+	if ed25519Signer != nil {
+		ed25519CACertDer, err = generateTenantCADer(state, ca.config.Name,
+			ed25519Signer)
+		if err != nil {
+			return err
+		}
+	}
+	ca.caCertDer = caCertDer
+	ca.ed25519CACertDer = ed25519CACertDer
+	ca.ed25519Signer = ed25519Signer
+	// Assignment of signer MUST be the last operation.
+	ca.signer = signer
+	state.logger.Printf("tenant CA %s loaded", ca.config.Name)
+	return nil
+}
+
+func generateTenantCADer(state *RuntimeState, name string,
+	keySigner crypto.Signer) ([]byte, error) {
+	organizationName := state.HostIdentity
+	if state.KerberosRealm != nil {
+		organizationName = *state.KerberosRealm
+	}
+	return certgen.GenSelfSignedCACert(name+"."+state.HostIdentity,
+		organizationName, keySigner)
+}
+
+// findTenantCA returns the tenant CA with the given name or profile.
+func (state *RuntimeState) findTenantCA(nameOrProfile string) *tenantCA {
+	if ca, ok := state.tenantCAs[nameOrProfile]; ok {
+		return ca
+	}
+	for _, config := range state.Config.TenantCAs {
+		for _, profile := range config.Profiles {
+			if profile == nameOrProfile {
+				return state.tenantCAs[config.Name]
+			}
+		}
+	}
+	return nil
+}
+
+func (state *RuntimeState) tenantCAsUseGroups() bool {
+	for _, config := range state.Config.TenantCAs {
+		if len(config.Groups) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// selectTenantCA returns the tenant CA to use, or nil for the default CA.
+// A requested CA (by name or profile) takes precedence over group
+// membership. The error is caused by the request.
+func (state *RuntimeState) selectTenantCA(requestedCA string,
+	userGroups []string) (*tenantCA, error) {
+	if requestedCA == "" {
+		for _, config := range state.Config.TenantCAs {
+			if ca := state.tenantCAs[config.Name]; ca.hasGroupMember(userGroups) {
+				return ca, nil
+			}
+		}
+		return nil, nil
+	}
+	ca := state.findTenantCA(requestedCA)
+	if ca == nil {
+		return nil, fmt.Errorf("unknown CA: %s", requestedCA)
+	}
+	if len(ca.config.Groups) > 0 && !ca.hasGroupMember(userGroups) {
+		return nil, fmt.Errorf("not allowed to use CA: %s", requestedCA)
+	}
+	return ca, nil
+}
+
+// getCertIssuer returns the CA that issues certificates for username.
+// requestedCA is a tenant CA name or profile, and may be empty. The first
+// error is caused by the request, the second one is internal.
+func (state *RuntimeState) getCertIssuer(username string,
+	requestedCA string) (*certIssuer, error, error) {
+	var userGroups []string
+	if state.tenantCAsUseGroups() {
+		var err error
+		userGroups, err = state.getUserGroups(username)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	ca, userErr := state.selectTenantCA(requestedCA, userGroups)
+	if userErr != nil {
+		return nil, userErr, nil
+	}
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	if ca == nil {
+		if state.Signer == nil {
+			return nil, nil, errors.New("signer not loaded")
+		}
+		signer, caCertDer, err := state.getSignerX509CAForPublic(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &certIssuer{
+			signer:        signer,
+			ed25519Signer: state.Ed25519Signer,
+			caCertDer:     caCertDer,
+		}, nil, nil
+	}
+	if ca.signer == nil {
+		return nil, nil, fmt.Errorf("tenant CA %s is not loaded",
+			ca.config.Name)
+	}
+	return &certIssuer{
+		caName:        ca.config.Name,
+		signer:        ca.signer,
+		ed25519Signer: ca.ed25519Signer,
+		caCertDer:     ca.caCertDer,
+	}, nil, nil
+}
+
+// parseCertgenPath returns the tenant CA requested in the path, if any, and
+// the target user.
+func parseCertgenPath(urlPath string) (string, string, bool) {
+	if strings.HasPrefix(urlPath, certgenPath) {
+		return "", urlPath[len(certgenPath):], true
+	}
+	if !strings.HasPrefix(urlPath, tenantCAPath) {
+		return "", "", false
+	}
+	caName, rest, ok := strings.Cut(urlPath[len(tenantCAPath):], "/")
+	if !ok || caName == "" || !strings.HasPrefix(rest, "certgen/") {
+		return "", "", false
+	}
+	return caName, rest[len("certgen/"):], true
+}
+
+func (state *RuntimeState) tenantCAPublicHandler(w http.ResponseWriter,
+	r *http.Request, target string) {
+	caName, kind, _ := strings.Cut(target, "/")
+	ca, ok := state.tenantCAs[caName]
+	if !ok {
+		state.writeFailureResponse(w, r, http.StatusNotFound, "")
+		return
+	}
+	state.Mutex.Lock()
+	signer := ca.signer
+	ed25519Signer := ca.ed25519Signer
+	caCertDers := [][]byte{ca.caCertDer}
+	if ca.ed25519CACertDer != nil {
+		caCertDers = [][]byte{ca.ed25519CACertDer, ca.caCertDer}
+	}
+	state.Mutex.Unlock()
+	if signer == nil {
+		state.writeFailureResponse(w, r, http.StatusServiceUnavailable, "")
+		logger.Printf("tenant CA %s not loaded", caName)
+		return
+	}
+	switch kind {
+	case "x509ca":
+		state.writeX509CAs(w, r, caCertDers, "keymasterx509CA-"+caName+".pem")
+	case "sshca":
+		publicKeys := []crypto.PublicKey{signer.Public()}
+		if ed25519Signer != nil {
+			publicKeys = []crypto.PublicKey{ed25519Signer.Public(),
+				signer.Public()}
+		}
+		state.writeSSHCAs(w, r, publicKeys, "keymastersshCA-"+caName+".pub")
+	default:
+		state.writeFailureResponse(w, r, http.StatusNotFound, "")
+	}
+}
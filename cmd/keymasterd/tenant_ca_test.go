@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+func writeTestTenantCAKey(t *testing.T, dir string, name string,
+	passphrase []byte) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if passphrase != nil {
+		keyData, err = cryptoutils.PGPArmorEncryptBytes(keyData, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, keyData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key, filename
+}
+
+func TestLoadTenantCAConfigs(t *testing.T) {
+	dir := t.TempDir()
+	_, keyFilename := writeTestTenantCAKey(t, dir, "partner.key", nil)
+	goodConfigs := [][]tenantCAConfig{
+		{
+			{Name: "partner", SSHCAFilename: keyFilename,
+				Profiles: []string{"partner-prod"}},
+			{Name: "corp", ExternalSignerConf: ExternalSignerConfig{
+				Type: "remote", Location: "unix:///run/signer.sock"},
+				Profiles: []string{"corp-laptops"}},
+		},
+		// A CA may list its own name as a profile.
+		{{Name: "partner", SSHCAFilename: keyFilename,
+			Profiles: []string{"partner"}}},
+	}
+	for _, configs := range goodConfigs {
+		state := RuntimeState{}
+		state.Config.TenantCAs = configs
+		if err := state.loadTenantCAConfigs(); err != nil {
+			t.Fatalf("config %+v failed: %s", configs, err)
+		}
+	}
+	badConfigs := [][]tenantCAConfig{
+		{{Name: "", SSHCAFilename: keyFilename}},
+		{{Name: "bad/name", SSHCAFilename: keyFilename}},
+		{{Name: "partner"}},
+		{{Name: "partner", SSHCAFilename: keyFilename,
+			ExternalSignerConf: ExternalSignerConfig{Type: "remote",
+				Location: "unix:///run/signer.sock"}}},
+		{{Name: "partner", SSHCAFilename: filepath.Join(dir, "missing")}},
+		{{Name: "partner", ExternalSignerConf: ExternalSignerConfig{
+			Type: "remote", Location: "tcp://signer:6930"}}},
+		{
+			{Name: "partner", SSHCAFilename: keyFilename},
+			{Name: "partner", SSHCAFilename: keyFilename},
+		},
+		{
+			{Name: "partner", SSHCAFilename: keyFilename,
+				Profiles: []string{"shared"}},
+			{Name: "corp", SSHCAFilename: keyFilename,
+				Profiles: []string{"shared"}},
+		},
+		{
+			{Name: "partner", SSHCAFilename: keyFilename,
+				Profiles: []string{"corp"}},
+			{Name: "corp", SSHCAFilename: keyFilename},
+		},
+	}
+	for _, configs := range badConfigs {
+		state := RuntimeState{}
+		state.Config.TenantCAs = configs
+		if err := state.loadTenantCAConfigs(); err == nil {
+			t.Errorf("config %+v should have failed", configs)
+		}
+	}
+}
+
+func TestSelectTenantCA(t *testing.T) {
+	dir := t.TempDir()
+	_, keyFilename := writeTestTenantCAKey(t, dir, "ca.key", nil)
+	state := RuntimeState{}
+	state.Config.TenantCAs = []tenantCAConfig{
+		{Name: "partner", SSHCAFilename: keyFilename,
+			Profiles: []string{"partner-prod"}, Groups: []string{"partners"}},
+		{Name: "lab", SSHCAFilename: keyFilename,
+			Profiles: []string{"lab-hosts"}},
+	}
+	if err := state.loadTenantCAConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	if !state.tenantCAsUseGroups() {
+		t.Fatal("tenant CAs use groups")
+	}
+	tests := []struct {
+		requestedCA string
+		userGroups  []string
+		expectedCA  string
+		fails       bool
+	}{
+		{"", nil, "", false},
+		{"", []string{"staff"}, "", false},
+		{"", []string{"staff", "partners"}, "partner", false},
+		{"partner", []string{"partners"}, "partner", false},
+		{"partner-prod", []string{"partners"}, "partner", false},
+		{"partner-prod", []string{"staff"}, "", true},
+		{"lab", nil, "lab", false},
+		{"lab-hosts", []string{"partners"}, "lab", false},
+		{"unknown", nil, "", true},
+	}
+	for _, test := range tests {
+		ca, err := state.selectTenantCA(test.requestedCA, test.userGroups)
+		if test.fails {
+			if err == nil {
+				t.Errorf("requesting '%s' with groups %v should have failed",
+					test.requestedCA, test.userGroups)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("requesting '%s' with groups %v failed: %s",
+				test.requestedCA, test.userGroups, err)
+			continue
+		}
+		caName := ""
+		if ca != nil {
+			caName = ca.config.Name
+		}
+		if caName != test.expectedCA {
+			t.Errorf("requesting '%s' with groups %v selected '%s', expected '%s'",
+				test.requestedCA, test.userGroups, caName, test.expectedCA)
+		}
+	}
+}
+
+func TestParseCertgenPath(t *testing.T) {
+	tests := []struct {
+		path, caName, username string
+		ok                     bool
+	}{
+		{"/certgen/username", "", "username", true},
+		{"/ca/partner/certgen/username", "partner", "username", true},
+		{"/ca/partner/username", "", "", false},
+		{"/ca//certgen/username", "", "", false},
+		{"/other/username", "", "", false},
+	}
+	for _, test := range tests {
+		caName, username, ok := parseCertgenPath(test.path)
+		if ok != test.ok || caName != test.caName || username != test.username {
+			t.Errorf("%s: got (%s, %s, %v)", test.path, caName, username, ok)
+		}
+	}
+}
+
+func TestTenantCACertgen(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	state.HostIdentity = "keymaster.example.com"
+	dir := t.TempDir()
+	partnerKey, partnerFilename := writeTestTenantCAKey(t, dir, "partner.key",
+		nil)
+	passphrase := []byte("passphrase")
+	labKey, labFilename := writeTestTenantCAKey(t, dir, "lab.key", passphrase)
+	state.Config.TenantCAs = []tenantCAConfig{
+		{Name: "partner", SSHCAFilename: partnerFilename,
+			Profiles: []string{"partner-prod"}},
+		{Name: "lab", SSHCAFilename: labFilename},
+	}
+	if err := state.loadTenantCAConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.loadTenantCAs(nil); err != nil {
+		t.Fatal(err)
+	}
+	if state.tenantCAs["lab"].signer != nil {
+		t.Fatal("sealed tenant CA should not be loaded")
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := http.Cookie{Name: authCookieName, Value: cookieVal}
+	getCert := func(path string, expectedStatus int) *x509.Certificate {
+		req, err := createKeyBodyRequest("POST", path, testUserPEMPublicKey,
+			"")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(&authCookie)
+		rr, err := checkRequestHandlerCode(req, state.certGenHandler,
+			expectedStatus)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if expectedStatus != http.StatusOK {
+			return nil
+		}
+		pemCert, err := io.ReadAll(rr.Result().Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(pemCert)
+		if block == nil {
+			t.Fatalf("%s: no certificate returned", path)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	for _, path := range []string{
+		"/ca/partner/certgen/username?type=x509",
+		"/certgen/username?type=x509&ca_profile=partner-prod",
+	} {
+		cert := getCert(path, http.StatusOK)
+		if cert.Issuer.CommonName != "partner.keymaster.example.com" {
+			t.Fatalf("%s: unexpected issuer: %s", path, cert.Issuer.CommonName)
+		}
+		if !partnerKey.PublicKey.Equal(state.tenantCAs["partner"].signer.Public()) {
+			t.Fatal("partner CA does not use its key")
+		}
+	}
+	defaultCA, err := x509.ParseCertificate(state.caCertDer[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := getCert("/certgen/username?type=x509", http.StatusOK)
+	if err := cert.CheckSignatureFrom(defaultCA); err != nil {
+		t.Fatalf("not issued by the default CA: %s", err)
+	}
+	getCert("/ca/unknown/certgen/username?type=x509", http.StatusForbidden)
+	getCert("/ca/lab/certgen/username?type=x509",
+		http.StatusInternalServerError)
+
+	// Sealed tenant CAs are unsealed with the passphrase of the default CA.
+	if err := state.loadTenantCAs([]byte("wrong")); err == nil {
+		t.Fatal("wrong passphrase should have failed")
+	}
+	if err := state.loadTenantCAs(passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if !labKey.PublicKey.Equal(state.tenantCAs["lab"].signer.Public()) {
+		t.Fatal("lab CA does not use its key")
+	}
+	cert = getCert("/ca/lab/certgen/username?type=x509", http.StatusOK)
+	if cert.Issuer.CommonName != "lab.keymaster.example.com" {
+		t.Fatalf("unexpected issuer: %s", cert.Issuer.CommonName)
+	}
+
+	// Each CA has its own public material.
+	req, err := http.NewRequest("GET", "/public/ca/partner/x509ca", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := checkRequestHandlerCode(req, state.publicPathHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemCA, err := io.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemCA)
+	if block == nil {
+		t.Fatal("no CA certificate returned")
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caCert.Subject.CommonName != "partner.keymaster.example.com" {
+		t.Fatalf("unexpected CA: %s", caCert.Subject.CommonName)
+	}
+	req, err = http.NewRequest("GET", "/public/ca/partner/sshca", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkRequestHandlerCode(req, state.publicPathHandler,
+		http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("GET", "/public/ca/unknown/x509ca", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkRequestHandlerCode(req, state.publicPathHandler,
+		http.StatusNotFound); err != nil {
+		t.Fatal(err)
+	}
+}
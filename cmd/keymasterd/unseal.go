@@ -23,6 +23,10 @@ func (state *RuntimeState) readyzHandler(w http.ResponseWriter,
 	if state.Signer == nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintf(w, "not ready\n")
+		if received, threshold := state.unsealShareProgress(); threshold > 0 {
+			fmt.Fprintf(w, "unseal shares received: %d/%d\n", received,
+				threshold)
+		}
 	} else {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "OK\n")
@@ -54,7 +58,9 @@ func (state *RuntimeState) secretInjectorHandler(w http.ResponseWriter,
 		logger.Printf("missing ssh_ca_password")
 		return
 	}
-	if err := state.unsealCA([]byte(sshCAPassword[0]), clientName); err != nil {
+	err := state.unsealCA([]byte(sshCAPassword[0]), clientName)
+	eventNotifier.PublishUnsealEvent(r, clientName, err)
+	if err != nil {
 		state.writeFailureResponse(w, r, http.StatusBadRequest,
 			"Invalid Post, "+err.Error())
 		logger.Println(err)
@@ -134,6 +140,16 @@ func (state *RuntimeState) unsealCA(password []byte, clientName string) error {
 		}
 	}
 
+	// Sealed tenant CAs share the passphrase of the default CA.
+	if err := state.loadTenantCAs(password); err != nil {
+		return err
+	}
+	if err := state.loadPairwiseSubjectSecret(password); err != nil {
+		return err
+	}
+	if err := state.loadPreviousCAKeys(password); err != nil {
+		return err
+	}
 	sendMessage := false
 	if state.Signer == nil {
 		sendMessage = true
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+const secretShareInjectorPath = "/admin/injectShare"
+
+const defaultUnsealShareTimeout = 15 * time.Minute
+
+// unsealShareCollector holds the shares received so far for one split. The
+// first share fixes the checksums every other share must match.
+type unsealShareCollector struct {
+	firstShare   *cryptoutils.UnsealShare
+	threshold    int
+	shares       map[byte]*cryptoutils.UnsealShare // Keyed by x coordinate.
+	submitters   map[string]struct{}
+	firstShareAt time.Time
+}
+
+func (config *splitKeyUnseal) applyDefaults() {
+	if config.ShareTimeout <= 0 {
+		config.ShareTimeout = defaultUnsealShareTimeout
+	}
+}
+
+func (collector *unsealShareCollector) wipe() {
+	for _, share := range collector.shares {
+		for i := range share.Share {
+			share.Share[i] = 0
+		}
+	}
+}
+
+func (collector *unsealShareCollector) submitterNames() string {
+	names := make([]string, 0, len(collector.submitters))
+	for name := range collector.submitters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Must be called with the lock held.
+func (state *RuntimeState) expireUnsealSharesIfStale() {
+	collector := state.unsealShares
+	if collector == nil {
+		return
+	}
+	timeout := state.Config.Base.SplitKeyUnseal.ShareTimeout
+	if timeout <= 0 {
+		timeout = defaultUnsealShareTimeout
+	}
+	if time.Since(collector.firstShareAt) < timeout {
+		return
+	}
+	state.logger.Printf("discarding %d/%d unseal shares from %s: timed out",
+		len(collector.shares), collector.threshold,
+		collector.submitterNames())
+	collector.wipe()
+	state.unsealShares = nil
+}
+
+// unsealShareProgress returns how many shares have been received and how
+// many are needed. Both are zero if no shares are pending.
+func (state *RuntimeState) unsealShareProgress() (int, int) {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	state.expireUnsealSharesIfStale()
+	if state.unsealShares == nil {
+		return 0, 0
+	}
+	return len(state.unsealShares.shares), state.unsealShares.threshold
+}
+
+// addUnsealShare records share. Once enough shares are received it returns
+// the recovered secret and the names of the submitters, and the pending
+// shares are discarded.
+func (state *RuntimeState) addUnsealShare(share *cryptoutils.UnsealShare,
+	clientName string) ([]byte, string, error) {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	if state.Signer != nil {
+		return nil, "", errors.New("signer not null, already unlocked")
+	}
+	requiredShares := state.Config.Base.SplitKeyUnseal.RequiredShares
+	if requiredShares > 0 && share.Threshold != requiredShares {
+		return nil, "", fmt.Errorf("share requires %d shares, expected %d",
+			share.Threshold, requiredShares)
+	}
+	// A share which does not match its own checksum is rejected without
+	// affecting the shares already received.
+	if err := share.Verify(); err != nil {
+		return nil, "", err
+	}
+	state.expireUnsealSharesIfStale()
+	collector := state.unsealShares
+	if collector == nil {
+		collector = &unsealShareCollector{
+			firstShare:   share,
+			threshold:    share.Threshold,
+			shares:       make(map[byte]*cryptoutils.UnsealShare),
+			submitters:   make(map[string]struct{}),
+			firstShareAt: time.Now(),
+		}
+		state.unsealShares = collector
+	}
+	if !share.SameSplit(collector.firstShare) {
+		return nil, "", errors.New("share belongs to a different split")
+	}
+	if _, ok := collector.submitters[clientName]; ok {
+		return nil, "", errors.New("a share was already submitted by " +
+			clientName)
+	}
+	x := share.Share[len(share.Share)-1]
+	if _, ok := collector.shares[x]; ok {
+		return nil, "", errors.New("share already submitted")
+	}
+	collector.shares[x] = share
+	collector.submitters[clientName] = struct{}{}
+	if len(collector.shares) < collector.threshold {
+		return nil, "", nil
+	}
+	state.unsealShares = nil
+	defer collector.wipe()
+	shares := make([]cryptoutils.UnsealShare, 0, len(collector.shares))
+	for _, share := range collector.shares {
+		shares = append(shares, *share)
+	}
+	secret, err := cryptoutils.CombineUnsealShares(shares)
+	if err != nil {
+		return nil, "", err
+	}
+	return secret, collector.submitterNames(), nil
+}
+
+func (state *RuntimeState) secretShareInjectorHandler(w http.ResponseWriter,
+	r *http.Request) {
+	// Same authentication as secretInjectorHandler: any valid admin client
+	// certificate, each share must come from a different certificate.
+	if r.TLS == nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		logger.Printf("We require TLS\n")
+		return
+	}
+	if len(r.TLS.VerifiedChains) < 1 {
+		state.writeFailureResponse(w, r, http.StatusForbidden, "")
+		logger.Printf("Forbidden\n")
+		return
+	}
+	clientName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	logger.Printf("Got unseal share connection from %s", clientName)
+	r.ParseForm()
+	share, err := cryptoutils.ParseUnsealShare(r.Form.Get("unseal_share"))
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid Post, "+err.Error())
+		logger.Printf("bad unseal share from %s: %s", clientName, err)
+		return
+	}
+	secret, submitters, err := state.addUnsealShare(share, clientName)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid Post, "+err.Error())
+		logger.Printf("rejected unseal share from %s: %s", clientName, err)
+		return
+	}
+	if secret == nil {
+		received, threshold := state.unsealShareProgress()
+		logger.Printf("accepted unseal share from %s (%d/%d)", clientName,
+			received, threshold)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "share accepted: %d/%d\n", received, threshold)
+		return
+	}
+	err = state.unsealCA(secret, "unseal shares from "+submitters)
+	for i := range secret {
+		secret[i] = 0
+	}
+	eventNotifier.PublishUnsealEvent(r, submitters, err)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid Post, combined shares did not unseal: "+err.Error())
+		logger.Printf("combined unseal shares from %s failed: %s", submitters,
+			err)
+		return
+	}
+	logger.Printf("unsealed with shares from %s", submitters)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK\n")
+}
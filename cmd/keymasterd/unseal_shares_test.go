@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+func newInjectShareRequest(t *testing.T, clientName string,
+	share cryptoutils.UnsealShare) *http.Request {
+	form := url.Values{"unseal_share": {share.String()}}
+	req, err := http.NewRequest("POST", secretShareInjectorPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	var subjectCert x509.Certificate
+	subjectCert.Subject.CommonName = clientName
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{&subjectCert}},
+	}
+	return req
+}
+
+func checkReadyzBody(t *testing.T, state *RuntimeState, expected string) {
+	req, err := http.NewRequest("GET", readyzPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := checkRequestHandlerCode(req, state.readyzHandler,
+		http.StatusServiceUnavailable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != expected {
+		t.Fatalf("readyz body=%q expected=%q", body, expected)
+	}
+}
+
+func TestInjectingSecretShares(t *testing.T) {
+	state := RuntimeState{logger: testlogger.New(t)}
+	state.SSHCARawFileContent = []byte(encryptedTestSignerPrivateKey)
+	state.SignerIsReady = make(chan bool, 1)
+	state.Config.Base.SplitKeyUnseal.applyDefaults()
+
+	shares, err := cryptoutils.SplitSecretToUnsealShares([]byte("password"),
+		3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherShares, err := cryptoutils.SplitSecretToUnsealShares(
+		[]byte("password"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badShares, err := cryptoutils.SplitSecretToUnsealShares(
+		[]byte("badpassword"), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No client certificate.
+	req := newInjectShareRequest(t, "alice", shares[0])
+	req.TLS = &tls.ConnectionState{}
+	_, err = checkRequestHandlerCode(req, state.secretShareInjectorHandler,
+		http.StatusForbidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newInjectShareRequest(t, "alice",
+		shares[0]), state.secretShareInjectorHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReadyzBody(t, &state, "not ready\nunseal shares received: 1/2\n")
+	// A corrupted share is rejected and the others are kept.
+	corruptedShare := shares[1]
+	corruptedShare.Share = append([]byte{}, shares[1].Share...)
+	corruptedShare.Share[0] ^= 1
+	_, err = checkRequestHandlerCode(newInjectShareRequest(t, "bob",
+		corruptedShare), state.secretShareInjectorHandler,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := state.addUnsealShare(&corruptedShare, "bob"); err == nil {
+		t.Fatal("accepted a corrupted share")
+	}
+	checkReadyzBody(t, &state, "not ready\nunseal shares received: 1/2\n")
+	// Same custodian, share from another split and timeout.
+	_, err = checkRequestHandlerCode(newInjectShareRequest(t, "alice",
+		shares[1]), state.secretShareInjectorHandler, http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newInjectShareRequest(t, "bob",
+		otherShares[1]), state.secretShareInjectorHandler,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.unsealShares.firstShareAt = time.Now().Add(-time.Hour)
+	checkReadyzBody(t, &state, "not ready\n")
+	// Valid shares of the wrong secret are discarded once combined.
+	_, err = checkRequestHandlerCode(newInjectShareRequest(t, "alice",
+		badShares[0]), state.secretShareInjectorHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newInjectShareRequest(t, "bob",
+		badShares[1]), state.secretShareInjectorHandler,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReadyzBody(t, &state, "not ready\n")
+	// Now two custodians unseal.
+	_, err = checkRequestHandlerCode(newInjectShareRequest(t, "bob",
+		shares[1]), state.secretShareInjectorHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Signer != nil {
+		t.Fatal("unsealed with a single share")
+	}
+	_, err = checkRequestHandlerCode(newInjectShareRequest(t, "carol",
+		shares[2]), state.secretShareInjectorHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Signer == nil {
+		t.Fatal("The signer should now be loaded")
+	}
+	if state.unsealShares != nil {
+		t.Fatal("shares should be discarded after unsealing")
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Package alerts detects anomalies in the keymaster event stream with rules
+declared in the keymaster-eventmond configuration.
+
+The rule types are:
+
+	rate:              more than Threshold events of EventTypes (default: SSH
+	                   and X.509 certificates) for a user within Window
+	                   (default: 10m).
+	multiple_networks: events of EventTypes (default: SSH and X.509
+	                   certificates) for a user from more than one of the named
+	                   Networks within Window (default: 1h).
+	new_user_agent:    a successful event of EventTypes (default: Auth and
+	                   WebLogin) from a user agent (browser family and
+	                   operating system) not seen within Window (default: 31
+	                   days) for a user who has logged in within Window.
+	cert_without_2fa:  a certificate issued to a user who has not used a
+	                   second factor within Window (default: 31 days).
+	                   Alerted once per user and Window.
+
+The state of the rules older than Window is forgotten.
+*/
+package alerts
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+)
+
+const (
+	RuleTypeCertWithout2FA   = "cert_without_2fa"
+	RuleTypeMultipleNetworks = "multiple_networks"
+	RuleTypeNewUserAgent     = "new_user_agent"
+	RuleTypeRate             = "rate"
+)
+
+type RuleConfig struct {
+	Name       string   `yaml:"name"`
+	Type       string   `yaml:"type"`
+	EventTypes []string `yaml:"event_types"`
+	// Users limits the rule to users matching these patterns (path.Match
+	// syntax). Default: all.
+	Users        []string      `yaml:"users"`
+	ExcludeUsers []string      `yaml:"exclude_users"`
+	Threshold    uint          `yaml:"threshold"` // rate.
+	Window       time.Duration `yaml:"window"`
+	// Networks maps names (such as countries) to CIDR blocks.
+	Networks map[string][]string `yaml:"networks"`
+	// NetworksFile has more networks, one "CIDR name" pair per line.
+	NetworksFile string `yaml:"networks_file"`
+}
+
+// Alert is raised by a rule for an event.
+type Alert struct {
+	Rule     string
+	RuleType string
+	Time     time.Time
+	Username string
+	Message  string
+	Event    *sinks.Event // The event which triggered the alert.
+}
+
+type Engine struct {
+	logger log.Logger
+	rules  []*rule
+	mutex  sync.Mutex
+	// Protected by lock.
+	counts         map[string]uint64 // Key: rule name.
+	lastExpireTime time.Time
+	recentAlerts   []*Alert // Newest last.
+}
+
+// New creates the rules. It returns an error for invalid rules.
+func New(configs []RuleConfig, logger log.Logger) (*Engine, error) {
+	return newEngine(configs, logger)
+}
+
+// Learn updates the state of the rules with a past event, without alerting.
+func (e *Engine) Learn(event *sinks.Event) {
+	e.process(event, true)
+}
+
+// Process checks an event against the rules and returns the alerts raised.
+func (e *Engine) Process(event *sinks.Event) []*Alert {
+	return e.process(event, false)
+}
+
+// SinkEvent returns the alert as an event of type sinks.EventTypeAlert.
+func (a *Alert) SinkEvent() *sinks.Event {
+	return a.sinkEvent()
+}
+
+// WriteHtml writes the alert counts and the latest alerts.
+func (e *Engine) WriteHtml(writer io.Writer) {
+	e.writeHtml(writer)
+}
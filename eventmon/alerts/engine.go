@@ -0,0 +1,248 @@
+package alerts
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	expireInterval  = 10 * time.Minute
+	numRecentAlerts = 100
+	numShownAlerts  = 20
+)
+
+var (
+	alertCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keymaster_eventmond_alerts_total",
+			Help: "Alerts raised by each rule.",
+		},
+		[]string{"rule", "type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(alertCounter)
+}
+
+type rule struct {
+	config     RuleConfig
+	eventTypes map[string]struct{} // All if nil.
+	checker    checker
+}
+
+func newRule(config RuleConfig) (*rule, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("rule of type: %s has no name", config.Type)
+	}
+	for _, patterns := range [][]string{config.Users, config.ExcludeUsers} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule: %s: %s: %s", config.Name,
+					pattern, err)
+			}
+		}
+	}
+	newRule := &rule{config: config}
+	eventTypes := config.EventTypes
+	var err error
+	switch config.Type {
+	case RuleTypeCertWithout2FA:
+		if len(eventTypes) > 0 {
+			return nil, fmt.Errorf("rule: %s: event_types not supported",
+				config.Name)
+		}
+		newRule.checker = newCertWithout2FAChecker(config)
+	case RuleTypeMultipleNetworks:
+		if len(eventTypes) < 1 {
+			eventTypes = certEventTypes
+		}
+		newRule.checker, err = newMultipleNetworksChecker(config)
+	case RuleTypeNewUserAgent:
+		if len(eventTypes) < 1 {
+			eventTypes = []string{
+				eventmon.EventTypeAuth,
+				eventmon.EventTypeWebLogin,
+			}
+		}
+		newRule.checker = newNewUserAgentChecker(config)
+	case RuleTypeRate:
+		if len(eventTypes) < 1 {
+			eventTypes = certEventTypes
+		}
+		newRule.checker, err = newRateChecker(config)
+	default:
+		return nil, fmt.Errorf("rule: %s: unknown type: %s", config.Name,
+			config.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(eventTypes) > 0 {
+		newRule.eventTypes = make(map[string]struct{}, len(eventTypes))
+		for _, eventType := range eventTypes {
+			newRule.eventTypes[eventType] = struct{}{}
+		}
+	}
+	return newRule, nil
+}
+
+func matchesAny(patterns []string, username string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, username); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matches(event *sinks.Event) bool {
+	if r.eventTypes != nil {
+		if _, ok := r.eventTypes[event.Type]; !ok {
+			return false
+		}
+	}
+	if len(r.config.Users) > 0 && !matchesAny(r.config.Users, event.Username) {
+		return false
+	}
+	return !matchesAny(r.config.ExcludeUsers, event.Username)
+}
+
+func newEngine(configs []RuleConfig, logger log.Logger) (*Engine, error) {
+	engine := &Engine{
+		logger: logger,
+		counts: make(map[string]uint64),
+	}
+	for _, config := range configs {
+		if _, ok := engine.counts[config.Name]; ok {
+			return nil, fmt.Errorf("duplicate rule name: %s", config.Name)
+		}
+		rule, err := newRule(config)
+		if err != nil {
+			return nil, err
+		}
+		engine.rules = append(engine.rules, rule)
+		engine.counts[config.Name] = 0
+		alertCounter.WithLabelValues(config.Name, config.Type)
+	}
+	return engine, nil
+}
+
+func (e *Engine) process(event *sinks.Event, learnOnly bool) []*Alert {
+	if event.Username == "" {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if event.Time.Sub(e.lastExpireTime) >= expireInterval {
+		for _, rule := range e.rules {
+			rule.checker.expire(event.Time)
+		}
+		e.lastExpireTime = event.Time
+	}
+	var alerts []*Alert
+	for _, rule := range e.rules {
+		if !rule.matches(event) {
+			continue
+		}
+		message := rule.checker.check(event)
+		if message == "" || learnOnly {
+			continue
+		}
+		alert := &Alert{
+			Rule:     rule.config.Name,
+			RuleType: rule.config.Type,
+			Time:     event.Time,
+			Username: event.Username,
+			Message:  message,
+			Event:    event,
+		}
+		e.logger.Printf("Alert: %s: %s: %s\n", alert.Rule, alert.Username,
+			alert.Message)
+		alertCounter.WithLabelValues(alert.Rule, alert.RuleType).Inc()
+		e.counts[alert.Rule]++
+		e.recentAlerts = append(e.recentAlerts, alert)
+		if len(e.recentAlerts) > numRecentAlerts {
+			e.recentAlerts = e.recentAlerts[1:]
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts
+}
+
+func (a *Alert) sinkEvent() *sinks.Event {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return &sinks.Event{
+		ID:             hex.EncodeToString(id[:]),
+		Type:           sinks.EventTypeAlert,
+		Time:           a.Time,
+		ServerHostname: a.Event.ServerHostname,
+		SourceIP:       a.Event.SourceIP,
+		UserAgent:      a.Event.UserAgent,
+		Username:       a.Username,
+		Rule:           a.Rule,
+		Message:        a.Message,
+	}
+}
+
+func (e *Engine) writeHtml(writer io.Writer) {
+	if len(e.rules) < 1 {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	fmt.Fprintln(writer, "Alerts:<br>")
+	fmt.Fprintln(writer, `<table border="1">`)
+	fmt.Fprintln(writer, "  <tr>")
+	fmt.Fprintln(writer, "    <th>Rule</th>")
+	fmt.Fprintln(writer, "    <th>Type</th>")
+	fmt.Fprintln(writer, "    <th>Alerts</th>")
+	fmt.Fprintln(writer, "  </tr>")
+	for _, rule := range e.rules {
+		fmt.Fprintln(writer, "  <tr>")
+		fmt.Fprintf(writer, "    <td>%s</td>\n",
+			html.EscapeString(rule.config.Name))
+		fmt.Fprintf(writer, "    <td>%s</td>\n", rule.config.Type)
+		fmt.Fprintf(writer, "    <td>%d</td>\n", e.counts[rule.config.Name])
+		fmt.Fprintln(writer, "  </tr>")
+	}
+	fmt.Fprintln(writer, "</table>")
+	if len(e.recentAlerts) < 1 {
+		return
+	}
+	fmt.Fprintln(writer, "Latest alerts:<br>")
+	fmt.Fprintln(writer, `<table border="1">`)
+	fmt.Fprintln(writer, "  <tr>")
+	fmt.Fprintln(writer, "    <th>Time</th>")
+	fmt.Fprintln(writer, "    <th>Rule</th>")
+	fmt.Fprintln(writer, "    <th>Username</th>")
+	fmt.Fprintln(writer, "    <th>Message</th>")
+	fmt.Fprintln(writer, "  </tr>")
+	for index := len(e.recentAlerts) - 1; index >= 0 &&
+		index >= len(e.recentAlerts)-numShownAlerts; index-- {
+		alert := e.recentAlerts[index]
+		fmt.Fprintln(writer, "  <tr>")
+		fmt.Fprintf(writer, "    <td>%s</td>\n",
+			alert.Time.Local().Format(time.RFC3339))
+		fmt.Fprintf(writer, "    <td>%s</td>\n", html.EscapeString(alert.Rule))
+		fmt.Fprintf(writer, "    <td>%s</td>\n",
+			html.EscapeString(alert.Username))
+		fmt.Fprintf(writer, "    <td>%s</td>\n",
+			html.EscapeString(alert.Message))
+		fmt.Fprintln(writer, "  </tr>")
+	}
+	fmt.Fprintln(writer, "</table>")
+}
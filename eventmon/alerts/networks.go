@@ -0,0 +1,80 @@
+package alerts
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+type namedNetwork struct {
+	name    string
+	network *net.IPNet
+}
+
+// loadNetworks returns the networks, most specific first.
+func loadNetworks(networksMap map[string][]string, filename string) (
+	[]namedNetwork, error) {
+	var networks []namedNetwork
+	addNetwork := func(cidr, name string) error {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, namedNetwork{name, network})
+		return nil
+	}
+	for name, cidrs := range networksMap {
+		for _, cidr := range cidrs {
+			if err := addNetwork(cidr, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if filename != "" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected CIDR and name",
+					filename, lineNumber)
+			}
+			if err := addNetwork(fields[0], fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", filename, lineNumber, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(networks, func(left, right int) bool {
+		leftOnes, _ := networks[left].network.Mask.Size()
+		rightOnes, _ := networks[right].network.Mask.Size()
+		return leftOnes > rightOnes
+	})
+	return networks, nil
+}
+
+// findNetwork returns the name of the most specific network containing ip.
+func findNetwork(networks []namedNetwork, ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	for _, network := range networks {
+		if network.network.Contains(ip) {
+			return network.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package alerts
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadNetworks(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "networks")
+	err := os.WriteFile(filename, []byte(
+		"# Comment.\n\n192.0.2.0/24 home\n192.0.2.128/25 lab\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks, err := loadNetworks(
+		map[string][]string{"office": {"10.0.0.0/8"}}, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]string{
+		"10.1.2.3":     "office",
+		"192.0.2.1":    "home",
+		"192.0.2.200":  "lab",
+		"198.51.100.1": "",
+	} {
+		if name := findNetwork(networks, net.ParseIP(ip)); name != expected {
+			t.Errorf("%s: expected: %q, got: %q", ip, expected, name)
+		}
+	}
+	if name := findNetwork(networks, nil); name != "" {
+		t.Errorf("nil IP: got: %q", name)
+	}
+}
+
+func TestLoadNetworksErrors(t *testing.T) {
+	if _, err := loadNetworks(map[string][]string{"bad": {"10.0.0.0"}},
+		""); err == nil {
+		t.Error("no error for invalid CIDR")
+	}
+	filename := filepath.Join(t.TempDir(), "networks")
+	if err := os.WriteFile(filename, []byte("10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadNetworks(nil, filename); err == nil {
+		t.Error("no error for missing name")
+	}
+	if _, err := loadNetworks(nil, filename+".missing"); err == nil {
+		t.Error("no error for missing file")
+	}
+}
@@ -0,0 +1,241 @@
+package alerts
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const durationMonth = time.Hour * 24 * 31
+
+// checker keeps the state of a rule. check returns the alert message, if the
+// event raises an alert. expire forgets the state older than the window of
+// the rule.
+type checker interface {
+	check(event *sinks.Event) string
+	expire(now time.Time)
+}
+
+var certEventTypes = []string{
+	eventmon.EventTypeSSHCert,
+	eventmon.EventTypeX509Cert,
+}
+
+func isSuccess(event *sinks.Event) bool {
+	return event.Outcome == "" || event.Outcome == eventmon.OutcomeSuccess
+}
+
+type rateChecker struct {
+	threshold uint
+	window    time.Duration
+	times     map[string][]time.Time // Key: username.
+}
+
+func newRateChecker(config RuleConfig) (*rateChecker, error) {
+	if config.Threshold < 1 {
+		return nil, fmt.Errorf("rule: %s: no threshold", config.Name)
+	}
+	if config.Window <= 0 {
+		config.Window = 10 * time.Minute
+	}
+	return &rateChecker{
+		threshold: config.Threshold,
+		window:    config.Window,
+		times:     make(map[string][]time.Time),
+	}, nil
+}
+
+func (c *rateChecker) check(event *sinks.Event) string {
+	minTime := event.Time.Add(-c.window)
+	times := c.times[event.Username]
+	for len(times) > 0 && !times[0].After(minTime) {
+		times = times[1:]
+	}
+	times = append(times, event.Time)
+	c.times[event.Username] = times
+	// Alert once when the threshold is exceeded, not for each event after.
+	if uint(len(times)) != c.threshold+1 {
+		return ""
+	}
+	return fmt.Sprintf("%d %s events within %s", len(times), event.Type,
+		c.window)
+}
+
+func (c *rateChecker) expire(now time.Time) {
+	minTime := now.Add(-c.window)
+	for username, times := range c.times {
+		if !times[len(times)-1].After(minTime) {
+			delete(c.times, username)
+		}
+	}
+}
+
+type multipleNetworksChecker struct {
+	networks []namedNetwork
+	window   time.Duration
+	lastSeen map[string]map[string]time.Time // Keys: username, network.
+}
+
+func newMultipleNetworksChecker(config RuleConfig) (
+	*multipleNetworksChecker, error) {
+	networks, err := loadNetworks(config.Networks, config.NetworksFile)
+	if err != nil {
+		return nil, fmt.Errorf("rule: %s: %s", config.Name, err)
+	}
+	names := make(map[string]struct{})
+	for _, network := range networks {
+		names[network.name] = struct{}{}
+	}
+	if len(names) < 2 {
+		return nil, fmt.Errorf("rule: %s: fewer than two networks",
+			config.Name)
+	}
+	if config.Window <= 0 {
+		config.Window = time.Hour
+	}
+	return &multipleNetworksChecker{
+		networks: networks,
+		window:   config.Window,
+		lastSeen: make(map[string]map[string]time.Time),
+	}, nil
+}
+
+func (c *multipleNetworksChecker) check(event *sinks.Event) string {
+	name := findNetwork(c.networks, net.ParseIP(event.SourceIP))
+	if name == "" {
+		return ""
+	}
+	lastSeen := c.lastSeen[event.Username]
+	if lastSeen == nil {
+		lastSeen = make(map[string]time.Time)
+		c.lastSeen[event.Username] = lastSeen
+	}
+	expireTimes(lastSeen, event.Time.Add(-c.window))
+	_, alreadySeen := lastSeen[name]
+	lastSeen[name] = event.Time
+	if alreadySeen || len(lastSeen) < 2 {
+		return ""
+	}
+	names := make([]string, 0, len(lastSeen))
+	for network := range lastSeen {
+		names = append(names, network)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%s events from %s within %s", event.Type,
+		strings.Join(names, ", "), c.window)
+}
+
+func (c *multipleNetworksChecker) expire(now time.Time) {
+	minTime := now.Add(-c.window)
+	for username, lastSeen := range c.lastSeen {
+		expireTimes(lastSeen, minTime)
+		if len(lastSeen) < 1 {
+			delete(c.lastSeen, username)
+		}
+	}
+}
+
+// expireTimes deletes the entries last seen at or before minTime.
+func expireTimes(lastSeen map[string]time.Time, minTime time.Time) {
+	for key, seenTime := range lastSeen {
+		if !seenTime.After(minTime) {
+			delete(lastSeen, key)
+		}
+	}
+}
+
+type newUserAgentChecker struct {
+	window time.Duration
+	// Keys: username, normalised user agent.
+	userAgents map[string]map[string]time.Time
+}
+
+func newNewUserAgentChecker(config RuleConfig) *newUserAgentChecker {
+	if config.Window <= 0 {
+		config.Window = durationMonth
+	}
+	return &newUserAgentChecker{
+		window:     config.Window,
+		userAgents: make(map[string]map[string]time.Time),
+	}
+}
+
+func (c *newUserAgentChecker) check(event *sinks.Event) string {
+	if event.UserAgent == "" || !isSuccess(event) {
+		return ""
+	}
+	userAgent := normaliseUserAgent(event.UserAgent)
+	userAgents := c.userAgents[event.Username]
+	if userAgents == nil {
+		// Nothing to compare with for the first login of a user.
+		c.userAgents[event.Username] = map[string]time.Time{
+			userAgent: event.Time,
+		}
+		return ""
+	}
+	_, alreadySeen := userAgents[userAgent]
+	userAgents[userAgent] = event.Time
+	if alreadySeen {
+		return ""
+	}
+	return "first " + event.Type + " from user agent: " + event.UserAgent
+}
+
+func (c *newUserAgentChecker) expire(now time.Time) {
+	minTime := now.Add(-c.window)
+	for username, userAgents := range c.userAgents {
+		expireTimes(userAgents, minTime)
+		if len(userAgents) < 1 {
+			delete(c.userAgents, username)
+		}
+	}
+}
+
+type certWithout2FAChecker struct {
+	window  time.Duration
+	alerted map[string]time.Time // Key: username.
+	used2FA map[string]time.Time // Key: username.
+}
+
+func newCertWithout2FAChecker(config RuleConfig) *certWithout2FAChecker {
+	if config.Window <= 0 {
+		config.Window = durationMonth
+	}
+	return &certWithout2FAChecker{
+		window:  config.Window,
+		alerted: make(map[string]time.Time),
+		used2FA: make(map[string]time.Time),
+	}
+}
+
+func (c *certWithout2FAChecker) check(event *sinks.Event) string {
+	switch event.Type {
+	case eventmon.EventTypeAuth:
+		if isSuccess(event) && event.AuthType != "" &&
+			event.AuthType != eventmon.AuthTypePassword {
+			c.used2FA[event.Username] = event.Time
+		}
+	case eventmon.EventTypeSSHCert, eventmon.EventTypeX509Cert:
+		if _, ok := c.used2FA[event.Username]; ok {
+			return ""
+		}
+		if _, ok := c.alerted[event.Username]; ok {
+			return ""
+		}
+		c.alerted[event.Username] = event.Time
+		return event.Type + " issued to a user who has not used 2FA within " +
+			c.window.String()
+	}
+	return ""
+}
+
+func (c *certWithout2FAChecker) expire(now time.Time) {
+	minTime := now.Add(-c.window)
+	expireTimes(c.alerted, minTime)
+	expireTimes(c.used2FA, minTime)
+}
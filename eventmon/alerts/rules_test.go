@@ -0,0 +1,252 @@
+package alerts
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+var testTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestEngine(t *testing.T, configs ...RuleConfig) *Engine {
+	engine, err := New(configs, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func checkAlerts(t *testing.T, alerts []*Alert, expectedRule string) {
+	if expectedRule == "" {
+		for _, alert := range alerts {
+			t.Errorf("unexpected alert: %s: %s", alert.Rule, alert.Message)
+		}
+		return
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(alerts))
+	}
+	if alerts[0].Rule != expectedRule {
+		t.Errorf("expected rule: %s, got: %s", expectedRule, alerts[0].Rule)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, configs := range [][]RuleConfig{
+		{{Type: RuleTypeRate, Threshold: 1}},
+		{{Name: "unknown", Type: "unknown"}},
+		{{Name: "rate", Type: RuleTypeRate}},
+		{{Name: "networks", Type: RuleTypeMultipleNetworks,
+			Networks: map[string][]string{"one": {"10.0.0.0/8"}}}},
+		{{Name: "users", Type: RuleTypeNewUserAgent, Users: []string{"["}}},
+		{
+			{Name: "duplicate", Type: RuleTypeNewUserAgent},
+			{Name: "duplicate", Type: RuleTypeNewUserAgent},
+		},
+	} {
+		if _, err := New(configs, testlogger.New(t)); err == nil {
+			t.Errorf("no error for: %v", configs)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	engine := newTestEngine(t, RuleConfig{
+		Name:         "cert-rate",
+		Type:         RuleTypeRate,
+		ExcludeUsers: []string{"robot-*"},
+		Threshold:    2,
+		Window:       time.Minute,
+	})
+	event := func(username string, offset time.Duration) *sinks.Event {
+		return &sinks.Event{
+			Type:     eventmon.EventTypeSSHCert,
+			Time:     testTime.Add(offset),
+			Username: username,
+		}
+	}
+	checkAlerts(t, engine.Process(event("alice", 0)), "")
+	checkAlerts(t, engine.Process(event("alice", time.Second)), "")
+	checkAlerts(t, engine.Process(event("alice", 2*time.Second)), "cert-rate")
+	// Only alert once while the threshold is exceeded.
+	checkAlerts(t, engine.Process(event("alice", 3*time.Second)), "")
+	// Events outside the window are forgotten.
+	checkAlerts(t, engine.Process(event("alice", time.Hour)), "")
+	for index := 0; index < 5; index++ {
+		checkAlerts(t, engine.Process(event("robot-1", 0)), "")
+	}
+	checkAlerts(t, engine.Process(&sinks.Event{
+		Type:     eventmon.EventTypeAuth,
+		Time:     testTime.Add(time.Hour),
+		Username: "alice",
+	}), "")
+}
+
+func TestMultipleNetworks(t *testing.T) {
+	engine := newTestEngine(t, RuleConfig{
+		Name: "networks",
+		Type: RuleTypeMultipleNetworks,
+		Networks: map[string][]string{
+			"office": {"10.0.0.0/8"},
+			"lab":    {"10.1.0.0/16"},
+			"home":   {"192.0.2.0/24"},
+		},
+	})
+	event := func(sourceIP string, offset time.Duration) *sinks.Event {
+		return &sinks.Event{
+			Type:     eventmon.EventTypeX509Cert,
+			Time:     testTime.Add(offset),
+			Username: "alice",
+			SourceIP: sourceIP,
+		}
+	}
+	checkAlerts(t, engine.Process(event("10.2.0.1", 0)), "")
+	checkAlerts(t, engine.Process(event("10.2.0.2", time.Minute)), "")
+	checkAlerts(t, engine.Process(event("198.51.100.1", time.Minute)), "")
+	alerts := engine.Process(event("10.1.0.1", 2*time.Minute))
+	checkAlerts(t, alerts, "networks")
+	if !strings.Contains(alerts[0].Message, "lab, office") {
+		t.Errorf("unexpected message: %s", alerts[0].Message)
+	}
+	checkAlerts(t, engine.Process(event("10.1.0.2", 3*time.Minute)), "")
+	checkAlerts(t, engine.Process(event("192.0.2.1", 3*time.Hour)), "")
+}
+
+func TestNewUserAgent(t *testing.T) {
+	engine := newTestEngine(t, RuleConfig{
+		Name: "user-agent",
+		Type: RuleTypeNewUserAgent,
+	})
+	event := func(userAgent, outcome string) *sinks.Event {
+		return &sinks.Event{
+			Type:      eventmon.EventTypeWebLogin,
+			Time:      testTime,
+			Outcome:   outcome,
+			Username:  "alice",
+			UserAgent: userAgent,
+		}
+	}
+	checkAlerts(t, engine.Process(event("firefox", "")), "")
+	checkAlerts(t, engine.Process(event("firefox", "")), "")
+	checkAlerts(t, engine.Process(event("curl", eventmon.OutcomeFailure)), "")
+	checkAlerts(t, engine.Process(event("curl", eventmon.OutcomeSuccess)),
+		"user-agent")
+	checkAlerts(t, engine.Process(event("curl", "")), "")
+	// A browser update is not a new user agent.
+	checkAlerts(t, engine.Process(event("Mozilla/5.0 (X11; Linux x86_64; "+
+		"rv:125.0) Gecko/20100101 Firefox/125.0", "")), "user-agent")
+	checkAlerts(t, engine.Process(event("Mozilla/5.0 (X11; Linux x86_64; "+
+		"rv:126.0) Gecko/20100101 Firefox/126.0", "")), "")
+}
+
+func TestExpire(t *testing.T) {
+	engine := newTestEngine(t,
+		RuleConfig{
+			Name:      "cert-rate",
+			Type:      RuleTypeRate,
+			Threshold: 2,
+		},
+		RuleConfig{
+			Name:   "user-agent",
+			Type:   RuleTypeNewUserAgent,
+			Window: 24 * time.Hour,
+		},
+		RuleConfig{
+			Name:   "no-2fa",
+			Type:   RuleTypeCertWithout2FA,
+			Window: 24 * time.Hour,
+		})
+	event := func(eventType, username string,
+		offset time.Duration) *sinks.Event {
+		return &sinks.Event{
+			Type:      eventType,
+			Time:      testTime.Add(offset),
+			Username:  username,
+			AuthType:  eventmon.AuthTypeTOTP,
+			UserAgent: "curl/8.5.0",
+		}
+	}
+	engine.Learn(event(eventmon.EventTypeAuth, "alice", 0))
+	engine.Learn(event(eventmon.EventTypeSSHCert, "alice", 0))
+	// Another user's events expire alice's state.
+	checkAlerts(t, engine.Process(event(eventmon.EventTypeWebLogin, "bob",
+		48*time.Hour)), "")
+	for _, rule := range engine.rules {
+		switch checker := rule.checker.(type) {
+		case *rateChecker:
+			if _, ok := checker.times["alice"]; ok {
+				t.Error("rate state not expired")
+			}
+		case *newUserAgentChecker:
+			if _, ok := checker.userAgents["alice"]; ok {
+				t.Error("user agents not expired")
+			}
+		case *certWithout2FAChecker:
+			if _, ok := checker.used2FA["alice"]; ok {
+				t.Error("2FA use not expired")
+			}
+		}
+	}
+	alice := event(eventmon.EventTypeSSHCert, "alice", 49*time.Hour)
+	alice.AuthType = ""
+	checkAlerts(t, engine.Process(alice), "no-2fa")
+}
+
+func TestCertWithout2FA(t *testing.T) {
+	engine := newTestEngine(t, RuleConfig{
+		Name: "no-2fa",
+		Type: RuleTypeCertWithout2FA,
+	})
+	event := func(eventType, username, authType string) *sinks.Event {
+		return &sinks.Event{
+			Type:     eventType,
+			Time:     testTime,
+			Username: username,
+			AuthType: authType,
+		}
+	}
+	checkAlerts(t, engine.Process(event(eventmon.EventTypeAuth, "alice",
+		eventmon.AuthTypeTOTP)), "")
+	checkAlerts(t, engine.Process(event(eventmon.EventTypeSSHCert, "alice",
+		"")), "")
+	checkAlerts(t, engine.Process(event(eventmon.EventTypeAuth, "bob",
+		eventmon.AuthTypePassword)), "")
+	checkAlerts(t, engine.Process(event(eventmon.EventTypeSSHCert, "bob",
+		"")), "no-2fa")
+	checkAlerts(t, engine.Process(event(eventmon.EventTypeX509Cert, "bob",
+		"")), "")
+}
+
+func TestLearn(t *testing.T) {
+	engine := newTestEngine(t, RuleConfig{
+		Name: "user-agent",
+		Type: RuleTypeNewUserAgent,
+	})
+	event := func(userAgent string) *sinks.Event {
+		return &sinks.Event{
+			Type:      eventmon.EventTypeAuth,
+			Time:      testTime,
+			Username:  "alice",
+			UserAgent: userAgent,
+		}
+	}
+	engine.Learn(event("firefox"))
+	engine.Learn(event("curl"))
+	checkAlerts(t, engine.Process(event("curl")), "")
+	alerts := engine.Process(event("chrome"))
+	checkAlerts(t, alerts, "user-agent")
+	sinkEvent := alerts[0].SinkEvent()
+	if sinkEvent.Type != sinks.EventTypeAlert ||
+		sinkEvent.Rule != "user-agent" || sinkEvent.Username != "alice" ||
+		sinkEvent.UserAgent != "chrome" || sinkEvent.ID == "" {
+		t.Errorf("unexpected alert event: %+v", sinkEvent)
+	}
+	if engine.counts["user-agent"] != 1 {
+		t.Errorf("expected 1 alert counted, got %d",
+			engine.counts["user-agent"])
+	}
+}
@@ -0,0 +1,61 @@
+package alerts
+
+import (
+	"strings"
+)
+
+type userAgentPattern struct {
+	token string
+	name  string
+}
+
+// Checked in order: browsers include the tokens of those they are based on.
+var browserPatterns = []userAgentPattern{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"FxiOS/", "Firefox"},
+	{"Firefox/", "Firefox"},
+	{"Safari/", "Safari"},
+}
+
+var osPatterns = []userAgentPattern{
+	{"Windows", "Windows"},
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Mac OS X", "macOS"},
+	{"CrOS", "ChromeOS"},
+	{"Linux", "Linux"},
+}
+
+func findPattern(userAgent string, patterns []userAgentPattern) string {
+	for _, pattern := range patterns {
+		if strings.Contains(userAgent, pattern.token) {
+			return pattern.name
+		}
+	}
+	return ""
+}
+
+// normaliseUserAgent returns the browser family and operating system of a
+// user agent, so that browser updates are not reported as new user agents.
+// For other clients, it returns the product name (such as "curl").
+func normaliseUserAgent(userAgent string) string {
+	browser := findPattern(userAgent, browserPatterns)
+	if browser == "" {
+		product := strings.Fields(userAgent)
+		if len(product) < 1 {
+			return ""
+		}
+		browser = strings.SplitN(product[0], "/", 2)[0]
+	}
+	if os := findPattern(userAgent, osPatterns); os != "" {
+		return browser + " on " + os
+	}
+	return browser
+}
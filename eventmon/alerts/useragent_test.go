@@ -0,0 +1,32 @@
+package alerts
+
+import (
+	"testing"
+)
+
+func TestNormaliseUserAgent(t *testing.T) {
+	for userAgent, expected := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36": "Chrome on Windows",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/125.0.0.0 Safari/537.36 " +
+			"Edg/125.0.0.0": "Edge on Windows",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:126.0) Gecko/20100101 " +
+			"Firefox/126.0": "Firefox on Linux",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) " +
+			"AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 " +
+			"Safari/605.1.15": "Safari on macOS",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) " +
+			"AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/124.0 " +
+			"Mobile/15E148 Safari/604.1": "Chrome on iOS",
+		"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/124.0 Mobile Safari/537.36": "Chrome on Android",
+		"curl/8.5.0":         "curl",
+		"Go-http-client/1.1": "Go-http-client",
+		"":                   "",
+	} {
+		if got := normaliseUserAgent(userAgent); got != expected {
+			t.Errorf("%s: expected %q, got %q", userAgent, expected, got)
+		}
+	}
+}
@@ -1,11 +1,16 @@
+/*
+Package eventrecorder stores the events received by keymaster-eventmond in a
+SQLite database, indexed by time, user, event type and service provider.
+Events older than the retention period are deleted.
+*/
 package eventrecorder
 
 import (
-	"crypto/x509"
+	"database/sql"
 	"time"
 
 	"github.com/Cloud-Foundations/golib/pkg/log"
-	"golang.org/x/crypto/ssh"
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
 )
 
 const (
@@ -21,10 +26,8 @@ const (
 	VIPAuthTypePush
 )
 
-type AuthInfo struct {
-	AuthType    uint
-	Username    string
-	VIPAuthType uint8
+type Config struct {
+	Retention time.Duration `yaml:"retention"` // Default: 31 days.
 }
 
 type Events struct {
@@ -34,11 +37,7 @@ type Events struct {
 
 type EventsMap map[string][]EventType // Key: username.
 
-type eventsListType struct {
-	newest *eventType
-	oldest *eventType
-}
-
+// EventType summarises a successful event for the activity report.
 type EventType struct {
 	AuthType           uint
 	CreateTime         uint64 // Seconds since Epoch.
@@ -50,29 +49,57 @@ type EventType struct {
 	VIPAuthType        uint8
 }
 
-type eventType struct {
-	EventType
-	newer *eventType
-	older *eventType
+type EventRecorder struct {
+	db          *sql.DB
+	logger      log.Logger
+	retention   time.Duration
+	stopChannel chan struct{}
 }
 
-type EventRecorder struct {
-	AuthChannel                 chan<- *AuthInfo
-	RequestEventsChannel        chan<- chan<- Events
-	ServiceProviderLoginChannel chan<- *SPLoginInfo
-	SshCertChannel              chan<- *ssh.Certificate
-	WebLoginChannel             chan<- string
-	X509CertChannel             chan<- *x509.Certificate
-	filename                    string
-	logger                      log.Logger
-	eventsMap                   map[string]*eventsListType // Key: username.
+// Query selects events. Zero values match everything.
+type Query struct {
+	Username           string
+	Start              time.Time // Inclusive.
+	End                time.Time // Exclusive.
+	EventTypes         []string
+	ServiceProviderUrl string
+	Limit              uint // Newest events are returned first.
+}
+
+// New opens (creating if needed) the event database in filename.
+func New(filename string, config Config, logger log.Logger) (
+	*EventRecorder, error) {
+	return newEventRecorder(filename, config, logger)
+}
+
+// Close stops expiring events and closes the database.
+func (sr *EventRecorder) Close() error {
+	return sr.close()
+}
+
+// GetEvents returns the successful events of the last month by user.
+func (sr *EventRecorder) GetEvents() (*Events, error) {
+	return sr.getEvents()
+}
+
+// ImportLegacyEvents imports the events from an events.gob file written by
+// previous versions and renames it, adding a .imported suffix. A missing file
+// is ignored.
+func (sr *EventRecorder) ImportLegacyEvents(filename string) error {
+	return sr.importLegacyEvents(filename)
+}
+
+// Query returns the events matching query, newest first.
+func (sr *EventRecorder) Query(query Query) ([]*sinks.Event, error) {
+	return sr.query(query)
 }
 
-type SPLoginInfo struct {
-	URL      string
-	Username string
+// Retention returns how long events are kept.
+func (sr *EventRecorder) Retention() time.Duration {
+	return sr.retention
 }
 
-func New(filename string, logger log.Logger) (*EventRecorder, error) {
-	return newEventRecorder(filename, logger)
+// Record stores an event.
+func (sr *EventRecorder) Record(event *sinks.Event) error {
+	return sr.record(event)
 }
@@ -1,256 +1,291 @@
 package eventrecorder
 
 import (
-	"bufio"
-	"crypto/x509"
-	"encoding/gob"
-	"os"
-	"syscall"
+	"database/sql"
+	"encoding/json"
+	"strings"
 	"time"
 
-	"github.com/Cloud-Foundations/Dominator/lib/fsutil"
 	"github.com/Cloud-Foundations/golib/pkg/log"
-	"golang.org/x/crypto/ssh"
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
-	bufferLength = 16
-	filePerms    = syscall.S_IRUSR | syscall.S_IWUSR | syscall.S_IRGRP |
-		syscall.S_IROTH
 	durationMonth = time.Hour * 24 * 31
+
+	eventColumns = "event_id, stream_id, sequence, time, type, outcome, " +
+		"failure_reason, server_hostname, source_ip, user_agent, username, " +
+		"requesting_username, auth_type, vip_auth_type, token_name, " +
+		"service_provider_url, client_id, missed_events, certificate"
 )
 
-func newEventRecorder(filename string, logger log.Logger) (
+var initializationStatements = []string{
+	`CREATE TABLE IF NOT EXISTS events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		stream_id TEXT NOT NULL,
+		sequence INTEGER NOT NULL,
+		time INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		failure_reason TEXT NOT NULL,
+		server_hostname TEXT NOT NULL,
+		source_ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		username TEXT NOT NULL,
+		requesting_username TEXT NOT NULL,
+		auth_type TEXT NOT NULL,
+		vip_auth_type TEXT NOT NULL,
+		token_name TEXT NOT NULL,
+		service_provider_url TEXT NOT NULL,
+		client_id TEXT NOT NULL,
+		missed_events INTEGER NOT NULL,
+		certificate TEXT NOT NULL)`,
+	"CREATE INDEX IF NOT EXISTS events_time ON events (time)",
+	"CREATE INDEX IF NOT EXISTS events_username ON events (username, time)",
+	"CREATE INDEX IF NOT EXISTS events_type ON events (type, time)",
+	`CREATE INDEX IF NOT EXISTS events_service_provider_url
+		ON events (service_provider_url, time)`,
+}
+
+// Event types summarised in the activity report.
+var activityEventTypes = []string{
+	eventmon.EventTypeAuth,
+	eventmon.EventTypeServiceProviderLogin,
+	eventmon.EventTypeSSHCert,
+	eventmon.EventTypeWebLogin,
+	eventmon.EventTypeX509Cert,
+}
+
+var authTypes = map[string]uint{
+	eventmon.AuthTypePassword:    AuthTypePassword,
+	eventmon.AuthTypeSymantecVIP: AuthTypeSymantecVIP,
+	eventmon.AuthTypeTOTP:        AuthTypeTOTP,
+	eventmon.AuthTypeU2F:         AuthTypeU2F,
+	eventmon.AuthTypeWebAuthn:    AuthTypeU2F,
+}
+
+func newEventRecorder(filename string, config Config, logger log.Logger) (
 	*EventRecorder, error) {
-	eventsMap, err := loadEvents(filename)
-	if err != nil && !os.IsNotExist(err) {
+	db, err := sql.Open("sqlite3", filename+"?_busy_timeout=5000")
+	if err != nil {
 		return nil, err
 	}
-	authChannel := make(chan *AuthInfo, bufferLength)
-	requestEventsChannel := make(chan chan<- Events, bufferLength)
-	serviceProviderLoginChannel := make(chan *SPLoginInfo, bufferLength)
-	sshCertChannel := make(chan *ssh.Certificate, bufferLength)
-	webLoginChannel := make(chan string, bufferLength)
-	x509CertChannel := make(chan *x509.Certificate, bufferLength)
+	// Serialise access, so that writes never fail with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	for _, statement := range initializationStatements {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if config.Retention <= 0 {
+		config.Retention = durationMonth
+	}
 	sr := &EventRecorder{
-		filename:                    filename,
-		logger:                      logger,
-		eventsMap:                   eventsMap,
-		AuthChannel:                 authChannel,
-		RequestEventsChannel:        requestEventsChannel,
-		ServiceProviderLoginChannel: serviceProviderLoginChannel,
-		SshCertChannel:              sshCertChannel,
-		WebLoginChannel:             webLoginChannel,
-		X509CertChannel:             x509CertChannel,
+		db:          db,
+		logger:      logger,
+		retention:   config.Retention,
+		stopChannel: make(chan struct{}),
 	}
-	go sr.eventLoop(authChannel, requestEventsChannel,
-		serviceProviderLoginChannel, sshCertChannel, webLoginChannel,
-		x509CertChannel)
+	go sr.expireLoop()
 	return sr, nil
 }
 
-func loadEvents(filename string) (map[string]*eventsListType, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return make(map[string]*eventsListType), err
-	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
-	decoder := gob.NewDecoder(reader)
-	var events EventsMap
-	if err := decoder.Decode(&events); err != nil {
-		return nil, err
-	}
-	eventsMap := make(map[string]*eventsListType, len(events))
-	minCreateTime := uint64(time.Now().Add(-durationMonth).Unix())
-	for username, eventsSlice := range events {
-		eventsList := &eventsListType{}
-		for _, savedEvent := range eventsSlice {
-			if savedEvent.CreateTime < minCreateTime {
-				continue
-			}
-			event := &eventType{
-				EventType: savedEvent,
-				older:     eventsList.newest,
-			}
-			if eventsList.newest != nil {
-				eventsList.newest.newer = event
-			}
-			eventsList.newest = event
-			if eventsList.oldest == nil {
-				eventsList.oldest = event
-			}
-		}
-		eventsMap[username] = eventsList
-	}
-	return eventsMap, nil
+func (sr *EventRecorder) close() error {
+	close(sr.stopChannel)
+	return sr.db.Close()
 }
 
-func (sr *EventRecorder) eventLoop(authChannel <-chan *AuthInfo,
-	requestEventsChannel <-chan chan<- Events,
-	serviceProviderLoginChannel <-chan *SPLoginInfo,
-	sshCertChannel <-chan *ssh.Certificate, webLoginChannel <-chan string,
-	x509CertChannel <-chan *x509.Certificate) {
-	var lastEvents *Events
-	sr.getEventsList(&lastEvents)
-	hourlyTimer := time.NewTimer(time.Hour)
-	saveTimer := time.NewTimer(time.Hour)
-	saveTimer.Stop()
+func (sr *EventRecorder) expireLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
 	for {
+		numDeleted, err := sr.expireOldEvents(time.Now().Add(-sr.retention))
+		if err != nil {
+			sr.logger.Println(err)
+		} else if numDeleted > 0 {
+			sr.logger.Printf("Deleted %d events older than %s\n", numDeleted,
+				sr.retention)
+		}
 		select {
-		case auth := <-authChannel:
-			saveTimer.Reset(time.Second * 5)
-			lastEvents = nil
-			sr.recordAuthEvent(auth.Username, auth.AuthType, auth.VIPAuthType)
-		case spLogin := <-serviceProviderLoginChannel:
-			saveTimer.Reset(time.Second * 5)
-			lastEvents = nil
-			sr.recordSPLoginEvent(spLogin.Username, spLogin.URL)
-		case cert := <-sshCertChannel:
-			saveTimer.Reset(time.Second * 5)
-			lastEvents = nil
-			sr.recordCertEvent(cert.ValidPrincipals[0],
-				time.Until(time.Unix(int64(cert.ValidBefore), 0)),
-				true, false)
-		case username := <-webLoginChannel:
-			saveTimer.Reset(time.Second * 5)
-			lastEvents = nil
-			sr.recordWebLoginEvent(username)
-		case cert := <-x509CertChannel:
-			saveTimer.Reset(time.Second * 5)
-			lastEvents = nil
-			sr.recordCertEvent(cert.Subject.CommonName,
-				time.Until(cert.NotAfter), false, true)
-		case <-hourlyTimer.C:
-			hourlyTimer.Reset(time.Hour)
-			if sr.expireOldEvents() {
-				saveTimer.Reset(time.Second * 5)
-				lastEvents = nil
-			}
-		case replyChannel := <-requestEventsChannel:
-			select { // Non-blocking.
-			case replyChannel <- *sr.getEventsList(&lastEvents):
-			default:
-			}
-		case <-saveTimer.C:
-			sr.getEventsList(&lastEvents)
-			if err := saveEvents(sr.filename, lastEvents.Events); err != nil {
-				sr.logger.Println(err)
-			}
+		case <-sr.stopChannel:
+			return
+		case <-ticker.C:
 		}
 	}
 }
 
-func (sr *EventRecorder) recordAuthEvent(username string, authType uint,
-	vipAuthType uint8) {
-	event := &eventType{EventType: EventType{
-		AuthType:    authType,
-		VIPAuthType: vipAuthType},
+func (sr *EventRecorder) expireOldEvents(minTime time.Time) (int64, error) {
+	result, err := sr.db.Exec("DELETE FROM events WHERE time < ?",
+		minTime.UnixNano())
+	if err != nil {
+		return 0, err
 	}
-	sr.recordEvent(username, event)
+	return result.RowsAffected()
 }
 
-func (sr *EventRecorder) recordCertEvent(username string,
-	lifetime time.Duration, ssh, x509 bool) {
-	lifetimeSeconds := uint32(lifetime.Seconds() + 0.5)
-	if lifetimeSeconds >= 3600 {
-		hours := lifetimeSeconds / 3600
-		hoursPlus := (lifetimeSeconds + 60) / 3600
-		if hoursPlus > hours {
-			lifetimeSeconds = hoursPlus * 3600
-		}
-	} else if lifetimeSeconds >= 60 {
-		minutes := lifetimeSeconds / 60
-		minutesPlus := (lifetimeSeconds + 1) / 60
-		if minutesPlus > minutes {
-			lifetimeSeconds = minutesPlus * 60
+func (sr *EventRecorder) record(event *sinks.Event) error {
+	return insertEvent(sr.db, event)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertEvent(db execer, event *sinks.Event) error {
+	var certificate []byte
+	if event.Certificate != nil {
+		var err error
+		certificate, err = json.Marshal(event.Certificate)
+		if err != nil {
+			return err
 		}
 	}
-	event := &eventType{
-		EventType: EventType{
-			LifetimeSeconds: lifetimeSeconds,
-			Ssh:             ssh,
-			X509:            x509,
-		},
-	}
-	sr.recordEvent(username, event)
+	_, err := db.Exec(
+		"INSERT INTO events ("+eventColumns+") VALUES "+
+			"(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		event.ID, event.StreamID, event.Sequence, event.Time.UnixNano(),
+		event.Type, event.Outcome, event.FailureReason, event.ServerHostname,
+		event.SourceIP, event.UserAgent, event.Username,
+		event.RequestingUsername, event.AuthType, event.VIPAuthType,
+		event.TokenName, event.ServiceProviderUrl, event.ClientID,
+		event.MissedEvents, string(certificate))
+	return err
 }
 
-func (sr *EventRecorder) recordEvent(username string, event *eventType) {
-	eventsList := sr.eventsMap[username]
-	if eventsList == nil {
-		eventsList = &eventsListType{}
-		sr.eventsMap[username] = eventsList
+func (sr *EventRecorder) query(query Query) ([]*sinks.Event, error) {
+	var conditions []string
+	var args []interface{}
+	if query.Username != "" {
+		conditions = append(conditions, "username = ?")
+		args = append(args, query.Username)
 	}
-	event.CreateTime = uint64(time.Now().Unix())
-	event.older = eventsList.newest
-	if eventsList.newest != nil {
-		eventsList.newest.newer = event
+	if !query.Start.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, query.Start.UnixNano())
 	}
-	eventsList.newest = event
-	if eventsList.oldest == nil {
-		eventsList.oldest = event
+	if !query.End.IsZero() {
+		conditions = append(conditions, "time < ?")
+		args = append(args, query.End.UnixNano())
 	}
+	if len(query.EventTypes) > 0 {
+		conditions = append(conditions, "type IN (?"+
+			strings.Repeat(", ?", len(query.EventTypes)-1)+")")
+		for _, eventType := range query.EventTypes {
+			args = append(args, eventType)
+		}
+	}
+	if query.ServiceProviderUrl != "" {
+		conditions = append(conditions, "service_provider_url = ?")
+		args = append(args, query.ServiceProviderUrl)
+	}
+	statement := "SELECT " + eventColumns + " FROM events"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY time DESC, id DESC"
+	if query.Limit > 0 {
+		statement += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+	rows, err := sr.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []*sinks.Event
+	for rows.Next() {
+		var event sinks.Event
+		var eventTime int64
+		var certificate string
+		err := rows.Scan(&event.ID, &event.StreamID, &event.Sequence,
+			&eventTime, &event.Type, &event.Outcome, &event.FailureReason,
+			&event.ServerHostname, &event.SourceIP, &event.UserAgent,
+			&event.Username, &event.RequestingUsername, &event.AuthType,
+			&event.VIPAuthType, &event.TokenName, &event.ServiceProviderUrl,
+			&event.ClientID, &event.MissedEvents, &certificate)
+		if err != nil {
+			return nil, err
+		}
+		event.Time = time.Unix(0, eventTime)
+		if certificate != "" {
+			event.Certificate = &sinks.Certificate{}
+			err := json.Unmarshal([]byte(certificate), event.Certificate)
+			if err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, &event)
+	}
+	return events, rows.Err()
 }
 
-func (sr *EventRecorder) recordSPLoginEvent(username, url string) {
-	event := &eventType{EventType: EventType{ServiceProviderUrl: url}}
-	sr.recordEvent(username, event)
-}
-
-func (sr *EventRecorder) recordWebLoginEvent(username string) {
-	event := &eventType{EventType: EventType{WebLogin: true}}
-	sr.recordEvent(username, event)
-}
-
-func (sr *EventRecorder) getEventsList(lastEvents **Events) *Events {
-	if *lastEvents != nil {
-		return *lastEvents
-	}
+func (sr *EventRecorder) getEvents() (*Events, error) {
 	startTime := time.Now()
-	eventsMap := make(map[string][]EventType, len(sr.eventsMap))
-	for username, eventsList := range sr.eventsMap {
-		events := make([]EventType, 0)
-		for event := eventsList.newest; event != nil; event = event.older {
-			events = append(events, event.EventType)
+	events, err := sr.query(Query{
+		Start:      startTime.Add(-durationMonth),
+		EventTypes: activityEventTypes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	eventsMap := make(EventsMap)
+	for _, event := range events {
+		if event.Outcome != "" && event.Outcome != eventmon.OutcomeSuccess {
+			continue
 		}
-		eventsMap[username] = events
+		eventsMap[event.Username] = append(eventsMap[event.Username],
+			summariseEvent(event))
 	}
-	*lastEvents = &Events{time.Since(startTime), eventsMap}
-	return *lastEvents
+	return &Events{time.Since(startTime), eventsMap}, nil
 }
 
-func saveEvents(filename string, eventsMap EventsMap) error {
-	file, err := fsutil.CreateRenamingWriter(filename, filePerms)
-	if err != nil {
-		return err
+func summariseEvent(event *sinks.Event) EventType {
+	summary := EventType{CreateTime: uint64(event.Time.Unix())}
+	switch event.Type {
+	case eventmon.EventTypeAuth:
+		summary.AuthType = authTypes[event.AuthType]
+		if event.VIPAuthType == eventmon.VIPAuthTypePush {
+			summary.VIPAuthType = VIPAuthTypePush
+		}
+	case eventmon.EventTypeServiceProviderLogin:
+		summary.ServiceProviderUrl = event.ServiceProviderUrl
+	case eventmon.EventTypeSSHCert:
+		summary.Ssh = true
+	case eventmon.EventTypeWebLogin:
+		summary.WebLogin = true
+	case eventmon.EventTypeX509Cert:
+		summary.X509 = true
 	}
-	defer file.Close()
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
-	encoder := gob.NewEncoder(writer)
-	if err := encoder.Encode(eventsMap); err != nil {
-		return err
+	if event.Certificate != nil {
+		summary.LifetimeSeconds = roundLifetime(
+			event.Certificate.NotAfter.Sub(event.Time))
 	}
-	return nil
+	return summary
 }
 
-func (sr *EventRecorder) expireOldEvents() bool {
-	minCreateTime := uint64(time.Now().Add(-durationMonth).Unix())
-	changed := false
-	for _, eventsList := range sr.eventsMap {
-		for event := eventsList.oldest; event != nil; event = event.newer {
-			if event.CreateTime >= minCreateTime {
-				break
-			}
-			eventsList.oldest = event.newer
-			if event.newer == nil {
-				eventsList.newest = nil
-			} else {
-				event.newer.older = nil
-			}
-			changed = true
+// roundLifetime returns the lifetime in seconds, rounded up to the hour or
+// minute if it is within a minute or a second of it.
+func roundLifetime(lifetime time.Duration) uint32 {
+	if lifetime < 0 {
+		return 0
+	}
+	lifetimeSeconds := uint32(lifetime.Seconds() + 0.5)
+	if lifetimeSeconds >= 3600 {
+		hours := lifetimeSeconds / 3600
+		hoursPlus := (lifetimeSeconds + 60) / 3600
+		if hoursPlus > hours {
+			lifetimeSeconds = hoursPlus * 3600
+		}
+	} else if lifetimeSeconds >= 60 {
+		minutes := lifetimeSeconds / 60
+		minutesPlus := (lifetimeSeconds + 1) / 60
+		if minutesPlus > minutes {
+			lifetimeSeconds = minutesPlus * 60
 		}
 	}
-	return changed
+	return lifetimeSeconds
 }
@@ -0,0 +1,198 @@
+package eventrecorder
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+func newTestRecorder(t *testing.T) *EventRecorder {
+	recorder, err := New(filepath.Join(t.TempDir(), "events.sqlite3"),
+		Config{}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { recorder.Close() })
+	return recorder
+}
+
+func recordEvents(t *testing.T, recorder *EventRecorder,
+	events ...*sinks.Event) {
+	for _, event := range events {
+		if err := recorder.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkUsernames(t *testing.T, events []*sinks.Event,
+	expected ...string) {
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for index, event := range events {
+		if event.Username != expected[index] {
+			t.Errorf("event %d: expected %s, got %s", index, expected[index],
+				event.Username)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	recorder := newTestRecorder(t)
+	now := time.Now()
+	recordEvents(t, recorder,
+		&sinks.Event{
+			ID:       "1",
+			Type:     eventmon.EventTypeAuth,
+			Time:     now.Add(-3 * time.Hour),
+			Outcome:  eventmon.OutcomeSuccess,
+			Username: "alice",
+			AuthType: eventmon.AuthTypeTOTP,
+			SourceIP: "192.0.2.1",
+		},
+		&sinks.Event{
+			Type:          eventmon.EventTypeAuthFailure,
+			Time:          now.Add(-2 * time.Hour),
+			Outcome:       eventmon.OutcomeFailure,
+			FailureReason: "invalid TOTP",
+			Username:      "bob",
+		},
+		&sinks.Event{
+			Type:               eventmon.EventTypeServiceProviderLogin,
+			Time:               now.Add(-time.Hour),
+			Username:           "alice",
+			ServiceProviderUrl: "https://sp.example.com/",
+		},
+		&sinks.Event{
+			Type:     eventmon.EventTypeSSHCert,
+			Time:     now,
+			Username: "bob",
+			Certificate: &sinks.Certificate{
+				Serial:     "42",
+				Principals: []string{"bob"},
+				NotBefore:  now,
+				NotAfter:   now.Add(16 * time.Hour),
+			},
+		})
+	events, err := recorder.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUsernames(t, events, "bob", "alice", "bob", "alice")
+	if events[3].ID != "1" || events[3].SourceIP != "192.0.2.1" ||
+		!events[3].Time.Equal(now.Add(-3*time.Hour)) {
+		t.Errorf("event not stored: %+v", events[3])
+	}
+	if cert := events[0].Certificate; cert == nil || cert.Serial != "42" ||
+		!cert.NotAfter.Equal(now.Add(16*time.Hour)) {
+		t.Errorf("certificate not stored: %+v", cert)
+	}
+	events, err = recorder.Query(Query{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUsernames(t, events, "alice", "alice")
+	events, err = recorder.Query(Query{
+		Start: now.Add(-150 * time.Minute),
+		End:   now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUsernames(t, events, "alice", "bob")
+	events, err = recorder.Query(Query{
+		EventTypes: []string{
+			eventmon.EventTypeAuth,
+			eventmon.EventTypeAuthFailure,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUsernames(t, events, "bob", "alice")
+	events, err = recorder.Query(Query{
+		ServiceProviderUrl: "https://sp.example.com/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUsernames(t, events, "alice")
+	events, err = recorder.Query(Query{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUsernames(t, events, "bob")
+}
+
+func TestExpireOldEvents(t *testing.T) {
+	recorder := newTestRecorder(t)
+	now := time.Now()
+	recordEvents(t, recorder,
+		&sinks.Event{Type: eventmon.EventTypeWebLogin, Username: "alice",
+			Time: now.Add(-2 * durationMonth)},
+		&sinks.Event{Type: eventmon.EventTypeWebLogin, Username: "bob",
+			Time: now})
+	// The expiry goroutine may have deleted the event already.
+	if _, err := recorder.expireOldEvents(now.Add(-durationMonth)); err != nil {
+		t.Fatal(err)
+	}
+	events, err := recorder.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUsernames(t, events, "bob")
+}
+
+func TestGetEvents(t *testing.T) {
+	recorder := newTestRecorder(t)
+	now := time.Now()
+	recordEvents(t, recorder,
+		&sinks.Event{
+			Type:        eventmon.EventTypeAuth,
+			Time:        now,
+			Outcome:     eventmon.OutcomeSuccess,
+			Username:    "alice",
+			AuthType:    eventmon.AuthTypeSymantecVIP,
+			VIPAuthType: eventmon.VIPAuthTypePush,
+		},
+		&sinks.Event{
+			Type:     eventmon.EventTypeAuthFailure,
+			Time:     now,
+			Outcome:  eventmon.OutcomeFailure,
+			Username: "alice",
+			AuthType: eventmon.AuthTypeTOTP,
+		},
+		&sinks.Event{
+			Type:     eventmon.EventTypeX509Cert,
+			Time:     now,
+			Username: "alice",
+			Certificate: &sinks.Certificate{
+				NotBefore: now,
+				NotAfter:  now.Add(16*time.Hour - 30*time.Second),
+			},
+		})
+	events, err := recorder.GetEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents := events.Events["alice"]
+	if len(aliceEvents) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(aliceEvents))
+	}
+	for _, event := range aliceEvents {
+		if event.X509 {
+			if event.LifetimeSeconds != 16*3600 {
+				t.Errorf("expected 16h lifetime, got %ds",
+					event.LifetimeSeconds)
+			}
+		} else if event.AuthType != AuthTypeSymantecVIP ||
+			event.VIPAuthType != VIPAuthTypePush {
+			t.Errorf("bad auth event: %+v", event)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package eventrecorder
+
+import (
+	"bufio"
+	"encoding/gob"
+	"os"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+var legacyAuthTypes = map[uint]string{
+	AuthTypePassword:    eventmon.AuthTypePassword,
+	AuthTypeSymantecVIP: eventmon.AuthTypeSymantecVIP,
+	AuthTypeTOTP:        eventmon.AuthTypeTOTP,
+	AuthTypeU2F:         eventmon.AuthTypeU2F,
+}
+
+func (sr *EventRecorder) importLegacyEvents(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	var eventsMap EventsMap
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&eventsMap); err != nil {
+		return err
+	}
+	tx, err := sr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	numEvents := 0
+	for username, events := range eventsMap {
+		for _, event := range events {
+			if err := insertEvent(tx, legacyEvent(username, event)); err != nil {
+				return err
+			}
+			numEvents++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	sr.logger.Printf("Imported %d events from %s\n", numEvents, filename)
+	return os.Rename(filename, filename+".imported")
+}
+
+func legacyEvent(username string, event EventType) *sinks.Event {
+	newEvent := &sinks.Event{
+		Time:     time.Unix(int64(event.CreateTime), 0),
+		Outcome:  eventmon.OutcomeSuccess,
+		Username: username,
+	}
+	switch {
+	case event.Ssh || event.X509:
+		newEvent.Type = eventmon.EventTypeX509Cert
+		if event.Ssh {
+			newEvent.Type = eventmon.EventTypeSSHCert
+		}
+		newEvent.Certificate = &sinks.Certificate{
+			Principals: []string{username},
+			NotBefore:  newEvent.Time,
+			NotAfter: newEvent.Time.Add(
+				time.Duration(event.LifetimeSeconds) * time.Second),
+		}
+	case event.WebLogin:
+		newEvent.Type = eventmon.EventTypeWebLogin
+	case event.ServiceProviderUrl != "":
+		newEvent.Type = eventmon.EventTypeServiceProviderLogin
+		newEvent.ServiceProviderUrl = event.ServiceProviderUrl
+	default:
+		newEvent.Type = eventmon.EventTypeAuth
+		newEvent.AuthType = legacyAuthTypes[event.AuthType]
+		if event.AuthType == AuthTypeSymantecVIP {
+			newEvent.VIPAuthType = eventmon.VIPAuthTypeOTP
+			if event.VIPAuthType == VIPAuthTypePush {
+				newEvent.VIPAuthType = eventmon.VIPAuthTypePush
+			}
+		}
+	}
+	return newEvent
+}
@@ -0,0 +1,74 @@
+package eventrecorder
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+func TestImportLegacyEvents(t *testing.T) {
+	recorder := newTestRecorder(t)
+	filename := filepath.Join(t.TempDir(), "events.gob")
+	createTime := uint64(time.Now().Unix())
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(file).Encode(EventsMap{
+		"alice": {
+			{AuthType: AuthTypeU2F, CreateTime: createTime},
+			{CreateTime: createTime, LifetimeSeconds: 3600, Ssh: true},
+		},
+		"bob": {
+			{CreateTime: createTime, ServiceProviderUrl: "https://sp/"},
+		},
+	})
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.ImportLegacyEvents(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".imported"); err != nil {
+		t.Error(err)
+	}
+	events, err := recorder.Query(Query{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	for _, event := range events {
+		switch event.Type {
+		case eventmon.EventTypeAuth:
+			if event.AuthType != eventmon.AuthTypeU2F {
+				t.Errorf("expected U2F, got %s", event.AuthType)
+			}
+		case eventmon.EventTypeSSHCert:
+			if event.Certificate == nil ||
+				event.Certificate.NotAfter.Sub(event.Time) != time.Hour {
+				t.Errorf("bad certificate: %+v", event.Certificate)
+			}
+		default:
+			t.Errorf("unexpected event type: %s", event.Type)
+		}
+	}
+	activity, err := recorder.GetEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobEvents := activity.Events["bob"]
+	if len(bobEvents) != 1 || bobEvents[0].ServiceProviderUrl != "https://sp/" {
+		t.Errorf("bad events for bob: %+v", bobEvents)
+	}
+	// The renamed file is not imported again.
+	if err := recorder.ImportLegacyEvents(filename); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/Cloud-Foundations/keymaster/eventmon/eventrecorder"
 	"github.com/Cloud-Foundations/keymaster/eventmon/monitord"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type HtmlWriter interface {
@@ -29,7 +30,9 @@ func StartServer(portNum uint, eventRecorder *eventrecorder.EventRecorder,
 	}
 	myState := state{eventRecorder, monitor}
 	http.HandleFunc("/", myState.statusHandler)
+	http.HandleFunc("/exportEvents", myState.exportEventsHandler)
 	http.HandleFunc("/showActivity", myState.showActivityHandler)
+	http.Handle("/prometheus_metrics", promhttp.Handler())
 	if daemon {
 		go http.Serve(listener, nil)
 	} else {
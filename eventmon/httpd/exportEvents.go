@@ -0,0 +1,155 @@
+package httpd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/eventmon/eventrecorder"
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+)
+
+const (
+	defaultExportLimit = 1000
+	maxExportLimit     = 100000
+)
+
+var csvHeader = []string{
+	"time",
+	"id",
+	"type",
+	"outcome",
+	"failure_reason",
+	"username",
+	"requesting_username",
+	"auth_type",
+	"vip_auth_type",
+	"token_name",
+	"service_provider_url",
+	"client_id",
+	"source_ip",
+	"user_agent",
+	"server_hostname",
+	"certificate_serial",
+	"certificate_not_after",
+}
+
+// parseQuery returns the event query for the parameters: user,
+// service_provider, start and end (RFC 3339), type (repeated or comma
+// separated) and limit (default 1000, at most 100000).
+func parseQuery(values url.Values) (eventrecorder.Query, error) {
+	query := eventrecorder.Query{
+		Username:           values.Get("user"),
+		ServiceProviderUrl: values.Get("service_provider"),
+		Limit:              defaultExportLimit,
+	}
+	var err error
+	if value := values.Get("start"); value != "" {
+		if query.Start, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("bad start: %s", err)
+		}
+	}
+	if value := values.Get("end"); value != "" {
+		if query.End, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("bad end: %s", err)
+		}
+	}
+	for _, value := range values["type"] {
+		for _, eventType := range strings.Split(value, ",") {
+			if eventType != "" {
+				query.EventTypes = append(query.EventTypes, eventType)
+			}
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return query, fmt.Errorf("bad limit: %s", err)
+		}
+		if limit < 1 || limit > maxExportLimit {
+			return query, fmt.Errorf("limit must be from 1 to %d",
+				maxExportLimit)
+		}
+		query.Limit = uint(limit)
+	}
+	return query, nil
+}
+
+func writeCSV(writer io.Writer, events []*sinks.Event) error {
+	csvWriter := csv.NewWriter(writer)
+	if err := csvWriter.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, event := range events {
+		var serial, notAfter string
+		if event.Certificate != nil {
+			serial = event.Certificate.Serial
+			notAfter = event.Certificate.NotAfter.UTC().Format(time.RFC3339)
+		}
+		err := csvWriter.Write([]string{
+			event.Time.UTC().Format(time.RFC3339Nano),
+			event.ID,
+			event.Type,
+			event.Outcome,
+			event.FailureReason,
+			event.Username,
+			event.RequestingUsername,
+			event.AuthType,
+			event.VIPAuthType,
+			event.TokenName,
+			event.ServiceProviderUrl,
+			event.ClientID,
+			event.SourceIP,
+			event.UserAgent,
+			event.ServerHostname,
+			serial,
+			notAfter,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func (s state) exportEventsHandler(w http.ResponseWriter, req *http.Request) {
+	query, err := parseQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+	events, err := s.eventRecorder.Query(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=events."+format)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		writeCSV(w, events)
+	} else {
+		if events == nil {
+			events = []*sinks.Event{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		encoder.Encode(events)
+	}
+}
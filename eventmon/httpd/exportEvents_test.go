@@ -0,0 +1,87 @@
+package httpd
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/eventmon/sinks"
+)
+
+func TestParseQuery(t *testing.T) {
+	values, err := url.ParseQuery("user=alice&start=2024-05-01T00:00:00Z" +
+		"&type=Auth,AuthFailure&type=SSHCert&limit=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := parseQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Username != "alice" || query.Limit != 10 ||
+		!query.Start.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) ||
+		!query.End.IsZero() {
+		t.Errorf("bad query: %+v", query)
+	}
+	if len(query.EventTypes) != 3 || query.EventTypes[2] != "SSHCert" {
+		t.Errorf("bad event types: %v", query.EventTypes)
+	}
+	query, err = parseQuery(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Limit != defaultExportLimit {
+		t.Errorf("expected default limit, got %d", query.Limit)
+	}
+	for _, rawQuery := range []string{
+		"start=yesterday",
+		"limit=-1",
+		"limit=0",
+		"limit=100001",
+	} {
+		values, _ := url.ParseQuery(rawQuery)
+		if _, err := parseQuery(values); err == nil {
+			t.Errorf("%s did not fail", rawQuery)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	eventTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	buffer := &bytes.Buffer{}
+	err := writeCSV(buffer, []*sinks.Event{
+		{
+			ID:            "0123",
+			Type:          "AuthFailure",
+			Time:          eventTime,
+			Outcome:       "Failure",
+			FailureReason: "invalid TOTP, try again",
+			Username:      "alice",
+			AuthType:      "TOTP",
+		},
+		{
+			Type:     "SSHCert",
+			Time:     eventTime,
+			Username: "bob",
+			Certificate: &sinks.Certificate{
+				Serial:   "42",
+				NotAfter: eventTime.Add(time.Hour),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "time,id,type,outcome,failure_reason,username," +
+		"requesting_username,auth_type,vip_auth_type,token_name," +
+		"service_provider_url,client_id,source_ip,user_agent," +
+		"server_hostname,certificate_serial,certificate_not_after\n" +
+		"2024-05-01T12:00:00Z,0123,AuthFailure,Failure," +
+		"\"invalid TOTP, try again\",alice,,TOTP,,,,,,,,,\n" +
+		"2024-05-01T12:00:00Z,,SSHCert,,,bob,,,,,,,,,,42," +
+		"2024-05-01T13:00:00Z\n"
+	if buffer.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buffer.String())
+	}
+}
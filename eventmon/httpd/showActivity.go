@@ -45,9 +45,12 @@ func (s state) showActivityHandler(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintln(writer, "<center>")
 	fmt.Fprintln(writer, "<h1>keymaster-eventmond activity report</h1>")
 	fmt.Fprintln(writer, "</center>")
-	eventsChannel := make(chan eventrecorder.Events, 1)
-	s.eventRecorder.RequestEventsChannel <- eventsChannel
-	eventsMap := <-eventsChannel
+	eventsMap, err := s.eventRecorder.GetEvents()
+	if err != nil {
+		fmt.Fprintf(writer, "Error getting events: %s\n", err)
+		fmt.Fprintln(writer, "</body>")
+		return
+	}
 	startTime := time.Now()
 	usernames := make([]string, 0, len(eventsMap.Events))
 	for username := range eventsMap.Events {
@@ -40,4 +40,7 @@ func (s state) statusHandler(w http.ResponseWriter, req *http.Request) {
 
 func (s state) writeDashboard(writer io.Writer) {
 	fmt.Fprintln(writer, `<a href="showActivity">Show activity</a><br>`)
+	fmt.Fprintln(writer,
+		`Export events: <a href="exportEvents?format=json">JSON</a> `+
+			`<a href="exportEvents?format=csv">CSV</a><br>`)
 }
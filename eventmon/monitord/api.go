@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -26,6 +27,7 @@ type Monitor struct {
 	closers                 map[string]chan<- struct{} // [addr]close notifier.
 	// Transmit side channels (private).
 	authChannel                 chan<- AuthInfo
+	eventChannel                chan<- eventmon.EventV1
 	serviceProviderLoginChannel chan<- SPLoginInfo
 	sshRawCertChannel           chan<- []byte
 	sshCertChannel              chan<- *ssh.Certificate
@@ -34,6 +36,7 @@ type Monitor struct {
 	x509CertChannel             chan<- *x509.Certificate
 	// Receive side channels (public).
 	AuthChannel                 <-chan AuthInfo
+	EventChannel                <-chan eventmon.EventV1 // All events, must be read.
 	ServiceProviderLoginChannel <-chan SPLoginInfo
 	SshRawCertChannel           <-chan []byte
 	SshCertChannel              <-chan *ssh.Certificate
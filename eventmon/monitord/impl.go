@@ -10,6 +10,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,16 +23,24 @@ import (
 )
 
 const (
-	bufferLength = 16
+	bufferLength      = 16
+	eventBufferLength = 1024
 )
 
 var (
 	ErrorKeymasterDaemonNotReady = errors.New("keymasterd not ready")
 )
 
+// resumePoint is the last event received from a keymasterd.
+type resumePoint struct {
+	streamID string
+	sequence uint64
+}
+
 func newMonitor(keymasterServerHostname string, keymasterServerPortNum uint,
 	logger log.Logger) (*Monitor, error) {
 	authChannel := make(chan AuthInfo, bufferLength)
+	eventChannel := make(chan eventmon.EventV1, eventBufferLength)
 	serviceProviderLoginChannel := make(chan SPLoginInfo, bufferLength)
 	sshRawCertChannel := make(chan []byte, bufferLength)
 	sshCertChannel := make(chan *ssh.Certificate, bufferLength)
@@ -43,6 +53,7 @@ func newMonitor(keymasterServerHostname string, keymasterServerPortNum uint,
 		closers:                 make(map[string]chan<- struct{}),
 		// Transmit side channels (private).
 		authChannel:                 authChannel,
+		eventChannel:                eventChannel,
 		serviceProviderLoginChannel: serviceProviderLoginChannel,
 		sshRawCertChannel:           sshRawCertChannel,
 		sshCertChannel:              sshCertChannel,
@@ -51,6 +62,7 @@ func newMonitor(keymasterServerHostname string, keymasterServerPortNum uint,
 		x509CertChannel:             x509CertChannel,
 		// Receive side channels (public).
 		AuthChannel:                 authChannel,
+		EventChannel:                eventChannel,
 		ServiceProviderLoginChannel: serviceProviderLoginChannel,
 		SshRawCertChannel:           sshRawCertChannel,
 		SshCertChannel:              sshCertChannel,
@@ -130,11 +142,12 @@ func (m *Monitor) startMonitoring(ip string, closeChannel <-chan struct{},
 	logger log.Logger) {
 	addr := fmt.Sprintf("%s:%d", ip, m.keymasterServerPortNum)
 	reportedNotReady := false
+	var resume resumePoint
 	for ; ; time.Sleep(time.Second) {
 		if checkForEvent(closeChannel) {
 			return
 		}
-		conn, err := m.dialAndConnect(addr)
+		conn, isV1, err := m.dialAndConnect(addr, resume)
 		if m.setKeymasterStatus(ip, err) {
 			return
 		}
@@ -152,8 +165,15 @@ func (m *Monitor) startMonitoring(ip string, closeChannel <-chan struct{},
 			time.Sleep(time.Second * 4)
 			continue
 		}
-		logger.Println("connected, starting monitoring")
-		forget, err := m.monitor(conn, closeChannel, logger)
+		if !isV1 {
+			logger.Println("connected (v0 protocol), starting monitoring")
+		} else if resume.streamID == "" {
+			logger.Println("connected, starting monitoring")
+		} else {
+			logger.Printf("connected, resuming monitoring after event %d\n",
+				resume.sequence)
+		}
+		forget, err := m.monitor(conn, isV1, &resume, closeChannel, logger)
 		if forget {
 			return
 		}
@@ -164,12 +184,39 @@ func (m *Monitor) startMonitoring(ip string, closeChannel <-chan struct{},
 	}
 }
 
-func (m *Monitor) dialAndConnect(addr string) (net.Conn, error) {
+// dialAndConnect connects using the v1 protocol, resuming after the last
+// event received, falling back to v0 for keymasterd versions without it.
+// Returns true if using the v1 protocol.
+func (m *Monitor) dialAndConnect(addr string, resume resumePoint) (
+	net.Conn, bool, error) {
+	path := eventmon.HttpPathV1
+	if resume.streamID != "" {
+		path += "?" + url.Values{
+			"after":  {strconv.FormatUint(resume.sequence, 10)},
+			"stream": {resume.streamID},
+		}.Encode()
+	}
+	conn, err := m.dialAndConnectPath(addr, path)
+	if err == nil {
+		return conn, true, nil
+	}
+	if err != ErrorKeymasterDaemonNotReady {
+		return nil, false, err
+	}
+	// A sealed keymasterd also returns 404 for the v1 path.
+	conn, err = m.dialAndConnectPath(addr, eventmon.HttpPath)
+	if err != nil {
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+func (m *Monitor) dialAndConnectPath(addr, path string) (net.Conn, error) {
 	conn, err := net.DialTimeout("tcp", addr, time.Minute)
 	if err != nil {
 		return nil, err
 	}
-	if newConn, err := m.connect(conn); err != nil {
+	if newConn, err := m.connect(conn, path); err != nil {
 		conn.Close()
 		return nil, err
 	} else {
@@ -177,7 +224,7 @@ func (m *Monitor) dialAndConnect(addr string) (net.Conn, error) {
 	}
 }
 
-func (m *Monitor) connect(rawConn net.Conn) (net.Conn, error) {
+func (m *Monitor) connect(rawConn net.Conn, path string) (net.Conn, error) {
 	if tcpConn, ok := rawConn.(*net.TCPConn); ok {
 		if err := tcpConn.SetKeepAlive(true); err != nil {
 			return nil, err
@@ -192,7 +239,7 @@ func (m *Monitor) connect(rawConn net.Conn) (net.Conn, error) {
 	if err := conn.Handshake(); err != nil {
 		return nil, err
 	}
-	io.WriteString(conn, "CONNECT "+eventmon.HttpPath+" HTTP/1.0\n\n")
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
 	// Require successful HTTP response before enabling communications.
 	resp, err := http.ReadResponse(bufio.NewReader(conn),
 		&http.Request{Method: "CONNECT"})
@@ -210,8 +257,8 @@ func (m *Monitor) connect(rawConn net.Conn) (net.Conn, error) {
 
 // Returns true if monitoring should stop (because a message was sent to the
 // closeChannel).
-func (m *Monitor) monitor(conn net.Conn, closeChannel <-chan struct{},
-	logger log.Logger) (bool, error) {
+func (m *Monitor) monitor(conn net.Conn, isV1 bool, resume *resumePoint,
+	closeChannel <-chan struct{}, logger log.Logger) (bool, error) {
 	closedChannel := make(chan struct{}, 1)
 	exitChannel := make(chan struct{}, 1)
 	go func() {
@@ -222,9 +269,9 @@ func (m *Monitor) monitor(conn net.Conn, closeChannel <-chan struct{},
 		case <-exitChannel:
 		}
 	}()
-	reader := bufio.NewReader(conn)
+	decoder := json.NewDecoder(bufio.NewReader(conn))
 	for {
-		receiveData, err := receiveV0(reader)
+		receiveData, err := receive(decoder, isV1)
 		if checkForEvent(closedChannel) {
 			return true, nil
 		}
@@ -235,18 +282,31 @@ func (m *Monitor) monitor(conn net.Conn, closeChannel <-chan struct{},
 			}
 			return false, err
 		} else {
+			if receiveData.StreamID != "" {
+				resume.streamID = receiveData.StreamID
+				resume.sequence = receiveData.Sequence
+				if receiveData.Type == eventmon.EventTypeGap {
+					resume.sequence += receiveData.MissedEvents - 1
+				}
+			}
 			m.notify(receiveData, logger)
 		}
 	}
 }
 
-func receiveV0(reader io.Reader) (eventmon.EventV0, error) {
+func receive(decoder *json.Decoder, isV1 bool) (eventmon.EventV1, error) {
+	if isV1 {
+		var event eventmon.EventV1
+		if err := decoder.Decode(&event); err != nil {
+			return eventmon.EventV1{}, err
+		}
+		return event, nil
+	}
 	var event eventmon.EventV0
-	decoder := json.NewDecoder(reader)
 	if err := decoder.Decode(&event); err != nil {
-		return eventmon.EventV0{}, err
+		return eventmon.EventV1{}, err
 	}
-	return event, nil
+	return event.V1(), nil
 }
 
 func (m *Monitor) writeHtml(writer io.Writer) {
@@ -281,31 +341,89 @@ func (m *Monitor) writeHtml(writer io.Writer) {
 	fmt.Fprintln(writer, "</table>")
 }
 
-func (m *Monitor) notify(event eventmon.EventV0, logger log.Logger) {
+// factorName returns the authentication type of the event, including the VIP
+// authentication type.
+func factorName(factor *eventmon.FactorV1) string {
+	if factor == nil {
+		return "?"
+	}
+	if factor.AuthType != eventmon.AuthTypeSymantecVIP {
+		return factor.AuthType
+	}
+	switch factor.VIPAuthType {
+	case eventmon.VIPAuthTypeOTP:
+		return factor.AuthType + "/OTP"
+	case eventmon.VIPAuthTypePush:
+		return factor.AuthType + "/Push"
+	default:
+		return factor.AuthType + "/?"
+	}
+}
+
+func (m *Monitor) notify(event eventmon.EventV1, logger log.Logger) {
+	// Every event must be recorded, so wait rather than drop it. Reading
+	// from the keymasterd stops meanwhile.
+	select {
+	case m.eventChannel <- event:
+	default:
+		logger.Printf("Event queue full, waiting to queue event %d\n",
+			event.Sequence)
+		m.eventChannel <- event
+	}
 	switch event.Type {
 	case eventmon.EventTypeAuth:
-		authType := event.AuthType
+		logger.Printf("User %s authentication: %s\n", factorName(event.Factor),
+			event.Username)
+		if event.Factor == nil {
+			break
+		}
 		var vipAuthType string
-		if event.AuthType == eventmon.AuthTypeSymantecVIP {
-			vipAuthType = event.VIPAuthType
-			switch event.VIPAuthType {
-			case eventmon.VIPAuthTypeOTP:
-				authType += "/OTP"
-			case eventmon.VIPAuthTypePush:
-				authType += "/Push"
-			default:
-				authType += "/?"
-			}
+		if event.Factor.AuthType == eventmon.AuthTypeSymantecVIP {
+			vipAuthType = event.Factor.VIPAuthType
 		}
-		logger.Printf("User %s authentication: %s\n", authType, event.Username)
 		select { // Non-blocking notification.
 		case m.authChannel <- AuthInfo{
-			AuthType:    event.AuthType,
+			AuthType:    event.Factor.AuthType,
 			Username:    event.Username,
 			VIPAuthType: vipAuthType,
 		}:
 		default:
 		}
+	case eventmon.EventTypeAuthFailure:
+		logger.Printf("User %s authentication failure: %s from %s: %s\n",
+			factorName(event.Factor), event.Username, event.SourceIP,
+			event.FailureReason)
+	case eventmon.EventTypeBootstrapOTPGeneration:
+		logger.Printf("Bootstrap OTP generated for: %s\n", event.Username)
+	case eventmon.EventTypeGap:
+		logger.Printf("Lost %d events from event %d\n", event.MissedEvents,
+			event.Sequence)
+	case eventmon.EventTypeOIDCCodeIssue:
+		logger.Printf("OIDC code issued to: %s for: %s\n", event.ClientID,
+			event.Username)
+	case eventmon.EventTypeOIDCTokenIssue:
+		logger.Printf("OIDC token issued to: %s for: %s\n", event.ClientID,
+			event.Username)
+	case eventmon.EventTypeTokenDeletion:
+		logger.Printf("User %s token deleted for: %s\n",
+			factorName(event.Factor), event.Username)
+	case eventmon.EventTypeTokenRegistration:
+		logger.Printf("User %s token registered for: %s\n",
+			factorName(event.Factor), event.Username)
+	case eventmon.EventTypeUnseal:
+		if event.Outcome == eventmon.OutcomeSuccess {
+			logger.Printf("Unsealed by: %s\n", event.RequestingUsername)
+		} else {
+			logger.Printf("Unseal by: %s failed: %s\n",
+				event.RequestingUsername, event.FailureReason)
+		}
+	case eventmon.EventTypeUserAdd:
+		logger.Printf("User added: %s\n", event.Username)
+	case eventmon.EventTypeUserDelete:
+		logger.Printf("User deleted: %s\n", event.Username)
+	case eventmon.EventTypeServiceProviderConsent:
+		logger.Printf("User %s approved access for service: %s\n",
+			event.Username, event.ServiceProviderUrl)
 	case eventmon.EventTypeServiceProviderLogin:
 		logger.Printf("User %s logged into service: %s\n",
 			event.Username, event.ServiceProviderUrl)
@@ -0,0 +1,193 @@
+/*
+Package sinks streams keymaster events to external systems, such as a SIEM.
+
+Each sink has a bounded queue. Events which cannot be delivered are retried
+with exponential backoff, and dropped (with a log message) when the queue is
+full or the retries are exhausted, so that a slow or failed sink never blocks
+event monitoring.
+*/
+package sinks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const (
+	// EventTypeAlert is the type of the events for the alerts raised by
+	// keymaster-eventmond rules.
+	EventTypeAlert = "Alert"
+
+	TypeJSONFile = "json_file"
+	TypeKafka    = "kafka"
+	TypeSyslog   = "syslog"
+	TypeWebhook  = "webhook"
+)
+
+// Config is the configuration of one sink. Type selects which one of the
+// type specific sections is used.
+type Config struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// EventTypes limits the sink to these types (eventmon.EventType*).
+	// Default: all.
+	EventTypes []string `yaml:"event_types"`
+	// Users limits the sink to users matching these patterns (path.Match
+	// syntax). Default: all.
+	Users []string `yaml:"users"`
+	// ExcludeUsers drops events for users matching these patterns.
+	ExcludeUsers []string `yaml:"exclude_users"`
+	QueueLength  uint     `yaml:"queue_length"` // Default: 1024.
+	MaxRetries   uint     `yaml:"max_retries"`  // Default: 10.
+
+	JSONFile JSONFileConfig `yaml:"json_file"`
+	Kafka    KafkaConfig    `yaml:"kafka"`
+	Syslog   SyslogConfig   `yaml:"syslog"`
+	Webhook  WebhookConfig  `yaml:"webhook"`
+}
+
+// JSONFileConfig writes each event as a line of JSON appended to a file.
+type JSONFileConfig struct {
+	Filename string `yaml:"filename"`
+}
+
+// KafkaConfig produces each event as a JSON record keyed by username. The
+// records are batched, compressed and retried by the producer, so the
+// MaxRetries of the sink do not apply.
+type KafkaConfig struct {
+	Brokers  []string `yaml:"brokers"` // host:port
+	Topic    string   `yaml:"topic"`
+	ClientID string   `yaml:"client_id"` // Default: keymaster-eventmond.
+	// RequiredAcks is 1 (leader) or -1 (all in-sync replicas). Default: -1.
+	// 0 (no acknowledgement) is not supported.
+	RequiredAcks *int16 `yaml:"required_acks"`
+	// Timeout bounds the delivery of a record, retries included. Default: 1m.
+	Timeout time.Duration `yaml:"timeout"`
+	// Linger is how long to wait for more records to fill a batch.
+	// Default: 100ms.
+	Linger time.Duration `yaml:"linger"`
+	// Compression is none, gzip, snappy, lz4 or zstd. Default: snappy.
+	Compression string          `yaml:"compression"`
+	TLS         KafkaTLSConfig  `yaml:"tls"`
+	SASL        KafkaSASLConfig `yaml:"sasl"`
+}
+
+// KafkaTLSConfig enables TLS if Enabled or any of the files is set.
+type KafkaTLSConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	CAFile   string `yaml:"ca_file"`   // Default: the system roots.
+	CertFile string `yaml:"cert_file"` // Optional client certificate.
+	KeyFile  string `yaml:"key_file"`
+}
+
+// KafkaSASLConfig authenticates with PLAIN (only over TLS), SCRAM-SHA-256 or
+// SCRAM-SHA-512.
+type KafkaSASLConfig struct {
+	Mechanism    string `yaml:"mechanism"`
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// SyslogConfig sends RFC 5424 messages with a CEF payload.
+type SyslogConfig struct {
+	// Network is udp, tcp (octet counting framing) or unixgram. Default: udp.
+	Network  string `yaml:"network"`
+	Address  string `yaml:"address"`
+	Facility string `yaml:"facility"` // Default: auth.
+	AppName  string `yaml:"app_name"` // Default: keymaster-eventmond.
+	Hostname string `yaml:"hostname"` // Default: the local hostname.
+}
+
+// WebhookConfig POSTs each event as JSON. If SecretFile is set, requests are
+// signed with HMAC-SHA256 over the timestamp header, a "." and the body.
+type WebhookConfig struct {
+	URL        string        `yaml:"url"`
+	SecretFile string        `yaml:"secret_file"`
+	Timeout    time.Duration `yaml:"timeout"` // Default: 10s.
+}
+
+// Event is the record sent to sinks.
+type Event struct {
+	ID                 string       `json:"id,omitempty"`
+	StreamID           string       `json:"stream_id,omitempty"`
+	Sequence           uint64       `json:"sequence,omitempty"`
+	Type               string       `json:"type"`
+	Time               time.Time    `json:"time"`
+	Outcome            string       `json:"outcome,omitempty"`
+	FailureReason      string       `json:"failure_reason,omitempty"`
+	ServerHostname     string       `json:"server_hostname,omitempty"`
+	SourceIP           string       `json:"source_ip,omitempty"`
+	UserAgent          string       `json:"user_agent,omitempty"`
+	Username           string       `json:"username,omitempty"`
+	RequestingUsername string       `json:"requesting_username,omitempty"`
+	AuthType           string       `json:"auth_type,omitempty"`
+	VIPAuthType        string       `json:"vip_auth_type,omitempty"`
+	TokenName          string       `json:"token_name,omitempty"`
+	ServiceProviderUrl string       `json:"service_provider_url,omitempty"`
+	ClientID           string       `json:"client_id,omitempty"`
+	MissedEvents       uint64       `json:"missed_events,omitempty"`
+	Rule               string       `json:"rule,omitempty"`    // Alert.
+	Message            string       `json:"message,omitempty"` // Alert.
+	Certificate        *Certificate `json:"certificate,omitempty"`
+}
+
+// Certificate describes an issued SSH or X.509 certificate.
+type Certificate struct {
+	Serial     string    `json:"serial"`
+	KeyId      string    `json:"key_id,omitempty"` // SSH only.
+	Principals []string  `json:"principals,omitempty"`
+	NotBefore  time.Time `json:"not_before"`
+	NotAfter   time.Time `json:"not_after"`
+}
+
+// Sink delivers events. Send is never called concurrently.
+type Sink interface {
+	Send(event *Event) error
+	Close() error
+}
+
+type Sinks struct {
+	logger log.Logger
+	sinks  []*queuedSink
+}
+
+type queuedSink struct {
+	config      Config
+	sink        Sink
+	logger      log.Logger
+	queue       chan *Event
+	stopChannel chan struct{}
+	waitGroup   sync.WaitGroup
+}
+
+// NewEvent converts an event received from keymasterd. The certificate in
+// certificate events is parsed. The received time is used if the event has no
+// time (events from keymasterd versions without the v1 protocol).
+func NewEvent(event eventmon.EventV1, received time.Time) (*Event, error) {
+	return newEvent(event, received)
+}
+
+// New creates the configured sinks.
+func New(configs []Config, logger log.Logger) (*Sinks, error) {
+	return newSinks(configs, logger)
+}
+
+// NewSink creates a sink without a queue or filters. Sinks which deliver in
+// the background log their failures to logger.
+func NewSink(config Config, logger log.Logger) (Sink, error) {
+	return newSink(config, logger)
+}
+
+// Close stops the sinks after trying once to deliver the queued events. Send
+// must not be called concurrently or afterwards.
+func (s *Sinks) Close() {
+	s.close()
+}
+
+// Send queues the event for each sink whose filters it matches.
+func (s *Sinks) Send(event *Event) {
+	s.send(event)
+}
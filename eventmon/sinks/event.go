@@ -0,0 +1,73 @@
+package sinks
+
+import (
+	"crypto/x509"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+	"golang.org/x/crypto/ssh"
+)
+
+func newEvent(event eventmon.EventV1, received time.Time) (*Event, error) {
+	newEvent := &Event{
+		ID:                 event.ID,
+		StreamID:           event.StreamID,
+		Sequence:           event.Sequence,
+		Type:               event.Type,
+		Time:               event.Time,
+		Outcome:            event.Outcome,
+		FailureReason:      event.FailureReason,
+		ServerHostname:     event.ServerHostname,
+		SourceIP:           event.SourceIP,
+		UserAgent:          event.UserAgent,
+		Username:           event.Username,
+		RequestingUsername: event.RequestingUsername,
+		ServiceProviderUrl: event.ServiceProviderUrl,
+		ClientID:           event.ClientID,
+		MissedEvents:       event.MissedEvents,
+	}
+	if newEvent.Time.IsZero() {
+		newEvent.Time = received
+	}
+	if factor := event.Factor; factor != nil {
+		newEvent.AuthType = factor.AuthType
+		newEvent.VIPAuthType = factor.VIPAuthType
+		newEvent.TokenName = factor.TokenName
+	}
+	switch event.Type {
+	case eventmon.EventTypeSSHCert:
+		pubKey, err := ssh.ParsePublicKey(event.CertData)
+		if err != nil {
+			return nil, err
+		}
+		sshCert, ok := pubKey.(*ssh.Certificate)
+		if !ok {
+			return nil, errors.New("SSH public key is not a certificate")
+		}
+		newEvent.Certificate = &Certificate{
+			Serial:     strconv.FormatUint(sshCert.Serial, 10),
+			KeyId:      sshCert.KeyId,
+			Principals: sshCert.ValidPrincipals,
+			NotBefore:  time.Unix(int64(sshCert.ValidAfter), 0),
+			NotAfter:   time.Unix(int64(sshCert.ValidBefore), 0),
+		}
+		if len(sshCert.ValidPrincipals) > 0 {
+			newEvent.Username = sshCert.ValidPrincipals[0]
+		}
+	case eventmon.EventTypeX509Cert:
+		x509Cert, err := x509.ParseCertificate(event.CertData)
+		if err != nil {
+			return nil, err
+		}
+		newEvent.Certificate = &Certificate{
+			Serial:     x509Cert.SerialNumber.String(),
+			Principals: []string{x509Cert.Subject.CommonName},
+			NotBefore:  x509Cert.NotBefore,
+			NotAfter:   x509Cert.NotAfter,
+		}
+		newEvent.Username = x509Cert.Subject.CommonName
+	}
+	return newEvent, nil
+}
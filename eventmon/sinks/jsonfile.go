@@ -0,0 +1,37 @@
+package sinks
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+type jsonFileSink struct {
+	file *os.File
+}
+
+func newJSONFileSink(config JSONFileConfig) (*jsonFileSink, error) {
+	if config.Filename == "" {
+		return nil, errors.New("no filename")
+	}
+	file, err := os.OpenFile(config.Filename,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonFileSink{file: file}, nil
+}
+
+func (s *jsonFileSink) Send(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// A single write keeps lines whole for concurrent readers.
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+func (s *jsonFileSink) Close() error {
+	return s.file.Close()
+}
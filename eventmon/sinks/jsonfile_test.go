@@ -0,0 +1,55 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func TestJSONFileSink(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events.json")
+	for _, username := range []string{"alice", "bob"} {
+		// Each sink appends to the file.
+		sink, err := NewSink(Config{
+			Type:     TypeJSONFile,
+			JSONFile: JSONFileConfig{Filename: filename},
+		}, testlogger.New(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sink.Send(&Event{
+			Type:     "WebLogin",
+			Time:     time.Now(),
+			Username: username,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var usernames []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		usernames = append(usernames, event.Username)
+	}
+	if len(usernames) != 2 || usernames[0] != "alice" ||
+		usernames[1] != "bob" {
+		t.Errorf("expected alice and bob, got %v", usernames)
+	}
+}
@@ -0,0 +1,216 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	defaultKafkaClientID    = "keymaster-eventmond"
+	defaultKafkaCompression = "snappy"
+	defaultKafkaLinger      = 100 * time.Millisecond
+	defaultKafkaTimeout     = time.Minute
+)
+
+var kafkaCompressionCodecs = map[string]kgo.CompressionCodec{
+	"none":   kgo.NoCompression(),
+	"gzip":   kgo.GzipCompression(),
+	"snappy": kgo.SnappyCompression(),
+	"lz4":    kgo.Lz4Compression(),
+	"zstd":   kgo.ZstdCompression(),
+}
+
+// kafkaSink hands the events to the producer, which batches, compresses and
+// retries them in the background. Send only blocks while the producer buffer
+// is full.
+type kafkaSink struct {
+	client  *kgo.Client
+	logger  log.Logger
+	timeout time.Duration
+}
+
+func newKafkaSink(config KafkaConfig, logger log.Logger) (*kafkaSink, error) {
+	options, err := config.producerOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kgo.NewClient(options...)
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultKafkaTimeout
+	}
+	return &kafkaSink{client: client, logger: logger, timeout: timeout}, nil
+}
+
+func (c KafkaConfig) producerOptions() ([]kgo.Opt, error) {
+	if len(c.Brokers) < 1 {
+		return nil, errors.New("no brokers")
+	}
+	if c.Topic == "" {
+		return nil, errors.New("no topic")
+	}
+	if c.ClientID == "" {
+		c.ClientID = defaultKafkaClientID
+	}
+	if c.Compression == "" {
+		c.Compression = defaultKafkaCompression
+	}
+	if c.Linger <= 0 {
+		c.Linger = defaultKafkaLinger
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultKafkaTimeout
+	}
+	codec, ok := kafkaCompressionCodecs[c.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression: %s", c.Compression)
+	}
+	options := []kgo.Opt{
+		kgo.SeedBrokers(c.Brokers...),
+		kgo.DefaultProduceTopic(c.Topic),
+		kgo.ClientID(c.ClientID),
+		kgo.ProducerBatchCompression(codec),
+		kgo.ProducerLinger(c.Linger),
+		kgo.RecordDeliveryTimeout(c.Timeout),
+	}
+	requiredAcks := int16(-1)
+	if c.RequiredAcks != nil {
+		requiredAcks = *c.RequiredAcks
+	}
+	switch requiredAcks {
+	case -1:
+		options = append(options, kgo.RequiredAcks(kgo.AllISRAcks()))
+	case 1:
+		// Idempotent writes need the acknowledgement of all replicas.
+		options = append(options, kgo.RequiredAcks(kgo.LeaderAck()),
+			kgo.DisableIdempotentWrite())
+	case 0:
+		return nil, errors.New(
+			"required_acks 0 is not supported: lost events would go unnoticed")
+	default:
+		return nil, fmt.Errorf("bad required_acks: %d", requiredAcks)
+	}
+	tlsConfig, err := c.TLS.makeTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		options = append(options, kgo.DialTLSConfig(tlsConfig))
+	}
+	mechanism, err := c.SASL.makeMechanism(tlsConfig != nil)
+	if err != nil {
+		return nil, err
+	}
+	if mechanism != nil {
+		options = append(options, kgo.SASL(mechanism))
+	}
+	return options, nil
+}
+
+// makeTLSConfig returns nil if TLS is not enabled.
+func (c KafkaTLSConfig) makeTLSConfig() (*tls.Config, error) {
+	if !c.Enabled && c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		caData, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// makeMechanism returns nil if SASL is not enabled.
+func (c KafkaSASLConfig) makeMechanism(useTLS bool) (sasl.Mechanism, error) {
+	if c.Mechanism == "" {
+		return nil, nil
+	}
+	if c.Username == "" {
+		return nil, errors.New("no SASL username")
+	}
+	if c.PasswordFile == "" {
+		return nil, errors.New("no SASL password_file")
+	}
+	password, err := os.ReadFile(c.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	password = bytes.TrimSpace(password)
+	if len(password) < 1 {
+		return nil, fmt.Errorf("empty password file: %s", c.PasswordFile)
+	}
+	switch strings.ToUpper(c.Mechanism) {
+	case "PLAIN":
+		if !useTLS {
+			return nil, errors.New("SASL PLAIN would send the password in clear, enable TLS")
+		}
+		return plain.Auth{User: c.Username,
+			Pass: string(password)}.AsMechanism(), nil
+	case "SCRAM-SHA-256":
+		return scram.Auth{User: c.Username,
+			Pass: string(password)}.AsSha256Mechanism(), nil
+	case "SCRAM-SHA-512":
+		return scram.Auth{User: c.Username,
+			Pass: string(password)}.AsSha512Mechanism(), nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism: %s", c.Mechanism)
+}
+
+func (s *kafkaSink) Send(event *Event) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	record := &kgo.Record{
+		Key:       []byte(event.Username),
+		Value:     value,
+		Timestamp: event.Time,
+	}
+	s.client.Produce(context.Background(), record,
+		func(record *kgo.Record, err error) {
+			if err != nil {
+				s.logger.Printf("dropping %s event for %s: %s\n",
+					event.Type, event.Username, err)
+			}
+		})
+	return nil
+}
+
+// Close waits until the buffered events are delivered or the timeout expires.
+func (s *kafkaSink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	err := s.client.Flush(ctx)
+	s.client.Close()
+	return err
+}
@@ -0,0 +1,175 @@
+package sinks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// makeKafkaTLSConfig returns a server config for 127.0.0.1 and writes its
+// self-signed certificate to caFile.
+func makeKafkaTLSConfig(t *testing.T, caFile string) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{
+		{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestKafkaSink(t *testing.T) {
+	directory := t.TempDir()
+	caFile := filepath.Join(directory, "ca.pem")
+	passwordFile := filepath.Join(directory, "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1),
+		kfake.SeedTopics(2, "keymaster"),
+		kfake.TLS(makeKafkaTLSConfig(t, caFile)),
+		kfake.EnableSASL(),
+		kfake.Superuser("SCRAM-SHA-256", "eventmon", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	kafkaConfig := KafkaConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   "keymaster",
+		TLS:     KafkaTLSConfig{CAFile: caFile},
+		SASL: KafkaSASLConfig{Mechanism: "SCRAM-SHA-256",
+			Username: "eventmon", PasswordFile: passwordFile},
+	}
+	sink, err := NewSink(Config{Type: TypeKafka, Kafka: kafkaConfig},
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usernames := []string{"alice", "bob", "carol"}
+	for _, username := range usernames {
+		event := &Event{Type: "WebLogin", Time: time.Now(), Username: username}
+		if err := sink.Send(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close delivers the buffered records.
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	options, err := kafkaConfig.producerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := kgo.NewClient(append(options,
+		kgo.ConsumeTopics("keymaster"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	received := make(map[string]Event)
+	for len(received) < len(usernames) {
+		fetches := consumer.PollFetches(ctx)
+		if err := fetches.Err0(); err != nil {
+			t.Fatal(err)
+		}
+		fetches.EachRecord(func(record *kgo.Record) {
+			var event Event
+			if err := json.Unmarshal(record.Value, &event); err != nil {
+				t.Fatal(err)
+			}
+			if string(record.Key) != event.Username {
+				t.Errorf("record key %s for event of %s",
+					record.Key, event.Username)
+			}
+			received[event.Username] = event
+		})
+	}
+	for _, username := range usernames {
+		if event := received[username]; event.Type != "WebLogin" {
+			t.Errorf("bad event for %s: %v", username, event)
+		}
+	}
+}
+
+func TestKafkaSinkConfig(t *testing.T) {
+	acks := func(value int16) *int16 { return &value }
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	brokers := []string{"localhost:9092"}
+	for _, config := range []KafkaConfig{
+		{Topic: "keymaster"},
+		{Brokers: brokers},
+		{Brokers: brokers, Topic: "t", RequiredAcks: acks(2)},
+		{Brokers: brokers, Topic: "t", RequiredAcks: acks(0)},
+		{Brokers: brokers, Topic: "t", Compression: "brotli"},
+		{Brokers: brokers, Topic: "t",
+			TLS: KafkaTLSConfig{CAFile: passwordFile}},
+		{Brokers: brokers, Topic: "t",
+			SASL: KafkaSASLConfig{Mechanism: "SCRAM-SHA-256",
+				PasswordFile: passwordFile}},
+		{Brokers: brokers, Topic: "t",
+			SASL: KafkaSASLConfig{Mechanism: "GSSAPI", Username: "u",
+				PasswordFile: passwordFile}},
+		// PLAIN would send the password in clear without TLS.
+		{Brokers: brokers, Topic: "t",
+			SASL: KafkaSASLConfig{Mechanism: "PLAIN", Username: "u",
+				PasswordFile: passwordFile}},
+	} {
+		if _, err := config.producerOptions(); err == nil {
+			t.Errorf("bad config did not fail: %v", config)
+		}
+	}
+	for _, config := range []KafkaConfig{
+		{Brokers: brokers, Topic: "t"},
+		{Brokers: brokers, Topic: "t", RequiredAcks: acks(1),
+			Compression: "zstd"},
+		{Brokers: brokers, Topic: "t", TLS: KafkaTLSConfig{Enabled: true},
+			SASL: KafkaSASLConfig{Mechanism: "PLAIN", Username: "u",
+				PasswordFile: passwordFile}},
+	} {
+		if _, err := config.producerOptions(); err != nil {
+			t.Errorf("%v: %s", config, err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package sinks
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/prefixlogger"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	defaultQueueLength = 1024
+	defaultMaxRetries  = 10
+	minRetryInterval   = time.Second
+	maxRetryInterval   = time.Minute
+)
+
+func newSink(config Config, logger log.Logger) (Sink, error) {
+	switch config.Type {
+	case TypeJSONFile:
+		return newJSONFileSink(config.JSONFile)
+	case TypeKafka:
+		return newKafkaSink(config.Kafka, logger)
+	case TypeSyslog:
+		return newSyslogSink(config.Syslog)
+	case TypeWebhook:
+		return newWebhookSink(config.Webhook)
+	}
+	return nil, fmt.Errorf("unknown sink type: \"%s\"", config.Type)
+}
+
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad user pattern: \"%s\"", pattern)
+		}
+	}
+	return nil
+}
+
+func newSinks(configs []Config, logger log.Logger) (*Sinks, error) {
+	sinks := &Sinks{logger: logger}
+	names := make(map[string]struct{}, len(configs))
+	for index, config := range configs {
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("%s%d", config.Type, index)
+		}
+		if _, ok := names[config.Name]; ok {
+			sinks.close()
+			return nil, fmt.Errorf("duplicate sink name: %s", config.Name)
+		}
+		names[config.Name] = struct{}{}
+		if config.QueueLength < 1 {
+			config.QueueLength = defaultQueueLength
+		}
+		if config.MaxRetries < 1 {
+			config.MaxRetries = defaultMaxRetries
+		}
+		err := checkPatterns(config.Users)
+		if err == nil {
+			err = checkPatterns(config.ExcludeUsers)
+		}
+		sinkLogger := prefixlogger.New("sink "+config.Name+": ", logger)
+		var sink Sink
+		if err == nil {
+			sink, err = newSink(config, sinkLogger)
+		}
+		if err != nil {
+			sinks.close()
+			return nil, fmt.Errorf("sink %s: %s", config.Name, err)
+		}
+		sinks.sinks = append(sinks.sinks, startQueuedSink(config, sink,
+			sinkLogger))
+	}
+	return sinks, nil
+}
+
+func startQueuedSink(config Config, sink Sink,
+	logger log.Logger) *queuedSink {
+	queuedSink := &queuedSink{
+		config:      config,
+		sink:        sink,
+		logger:      logger,
+		queue:       make(chan *Event, config.QueueLength),
+		stopChannel: make(chan struct{}),
+	}
+	queuedSink.waitGroup.Add(1)
+	go queuedSink.loop()
+	return queuedSink
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) matches(event *Event) bool {
+	if len(c.EventTypes) > 0 {
+		var found bool
+		for _, eventType := range c.EventTypes {
+			if eventType == event.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(c.Users) > 0 && !matchesAny(c.Users, event.Username) {
+		return false
+	}
+	return !matchesAny(c.ExcludeUsers, event.Username)
+}
+
+func (s *Sinks) close() {
+	for _, sink := range s.sinks {
+		close(sink.stopChannel)
+		close(sink.queue)
+	}
+	for _, sink := range s.sinks {
+		sink.waitGroup.Wait()
+		if err := sink.sink.Close(); err != nil {
+			sink.logger.Println(err)
+		}
+	}
+	s.sinks = nil
+}
+
+func (s *Sinks) send(event *Event) {
+	for _, sink := range s.sinks {
+		if !sink.config.matches(event) {
+			continue
+		}
+		select { // Non-blocking notification.
+		case sink.queue <- event:
+		default:
+			sink.logger.Printf("queue full, dropping %s event for %s\n",
+				event.Type, event.Username)
+		}
+	}
+}
+
+func (s *queuedSink) loop() {
+	defer s.waitGroup.Done()
+	for event := range s.queue {
+		s.deliver(event)
+	}
+}
+
+func (s *queuedSink) deliver(event *Event) {
+	retryInterval := minRetryInterval
+	for retry := uint(0); ; retry++ {
+		err := s.sink.Send(event)
+		if err == nil {
+			return
+		}
+		if retry >= s.config.MaxRetries {
+			s.logger.Printf("dropping %s event for %s: %s\n",
+				event.Type, event.Username, err)
+			return
+		}
+		s.logger.Printf("%s, retrying in %s\n", err, retryInterval)
+		select {
+		case <-s.stopChannel:
+			s.logger.Printf("closing, dropping %s event for %s\n",
+				event.Type, event.Username)
+			return
+		case <-time.After(retryInterval):
+		}
+		retryInterval *= 2
+		if retryInterval > maxRetryInterval {
+			retryInterval = maxRetryInterval
+		}
+	}
+}
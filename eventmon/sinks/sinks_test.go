@@ -0,0 +1,201 @@
+package sinks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+type testSink struct {
+	failures int // Fail this many times before succeeding.
+	events   chan *Event
+}
+
+func (s *testSink) Send(event *Event) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("test failure")
+	}
+	s.events <- event
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func newTestSinks(t *testing.T, config Config, sink Sink) *Sinks {
+	if config.QueueLength < 1 {
+		config.QueueLength = defaultQueueLength
+	}
+	if config.MaxRetries < 1 {
+		config.MaxRetries = defaultMaxRetries
+	}
+	logger := testlogger.New(t)
+	return &Sinks{
+		logger: logger,
+		sinks:  []*queuedSink{startQueuedSink(config, sink, logger)},
+	}
+}
+
+func TestConfigMatches(t *testing.T) {
+	config := Config{
+		EventTypes:   []string{eventmon.EventTypeSSHCert},
+		Users:        []string{"a*", "bob"},
+		ExcludeUsers: []string{"admin"},
+	}
+	for _, test := range []struct {
+		event   Event
+		matches bool
+	}{
+		{Event{Type: eventmon.EventTypeSSHCert, Username: "alice"}, true},
+		{Event{Type: eventmon.EventTypeSSHCert, Username: "bob"}, true},
+		{Event{Type: eventmon.EventTypeSSHCert, Username: "admin"}, false},
+		{Event{Type: eventmon.EventTypeSSHCert, Username: "carol"}, false},
+		{Event{Type: eventmon.EventTypeWebLogin, Username: "alice"}, false},
+	} {
+		if matches := config.matches(&test.event); matches != test.matches {
+			t.Errorf("%s %s: expected %v, got %v", test.event.Type,
+				test.event.Username, test.matches, matches)
+		}
+	}
+	if !(Config{}).matches(&Event{Type: eventmon.EventTypeAuth}) {
+		t.Error("empty filter did not match")
+	}
+}
+
+func TestNewSinksErrors(t *testing.T) {
+	logger := testlogger.New(t)
+	for _, configs := range [][]Config{
+		{{Type: "carrier-pigeon"}},
+		{{Type: TypeWebhook}},
+		{{Type: TypeWebhook, Webhook: WebhookConfig{URL: "http://x"},
+			Users: []string{"["}}},
+		{
+			{Name: "a", Type: TypeWebhook, Webhook: WebhookConfig{URL: "http://x"}},
+			{Name: "a", Type: TypeWebhook, Webhook: WebhookConfig{URL: "http://y"}},
+		},
+	} {
+		if _, err := New(configs, logger); err == nil {
+			t.Errorf("bad config did not fail: %v", configs)
+		}
+	}
+}
+
+func TestSinksRetry(t *testing.T) {
+	sink := &testSink{failures: 1, events: make(chan *Event, 1)}
+	sinks := newTestSinks(t, Config{}, sink)
+	defer sinks.Close()
+	sinks.Send(&Event{Type: eventmon.EventTypeWebLogin, Username: "alice"})
+	select {
+	case event := <-sink.events:
+		if event.Username != "alice" {
+			t.Errorf("bad event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not retried")
+	}
+}
+
+func TestSinksFilter(t *testing.T) {
+	sink := &testSink{events: make(chan *Event, 2)}
+	sinks := newTestSinks(t, Config{Users: []string{"bob"}}, sink)
+	sinks.Send(&Event{Type: eventmon.EventTypeWebLogin, Username: "alice"})
+	sinks.Send(&Event{Type: eventmon.EventTypeWebLogin, Username: "bob"})
+	sinks.Close()
+	close(sink.events)
+	var usernames []string
+	for event := range sink.events {
+		usernames = append(usernames, event.Username)
+	}
+	if len(usernames) != 1 || usernames[0] != "bob" {
+		t.Errorf("expected only bob, got %v", usernames)
+	}
+}
+
+func TestNewEventX509(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := NewEvent(eventmon.EventV1{
+		Type:     eventmon.EventTypeX509Cert,
+		CertData: der,
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Username != "alice" {
+		t.Errorf("expected alice, got %s", event.Username)
+	}
+	if event.Certificate == nil || event.Certificate.Serial != "1234" ||
+		!event.Certificate.NotAfter.Equal(notAfter) {
+		t.Errorf("bad certificate: %v", event.Certificate)
+	}
+	_, err = NewEvent(eventmon.EventV1{
+		Type:     eventmon.EventTypeSSHCert,
+		CertData: []byte("junk"),
+	}, time.Now())
+	if err == nil {
+		t.Error("junk certificate did not fail")
+	}
+}
+
+func TestNewEventFactor(t *testing.T) {
+	eventTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	event, err := NewEvent(eventmon.EventV1{
+		ID:       "0123",
+		Time:     eventTime,
+		Type:     eventmon.EventTypeTokenRegistration,
+		Outcome:  eventmon.OutcomeSuccess,
+		SourceIP: "192.0.2.1",
+		Username: "alice",
+		Factor: &eventmon.FactorV1{
+			AuthType:  eventmon.AuthTypeTOTP,
+			TokenName: "phone",
+		},
+		RequestingUsername: "admin",
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.Time.Equal(eventTime) {
+		t.Errorf("expected %s, got %s", eventTime, event.Time)
+	}
+	if event.AuthType != eventmon.AuthTypeTOTP || event.TokenName != "phone" {
+		t.Errorf("bad factor: %s %s", event.AuthType, event.TokenName)
+	}
+	if event.SourceIP != "192.0.2.1" || event.RequestingUsername != "admin" {
+		t.Errorf("bad request details: %+v", event)
+	}
+	// Events from the v0 protocol have no time.
+	event, err = NewEvent(eventmon.EventV1{Type: eventmon.EventTypeWebLogin},
+		eventTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.Time.Equal(eventTime) {
+		t.Errorf("expected %s, got %s", eventTime, event.Time)
+	}
+}
@@ -0,0 +1,234 @@
+package sinks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const (
+	cefVendor        = "Cloud-Foundations"
+	cefProduct       = "keymaster"
+	cefDeviceVersion = "1"
+
+	defaultSyslogAppName = "keymaster-eventmond"
+	rfc5424TimeFormat    = "2006-01-02T15:04:05.000000Z07:00"
+	syslogSeverityInfo   = 6
+	syslogDialTimeout    = 10 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+var cefEventNames = map[string]string{
+	EventTypeAlert:                           "Anomaly detected",
+	eventmon.EventTypeAuth:                   "User authenticated",
+	eventmon.EventTypeAuthFailure:            "User authentication failed",
+	eventmon.EventTypeBootstrapOTPGeneration: "Bootstrap OTP generated",
+	eventmon.EventTypeGap:                    "Events lost",
+	eventmon.EventTypeOIDCCodeIssue:          "OIDC authorization code issued",
+	eventmon.EventTypeOIDCTokenIssue:         "OIDC token issued",
+	eventmon.EventTypeServiceProviderConsent: "Service provider consent",
+	eventmon.EventTypeServiceProviderLogin:   "Service provider login",
+	eventmon.EventTypeSSHCert:                "SSH certificate issued",
+	eventmon.EventTypeTokenDeletion:          "Token deleted",
+	eventmon.EventTypeTokenRegistration:      "Token registered",
+	eventmon.EventTypeUnseal:                 "Unseal",
+	eventmon.EventTypeUserAdd:                "User added",
+	eventmon.EventTypeUserDelete:             "User deleted",
+	eventmon.EventTypeWebLogin:               "Web login",
+	eventmon.EventTypeX509Cert:               "X.509 certificate issued",
+}
+
+var cefEventSeverities = map[string]int{
+	EventTypeAlert:                           8,
+	eventmon.EventTypeAuthFailure:            6,
+	eventmon.EventTypeBootstrapOTPGeneration: 6,
+	eventmon.EventTypeGap:                    7,
+	eventmon.EventTypeSSHCert:                5,
+	eventmon.EventTypeTokenDeletion:          5,
+	eventmon.EventTypeTokenRegistration:      5,
+	eventmon.EventTypeUnseal:                 7,
+	eventmon.EventTypeUserAdd:                6,
+	eventmon.EventTypeUserDelete:             6,
+	eventmon.EventTypeX509Cert:               5,
+}
+
+type syslogSink struct {
+	network  string
+	address  string
+	priority int
+	appName  string
+	hostname string
+	procID   string
+	conn     net.Conn
+}
+
+func newSyslogSink(config SyslogConfig) (*syslogSink, error) {
+	if config.Address == "" {
+		return nil, errors.New("no address")
+	}
+	sink := &syslogSink{
+		network:  config.Network,
+		address:  config.Address,
+		appName:  config.AppName,
+		hostname: config.Hostname,
+		procID:   strconv.Itoa(os.Getpid()),
+	}
+	switch sink.network {
+	case "":
+		sink.network = "udp"
+	case "tcp", "udp", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", sink.network)
+	}
+	if config.Facility == "" {
+		config.Facility = "auth"
+	}
+	facility, ok := syslogFacilities[config.Facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility: %s", config.Facility)
+	}
+	sink.priority = facility*8 + syslogSeverityInfo
+	if sink.appName == "" {
+		sink.appName = defaultSyslogAppName
+	}
+	if sink.hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		sink.hostname = hostname
+	}
+	return sink, nil
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+
+var cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`,
+	"\n", `\n`, "\r", `\r`)
+
+func formatMilliseconds(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// formatCEF returns the event in ArcSight Common Event Format.
+func formatCEF(event *Event) string {
+	name, ok := cefEventNames[event.Type]
+	if !ok {
+		name = event.Type
+	}
+	severity, ok := cefEventSeverities[event.Type]
+	if !ok {
+		severity = 3
+	}
+	var extensions []string
+	addExtension := func(key, value string) {
+		if value != "" {
+			extensions = append(extensions,
+				key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+	addCustomString := func(index int, label, value string) {
+		if value != "" {
+			addExtension(fmt.Sprintf("cs%dLabel", index), label)
+			addExtension(fmt.Sprintf("cs%d", index), value)
+		}
+	}
+	addExtension("rt", formatMilliseconds(event.Time))
+	addExtension("externalId", event.ID)
+	addExtension("outcome", event.Outcome)
+	addExtension("reason", event.FailureReason)
+	addExtension("dvchost", event.ServerHostname)
+	addExtension("src", event.SourceIP)
+	addExtension("requestClientApplication", event.UserAgent)
+	addExtension("suser", event.Username)
+	addCustomString(1, "authType", event.AuthType)
+	addCustomString(2, "vipAuthType", event.VIPAuthType)
+	addCustomString(6, "requestingUser", event.RequestingUsername)
+	addExtension("request", event.ServiceProviderUrl)
+	// cs3 to cs5 describe the certificate, token, OIDC client or alert rule.
+	addCustomString(3, "tokenName", event.TokenName)
+	addCustomString(3, "clientId", event.ClientID)
+	addCustomString(3, "rule", event.Rule)
+	addExtension("msg", event.Message)
+	if event.MissedEvents > 0 {
+		addExtension("cnt", strconv.FormatUint(event.MissedEvents, 10))
+	}
+	if cert := event.Certificate; cert != nil {
+		addCustomString(3, "certSerial", cert.Serial)
+		addCustomString(4, "principals", strings.Join(cert.Principals, ","))
+		addCustomString(5, "keyId", cert.KeyId)
+		addExtension("start", formatMilliseconds(cert.NotBefore))
+		addExtension("end", formatMilliseconds(cert.NotAfter))
+	}
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(cefVendor),
+		cefHeaderEscaper.Replace(cefProduct),
+		cefHeaderEscaper.Replace(cefDeviceVersion),
+		cefHeaderEscaper.Replace(event.Type),
+		cefHeaderEscaper.Replace(name),
+		severity,
+		strings.Join(extensions, " "))
+}
+
+// formatMessage returns an RFC 5424 message without structured data.
+func (s *syslogSink) formatMessage(event *Event) string {
+	return fmt.Sprintf("<%d>1 %s %s %s %s %s - %s",
+		s.priority, event.Time.Format(rfc5424TimeFormat), s.hostname,
+		s.appName, s.procID, event.Type, formatCEF(event))
+}
+
+func (s *syslogSink) Send(event *Event) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, syslogDialTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	message := s.formatMessage(event)
+	if s.network == "tcp" {
+		// Octet counting framing (RFC 6587).
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+	if _, err := s.conn.Write([]byte(message)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,170 @@
+package sinks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCertEvent = &Event{
+	Type:     "SSHCert",
+	Time:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	Username: "alice",
+	Certificate: &Certificate{
+		Serial:     "42",
+		KeyId:      "alice=admin|ops",
+		Principals: []string{"alice", "admin"},
+		NotBefore:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		NotAfter:   time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC),
+	},
+}
+
+func TestFormatCEF(t *testing.T) {
+	expected := `CEF:0|Cloud-Foundations|keymaster|1|SSHCert|` +
+		`SSH certificate issued|5|rt=1714564800000 suser=alice ` +
+		`cs3Label=certSerial cs3=42 cs4Label=principals cs4=alice,admin ` +
+		`cs5Label=keyId cs5=alice\=admin|ops start=1714564800000 ` +
+		`end=1714593600000`
+	if cef := formatCEF(testCertEvent); cef != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, cef)
+	}
+	event := &Event{Type: "Web|Login", Time: testCertEvent.Time}
+	if cef := formatCEF(event); !strings.Contains(cef, `|Web\|Login|`) {
+		t.Errorf("header not escaped: %s", cef)
+	}
+}
+
+func TestFormatCEFFailure(t *testing.T) {
+	event := &Event{
+		ID:            "0123",
+		Type:          "AuthFailure",
+		Time:          testCertEvent.Time,
+		Outcome:       "Failure",
+		FailureReason: "invalid TOTP",
+		SourceIP:      "192.0.2.1",
+		UserAgent:     "curl/8.0",
+		Username:      "alice",
+		AuthType:      "TOTP",
+	}
+	expected := `CEF:0|Cloud-Foundations|keymaster|1|AuthFailure|` +
+		`User authentication failed|6|rt=1714564800000 externalId=0123 ` +
+		`outcome=Failure reason=invalid TOTP src=192.0.2.1 ` +
+		`requestClientApplication=curl/8.0 suser=alice ` +
+		`cs1Label=authType cs1=TOTP`
+	if cef := formatCEF(event); cef != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, cef)
+	}
+}
+
+func TestFormatCEFAlert(t *testing.T) {
+	event := &Event{
+		Type:     EventTypeAlert,
+		Time:     testCertEvent.Time,
+		SourceIP: "192.0.2.1",
+		Username: "alice",
+		Rule:     "cert-rate",
+		Message:  "11 SSHCert events within 10m0s",
+	}
+	expected := `CEF:0|Cloud-Foundations|keymaster|1|Alert|` +
+		`Anomaly detected|8|rt=1714564800000 src=192.0.2.1 suser=alice ` +
+		`cs3Label=rule cs3=cert-rate msg=11 SSHCert events within 10m0s`
+	if cef := formatCEF(event); cef != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, cef)
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := newSyslogSink(SyslogConfig{
+		Address:  conn.LocalAddr().String(),
+		Facility: "local0",
+		Hostname: "eventmon.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Send(testCertEvent); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	length, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(buffer[:length])
+	expectedPrefix := "<134>1 2024-05-01T12:00:00.000000Z eventmon.example.com " +
+		"keymaster-eventmond " + sink.procID + " SSHCert - CEF:0|"
+	if !strings.HasPrefix(message, expectedPrefix) {
+		t.Errorf("expected prefix:\n%s\ngot:\n%s", expectedPrefix, message)
+	}
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sink, err := newSyslogSink(SyslogConfig{
+		Network: "tcp",
+		Address: listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(testCertEvent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		prefix, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := make([]byte, length)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(message), "<38>1 ") {
+			t.Errorf("bad message: %s", message)
+		}
+		if !strings.HasSuffix(string(message), "end=1714593600000") {
+			t.Errorf("message not framed: %s", message)
+		}
+	}
+}
+
+func TestSyslogSinkConfig(t *testing.T) {
+	for _, config := range []SyslogConfig{
+		{},
+		{Address: "localhost:514", Network: "carrier-pigeon"},
+		{Address: "localhost:514", Facility: "nonsense"},
+	} {
+		if _, err := newSyslogSink(config); err == nil {
+			t.Errorf("bad config did not fail: %v", config)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package sinks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+
+	webhookEventHeader     = "X-Keymaster-Event"
+	webhookSignatureHeader = "X-Keymaster-Signature"
+	webhookTimestampHeader = "X-Keymaster-Timestamp"
+)
+
+type webhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func newWebhookSink(config WebhookConfig) (*webhookSink, error) {
+	if config.URL == "" {
+		return nil, errors.New("no URL")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, err
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+	sink := &webhookSink{
+		url:    config.URL,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+	if config.SecretFile != "" {
+		secret, err := os.ReadFile(config.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		sink.secret = bytes.TrimSpace(secret)
+		if len(sink.secret) < 1 {
+			return nil, fmt.Errorf("empty secret file: %s", config.SecretFile)
+		}
+	}
+	return sink, nil
+}
+
+// computeWebhookSignature returns the value of the signature header.
+func computeWebhookSignature(secret []byte, timestamp string,
+	body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *webhookSink) Send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event.Type)
+	if len(s.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader,
+			computeWebhookSignature(s.secret, timestamp, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook error: %s: %s", resp.Status,
+			strings.TrimSpace(string(message)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
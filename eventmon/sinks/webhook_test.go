@@ -0,0 +1,87 @@
+package sinks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func TestWebhookSink(t *testing.T) {
+	secret := []byte("s3cret")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, append(secret, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan Event, 1)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 { // The first request fails and is retried.
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			signature := computeWebhookSignature(secret,
+				r.Header.Get(webhookTimestampHeader), body)
+			if r.Header.Get(webhookSignatureHeader) != signature {
+				http.Error(w, "bad signature", http.StatusUnauthorized)
+				t.Error("bad signature")
+				return
+			}
+			if r.Header.Get(webhookEventHeader) != "WebLogin" {
+				t.Errorf("bad event header: %s",
+					r.Header.Get(webhookEventHeader))
+			}
+			var event Event
+			if err := json.Unmarshal(body, &event); err != nil {
+				t.Error(err)
+				return
+			}
+			received <- event
+		}))
+	defer server.Close()
+	sinks, err := New([]Config{{
+		Type: TypeWebhook,
+		Webhook: WebhookConfig{
+			URL:        server.URL,
+			SecretFile: secretFile,
+		},
+	}}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sinks.Close()
+	sinks.Send(&Event{Type: "WebLogin", Time: time.Now(), Username: "alice"})
+	select {
+	case event := <-received:
+		if event.Username != "alice" {
+			t.Errorf("expected alice, got %s", event.Username)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+}
+
+func TestComputeWebhookSignature(t *testing.T) {
+	// Computed with:
+	// printf '1700000000.{}' | openssl dgst -sha256 -hmac key
+	expected := "sha256=" +
+		"9d713ed406bb7076d4123f0dc2c39d2df5c654ed4b0cd56b52c8b4c940bd63ae"
+	signature := computeWebhookSignature([]byte("key"), "1700000000",
+		[]byte("{}"))
+	if signature != expected {
+		t.Errorf("expected %s, got %s", expected, signature)
+	}
+}
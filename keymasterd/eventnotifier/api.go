@@ -8,39 +8,126 @@ import (
 	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
 )
 
+// EventNotifier publishes events to the eventmon clients connected to
+// eventmon.HttpPath (EventV0) and eventmon.HttpPathV1 (EventV1). The request
+// given to the Publish methods, which may be nil, provides the source IP
+// address and user agent. The latest events are buffered so that EventV1
+// clients can resume after a disconnect.
 type EventNotifier struct {
-	logger log.DebugLogger
-	mutex  sync.Mutex
+	hostname         string
+	logger           log.DebugLogger
+	previousStreamID string
+	streamID         string
+	mutex            sync.Mutex
 	// Protected by lock.
-	transmitChannels map[chan<- eventmon.EventV0]chan<- eventmon.EventV0
+	history        *eventHistory
+	notifyChannels map[chan<- struct{}]struct{}
 }
 
-func New(logger log.DebugLogger) *EventNotifier {
-	return newEventNotifier(logger)
+type Params struct {
+	// Required parameters.
+	Logger log.DebugLogger
+	// Optional parameters.
+	HistoryLength uint // Number of events buffered. Default: 10000.
+	// File recording the StreamID, so that the clients of the stream before a
+	// restart are sent the buffered events of the new stream. Without it,
+	// clients resuming an unknown stream are only sent new events.
+	StreamIDFilename string
 }
 
-func (n *EventNotifier) PublishAuthEvent(authType, username string) {
-	n.publishAuthEvent(authType, username)
+func New(params Params) (*EventNotifier, error) {
+	return newEventNotifier(params)
 }
 
-func (n *EventNotifier) PublishServiceProviderLoginEvent(url, username string) {
-	n.publishServiceProviderLoginEvent(url, username)
+func (n *EventNotifier) PublishAuthEvent(r *http.Request, authType,
+	username string) {
+	n.publishAuthEvent(r, authType, username)
 }
 
-func (n *EventNotifier) PublishSSH(cert []byte) {
-	n.publishCert(eventmon.EventTypeSSHCert, cert)
+// PublishAuthFailureEvent publishes a failed authentication. The reason is
+// one of the eventmon.FailureReason* codes. Only EventV1 clients receive it.
+func (n *EventNotifier) PublishAuthFailureEvent(r *http.Request, authType,
+	username, reason string) {
+	n.publishAuthFailureEvent(r, authType, username, reason)
 }
 
-func (n *EventNotifier) PublishWebLoginEvent(username string) {
-	n.publishWebLoginEvent(username)
+func (n *EventNotifier) PublishBootstrapOTPGenerationEvent(r *http.Request,
+	username, requestingUsername string) {
+	n.publishUserEvent(r, eventmon.EventTypeBootstrapOTPGeneration, username,
+		requestingUsername)
 }
 
-func (n *EventNotifier) PublishVIPAuthEvent(vipAuthType, username string) {
-	n.publishVIPAuthEvent(vipAuthType, username)
+func (n *EventNotifier) PublishOIDCCodeIssueEvent(r *http.Request, clientID,
+	username string) {
+	n.publishOIDCEvent(r, eventmon.EventTypeOIDCCodeIssue, clientID, username)
 }
 
-func (n *EventNotifier) PublishX509(cert []byte) {
-	n.publishCert(eventmon.EventTypeX509Cert, cert)
+func (n *EventNotifier) PublishOIDCTokenIssueEvent(r *http.Request, clientID,
+	username string) {
+	n.publishOIDCEvent(r, eventmon.EventTypeOIDCTokenIssue, clientID,
+		username)
+}
+
+func (n *EventNotifier) PublishServiceProviderConsentEvent(r *http.Request,
+	url, username string) {
+	n.publishServiceProviderEvent(r,
+		eventmon.EventTypeServiceProviderConsent, url, username)
+}
+
+func (n *EventNotifier) PublishServiceProviderLoginEvent(r *http.Request, url,
+	username string) {
+	n.publishServiceProviderEvent(r, eventmon.EventTypeServiceProviderLogin,
+		url, username)
+}
+
+func (n *EventNotifier) PublishSSH(r *http.Request, cert []byte) {
+	n.publishCert(r, eventmon.EventTypeSSHCert, cert)
+}
+
+func (n *EventNotifier) PublishTokenDeletionEvent(r *http.Request, authType,
+	tokenName, username, requestingUsername string) {
+	n.publishTokenEvent(r, eventmon.EventTypeTokenDeletion, authType,
+		tokenName, username, requestingUsername)
+}
+
+func (n *EventNotifier) PublishTokenRegistrationEvent(r *http.Request,
+	authType, tokenName, username, requestingUsername string) {
+	n.publishTokenEvent(r, eventmon.EventTypeTokenRegistration, authType,
+		tokenName, username, requestingUsername)
+}
+
+// PublishUnsealEvent publishes an unseal attempt: a failure if err is not
+// nil. The error text is not published, since it may reveal details of the
+// secret.
+func (n *EventNotifier) PublishUnsealEvent(r *http.Request,
+	requestingUsername string, err error) {
+	n.publishUnsealEvent(r, requestingUsername, err)
+}
+
+func (n *EventNotifier) PublishUserAddEvent(r *http.Request, username,
+	requestingUsername string) {
+	n.publishUserEvent(r, eventmon.EventTypeUserAdd, username,
+		requestingUsername)
+}
+
+func (n *EventNotifier) PublishUserDeleteEvent(r *http.Request, username,
+	requestingUsername string) {
+	n.publishUserEvent(r, eventmon.EventTypeUserDelete, username,
+		requestingUsername)
+}
+
+func (n *EventNotifier) PublishWebLoginEvent(r *http.Request,
+	username string) {
+	n.publishWebLoginEvent(r, username)
+}
+
+func (n *EventNotifier) PublishVIPAuthEvent(r *http.Request, vipAuthType,
+	username string) {
+	n.publishVIPAuthEvent(r, vipAuthType, username)
+}
+
+func (n *EventNotifier) PublishX509(r *http.Request, cert []byte) {
+	n.publishCert(r, eventmon.EventTypeX509Cert, cert)
 }
 
 func (n *EventNotifier) ServeHTTP(w http.ResponseWriter, req *http.Request) {
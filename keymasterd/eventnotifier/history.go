@@ -0,0 +1,53 @@
+package eventnotifier
+
+import (
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+// eventHistory is a ring buffer of the latest events. The caller must
+// serialise access.
+type eventHistory struct {
+	events       []eventmon.EventV1
+	nextSequence uint64
+}
+
+func newEventHistory(length uint) *eventHistory {
+	return &eventHistory{
+		events:       make([]eventmon.EventV1, length),
+		nextSequence: 1,
+	}
+}
+
+// add sets the sequence number of the event and records it, overwriting the
+// oldest one if the buffer is full.
+func (h *eventHistory) add(event eventmon.EventV1) eventmon.EventV1 {
+	event.Sequence = h.nextSequence
+	h.events[h.nextSequence%uint64(len(h.events))] = event
+	h.nextSequence++
+	return event
+}
+
+func (h *eventHistory) oldestSequence() uint64 {
+	if h.nextSequence-1 <= uint64(len(h.events)) {
+		return 1
+	}
+	return h.nextSequence - uint64(len(h.events))
+}
+
+// getFrom returns the buffered events starting at sequence and how many
+// events from sequence onwards are no longer buffered.
+func (h *eventHistory) getFrom(sequence uint64) ([]eventmon.EventV1, uint64) {
+	if sequence >= h.nextSequence {
+		return nil, 0
+	}
+	var lost uint64
+	if oldest := h.oldestSequence(); sequence < oldest {
+		lost = oldest - sequence
+		sequence = oldest
+	}
+	events := make([]eventmon.EventV1, 0, h.nextSequence-sequence)
+	for ; sequence < h.nextSequence; sequence++ {
+		events = append(events, h.events[sequence%uint64(len(h.events))])
+	}
+	return events, lost
+}
@@ -0,0 +1,52 @@
+package eventnotifier
+
+import (
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+func checkSequences(t *testing.T, events []eventmon.EventV1,
+	expected ...uint64) {
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for index, event := range events {
+		if event.Sequence != expected[index] {
+			t.Errorf("expected sequence %d, got %d", expected[index],
+				event.Sequence)
+		}
+	}
+}
+
+func TestEventHistory(t *testing.T) {
+	history := newEventHistory(3)
+	if events, lost := history.getFrom(1); len(events) != 0 || lost != 0 {
+		t.Errorf("empty history returned %d events, %d lost", len(events),
+			lost)
+	}
+	for i := 0; i < 2; i++ {
+		history.add(eventmon.EventV1{Type: eventmon.EventTypeWebLogin})
+	}
+	events, lost := history.getFrom(1)
+	checkSequences(t, events, 1, 2)
+	if lost != 0 {
+		t.Errorf("expected no lost events, got %d", lost)
+	}
+	for i := 0; i < 3; i++ {
+		history.add(eventmon.EventV1{Type: eventmon.EventTypeWebLogin})
+	}
+	events, lost = history.getFrom(1)
+	checkSequences(t, events, 3, 4, 5)
+	if lost != 2 {
+		t.Errorf("expected 2 lost events, got %d", lost)
+	}
+	events, lost = history.getFrom(5)
+	checkSequences(t, events, 5)
+	if lost != 0 {
+		t.Errorf("expected no lost events, got %d", lost)
+	}
+	if events, _ := history.getFrom(6); len(events) != 0 {
+		t.Errorf("expected no events, got %d", len(events))
+	}
+}
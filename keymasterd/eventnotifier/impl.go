@@ -2,74 +2,200 @@ package eventnotifier
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/util"
 	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
 )
 
 const (
-	bufferLength = 16
+	defaultHistoryLength = 10000
 )
 
-func newEventNotifier(logger log.DebugLogger) *EventNotifier {
-	channels := make(map[chan<- eventmon.EventV0]chan<- eventmon.EventV0)
+func newEventNotifier(params Params) (*EventNotifier, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		params.Logger.Println(err)
+	}
+	if params.HistoryLength < 1 {
+		params.HistoryLength = defaultHistoryLength
+	}
+	streamID, err := newEventID()
+	if err != nil {
+		return nil, err
+	}
+	var previousStreamID string
+	if params.StreamIDFilename != "" {
+		previousStreamID, err = swapStreamID(params.StreamIDFilename, streamID)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &EventNotifier{
-		logger:           logger,
-		transmitChannels: channels,
+		hostname:         hostname,
+		logger:           params.Logger,
+		previousStreamID: previousStreamID,
+		streamID:         streamID,
+		history:          newEventHistory(params.HistoryLength),
+		notifyChannels:   make(map[chan<- struct{}]struct{}),
+	}, nil
+}
+
+func newEventID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("cannot generate event ID: %s", err)
 	}
+	return hex.EncodeToString(id[:]), nil
 }
 
-func (n *EventNotifier) publishAuthEvent(authType, username string) {
-	transmitData := eventmon.EventV0{
-		Type:     eventmon.EventTypeAuth,
-		AuthType: authType,
-		Username: username,
+// swapStreamID records streamID in filename and returns the stream ID which
+// was recorded there, if any.
+func swapStreamID(filename, streamID string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
 	}
-	n.transmitEvent(transmitData)
+	err = os.WriteFile(filename, []byte(streamID+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
 }
 
-func (n *EventNotifier) publishCert(certType string, certData []byte) {
-	transmitData := eventmon.EventV0{Type: certType, CertData: certData}
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-	for ch := range n.transmitChannels {
-		select {
-		case ch <- transmitData:
-		default:
-		}
+// publish fills in the common fields and sends the event to all clients.
+func (n *EventNotifier) publish(r *http.Request, event eventmon.EventV1) {
+	id, err := newEventID()
+	if err != nil {
+		n.logger.Printf("dropping %s event: %s\n", event.Type, err)
+		return
+	}
+	event.ID = id
+	event.Time = time.Now().UTC()
+	event.ServerHostname = n.hostname
+	if event.Outcome == "" {
+		event.Outcome = eventmon.OutcomeSuccess
+	}
+	if r != nil {
+		event.SourceIP = util.GetRequestRealIp(r)
+		event.UserAgent = r.UserAgent()
 	}
+	n.addEvent(event)
 }
 
-func (n *EventNotifier) publishServiceProviderLoginEvent(url, username string) {
-	transmitData := eventmon.EventV0{
-		Type:               eventmon.EventTypeServiceProviderLogin,
+func (n *EventNotifier) publishAuthEvent(r *http.Request, authType,
+	username string) {
+	n.publish(r, eventmon.EventV1{
+		Type:     eventmon.EventTypeAuth,
+		Factor:   &eventmon.FactorV1{AuthType: authType},
+		Username: username,
+	})
+}
+
+func (n *EventNotifier) publishAuthFailureEvent(r *http.Request, authType,
+	username, reason string) {
+	n.publish(r, eventmon.EventV1{
+		Type:          eventmon.EventTypeAuthFailure,
+		Outcome:       eventmon.OutcomeFailure,
+		FailureReason: reason,
+		Factor:        &eventmon.FactorV1{AuthType: authType},
+		Username:      username,
+	})
+}
+
+func (n *EventNotifier) publishCert(r *http.Request, certType string,
+	certData []byte) {
+	n.publish(r, eventmon.EventV1{Type: certType, CertData: certData})
+}
+
+func (n *EventNotifier) publishOIDCEvent(r *http.Request, eventType, clientID,
+	username string) {
+	n.publish(r, eventmon.EventV1{
+		Type:     eventType,
+		ClientID: clientID,
+		Username: username,
+	})
+}
+
+func (n *EventNotifier) publishServiceProviderEvent(r *http.Request,
+	eventType, url, username string) {
+	n.publish(r, eventmon.EventV1{
+		Type:               eventType,
 		ServiceProviderUrl: url,
 		Username:           username,
+	})
+}
+
+func (n *EventNotifier) publishTokenEvent(r *http.Request, eventType,
+	authType, tokenName, username, requestingUsername string) {
+	if requestingUsername == username {
+		requestingUsername = ""
 	}
-	n.transmitEvent(transmitData)
+	n.publish(r, eventmon.EventV1{
+		Type: eventType,
+		Factor: &eventmon.FactorV1{
+			AuthType:  authType,
+			TokenName: tokenName,
+		},
+		Username:           username,
+		RequestingUsername: requestingUsername,
+	})
 }
 
-func (n *EventNotifier) publishWebLoginEvent(username string) {
-	transmitData := eventmon.EventV0{
-		Type:     eventmon.EventTypeWebLogin,
-		Username: username,
+func (n *EventNotifier) publishUnsealEvent(r *http.Request,
+	requestingUsername string, err error) {
+	event := eventmon.EventV1{
+		Type:               eventmon.EventTypeUnseal,
+		RequestingUsername: requestingUsername,
 	}
-	n.transmitEvent(transmitData)
+	if err != nil {
+		event.Outcome = eventmon.OutcomeFailure
+		event.FailureReason = eventmon.FailureReasonUnsealFailed
+	}
+	n.publish(r, event)
 }
 
-func (n *EventNotifier) publishVIPAuthEvent(vipAuthType, username string) {
-	transmitData := eventmon.EventV0{
-		Type:        eventmon.EventTypeAuth,
-		AuthType:    eventmon.AuthTypeSymantecVIP,
-		VIPAuthType: vipAuthType,
-		Username:    username,
+func (n *EventNotifier) publishUserEvent(r *http.Request, eventType, username,
+	requestingUsername string) {
+	if requestingUsername == username {
+		requestingUsername = ""
 	}
-	n.transmitEvent(transmitData)
+	n.publish(r, eventmon.EventV1{
+		Type:               eventType,
+		Username:           username,
+		RequestingUsername: requestingUsername,
+	})
+}
+
+func (n *EventNotifier) publishWebLoginEvent(r *http.Request,
+	username string) {
+	n.publish(r, eventmon.EventV1{
+		Type:     eventmon.EventTypeWebLogin,
+		Username: username,
+	})
+}
+
+func (n *EventNotifier) publishVIPAuthEvent(r *http.Request, vipAuthType,
+	username string) {
+	n.publish(r, eventmon.EventV1{
+		Type: eventmon.EventTypeAuth,
+		Factor: &eventmon.FactorV1{
+			AuthType:    eventmon.AuthTypeSymantecVIP,
+			VIPAuthType: vipAuthType,
+		},
+		Username: username,
+	})
 }
 
 func (n *EventNotifier) serveHTTP(w http.ResponseWriter, req *http.Request) {
@@ -78,6 +204,18 @@ func (n *EventNotifier) serveHTTP(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	isV1 := req.URL.Path == eventmon.HttpPathV1
+	var resumeSequence uint64
+	if isV1 {
+		var err error
+		resumeSequence, err = n.getResumeSequence(req.URL.Query())
+		if err != nil {
+			n.logger.Println("bad eventmon resume: ", err.Error())
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -110,55 +248,134 @@ func (n *EventNotifier) serveHTTP(w http.ResponseWriter, req *http.Request) {
 		n.logger.Println("error writing connect message: ", err.Error())
 		return
 	}
-	n.logger.Println("eventmon client connected")
-	n.handleConnection(bufRw)
+	if resumeSequence > 0 {
+		n.logger.Printf("eventmon client connected to %s, resuming from %d\n",
+			req.URL.Path, resumeSequence)
+	} else {
+		n.logger.Println("eventmon client connected to " + req.URL.Path)
+	}
+	n.handleConnection(bufRw, isV1, resumeSequence)
+}
+
+// getResumeSequence returns the sequence number of the first event to send
+// to a client resuming the stream given by the query parameters, or 0 to
+// send only new events.
+func (n *EventNotifier) getResumeSequence(query url.Values) (uint64, error) {
+	streamID := query.Get("stream")
+	if streamID == "" {
+		return 0, nil
+	}
+	if streamID != n.streamID {
+		if n.previousStreamID != "" && streamID == n.previousStreamID {
+			return 1, nil // keymasterd restarted: send the whole new stream.
+		}
+		return 0, nil
+	}
+	after, err := strconv.ParseUint(query.Get("after"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return after + 1, nil
 }
 
-func (n *EventNotifier) handleConnection(rw *bufio.ReadWriter) {
-	transmitChannel := make(chan eventmon.EventV0, bufferLength)
+func (n *EventNotifier) handleConnection(rw *bufio.ReadWriter, isV1 bool,
+	sequence uint64) {
+	notifyChannel := make(chan struct{}, 1)
 	closeChannel := getCloseNotifier(rw)
 	n.mutex.Lock()
-	n.transmitChannels[transmitChannel] = transmitChannel
+	n.notifyChannels[notifyChannel] = struct{}{}
+	if sequence < 1 || sequence > n.history.nextSequence {
+		sequence = n.history.nextSequence
+	}
 	n.mutex.Unlock()
 	defer func() {
 		n.mutex.Lock()
-		delete(n.transmitChannels, transmitChannel)
+		delete(n.notifyChannels, notifyChannel)
 		n.mutex.Unlock()
 	}()
 	for {
-		select {
-		case transmitData := <-transmitChannel:
-			if err := transmitV0(rw, transmitData); err != nil {
+		n.mutex.Lock()
+		events, lost := n.history.getFrom(sequence)
+		n.mutex.Unlock()
+		if lost > 0 && isV1 {
+			gapEvent, err := n.makeGapEvent(sequence, lost)
+			if err != nil {
 				n.logger.Println(err)
 				return
 			}
-		case err := <-closeChannel:
-			if err == io.EOF {
-				n.logger.Println("eventmon client disconnected")
+			if err := transmit(rw, gapEvent); err != nil {
+				n.logger.Println(err)
 				return
 			}
+		}
+		sequence += lost + uint64(len(events))
+		for _, event := range events {
+			var err error
+			if isV1 {
+				err = transmit(rw, event)
+			} else if eventV0, ok := event.V0(); ok {
+				err = transmit(rw, eventV0)
+			} else {
+				continue
+			}
+			if err != nil {
+				n.logger.Println(err)
+				return
+			}
+		}
+		if err := rw.Flush(); err != nil {
 			n.logger.Println(err)
 			return
 		}
-		if err := rw.Flush(); err != nil {
+		select {
+		case <-notifyChannel:
+		case err := <-closeChannel:
+			if err == io.EOF {
+				n.logger.Println("eventmon client disconnected")
+				return
+			}
 			n.logger.Println(err)
 			return
 		}
 	}
 }
 
-func (n *EventNotifier) transmitEvent(event eventmon.EventV0) {
+// addEvent buffers the event and wakes up the clients.
+func (n *EventNotifier) addEvent(event eventmon.EventV1) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
-	for ch := range n.transmitChannels {
-		select {
-		case ch <- event:
+	event.StreamID = n.streamID
+	n.history.add(event)
+	for ch := range n.notifyChannels {
+		select { // Non-blocking notification.
+		case ch <- struct{}{}:
 		default:
 		}
 	}
 }
 
-func transmitV0(writer io.Writer, event eventmon.EventV0) error {
+// makeGapEvent returns the marker for lost events, sent to clients which fell
+// too far behind.
+func (n *EventNotifier) makeGapEvent(sequence,
+	missedEvents uint64) (eventmon.EventV1, error) {
+	id, err := newEventID()
+	if err != nil {
+		return eventmon.EventV1{}, err
+	}
+	return eventmon.EventV1{
+		ID:             id,
+		StreamID:       n.streamID,
+		Sequence:       sequence,
+		Time:           time.Now().UTC(),
+		Type:           eventmon.EventTypeGap,
+		Outcome:        eventmon.OutcomeFailure,
+		FailureReason:  eventmon.FailureReasonBufferOverflow,
+		ServerHostname: n.hostname,
+		MissedEvents:   missedEvents,
+	}, nil
+}
+
+func transmit(writer io.Writer, event interface{}) error {
 	encoder := json.NewEncoder(writer)
 	encoder.SetIndent("", "   ")
 	return encoder.Encode(event)
@@ -0,0 +1,206 @@
+package eventnotifier
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+func connect(t *testing.T, addr, path string) *json.Decoder {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != eventmon.ConnectString {
+		t.Fatalf("unexpected HTTP response: %s", resp.Status)
+	}
+	return json.NewDecoder(reader)
+}
+
+func (n *EventNotifier) waitForClients(numClients int) error {
+	for i := 0; i < 1000; i++ {
+		n.mutex.Lock()
+		numConnected := len(n.notifyChannels)
+		n.mutex.Unlock()
+		if numConnected >= numClients {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.New("timed out waiting for clients")
+}
+
+func TestPublish(t *testing.T) {
+	notifier, err := New(Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(eventmon.HttpPath, notifier)
+	mux.Handle(eventmon.HttpPathV1, notifier)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+	decoderV0 := connect(t, addr, eventmon.HttpPath)
+	decoderV1 := connect(t, addr, eventmon.HttpPathV1)
+	if err := notifier.waitForClients(2); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/api/v0/TOTPAuth", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	notifier.PublishAuthFailureEvent(req, eventmon.AuthTypeTOTP, "alice",
+		eventmon.FailureReasonInvalidOTP)
+	notifier.PublishAuthEvent(req, eventmon.AuthTypeWebAuthn, "alice")
+	var eventV1 eventmon.EventV1
+	if err := decoderV1.Decode(&eventV1); err != nil {
+		t.Fatal(err)
+	}
+	if eventV1.Type != eventmon.EventTypeAuthFailure ||
+		eventV1.Outcome != eventmon.OutcomeFailure ||
+		eventV1.FailureReason != eventmon.FailureReasonInvalidOTP {
+		t.Errorf("bad failure event: %+v", eventV1)
+	}
+	if eventV1.SourceIP != "192.0.2.1" || eventV1.UserAgent != "test-agent" {
+		t.Errorf("bad request details: %+v", eventV1)
+	}
+	if eventV1.ID == "" || eventV1.Time.IsZero() {
+		t.Errorf("missing ID or time: %+v", eventV1)
+	}
+	firstID := eventV1.ID
+	if err := decoderV1.Decode(&eventV1); err != nil {
+		t.Fatal(err)
+	}
+	if eventV1.Type != eventmon.EventTypeAuth ||
+		eventV1.Outcome != eventmon.OutcomeSuccess ||
+		eventV1.Factor == nil ||
+		eventV1.Factor.AuthType != eventmon.AuthTypeWebAuthn {
+		t.Errorf("bad auth event: %+v", eventV1)
+	}
+	if eventV1.ID == firstID {
+		t.Errorf("duplicate event ID: %s", firstID)
+	}
+	// The v0 client only receives the successful authentication.
+	var eventV0 eventmon.EventV0
+	if err := decoderV0.Decode(&eventV0); err != nil {
+		t.Fatal(err)
+	}
+	expected := eventmon.EventV0{
+		Type:     eventmon.EventTypeAuth,
+		AuthType: eventmon.AuthTypeU2F,
+		Username: "alice",
+	}
+	if !reflect.DeepEqual(eventV0, expected) {
+		t.Errorf("expected %+v, got %+v", expected, eventV0)
+	}
+}
+
+func TestResume(t *testing.T) {
+	streamIDFilename := filepath.Join(t.TempDir(), "stream-id")
+	if err := os.WriteFile(streamIDFilename, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	notifier, err := New(Params{
+		Logger:           testlogger.New(t),
+		HistoryLength:    3,
+		StreamIDFilename: streamIDFilename,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(streamIDFilename); err != nil {
+		t.Fatal(err)
+	} else if string(data) != notifier.streamID+"\n" {
+		t.Errorf("stream ID not recorded: %q", string(data))
+	}
+	mux := http.NewServeMux()
+	mux.Handle(eventmon.HttpPathV1, notifier)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		notifier.PublishWebLoginEvent(nil, username)
+	}
+	// Resume after alice: bob, carol and dave are buffered.
+	decoder := connect(t, addr, fmt.Sprintf("%s?stream=%s&after=1",
+		eventmon.HttpPathV1, notifier.streamID))
+	var event eventmon.EventV1
+	for _, username := range []string{"bob", "carol", "dave"} {
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Username != username {
+			t.Errorf("expected %s, got %s", username, event.Username)
+		}
+	}
+	// Resume from the start: alice was lost.
+	decoder = connect(t, addr, fmt.Sprintf("%s?stream=%s&after=0",
+		eventmon.HttpPathV1, notifier.streamID))
+	if err := decoder.Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != eventmon.EventTypeGap || event.Sequence != 1 ||
+		event.MissedEvents != 1 {
+		t.Errorf("bad gap event: %+v", event)
+	}
+	if err := decoder.Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Username != "bob" || event.Sequence != 2 {
+		t.Errorf("expected bob/2, got %s/%d", event.Username, event.Sequence)
+	}
+	// The stream of the previous keymasterd: the new stream is sent.
+	decoder = connect(t, addr, eventmon.HttpPathV1+"?stream=old&after=100")
+	if err := decoder.Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != eventmon.EventTypeGap || event.MissedEvents != 1 {
+		t.Errorf("bad gap event: %+v", event)
+	}
+	// An unknown stream: only new events are sent.
+	unknownDecoder := connect(t, addr,
+		eventmon.HttpPathV1+"?stream=unknown&after=100")
+	// Live events follow the buffered ones.
+	if err := notifier.waitForClients(4); err != nil {
+		t.Fatal(err)
+	}
+	notifier.PublishWebLoginEvent(nil, "eve")
+	if err := unknownDecoder.Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Username != "eve" {
+		t.Errorf("expected eve, got %s", event.Username)
+	}
+	for _, username := range []string{"bob", "carol", "dave", "eve"} {
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Username != username {
+			t.Errorf("expected %s, got %s", username, event.Username)
+		}
+	}
+	if event.Sequence != 5 || event.StreamID != notifier.streamID {
+		t.Errorf("bad sequence: %s/%d", event.StreamID, event.Sequence)
+	}
+}
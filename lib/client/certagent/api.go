@@ -0,0 +1,125 @@
+/*
+Package certagent keeps Keymaster certificates fresh for a long running client.
+
+A Manager authenticates once, requests the certificates and then renews them
+in the background when 3/4 of their lifetime has elapsed, re-using the
+authentication cookie held in the HTTP client. When the cookie has expired it
+authenticates again, which may prompt the user (password, token or a touch of
+the security key, depending on the server policy). After a failed renewal it
+waits before trying again, doubling the wait on each failure.
+
+The certificates can be requested by other local tools over a Unix socket.
+The protocol is HTTP: a GET request to CertificatePath with the query
+parameters:
+
+	type:         the name of the certificate (i.e. ssh, x509)
+	min_validity: optional duration, the certificate is renewed if it expires
+	              sooner. It is capped at half of the certificate lifetime
+
+returns a CertificateResponse encoded as JSON.
+*/
+package certagent
+
+import (
+	"crypto"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const CertificatePath = "/v1/certificate"
+
+// CertSpec describes a certificate to keep fresh.
+type CertSpec struct {
+	Name     string // The type requested from the agent.
+	CertType string // The type requested from Keymaster: ssh|x509|x509-kubernetes
+	Signer   crypto.Signer
+	Optional bool // If true, it is dropped if Keymaster does not issue it.
+}
+
+type Params struct {
+	// Required parameters.
+	// Authenticate authenticates to Keymaster, storing the cookie in the
+	// HttpClient cookie jar, and returns the URL of the server. It may
+	// prompt the user.
+	Authenticate func() (string, error)
+	CertSpecs    []CertSpec
+	HttpClient   *http.Client
+	Logger       log.DebugLogger
+	UserName     string
+	// Optional parameters.
+	AddGroups       bool
+	UserAgentString string
+	// OnRenew is called after a certificate is issued, including the first
+	// time.
+	OnRenew func(cert *Certificate)
+}
+
+type Certificate struct {
+	Name      string
+	CertType  string
+	Data      []byte // PEM for X.509 and authorized key format for SSH.
+	Signer    crypto.Signer
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+type CertificateResponse struct {
+	Type        string    `json:"type"`
+	Certificate string    `json:"certificate"`
+	PrivateKey  string    `json:"private_key"` // PEM.
+	NotAfter    time.Time `json:"not_after"`
+}
+
+type Manager struct {
+	params      Params
+	renewMutex  sync.Mutex // Serialises renewals (and prompts).
+	baseURL     string     // Protected by renewMutex.
+	mutex       sync.RWMutex
+	certs       map[string]*Certificate // Protected by mutex.
+	renewPeriod time.Duration
+	failures    map[string]int       // Protected by renewMutex.
+	retryTime   map[string]time.Time // Protected by renewMutex.
+}
+
+// DefaultSocketDir returns the directory of the default agent sockets. Unlike
+// ~/.keymaster it must only be accessible by the user.
+func DefaultSocketDir(homeDir string) string {
+	return filepath.Join(homeDir, ".keymaster", "agent")
+}
+
+// DefaultSocketPath returns the socket for the agent of the given file
+// prefix.
+func DefaultSocketPath(homeDir string, filePrefix string) string {
+	return filepath.Join(DefaultSocketDir(homeDir), filePrefix+"-agent.sock")
+}
+
+// GetCertificate asks the agent listening on socketPath for the certificate
+// with the given name. The agent renews it first if it expires within
+// minValidity.
+func GetCertificate(socketPath string, name string,
+	minValidity time.Duration) (*CertificateResponse, error) {
+	return getCertificate(socketPath, name, minValidity)
+}
+
+// NewManager authenticates and gets the initial certificates. They are
+// renewed in the background.
+func NewManager(params Params) (*Manager, error) {
+	return newManager(params)
+}
+
+// GetCertificate returns the named certificate, renewing it first if it
+// expires within minValidity.
+func (m *Manager) GetCertificate(name string, minValidity time.Duration) (
+	*Certificate, error) {
+	return m.getCertificate(name, minValidity)
+}
+
+// Serve serves requests from local tools. It only returns on error.
+func (m *Manager) Serve(listener net.Listener) error {
+	return m.serve(listener)
+}
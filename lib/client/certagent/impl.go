@@ -0,0 +1,351 @@
+package certagent
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultRenewPeriod = time.Minute
+	maxRetryDelay      = 30 * time.Minute
+)
+
+func newManager(p Params) (*Manager, error) {
+	if p.Authenticate == nil || p.HttpClient == nil || p.Logger == nil ||
+		p.UserName == "" {
+		return nil, errors.New("missing required parameters")
+	}
+	if len(p.CertSpecs) < 1 {
+		return nil, errors.New("no certificates requested")
+	}
+	m := &Manager{
+		params:      p,
+		certs:       make(map[string]*Certificate),
+		renewPeriod: defaultRenewPeriod,
+		failures:    make(map[string]int),
+		retryTime:   make(map[string]time.Time),
+	}
+	m.renewMutex.Lock()
+	defer m.renewMutex.Unlock()
+	baseURL, err := p.Authenticate()
+	if err != nil {
+		return nil, err
+	}
+	m.baseURL = baseURL
+	for _, spec := range p.CertSpecs {
+		cert, err := m.requestCertificate(spec)
+		if err != nil {
+			if spec.Optional {
+				p.Logger.Debugf(0, "%s certificate not available: %s\n",
+					spec.Name, err)
+				continue
+			}
+			return nil, err
+		}
+		m.storeCertificate(cert)
+	}
+	go m.renewLoop()
+	return m, nil
+}
+
+// parseCertificate returns the validity of a certificate issued by
+// Keymaster.
+func parseCertificate(certType string, data []byte) (time.Time, time.Time,
+	error) {
+	if certType == "ssh" {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		sshCert, ok := pubKey.(*ssh.Certificate)
+		if !ok {
+			return time.Time{}, time.Time{}, errors.New("not an SSH certificate")
+		}
+		return time.Unix(int64(sshCert.ValidAfter), 0),
+			time.Unix(int64(sshCert.ValidBefore), 0), nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, time.Time{},
+			errors.New("unable to decode certificate PEM block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return cert.NotBefore, cert.NotAfter, nil
+}
+
+func (m *Manager) requestCertificate(spec CertSpec) (*Certificate, error) {
+	data, err := twofa.DoCertRequest(spec.Signer, m.params.HttpClient,
+		m.params.UserName, m.baseURL, spec.CertType, m.params.AddGroups,
+		m.params.UserAgentString, m.params.Logger)
+	if err != nil {
+		return nil, err
+	}
+	notBefore, notAfter, err := parseCertificate(spec.CertType, data)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{
+		Name:      spec.Name,
+		CertType:  spec.CertType,
+		Data:      data,
+		Signer:    spec.Signer,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+	}, nil
+}
+
+func (m *Manager) storeCertificate(cert *Certificate) {
+	m.mutex.Lock()
+	m.certs[cert.Name] = cert
+	m.mutex.Unlock()
+	m.params.Logger.Debugf(1, "got %s certificate valid until %s\n",
+		cert.Name, cert.NotAfter)
+	if m.params.OnRenew != nil {
+		m.params.OnRenew(cert)
+	}
+}
+
+func (m *Manager) getCachedCertificate(name string) *Certificate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.certs[name]
+}
+
+func (m *Manager) getSpec(name string) (CertSpec, bool) {
+	for _, spec := range m.params.CertSpecs {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return CertSpec{}, false
+}
+
+// renewCertificate requests a new certificate, authenticating again if the
+// authentication cookie has expired. It must be called with renewMutex held.
+func (m *Manager) renewCertificate(spec CertSpec) (*Certificate, error) {
+	cert, err := m.requestCertificate(spec)
+	if err == nil || !errors.Is(err, twofa.ErrUnauthorized) {
+		return cert, err
+	}
+	m.params.Logger.Debugf(0, "cannot renew %s certificate: %s\n", spec.Name,
+		err)
+	m.params.Logger.Printf("authenticating to renew %s certificate\n",
+		spec.Name)
+	baseURL, err := m.params.Authenticate()
+	if err != nil {
+		return nil, err
+	}
+	m.baseURL = baseURL
+	return m.requestCertificate(spec)
+}
+
+// retryDelay returns how long to wait before renewing a certificate again
+// after the given number of consecutive failures.
+func (m *Manager) retryDelay(failures int) time.Duration {
+	delay := m.renewPeriod
+	for ; failures > 1 && delay < maxRetryDelay; failures-- {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// renew renews the certificate with the given name, backing off after
+// failures so that a broken server or a dismissed prompt is not retried on
+// every request. It must be called with renewMutex held.
+func (m *Manager) renew(name string) (*Certificate, error) {
+	spec, ok := m.getSpec(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown certificate type: %s", name)
+	}
+	if retryTime := m.retryTime[name]; time.Now().Before(retryTime) {
+		return nil, fmt.Errorf("not renewing %s certificate until %s",
+			name, retryTime.Format(time.RFC3339))
+	}
+	cert, err := m.renewCertificate(spec)
+	if err != nil {
+		m.failures[name]++
+		m.retryTime[name] = time.Now().Add(m.retryDelay(m.failures[name]))
+		return nil, err
+	}
+	delete(m.failures, name)
+	delete(m.retryTime, name)
+	m.storeCertificate(cert)
+	m.params.Logger.Printf("renewed %s certificate\n", name)
+	return cert, nil
+}
+
+// capMinValidity limits minValidity to half of the certificate lifetime, as
+// more would renew the certificate on every request.
+func capMinValidity(cert *Certificate,
+	minValidity time.Duration) time.Duration {
+	maxValidity := cert.NotAfter.Sub(cert.NotBefore) / 2
+	if minValidity > maxValidity {
+		return maxValidity
+	}
+	return minValidity
+}
+
+func (m *Manager) getCertificate(name string, minValidity time.Duration) (
+	*Certificate, error) {
+	cert := m.getCachedCertificate(name)
+	if cert != nil {
+		minValidity = capMinValidity(cert, minValidity)
+	}
+	if cert != nil && time.Until(cert.NotAfter) > minValidity {
+		return cert, nil
+	}
+	// Optional certificates are dropped if they were not issued.
+	if spec, ok := m.getSpec(name); ok && spec.Optional && cert == nil {
+		return nil, fmt.Errorf("%s certificate not available", name)
+	}
+	m.renewMutex.Lock()
+	defer m.renewMutex.Unlock()
+	// Maybe renewed while waiting for the lock.
+	if cert := m.getCachedCertificate(name); cert != nil &&
+		time.Until(cert.NotAfter) > minValidity {
+		return cert, nil
+	}
+	return m.renew(name)
+}
+
+func needsRenewal(cert *Certificate) bool {
+	renewTime := cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 3 / 4)
+	return !time.Now().Before(renewTime)
+}
+
+func (m *Manager) renewLoop() {
+	for ; ; time.Sleep(m.renewPeriod) {
+		m.renewOnce()
+	}
+}
+
+func (m *Manager) renewOnce() {
+	m.renewMutex.Lock()
+	defer m.renewMutex.Unlock()
+	for _, spec := range m.params.CertSpecs {
+		cert := m.getCachedCertificate(spec.Name)
+		if cert == nil || !needsRenewal(cert) {
+			continue
+		}
+		if time.Now().Before(m.retryTime[spec.Name]) {
+			continue
+		}
+		if _, err := m.renew(spec.Name); err != nil {
+			m.params.Logger.Printf("error renewing %s certificate: %s\n",
+				spec.Name, err)
+		}
+	}
+}
+
+func (m *Manager) certificateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("type")
+	var minValidity time.Duration
+	if value := r.URL.Query().Get("min_validity"); value != "" {
+		var err error
+		minValidity, err = time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, "invalid min_validity", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := m.getSpec(name); !ok {
+		http.Error(w, "unknown certificate type", http.StatusNotFound)
+		return
+	}
+	cert, err := m.getCertificate(name, minValidity)
+	if err != nil {
+		m.params.Logger.Println(err)
+		http.Error(w, "cannot get certificate", http.StatusServiceUnavailable)
+		return
+	}
+	privateKey, err := marshalPrivateKey(cert)
+	if err != nil {
+		m.params.Logger.Println(err)
+		http.Error(w, "cannot encode key", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CertificateResponse{
+		Type:        cert.Name,
+		Certificate: string(cert.Data),
+		PrivateKey:  string(privateKey),
+		NotAfter:    cert.NotAfter,
+	})
+}
+
+func marshalPrivateKey(cert *Certificate) ([]byte, error) {
+	if cert.CertType == "ssh" {
+		block, err := ssh.MarshalPrivateKey(cert.Signer, "")
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(block), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(cert.Signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func (m *Manager) serve(listener net.Listener) error {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc(CertificatePath, m.certificateHandler)
+	server := &http.Server{
+		Handler:           serveMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return server.Serve(listener)
+}
+
+func getCertificate(socketPath string, name string,
+	minValidity time.Duration) (*CertificateResponse, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn,
+				error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	query := url.Values{"type": {name}}
+	if minValidity > 0 {
+		query.Set("min_validity", minValidity.String())
+	}
+	resp, err := client.Get("http://agent" + CertificatePath + "?" +
+		query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting certificate: %s", resp.Status)
+	}
+	var response CertificateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
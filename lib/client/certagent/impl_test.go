@@ -0,0 +1,371 @@
+package certagent
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"golang.org/x/crypto/ssh"
+)
+
+// testKeymaster issues certificates to clients with a valid cookie.
+type testKeymaster struct {
+	caKey        *ecdsa.PrivateKey
+	sshSigner    ssh.Signer
+	mutex        sync.Mutex
+	cookie       string
+	lifetime     time.Duration
+	issued       map[string]int
+	authAttempts int
+	requests     int
+	failing      bool
+}
+
+func newTestKeymaster(t *testing.T) *testKeymaster {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshSigner, err := ssh.NewSignerFromSigner(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeymaster{
+		caKey:     caKey,
+		sshSigner: sshSigner,
+		lifetime:  time.Hour,
+		issued:    make(map[string]int),
+	}
+}
+
+func (k *testKeymaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.requests++
+	if k.failing {
+		http.Error(w, "failing", http.StatusInternalServerError)
+		return
+	}
+	cookie, err := r.Cookie("auth_cookie")
+	if err != nil || k.cookie == "" || cookie.Value != k.cookie {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/certgen/") {
+		http.NotFound(w, r)
+		return
+	}
+	certType := r.URL.Query().Get("type")
+	if certType == "x509-kubernetes" {
+		http.Error(w, "not configured", http.StatusBadRequest)
+		return
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("pubkeyfile")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pubKeyData, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	switch certType {
+	case "ssh":
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyData)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert := &ssh.Certificate{
+			Key:             pubKey,
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"username"},
+			ValidAfter:      uint64(now.Unix()),
+			ValidBefore:     uint64(now.Add(k.lifetime).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, k.sshSigner); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(ssh.MarshalAuthorizedKey(cert))
+	case "x509":
+		block, _ := pem.Decode(pubKeyData)
+		if block == nil {
+			http.Error(w, "bad key", http.StatusBadRequest)
+			return
+		}
+		pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(now.UnixNano()),
+			Subject:      pkix.Name{CommonName: "username"},
+			NotBefore:    now,
+			NotAfter:     now.Add(k.lifetime),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template,
+			pubKey, k.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	k.issued[certType]++
+}
+
+func (k *testKeymaster) getIssued(certType string) int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.issued[certType]
+}
+
+func (k *testKeymaster) getRequests() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.requests
+}
+
+func (k *testKeymaster) setFailing(failing bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.failing = failing
+}
+
+func (k *testKeymaster) expireCookie() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.cookie = ""
+}
+
+func newTestManager(t *testing.T, keymaster *testKeymaster) (*Manager,
+	*int) {
+	server := httptest.NewServer(keymaster)
+	t.Cleanup(server.Close)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	x509Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sshKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var renewed int
+	var renewMutex sync.Mutex
+	manager, err := NewManager(Params{
+		Authenticate: func() (string, error) {
+			keymaster.mutex.Lock()
+			keymaster.authAttempts++
+			keymaster.cookie = time.Now().String()
+			cookie := &http.Cookie{Name: "auth_cookie", Value: keymaster.cookie}
+			keymaster.mutex.Unlock()
+			serverURL, _ := url.Parse(server.URL)
+			jar.SetCookies(serverURL, []*http.Cookie{cookie})
+			return server.URL, nil
+		},
+		CertSpecs: []CertSpec{
+			{Name: "ssh", CertType: "ssh", Signer: sshKey},
+			{Name: "x509", CertType: "x509", Signer: x509Key},
+			{Name: "x509-kubernetes", CertType: "x509-kubernetes",
+				Signer: x509Key, Optional: true},
+		},
+		HttpClient: client,
+		Logger:     testlogger.New(t),
+		UserName:   "username",
+		OnRenew: func(cert *Certificate) {
+			renewMutex.Lock()
+			renewed++
+			renewMutex.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager, &renewed
+}
+
+// ageCertificate makes the cached certificate look issued age ago.
+func ageCertificate(manager *Manager, name string, age time.Duration) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	cert := *manager.certs[name]
+	cert.NotBefore = cert.NotBefore.Add(-age)
+	cert.NotAfter = cert.NotAfter.Add(-age)
+	manager.certs[name] = &cert
+}
+
+func TestManagerRenewal(t *testing.T) {
+	keymaster := newTestKeymaster(t)
+	manager, renewed := newTestManager(t, keymaster)
+	if *renewed != 2 {
+		t.Fatalf("expected 2 initial certificates, got %d", *renewed)
+	}
+	if _, err := manager.GetCertificate("x509-kubernetes", 0); err == nil {
+		t.Fatal("unavailable optional certificate should fail")
+	}
+	cert, err := manager.GetCertificate("x509", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keymaster.getIssued("x509") != 1 {
+		t.Fatal("cached certificate not used")
+	}
+	// The minimum validity is capped at half of the lifetime.
+	if _, err := manager.GetCertificate("x509", 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if keymaster.getIssued("x509") != 1 {
+		t.Fatal("fresh certificate renewed")
+	}
+	// A certificate that expires too soon is renewed on demand.
+	ageCertificate(manager, "x509", 40*time.Minute)
+	newCert, err := manager.GetCertificate("x509", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keymaster.getIssued("x509") != 2 || newCert == cert {
+		t.Fatal("certificate not renewed")
+	}
+	// An expired cookie causes authentication again.
+	keymaster.expireCookie()
+	ageCertificate(manager, "ssh", 40*time.Minute)
+	if _, err := manager.GetCertificate("ssh", 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if keymaster.authAttempts != 2 {
+		t.Fatalf("expected 2 authentications, got %d", keymaster.authAttempts)
+	}
+	// Background renewal after 3/4 of the lifetime.
+	keymaster.mutex.Lock()
+	keymaster.lifetime = 4 * time.Second
+	keymaster.mutex.Unlock()
+	ageCertificate(manager, "ssh", 40*time.Minute)
+	if _, err := manager.GetCertificate("ssh", 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	issued := keymaster.getIssued("ssh")
+	manager.renewOnce()
+	if keymaster.getIssued("ssh") != issued {
+		t.Fatal("certificate renewed too early")
+	}
+	time.Sleep(3 * time.Second)
+	manager.renewOnce()
+	if keymaster.getIssued("ssh") != issued+1 {
+		t.Fatal("certificate not renewed in the background")
+	}
+}
+
+func TestManagerRenewalFailure(t *testing.T) {
+	keymaster := newTestKeymaster(t)
+	manager, _ := newTestManager(t, keymaster)
+	ageCertificate(manager, "x509", 50*time.Minute)
+	// Other errors do not cause authentication again.
+	keymaster.setFailing(true)
+	if _, err := manager.GetCertificate("x509", 30*time.Minute); err == nil {
+		t.Fatal("renewal should fail")
+	}
+	if keymaster.authAttempts != 1 {
+		t.Fatalf("expected 1 authentication, got %d", keymaster.authAttempts)
+	}
+	// Failures are not retried until the backoff expires.
+	requests := keymaster.getRequests()
+	keymaster.setFailing(false)
+	if _, err := manager.GetCertificate("x509", 30*time.Minute); err == nil {
+		t.Fatal("renewal should be delayed")
+	}
+	manager.renewOnce()
+	if keymaster.getRequests() != requests {
+		t.Fatal("renewal retried during backoff")
+	}
+	if delay := manager.retryDelay(2); delay != 2*manager.renewPeriod {
+		t.Fatalf("unexpected retry delay: %s", delay)
+	}
+	if delay := manager.retryDelay(100); delay != maxRetryDelay {
+		t.Fatalf("unexpected retry delay: %s", delay)
+	}
+	manager.renewMutex.Lock()
+	manager.retryTime["x509"] = time.Now()
+	manager.renewMutex.Unlock()
+	if _, err := manager.GetCertificate("x509", 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if keymaster.getIssued("x509") != 2 {
+		t.Fatal("certificate not renewed after the backoff")
+	}
+	if manager.failures["x509"] != 0 {
+		t.Fatal("failures not reset")
+	}
+}
+
+func TestServe(t *testing.T) {
+	keymaster := newTestKeymaster(t)
+	manager, _ := newTestManager(t, keymaster)
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go manager.Serve(listener)
+	response, err := GetCertificate(socketPath, "ssh", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(response.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(response.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert := pubKey.(*ssh.Certificate)
+	if string(sshCert.Key.Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Fatal("key does not match the certificate")
+	}
+	ageCertificate(manager, "x509", 40*time.Minute)
+	response, err = GetCertificate(socketPath, "x509", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keymaster.getIssued("x509") != 2 {
+		t.Fatal("min_validity not honoured")
+	}
+	if block, _ := pem.Decode([]byte(response.PrivateKey)); block == nil ||
+		block.Type != "PRIVATE KEY" {
+		t.Fatal("bad private key")
+	}
+	if _, err := GetCertificate(socketPath, "unknown", 0); err == nil {
+		t.Fatal("unknown type should fail")
+	}
+}
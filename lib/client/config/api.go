@@ -12,13 +12,61 @@ type BaseConfig struct {
 	FilePrefix       string `yaml:"file_prefix"`
 	Gen_Cert_URLS    string `yaml:"gen_cert_urls"`
 	PreferredKeyType string `yaml:"preferred_key_type"`
+	RootCAFilename   string `yaml:"root_ca_filename"`
 	Username         string `yaml:"username"`
 	WebauthBrowser   string `yaml:"webauth_browser"`
 }
 
+// ProfileConfig holds the settings of a profile. Unset settings are taken
+// from BaseConfig.
+type ProfileConfig struct {
+	AddGroups        *bool  `yaml:"add_groups"`
+	AgentConfirmUse  *bool  `yaml:"agent_confirm_use"`
+	FilePrefix       string `yaml:"file_prefix"`
+	Gen_Cert_URLS    string `yaml:"gen_cert_urls"`
+	PreferredKeyType string `yaml:"preferred_key_type"`
+	RootCAFilename   string `yaml:"root_ca_filename"`
+	Username         string `yaml:"username"`
+	WebauthBrowser   string `yaml:"webauth_browser"`
+}
+
+// SSHAgentConfig configures the SSH agent served by "keymaster agent".
+type SSHAgentConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Default: ~/.keymaster/agent/<file_prefix>-ssh-agent.sock
+	SocketPath string `yaml:"socket_path"`
+	// If set, the keymaster keys may only be used for these hosts.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// Default: ~/.ssh/known_hosts
+	KnownHostsFiles []string `yaml:"known_hosts_files"`
+	// If true, other keys are served from the agent in $SSH_AUTH_SOCK.
+	ForwardUpstream bool `yaml:"forward_upstream"`
+}
+
+// HardwareKeyConfig configures the piv and tpm preferred_key_type.
+type HardwareKeyConfig struct {
+	// Serial number of the YubiKey. Default: the first YubiKey found.
+	PIVSerial uint32 `yaml:"piv_serial"`
+	// Default: 95, the last retired key management slot.
+	PIVSlot string `yaml:"piv_slot"`
+	// One of never, always or cached. Default: cached.
+	PIVTouchPolicy string `yaml:"piv_touch_policy"`
+	// If true, a key in the slot which was not generated on the YubiKey is
+	// replaced. By default only empty slots get a new key.
+	PIVReplaceKey bool `yaml:"piv_replace_key"`
+}
+
 // AppConfigFile represents a keymaster client configuration file
 type AppConfigFile struct {
-	Base BaseConfig
+	Base        BaseConfig
+	HardwareKey HardwareKeyConfig `yaml:"hardware_key"`
+	SSHAgent    SSHAgentConfig    `yaml:"ssh_agent"`
+	// Profiles are for several keymaster deployments. The settings of a
+	// profile override those in Base.
+	Profiles       map[string]ProfileConfig `yaml:"profiles"`
+	DefaultProfile string                   `yaml:"default_profile"`
+	// Profile is the name of the profile applied by GetProfile, if any.
+	Profile string `yaml:"-"`
 }
 
 // LoadVerifyConfigFile reads, verifies, and returns the contents of
@@ -28,6 +76,18 @@ func LoadVerifyConfigFile(configFilename string) (AppConfigFile, error) {
 	return loadVerifyConfigFile(configFilename)
 }
 
+// GetProfile returns the configuration with the settings of the named
+// profile applied to the base ones. An empty name selects the default
+// profile, if any.
+func (c AppConfigFile) GetProfile(name string) (AppConfigFile, error) {
+	return c.getProfile(name)
+}
+
+// ProfileNames returns the sorted names of the profiles.
+func (c AppConfigFile) ProfileNames() []string {
+	return c.profileNames()
+}
+
 // GetConfigFromHost grabs a default config file from a given host and stores
 // it in the local file system.
 func GetConfigFromHost(
@@ -2,9 +2,13 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
+	"regexp"
+	"sort"
 
 	"github.com/Cloud-Foundations/golib/pkg/log"
 	"gopkg.in/yaml.v2"
@@ -27,16 +31,23 @@ func loadVerifyConfigFile(configFilename string) (AppConfigFile, error) {
 		return config, err
 	}
 
-	if len(config.Base.Gen_Cert_URLS) < 1 {
+	if len(config.Base.Gen_Cert_URLS) < 1 && len(config.Profiles) < 1 {
 		err = errors.New("Invalid Config file... no place get the certs")
 		return config, err
 	}
 	// TODO: ensure all enpoints are https urls
 
-	if config.Base.PreferredKeyType != "" {
-		prefKey := config.Base.PreferredKeyType
-		if prefKey != "rsa" && prefKey != "p256" && prefKey != "p384" {
-			err = errors.New("Invalid Config file... invalid KeyPreference")
+	if !isValidKeyType(config.Base.PreferredKeyType) {
+		err = errors.New("Invalid Config file... invalid KeyPreference")
+		return config, err
+	}
+	if err := verifyProfiles(config); err != nil {
+		return config, err
+	}
+
+	for _, pattern := range config.SSHAgent.AllowedHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			err = errors.New("Invalid Config file... invalid allowed_hosts pattern")
 			return config, err
 		}
 	}
@@ -44,6 +55,89 @@ func loadVerifyConfigFile(configFilename string) (AppConfigFile, error) {
 	return config, nil
 }
 
+var profileNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+func isValidKeyType(keyType string) bool {
+	switch keyType {
+	case "", "rsa", "p256", "p384", "piv", "tpm":
+		return true
+	}
+	return false
+}
+
+func verifyProfiles(config AppConfigFile) error {
+	for name, profile := range config.Profiles {
+		if !profileNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid Config file... invalid profile name %q",
+				name)
+		}
+		if len(profile.Gen_Cert_URLS) < 1 &&
+			len(config.Base.Gen_Cert_URLS) < 1 {
+			return fmt.Errorf(
+				"Invalid Config file... no place get the certs for profile %s",
+				name)
+		}
+		if !isValidKeyType(profile.PreferredKeyType) {
+			return fmt.Errorf(
+				"Invalid Config file... invalid KeyPreference for profile %s",
+				name)
+		}
+	}
+	if config.DefaultProfile != "" {
+		if _, ok := config.Profiles[config.DefaultProfile]; !ok {
+			return errors.New(
+				"Invalid Config file... default_profile is not a profile")
+		}
+	}
+	return nil
+}
+
+func (c AppConfigFile) getProfile(name string) (AppConfigFile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	if name == "" {
+		return c, nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return c, fmt.Errorf("unknown profile: %s", name)
+	}
+	c.Profile = name
+	base := &c.Base
+	if profile.AddGroups != nil {
+		base.AddGroups = *profile.AddGroups
+	}
+	if profile.AgentConfirmUse != nil {
+		base.AgentConfirmUse = *profile.AgentConfirmUse
+	}
+	for _, setting := range []struct {
+		value    *string
+		override string
+	}{
+		{&base.FilePrefix, profile.FilePrefix},
+		{&base.Gen_Cert_URLS, profile.Gen_Cert_URLS},
+		{&base.PreferredKeyType, profile.PreferredKeyType},
+		{&base.RootCAFilename, profile.RootCAFilename},
+		{&base.Username, profile.Username},
+		{&base.WebauthBrowser, profile.WebauthBrowser},
+	} {
+		if setting.override != "" {
+			*setting.value = setting.override
+		}
+	}
+	return c, nil
+}
+
+func (c AppConfigFile) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 const hostConfigPath = "/public/clientConfig"
 
 func getConfigFromHost(
@@ -83,6 +83,171 @@ func TestLoadVerifyConfigFileFailNoGenCertUrls(t *testing.T) {
 	}
 }
 
+const sshAgentConfigFile = `base:
+    gen_cert_urls: "https://localhost:33443/"
+ssh_agent:
+    enabled: true
+    allowed_hosts:
+      - "*.example.com"
+    forward_upstream: true
+`
+
+const invalidConfigFileBadAllowedHosts = `base:
+    gen_cert_urls: "https://localhost:33443/"
+ssh_agent:
+    allowed_hosts:
+      - "[example.com"
+`
+
+func TestLoadVerifyConfigFileSSHAgent(t *testing.T) {
+	tmpfile, err := createTempFileWithStringContent("test_LoadVerifyConfig", sshAgentConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name()) // clean up
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadVerifyConfigFile(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.SSHAgent.Enabled || !config.SSHAgent.ForwardUpstream ||
+		len(config.SSHAgent.AllowedHosts) != 1 {
+		t.Fatalf("unexpected ssh_agent config: %+v", config.SSHAgent)
+	}
+	tmpfile, err = createTempFileWithStringContent("test_LoadVerifyConfigFail_", invalidConfigFileBadAllowedHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name()) // clean up
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadVerifyConfigFile(tmpfile.Name())
+	if err == nil {
+		t.Fatal("Should have failed bad allowed_hosts pattern")
+	}
+}
+
+const hardwareKeyConfigFile = `base:
+    gen_cert_urls: "https://localhost:33443/"
+    preferred_key_type: piv
+hardware_key:
+    piv_serial: 1234
+    piv_touch_policy: always
+    piv_replace_key: true
+`
+
+func TestLoadVerifyConfigFileHardwareKey(t *testing.T) {
+	tmpfile, err := createTempFileWithStringContent("test_LoadVerifyConfig", hardwareKeyConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name()) // clean up
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadVerifyConfigFile(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.HardwareKey.PIVSerial != 1234 ||
+		config.HardwareKey.PIVTouchPolicy != "always" ||
+		!config.HardwareKey.PIVReplaceKey {
+		t.Fatalf("unexpected hardware_key config: %+v", config.HardwareKey)
+	}
+}
+
+const profilesConfigFile = `base:
+    username: alice
+    file_prefix: km
+    agent_confirm_use: true
+profiles:
+    prod:
+        gen_cert_urls: "https://keymaster.example.com/"
+        add_groups: true
+    staging:
+        agent_confirm_use: false
+        gen_cert_urls: "https://keymaster.staging.example.com/"
+        root_ca_filename: /etc/staging-ca.pem
+        username: alice-test
+        file_prefix: staging
+        preferred_key_type: p256
+default_profile: prod
+`
+
+func TestLoadVerifyConfigFileProfiles(t *testing.T) {
+	tmpfile, err := createTempFileWithStringContent("test_LoadVerifyConfig", profilesConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name()) // clean up
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadVerifyConfigFile(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := config.ProfileNames(); strings.Join(names, ",") != "prod,staging" {
+		t.Fatalf("unexpected profiles: %v", names)
+	}
+	prod, err := config.GetProfile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prod.Profile != "prod" || prod.Base.Username != "alice" ||
+		prod.Base.FilePrefix != "km" || !prod.Base.AddGroups ||
+		!prod.Base.AgentConfirmUse ||
+		prod.Base.Gen_Cert_URLS != "https://keymaster.example.com/" {
+		t.Fatalf("unexpected prod profile: %+v", prod.Base)
+	}
+	staging, err := config.GetProfile("staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BaseConfig{
+		FilePrefix:       "staging",
+		Gen_Cert_URLS:    "https://keymaster.staging.example.com/",
+		PreferredKeyType: "p256",
+		RootCAFilename:   "/etc/staging-ca.pem",
+		Username:         "alice-test",
+	}
+	if staging.Base != expected {
+		t.Fatalf("unexpected staging profile: %+v", staging.Base)
+	}
+	if _, err := config.GetProfile("dev"); err == nil {
+		t.Fatal("unknown profile should fail")
+	}
+	config.DefaultProfile = ""
+	if noProfile, err := config.GetProfile(""); err != nil ||
+		noProfile.Profile != "" || noProfile.Base.Gen_Cert_URLS != "" {
+		t.Fatal("no profile should be applied without a default")
+	}
+}
+
+func TestLoadVerifyConfigFileBadProfiles(t *testing.T) {
+	for _, content := range []string{
+		"profiles:\n    prod:\n        username: alice\n",
+		"profiles:\n    ../prod:\n        gen_cert_urls: https://a/\n",
+		"profiles:\n    prod:\n        gen_cert_urls: https://a/\n        preferred_key_type: dsa\n",
+		"profiles:\n    prod:\n        gen_cert_urls: https://a/\ndefault_profile: dev\n",
+	} {
+		tmpfile, err := createTempFileWithStringContent("test_LoadVerifyConfigFail_", content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmpfile.Name()) // clean up
+		if err := tmpfile.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadVerifyConfigFile(tmpfile.Name()); err == nil {
+			t.Fatalf("Should have failed: %s", content)
+		}
+	}
+}
+
 func TestLoadVerifyConfigFileFailNoSuchFile(t *testing.T) {
 	_, err := loadVerifyConfigFile("NonExistentFile")
 	if err == nil {
@@ -0,0 +1,82 @@
+/*
+Package hwkey provides client keys which are generated in hardware and never
+leave it: a PIV smart card (such as a YubiKey) or a TPM.
+
+Certificates issued for these keys are useless without the device, so stolen
+certificate files cannot be used elsewhere. The keys cannot be written to disk
+nor added to an external SSH agent; they can only be used by the process
+holding the Signer.
+*/
+package hwkey
+
+import (
+	"crypto"
+	"io"
+	"sync"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// Signer is a crypto.Signer backed by hardware. Close releases the device.
+type Signer interface {
+	crypto.Signer
+	io.Closer
+}
+
+type PIVParams struct {
+	// Serial is the serial number of the YubiKey. If zero, the first one
+	// found is used.
+	Serial uint32
+	// Slot is the key slot in hex, i.e. 9a or 82-95. Default: 95, the last
+	// retired key management slot.
+	Slot string
+	// TouchPolicy is one of never, always or cached. Default: cached.
+	TouchPolicy string
+	// PINPrompt is called when the PIN is needed, at most once per Signer.
+	PINPrompt func() (string, error)
+	// ReplaceKey allows replacing a key in the slot which cannot be attested,
+	// i.e. an imported key. By default only empty slots get a new key.
+	ReplaceKey bool
+}
+
+// TPMParams describes a TPM key. The key is derived from the owner hierarchy
+// seed, so it is the same every time for the same Name and AuthValue, until
+// the TPM is cleared.
+type TPMParams struct {
+	Name string
+	// AuthValue is required to use the key. It is also mixed into the key,
+	// so that other users of the TPM cannot derive it. Required, at least
+	// 16 bytes.
+	AuthValue []byte
+}
+
+type pivSigner struct {
+	mutex     sync.Mutex // Serialises access to the card.
+	yk        *piv.YubiKey
+	publicKey crypto.PublicKey
+	signer    crypto.Signer
+}
+
+type tpmSigner struct {
+	mutex     sync.Mutex // Serialises access to the TPM.
+	tpm       transport.TPMCloser
+	handle    tpm2.NamedHandle
+	authValue []byte
+	publicKey crypto.PublicKey
+}
+
+// NewPIVSigner returns a signer for the key in the configured slot of a
+// YubiKey, generating one if the slot is empty (or, with ReplaceKey, holds a
+// key which was not generated on the device). Generating requires the
+// management key: either the default one or one protected by the PIN.
+func NewPIVSigner(params PIVParams) (Signer, error) {
+	return newPIVSigner(params)
+}
+
+// NewTPMSigner returns a signer for a non-exportable ECDSA P-256 key in the
+// TPM of the machine.
+func NewTPMSigner(params TPMParams) (Signer, error) {
+	return newTPMSigner(params)
+}
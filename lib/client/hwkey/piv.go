@@ -0,0 +1,203 @@
+package hwkey
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-piv/piv-go/v2/piv"
+)
+
+const defaultPIVSlot = "95"
+
+func parsePIVSlot(value string) (piv.Slot, error) {
+	if value == "" {
+		value = defaultPIVSlot
+	}
+	key, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return piv.Slot{}, fmt.Errorf("invalid PIV slot: %s", value)
+	}
+	switch key {
+	case 0x9a:
+		return piv.SlotAuthentication, nil
+	case 0x9c:
+		return piv.SlotSignature, nil
+	case 0x9d:
+		return piv.SlotKeyManagement, nil
+	case 0x9e:
+		return piv.SlotCardAuthentication, nil
+	}
+	if slot, ok := piv.RetiredKeyManagementSlot(uint32(key)); ok {
+		return slot, nil
+	}
+	return piv.Slot{}, fmt.Errorf("invalid PIV slot: %s", value)
+}
+
+func parseTouchPolicy(value string) (piv.TouchPolicy, error) {
+	switch value {
+	case "never":
+		return piv.TouchPolicyNever, nil
+	case "always":
+		return piv.TouchPolicyAlways, nil
+	case "", "cached":
+		return piv.TouchPolicyCached, nil
+	}
+	return 0, fmt.Errorf("invalid touch policy: %s", value)
+}
+
+// cachePINPrompt returns a prompt which asks the user at most once.
+func cachePINPrompt(prompt func() (string, error)) func() (string, error) {
+	if prompt == nil {
+		return func() (string, error) {
+			return "", errors.New("PIN needed but no way to prompt for it")
+		}
+	}
+	var once sync.Once
+	var pin string
+	var err error
+	return func() (string, error) {
+		once.Do(func() { pin, err = prompt() })
+		return pin, err
+	}
+}
+
+func openYubiKey(serial uint32) (*piv.YubiKey, error) {
+	cards, err := piv.Cards()
+	if err != nil {
+		return nil, err
+	}
+	for _, card := range cards {
+		if !strings.Contains(strings.ToLower(card), "yubikey") {
+			continue
+		}
+		yk, err := piv.Open(card)
+		if err != nil {
+			return nil, fmt.Errorf("error opening yubikey err=%s", err)
+		}
+		ykSerial, err := yk.Serial()
+		if err != nil {
+			yk.Close()
+			return nil, err
+		}
+		if serial == 0 || serial == ykSerial {
+			return yk, nil
+		}
+		yk.Close()
+	}
+	return nil, errors.New("no yubikey found")
+}
+
+func generatePIVKey(yk *piv.YubiKey, slot piv.Slot,
+	touchPolicy piv.TouchPolicy,
+	getPIN func() (string, error)) (crypto.PublicKey, error) {
+	key := piv.Key{
+		Algorithm:   piv.AlgorithmEC256,
+		PINPolicy:   piv.PINPolicyOnce,
+		TouchPolicy: touchPolicy,
+	}
+	pub, err := yk.GenerateKey(piv.DefaultManagementKey, slot, key)
+	if err == nil {
+		return pub, nil
+	}
+	pin, err := getPIN()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := yk.Metadata(pin)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.ManagementKey == nil {
+		return nil, errors.New(
+			"management key is neither the default nor protected by the PIN")
+	}
+	return yk.GenerateKey(*metadata.ManagementKey, slot, key)
+}
+
+// checkPIVSlotEmpty returns nil if a key may be generated in slot, given the
+// errors from attesting its key and from reading its key information.
+// Attesting also fails for imported keys, so the key information tells
+// whether the slot is empty. Old YubiKeys do not support it.
+func checkPIVSlotEmpty(slot piv.Slot, attestErr error, keyInfoErr error,
+	replaceKey bool) error {
+	if !errors.Is(attestErr, piv.ErrNotFound) {
+		return fmt.Errorf("cannot attest key in slot %s: %s", slot, attestErr)
+	}
+	if errors.Is(keyInfoErr, piv.ErrNotFound) || replaceKey {
+		return nil
+	}
+	if keyInfoErr == nil {
+		return fmt.Errorf(
+			"slot %s holds a key which was not generated on the device", slot)
+	}
+	return fmt.Errorf("cannot tell whether slot %s is empty: %s", slot,
+		keyInfoErr)
+}
+
+func newPIVSigner(params PIVParams) (Signer, error) {
+	slot, err := parsePIVSlot(params.Slot)
+	if err != nil {
+		return nil, err
+	}
+	touchPolicy, err := parseTouchPolicy(params.TouchPolicy)
+	if err != nil {
+		return nil, err
+	}
+	yk, err := openYubiKey(params.Serial)
+	if err != nil {
+		return nil, err
+	}
+	getPIN := cachePINPrompt(params.PINPrompt)
+	// Only keys generated on the device can be attested.
+	var pub crypto.PublicKey
+	if cert, err := yk.Attest(slot); err == nil {
+		pub = cert.PublicKey
+	} else {
+		var keyInfoErr error
+		if errors.Is(err, piv.ErrNotFound) {
+			_, keyInfoErr = yk.KeyInfo(slot)
+		}
+		err := checkPIVSlotEmpty(slot, err, keyInfoErr, params.ReplaceKey)
+		if err != nil {
+			yk.Close()
+			return nil, err
+		}
+		pub, err = generatePIVKey(yk, slot, touchPolicy, getPIN)
+		if err != nil {
+			yk.Close()
+			return nil, fmt.Errorf("cannot generate key in slot %s: %s",
+				slot, err)
+		}
+	}
+	priv, err := yk.PrivateKey(slot, pub, piv.KeyAuth{PINPrompt: getPIN})
+	if err != nil {
+		yk.Close()
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		yk.Close()
+		return nil, fmt.Errorf("PIV private key(%T) is not a signer", priv)
+	}
+	return &pivSigner{yk: yk, publicKey: pub, signer: signer}, nil
+}
+
+func (s *pivSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *pivSigner) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.signer.Sign(rand, digest, opts)
+}
+
+func (s *pivSigner) Close() error {
+	return s.yk.Close()
+}
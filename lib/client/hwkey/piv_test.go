@@ -0,0 +1,105 @@
+package hwkey
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-piv/piv-go/v2/piv"
+)
+
+func TestParsePIVSlot(t *testing.T) {
+	tests := map[string]piv.Slot{
+		"":   mustRetiredSlot(t, 0x95),
+		"9a": piv.SlotAuthentication,
+		"9e": piv.SlotCardAuthentication,
+		"82": mustRetiredSlot(t, 0x82),
+	}
+	for value, expected := range tests {
+		slot, err := parsePIVSlot(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slot != expected {
+			t.Errorf("slot %q: got %s, expected %s", value, slot, expected)
+		}
+	}
+	for _, value := range []string{"96", "zz", "9b"} {
+		if _, err := parsePIVSlot(value); err == nil {
+			t.Errorf("slot %q should fail", value)
+		}
+	}
+}
+
+func mustRetiredSlot(t *testing.T, key uint32) piv.Slot {
+	slot, ok := piv.RetiredKeyManagementSlot(key)
+	if !ok {
+		t.Fatalf("no slot %x", key)
+	}
+	return slot
+}
+
+func TestParseTouchPolicy(t *testing.T) {
+	if policy, err := parseTouchPolicy(""); err != nil ||
+		policy != piv.TouchPolicyCached {
+		t.Fatal("default touch policy should be cached")
+	}
+	if policy, err := parseTouchPolicy("always"); err != nil ||
+		policy != piv.TouchPolicyAlways {
+		t.Fatal("bad always touch policy")
+	}
+	if _, err := parseTouchPolicy("sometimes"); err == nil {
+		t.Fatal("invalid touch policy should fail")
+	}
+}
+
+func TestCheckPIVSlotEmpty(t *testing.T) {
+	notFound := fmt.Errorf("command failed: %w", piv.ErrNotFound)
+	otherErr := errors.New("card removed")
+	tests := []struct {
+		attestErr  error
+		keyInfoErr error
+		replaceKey bool
+		ok         bool
+	}{
+		{notFound, notFound, false, true},  // Empty slot.
+		{notFound, nil, false, false},      // Imported key.
+		{notFound, nil, true, true},        // Imported key, replaced.
+		{notFound, otherErr, false, false}, // Old YubiKey.
+		{notFound, otherErr, true, true},   // Old YubiKey, replaced.
+		{otherErr, notFound, false, false}, // Attest failed.
+		{otherErr, notFound, true, false},  // Attest failed.
+	}
+	for _, test := range tests {
+		err := checkPIVSlotEmpty(piv.SlotAuthentication, test.attestErr,
+			test.keyInfoErr, test.replaceKey)
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: unexpected result: %v", test, err)
+		}
+	}
+}
+
+func TestCachePINPrompt(t *testing.T) {
+	var prompts int
+	getPIN := cachePINPrompt(func() (string, error) {
+		prompts++
+		return "123456", nil
+	})
+	for i := 0; i < 2; i++ {
+		if pin, err := getPIN(); err != nil || pin != "123456" {
+			t.Fatal("bad PIN")
+		}
+	}
+	if prompts != 1 {
+		t.Fatalf("prompted %d times", prompts)
+	}
+	getPIN = cachePINPrompt(func() (string, error) {
+		return "", errors.New("cancelled")
+	})
+	if _, err := getPIN(); err == nil {
+		t.Fatal("prompt error not returned")
+	}
+	if _, err := cachePINPrompt(nil)(); err == nil {
+		t.Fatal("missing prompt should fail")
+	}
+}
@@ -0,0 +1,180 @@
+package hwkey
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+const (
+	tpmKeyNamePrefix   = "keymaster:"
+	minTPMAuthValueLen = 16
+)
+
+// tpmKeyTemplate returns the template of a non-exportable signing key. The
+// unique field makes keys with different names or auth values different;
+// the auth value itself does not change the key of a primary object.
+func tpmKeyTemplate(name string, authValue []byte) tpm2.TPMTPublic {
+	authDigest := sha256.Sum256(authValue)
+	return tpm2.TPMTPublic{
+		Type:    tpm2.TPMAlgECC,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			FixedTPM:            true,
+			FixedParent:         true,
+			SensitiveDataOrigin: true,
+			UserWithAuth:        true,
+			SignEncrypt:         true,
+		},
+		Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC,
+			&tpm2.TPMSECCParms{
+				// The hash is chosen when signing.
+				Scheme:  tpm2.TPMTECCScheme{Scheme: tpm2.TPMAlgNull},
+				CurveID: tpm2.TPMECCNistP256,
+				KDF:     tpm2.TPMTKDFScheme{Scheme: tpm2.TPMAlgNull},
+			}),
+		Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgECC,
+			&tpm2.TPMSECCPoint{
+				X: tpm2.TPM2BECCParameter{
+					Buffer: []byte(tpmKeyNamePrefix + name),
+				},
+				Y: tpm2.TPM2BECCParameter{Buffer: authDigest[:]},
+			}),
+	}
+}
+
+func newTPMSigner(params TPMParams) (Signer, error) {
+	tpm, err := transport.OpenTPM()
+	if err != nil {
+		return nil, err
+	}
+	signer, err := openTPMSigner(tpm, params)
+	if err != nil {
+		tpm.Close()
+		return nil, err
+	}
+	return signer, nil
+}
+
+func openTPMSigner(tpm transport.TPMCloser, params TPMParams) (
+	*tpmSigner, error) {
+	if len(params.AuthValue) < minTPMAuthValueLen {
+		return nil, errors.New("TPM key auth value too short")
+	}
+	response, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				UserAuth: tpm2.TPM2BAuth{Buffer: params.AuthValue},
+			},
+		},
+		InPublic: tpm2.New2B(tpmKeyTemplate(params.Name, params.AuthValue)),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create TPM key: %s", err)
+	}
+	handle := tpm2.NamedHandle{
+		Handle: response.ObjectHandle,
+		Name:   response.Name,
+	}
+	publicKey, err := tpmPublicKey(response.OutPublic)
+	if err != nil {
+		tpm2.FlushContext{FlushHandle: handle}.Execute(tpm)
+		return nil, err
+	}
+	return &tpmSigner{
+		tpm:       tpm,
+		handle:    handle,
+		authValue: params.AuthValue,
+		publicKey: publicKey,
+	}, nil
+}
+
+func tpmPublicKey(outPublic tpm2.TPM2BPublic) (crypto.PublicKey, error) {
+	public, err := outPublic.Contents()
+	if err != nil {
+		return nil, err
+	}
+	parameters, err := public.Parameters.ECCDetail()
+	if err != nil {
+		return nil, err
+	}
+	point, err := public.Unique.ECC()
+	if err != nil {
+		return nil, err
+	}
+	return tpm2.ECDSAPub(parameters, point)
+}
+
+func tpmHashAlgorithm(hash crypto.Hash) (tpm2.TPMAlgID, error) {
+	switch hash {
+	case crypto.SHA256:
+		return tpm2.TPMAlgSHA256, nil
+	case crypto.SHA384:
+		return tpm2.TPMAlgSHA384, nil
+	case crypto.SHA512:
+		return tpm2.TPMAlgSHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported hash: %s", hash)
+}
+
+// encodeECDSASignature returns the ASN.1 encoding used by crypto/ecdsa.
+func encodeECDSASignature(r, s []byte) ([]byte, error) {
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)})
+}
+
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *tpmSigner) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	hashAlg, err := tpmHashAlgorithm(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response, err := tpm2.Sign{
+		KeyHandle: tpm2.AuthHandle{
+			Handle: s.handle.Handle,
+			Name:   s.handle.Name,
+			Auth:   tpm2.PasswordAuth(s.authValue),
+		},
+		Digest: tpm2.TPM2BDigest{Buffer: digest},
+		InScheme: tpm2.TPMTSigScheme{
+			Scheme: tpm2.TPMAlgECDSA,
+			Details: tpm2.NewTPMUSigScheme(tpm2.TPMAlgECDSA,
+				&tpm2.TPMSSchemeHash{HashAlg: hashAlg}),
+		},
+		Validation: tpm2.TPMTTKHashCheck{
+			Tag:       tpm2.TPMSTHashCheck,
+			Hierarchy: tpm2.TPMRHNull,
+		},
+	}.Execute(s.tpm)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := response.Signature.Signature.ECDSA()
+	if err != nil {
+		return nil, err
+	}
+	return encodeECDSASignature(signature.SignatureR.Buffer,
+		signature.SignatureS.Buffer)
+}
+
+func (s *tpmSigner) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tpm2.FlushContext{FlushHandle: s.handle}.Execute(s.tpm)
+	return s.tpm.Close()
+}
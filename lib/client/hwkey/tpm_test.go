@@ -0,0 +1,122 @@
+package hwkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/tcp"
+)
+
+// getSimulator connects to the TPM reference simulator at the command
+// address in $KEYMASTER_TPM_SIMULATOR (i.e. localhost:2321), or skips the
+// test. The platform port is the next one, as the simulator uses.
+func getSimulator(t *testing.T) *tcp.TPM {
+	address := os.Getenv("KEYMASTER_TPM_SIMULATOR")
+	if address == "" {
+		t.Skip("KEYMASTER_TPM_SIMULATOR not set, skipping test")
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpm, err := tcp.Open(tcp.Config{
+		CommandAddress:  address,
+		PlatformAddress: net.JoinHostPort(host, strconv.Itoa(port+1)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tpm.PowerOn(); err != nil {
+		tpm.Close()
+		t.Fatal(err)
+	}
+	// Fails if already started, which is fine.
+	tpm2.Startup{StartupType: tpm2.TPMSUClear}.Execute(tpm)
+	return tpm
+}
+
+func TestEncodeECDSASignature(t *testing.T) {
+	signature, err := encodeECDSASignature([]byte{0x80, 1}, []byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// R needs a leading zero to be positive.
+	expected := []byte{0x30, 0x08, 0x02, 0x03, 0x00, 0x80, 0x01, 0x02, 0x01, 0x02}
+	if string(signature) != string(expected) {
+		t.Fatalf("got %x, expected %x", signature, expected)
+	}
+}
+
+func TestTPMSigner(t *testing.T) {
+	tpm := getSimulator(t)
+	authValue := []byte("0123456789abcdef")
+	if _, err := openTPMSigner(tpm, TPMParams{Name: "test"}); err == nil {
+		t.Fatal("missing auth value should fail")
+	}
+	signer, err := openTPMSigner(tpm,
+		TPMParams{Name: "test", AuthValue: authValue})
+	if err != nil {
+		tpm.Close()
+		t.Fatal(err)
+	}
+	defer signer.Close()
+	publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		t.Fatalf("unexpected public key type %T", signer.Public())
+	}
+	digest := sha256.Sum256([]byte("message"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		t.Fatal("bad SHA-256 signature")
+	}
+	digest384 := sha512.Sum384([]byte("message"))
+	signature, err = signer.Sign(rand.Reader, digest384[:], crypto.SHA384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(publicKey, digest384[:], signature) {
+		t.Fatal("bad SHA-384 signature")
+	}
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.MD5); err == nil {
+		t.Fatal("unsupported hash should fail")
+	}
+	// The same name and auth value give the same key, others another key.
+	tests := []struct {
+		params TPMParams
+		same   bool
+	}{
+		{TPMParams{Name: "test", AuthValue: authValue}, true},
+		{TPMParams{Name: "other", AuthValue: authValue}, false},
+		{TPMParams{Name: "test", AuthValue: []byte("fedcba9876543210")}, false},
+	}
+	for _, test := range tests {
+		other, err := openTPMSigner(tpm, test.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if publicKey.Equal(other.Public()) != test.same {
+			t.Errorf("unexpected key for %+v", test.params)
+		}
+		tpm2.FlushContext{FlushHandle: other.handle}.Execute(tpm)
+	}
+	// The key cannot be used without the auth value.
+	signer.authValue = []byte("wrong")
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("sign with wrong auth value should fail")
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Package kubeconfig may be used to configure kubectl (and any other client
+using client-go) to authenticate with the x509-kubernetes certificates
+issued by Keymaster.
+
+The clusters are published by the Keymaster server at
+proto.KubernetesClustersPath. For each cluster a cluster and a context entry
+are written to the kubeconfig file, all using the same user entry. That user
+runs an exec credential plugin (client.authentication.k8s.io/v1), which is
+expected to print the result of NewExecCredential.
+*/
+package kubeconfig
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	ExecCredentialAPIVersion = "client.authentication.k8s.io/v1"
+	ExecCredentialKind       = "ExecCredential"
+)
+
+// ExecConfig is the command that kubectl runs to get credentials.
+type ExecConfig struct {
+	Command     string
+	Args        []string
+	InstallHint string // Shown by kubectl if Command cannot be run.
+}
+
+type Params struct {
+	Clusters []proto.KubernetesCluster
+	UserName string // Name of the user entry for the clusters.
+	Exec     ExecConfig
+}
+
+// Result is what Merge changed.
+type Result struct {
+	Contexts       []string
+	CurrentContext string // Set if there was none.
+}
+
+type ExecCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Status     ExecCredentialStatus `json:"status"`
+}
+
+type ExecCredentialStatus struct {
+	ExpirationTimestamp   string `json:"expirationTimestamp"` // RFC 3339.
+	ClientCertificateData string `json:"clientCertificateData"`
+	ClientKeyData         string `json:"clientKeyData"`
+}
+
+// DefaultFilename returns the kubeconfig file that kubectl writes to: the
+// first file in $KUBECONFIG, or ~/.kube/config.
+func DefaultFilename(homeDir string) string {
+	return defaultFilename(homeDir)
+}
+
+// GetClusters fetches the clusters published by the Keymaster server at
+// baseURL.
+func GetClusters(baseURL string, client *http.Client) (
+	[]proto.KubernetesCluster, error) {
+	return getClusters(baseURL, client)
+}
+
+// Merge adds or replaces the entries for the clusters in the kubeconfig
+// file, creating it if needed. Other entries and settings are preserved.
+// Existing entries with the same names are overwritten.
+func Merge(filename string, params Params) (*Result, error) {
+	return merge(filename, params)
+}
+
+// NewExecCredential returns the credential for a PEM certificate and key
+// pair. The expiration is the one of the certificate.
+func NewExecCredential(certPEM, keyPEM []byte) (*ExecCredential, error) {
+	return newExecCredential(certPEM, keyPEM)
+}
+
+// CertificateExpiration returns when the PEM certificate and key pair
+// expires. It fails if they do not match.
+func CertificateExpiration(certPEM, keyPEM []byte) (time.Time, error) {
+	return certificateExpiration(certPEM, keyPEM)
+}
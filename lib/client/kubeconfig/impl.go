@@ -0,0 +1,191 @@
+package kubeconfig
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"gopkg.in/yaml.v2"
+)
+
+// kubeconfigType only has the fields that are changed, everything else is
+// kept in the inline maps so that it is written back unchanged.
+type kubeconfigType struct {
+	APIVersion     string                 `yaml:"apiVersion"`
+	Kind           string                 `yaml:"kind"`
+	Clusters       []namedEntry           `yaml:"clusters"`
+	Contexts       []namedEntry           `yaml:"contexts"`
+	CurrentContext string                 `yaml:"current-context"`
+	Users          []namedEntry           `yaml:"users"`
+	Other          map[string]interface{} `yaml:",inline"`
+}
+
+type namedEntry struct {
+	Name  string                 `yaml:"name"`
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+func defaultFilename(homeDir string) string {
+	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+		for _, filename := range filepath.SplitList(kubeconfig) {
+			if filename != "" {
+				return filename
+			}
+		}
+	}
+	return filepath.Join(homeDir, ".kube", "config")
+}
+
+func getClusters(baseURL string, client *http.Client) (
+	[]proto.KubernetesCluster, error) {
+	resp, err := client.Get(strings.TrimSuffix(baseURL, "/") +
+		proto.KubernetesClustersPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting kubernetes clusters: %s",
+			resp.Status)
+	}
+	var response proto.KubernetesClustersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response.Clusters, nil
+}
+
+// upsert replaces the entry with the same name, or appends it.
+func upsert(entries []namedEntry, name string, key string,
+	value map[string]interface{}) []namedEntry {
+	entry := namedEntry{Name: name, Other: map[string]interface{}{key: value}}
+	for index := range entries {
+		if entries[index].Name == name {
+			entries[index] = entry
+			return entries
+		}
+	}
+	return append(entries, entry)
+}
+
+func readKubeconfig(filename string) (*kubeconfigType, error) {
+	config := &kubeconfigType{}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", filename, err)
+	}
+	if config.APIVersion == "" {
+		config.APIVersion = "v1"
+	}
+	if config.Kind == "" {
+		config.Kind = "Config"
+	}
+	return config, nil
+}
+
+func writeKubeconfig(filename string, config *kubeconfigType) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	tmpFilename := filename + "~"
+	if err := os.WriteFile(tmpFilename, data, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilename)
+	return os.Rename(tmpFilename, filename)
+}
+
+func merge(filename string, params Params) (*Result, error) {
+	if len(params.Clusters) < 1 {
+		return nil, errors.New("no clusters")
+	}
+	if params.UserName == "" || params.Exec.Command == "" {
+		return nil, errors.New("user name and exec command are required")
+	}
+	config, err := readKubeconfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	for _, cluster := range params.Clusters {
+		clusterValue := map[string]interface{}{"server": cluster.Server}
+		if len(cluster.CertificateAuthorityData) > 0 {
+			clusterValue["certificate-authority-data"] =
+				base64.StdEncoding.EncodeToString(
+					cluster.CertificateAuthorityData)
+		}
+		config.Clusters = upsert(config.Clusters, cluster.Name, "cluster",
+			clusterValue)
+		contextValue := map[string]interface{}{
+			"cluster": cluster.Name,
+			"user":    params.UserName,
+		}
+		if cluster.Namespace != "" {
+			contextValue["namespace"] = cluster.Namespace
+		}
+		config.Contexts = upsert(config.Contexts, cluster.Name, "context",
+			contextValue)
+		result.Contexts = append(result.Contexts, cluster.Name)
+	}
+	execValue := map[string]interface{}{
+		"apiVersion":      ExecCredentialAPIVersion,
+		"command":         params.Exec.Command,
+		"interactiveMode": "IfAvailable",
+	}
+	if len(params.Exec.Args) > 0 {
+		execValue["args"] = params.Exec.Args
+	}
+	if params.Exec.InstallHint != "" {
+		execValue["installHint"] = params.Exec.InstallHint
+	}
+	config.Users = upsert(config.Users, params.UserName, "user",
+		map[string]interface{}{"exec": execValue})
+	if config.CurrentContext == "" {
+		config.CurrentContext = params.Clusters[0].Name
+		result.CurrentContext = config.CurrentContext
+	}
+	if err := writeKubeconfig(filename, config); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func certificateExpiration(certPEM, keyPEM []byte) (time.Time, error) {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return keyPair.Leaf.NotAfter, nil
+}
+
+func newExecCredential(certPEM, keyPEM []byte) (*ExecCredential, error) {
+	notAfter, err := certificateExpiration(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecCredential{
+		APIVersion: ExecCredentialAPIVersion,
+		Kind:       ExecCredentialKind,
+		Status: ExecCredentialStatus{
+			ExpirationTimestamp:   notAfter.UTC().Format(time.RFC3339),
+			ClientCertificateData: string(certPEM),
+			ClientKeyData:         string(keyPEM),
+		},
+	}, nil
+}
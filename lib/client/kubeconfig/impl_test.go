@@ -0,0 +1,245 @@
+package kubeconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"gopkg.in/yaml.v2"
+)
+
+const existingKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: other
+  cluster:
+    server: https://other.example.com
+- name: prod
+  cluster:
+    server: https://old.example.com
+contexts:
+- name: other
+  context:
+    cluster: other
+    user: other-user
+current-context: other
+preferences:
+  colors: true
+users:
+- name: other-user
+  user:
+    token: secret
+`
+
+func testParams() Params {
+	return Params{
+		Clusters: []proto.KubernetesCluster{
+			{Name: "prod", Server: "https://prod.example.com:6443",
+				CertificateAuthorityData: []byte("CA"), Namespace: "apps"},
+			{Name: "dev", Server: "https://dev.example.com"},
+		},
+		UserName: "keymaster",
+		Exec: ExecConfig{
+			Command: "/usr/bin/keymaster",
+			Args:    []string{"kubernetes-credential"},
+		},
+	}
+}
+
+func findEntry(entries []namedEntry, name string) map[interface{}]interface{} {
+	for _, entry := range entries {
+		if entry.Name == name {
+			for _, value := range entry.Other {
+				return value.(map[interface{}]interface{})
+			}
+		}
+	}
+	return nil
+}
+
+func TestMergeExisting(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(filename, []byte(existingKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Merge(filename, testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Contexts) != 2 || result.CurrentContext != "" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	config, err := readKubeconfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CurrentContext != "other" {
+		t.Fatalf("current context changed to: %s", config.CurrentContext)
+	}
+	if _, ok := config.Other["preferences"]; !ok {
+		t.Fatal("preferences lost")
+	}
+	if len(config.Clusters) != 3 || len(config.Contexts) != 3 ||
+		len(config.Users) != 2 {
+		t.Fatalf("unexpected entries: %+v", config)
+	}
+	if findEntry(config.Users, "other-user")["token"] != "secret" {
+		t.Fatal("other user lost")
+	}
+	if server := findEntry(config.Clusters, "prod")["server"]; server != "https://prod.example.com:6443" {
+		t.Fatalf("cluster not replaced: %s", server)
+	}
+	if findEntry(config.Clusters, "prod")["certificate-authority-data"] != "Q0E=" {
+		t.Fatal("bad CA data")
+	}
+	context := findEntry(config.Contexts, "prod")
+	if context["user"] != "keymaster" || context["namespace"] != "apps" {
+		t.Fatalf("bad context: %v", context)
+	}
+	exec, ok := findEntry(config.Users, "keymaster")["exec"].(map[interface{}]interface{})
+	if !ok || exec["apiVersion"] != ExecCredentialAPIVersion ||
+		exec["command"] != "/usr/bin/keymaster" {
+		t.Fatalf("bad exec config: %v", exec)
+	}
+	// Merging again is idempotent.
+	if _, err := Merge(filename, testParams()); err != nil {
+		t.Fatal(err)
+	}
+	config, err = readKubeconfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Clusters) != 3 || len(config.Contexts) != 3 ||
+		len(config.Users) != 2 {
+		t.Fatalf("entries duplicated: %+v", config)
+	}
+}
+
+func TestMergeNew(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".kube", "config")
+	result, err := Merge(filename, testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CurrentContext != "prod" {
+		t.Fatalf("unexpected current context: %s", result.CurrentContext)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode: %s", fi.Mode())
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["apiVersion"] != "v1" || raw["kind"] != "Config" {
+		t.Fatalf("bad header: %v", raw)
+	}
+	if _, err := Merge(filename, Params{UserName: "keymaster"}); err == nil {
+		t.Fatal("merging no clusters should fail")
+	}
+}
+
+func TestDefaultFilename(t *testing.T) {
+	t.Setenv("KUBECONFIG", "")
+	if filename := DefaultFilename("/home/user"); filename != "/home/user/.kube/config" {
+		t.Fatalf("unexpected filename: %s", filename)
+	}
+	t.Setenv("KUBECONFIG", "/tmp/a"+string(filepath.ListSeparator)+"/tmp/b")
+	if filename := DefaultFilename("/home/user"); filename != "/tmp/a" {
+		t.Fatalf("unexpected filename: %s", filename)
+	}
+}
+
+func TestGetClusters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != proto.KubernetesClustersPath {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(proto.KubernetesClustersResponse{
+				Clusters: testParams().Clusters})
+		}))
+	defer server.Close()
+	clusters, err := GetClusters(server.URL+"/", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Name != "prod" {
+		t.Fatalf("unexpected clusters: %+v", clusters)
+	}
+}
+
+func TestNewExecCredential(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "username"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	credential, err := NewExecCredential(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiration, err := time.Parse(time.RFC3339,
+		credential.Status.ExpirationTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiration.Equal(notAfter) {
+		t.Fatalf("expiration %s != %s", expiration, notAfter)
+	}
+	if credential.Kind != ExecCredentialKind ||
+		credential.Status.ClientKeyData != string(keyPEM) {
+		t.Fatalf("bad credential: %+v", credential)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyDer, err := x509.MarshalPKCS8PrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewExecCredential(certPEM,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: otherKeyDer}))
+	if err == nil {
+		t.Fatal("mismatched key should fail")
+	}
+}
@@ -50,6 +50,34 @@ func deleteDuplicateEntries(comment string, agentClient agent.ExtendedAgent, log
 	return deletedCount, nil
 }
 
+func listCertificatesConnection(conn net.Conn) ([]Certificate, error) {
+	keyList, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, err
+	}
+	var certificates []Certificate
+	for _, key := range keyList {
+		pubKey, err := ssh.ParsePublicKey(key.Marshal())
+		if err != nil {
+			continue
+		}
+		if cert, ok := pubKey.(*ssh.Certificate); ok {
+			certificates = append(certificates,
+				Certificate{Comment: key.Comment, Certificate: cert})
+		}
+	}
+	return certificates, nil
+}
+
+func listCertificates() ([]Certificate, error) {
+	conn, err := connectToDefaultSSHAgentLocation()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return listCertificatesConnection(conn)
+}
+
 func upsertCertIntoAgentConnection(
 	certText []byte,
 	privateKey interface{},
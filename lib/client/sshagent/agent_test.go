@@ -2,6 +2,7 @@ package sshagent
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"runtime"
 	"testing"
@@ -154,3 +155,39 @@ func TestDeleteDuplicateEntries(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestListCertificatesConnection(t *testing.T) {
+	keyring := agent.NewKeyring()
+	privateKey, err := ssh.ParseRawPrivateKey([]byte(demoKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(demoCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keyring.Add(agent.AddedKey{
+		PrivateKey:  privateKey,
+		Certificate: pubKey.(*ssh.Certificate),
+		Comment:     "keymaster-rsa-username",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Plain keys are not listed.
+	if err := keyring.Add(agent.AddedKey{PrivateKey: privateKey}); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go agent.ServeAgent(keyring, serverConn)
+	certificates, err := ListCertificatesConnection(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificates) != 1 ||
+		certificates[0].Comment != "keymaster-rsa-username" ||
+		certificates[0].Certificate.KeyId != pubKey.(*ssh.Certificate).KeyId {
+		t.Fatalf("unexpected certificates: %+v", certificates)
+	}
+}
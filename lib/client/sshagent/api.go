@@ -1,8 +1,12 @@
 package sshagent
 
 import (
-	"golang.org/x/crypto/ssh/agent"
+	"io"
 	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
@@ -34,3 +38,73 @@ func WithAddedKeyUpsertCertIntoAgent(certToAdd agent.AddedKey, logger log.DebugL
 func WithAddedKeyUpsertCertIntoAgentConnection(certToAdd agent.AddedKey, conn net.Conn, logger log.DebugLogger) error {
 	return withAddedKeyUpsertCertIntoAgentConnection(certToAdd, conn, logger)
 }
+
+// Certificate is a certificate held by an SSH agent.
+type Certificate struct {
+	Comment     string
+	Certificate *ssh.Certificate
+}
+
+// ListCertificates returns the certificates held by the default SSH agent.
+func ListCertificates() ([]Certificate, error) {
+	return listCertificates()
+}
+
+// ListCertificatesConnection returns the certificates held by the SSH agent
+// at the other end of conn.
+func ListCertificatesConnection(conn net.Conn) ([]Certificate, error) {
+	return listCertificatesConnection(conn)
+}
+
+// KeyPolicy restricts the use of a key held by an Agent.
+type KeyPolicy struct {
+	// If not empty, the key may only be used to authenticate to hosts
+	// matching one of these patterns (i.e. *.example.com). The destination
+	// is learnt from the session-bind extension of OpenSSH 8.9 and later
+	// and its host key must be in the known hosts files. Hashed known hosts
+	// entries only match patterns without wildcards. Restricted keys are
+	// not used through forwarded connections.
+	AllowedHosts []string
+}
+
+type AgentParams struct {
+	// Used to find the names of the destination hosts. Missing files are
+	// ignored.
+	KnownHostsFiles []string
+	Logger          log.DebugLogger
+	// Optional socket of an agent holding other keys, usually the system
+	// agent. Keys added by clients (i.e. with ssh-add) are stored in it.
+	// Each client connection gets its own upstream connection, so that
+	// session bindings are not shared between clients.
+	UpstreamSocket string
+}
+
+// Agent is an SSH agent for keymaster-issued certificates. Every use of
+// a key is logged, and keys are removed when their certificate expires.
+type Agent struct {
+	params   AgentParams
+	keyring  agent.ExtendedAgent
+	mutex    sync.Mutex
+	policies map[string]keyPolicy // Key: marshalled public key.
+}
+
+// NewAgent returns an empty agent.
+func NewAgent(params AgentParams) *Agent {
+	return newAgent(params)
+}
+
+// AddCertificate adds or replaces (by comment) a certificate and its key.
+// The lifetime is set to the remaining validity of the certificate.
+func (a *Agent) AddCertificate(key agent.AddedKey, policy KeyPolicy) error {
+	return a.addCertificate(key, policy)
+}
+
+// Serve serves agent requests from clients. It only returns on error.
+func (a *Agent) Serve(listener net.Listener) error {
+	return a.serve(listener)
+}
+
+// ServeConn serves agent requests on a single connection.
+func (a *Agent) ServeConn(conn io.ReadWriter) error {
+	return a.serveConn(conn)
+}
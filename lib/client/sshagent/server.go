@@ -0,0 +1,550 @@
+package sshagent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sessionBindExtension = "session-bind@openssh.com"
+	hostboundMethod      = "publickey-hostbound-v00@openssh.com"
+	maxSessionBinds      = 16 // As OpenSSH.
+)
+
+var errNotAllowed = errors.New("key not allowed for this destination")
+
+type keyPolicy struct {
+	KeyPolicy
+	comment   string
+	notAfter  time.Time
+	publicKey ssh.PublicKey
+}
+
+// session is the state of one client connection.
+type session struct {
+	agent *Agent
+	// Sessions bound to the connection, the last one is the current hop.
+	binds    []sessionBind
+	upstream agent.ExtendedAgent // Connected on first use.
+	closer   io.Closer
+}
+
+type sessionBind struct {
+	hostKey    ssh.PublicKey
+	sessionID  []byte
+	forwarding bool
+	message    []byte // Replayed to new upstream connections.
+}
+
+type sessionBindMsg struct {
+	HostKey      []byte
+	SessionID    []byte
+	Signature    []byte
+	IsForwarding bool
+}
+
+// userauthRequestMsg is the data signed for SSH public key authentication,
+// after the session ID.
+type userauthRequestMsg struct {
+	User    string `sshtype:"50"`
+	Service string
+	Method  string
+	HasSig  bool
+	Algo    string
+	PubKey  []byte
+	Rest    []byte `ssh:"rest"`
+}
+
+type hostboundRequestMsg struct {
+	HostKey []byte
+	Rest    []byte `ssh:"rest"`
+}
+
+func newAgent(params AgentParams) *Agent {
+	return &Agent{
+		params:   params,
+		keyring:  agent.NewKeyring().(agent.ExtendedAgent),
+		policies: make(map[string]keyPolicy),
+	}
+}
+
+func (a *Agent) addCertificate(key agent.AddedKey, policy KeyPolicy) error {
+	if key.Certificate == nil {
+		return errors.New("needs a certificate to be added")
+	}
+	for _, pattern := range policy.AllowedHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad host pattern %s: %s", pattern, err)
+		}
+	}
+	notAfter := time.Unix(int64(key.Certificate.ValidBefore), 0)
+	lifetime := time.Until(notAfter)
+	if lifetime <= 0 {
+		return errors.New("certificate expired")
+	}
+	key.LifetimeSecs = uint32(math.Ceil(lifetime.Seconds()))
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.expirePoliciesLocked()
+	for keyBlob, oldPolicy := range a.policies {
+		if oldPolicy.comment == key.Comment {
+			a.keyring.Remove(oldPolicy.publicKey)
+			delete(a.policies, keyBlob)
+		}
+	}
+	if err := a.keyring.Add(key); err != nil {
+		return err
+	}
+	a.policies[string(key.Certificate.Marshal())] = keyPolicy{
+		KeyPolicy: policy,
+		comment:   key.Comment,
+		notAfter:  notAfter,
+		publicKey: key.Certificate,
+	}
+	return nil
+}
+
+// expirePoliciesLocked forgets the policies of the keys expired by the
+// keyring.
+func (a *Agent) expirePoliciesLocked() {
+	now := time.Now()
+	for keyBlob, policy := range a.policies {
+		if now.After(policy.notAfter) {
+			delete(a.policies, keyBlob)
+		}
+	}
+}
+
+func (a *Agent) getPolicy(key ssh.PublicKey) (keyPolicy, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.expirePoliciesLocked()
+	policy, ok := a.policies[string(key.Marshal())]
+	return policy, ok
+}
+
+func (a *Agent) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			if err := a.serveConn(conn); err != nil && err != io.EOF {
+				a.params.Logger.Debugf(1, "ssh agent connection: %s\n", err)
+			}
+		}(conn)
+	}
+}
+
+func (a *Agent) serveConn(conn io.ReadWriter) error {
+	s := &session{agent: a}
+	defer s.close()
+	return agent.ServeAgent(s, conn)
+}
+
+// getUpstream returns the upstream agent for the session, connecting to it if
+// needed, or nil if there is none.
+func (s *session) getUpstream() (agent.ExtendedAgent, error) {
+	if s.upstream != nil || s.agent.params.UpstreamSocket == "" {
+		return s.upstream, nil
+	}
+	conn, err := net.Dial("unix", s.agent.params.UpstreamSocket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to upstream agent: %s", err)
+	}
+	upstream := agent.NewClient(conn)
+	for _, bind := range s.binds {
+		// Old agents do not support the extension.
+		_, err := upstream.Extension(sessionBindExtension, bind.message)
+		if isConnectionError(err) {
+			conn.Close()
+			return nil, fmt.Errorf("cannot bind upstream agent: %s", err)
+		}
+	}
+	s.upstream = upstream
+	s.closer = conn
+	return s.upstream, nil
+}
+
+// isConnectionError returns true if err is an I/O error rather than a
+// failure reported by the agent. The agent client does not wrap them.
+func isConnectionError(err error) bool {
+	return err != nil &&
+		strings.HasPrefix(err.Error(), "agent: client error: ")
+}
+
+// upstreamFailed drops the upstream connection after an I/O error, so that
+// the next request reconnects.
+func (s *session) upstreamFailed(err error) {
+	if isConnectionError(err) {
+		s.close()
+	}
+}
+
+func (s *session) close() {
+	if s.closer != nil {
+		s.closer.Close()
+		s.closer = nil
+	}
+	s.upstream = nil
+}
+
+// destinationNames returns the names of the host with hostKey in the known
+// hosts files.
+func (a *Agent) destinationNames(hostKey ssh.PublicKey) []string {
+	keyBlob := hostKey.Marshal()
+	var names []string
+	for _, filename := range a.params.KnownHostsFiles {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		for rest := data; len(rest) > 0; {
+			var marker string
+			var hosts []string
+			var pubKey ssh.PublicKey
+			marker, hosts, pubKey, _, rest, err = ssh.ParseKnownHosts(rest)
+			if err != nil {
+				break
+			}
+			if marker != "" || !bytes.Equal(pubKey.Marshal(), keyBlob) {
+				continue
+			}
+			for _, host := range hosts {
+				if strings.HasPrefix(host, "|") { // Hashed.
+					continue
+				}
+				if strings.HasPrefix(host, "[") {
+					if host, _, err = net.SplitHostPort(host); err != nil {
+						continue
+					}
+				}
+				names = append(names, host)
+			}
+		}
+	}
+	return names
+}
+
+// isKnownHost returns true if hostname has hostKey in the known hosts files,
+// including hashed entries.
+func (a *Agent) isKnownHost(hostname string, hostKey ssh.PublicKey) bool {
+	var filenames []string
+	for _, filename := range a.params.KnownHostsFiles {
+		if _, err := os.Stat(filename); err == nil {
+			filenames = append(filenames, filename)
+		}
+	}
+	if len(filenames) < 1 {
+		return false
+	}
+	callback, err := knownhosts.New(filenames...)
+	if err != nil {
+		a.params.Logger.Println(err)
+		return false
+	}
+	address := net.JoinHostPort(hostname, "22")
+	return callback(address, &net.TCPAddr{IP: net.IPv4zero, Port: 22},
+		hostKey) == nil
+}
+
+// parseUserauthRequest returns the session ID and, for host bound requests,
+// the host key in the data signed for a public key authentication with key.
+func parseUserauthRequest(data []byte, key ssh.PublicKey) ([]byte,
+	ssh.PublicKey, error) {
+	var sessionID struct {
+		SessionID []byte
+		Rest      []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &sessionID); err != nil {
+		return nil, nil, errors.New("not a userauth request")
+	}
+	var msg userauthRequestMsg
+	if err := ssh.Unmarshal(sessionID.Rest, &msg); err != nil {
+		return nil, nil, errors.New("not a userauth request")
+	}
+	if !msg.HasSig || !bytes.Equal(msg.PubKey, key.Marshal()) {
+		return nil, nil, errors.New("userauth request for another key")
+	}
+	switch msg.Method {
+	case "publickey":
+		if len(msg.Rest) > 0 {
+			return nil, nil, errors.New("trailing data in userauth request")
+		}
+		return sessionID.SessionID, nil, nil
+	case hostboundMethod:
+		var hostbound hostboundRequestMsg
+		if err := ssh.Unmarshal(msg.Rest, &hostbound); err != nil {
+			return nil, nil, err
+		}
+		if len(hostbound.Rest) > 0 {
+			return nil, nil, errors.New("trailing data in userauth request")
+		}
+		hostKey, err := ssh.ParsePublicKey(hostbound.HostKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sessionID.SessionID, hostKey, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported userauth method: %s", msg.Method)
+}
+
+// checkDestination returns the name of the destination allowed by policy
+// for signing data in the session.
+func (s *session) checkDestination(policy keyPolicy, key ssh.PublicKey,
+	data []byte) (string, error) {
+	if len(policy.AllowedHosts) < 1 {
+		return "", nil
+	}
+	if len(s.binds) < 1 {
+		return "", errors.New("unknown destination")
+	}
+	bind := s.binds[len(s.binds)-1]
+	if bind.forwarding {
+		return "", errors.New("restricted key used through forwarding")
+	}
+	sessionID, hostKey, err := parseUserauthRequest(data, key)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(sessionID, bind.sessionID) {
+		return "", errors.New("userauth request for another session")
+	}
+	if hostKey != nil &&
+		!bytes.Equal(hostKey.Marshal(), bind.hostKey.Marshal()) {
+		return "", errors.New("userauth request for another host")
+	}
+	return s.agent.checkHost(policy, bind.hostKey)
+}
+
+// checkHost returns the name of the destination allowed by policy.
+func (a *Agent) checkHost(policy keyPolicy,
+	destination ssh.PublicKey) (string, error) {
+	names := a.destinationNames(destination)
+	for _, pattern := range policy.AllowedHosts {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched {
+				return name, nil
+			}
+		}
+		if !strings.ContainsAny(pattern, "*?[") &&
+			a.isKnownHost(pattern, destination) {
+			return pattern, nil
+		}
+	}
+	return "", errNotAllowed
+}
+
+func (s *session) List() ([]*agent.Key, error) {
+	keys, err := s.agent.keyring.List()
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := s.getUpstream()
+	if err == nil && upstream == nil {
+		return keys, nil
+	}
+	var upstreamKeys []*agent.Key
+	if err == nil {
+		upstreamKeys, err = upstream.List()
+		s.upstreamFailed(err)
+	}
+	if err != nil {
+		s.agent.params.Logger.Debugf(0, "cannot list upstream agent: %s\n", err)
+		return keys, nil
+	}
+	ownKeys := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		ownKeys[string(key.Marshal())] = struct{}{}
+	}
+	for _, key := range upstreamKeys {
+		if _, ok := ownKeys[string(key.Marshal())]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *session) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature,
+	error) {
+	return s.SignWithFlags(key, data, 0)
+}
+
+func (s *session) SignWithFlags(key ssh.PublicKey, data []byte,
+	flags agent.SignatureFlags) (*ssh.Signature, error) {
+	logger := s.agent.params.Logger
+	policy, ok := s.agent.getPolicy(key)
+	if !ok {
+		upstream, err := s.getUpstream()
+		if err != nil {
+			return nil, err
+		}
+		if upstream == nil {
+			// Added by a client, without policy.
+			return s.agent.keyring.SignWithFlags(key, data, flags)
+		}
+		signature, err := upstream.SignWithFlags(key, data, flags)
+		s.upstreamFailed(err)
+		return signature, err
+	}
+	name, err := s.checkDestination(policy, key, data)
+	if err != nil {
+		logger.Printf("ssh agent: denied use of %s: %s\n", policy.comment, err)
+		return nil, err
+	}
+	signature, err := s.agent.keyring.SignWithFlags(key, data, flags)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		logger.Printf("ssh agent: used %s\n", policy.comment)
+	} else {
+		logger.Printf("ssh agent: used %s for %s\n", policy.comment, name)
+	}
+	return signature, nil
+}
+
+func (s *session) Add(key agent.AddedKey) error {
+	upstream, err := s.getUpstream()
+	if err != nil {
+		return err
+	}
+	if upstream != nil {
+		err := upstream.Add(key)
+		s.upstreamFailed(err)
+		return err
+	}
+	return s.agent.keyring.Add(key)
+}
+
+func (s *session) Remove(key ssh.PublicKey) error {
+	s.agent.mutex.Lock()
+	_, ok := s.agent.policies[string(key.Marshal())]
+	delete(s.agent.policies, string(key.Marshal()))
+	s.agent.mutex.Unlock()
+	if ok {
+		return s.agent.keyring.Remove(key)
+	}
+	upstream, err := s.getUpstream()
+	if err != nil {
+		return err
+	}
+	if upstream == nil {
+		return s.agent.keyring.Remove(key)
+	}
+	err = upstream.Remove(key)
+	s.upstreamFailed(err)
+	return err
+}
+
+func (s *session) RemoveAll() error {
+	s.agent.mutex.Lock()
+	s.agent.policies = make(map[string]keyPolicy)
+	s.agent.mutex.Unlock()
+	if err := s.agent.keyring.RemoveAll(); err != nil {
+		return err
+	}
+	upstream, err := s.getUpstream()
+	if err != nil || upstream == nil {
+		return err
+	}
+	err = upstream.RemoveAll()
+	s.upstreamFailed(err)
+	return err
+}
+
+func (s *session) Lock(passphrase []byte) error {
+	if err := s.agent.keyring.Lock(passphrase); err != nil {
+		return err
+	}
+	upstream, err := s.getUpstream()
+	if err != nil || upstream == nil {
+		return err
+	}
+	err = upstream.Lock(passphrase)
+	s.upstreamFailed(err)
+	return err
+}
+
+func (s *session) Unlock(passphrase []byte) error {
+	if err := s.agent.keyring.Unlock(passphrase); err != nil {
+		return err
+	}
+	upstream, err := s.getUpstream()
+	if err != nil || upstream == nil {
+		return err
+	}
+	err = upstream.Unlock(passphrase)
+	s.upstreamFailed(err)
+	return err
+}
+
+func (s *session) Signers() ([]ssh.Signer, error) {
+	return s.agent.keyring.Signers()
+}
+
+func (s *session) Extension(extensionType string, contents []byte) (
+	[]byte, error) {
+	if extensionType != sessionBindExtension {
+		upstream, err := s.getUpstream()
+		if err != nil {
+			return nil, err
+		}
+		if upstream == nil {
+			return nil, agent.ErrExtensionUnsupported
+		}
+		response, err := upstream.Extension(extensionType, contents)
+		s.upstreamFailed(err)
+		return response, err
+	}
+	var msg sessionBindMsg
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(msg.Signature, &signature); err != nil {
+		return nil, err
+	}
+	if err := hostKey.Verify(msg.SessionID, &signature); err != nil {
+		return nil, fmt.Errorf("bad session-bind signature: %s", err)
+	}
+	if len(s.binds) > 0 && !s.binds[len(s.binds)-1].forwarding {
+		return nil, errors.New("connection already bound for authentication")
+	}
+	if len(s.binds) >= maxSessionBinds {
+		return nil, errors.New("too many session bindings")
+	}
+	bind := sessionBind{
+		hostKey:    hostKey,
+		sessionID:  msg.SessionID,
+		forwarding: msg.IsForwarding,
+		message:    contents,
+	}
+	if s.upstream != nil {
+		// Let the upstream agent apply its own restrictions. Old agents do
+		// not support the extension.
+		_, err := s.upstream.Extension(extensionType, contents)
+		s.upstreamFailed(err)
+	}
+	// Connecting to the upstream agent later replays the bindings.
+	s.binds = append(s.binds, bind)
+	return nil, nil
+}
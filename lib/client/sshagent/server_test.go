@@ -0,0 +1,308 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestSigner(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, signer
+}
+
+func newTestCertificate(t *testing.T, caSigner ssh.Signer,
+	lifetime time.Duration) (ed25519.PrivateKey, *ssh.Certificate) {
+	key, signer := newTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"username"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(lifetime).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func connectTestAgent(t *testing.T, a *Agent) agent.ExtendedAgent {
+	clientConn, serverConn := net.Pipe()
+	go a.ServeConn(serverConn)
+	t.Cleanup(func() { clientConn.Close() })
+	return agent.NewClient(clientConn)
+}
+
+func bindSession(t *testing.T, client agent.ExtendedAgent,
+	hostSigner ssh.Signer, forwarding bool) ([]byte, error) {
+	sessionID := make([]byte, 32)
+	if _, err := rand.Read(sessionID); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := hostSigner.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Extension(sessionBindExtension, ssh.Marshal(sessionBindMsg{
+		HostKey:      hostSigner.PublicKey().Marshal(),
+		SessionID:    sessionID,
+		Signature:    ssh.Marshal(signature),
+		IsForwarding: forwarding,
+	}))
+	return sessionID, err
+}
+
+// userauthData returns the data signed by an SSH client to authenticate with
+// key. If hostKey is not nil the request is host bound.
+func userauthData(sessionID []byte, key ssh.PublicKey,
+	hostKey ssh.PublicKey) []byte {
+	msg := userauthRequestMsg{
+		User:    "username",
+		Service: "ssh-connection",
+		Method:  "publickey",
+		HasSig:  true,
+		Algo:    key.Type(),
+		PubKey:  key.Marshal(),
+	}
+	if hostKey != nil {
+		msg.Method = hostboundMethod
+		msg.Rest = ssh.Marshal(struct{ HostKey []byte }{hostKey.Marshal()})
+	}
+	return append(ssh.Marshal(struct{ SessionID []byte }{sessionID}),
+		ssh.Marshal(msg)...)
+}
+
+func TestAgentDestinationRestrictions(t *testing.T) {
+	_, caSigner := newTestSigner(t)
+	_, allowedHost := newTestSigner(t)
+	_, hashedHost := newTestSigner(t)
+	_, otherHost := newTestSigner(t)
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	knownHosts := strings.Join([]string{
+		knownhosts.Line([]string{"host1.example.com"},
+			allowedHost.PublicKey()),
+		knownhosts.Line([]string{knownhosts.HashHostname("hashed.example.org")},
+			hashedHost.PublicKey()),
+		knownhosts.Line([]string{"host2.example.org"}, otherHost.PublicKey()),
+	}, "\n") + "\n"
+	if err := os.WriteFile(knownHostsFile, []byte(knownHosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := NewAgent(AgentParams{
+		KnownHostsFiles: []string{knownHostsFile},
+		Logger:          testlogger.New(t),
+	})
+	key, cert := newTestCertificate(t, caSigner, time.Hour)
+	err := a.AddCertificate(agent.AddedKey{PrivateKey: key, Certificate: cert,
+		Comment: "keymaster"},
+		KeyPolicy{AllowedHosts: []string{"*.example.com", "hashed.example.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("challenge")
+	client := connectTestAgent(t, a)
+	keys, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "keymaster" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if _, err := client.Sign(cert, data); err == nil {
+		t.Fatal("sign without destination should fail")
+	}
+	for _, hostSigner := range []ssh.Signer{allowedHost, hashedHost} {
+		client := connectTestAgent(t, a)
+		sessionID, err := bindSession(t, client, hostSigner, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, hostKey := range []ssh.PublicKey{nil, hostSigner.PublicKey()} {
+			data := userauthData(sessionID, cert, hostKey)
+			signature, err := client.Sign(cert, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cert.Key.Verify(data, signature); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := client.Sign(cert, data); err == nil {
+			t.Fatal("sign of other data should fail")
+		}
+		otherData := userauthData([]byte("other session"), cert, nil)
+		if _, err := client.Sign(cert, otherData); err == nil {
+			t.Fatal("sign for other session should fail")
+		}
+		otherData = userauthData(sessionID, cert, otherHost.PublicKey())
+		if _, err := client.Sign(cert, otherData); err == nil {
+			t.Fatal("sign for other host key should fail")
+		}
+		if _, err := bindSession(t, client, otherHost, false); err == nil {
+			t.Fatal("binding again after authentication should fail")
+		}
+	}
+	client = connectTestAgent(t, a)
+	sessionID, err := bindSession(t, client, otherHost, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Sign(cert, userauthData(sessionID, cert, nil)); err == nil {
+		t.Fatal("sign for other host should fail")
+	}
+	// Restricted keys are not used through forwarded agents.
+	client = connectTestAgent(t, a)
+	if _, err := bindSession(t, client, allowedHost, true); err != nil {
+		t.Fatal(err)
+	}
+	sessionID, err = bindSession(t, client, allowedHost, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Sign(cert, userauthData(sessionID, cert, nil)); err == nil {
+		t.Fatal("sign through forwarding should fail")
+	}
+	// The host must prove the binding.
+	client = connectTestAgent(t, a)
+	sessionID = []byte("session")
+	signature, err := otherHost.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Extension(sessionBindExtension, ssh.Marshal(sessionBindMsg{
+		HostKey:   allowedHost.PublicKey().Marshal(),
+		SessionID: sessionID,
+		Signature: ssh.Marshal(signature),
+	}))
+	if err == nil {
+		t.Fatal("bad session-bind signature should fail")
+	}
+	if _, err := client.Sign(cert, userauthData(sessionID, cert, nil)); err == nil {
+		t.Fatal("sign after bad binding should fail")
+	}
+}
+
+// serveTestUpstream serves keyring on a socket and returns its path and a
+// function that closes the connections accepted so far.
+func serveTestUpstream(t *testing.T, keyring agent.Agent) (string, func()) {
+	socketPath := filepath.Join(t.TempDir(), "upstream.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var mutex sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	return socketPath, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}
+}
+
+func TestAgentUpstreamAndExpiration(t *testing.T) {
+	_, caSigner := newTestSigner(t)
+	upstream := agent.NewKeyring().(agent.ExtendedAgent)
+	upstreamKey, upstreamSigner := newTestSigner(t)
+	if err := upstream.Add(agent.AddedKey{PrivateKey: upstreamKey}); err != nil {
+		t.Fatal(err)
+	}
+	upstreamSocket, disconnect := serveTestUpstream(t, upstream)
+	a := NewAgent(AgentParams{Logger: testlogger.New(t),
+		UpstreamSocket: upstreamSocket})
+	key, cert := newTestCertificate(t, caSigner, 2*time.Second)
+	err := a.AddCertificate(agent.AddedKey{PrivateKey: key, Certificate: cert,
+		Comment: "keymaster"}, KeyPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replaced by comment.
+	key, cert = newTestCertificate(t, caSigner, 2*time.Second)
+	err = a.AddCertificate(agent.AddedKey{PrivateKey: key, Certificate: cert,
+		Comment: "keymaster"}, KeyPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := connectTestAgent(t, a)
+	keys, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	data := []byte("challenge")
+	if _, err := client.Sign(cert, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Sign(upstreamSigner.PublicKey(), data); err != nil {
+		t.Fatal(err)
+	}
+	// Keys added by clients go to the upstream agent.
+	otherKey, _ := newTestSigner(t)
+	if err := client.Add(agent.AddedKey{PrivateKey: otherKey}); err != nil {
+		t.Fatal(err)
+	}
+	if upstreamKeys, _ := upstream.List(); len(upstreamKeys) != 2 {
+		t.Fatal("key not added to upstream agent")
+	}
+	// The upstream agent is reconnected after a failure.
+	disconnect()
+	if _, err := client.Sign(upstreamSigner.PublicKey(), data); err == nil {
+		t.Fatal("sign with a closed upstream connection should fail")
+	}
+	if _, err := client.Sign(upstreamSigner.PublicKey(), data); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * time.Second)
+	keys, err = client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expired certificate not removed: %v", keys)
+	}
+	if _, err := client.Sign(cert, data); err == nil {
+		t.Fatal("sign with expired certificate should fail")
+	}
+	_, expiredCert := newTestCertificate(t, caSigner, -time.Second)
+	err = a.AddCertificate(agent.AddedKey{PrivateKey: key,
+		Certificate: expiredCert}, KeyPolicy{})
+	if err == nil {
+		t.Fatal("adding an expired certificate should fail")
+	}
+}
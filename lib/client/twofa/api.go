@@ -3,6 +3,7 @@ package twofa
 
 import (
 	"crypto"
+	"errors"
 	"flag"
 	"net/http"
 	"time"
@@ -21,6 +22,10 @@ var (
 	noVIPAccess = flag.Bool("noVIPAccess", false, "Don't use VIPAccess as second factor")
 )
 
+// ErrUnauthorized is wrapped in the error returned by DoCertRequest when the
+// server rejects the authentication cookie, usually because it has expired.
+var ErrUnauthorized = errors.New("authentication cookie rejected")
+
 // AuthenticateToTargetUrls does an authentication to the keymasted server
 // it performs 2fa if needed using the server side specified methods
 // it assumes the http client has a valid cookiejar
@@ -159,7 +159,7 @@ func genericAuthenticateWithToken(
 	// Read VIP token from client
 
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("Enter %s/OTP code (or wait for %s push): ", pushType, pushType)
+	fmt.Fprintf(os.Stderr, "Enter %s/OTP code (or wait for %s push): ", pushType, pushType)
 	otpText, err := reader.ReadString('\n')
 	if err != nil {
 		logger.Debugf(0, "codeText:  Failure to get string %s", err)
@@ -24,7 +24,7 @@ func doTOTPAuthenticate(
 	logger.Printf("top of doTOTPAuthenticate")
 
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("Enter TOTP code: ")
+	fmt.Fprint(os.Stderr, "Enter TOTP code: ")
 	totpText, err := reader.ReadString('\n')
 	if err != nil {
 		logger.Debugf(0, "codeText:  Failure to get string %s", err)
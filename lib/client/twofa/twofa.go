@@ -39,7 +39,7 @@ func createKeyBodyRequest(method, urlStr, filedata string) (*http.Request, error
 	//
 	fileWriter, err := bodyWriter.CreateFormFile("pubkeyfile", "somefilename.pub")
 	if err != nil {
-		fmt.Println("error writing to buffer")
+		fmt.Fprintln(os.Stderr, "error writing to buffer")
 		return nil, err
 	}
 	// When using a file this used to be: fh, err := os.Open(pubKeyFilename)
@@ -119,6 +119,10 @@ func doCertRequestInternal(client *http.Client,
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("got error from call %s, url='%s': %w",
+			resp.Status, targetURL, ErrUnauthorized)
+	}
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("got error from call %s, url='%s'", resp.Status, targetURL)
 	}
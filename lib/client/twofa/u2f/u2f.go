@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"strings"
 	"time"
@@ -285,7 +286,7 @@ func checkDeviceAuthSuccess(req *u2fhost.AuthenticateRequest, device u2fhost.Dev
 	for {
 		select {
 		case <-timeout:
-			fmt.Println("Failed to get authentication response after 3 seconds")
+			fmt.Fprintln(os.Stderr, "Failed to get authentication response after 3 seconds")
 			return false, nil
 		case <-interval.C:
 			_, err := device.Authenticate(req)
@@ -396,7 +397,7 @@ func authenticateHelper(req *u2fhost.AuthenticateRequest, devices []*u2fhost.Hid
 	for {
 		select {
 		case <-timeout:
-			fmt.Println("Failed to get authentication response after 25 seconds")
+			fmt.Fprintln(os.Stderr, "Failed to get authentication response after 25 seconds")
 			return nil, fmt.Errorf("Authentication timeout")
 		case <-interval.C:
 			for handleReq, device := range registeredDevices {
@@ -34,13 +34,13 @@ const rsaKeySize = 2048
 const maxPasswordLength = 512
 
 func getUserCreds(userName string) (password []byte, err error) {
-	fmt.Printf("Password for %s: ", userName)
+	fmt.Fprintf(os.Stderr, "Password for %s: ", userName)
 
 	if term.IsTerminal(int(os.Stdin.Fd())) {
 		password, err = term.ReadPassword(int(os.Stdin.Fd()))
 
 		// Always print newline, even on error
-		fmt.Println()
+		fmt.Fprintln(os.Stderr)
 
 		if err != nil {
 			return nil, fmt.Errorf("failed to read password: %w", err)
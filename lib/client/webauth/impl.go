@@ -117,13 +117,13 @@ func (s *state) getToken() (string, error) {
 	var token string
 	var inputData []byte
 	for {
-		fmt.Printf("Enter token: ")
+		fmt.Fprint(os.Stderr, "Enter token: ")
 		var err error
 		inputData, err = term.ReadPassword(int(syscall.Stdin))
 		if err != nil {
 			return "", err
 		}
-		fmt.Println()
+		fmt.Fprintln(os.Stderr)
 		token = strings.TrimSpace(string(inputData))
 		if _, err := parseToken(token); err != nil {
 			s.logger.Printf("Token appears invalid. Try again: %s\n", err)
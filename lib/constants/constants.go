@@ -7,4 +7,7 @@ const (
 	DefaultEventmonPortNumber          = 6921
 	DefaultKeymasterEventmonConfigFile = "/etc/keymaster-eventmond/config.yml"
 	DefaultKeymasterEventmonStateDir   = "/var/lib/keymaster-eventmond"
+
+	DefaultKeymasterSignerdConfigFile = "/etc/keymaster-signerd/config.yml"
+	DefaultKeymasterSignerdListen     = "unix:///run/keymaster-signerd/signer.sock"
 )
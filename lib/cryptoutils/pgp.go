@@ -59,3 +59,34 @@ func PGPArmorEncryptBytes(plaintext []byte, passphrase []byte) ([]byte, error) {
 	}
 	return armoredBuf.Bytes(), nil
 }
+
+// PGPArmorEncryptBytesToKeys encrypts plaintext to every key in the armored
+// public keyring.
+func PGPArmorEncryptBytesToKeys(plaintext []byte,
+	armoredKeyRing []byte) ([]byte, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armoredKeyRing))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read public keys: %s", err)
+	}
+	armoredBuf := new(bytes.Buffer)
+	armoredWriter, err := armor.Encode(armoredBuf, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintextWriter, err := openpgp.Encrypt(armoredWriter, entities, nil, nil,
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = plaintextWriter.Write(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if err := plaintextWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := armoredWriter.Close(); err != nil {
+		return nil, err
+	}
+	return armoredBuf.Bytes(), nil
+}
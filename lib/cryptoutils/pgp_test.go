@@ -2,8 +2,12 @@ package cryptoutils
 
 import (
 	"bytes"
+	"io"
 	"testing"
 
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
 	"github.com/Cloud-Foundations/keymaster/lib/certgen"
 )
 
@@ -63,3 +67,56 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 
 }
+
+func TestEncryptToKeysDecrypt(t *testing.T) {
+	entity, err := openpgp.NewEntity("custodian", "", "custodian@example.com",
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys without hash preferences default to the unavailable RIPEMD160.
+	for name, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		err := identity.SelfSignature.SignUserId(name, entity.PrimaryKey,
+			entity.PrivateKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var publicKeyBuffer bytes.Buffer
+	armoredWriter, err := armor.Encode(&publicKeyBuffer, openpgp.PublicKeyType,
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(armoredWriter); err != nil {
+		t.Fatal(err)
+	}
+	armoredWriter.Close()
+	inData := []byte("123456781234567")
+	armoredBytes, err := PGPArmorEncryptBytesToKeys(inData,
+		publicKeyBuffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	armorBlock, err := armor.Decode(bytes.NewReader(armoredBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(armorBlock.Body,
+		openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outData, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(inData, outData) {
+		t.Fatal("roundtrip fail")
+	}
+	_, err = PGPArmorEncryptBytesToKeys(inData, []byte("not a key"))
+	if err == nil {
+		t.Fatal("should fail with bad keyring")
+	}
+}
@@ -0,0 +1,324 @@
+package cryptoutils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Shamir secret sharing over GF(2^8) using the AES polynomial. Each share is
+// the evaluation of one random polynomial per secret byte, followed by the x
+// coordinate of the share.
+//
+// Unseal shares carry the SHA-256 digests of every share of the split, so a
+// corrupted share is detected on its own. The split secret is prefixed with a
+// random key which is used to MAC the secret, so that a wrong combination is
+// detected without revealing anything about the secret to a custodian.
+
+const unsealSharePrefix = "keymaster-unseal-share"
+const unsealShareVersion = "v2"
+const splitIDLength = 8
+const unsealMACKeyLength = 32
+
+var ErrBadUnsealChecksum = errors.New(
+	"combined shares do not match the secret checksum")
+
+// UnsealShare is one of the shares of a split secret, tagged with the split
+// it belongs to and how many shares are needed to recover the secret.
+type UnsealShare struct {
+	SplitID      string
+	Threshold    int
+	Share        []byte
+	SecretMAC    []byte   // HMAC-SHA256 of the secret.
+	ShareDigests [][]byte // SHA-256 of every share, indexed by x-1.
+}
+
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		if b&1 == 1 {
+			product ^= a
+		}
+		highBit := a & 0x80
+		a <<= 1
+		if highBit != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+// gfInverse returns a^254 which is the multiplicative inverse of a.
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+func evaluatePolynomial(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfMul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// SplitSecret splits secret into parts shares, any threshold of which can be
+// combined to recover the secret.
+func SplitSecret(secret []byte, parts int, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 2 || threshold > parts {
+		return nil, fmt.Errorf("threshold must be between 2 and %d", parts)
+	}
+	if parts > 255 {
+		return nil, errors.New("cannot split into more than 255 shares")
+	}
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	for index, secretByte := range secret {
+		coefficients[0] = secretByte
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share[index] = evaluatePolynomial(coefficients, share[len(secret)])
+		}
+	}
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+	return shares, nil
+}
+
+// CombineShares recovers a secret from shares made by SplitSecret. Combining
+// fewer shares than the threshold returns garbage rather than an error.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are needed")
+	}
+	shareLength := len(shares[0])
+	if shareLength < 2 {
+		return nil, errors.New("share too short")
+	}
+	xValues := make([]byte, len(shares))
+	seen := make(map[byte]struct{})
+	for i, share := range shares {
+		if len(share) != shareLength {
+			return nil, errors.New("shares have different lengths")
+		}
+		x := share[shareLength-1]
+		if _, ok := seen[x]; ok || x == 0 {
+			return nil, errors.New("duplicate or invalid share")
+		}
+		seen[x] = struct{}{}
+		xValues[i] = x
+	}
+	secret := make([]byte, shareLength-1)
+	for i, share := range shares {
+		// Lagrange basis polynomial for share i evaluated at zero.
+		numerator := byte(1)
+		denominator := byte(1)
+		for j := range shares {
+			if i == j {
+				continue
+			}
+			numerator = gfMul(numerator, xValues[j])
+			denominator = gfMul(denominator, xValues[i]^xValues[j])
+		}
+		basis := gfMul(numerator, gfInverse(denominator))
+		for index := range secret {
+			secret[index] ^= gfMul(share[index], basis)
+		}
+	}
+	return secret, nil
+}
+
+// SplitSecretToUnsealShares is like SplitSecret but returns tagged shares
+// with a fresh random split identifier and the checksums needed to verify
+// them.
+func SplitSecretToUnsealShares(secret []byte, parts int,
+	threshold int) ([]UnsealShare, error) {
+	macKey := make([]byte, unsealMACKeyLength, unsealMACKeyLength+len(secret))
+	if _, err := rand.Read(macKey); err != nil {
+		return nil, err
+	}
+	secretMAC := computeUnsealMAC(macKey, secret)
+	keyedSecret := append(macKey, secret...)
+	rawShares, err := SplitSecret(keyedSecret, parts, threshold)
+	for i := range keyedSecret {
+		keyedSecret[i] = 0
+	}
+	if err != nil {
+		return nil, err
+	}
+	splitID := make([]byte, splitIDLength)
+	if _, err := rand.Read(splitID); err != nil {
+		return nil, err
+	}
+	shareDigests := make([][]byte, 0, len(rawShares))
+	for _, rawShare := range rawShares {
+		digest := sha256.Sum256(rawShare)
+		shareDigests = append(shareDigests, digest[:])
+	}
+	shares := make([]UnsealShare, 0, len(rawShares))
+	for _, rawShare := range rawShares {
+		shares = append(shares, UnsealShare{
+			SplitID:      hex.EncodeToString(splitID),
+			Threshold:    threshold,
+			Share:        rawShare,
+			SecretMAC:    secretMAC,
+			ShareDigests: shareDigests,
+		})
+	}
+	return shares, nil
+}
+
+// CombineUnsealShares recovers the secret from verified shares of the same
+// split. It returns ErrBadUnsealChecksum if the result is not the secret
+// which was split.
+func CombineUnsealShares(shares []UnsealShare) ([]byte, error) {
+	rawShares := make([][]byte, 0, len(shares))
+	for _, share := range shares {
+		if err := share.Verify(); err != nil {
+			return nil, err
+		}
+		if !share.SameSplit(&shares[0]) {
+			return nil, errors.New("shares belong to different splits")
+		}
+		rawShares = append(rawShares, share.Share)
+	}
+	keyedSecret, err := CombineShares(rawShares)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyedSecret) <= unsealMACKeyLength {
+		return nil, errors.New("share too short")
+	}
+	macKey := keyedSecret[:unsealMACKeyLength]
+	secret := append([]byte{}, keyedSecret[unsealMACKeyLength:]...)
+	valid := hmac.Equal(computeUnsealMAC(macKey, secret),
+		shares[0].SecretMAC)
+	for i := range keyedSecret {
+		keyedSecret[i] = 0
+	}
+	if !valid {
+		for i := range secret {
+			secret[i] = 0
+		}
+		return nil, ErrBadUnsealChecksum
+	}
+	return secret, nil
+}
+
+func computeUnsealMAC(macKey, secret []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// SameSplit returns true if share and other were made by the same split.
+func (share *UnsealShare) SameSplit(other *UnsealShare) bool {
+	if share.SplitID != other.SplitID || share.Threshold != other.Threshold ||
+		!bytes.Equal(share.SecretMAC, other.SecretMAC) ||
+		len(share.ShareDigests) != len(other.ShareDigests) {
+		return false
+	}
+	for index, digest := range share.ShareDigests {
+		if !bytes.Equal(digest, other.ShareDigests[index]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify checks the share data against the digest of the share.
+func (share *UnsealShare) Verify() error {
+	if len(share.Share) < 2 {
+		return errors.New("invalid share data")
+	}
+	x := int(share.Share[len(share.Share)-1])
+	if x < 1 || x > len(share.ShareDigests) {
+		return errors.New("invalid share index")
+	}
+	digest := sha256.Sum256(share.Share)
+	if !hmac.Equal(digest[:], share.ShareDigests[x-1]) {
+		return fmt.Errorf("share %d does not match its checksum", x)
+	}
+	return nil
+}
+
+// String returns the text encoding of the share, which is what custodians
+// submit to keymasterd.
+func (share UnsealShare) String() string {
+	checksums := append([]byte{}, share.SecretMAC...)
+	for _, digest := range share.ShareDigests {
+		checksums = append(checksums, digest...)
+	}
+	return strings.Join([]string{unsealSharePrefix, unsealShareVersion,
+		share.SplitID, strconv.Itoa(share.Threshold),
+		base64.RawURLEncoding.EncodeToString(share.Share),
+		base64.RawURLEncoding.EncodeToString(checksums)}, ":")
+}
+
+// ParseUnsealShare parses the output of UnsealShare.String and verifies the
+// share against its checksum.
+func ParseUnsealShare(text string) (*UnsealShare, error) {
+	fields := strings.Split(strings.TrimSpace(text), ":")
+	if len(fields) < 2 || fields[0] != unsealSharePrefix {
+		return nil, errors.New("not a keymaster unseal share")
+	}
+	if fields[1] != unsealShareVersion {
+		return nil, fmt.Errorf("unsupported share version: %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("not a keymaster unseal share")
+	}
+	splitID, err := hex.DecodeString(fields[2])
+	if err != nil || len(splitID) != splitIDLength {
+		return nil, errors.New("invalid split identifier")
+	}
+	threshold, err := strconv.Atoi(fields[3])
+	if err != nil || threshold < 2 || threshold > 255 {
+		return nil, errors.New("invalid threshold")
+	}
+	rawShare, err := base64.RawURLEncoding.DecodeString(fields[4])
+	if err != nil || len(rawShare) < 2 || rawShare[len(rawShare)-1] == 0 {
+		return nil, errors.New("invalid share data")
+	}
+	checksums, err := base64.RawURLEncoding.DecodeString(fields[5])
+	if err != nil || len(checksums)%sha256.Size != 0 ||
+		len(checksums) < sha256.Size*(threshold+1) {
+		return nil, errors.New("invalid share checksums")
+	}
+	share := &UnsealShare{
+		SplitID:   fields[2],
+		Threshold: threshold,
+		Share:     rawShare,
+		SecretMAC: checksums[:sha256.Size],
+	}
+	for offset := sha256.Size; offset < len(checksums); offset += sha256.Size {
+		share.ShareDigests = append(share.ShareDigests,
+			checksums[offset:offset+sha256.Size])
+	}
+	if err := share.Verify(); err != nil {
+		return nil, err
+	}
+	return share, nil
+}
@@ -0,0 +1,125 @@
+package cryptoutils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInverse(byte(a))) != 1 {
+			t.Fatalf("bad inverse for %d", a)
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("got %d shares", len(shares))
+	}
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4},
+		{0, 1, 2, 3, 4}} {
+		var selected [][]byte
+		for _, index := range subset {
+			selected = append(selected, shares[index])
+		}
+		recovered, err := CombineShares(selected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(recovered, secret) {
+			t.Fatalf("subset %v recovered %q", subset, recovered)
+		}
+	}
+	recovered, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(recovered, secret) {
+		t.Fatal("recovered secret below threshold")
+	}
+	if _, err := CombineShares([][]byte{shares[0], shares[0]}); err == nil {
+		t.Fatal("duplicate shares should fail")
+	}
+	for _, badThreshold := range []int{0, 1, 6} {
+		if _, err := SplitSecret(secret, 5, badThreshold); err == nil {
+			t.Fatalf("threshold %d should fail", badThreshold)
+		}
+	}
+}
+
+func TestUnsealShareEncoding(t *testing.T) {
+	shares, err := SplitSecretToUnsealShares([]byte("password"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shares[0].SplitID != shares[2].SplitID {
+		t.Fatal("shares should have the same split id")
+	}
+	parsed, err := ParseUnsealShare(shares[1].String() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.SplitID != shares[1].SplitID || parsed.Threshold != 2 ||
+		!bytes.Equal(parsed.Share, shares[1].Share) {
+		t.Fatalf("bad roundtrip %+v", parsed)
+	}
+	if !parsed.SameSplit(&shares[0]) {
+		t.Fatal("parsed share should belong to the same split")
+	}
+	fields := strings.Split(shares[1].String(), ":")
+	for _, bad := range []string{"", "password",
+		"keymaster-unseal-share:v1:0011223344556677:2:AAE",
+		"keymaster-unseal-share:v2:0011223344556677:2:AAE",
+		"keymaster-unseal-share:v2:0011:2:AAE:" + fields[5],
+		"keymaster-unseal-share:v2:0011223344556677:1:AAE:" + fields[5],
+		"keymaster-unseal-share:v2:0011223344556677:2:AAA:" + fields[5],
+		"keymaster-unseal-share:v2:0011223344556677:2:AAE:" + fields[5],
+		strings.Join(fields[:5], ":") + ":AAAA"} {
+		if _, err := ParseUnsealShare(bad); err == nil {
+			t.Fatalf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestCombineUnsealShares(t *testing.T) {
+	shares, err := SplitSecretToUnsealShares([]byte("password"), 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := CombineUnsealShares(shares[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret) != "password" {
+		t.Fatalf("recovered %q", secret)
+	}
+	if _, err := CombineUnsealShares(shares[:2]); err != ErrBadUnsealChecksum {
+		t.Fatalf("expected ErrBadUnsealChecksum below threshold, got: %v",
+			err)
+	}
+	corrupted := shares[0]
+	corrupted.Share = append([]byte{}, corrupted.Share...)
+	corrupted.Share[0] ^= 1
+	if err := corrupted.Verify(); err == nil {
+		t.Fatal("corrupted share verified")
+	}
+	if _, err := CombineUnsealShares([]UnsealShare{corrupted, shares[1],
+		shares[2]}); err == nil {
+		t.Fatal("combined a corrupted share")
+	}
+	otherShares, err := SplitSecretToUnsealShares([]byte("password"), 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CombineUnsealShares([]UnsealShare{otherShares[0], shares[1],
+		shares[2]}); err == nil {
+		t.Fatal("combined shares of different splits")
+	}
+}
@@ -0,0 +1,63 @@
+package profilestore
+
+import (
+	"errors"
+)
+
+// ErrProfileChanged is returned by SwapProfile when the profile is not the
+// one expected.
+var ErrProfileChanged = errors.New("profile changed")
+
+// ProfileStore is an interface type that defines how keymasterd stores user
+// profiles and signed expiring data. Profiles are opaque to the store. The
+// signed data MUST be signed by the caller, since it may be stored out of the
+// memory space of the running process.
+type ProfileStore interface {
+	// GetUsers returns the usernames with a profile, sorted. fromCache is
+	// true if the data may be stale and must not be written back.
+	GetUsers() (names []string, fromCache bool, err error)
+	// LoadProfile returns the profile of a user. If there is no profile it
+	// returns nil, false and a nil error.
+	LoadProfile(username string) (data []byte, ok bool, fromCache bool,
+		err error)
+	// SaveProfile inserts or replaces the profile of a user.
+	SaveProfile(username string, data []byte) error
+	// DeleteProfile deletes the profile of a user.
+	DeleteProfile(username string) error
+	// GetSigned returns the data for a key and type if it exists and has not
+	// expired. If it does not exist or has expired it returns false, an empty
+	// string and nil.
+	GetSigned(key string, dataType int) (bool, string, error)
+	// UpsertSigned inserts or updates the data and expiration for a key and
+	// type.
+	UpsertSigned(key string, dataType int, expiration int64,
+		data string) error
+	// DeleteSigned deletes the data for a key and type.
+	DeleteSigned(key string, dataType int) error
+	// ListSigned returns all the signed data which has not expired.
+	ListSigned() ([]SignedData, error)
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// ProfileSwapper is implemented by the ProfileStores which can replace a
+// profile only if it has not changed since it was loaded.
+type ProfileSwapper interface {
+	// SwapProfile replaces the profile of a user with newData if it is
+	// oldData. Otherwise it returns ErrProfileChanged.
+	SwapProfile(username string, oldData, newData []byte) error
+}
+
+type SignedData struct {
+	Key             string
+	Type            int
+	Data            string
+	ExpirationEpoch int64
+}
+
+// Copy copies all the profiles and unexpired signed data from source to
+// destination, replacing existing entries. It returns the number of profiles
+// and signed data entries copied.
+func Copy(source, destination ProfileStore) (int, int, error) {
+	return copyStore(source, destination)
+}
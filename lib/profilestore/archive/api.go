@@ -0,0 +1,170 @@
+// Package archive implements signed backups of the data of keymasterd: the
+// user profiles and the signed data of a profilestore.ProfileStore.
+//
+// Profiles are stored by keymasterd in the gob encoding, which depends on the
+// Go types of keymasterd. Archives contain them in a stable JSON form instead,
+// so that they can be read and restored by other versions. The archive is
+// signed and may be encrypted with a passphrase.
+package archive
+
+import (
+	"crypto"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+// FormatVersion is the version of the archive format written. Archives with
+// a later version cannot be read.
+const FormatVersion = 1
+
+const (
+	ActionAdd          = "add"
+	ActionUpdate       = "update"
+	ActionNotInArchive = "not in archive" // Restore keeps these.
+)
+
+var ErrBadSignature = errors.New("archive signature verification failed")
+
+type Archive struct {
+	FormatVersion int          `json:"format_version"`
+	CreatedAt     time.Time    `json:"created_at"`
+	Users         []User       `json:"users"`
+	SignedData    []SignedData `json:"signed_data"`
+}
+
+type User struct {
+	Username string   `json:"username"`
+	Profile  *Profile `json:"profile"`
+}
+
+type SignedData struct {
+	Key             string `json:"key"`
+	Type            int    `json:"type"`
+	Data            string `json:"data"`
+	ExpirationEpoch int64  `json:"expiration_epoch"`
+}
+
+// Change is a difference between an archive and a ProfileStore.
+type Change struct {
+	Action string // ActionAdd, ActionUpdate or ActionNotInArchive.
+	Kind   string // "profile" or "signed data".
+	Key    string // The username for profiles.
+}
+
+// Profile is the stable form of a user profile of keymasterd. The field names
+// match the gob encoding of the profiles and the JSON names are the stable
+// names. Pending registration challenges are not kept.
+type Profile struct {
+	Username                   string                      `json:"username"`
+	DisplayName                string                      `json:"display_name,omitempty"`
+	UserHasRegistered2ndFactor bool                        `json:"has_registered_2nd_factor"`
+	LastSuccessfullTOTPCounter int64                       `json:"last_totp_counter,omitempty"`
+	BootstrapOTP               *BootstrapOTP               `json:"bootstrap_otp,omitempty"`
+	U2fAuthData                map[int64]*U2fAuthData      `json:"u2f_tokens,omitempty"`
+	TOTPAuthData               map[int64]*TOTPAuthData     `json:"totp_tokens,omitempty"`
+	WebauthnID                 uint64                      `json:"webauthn_id,omitempty"`
+	WebauthnData               map[int64]*WebauthnAuthData `json:"webauthn_tokens,omitempty"`
+	IdPConsents                map[string]*IdPConsent      `json:"idp_consents,omitempty"`
+}
+
+type BootstrapOTP struct {
+	ExpiresAt  time.Time `json:"expires_at"`
+	Sha512Hash []byte    `json:"sha512_hash"`
+}
+
+type U2fAuthData struct {
+	Enabled      bool             `json:"enabled"`
+	CreatedAt    time.Time        `json:"created_at"`
+	CreatorAddr  string           `json:"creator_addr,omitempty"`
+	Counter      uint32           `json:"counter"`
+	Name         string           `json:"name,omitempty"`
+	Registration *U2fRegistration `json:"registration,omitempty"`
+}
+
+// U2fRegistration is the raw registration data from a U2F token, the binary
+// form of a u2f.Registration.
+type U2fRegistration []byte
+
+type TOTPAuthData struct {
+	Enabled         bool      `json:"enabled"`
+	CreatedAt       time.Time `json:"created_at"`
+	Name            string    `json:"name,omitempty"`
+	EncryptedSecret [][]byte  `json:"encrypted_secret"`
+	TOTPType        int       `json:"totp_type"`
+	ValidatorAddr   string    `json:"validator_addr,omitempty"`
+}
+
+type WebauthnAuthData struct {
+	Enabled    bool                `json:"enabled"`
+	CreatedAt  time.Time           `json:"created_at"`
+	Name       string              `json:"name,omitempty"`
+	Credential webauthn.Credential `json:"credential"`
+}
+
+type IdPConsent struct {
+	Scopes     []string  `json:"scopes"`
+	Audiences  []string  `json:"audiences"`
+	ApprovedAt time.Time `json:"approved_at"`
+}
+
+// DecodeProfile decodes a profile saved by keymasterd.
+func DecodeProfile(data []byte) (*Profile, error) {
+	return decodeProfile(data)
+}
+
+// Diff returns the changes Restore would make to store, followed by the
+// entries of store which are not in the archive.
+func Diff(archive *Archive, store profilestore.ProfileStore) ([]Change, error) {
+	return diff(archive, store)
+}
+
+// Export reads the profiles and the unexpired signed data of store.
+func Export(store profilestore.ProfileStore) (*Archive, error) {
+	return export(store)
+}
+
+// IsEncrypted returns true if the archive data are encrypted.
+func IsEncrypted(data []byte) bool {
+	return isEncrypted(data)
+}
+
+// Read verifies the signature of the archive data with publicKey and decodes
+// it. The passphrase is required if the archive data are encrypted.
+func Read(data []byte, publicKey crypto.PublicKey,
+	passphrase []byte) (*Archive, error) {
+	return read(data, publicKey, passphrase)
+}
+
+// Restore saves the profiles and the unexpired signed data of the archive to
+// store, replacing existing entries. Entries not in the archive are kept. It
+// returns the number of profiles and signed data entries saved.
+func Restore(archive *Archive, store profilestore.ProfileStore) (
+	int, int, error) {
+	return restore(archive, store)
+}
+
+// Write signs the archive with signer and writes it to writer. If passphrase
+// is not empty the archive is encrypted with it.
+func Write(writer io.Writer, archive *Archive, signer crypto.Signer,
+	passphrase []byte) error {
+	return write(writer, archive, signer, passphrase)
+}
+
+// Encode encodes the profile the way keymasterd saves it.
+func (p *Profile) Encode() ([]byte, error) {
+	return p.encode()
+}
+
+func (r U2fRegistration) MarshalBinary() ([]byte, error) {
+	return r, nil
+}
+
+func (r *U2fRegistration) UnmarshalBinary(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
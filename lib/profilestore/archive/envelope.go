@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Cloud-Foundations/keymaster/lib/cryptoutils"
+)
+
+const (
+	pgpMessageHeader = "-----BEGIN PGP MESSAGE-----"
+	signatureContext = "keymaster user data archive\x00"
+)
+
+// envelope is the signed archive. Payload is the JSON encoded Archive.
+type envelope struct {
+	FormatVersion int    `json:"format_version"`
+	Payload       []byte `json:"payload"`
+	Signature     []byte `json:"signature"`
+}
+
+// signedMessage binds the signature to the format of the payload.
+func signedMessage(formatVersion int, payload []byte) []byte {
+	message := []byte(fmt.Sprintf("%s%d\x00", signatureContext, formatVersion))
+	return append(message, payload...)
+}
+
+func sign(signer crypto.Signer, message []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, message, crypto.Hash(0))
+	}
+	hash := sha256.Sum256(message)
+	return signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+func verify(publicKey crypto.PublicKey, message, signature []byte) error {
+	hash := sha256.Sum256(message)
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, signature) {
+			return ErrBadSignature
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return ErrBadSignature
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+			return ErrBadSignature
+		}
+	default:
+		return fmt.Errorf("unsupported public key type: %T", publicKey)
+	}
+	return nil
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(pgpMessageHeader))
+}
+
+func write(writer io.Writer, archive *Archive, signer crypto.Signer,
+	passphrase []byte) error {
+	payload, err := json.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	signature, err := sign(signer, signedMessage(FormatVersion, payload))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(envelope{
+		FormatVersion: FormatVersion,
+		Payload:       payload,
+		Signature:     signature,
+	}, "", "    ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if len(passphrase) > 0 {
+		data, err = cryptoutils.PGPArmorEncryptBytes(data, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+func read(data []byte, publicKey crypto.PublicKey,
+	passphrase []byte) (*Archive, error) {
+	if isEncrypted(data) {
+		if len(passphrase) < 1 {
+			return nil, errors.New("archive is encrypted, passphrase required")
+		}
+		var err error
+		data, err = cryptoutils.PGPDecryptArmoredBytes(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var signed envelope
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("error decoding archive: %s", err)
+	}
+	if signed.FormatVersion < 1 || signed.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("unsupported archive format version: %d",
+			signed.FormatVersion)
+	}
+	err := verify(publicKey,
+		signedMessage(signed.FormatVersion, signed.Payload), signed.Signature)
+	if err != nil {
+		return nil, err
+	}
+	var archive Archive
+	if err := json.Unmarshal(signed.Payload, &archive); err != nil {
+		return nil, fmt.Errorf("error decoding archive: %s", err)
+	}
+	if archive.FormatVersion != signed.FormatVersion {
+		return nil, errors.New("archive format version mismatch")
+	}
+	return &archive, nil
+}
@@ -0,0 +1,66 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func newTestingArchive(t *testing.T) *Archive {
+	return &Archive{
+		FormatVersion: FormatVersion,
+		Users:         []User{{Username: "user1", Profile: makeProfile("user1")}},
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, passphrase := range []string{"", "passphrase"} {
+		var buffer bytes.Buffer
+		err := Write(&buffer, newTestingArchive(t), privateKey,
+			[]byte(passphrase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsEncrypted(buffer.Bytes()) != (passphrase != "") {
+			t.Fatalf("encrypted: %v with passphrase: %q",
+				IsEncrypted(buffer.Bytes()), passphrase)
+		}
+		archive, err := Read(buffer.Bytes(), publicKey, []byte(passphrase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(archive.Users) != 1 || archive.Users[0].Username != "user1" {
+			t.Fatalf("unexpected archive: %+v", archive)
+		}
+	}
+}
+
+func TestReadRejectsTampering(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := Write(&buffer, newTestingArchive(t), privateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(buffer.Bytes(), otherPublicKey, nil); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature for another key, got: %v", err)
+	}
+	// Change a byte of the base64 payload.
+	data := buffer.Bytes()
+	index := bytes.Index(data, []byte(`"payload": "`)) + 20
+	data[index] ^= 1
+	if _, err := Read(data, publicKey, nil); err == nil {
+		t.Fatal("read a tampered archive")
+	}
+}
@@ -0,0 +1,222 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+func decodeProfile(data []byte) (*Profile, error) {
+	var profile Profile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("error decoding profile: %s", err)
+	}
+	if bootstrap := profile.BootstrapOTP; bootstrap != nil &&
+		bootstrap.ExpiresAt.IsZero() && len(bootstrap.Sha512Hash) < 1 {
+		profile.BootstrapOTP = nil
+	}
+	return &profile, nil
+}
+
+func (p *Profile) encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(p); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func signedDataKey(data SignedData) string {
+	return fmt.Sprintf("%s (type %d)", data.Key, data.Type)
+}
+
+func sortSignedData(signedData []SignedData) {
+	sort.Slice(signedData, func(left, right int) bool {
+		if signedData[left].Key != signedData[right].Key {
+			return signedData[left].Key < signedData[right].Key
+		}
+		return signedData[left].Type < signedData[right].Type
+	})
+}
+
+func listSigned(store profilestore.ProfileStore) ([]SignedData, error) {
+	list, err := store.ListSigned()
+	if err != nil {
+		return nil, err
+	}
+	signedData := make([]SignedData, 0, len(list))
+	for _, data := range list {
+		signedData = append(signedData, SignedData(data))
+	}
+	sortSignedData(signedData)
+	return signedData, nil
+}
+
+// loadProfile returns nil if there is no profile for username.
+func loadProfile(store profilestore.ProfileStore,
+	username string) (*Profile, error) {
+	data, ok, fromCache, err := store.LoadProfile(username)
+	if err != nil {
+		return nil, fmt.Errorf("error loading profile for: %s: %s",
+			username, err)
+	}
+	if fromCache {
+		return nil, errors.New("profile DB not available, only its cache")
+	}
+	if !ok {
+		return nil, nil
+	}
+	profile, err := decodeProfile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", username, err)
+	}
+	return profile, nil
+}
+
+func export(store profilestore.ProfileStore) (*Archive, error) {
+	usernames, fromCache, err := store.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	if fromCache {
+		return nil, errors.New("profile DB not available, only its cache")
+	}
+	archive := &Archive{
+		FormatVersion: FormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		Users:         make([]User, 0, len(usernames)),
+	}
+	for _, username := range usernames {
+		profile, err := loadProfile(store, username)
+		if err != nil {
+			return nil, err
+		}
+		if profile == nil { // Deleted since listed.
+			continue
+		}
+		archive.Users = append(archive.Users,
+			User{Username: username, Profile: profile})
+	}
+	archive.SignedData, err = listSigned(store)
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+func restore(archive *Archive, store profilestore.ProfileStore) (
+	int, int, error) {
+	var numProfiles, numSigned int
+	for _, user := range archive.Users {
+		data, err := user.Profile.encode()
+		if err != nil {
+			return numProfiles, numSigned, err
+		}
+		if err := store.SaveProfile(user.Username, data); err != nil {
+			return numProfiles, numSigned, err
+		}
+		numProfiles++
+	}
+	now := time.Now().Unix()
+	for _, data := range archive.SignedData {
+		if data.ExpirationEpoch <= now {
+			continue
+		}
+		err := store.UpsertSigned(data.Key, data.Type, data.ExpirationEpoch,
+			data.Data)
+		if err != nil {
+			return numProfiles, numSigned, err
+		}
+		numSigned++
+	}
+	return numProfiles, numSigned, nil
+}
+
+func profilesEqual(left, right *Profile) (bool, error) {
+	leftJSON, err := json.Marshal(left)
+	if err != nil {
+		return false, err
+	}
+	rightJSON, err := json.Marshal(right)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(leftJSON, rightJSON), nil
+}
+
+func diff(archive *Archive, store profilestore.ProfileStore) ([]Change, error) {
+	var changes []Change
+	archiveUsers := make(map[string]struct{}, len(archive.Users))
+	for _, user := range archive.Users {
+		archiveUsers[user.Username] = struct{}{}
+		liveProfile, err := loadProfile(store, user.Username)
+		if err != nil {
+			return nil, err
+		}
+		if liveProfile == nil {
+			changes = append(changes,
+				Change{Action: ActionAdd, Kind: "profile", Key: user.Username})
+			continue
+		}
+		if equal, err := profilesEqual(user.Profile, liveProfile); err != nil {
+			return nil, err
+		} else if !equal {
+			changes = append(changes,
+				Change{Action: ActionUpdate, Kind: "profile", Key: user.Username})
+		}
+	}
+	liveSigned, err := listSigned(store)
+	if err != nil {
+		return nil, err
+	}
+	liveData := make(map[string]SignedData, len(liveSigned))
+	for _, data := range liveSigned {
+		liveData[signedDataKey(data)] = data
+	}
+	archiveSigned := make(map[string]struct{}, len(archive.SignedData))
+	now := time.Now().Unix()
+	for _, data := range archive.SignedData {
+		if data.ExpirationEpoch <= now {
+			continue
+		}
+		key := signedDataKey(data)
+		archiveSigned[key] = struct{}{}
+		if live, ok := liveData[key]; !ok {
+			changes = append(changes,
+				Change{Action: ActionAdd, Kind: "signed data", Key: key})
+		} else if live != data {
+			changes = append(changes,
+				Change{Action: ActionUpdate, Kind: "signed data", Key: key})
+		}
+	}
+	usernames, _, err := store.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, username := range usernames {
+		if _, ok := archiveUsers[username]; !ok {
+			changes = append(changes, Change{
+				Action: ActionNotInArchive,
+				Kind:   "profile",
+				Key:    username,
+			})
+		}
+	}
+	for _, data := range liveSigned {
+		key := signedDataKey(data)
+		if _, ok := archiveSigned[key]; !ok {
+			changes = append(changes, Change{
+				Action: ActionNotInArchive,
+				Kind:   "signed data",
+				Key:    key,
+			})
+		}
+	}
+	return changes, nil
+}
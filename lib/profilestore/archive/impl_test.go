@@ -0,0 +1,190 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tstranex/u2f"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/memstore"
+)
+
+// The gob encoded parts of the profile of keymasterd which use types not
+// defined in this package.
+type keymasterdU2fAuthData struct {
+	Name         string
+	Registration *u2f.Registration
+}
+
+type keymasterdProfile struct {
+	Username    string
+	U2fAuthData map[int64]*keymasterdU2fAuthData
+}
+
+func makeU2fRegistration(t *testing.T) *u2f.Registration {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "U2F token"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := key.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyHandle := []byte("key handle")
+	raw := append([]byte{0x05}, publicKey.Bytes()...)
+	raw = append(raw, byte(len(keyHandle)))
+	raw = append(raw, keyHandle...)
+	raw = append(raw, certDER...)
+	raw = append(raw, 0x30, 0x00) // An empty signature.
+	var registration u2f.Registration
+	if err := registration.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	return &registration
+}
+
+func makeProfile(username string) *Profile {
+	return &Profile{
+		Username:                   username,
+		UserHasRegistered2ndFactor: true,
+		TOTPAuthData: map[int64]*TOTPAuthData{
+			1: {
+				Enabled:         true,
+				CreatedAt:       time.Unix(1000, 0).UTC(),
+				Name:            "totp",
+				EncryptedSecret: [][]byte{[]byte("secret")},
+			},
+		},
+	}
+}
+
+func TestU2fRegistrationCompatible(t *testing.T) {
+	registration := makeU2fRegistration(t)
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(keymasterdProfile{
+		Username: "user1",
+		U2fAuthData: map[int64]*keymasterdU2fAuthData{
+			1: {Name: "token", Registration: registration},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := DecodeProfile(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := json.Marshal(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile = &Profile{}
+	if err := json.Unmarshal(jsonData, profile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := profile.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded keymasterdProfile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	u2fData := decoded.U2fAuthData[1]
+	if u2fData == nil || u2fData.Name != "token" {
+		t.Fatalf("U2F data not restored: %+v", decoded.U2fAuthData)
+	}
+	if !bytes.Equal(u2fData.Registration.KeyHandle, registration.KeyHandle) {
+		t.Fatal("U2F registration differs")
+	}
+}
+
+func TestExportRestore(t *testing.T) {
+	source := memstore.New()
+	for _, username := range []string{"user1", "user2"} {
+		data, err := makeProfile(username).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := source.SaveProfile(username, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiration := time.Now().Add(time.Hour).Unix()
+	if err := source.UpsertSigned("key1", 1, expiration, "data1"); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := Export(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.Users) != 2 || len(archive.SignedData) != 1 {
+		t.Fatalf("unexpected archive: %+v", archive)
+	}
+	destination := memstore.New()
+	oldProfile := makeProfile("user2")
+	oldProfile.DisplayName = "Old Name"
+	data, err := oldProfile.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := destination.SaveProfile("user2", data); err != nil {
+		t.Fatal(err)
+	}
+	data, err = makeProfile("user3").Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := destination.SaveProfile("user3", data); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Diff(archive, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedChanges := []Change{
+		{Action: ActionAdd, Kind: "profile", Key: "user1"},
+		{Action: ActionUpdate, Kind: "profile", Key: "user2"},
+		{Action: ActionAdd, Kind: "signed data", Key: "key1 (type 1)"},
+		{Action: ActionNotInArchive, Kind: "profile", Key: "user3"},
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Fatalf("expected changes: %v, got: %v", expectedChanges, changes)
+	}
+	numProfiles, numSigned, err := Restore(archive, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numProfiles != 2 || numSigned != 1 {
+		t.Fatalf("restored %d profiles and %d signed data",
+			numProfiles, numSigned)
+	}
+	changes, err = Diff(archive, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Action != ActionNotInArchive {
+		t.Fatalf("unexpected changes after restore: %v", changes)
+	}
+}
@@ -0,0 +1,43 @@
+package profilestore
+
+import (
+	"fmt"
+)
+
+func copyStore(source, destination ProfileStore) (int, int, error) {
+	usernames, _, err := source.GetUsers()
+	if err != nil {
+		return 0, 0, err
+	}
+	numProfiles := 0
+	for _, username := range usernames {
+		data, ok, _, err := source.LoadProfile(username)
+		if err != nil {
+			return numProfiles, 0, fmt.Errorf("error loading profile: %s: %s",
+				username, err)
+		}
+		if !ok { // Deleted since listing.
+			continue
+		}
+		if err := destination.SaveProfile(username, data); err != nil {
+			return numProfiles, 0, fmt.Errorf("error saving profile: %s: %s",
+				username, err)
+		}
+		numProfiles++
+	}
+	signedDataList, err := source.ListSigned()
+	if err != nil {
+		return numProfiles, 0, err
+	}
+	numSigned := 0
+	for _, signedData := range signedDataList {
+		err := destination.UpsertSigned(signedData.Key, signedData.Type,
+			signedData.ExpirationEpoch, signedData.Data)
+		if err != nil {
+			return numProfiles, numSigned, fmt.Errorf(
+				"error saving signed data: %s: %s", signedData.Key, err)
+		}
+		numSigned++
+	}
+	return numProfiles, numSigned, nil
+}
@@ -0,0 +1,36 @@
+package profilestore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/memstore"
+)
+
+func TestCopy(t *testing.T) {
+	source := memstore.New()
+	destination := memstore.New()
+	source.SaveProfile("alice", []byte("alice"))
+	source.SaveProfile("bob", []byte("bob"))
+	now := time.Now().Unix()
+	source.UpsertSigned("alice", 1, now+3600, "valid")
+	source.UpsertSigned("bob", 1, now-1, "expired")
+	destination.SaveProfile("alice", []byte("old"))
+	numProfiles, numSigned, err := profilestore.Copy(source, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numProfiles != 2 || numSigned != 1 {
+		t.Fatalf("copied %d profiles and %d signed data", numProfiles,
+			numSigned)
+	}
+	if data, _, _, _ := destination.LoadProfile("alice"); string(data) !=
+		"alice" {
+		t.Fatalf("profile not replaced: %q", data)
+	}
+	if ok, data, _ := destination.GetSigned("alice", 1); !ok ||
+		data != "valid" {
+		t.Fatalf("unexpected signed data: %v, %q", ok, data)
+	}
+}
@@ -0,0 +1,117 @@
+// Package encryptedstore implements a profilestore.ProfileStore which encrypts
+// the profiles before saving them in another ProfileStore, so that the secrets
+// in them cannot be read by anyone with access to the DB.
+//
+// Profiles are encrypted with AES-GCM under a data key, which is stored with
+// the profile wrapped (encrypted) under a key encryption key held by a
+// KeyWrapper. Each save makes a new data key, so that no data key is shared
+// between profiles or kept in use by other servers after a Rekey. The ID of
+// the KeyWrapper is stored with each profile, and profiles which are
+// unencrypted or wrapped under another KeyWrapper are re-encrypted when they
+// are loaded, unless the Store is read-only. Signed data are not encrypted.
+package encryptedstore
+
+import (
+	"crypto"
+	"errors"
+	"sync"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+// ErrNoKeyWrapper is returned when an encrypted profile is loaded or any
+// profile is saved before the KeyWrapper is set.
+var ErrNoKeyWrapper = errors.New("profile encryption key not available")
+
+// ErrSignerNotSupported is returned when a KeyWrapper cannot be derived from
+// a signer.
+var ErrSignerNotSupported = errors.New(
+	"signer type not supported for deriving secrets")
+
+// KeyWrapper protects the data keys.
+type KeyWrapper interface {
+	// KeyID identifies the key encryption key.
+	KeyID() string
+	// UnwrapKey decrypts a data key encrypted by WrapKey.
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+	// WrapKey encrypts a data key.
+	WrapKey(dataKey []byte) ([]byte, error)
+}
+
+type Store struct {
+	profilestore.ProfileStore
+	logger   log.DebugLogger
+	readOnly bool
+	mutex    sync.Mutex
+	// Protected by mutex.
+	previousWrappers []KeyWrapper
+	unwrappedKeys    map[string]dataKey // Key: username.
+	wrapper          KeyWrapper
+}
+
+var _ profilestore.ProfileStore = (*Store)(nil)
+
+// New returns a Store which saves the encrypted profiles in store. Profiles
+// cannot be saved until SetKeyWrapper is called.
+func New(store profilestore.ProfileStore, logger log.DebugLogger) *Store {
+	return &Store{
+		ProfileStore:  store,
+		logger:        logger,
+		unwrappedKeys: make(map[string]dataKey),
+	}
+}
+
+// NewReadOnly returns a Store which decrypts the profiles in store without
+// ever writing to it: profiles are not re-encrypted when they are loaded and
+// cannot be saved.
+func NewReadOnly(store profilestore.ProfileStore,
+	logger log.DebugLogger) *Store {
+	s := New(store, logger)
+	s.readOnly = true
+	return s
+}
+
+// IsEncrypted reports whether data is a profile encrypted by a Store.
+func IsEncrypted(data []byte) bool {
+	return isEncrypted(data)
+}
+
+// NewSecretKeyWrapper returns a KeyWrapper with a key encryption key derived
+// from a secret, such as the private key of the CA.
+func NewSecretKeyWrapper(secret []byte) (KeyWrapper, error) {
+	return newSecretKeyWrapper(secret)
+}
+
+// NewSignerKeyWrapper returns a KeyWrapper with a key encryption key derived
+// from the private key of signer, such as the CA of keymasterd. External
+// signers, whose private key is not in memory, are not supported.
+func NewSignerKeyWrapper(signer crypto.Signer) (KeyWrapper, error) {
+	return newSignerKeyWrapper(signer)
+}
+
+// SignerSupported reports whether NewSignerKeyWrapper supports signer.
+func SignerSupported(signer crypto.Signer) bool {
+	return signerSupported(signer)
+}
+
+func (s *Store) LoadProfile(username string) ([]byte, bool, bool, error) {
+	return s.loadProfile(username)
+}
+
+// Rekey encrypts all the profiles with new data keys. It returns the number
+// of profiles encrypted.
+func (s *Store) Rekey() (int, error) {
+	return s.rekey()
+}
+
+func (s *Store) SaveProfile(username string, data []byte) error {
+	return s.saveProfile(username, data)
+}
+
+// SetKeyWrapper sets the KeyWrapper used to wrap new data keys and to unwrap
+// the data keys of loaded profiles. The previous KeyWrappers unwrap the data
+// keys of profiles not yet re-encrypted after changing the KeyWrapper.
+func (s *Store) SetKeyWrapper(wrapper KeyWrapper, previous ...KeyWrapper) {
+	s.setKeyWrapper(wrapper, previous)
+}
@@ -0,0 +1,282 @@
+package encryptedstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+// encryptedPrefix starts encrypted profiles. keymasterd stores gob streams,
+// which never start with a zero byte, so unencrypted profiles saved by
+// earlier versions can still be read.
+const encryptedPrefix = "\x00keymaster-encrypted-profile-v1\n"
+
+const (
+	dataKeySize     = 32
+	maxSwapAttempts = 3
+)
+
+var (
+	errNoSwapper = errors.New(
+		"profile store does not support conditional updates")
+	errReadOnly = errors.New("profile store is read-only")
+)
+
+// dataKey is the last data key used for the profile of a user, kept to save
+// unwrapping it again.
+type dataKey struct {
+	key        []byte
+	wrappedKey []byte
+}
+
+// envelope is an encrypted profile. The username is authenticated with the
+// data so that profiles cannot be swapped between users.
+type envelope struct {
+	KeyID      string
+	WrappedKey []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func (s *Store) setKeyWrapper(wrapper KeyWrapper, previous []KeyWrapper) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.wrapper = wrapper
+	s.previousWrappers = previous
+}
+
+func (s *Store) getKeyWrapper() KeyWrapper {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.wrapper
+}
+
+// newDataKey makes a data key for the profile of username and returns it with
+// the ID of the KeyWrapper which wrapped it.
+func (s *Store) newDataKey(username string) (dataKey, string, error) {
+	wrapper := s.getKeyWrapper()
+	if wrapper == nil {
+		return dataKey{}, "", ErrNoKeyWrapper
+	}
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return dataKey{}, "", err
+	}
+	wrappedKey, err := wrapper.WrapKey(key)
+	if err != nil {
+		return dataKey{}, "", err
+	}
+	newKey := dataKey{key: key, wrappedKey: wrappedKey}
+	s.mutex.Lock()
+	s.unwrappedKeys[username] = newKey
+	s.mutex.Unlock()
+	return newKey, wrapper.KeyID(), nil
+}
+
+// unwrapKey unwraps the data key of the profile of username with the
+// KeyWrapper with the ID keyID, or else with the current KeyWrapper.
+func (s *Store) unwrapKey(username string, keyID string,
+	wrappedKey []byte) ([]byte, error) {
+	s.mutex.Lock()
+	cachedKey, ok := s.unwrappedKeys[username]
+	ok = ok && bytes.Equal(cachedKey.wrappedKey, wrappedKey)
+	wrapper := s.wrapper
+	for _, previous := range s.previousWrappers {
+		if previous.KeyID() == keyID {
+			wrapper = previous
+		}
+	}
+	s.mutex.Unlock()
+	if ok {
+		return cachedKey.key, nil
+	}
+	if wrapper == nil {
+		return nil, ErrNoKeyWrapper
+	}
+	key, err := wrapper.UnwrapKey(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.unwrappedKeys[username] = dataKey{key: key, wrappedKey: wrappedKey}
+	s.mutex.Unlock()
+	return key, nil
+}
+
+func (s *Store) encrypt(username string, data []byte) ([]byte, error) {
+	key, keyID, err := s.newDataKey(username)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	buffer := bytes.NewBufferString(encryptedPrefix)
+	err = gob.NewEncoder(buffer).Encode(envelope{
+		KeyID:      keyID,
+		WrappedKey: key.wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, data, []byte(username)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedPrefix))
+}
+
+// decrypt returns the profile and the ID of the KeyWrapper it was encrypted
+// under, which is empty if it was not encrypted.
+func (s *Store) decrypt(username string, data []byte) ([]byte, string, error) {
+	if !isEncrypted(data) {
+		return data, "", nil
+	}
+	var encrypted envelope
+	err := gob.NewDecoder(bytes.NewReader(
+		data[len(encryptedPrefix):])).Decode(&encrypted)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding encrypted profile: %s",
+			err)
+	}
+	key, err := s.unwrapKey(username, encrypted.KeyID, encrypted.WrappedKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("error unwrapping key: %s: %s",
+			encrypted.KeyID, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return nil, "", errors.New("bad nonce size")
+	}
+	plaintext, err := aead.Open(nil, encrypted.Nonce, encrypted.Ciphertext,
+		[]byte(username))
+	if err != nil {
+		return nil, "", fmt.Errorf("error decrypting profile: %s", err)
+	}
+	return plaintext, encrypted.KeyID, nil
+}
+
+func (s *Store) loadProfile(username string) ([]byte, bool, bool, error) {
+	data, ok, fromCache, err := s.ProfileStore.LoadProfile(username)
+	if err != nil || !ok {
+		return data, ok, fromCache, err
+	}
+	plaintext, keyID, err := s.decrypt(username, data)
+	if err != nil {
+		return nil, false, fromCache, err
+	}
+	// Stale data from a cache must not be written back, and the profile is
+	// only replaced if it has not been saved since it was loaded.
+	if wrapper := s.getKeyWrapper(); wrapper != nil && !s.readOnly &&
+		!fromCache && keyID != wrapper.KeyID() {
+		switch err := s.swapProfile(username, data, plaintext); err {
+		case nil:
+			s.logger.Debugf(1, "re-encrypted profile for: %s\n", username)
+		case errNoSwapper, profilestore.ErrProfileChanged:
+			// Re-encrypted when next saved.
+		default:
+			s.logger.Printf("error re-encrypting profile for: %s: %s\n",
+				username, err)
+		}
+	}
+	return plaintext, true, fromCache, nil
+}
+
+// swapProfile encrypts plaintext and replaces the stored profile with it if
+// the stored profile is still oldData.
+func (s *Store) swapProfile(username string, oldData, plaintext []byte) error {
+	swapper, ok := s.ProfileStore.(profilestore.ProfileSwapper)
+	if !ok {
+		return errNoSwapper
+	}
+	encrypted, err := s.encrypt(username, plaintext)
+	if err != nil {
+		return err
+	}
+	return swapper.SwapProfile(username, oldData, encrypted)
+}
+
+func (s *Store) saveProfile(username string, data []byte) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	encrypted, err := s.encrypt(username, data)
+	if err != nil {
+		return err
+	}
+	return s.ProfileStore.SaveProfile(username, encrypted)
+}
+
+func (s *Store) rekey() (int, error) {
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+	if s.getKeyWrapper() == nil {
+		return 0, ErrNoKeyWrapper
+	}
+	if _, ok := s.ProfileStore.(profilestore.ProfileSwapper); !ok {
+		return 0, errNoSwapper
+	}
+	users, fromCache, err := s.ProfileStore.GetUsers()
+	if err != nil {
+		return 0, err
+	}
+	if fromCache {
+		return 0, errors.New("profile DB unavailable")
+	}
+	numProfiles := 0
+	for _, username := range users {
+		rekeyed, err := s.rekeyProfile(username)
+		if err != nil {
+			return numProfiles, err
+		}
+		if rekeyed {
+			numProfiles++
+		}
+	}
+	return numProfiles, nil
+}
+
+// rekeyProfile re-encrypts the profile of a user with a new data key,
+// trying again if it is saved meanwhile. It returns false if the user has no
+// profile.
+func (s *Store) rekeyProfile(username string) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		data, ok, fromCache, err := s.ProfileStore.LoadProfile(username)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+		if fromCache {
+			return false, errors.New("profile DB unavailable")
+		}
+		plaintext, _, err := s.decrypt(username, data)
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", username, err)
+		}
+		err = s.swapProfile(username, data, plaintext)
+		if err == profilestore.ErrProfileChanged && attempt < maxSwapAttempts {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", username, err)
+		}
+		return true, nil
+	}
+}
@@ -0,0 +1,290 @@
+package encryptedstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/memstore"
+)
+
+func newTestingKeyWrapper(t *testing.T, secret string) KeyWrapper {
+	wrapper, err := NewSecretKeyWrapper([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapper
+}
+
+func loadRaw(t *testing.T, backing *memstore.MemStore,
+	username string) []byte {
+	data, ok, _, err := backing.LoadProfile(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("no profile for: %s", username)
+	}
+	return data
+}
+
+func loadWrappedKey(t *testing.T, backing *memstore.MemStore,
+	username string) string {
+	data := loadRaw(t, backing, username)
+	var encrypted envelope
+	err := gob.NewDecoder(bytes.NewReader(
+		data[len(encryptedPrefix):])).Decode(&encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encrypted.WrappedKey)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	backing := memstore.New()
+	s := New(backing, testlogger.New(t))
+	if err := s.SaveProfile("user1", []byte("secret1")); err != ErrNoKeyWrapper {
+		t.Fatalf("expected ErrNoKeyWrapper, got: %v", err)
+	}
+	s.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	if err := s.SaveProfile("user1", []byte("secret1")); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(loadRaw(t, backing, "user1"), []byte("secret1")) {
+		t.Fatal("profile saved unencrypted")
+	}
+	// A new Store, as on another server, must unwrap the data key.
+	s = New(backing, testlogger.New(t))
+	if _, _, _, err := s.LoadProfile("user1"); err == nil {
+		t.Fatal("loaded encrypted profile without a KeyWrapper")
+	}
+	s.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	data, ok, _, err := s.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(data) != "secret1" {
+		t.Fatalf("unexpected profile: %v %q", ok, data)
+	}
+	if _, _, _, err := s.LoadProfile("unknown"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSwappedProfile(t *testing.T) {
+	backing := memstore.New()
+	s := New(backing, testlogger.New(t))
+	s.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	if err := s.SaveProfile("user1", []byte("secret1")); err != nil {
+		t.Fatal(err)
+	}
+	err := backing.SaveProfile("user2", loadRaw(t, backing, "user1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.LoadProfile("user2"); err == nil {
+		t.Fatal("loaded profile of another user")
+	}
+}
+
+func TestReencryptOnLoad(t *testing.T) {
+	backing := memstore.New()
+	if err := backing.SaveProfile("user1", []byte("plain1")); err != nil {
+		t.Fatal(err)
+	}
+	s := New(backing, testlogger.New(t))
+	// Unencrypted profiles are readable while sealed.
+	data, ok, _, err := s.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(data) != "plain1" {
+		t.Fatalf("unexpected profile: %v %q", ok, data)
+	}
+	oldWrapper := newTestingKeyWrapper(t, "old CA key")
+	s.SetKeyWrapper(oldWrapper)
+	if _, _, _, err := s.LoadProfile("user1"); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(loadRaw(t, backing, "user1"), []byte("plain1")) {
+		t.Fatal("profile not encrypted on load")
+	}
+	// Change the KeyWrapper: the profile is re-encrypted under the new one.
+	s = New(backing, testlogger.New(t))
+	newWrapper := newTestingKeyWrapper(t, "new CA key")
+	s.SetKeyWrapper(newWrapper, oldWrapper)
+	if _, _, _, err := s.LoadProfile("user1"); err != nil {
+		t.Fatal(err)
+	}
+	s = New(backing, testlogger.New(t))
+	s.SetKeyWrapper(newWrapper)
+	data, _, _, err = s.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "plain1" {
+		t.Fatalf("unexpected profile: %q", data)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	backing := memstore.New()
+	if err := backing.SaveProfile("user1", []byte("plain1")); err != nil {
+		t.Fatal(err)
+	}
+	s := NewReadOnly(backing, testlogger.New(t))
+	s.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	data, ok, _, err := s.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(data) != "plain1" {
+		t.Fatalf("unexpected profile: %v %q", ok, data)
+	}
+	if string(loadRaw(t, backing, "user1")) != "plain1" {
+		t.Fatal("profile re-encrypted on load")
+	}
+	if err := s.SaveProfile("user1", []byte("plain2")); err == nil {
+		t.Fatal("saved profile in read-only store")
+	}
+	if _, err := s.Rekey(); err == nil {
+		t.Fatal("rekeyed read-only store")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	backing := memstore.New()
+	s := New(backing, testlogger.New(t))
+	s.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	for _, username := range []string{"user1", "user2"} {
+		if err := s.SaveProfile(username, []byte(username)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backing.SaveProfile("user3", []byte("user3")); err != nil {
+		t.Fatal(err)
+	}
+	oldData := loadRaw(t, backing, "user1")
+	numProfiles, err := s.Rekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numProfiles != 3 {
+		t.Fatalf("expected 3 profiles, got: %d", numProfiles)
+	}
+	if bytes.Equal(loadRaw(t, backing, "user1"), oldData) {
+		t.Fatal("profile not re-encrypted")
+	}
+	if bytes.Contains(loadRaw(t, backing, "user3"), []byte("user3")) {
+		t.Fatal("profile not encrypted")
+	}
+	for _, username := range []string{"user1", "user2", "user3"} {
+		data, _, _, err := s.LoadProfile(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != username {
+			t.Fatalf("unexpected profile for %s: %q", username, data)
+		}
+	}
+}
+
+func TestRekeyAcrossStores(t *testing.T) {
+	// Two servers sharing a DB.
+	backing := memstore.New()
+	s1 := New(backing, testlogger.New(t))
+	s1.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	s2 := New(backing, testlogger.New(t))
+	s2.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	oldKeys := make(map[string]struct{})
+	for _, username := range []string{"user1", "user2"} {
+		if err := s2.SaveProfile(username, []byte(username)); err != nil {
+			t.Fatal(err)
+		}
+		oldKeys[loadWrappedKey(t, backing, username)] = struct{}{}
+	}
+	if len(oldKeys) != 2 {
+		t.Fatal("profiles share a data key")
+	}
+	if _, err := s1.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	// The other server must not keep using the data keys from before.
+	for _, username := range []string{"user1", "user2", "user3"} {
+		if err := s2.SaveProfile(username, []byte(username)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := oldKeys[loadWrappedKey(t, backing, username)]; ok {
+			t.Fatalf("data key from before the rekey used for %s", username)
+		}
+		data, _, _, err := s1.LoadProfile(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != username {
+			t.Fatalf("unexpected profile for %s: %q", username, data)
+		}
+	}
+}
+
+// racingStore saves a profile after it is loaded, as another server would.
+type racingStore struct {
+	*memstore.MemStore
+	racingData []byte
+}
+
+func (rs *racingStore) LoadProfile(username string) ([]byte, bool, bool,
+	error) {
+	data, ok, fromCache, err := rs.MemStore.LoadProfile(username)
+	if rs.racingData != nil {
+		rs.MemStore.SaveProfile(username, rs.racingData)
+		rs.racingData = nil
+	}
+	return data, ok, fromCache, err
+}
+
+func TestReencryptOnLoadKeepsNewerProfile(t *testing.T) {
+	backing := &racingStore{MemStore: memstore.New()}
+	if err := backing.SaveProfile("user1", []byte("plain1")); err != nil {
+		t.Fatal(err)
+	}
+	s := New(backing, testlogger.New(t))
+	s.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	backing.racingData = []byte("plain2")
+	if _, _, _, err := s.LoadProfile("user1"); err != nil {
+		t.Fatal(err)
+	}
+	if data := loadRaw(t, backing.MemStore, "user1"); string(data) != "plain2" {
+		t.Fatalf("newer profile overwritten: %q", data)
+	}
+	// Rekey tries again.
+	backing.racingData = []byte("plain3")
+	if _, err := s.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	data, _, _, err := s.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "plain3" {
+		t.Fatalf("unexpected profile: %q", data)
+	}
+	if bytes.Contains(loadRaw(t, backing.MemStore, "user1"), data) {
+		t.Fatal("profile not encrypted")
+	}
+}
+
+// plainStore hides the SwapProfile method of the MemStore.
+type plainStore struct {
+	profilestore.ProfileStore
+}
+
+func TestRekeyRequiresSwapper(t *testing.T) {
+	s := New(plainStore{memstore.New()}, testlogger.New(t))
+	s.SetKeyWrapper(newTestingKeyWrapper(t, "CA key"))
+	if _, err := s.Rekey(); err != errNoSwapper {
+		t.Fatalf("expected errNoSwapper, got: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+// Package kmswrapper implements an encryptedstore.KeyWrapper which wraps the
+// data keys with a symmetric AWS KMS key.
+package kmswrapper
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/encryptedstore"
+)
+
+// This interface is only to abstract the kms.Client so that we can write tests
+type minKmsClient interface {
+	Decrypt(ctx context.Context, params *kms.DecryptInput,
+		optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+	Encrypt(ctx context.Context, params *kms.EncryptInput,
+		optFns ...func(*kms.Options)) (*kms.EncryptOutput, error)
+}
+
+type KmsKeyWrapper struct {
+	client minKmsClient
+	keyID  string
+}
+
+var _ encryptedstore.KeyWrapper = (*KmsKeyWrapper)(nil)
+
+// New returns a KeyWrapper for the KMS key keyID, which may be a key ID, ARN
+// or alias.
+func New(cfg aws.Config, keyID string) *KmsKeyWrapper {
+	return &KmsKeyWrapper{client: kms.NewFromConfig(cfg), keyID: keyID}
+}
+
+func (kw *KmsKeyWrapper) KeyID() string {
+	return "kms:" + kw.keyID
+}
+
+// UnwrapKey decrypts a data key. KMS finds the key from the wrapped key, so
+// data keys wrapped with another KMS key can be unwrapped if allowed.
+func (kw *KmsKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	return kw.unwrapKey(wrappedKey)
+}
+
+func (kw *KmsKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	return kw.wrapKey(dataKey)
+}
@@ -0,0 +1,45 @@
+package kmswrapper
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+const (
+	encryptionContextKey   = "purpose"
+	encryptionContextValue = "keymaster-profile-data-key"
+	requestTimeout         = time.Second * 10
+)
+
+func encryptionContext() map[string]string {
+	return map[string]string{encryptionContextKey: encryptionContextValue}
+}
+
+func (kw *KmsKeyWrapper) unwrapKey(wrappedKey []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := kw.client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    wrappedKey,
+		EncryptionContext: encryptionContext(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+func (kw *KmsKeyWrapper) wrapKey(dataKey []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := kw.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:             &kw.keyID,
+		Plaintext:         dataKey,
+		EncryptionContext: encryptionContext(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.CiphertextBlob, nil
+}
@@ -0,0 +1,66 @@
+package kmswrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// kmsClientMock "encrypts" by prefixing the key ID, and checks the key and
+// encryption context.
+type kmsClientMock struct {
+	keyID string
+}
+
+func (m *kmsClientMock) Decrypt(ctx context.Context, params *kms.DecryptInput,
+	optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	if params.EncryptionContext[encryptionContextKey] !=
+		encryptionContextValue {
+		return nil, errors.New("bad encryption context")
+	}
+	if !bytes.HasPrefix(params.CiphertextBlob, []byte(m.keyID)) {
+		return nil, errors.New("bad ciphertext")
+	}
+	return &kms.DecryptOutput{
+		Plaintext: params.CiphertextBlob[len(m.keyID):],
+	}, nil
+}
+
+func (m *kmsClientMock) Encrypt(ctx context.Context, params *kms.EncryptInput,
+	optFns ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	if *params.KeyId != m.keyID {
+		return nil, errors.New("unknown key")
+	}
+	if params.EncryptionContext[encryptionContextKey] !=
+		encryptionContextValue {
+		return nil, errors.New("bad encryption context")
+	}
+	return &kms.EncryptOutput{
+		CiphertextBlob: append([]byte(m.keyID), params.Plaintext...),
+	}, nil
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	kw := &KmsKeyWrapper{
+		client: &kmsClientMock{keyID: "alias/test"},
+		keyID:  "alias/test",
+	}
+	if kw.KeyID() != "kms:alias/test" {
+		t.Fatalf("unexpected key ID: %s", kw.KeyID())
+	}
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrappedKey, err := kw.WrapKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrappedKey, err := kw.UnwrapKey(wrappedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrappedKey, dataKey) {
+		t.Fatal("unwrapped key differs")
+	}
+}
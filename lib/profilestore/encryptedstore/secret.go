@@ -0,0 +1,72 @@
+package encryptedstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+const (
+	secretKeyInfo   = "keymaster profile key encryption key"
+	secretKeyIDInfo = "keymaster profile key encryption key ID"
+)
+
+type secretKeyWrapper struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+func newSecretKeyWrapper(secret []byte) (*secretKeyWrapper, error) {
+	if len(secret) < 1 {
+		return nil, errors.New("empty secret")
+	}
+	key, err := hkdf.Key(sha256.New, secret, nil, secretKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := hkdf.Key(sha256.New, secret, nil, secretKeyIDInfo, 8)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &secretKeyWrapper{
+		aead:  aead,
+		keyID: "secret:" + hex.EncodeToString(keyID),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (w *secretKeyWrapper) KeyID() string {
+	return w.keyID
+}
+
+func (w *secretKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	nonceSize := w.aead.NonceSize()
+	if len(wrappedKey) < nonceSize {
+		return nil, errors.New("wrapped key too short")
+	}
+	return w.aead.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:],
+		nil)
+}
+
+func (w *secretKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, dataKey, nil), nil
+}
@@ -0,0 +1,39 @@
+package encryptedstore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+)
+
+func newSignerKeyWrapper(signer crypto.Signer) (KeyWrapper, error) {
+	secret, err := deriveSignerSecret(signer)
+	if err != nil {
+		return nil, err
+	}
+	return newSecretKeyWrapper(secret)
+}
+
+func deriveSignerSecret(signer crypto.Signer) ([]byte, error) {
+	if signer == nil {
+		return nil, errors.New("signer not available")
+	}
+	if !signerSupported(signer) {
+		return nil, ErrSignerNotSupported
+	}
+	return x509.MarshalPKCS8PrivateKey(signer)
+}
+
+// signerSupported reports whether the private key of signer is in memory.
+// The secret of an external signer could only be a signature, which anyone
+// able to use the signer could ask for.
+func signerSupported(signer crypto.Signer) bool {
+	switch signer.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return true
+	}
+	return false
+}
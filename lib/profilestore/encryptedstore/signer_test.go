@@ -0,0 +1,70 @@
+package encryptedstore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"testing"
+)
+
+// externalSigner hides the type of the private key, like a hardware signer.
+type externalSigner struct {
+	signer crypto.Signer
+}
+
+func (s externalSigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s externalSigner) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	return s.signer.Sign(rand, digest, opts)
+}
+
+func TestSignerKeyWrapper(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, signer := range []crypto.Signer{rsaKey, ecdsaKey} {
+		wrapper1, err := NewSignerKeyWrapper(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapper2, err := NewSignerKeyWrapper(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wrapper1.KeyID() != wrapper2.KeyID() {
+			t.Fatalf("%T: key IDs differ", signer)
+		}
+		wrappedKey, err := wrapper1.WrapKey([]byte("data key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key, err := wrapper2.UnwrapKey(wrappedKey); err != nil {
+			t.Fatal(err)
+		} else if string(key) != "data key" {
+			t.Fatalf("%T: unexpected data key: %q", signer, key)
+		}
+	}
+	// A signature over a constant would be available to anyone able to use
+	// the signer.
+	for _, signer := range []crypto.Signer{
+		externalSigner{rsaKey}, externalSigner{ecdsaKey},
+	} {
+		if SignerSupported(signer) {
+			t.Fatalf("external %T signer supported", signer.Public())
+		}
+		if _, err := NewSignerKeyWrapper(signer); err != ErrSignerNotSupported {
+			t.Fatalf("expected ErrSignerNotSupported, got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Package memstore implements a profilestore.ProfileStore in memory. It is
+// used for testing and as the state of replicated stores.
+package memstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+type index struct {
+	Key      string
+	DataType int
+}
+
+type signedDatum struct {
+	Data       string
+	Expiration int64
+}
+
+type MemStore struct {
+	mutex    sync.RWMutex
+	profiles map[string][]byte
+	signed   map[index]signedDatum
+}
+
+// encodedStore is the serialised form of a MemStore.
+type encodedStore struct {
+	Profiles map[string][]byte
+	Signed   []profilestore.SignedData
+}
+
+var (
+	_ profilestore.ProfileStore   = (*MemStore)(nil)
+	_ profilestore.ProfileSwapper = (*MemStore)(nil)
+)
+
+func New() *MemStore {
+	return &MemStore{
+		profiles: make(map[string][]byte),
+		signed:   make(map[index]signedDatum),
+	}
+}
+
+func (ms *MemStore) Close() error {
+	return nil
+}
+
+func (ms *MemStore) GetUsers() ([]string, bool, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	names := make([]string, 0, len(ms.profiles))
+	for name := range ms.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, false, nil
+}
+
+func (ms *MemStore) LoadProfile(username string) ([]byte, bool, bool, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	data, ok := ms.profiles[username]
+	if !ok {
+		return nil, false, false, nil
+	}
+	return append([]byte(nil), data...), true, false, nil
+}
+
+func (ms *MemStore) SaveProfile(username string, data []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.profiles[username] = append([]byte(nil), data...)
+	return nil
+}
+
+func (ms *MemStore) SwapProfile(username string, oldData,
+	newData []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if data, ok := ms.profiles[username]; !ok || !bytes.Equal(data, oldData) {
+		return profilestore.ErrProfileChanged
+	}
+	ms.profiles[username] = append([]byte(nil), newData...)
+	return nil
+}
+
+func (ms *MemStore) DeleteProfile(username string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.profiles, username)
+	return nil
+}
+
+func (ms *MemStore) GetSigned(key string, dataType int) (bool, string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	datum, ok := ms.signed[index{Key: key, DataType: dataType}]
+	if !ok || datum.Expiration <= time.Now().Unix() {
+		return false, "", nil
+	}
+	return true, datum.Data, nil
+}
+
+func (ms *MemStore) UpsertSigned(key string, dataType int, expiration int64,
+	data string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.signed[index{Key: key, DataType: dataType}] = signedDatum{
+		Data:       data,
+		Expiration: expiration,
+	}
+	return nil
+}
+
+func (ms *MemStore) DeleteSigned(key string, dataType int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.signed, index{Key: key, DataType: dataType})
+	return nil
+}
+
+func (ms *MemStore) ListSigned() ([]profilestore.SignedData, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.listSigned(time.Now().Unix()), nil
+}
+
+// listSigned must be called with the lock held.
+func (ms *MemStore) listSigned(minExpiration int64) []profilestore.SignedData {
+	signedDataList := make([]profilestore.SignedData, 0, len(ms.signed))
+	for index, datum := range ms.signed {
+		if datum.Expiration <= minExpiration {
+			continue
+		}
+		signedDataList = append(signedDataList, profilestore.SignedData{
+			Key:             index.Key,
+			Type:            index.DataType,
+			Data:            datum.Data,
+			ExpirationEpoch: datum.Expiration,
+		})
+	}
+	sort.Slice(signedDataList, func(left, right int) bool {
+		if signedDataList[left].Key != signedDataList[right].Key {
+			return signedDataList[left].Key < signedDataList[right].Key
+		}
+		return signedDataList[left].Type < signedDataList[right].Type
+	})
+	return signedDataList
+}
+
+// DeleteExpiredSigned deletes the signed data which expired at or before
+// the time now (in seconds since the epoch).
+func (ms *MemStore) DeleteExpiredSigned(now int64) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for index, datum := range ms.signed {
+		if datum.Expiration <= now {
+			delete(ms.signed, index)
+		}
+	}
+}
+
+// Clone returns a copy of the store.
+func (ms *MemStore) Clone() *MemStore {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	clone := &MemStore{
+		profiles: make(map[string][]byte, len(ms.profiles)),
+		signed:   make(map[index]signedDatum, len(ms.signed)),
+	}
+	for username, data := range ms.profiles {
+		clone.profiles[username] = data // Never modified in place.
+	}
+	for index, datum := range ms.signed {
+		clone.signed[index] = datum
+	}
+	return clone
+}
+
+// Encode writes the contents of the store, including expired signed data.
+func (ms *MemStore) Encode(writer io.Writer) error {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return gob.NewEncoder(writer).Encode(encodedStore{
+		Profiles: ms.profiles,
+		Signed:   ms.listSigned(math.MinInt64),
+	})
+}
+
+// Decode replaces the contents of the store with data written by Encode.
+func (ms *MemStore) Decode(reader io.Reader) error {
+	var encoded encodedStore
+	if err := gob.NewDecoder(reader).Decode(&encoded); err != nil {
+		return err
+	}
+	signed := make(map[index]signedDatum, len(encoded.Signed))
+	for _, signedData := range encoded.Signed {
+		signed[index{Key: signedData.Key, DataType: signedData.Type}] =
+			signedDatum{
+				Data:       signedData.Data,
+				Expiration: signedData.ExpirationEpoch,
+			}
+	}
+	if encoded.Profiles == nil {
+		encoded.Profiles = make(map[string][]byte)
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.profiles = encoded.Profiles
+	ms.signed = signed
+	return nil
+}
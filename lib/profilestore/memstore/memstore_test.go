@@ -0,0 +1,65 @@
+package memstore
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+func TestMemStore(t *testing.T) {
+	ms := New()
+	if err := ms.SaveProfile("bob", []byte("bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SaveProfile("alice", []byte("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SwapProfile("alice", []byte("bob"),
+		[]byte("alice2")); err != profilestore.ErrProfileChanged {
+		t.Fatalf("expected ErrProfileChanged, got: %v", err)
+	}
+	if err := ms.SwapProfile("alice", []byte("alice"),
+		[]byte("alice")); err != nil {
+		t.Fatal(err)
+	}
+	users, _, err := ms.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(users, []string{"alice", "bob"}) {
+		t.Fatalf("unexpected users: %v", users)
+	}
+	now := time.Now().Unix()
+	ms.UpsertSigned("alice", 1, now+3600, "valid")
+	ms.UpsertSigned("bob", 1, now-1, "expired")
+	if ok, data, _ := ms.GetSigned("alice", 1); !ok || data != "valid" {
+		t.Fatalf("unexpected signed data: %v, %q", ok, data)
+	}
+	if ok, _, _ := ms.GetSigned("bob", 1); ok {
+		t.Fatal("got expired data")
+	}
+	var buffer bytes.Buffer
+	if err := ms.Clone().Encode(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	ms.DeleteExpiredSigned(now)
+	ms.DeleteProfile("bob")
+	decoded := New()
+	if err := decoded.Decode(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok, _, _ := decoded.LoadProfile("bob"); !ok ||
+		string(data) != "bob" {
+		t.Fatalf("unexpected profile: %v, %q", ok, data)
+	}
+	if len(decoded.signed) != 2 {
+		t.Fatalf("expected 2 signed data entries, got %d",
+			len(decoded.signed))
+	}
+	if len(ms.signed) != 1 {
+		t.Fatalf("expected 1 signed data entry, got %d", len(ms.signed))
+	}
+}
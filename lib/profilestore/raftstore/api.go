@@ -0,0 +1,203 @@
+// Package raftstore implements a profilestore.ProfileStore replicated between
+// the keymasterd servers of a cluster with the Raft consensus protocol, so
+// that no external database is needed.
+//
+// Each server keeps all the data in memory and serves reads locally. Writes
+// are forwarded to the leader, which commits them to a majority of the
+// servers, and return once they can be read locally. Reads on a follower
+// which has lost contact with the leader report that they come from a cache.
+// Raft and forwarded requests share one port, secured with mutual TLS: every
+// server needs a certificate for its address signed by the CA, which must be
+// dedicated to the cluster since any holder of a certificate signed by it can
+// read and write the data.
+package raftstore
+
+import (
+	"crypto/tls"
+	"net"
+	"net/rpc"
+	"sync"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/memstore"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+type Config struct {
+	// Address is the host:port other servers use to reach this server. It
+	// must be one of the Peers.
+	Address string `yaml:"address"`
+	// DataDirectory holds the Raft log and snapshots.
+	DataDirectory string `yaml:"data_directory"`
+	// Peers lists the addresses of all the servers in the cluster. The
+	// cluster is formed from this list the first time it starts.
+	Peers           []string `yaml:"peers"`
+	TLSCertFilename string   `yaml:"tls_cert_filename"`
+	TLSKeyFilename  string   `yaml:"tls_key_filename"`
+	TLSCAFilename   string   `yaml:"tls_ca_filename"`
+}
+
+// Store is a member of a cluster.
+type Store struct {
+	config          Config
+	logger          log.DebugLogger
+	state           *memstore.MemStore
+	raft            *raft.Raft
+	listener        net.Listener
+	transport       *raft.NetworkTransport
+	boltStore       *raftboltdb.BoltStore
+	clientTLSConfig *tls.Config
+	stopChannel     chan struct{}
+	forwardMutex    sync.Mutex
+	// Protected by forwardMutex.
+	leaderAddress string
+	leaderClient  *rpc.Client
+}
+
+// Client accesses the data of a cluster without being a member, for
+// maintenance tools. It only uses Peers and the TLS settings of the Config.
+type Client struct {
+	config    Config
+	logger    log.DebugLogger
+	tlsConfig *tls.Config
+	mutex     sync.Mutex
+	// Protected by mutex.
+	peerIndex int
+	rpcClient *rpc.Client
+}
+
+var (
+	_ profilestore.ProfileStore   = (*Client)(nil)
+	_ profilestore.ProfileStore   = (*Store)(nil)
+	_ profilestore.ProfileSwapper = (*Store)(nil)
+)
+
+// New starts a member of the cluster. Writes fail until a leader is elected.
+func New(config Config, logger log.DebugLogger) (*Store, error) {
+	return newStore(config, logger)
+}
+
+func (s *Store) Close() error {
+	return s.close()
+}
+
+func (s *Store) DeleteProfile(username string) error {
+	return s.apply(command{Operation: opDeleteProfile, Key: username})
+}
+
+func (s *Store) DeleteSigned(key string, dataType int) error {
+	return s.apply(command{
+		Operation: opDeleteSigned,
+		Key:       key,
+		DataType:  dataType,
+	})
+}
+
+func (s *Store) GetSigned(key string, dataType int) (bool, string, error) {
+	return s.state.GetSigned(key, dataType)
+}
+
+func (s *Store) GetUsers() ([]string, bool, error) {
+	users, _, err := s.state.GetUsers()
+	return users, s.isStale(), err
+}
+
+// IsLeader returns true if this server is the leader of the cluster.
+func (s *Store) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+func (s *Store) ListSigned() ([]profilestore.SignedData, error) {
+	return s.state.ListSigned()
+}
+
+func (s *Store) LoadProfile(username string) ([]byte, bool, bool, error) {
+	data, ok, _, err := s.state.LoadProfile(username)
+	return data, ok, s.isStale(), err
+}
+
+func (s *Store) SaveProfile(username string, data []byte) error {
+	return s.apply(command{
+		Operation: opSaveProfile,
+		Key:       username,
+		Data:      data,
+	})
+}
+
+func (s *Store) SwapProfile(username string, oldData, newData []byte) error {
+	return s.apply(command{
+		Operation: opSwapProfile,
+		Key:       username,
+		Data:      newData,
+		OldData:   oldData,
+	})
+}
+
+func (s *Store) UpsertSigned(key string, dataType int, expiration int64,
+	data string) error {
+	return s.apply(command{
+		Operation:  opUpsertSigned,
+		Key:        key,
+		Data:       []byte(data),
+		DataType:   dataType,
+		Expiration: expiration,
+	})
+}
+
+// NewClient returns a client which connects to the peers in turn.
+func NewClient(config Config, logger log.DebugLogger) (*Client, error) {
+	return newClient(config, logger)
+}
+
+func (c *Client) Close() error {
+	return c.close()
+}
+
+func (c *Client) DeleteProfile(username string) error {
+	return c.apply(command{Operation: opDeleteProfile, Key: username})
+}
+
+func (c *Client) DeleteSigned(key string, dataType int) error {
+	return c.apply(command{
+		Operation: opDeleteSigned,
+		Key:       key,
+		DataType:  dataType,
+	})
+}
+
+func (c *Client) GetSigned(key string, dataType int) (bool, string, error) {
+	return c.getSigned(key, dataType)
+}
+
+func (c *Client) GetUsers() ([]string, bool, error) {
+	return c.getUsers()
+}
+
+func (c *Client) ListSigned() ([]profilestore.SignedData, error) {
+	return c.listSigned()
+}
+
+func (c *Client) LoadProfile(username string) ([]byte, bool, bool, error) {
+	return c.loadProfile(username)
+}
+
+func (c *Client) SaveProfile(username string, data []byte) error {
+	return c.apply(command{
+		Operation: opSaveProfile,
+		Key:       username,
+		Data:      data,
+	})
+}
+
+func (c *Client) UpsertSigned(key string, dataType int, expiration int64,
+	data string) error {
+	return c.apply(command{
+		Operation:  opUpsertSigned,
+		Key:        key,
+		Data:       []byte(data),
+		DataType:   dataType,
+		Expiration: expiration,
+	})
+}
@@ -0,0 +1,105 @@
+package raftstore
+
+import (
+	"errors"
+	"net/rpc"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+func newClient(config Config, logger log.DebugLogger) (*Client, error) {
+	if len(config.Peers) < 1 {
+		return nil, errors.New("no peers specified")
+	}
+	_, tlsConfig, err := loadTLSConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{config: config, logger: logger, tlsConfig: tlsConfig}, nil
+}
+
+// call makes an RPC to the current peer, moving on to the next peers if it
+// cannot be reached.
+func (c *Client) call(method string, args interface{},
+	reply interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var err error
+	for range c.config.Peers {
+		if c.rpcClient == nil {
+			address := c.config.Peers[c.peerIndex]
+			conn, e := dial(address, connectionTypeRPC, c.tlsConfig,
+				dialTimeout)
+			if e != nil {
+				c.logger.Debugf(0, "raftstore: %s: %s\n", address, e)
+				err = e
+				c.peerIndex = (c.peerIndex + 1) % len(c.config.Peers)
+				continue
+			}
+			c.rpcClient = rpc.NewClient(conn)
+		}
+		err = c.rpcClient.Call(rpcServiceName+"."+method, args, reply)
+		if _, ok := err.(rpc.ServerError); err == nil || ok {
+			return err
+		}
+		c.rpcClient.Close()
+		c.rpcClient = nil
+		c.peerIndex = (c.peerIndex + 1) % len(c.config.Peers)
+	}
+	return err
+}
+
+func (c *Client) apply(cmd command) error {
+	encodedCommand, err := cmd.encode()
+	if err != nil {
+		return err
+	}
+	return c.call("Apply", ApplyRequest{Command: encodedCommand},
+		&ApplyResponse{})
+}
+
+func (c *Client) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.rpcClient == nil {
+		return nil
+	}
+	err := c.rpcClient.Close()
+	c.rpcClient = nil
+	return err
+}
+
+func (c *Client) getSigned(key string, dataType int) (bool, string, error) {
+	var reply GetSignedResponse
+	err := c.call("GetSigned",
+		GetSignedRequest{Key: key, DataType: dataType}, &reply)
+	if err != nil {
+		return false, "", err
+	}
+	return reply.Ok, reply.Data, nil
+}
+
+func (c *Client) getUsers() ([]string, bool, error) {
+	var users []string
+	if err := c.call("GetUsers", struct{}{}, &users); err != nil {
+		return nil, false, err
+	}
+	return users, false, nil
+}
+
+func (c *Client) listSigned() ([]profilestore.SignedData, error) {
+	var signedDataList []profilestore.SignedData
+	if err := c.call("ListSigned", struct{}{}, &signedDataList); err != nil {
+		return nil, err
+	}
+	return signedDataList, nil
+}
+
+func (c *Client) loadProfile(username string) ([]byte, bool, bool, error) {
+	var reply LoadProfileResponse
+	if err := c.call("LoadProfile", username, &reply); err != nil {
+		return nil, false, false, err
+	}
+	return reply.Data, reply.Ok, false, nil
+}
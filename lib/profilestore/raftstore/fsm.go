@@ -0,0 +1,93 @@
+package raftstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/memstore"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	opSaveProfile = iota + 1
+	opDeleteProfile
+	opUpsertSigned
+	opDeleteSigned
+	opDeleteExpiredSigned
+	opSwapProfile
+)
+
+// command is a change to the data, as written to the Raft log.
+type command struct {
+	Operation  uint
+	Key        string
+	Data       []byte
+	DataType   int
+	Expiration int64  // For opDeleteExpiredSigned: the time of deletion.
+	OldData    []byte // For opSwapProfile.
+}
+
+func (cmd command) encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(cmd); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// fsm applies the committed commands to the in-memory state. Commands must
+// not depend on anything but their contents, so that all the servers reach
+// the same state.
+type fsm struct {
+	state *memstore.MemStore
+}
+
+type fsmSnapshot struct {
+	state *memstore.MemStore
+}
+
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	var cmd command
+	if err := gob.NewDecoder(bytes.NewReader(log.Data)).Decode(
+		&cmd); err != nil {
+		return err
+	}
+	switch cmd.Operation {
+	case opSaveProfile:
+		return f.state.SaveProfile(cmd.Key, cmd.Data)
+	case opDeleteProfile:
+		return f.state.DeleteProfile(cmd.Key)
+	case opUpsertSigned:
+		return f.state.UpsertSigned(cmd.Key, cmd.DataType, cmd.Expiration,
+			string(cmd.Data))
+	case opDeleteSigned:
+		return f.state.DeleteSigned(cmd.Key, cmd.DataType)
+	case opDeleteExpiredSigned:
+		f.state.DeleteExpiredSigned(cmd.Expiration)
+		return nil
+	case opSwapProfile:
+		return f.state.SwapProfile(cmd.Key, cmd.OldData, cmd.Data)
+	}
+	return fmt.Errorf("unknown operation: %d", cmd.Operation)
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &fsmSnapshot{f.state.Clone()}, nil
+}
+
+func (f *fsm) Restore(reader io.ReadCloser) error {
+	defer reader.Close()
+	return f.state.Decode(reader)
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.state.Encode(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,237 @@
+package raftstore
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore/memstore"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	applyTimeout        = time.Second * 10
+	dialTimeout         = time.Second * 5
+	expireInterval      = time.Hour
+	maxLeaderContactAge = time.Second * 5
+	maxTransportPool    = 3
+	retainSnapshotCount = 2
+	transportTimeout    = time.Second * 10
+)
+
+// logWriter passes the output of the Raft library to a logger.
+type logWriter struct {
+	logger log.DebugLogger
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.logger.Print(string(p))
+	return len(p), nil
+}
+
+func newStore(config Config, logger log.DebugLogger) (*Store, error) {
+	if config.DataDirectory == "" {
+		return nil, errors.New("no data directory specified")
+	}
+	found := false
+	for _, peer := range config.Peers {
+		if peer == config.Address {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("address: %s not in peers", config.Address)
+	}
+	_, port, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, err
+	}
+	serverTLSConfig, clientTLSConfig, err := loadTLSConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.DataDirectory, 0700); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		config:          config,
+		logger:          logger,
+		state:           memstore.New(),
+		listener:        tls.NewListener(listener, serverTLSConfig),
+		clientTLSConfig: clientTLSConfig,
+		stopChannel:     make(chan struct{}),
+	}
+	layer := &streamLayer{
+		address:     advertisedAddress(config.Address),
+		connChannel: make(chan net.Conn),
+		stopChannel: s.stopChannel,
+		tlsConfig:   clientTLSConfig,
+	}
+	logOutput := &logWriter{logger}
+	s.transport = raft.NewNetworkTransport(layer, maxTransportPool,
+		transportTimeout, logOutput)
+	s.boltStore, err = raftboltdb.NewBoltStore(
+		filepath.Join(config.DataDirectory, "raft.db"))
+	if err != nil {
+		s.transport.Close()
+		s.listener.Close()
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(config.DataDirectory,
+		retainSnapshotCount, logOutput)
+	if err != nil {
+		s.boltStore.Close()
+		s.transport.Close()
+		s.listener.Close()
+		return nil, err
+	}
+	hasState, err := raft.HasExistingState(s.boltStore, s.boltStore,
+		snapshots)
+	if err != nil {
+		s.boltStore.Close()
+		s.transport.Close()
+		s.listener.Close()
+		return nil, err
+	}
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.Address)
+	raftConfig.LogOutput = logOutput
+	raftConfig.LogLevel = "WARN"
+	s.raft, err = raft.NewRaft(raftConfig, &fsm{s.state}, s.boltStore,
+		s.boltStore, snapshots, s.transport)
+	if err != nil {
+		s.boltStore.Close()
+		s.transport.Close()
+		s.listener.Close()
+		return nil, err
+	}
+	if !hasState {
+		var configuration raft.Configuration
+		for _, peer := range config.Peers {
+			configuration.Servers = append(configuration.Servers, raft.Server{
+				ID:      raft.ServerID(peer),
+				Address: raft.ServerAddress(peer),
+			})
+		}
+		err := s.raft.BootstrapCluster(configuration).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			s.close()
+			return nil, err
+		}
+		logger.Printf("raftstore: bootstrapped cluster with %d peers\n",
+			len(config.Peers))
+	}
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName(rpcServiceName,
+		&rpcService{s}); err != nil {
+		s.close()
+		return nil, err
+	}
+	go s.serveConnections(layer, rpcServer.ServeConn)
+	go s.expireLoop()
+	return s, nil
+}
+
+func (s *Store) apply(cmd command) error {
+	encodedCommand, err := cmd.encode()
+	if err != nil {
+		return err
+	}
+	if s.IsLeader() {
+		_, err := s.raftApply(encodedCommand)
+		return err
+	}
+	_, err = s.forward(encodedCommand)
+	return err
+}
+
+// raftApply commits an encoded command and returns its log index. The server
+// must be the leader.
+func (s *Store) raftApply(encodedCommand []byte) (uint64, error) {
+	future := s.raft.Apply(encodedCommand, applyTimeout)
+	if err := future.Error(); err != nil {
+		return 0, err
+	}
+	if err, ok := future.Response().(error); ok {
+		return 0, err
+	}
+	return future.Index(), nil
+}
+
+// waitForIndex waits until the log up to index has been applied locally, so
+// that reads on this server see the writes it forwarded.
+func (s *Store) waitForIndex(index uint64) error {
+	timeout := time.Now().Add(applyTimeout)
+	for s.raft.AppliedIndex() < index {
+		if time.Now().After(timeout) {
+			return fmt.Errorf("timed out waiting for index: %d", index)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
+
+// isStale returns true if this server is a follower which has lost contact
+// with the leader, so that its data may be out of date.
+func (s *Store) isStale() bool {
+	if s.IsLeader() {
+		return false
+	}
+	if leaderAddress, _ := s.raft.LeaderWithID(); leaderAddress == "" {
+		return true
+	}
+	return time.Since(s.raft.LastContact()) > maxLeaderContactAge
+}
+
+// expireLoop has the leader delete expired signed data, which would
+// otherwise accumulate since nothing else deletes it.
+func (s *Store) expireLoop() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopChannel:
+			return
+		case <-ticker.C:
+		}
+		if !s.IsLeader() {
+			continue
+		}
+		err := s.apply(command{
+			Operation:  opDeleteExpiredSigned,
+			Expiration: time.Now().Unix(),
+		})
+		if err != nil {
+			s.logger.Printf("raftstore: error deleting expired data: %s\n",
+				err)
+		}
+	}
+}
+
+func (s *Store) close() error {
+	err := s.raft.Shutdown().Error()
+	close(s.stopChannel)
+	s.transport.Close()
+	s.listener.Close()
+	if err := s.boltStore.Close(); err != nil {
+		s.logger.Printf("raftstore: error closing log: %s\n", err)
+	}
+	s.forwardMutex.Lock()
+	defer s.forwardMutex.Unlock()
+	if s.leaderClient != nil {
+		s.leaderClient.Close()
+		s.leaderClient = nil
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package raftstore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+func writeTestPEM(t *testing.T, filename, blockType string, data []byte) {
+	err := os.WriteFile(filename,
+		pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestingConfig returns a Config with a CA and a certificate for
+// 127.0.0.1 and the given peers, with Address and DataDirectory to be set.
+func newTestingConfig(t *testing.T, peers []string) Config {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raftstore test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate,
+		&caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert,
+		&key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		Peers:           peers,
+		TLSCAFilename:   filepath.Join(dir, "ca.pem"),
+		TLSCertFilename: filepath.Join(dir, "cert.pem"),
+		TLSKeyFilename:  filepath.Join(dir, "key.pem"),
+	}
+	writeTestPEM(t, config.TLSCAFilename, "CERTIFICATE", caDer)
+	writeTestPEM(t, config.TLSCertFilename, "CERTIFICATE", der)
+	writeTestPEM(t, config.TLSKeyFilename, "PRIVATE KEY", keyDer)
+	return config
+}
+
+func getTestingAddresses(t *testing.T, count int) []string {
+	var addresses []string
+	for i := 0; i < count; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, listener.Addr().String())
+		listener.Close()
+	}
+	return addresses
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	for timeout := time.Now().Add(time.Second * 30); ; {
+		if condition() {
+			return
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("timed out waiting for: %s", description)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	config := newTestingConfig(t, getTestingAddresses(t, 3))
+	var stores []*Store
+	for _, address := range config.Peers {
+		storeConfig := config
+		storeConfig.Address = address
+		storeConfig.DataDirectory = t.TempDir()
+		s, err := New(storeConfig, testlogger.New(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+	}
+	defer func() {
+		for _, s := range stores {
+			s.Close()
+		}
+	}()
+	var follower *Store
+	waitFor(t, "leader", func() bool {
+		numLeaders := 0
+		for _, s := range stores {
+			if s.IsLeader() {
+				numLeaders++
+			} else {
+				follower = s
+			}
+		}
+		return numLeaders == 1
+	})
+	// Forwarded to the leader, and readable on the follower once done.
+	if err := follower.SaveProfile("user1", []byte("profile1")); err != nil {
+		t.Fatal(err)
+	}
+	profile, found, fromCache, err := follower.LoadProfile("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !bytes.Equal(profile, []byte("profile1")) || fromCache {
+		t.Fatalf("unexpected profile on follower: %v %q %v", found, profile,
+			fromCache)
+	}
+	// Conditional updates are checked by the leader.
+	if err := follower.SwapProfile("user1", []byte("other"),
+		[]byte("profile2")); err != profilestore.ErrProfileChanged {
+		t.Fatalf("expected ErrProfileChanged, got: %v", err)
+	}
+	if err := follower.SwapProfile("user1", []byte("profile1"),
+		[]byte("profile1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		waitFor(t, "replication", func() bool {
+			data, ok, _, err := s.LoadProfile("user1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ok && bytes.Equal(data, []byte("profile1"))
+		})
+	}
+	client, err := NewClient(config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	expiration := time.Now().Add(time.Hour).Unix()
+	if err := client.UpsertSigned("key1", 1, expiration, "d1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		waitFor(t, "replication", func() bool {
+			ok, _, err := s.GetSigned("key1", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ok
+		})
+	}
+	ok, data, err := client.GetSigned("key1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || data != "d1" {
+		t.Fatalf("unexpected signed data: %v %q", ok, data)
+	}
+	users, _, err := client.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0] != "user1" {
+		t.Fatalf("unexpected users: %v", users)
+	}
+	if err := client.DeleteProfile("user1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		waitFor(t, "replication", func() bool {
+			_, ok, _, err := s.LoadProfile("user1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return !ok
+		})
+	}
+	// A follower cut off from the leader serves reads from its cache.
+	for _, s := range stores {
+		if s != follower {
+			s.Close()
+		}
+	}
+	stores = []*Store{follower}
+	waitFor(t, "stale follower", func() bool {
+		_, _, fromCache, err := follower.LoadProfile("user1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fromCache
+	})
+	if _, fromCache, err := follower.GetUsers(); err != nil {
+		t.Fatal(err)
+	} else if !fromCache {
+		t.Error("users not reported as cached")
+	}
+}
+
+func TestNewRequiresAddressInPeers(t *testing.T) {
+	config := newTestingConfig(t, []string{"127.0.0.1:1"})
+	config.Address = "127.0.0.1:2"
+	config.DataDirectory = t.TempDir()
+	if _, err := New(config, testlogger.New(t)); err == nil {
+		t.Fatal("New succeeded with an address not in the peers")
+	}
+}
@@ -0,0 +1,149 @@
+package raftstore
+
+import (
+	"errors"
+	"net/rpc"
+
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+const rpcServiceName = "ProfileStore"
+
+var errNotLeader = errors.New("not the leader")
+
+// The RPC message types are exported because net/rpc requires it.
+
+type ApplyRequest struct {
+	Command   []byte // Encoded command.
+	Forwarded bool   // If true, the receiver must be the leader.
+}
+
+type ApplyResponse struct {
+	Index uint64 // Log index of the command.
+}
+
+type GetSignedRequest struct {
+	Key      string
+	DataType int
+}
+
+type GetSignedResponse struct {
+	Ok   bool
+	Data string
+}
+
+type LoadProfileResponse struct {
+	Data []byte
+	Ok   bool
+}
+
+// rpcService serves the requests of the other members of the cluster and of
+// Clients.
+type rpcService struct {
+	store *Store
+}
+
+func (t *rpcService) Apply(request ApplyRequest, reply *ApplyResponse) error {
+	var err error
+	if t.store.IsLeader() {
+		reply.Index, err = t.store.raftApply(request.Command)
+		return err
+	}
+	if request.Forwarded {
+		return errNotLeader
+	}
+	reply.Index, err = t.store.forward(request.Command)
+	return err
+}
+
+func (t *rpcService) GetSigned(request GetSignedRequest,
+	reply *GetSignedResponse) error {
+	ok, data, err := t.store.state.GetSigned(request.Key, request.DataType)
+	if err != nil {
+		return err
+	}
+	reply.Ok = ok
+	reply.Data = data
+	return nil
+}
+
+func (t *rpcService) GetUsers(request struct{}, reply *[]string) error {
+	users, _, err := t.store.state.GetUsers()
+	if err != nil {
+		return err
+	}
+	*reply = users
+	return nil
+}
+
+func (t *rpcService) ListSigned(request struct{},
+	reply *[]profilestore.SignedData) error {
+	signedDataList, err := t.store.state.ListSigned()
+	if err != nil {
+		return err
+	}
+	*reply = signedDataList
+	return nil
+}
+
+func (t *rpcService) LoadProfile(username string,
+	reply *LoadProfileResponse) error {
+	data, ok, _, err := t.store.state.LoadProfile(username)
+	if err != nil {
+		return err
+	}
+	reply.Data = data
+	reply.Ok = ok
+	return nil
+}
+
+// forward sends an encoded command to the leader and waits until it has been
+// applied locally. It returns the log index of the command.
+func (s *Store) forward(encodedCommand []byte) (uint64, error) {
+	client, err := s.getLeaderClient()
+	if err != nil {
+		return 0, err
+	}
+	var reply ApplyResponse
+	err = client.Call(rpcServiceName+".Apply",
+		ApplyRequest{Command: encodedCommand, Forwarded: true}, &reply)
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		s.forwardMutex.Lock()
+		if s.leaderClient == client {
+			s.leaderClient.Close()
+			s.leaderClient = nil
+		}
+		s.forwardMutex.Unlock()
+	}
+	if err != nil {
+		if err.Error() == profilestore.ErrProfileChanged.Error() {
+			return 0, profilestore.ErrProfileChanged
+		}
+		return 0, err
+	}
+	return reply.Index, s.waitForIndex(reply.Index)
+}
+
+func (s *Store) getLeaderClient() (*rpc.Client, error) {
+	leaderAddress, _ := s.raft.LeaderWithID()
+	if leaderAddress == "" {
+		return nil, errors.New("no leader")
+	}
+	s.forwardMutex.Lock()
+	defer s.forwardMutex.Unlock()
+	if s.leaderClient != nil && s.leaderAddress == string(leaderAddress) {
+		return s.leaderClient, nil
+	}
+	if s.leaderClient != nil {
+		s.leaderClient.Close()
+		s.leaderClient = nil
+	}
+	conn, err := dial(string(leaderAddress), connectionTypeRPC,
+		s.clientTLSConfig, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s.leaderAddress = string(leaderAddress)
+	s.leaderClient = rpc.NewClient(conn)
+	return s.leaderClient, nil
+}
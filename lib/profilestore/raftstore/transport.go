@@ -0,0 +1,156 @@
+package raftstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// The first byte sent on a connection selects the protocol.
+const (
+	connectionTypeRaft = 'R'
+	connectionTypeRPC  = 'C'
+
+	connectionTypeTimeout = time.Second * 10
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// loadTLSConfigs returns the configurations for accepting and for making
+// connections. Both sides must present a certificate signed by the CA.
+func loadTLSConfigs(config Config) (*tls.Config, *tls.Config, error) {
+	if config.TLSCertFilename == "" || config.TLSKeyFilename == "" ||
+		config.TLSCAFilename == "" {
+		return nil, nil, errors.New("TLS certificate, key and CA required")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFilename,
+		config.TLSKeyFilename)
+	if err != nil {
+		return nil, nil, err
+	}
+	caPEM, err := os.ReadFile(config.TLSCAFilename)
+	if err != nil {
+		return nil, nil, err
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("no certificates in: %s",
+			config.TLSCAFilename)
+	}
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	clientConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caPool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return serverConfig, clientConfig, nil
+}
+
+// dial makes a connection for the protocol given by connectionType.
+func dial(address string, connectionType byte, tlsConfig *tls.Config,
+	timeout time.Duration) (net.Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp",
+		address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{connectionType}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+type advertisedAddress string
+
+func (address advertisedAddress) Network() string { return "tcp" }
+
+func (address advertisedAddress) String() string { return string(address) }
+
+// streamLayer is the raft.StreamLayer for the Raft connections accepted by
+// serveConnections.
+type streamLayer struct {
+	address     advertisedAddress
+	connChannel chan net.Conn
+	stopChannel <-chan struct{}
+	tlsConfig   *tls.Config
+}
+
+func (sl *streamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-sl.connChannel:
+		return conn, nil
+	case <-sl.stopChannel:
+		return nil, errListenerClosed
+	}
+}
+
+// Close is a no-op, the listener is closed by the Store.
+func (sl *streamLayer) Close() error {
+	return nil
+}
+
+func (sl *streamLayer) Addr() net.Addr {
+	return sl.address
+}
+
+func (sl *streamLayer) Dial(address raft.ServerAddress,
+	timeout time.Duration) (net.Conn, error) {
+	return dial(string(address), connectionTypeRaft, sl.tlsConfig, timeout)
+}
+
+// serveConnections hands the Raft connections to the stream layer and serves
+// the RPC connections.
+func (s *Store) serveConnections(layer *streamLayer,
+	serveRPC func(conn io.ReadWriteCloser)) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.stopChannel:
+				return
+			default:
+			}
+			s.logger.Printf("raftstore: accept error: %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go func(conn net.Conn) {
+			connectionType := make([]byte, 1)
+			conn.SetReadDeadline(time.Now().Add(connectionTypeTimeout))
+			if _, err := conn.Read(connectionType); err != nil {
+				s.logger.Debugf(1, "raftstore: %s: %s\n",
+					conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			switch connectionType[0] {
+			case connectionTypeRaft:
+				select {
+				case layer.connChannel <- conn:
+				case <-s.stopChannel:
+					conn.Close()
+				}
+			case connectionTypeRPC:
+				serveRPC(conn)
+			default:
+				s.logger.Printf("raftstore: %s: unknown connection type: %d\n",
+					conn.RemoteAddr(), connectionType[0])
+				conn.Close()
+			}
+		}(conn)
+	}
+}
@@ -0,0 +1,123 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+	"github.com/lib/pq"
+)
+
+type Config struct {
+	// StorageUrl is "sqlite:" optionally followed by a filename, or a
+	// "postgresql:" URL. Default: "sqlite:".
+	StorageUrl string
+	// DataDirectory contains the SQLite DB if StorageUrl has no filename.
+	DataDirectory string
+	// CacheFilename is the local SQLite cache of the DB, read when the DB
+	// does not respond in time. If empty there is no cache.
+	CacheFilename      string
+	ConnectionLifetime time.Duration
+	// ReadOnly opens the DB without applying the schema migrations, and
+	// writes fail with ErrReadOnly.
+	ReadOnly     bool
+	SyncDelay    time.Duration
+	SyncInterval time.Duration
+}
+
+// ErrNoSchema is returned by New in read-only mode if the DB does not exist
+// or has no profile table.
+var ErrNoSchema = errors.New("profile DB not initialised")
+
+// ErrReadOnly is returned by writes to a Store opened in read-only mode.
+var ErrReadOnly = errors.New("profile DB opened read-only")
+
+// MigrationStatus describes a schema migration.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	AppliedAt   time.Time // Zero if not applied.
+	Unknown     bool      // Applied by a newer version.
+}
+
+// Store is a profilestore.ProfileStore in an SQLite or PostgreSQL DB.
+type Store struct {
+	config               Config
+	logger               log.DebugLogger
+	db                   *sql.DB
+	dbType               string
+	cacheDB              *sql.DB
+	dbChanged            chan struct{} // Profile DB change notifications.
+	dbDone               chan struct{}
+	listener             *pq.Listener
+	remoteDBQueryTimeout time.Duration
+	// Versions of profile_changes skipped by the sync, which are applied if
+	// they appear later. Value: when first found missing.
+	missingVersions map[int64]time.Time
+}
+
+var (
+	_ profilestore.ProfileStore   = (*Store)(nil)
+	_ profilestore.ProfileSwapper = (*Store)(nil)
+)
+
+// GetMigrationStatus returns the schema migrations known to this version,
+// followed by those applied to the DB by newer versions.
+func GetMigrationStatus(config Config) ([]MigrationStatus, error) {
+	return getMigrationStatus(config)
+}
+
+// Migrate applies the pending schema migrations to the DB and returns how many
+// were applied. Concurrent migrations of a PostgreSQL DB are serialised.
+func Migrate(config Config, logger log.DebugLogger) (int, error) {
+	return migrate(config, logger)
+}
+
+// New opens the DB, applying the pending schema migrations unless
+// config.ReadOnly is set, and starts syncing the cache.
+func New(config Config, logger log.DebugLogger) (*Store, error) {
+	return newStore(config, logger)
+}
+
+func (s *Store) Close() error {
+	return s.close()
+}
+
+func (s *Store) DeleteProfile(username string) error {
+	return s.deleteProfile(username)
+}
+
+func (s *Store) DeleteSigned(key string, dataType int) error {
+	return s.deleteSigned(key, dataType)
+}
+
+func (s *Store) GetSigned(key string, dataType int) (bool, string, error) {
+	return s.getSigned(key, dataType)
+}
+
+func (s *Store) GetUsers() ([]string, bool, error) {
+	return s.getUsers()
+}
+
+func (s *Store) ListSigned() ([]profilestore.SignedData, error) {
+	return s.listSigned()
+}
+
+func (s *Store) LoadProfile(username string) ([]byte, bool, bool, error) {
+	return s.loadProfile(username)
+}
+
+func (s *Store) SaveProfile(username string, data []byte) error {
+	return s.saveProfile(username, data)
+}
+
+func (s *Store) SwapProfile(username string, oldData, newData []byte) error {
+	return s.swapProfile(username, oldData, newData)
+}
+
+func (s *Store) UpsertSigned(key string, dataType int, expiration int64,
+	data string) error {
+	return s.upsertSigned(key, dataType, expiration, data)
+}
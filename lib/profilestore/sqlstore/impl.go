@@ -0,0 +1,552 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	profileDBFilename = "userProfiles.sqlite3"
+
+	dbConnectionLifetimeDefault = time.Minute * 15
+	dbConnectionLifetimeMaximum = time.Hour
+
+	dbSyncDelayDefault = time.Second * 3
+	dbSyncDelayMinimum = time.Second
+	dbSyncDelayMaximum = time.Minute
+
+	dbSyncIntervalDefault = time.Second * 5
+	dbSyncIntervalMinimum = time.Second
+	dbSyncIntervalMaximum = time.Minute * 15
+
+	remoteDBQueryTimeout = time.Second * 2
+)
+
+func (config *Config) setSyncLimits() {
+	if config.SyncDelay < 1 {
+		config.SyncDelay = dbSyncDelayDefault
+	} else if config.SyncDelay < dbSyncDelayMinimum {
+		config.SyncDelay = dbSyncDelayMinimum
+	} else if config.SyncDelay > dbSyncDelayMaximum {
+		config.SyncDelay = dbSyncDelayMaximum
+	}
+	if config.SyncInterval < 1 {
+		config.SyncInterval = dbSyncIntervalDefault
+	} else if config.SyncInterval < dbSyncIntervalMinimum {
+		config.SyncInterval = dbSyncIntervalMinimum
+	} else if config.SyncInterval > dbSyncIntervalMaximum {
+		config.SyncInterval = dbSyncIntervalMaximum
+	}
+	if config.ConnectionLifetime < 1 {
+		config.ConnectionLifetime = dbConnectionLifetimeDefault
+	}
+	if config.ConnectionLifetime < config.SyncInterval {
+		config.ConnectionLifetime = config.SyncInterval
+	} else if config.ConnectionLifetime > dbConnectionLifetimeMaximum {
+		config.ConnectionLifetime = dbConnectionLifetimeMaximum
+	}
+}
+
+func newStore(config Config, logger log.DebugLogger) (*Store, error) {
+	logger.Debugf(3, "Top of sqlstore.New")
+	config.setSyncLimits()
+	s := &Store{
+		config:               config,
+		logger:               logger,
+		dbChanged:            make(chan struct{}, 1),
+		dbDone:               make(chan struct{}),
+		remoteDBQueryTimeout: remoteDBQueryTimeout,
+	}
+	var err error
+	s.db, s.dbType, err = openDB(config)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf(1, "doing %s", s.dbType)
+	if config.ReadOnly {
+		err = checkSchema(s.db, s.dbType)
+	} else {
+		_, err = migrateDB(s.db, s.dbType, logger)
+	}
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	if s.dbType == "sqlite" {
+		s.db.SetMaxIdleConns(0) // Make the DB NFS-friendly.
+	} else {
+		// Ensure that broken connections are replaced.
+		s.db.SetConnMaxLifetime(config.ConnectionLifetime)
+	}
+	if config.CacheFilename == "" {
+		return s, nil
+	}
+	s.cacheDB, err = initFileDBSQLite(config.CacheFilename, logger)
+	if err != nil {
+		logger.Printf("Failure on creation of cacheDB")
+		s.db.Close()
+		return nil, err
+	}
+	if s.dbType == "postgres" {
+		s.listenForDBChanges()
+	}
+	go s.backgroundDBSync(config.SyncDelay, s.dbDone)
+	return s, nil
+}
+
+func (s *Store) close() error {
+	if s.cacheDB != nil {
+		close(s.dbDone)
+		s.cacheDB.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	return s.db.Close()
+}
+
+// openDB opens the DB at config.StorageUrl without changing it and returns
+// the DB type. In read-only mode an SQLite DB must exist and is opened
+// read-only.
+func openDB(config Config) (*sql.DB, string, error) {
+	storageURL := config.StorageUrl
+	if storageURL == "" {
+		storageURL = "sqlite:"
+	}
+	splitString := strings.SplitN(storageURL, ":", 2)
+	if len(splitString) < 2 {
+		return nil, "", errors.New("Bad storage url string")
+	}
+	switch splitString[0] {
+	case "sqlite":
+		dbFilename := splitString[1]
+		if dbFilename == "" {
+			dbFilename = filepath.Join(config.DataDirectory, profileDBFilename)
+		}
+		if config.ReadOnly {
+			if _, err := os.Stat(dbFilename); os.IsNotExist(err) {
+				return nil, "", ErrNoSchema
+			}
+			dbFilename = "file:" + dbFilename + "?mode=ro"
+		}
+		db, err := sql.Open("sqlite3", dbFilename)
+		return db, "sqlite", err
+	case "postgresql":
+		db, err := sql.Open("postgres", config.StorageUrl)
+		return db, "postgres", err
+	}
+	return nil, "", errors.New("Bad storage url string")
+}
+
+var countUserProfileTablesStmt = map[string]string{
+	"sqlite":   "select count(*) from sqlite_master where type = 'table' and name = 'user_profile'",
+	"postgres": "select count(*) from information_schema.tables where table_name = 'user_profile' and table_schema = current_schema()",
+}
+
+// checkSchema returns ErrNoSchema if the profile table is missing, such as in
+// a new DB which was never migrated.
+func checkSchema(db *sql.DB, dbType string) error {
+	var count int
+	err := db.QueryRow(countUserProfileTablesStmt[dbType]).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count < 1 {
+		return ErrNoSchema
+	}
+	return nil
+}
+
+// This call initializes the database if it does not exist and applies the
+// pending migrations.
+func initFileDBSQLite(dbFilename string, logger log.DebugLogger) (
+	*sql.DB, error) {
+	if _, err := os.Stat(dbFilename); os.IsNotExist(err) {
+		logger.Printf("creating new db: %s", dbFilename)
+	}
+	fileDB, err := sql.Open("sqlite3", dbFilename)
+	if err != nil {
+		logger.Printf("Failure opening db: %s", dbFilename)
+		return nil, err
+	}
+	if _, err := migrateDB(fileDB, "sqlite", logger); err != nil {
+		fileDB.Close()
+		return nil, err
+	}
+	return fileDB, nil
+}
+
+func cleanupDBData(db *sql.DB, logger log.Logger) error {
+	if db == nil {
+		err := errors.New("nil database on cleanup")
+		return err
+	}
+	queryStr := fmt.Sprintf(
+		"DELETE from expiring_signed_user_data WHERE expiration_epoch < %d",
+		time.Now().Unix())
+	rows, err := db.Query(queryStr)
+	if err != nil {
+		logger.Printf("err='%s'", err)
+		return err
+	}
+	defer rows.Close()
+	return nil
+}
+
+func copyDBIntoSQLite(source, destination *sql.DB,
+	destinationType string) error {
+	if source == nil || destination == nil {
+		err := errors.New("nil databases")
+		return err
+	}
+	// Copy user profiles
+	rows, err := source.Query("SELECT username,profile_data FROM user_profile")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	queryStr := fmt.Sprintf(
+		"SELECT username, type, jws_data, expiration_epoch,update_epoch FROM expiring_signed_user_data WHERE expiration_epoch > %d",
+		time.Now().Unix())
+	genericRows, err := source.Query(queryStr)
+	if err != nil {
+		return err
+	}
+	defer genericRows.Close()
+	tx, err := destination.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"user_profile", "expiring_signed_user_data"} {
+		if _, err := tx.Exec("DELETE from " + table); err != nil {
+			return err
+		}
+	}
+	stmtText := saveUserProfileStmt[destinationType]
+	stmt, err := tx.Prepare(stmtText)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for rows.Next() {
+		var (
+			username     string
+			profileBytes []byte
+		)
+		if err := rows.Scan(&username, &profileBytes); err != nil {
+			return err
+		}
+		_, err = stmt.Exec(username, profileBytes)
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	expiringUpsertText := saveSignedUserDataStmt[destinationType]
+	expiringUpsertStmt, err := tx.Prepare(expiringUpsertText)
+	if err != nil {
+		return err
+	}
+	defer expiringUpsertStmt.Close()
+	for genericRows.Next() {
+		var (
+			username        string
+			dataType        int
+			jwsData         string
+			expirationEpoch int64
+			updateEpoch     int64
+		)
+		if err := genericRows.Scan(&username, &dataType, &jwsData,
+			&expirationEpoch, &updateEpoch); err != nil {
+			return err
+		}
+		//username, type, jws_data, expiration_epoch, update_epoch
+		_, err = expiringUpsertStmt.Exec(username, dataType, jwsData,
+			expirationEpoch, updateEpoch)
+		if err != nil {
+			return err
+		}
+	}
+	if err := genericRows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var getUsersStmt = map[string]string{
+	"sqlite":   "select username from user_profile order by username",
+	"postgres": "select username from user_profile order by username",
+}
+
+func gatherUsers(stmt *sql.Stmt) ([]string, error) {
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+type queryResult struct {
+	value interface{}
+	err   error
+}
+
+// queryWithFallback runs query against the DB, or against the cache DB if
+// the DB does not respond within the timeout. It returns true if the result
+// came from the cache.
+func (s *Store) queryWithFallback(name string,
+	query func(db *sql.DB, dbType string) (interface{}, error)) (
+	interface{}, bool, error) {
+	ch := make(chan queryResult, 1)
+	go func() {
+		// if the remoteDBQueryTimeout == 0 this means we are actuallty
+		// trying to force the cached db. In single core systems, we need to
+		// ensure this goroutine yields to sthis sleep is necesary
+		if s.remoteDBQueryTimeout == 0 && s.cacheDB != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		value, err := query(s.db, s.dbType)
+		ch <- queryResult{value, err}
+	}()
+	if s.cacheDB == nil {
+		result := <-ch
+		return result.value, false, result.err
+	}
+	select {
+	case result := <-ch:
+		return result.value, false, result.err
+	case <-time.After(s.remoteDBQueryTimeout):
+		s.logger.Printf("%s: timed out on primary DB\n", name)
+		value, err := query(s.cacheDB, "sqlite")
+		if err == nil {
+			s.logger.Printf("%s: got data from DB cache\n", name)
+		}
+		return value, true, err
+	}
+}
+
+func (s *Store) getUsers() ([]string, bool, error) {
+	value, fromCache, err := s.queryWithFallback("GetUsers",
+		func(db *sql.DB, dbType string) (interface{}, error) {
+			stmt, err := db.Prepare(getUsersStmt[dbType])
+			if err != nil {
+				return nil, err
+			}
+			defer stmt.Close()
+			return gatherUsers(stmt)
+		})
+	if err != nil {
+		s.logger.Printf("Problem with db ='%s'", err)
+		return nil, fromCache, err
+	}
+	return value.([]string), fromCache, nil
+}
+
+var loadUserProfileStmt = map[string]string{
+	"sqlite":   "select profile_data from user_profile where username = ?",
+	"postgres": "select profile_data from user_profile where username = $1",
+}
+
+/// Adding api to be load/save per user
+
+// Notice: each operation load/save should be atomic.
+
+func (s *Store) loadProfile(username string) ([]byte, bool, bool, error) {
+	value, fromCache, err := s.queryWithFallback("LoadProfile",
+		func(db *sql.DB, dbType string) (interface{}, error) {
+			var profileBytes []byte
+			err := db.QueryRow(loadUserProfileStmt[dbType], username).Scan(
+				&profileBytes)
+			return profileBytes, err
+		})
+	if err == sql.ErrNoRows {
+		if !fromCache {
+			s.updateCache(deleteUserProfileStmt["sqlite"], username)
+		}
+		return nil, false, fromCache, nil
+	}
+	if err != nil {
+		s.logger.Printf("Problem with db ='%s'", err)
+		return nil, false, fromCache, err
+	}
+	profileBytes := value.([]byte)
+	if !fromCache {
+		s.updateCache(saveUserProfileStmt["sqlite"], username, profileBytes)
+	}
+	s.logger.Debugf(10, "profile bytes len=%d", len(profileBytes))
+	return profileBytes, true, fromCache, nil
+}
+
+var saveUserProfileStmt = map[string]string{
+	"sqlite":   "insert or replace into user_profile(username, profile_data) values(?, ?)",
+	"postgres": "insert into user_profile(username, profile_data) values ($1,$2) on CONFLICT(username) DO UPDATE set  profile_data = excluded.profile_data",
+}
+
+// write runs stmtText in a transaction which also records the change.
+func (s *Store) write(username string, stmtText map[string]string,
+	args ...interface{}) error {
+	if s.config.ReadOnly {
+		return ErrReadOnly
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(stmtText[s.dbType])
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(args...); err != nil {
+		return err
+	}
+	if err := recordChange(tx, s.dbType, username); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.updateCache(stmtText["sqlite"], args...)
+	return nil
+}
+
+func (s *Store) saveProfile(username string, data []byte) error {
+	return s.write(username, saveUserProfileStmt, username, data)
+}
+
+var swapUserProfileStmt = map[string]string{
+	"sqlite":   "update user_profile set profile_data = ? where username = ? and profile_data = ?",
+	"postgres": "update user_profile set profile_data = $1 where username = $2 and profile_data = $3",
+}
+
+func (s *Store) swapProfile(username string, oldData, newData []byte) error {
+	if s.config.ReadOnly {
+		return ErrReadOnly
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(swapUserProfileStmt[s.dbType], newData, username,
+		oldData)
+	if err != nil {
+		return err
+	}
+	if numRows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if numRows < 1 {
+		return profilestore.ErrProfileChanged
+	}
+	if err := recordChange(tx, s.dbType, username); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.updateCache(saveUserProfileStmt["sqlite"], username, newData)
+	return nil
+}
+
+var deleteUserProfileStmt = map[string]string{
+	"sqlite":   "delete from  user_profile where username = ?",
+	"postgres": "delete from  user_profile where username = $1",
+}
+
+func (s *Store) deleteProfile(username string) error {
+	return s.write(username, deleteUserProfileStmt, username)
+}
+
+var deleteSignedUserDataStmt = map[string]string{
+	"sqlite":   "delete from expiring_signed_user_data where username = ? and type = ?",
+	"postgres": "delete from expiring_signed_user_data where username = $1 and type = $2",
+}
+
+func (s *Store) deleteSigned(username string, dataType int) error {
+	return s.write(username, deleteSignedUserDataStmt, username, dataType)
+}
+
+var getSignedUserDataStmt = map[string]string{
+	"sqlite":   "select jws_data from expiring_signed_user_data where username = ? and type =? and expiration_epoch > ?",
+	"postgres": "select jws_data from expiring_signed_user_data where username = $1 and type = $2 and expiration_epoch > $3",
+}
+
+func (s *Store) getSigned(username string, dataType int) (bool, string,
+	error) {
+	value, _, err := s.queryWithFallback("GetSigned",
+		func(db *sql.DB, dbType string) (interface{}, error) {
+			var jwsData string
+			err := db.QueryRow(getSignedUserDataStmt[dbType], username,
+				dataType, time.Now().Unix()).Scan(&jwsData)
+			return jwsData, err
+		})
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		s.logger.Printf("Problem with db ='%s'", err)
+		return false, "", err
+	}
+	return true, value.(string), nil
+}
+
+var saveSignedUserDataStmt = map[string]string{
+	"sqlite":   "insert or replace into expiring_signed_user_data(username, type, jws_data, expiration_epoch, update_epoch) values(?,?, ?, ?, ?)",
+	"postgres": "insert into expiring_signed_user_data(username, type, jws_data, expiration_epoch, update_epoch) values ($1,$2,$3,$4, $5) ON CONFLICT(username,type) DO UPDATE SET  jws_data = excluded.jws_data, expiration_epoch = excluded.expiration_epoch",
+}
+
+func (s *Store) upsertSigned(username string, dataType int,
+	expirationEpoch int64, data string) error {
+	return s.write(username, saveSignedUserDataStmt, username, dataType, data,
+		expirationEpoch, time.Now().Unix())
+}
+
+var listSignedUserDataStmt = map[string]string{
+	"sqlite":   "select username, type, jws_data, expiration_epoch from expiring_signed_user_data where expiration_epoch > ? order by username, type",
+	"postgres": "select username, type, jws_data, expiration_epoch from expiring_signed_user_data where expiration_epoch > $1 order by username, type",
+}
+
+func (s *Store) listSigned() ([]profilestore.SignedData, error) {
+	rows, err := s.db.Query(listSignedUserDataStmt[s.dbType],
+		time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var signedDataList []profilestore.SignedData
+	for rows.Next() {
+		var signedData profilestore.SignedData
+		if err := rows.Scan(&signedData.Key, &signedData.Type,
+			&signedData.Data, &signedData.ExpirationEpoch); err != nil {
+			return nil, err
+		}
+		signedDataList = append(signedDataList, signedData)
+	}
+	return signedDataList, rows.Err()
+}
@@ -0,0 +1,195 @@
+package sqlstore
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/profilestore"
+)
+
+func newTestingStore(t *testing.T, config Config) *Store {
+	tmpdir := t.TempDir()
+	config.DataDirectory = tmpdir
+	config.CacheFilename = filepath.Join(tmpdir, "cachedDB.sqlite3")
+	s, err := New(config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestDBCopy(t *testing.T) {
+	s := newTestingStore(t, Config{})
+	// copy blank db
+	err := copyDBIntoSQLite(s.db, s.cacheDB, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SaveProfile("username", []byte("profile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// copy the db now with one user
+	err = copyDBIntoSQLite(s.db, s.cacheDB, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchFromCache(t *testing.T) {
+	s := newTestingStore(t, Config{})
+	err := s.SaveProfile("username", []byte("profile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// copy blank with one user...
+	err = copyDBIntoSQLite(s.db, s.cacheDB, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.remoteDBQueryTimeout = 0
+	data, _, fromCache, err := s.LoadProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromCache {
+		t.Fatal("did NOT got data from cache")
+	}
+	if string(data) != "profile" {
+		t.Fatalf("unexpected profile: %q", data)
+	}
+	_, ok, fromCache, err := s.LoadProfile("unknown-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromCache {
+		t.Fatal("did NOT got data from cache")
+	}
+	if ok {
+		t.Fatal("This should have failed for invalid user")
+	}
+	users, fromCache, err := s.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromCache {
+		t.Fatal("did NOT got data from cache")
+	}
+	if !reflect.DeepEqual(users, []string{"username"}) {
+		t.Fatalf("unexpected users: %v", users)
+	}
+}
+
+func TestSigned(t *testing.T) {
+	s := newTestingStore(t, Config{})
+	expiration := time.Now().Add(time.Hour).Unix()
+	if err := s.UpsertSigned("alice", 1, expiration, "data1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpsertSigned("alice", 1, expiration, "data2"); err != nil {
+		t.Fatal(err)
+	}
+	err := s.UpsertSigned("bob", 1, time.Now().Add(-time.Hour).Unix(),
+		"expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, data, err := s.GetSigned("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || data != "data2" {
+		t.Fatalf("unexpected signed data: %v, %q", ok, data)
+	}
+	if ok, _, err := s.GetSigned("bob", 1); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("got expired data")
+	}
+	signedDataList, err := s.ListSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signedDataList) != 1 || signedDataList[0].Key != "alice" ||
+		signedDataList[0].ExpirationEpoch != expiration {
+		t.Fatalf("unexpected signed data list: %v", signedDataList)
+	}
+	if err := s.DeleteSigned("alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := s.GetSigned("alice", 1); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("got deleted data")
+	}
+}
+
+func TestSwapProfile(t *testing.T) {
+	s := newTestingStore(t, Config{})
+	if err := s.SwapProfile("alice", []byte("old"),
+		[]byte("new")); err != profilestore.ErrProfileChanged {
+		t.Fatalf("expected ErrProfileChanged for missing profile, got: %v",
+			err)
+	}
+	if err := s.SaveProfile("alice", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SwapProfile("alice", []byte("other"),
+		[]byte("new")); err != profilestore.ErrProfileChanged {
+		t.Fatalf("expected ErrProfileChanged, got: %v", err)
+	}
+	if err := s.SwapProfile("alice", []byte("old"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	data, _, _, err := s.LoadProfile("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("unexpected profile: %q", data)
+	}
+	if count := countCachedProfiles(t, s.cacheDB, "alice"); count != 1 {
+		t.Fatalf("local cache has %d profiles for alice", count)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{DataDirectory: dir, ReadOnly: true}
+	if _, err := New(config, testlogger.New(t)); err != ErrNoSchema {
+		t.Fatalf("expected ErrNoSchema for missing DB, got: %v", err)
+	}
+	config.ReadOnly = false
+	s, err := New(config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveProfile("alice", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	config.ReadOnly = true
+	s, err = New(config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	data, ok, _, err := s.LoadProfile("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(data) != "old" {
+		t.Fatalf("unexpected profile: %v %q", ok, data)
+	}
+	if err := s.SaveProfile("alice", []byte("new")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got: %v", err)
+	}
+	if err := s.SwapProfile("alice", []byte("old"),
+		[]byte("new")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// migrationLockID is the PostgreSQL advisory lock held while migrating, so
+// that only one server migrates the DB at a time.
+const migrationLockID = 0x6b6d6462 // "kmdb"
+
+// migration is a versioned change to the schema. Each migration is applied in
+// a transaction and recorded in the schema_migrations table. Applied
+// migrations must never be changed: add a new one instead.
+type migration struct {
+	version     int
+	description string
+	statements  map[string][]string // Key: dbType.
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		// Tables may exist from before migrations were recorded.
+		statements: map[string][]string{
+			"postgres": {
+				`create table if not exists user_profile (id serial not null primary key, username text unique, profile_data bytea);`,
+				`create table if not exists expiring_signed_user_data(id serial not null primary key, username text not null, jws_data text not null, type integer not null, expiration_epoch integer not null, update_epoch integer not null, UNIQUE(username,type));`,
+				`create table if not exists profile_changes(version bigserial not null primary key, username text not null, change_epoch bigint not null);`,
+			},
+			"sqlite": {
+				`create table if not exists user_profile (id integer not null primary key, username text unique, profile_data blob);`,
+				`create table if not exists expiring_signed_user_data(id integer not null primary key, username text not null, jws_data text not null, type integer not null, expiration_epoch integer not null, update_epoch integer no null, UNIQUE(username,type));`,
+				`create table if not exists profile_changes(version integer not null primary key autoincrement, username text not null, change_epoch integer not null);`,
+				`create table if not exists cache_sync_state(id integer not null primary key, version integer not null);`,
+			},
+		},
+	},
+	{
+		version:     2,
+		description: "64-bit epochs for signed data",
+		// SQLite integers are already 64-bit.
+		statements: map[string][]string{
+			"postgres": {
+				`alter table expiring_signed_user_data alter column expiration_epoch type bigint, alter column update_epoch type bigint;`,
+			},
+		},
+	},
+}
+
+var createSchemaMigrationsStmt = map[string]string{
+	"sqlite":   "create table if not exists schema_migrations(version integer not null primary key, description text not null, applied_epoch integer not null);",
+	"postgres": "create table if not exists schema_migrations(version integer not null primary key, description text not null, applied_epoch bigint not null);",
+}
+
+var countSchemaMigrationsTablesStmt = map[string]string{
+	"sqlite":   "select count(*) from sqlite_master where type = 'table' and name = 'schema_migrations'",
+	"postgres": "select count(*) from information_schema.tables where table_name = 'schema_migrations' and table_schema = current_schema()",
+}
+
+var countMigrationStmt = map[string]string{
+	"sqlite":   "select count(*) from schema_migrations where version = ?",
+	"postgres": "select count(*) from schema_migrations where version = $1",
+}
+
+var getMigrationsStmt = map[string]string{
+	"sqlite":   "select version, description, applied_epoch from schema_migrations",
+	"postgres": "select version, description, applied_epoch from schema_migrations",
+}
+
+var insertMigrationStmt = map[string]string{
+	"sqlite":   "insert into schema_migrations(version, description, applied_epoch) values(?, ?, ?)",
+	"postgres": "insert into schema_migrations(version, description, applied_epoch) values($1, $2, $3)",
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string,
+		args ...interface{}) (*sql.Rows, error)
+}
+
+// getAppliedMigrations returns the migrations recorded in the DB.
+func getAppliedMigrations(ctx context.Context, db querier,
+	dbType string) (map[int]MigrationStatus, error) {
+	rows, err := db.QueryContext(ctx, getMigrationsStmt[dbType])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]MigrationStatus)
+	for rows.Next() {
+		var status MigrationStatus
+		var appliedEpoch int64
+		err := rows.Scan(&status.Version, &status.Description, &appliedEpoch)
+		if err != nil {
+			return nil, err
+		}
+		status.AppliedAt = time.Unix(appliedEpoch, 0)
+		applied[status.Version] = status
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration returns false if the migration was applied concurrently.
+func applyMigration(ctx context.Context, conn *sql.Conn, dbType string,
+	m migration) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var count int
+	err = tx.QueryRowContext(ctx, countMigrationStmt[dbType],
+		m.version).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	for _, sqlStmt := range m.statements[dbType] {
+		if _, err := tx.ExecContext(ctx, sqlStmt); err != nil {
+			return false, fmt.Errorf("%s: %q", err, sqlStmt)
+		}
+	}
+	_, err = tx.ExecContext(ctx, insertMigrationStmt[dbType], m.version,
+		m.description, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// migrateDB applies the pending migrations and returns how many were applied.
+func migrateDB(db *sql.DB, dbType string, logger log.DebugLogger) (
+	int, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if dbType == "postgres" {
+		_, err := conn.ExecContext(ctx, "select pg_advisory_lock($1)",
+			migrationLockID)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.ExecContext(ctx, "select pg_advisory_unlock($1)",
+			migrationLockID)
+	}
+	if _, err := conn.ExecContext(ctx,
+		createSchemaMigrationsStmt[dbType]); err != nil {
+		return 0, err
+	}
+	applied, err := getAppliedMigrations(ctx, conn, dbType)
+	if err != nil {
+		return 0, err
+	}
+	numApplied := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		ok, err := applyMigration(ctx, conn, dbType, m)
+		if err != nil {
+			return numApplied, fmt.Errorf("migration %d: %s", m.version, err)
+		}
+		if ok {
+			logger.Printf("applied DB migration %d: %s\n", m.version,
+				m.description)
+			numApplied++
+		}
+	}
+	for version := range applied {
+		if version > migrations[len(migrations)-1].version {
+			logger.Printf("DB has migration %d unknown to this version\n",
+				version)
+		}
+	}
+	return numApplied, nil
+}
+
+func migrate(config Config, logger log.DebugLogger) (int, error) {
+	db, dbType, err := openDB(config)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return migrateDB(db, dbType, logger)
+}
+
+func getMigrationStatus(config Config) ([]MigrationStatus, error) {
+	db, dbType, err := openDB(config)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	ctx := context.Background()
+	var count int
+	err = db.QueryRowContext(ctx,
+		countSchemaMigrationsTablesStmt[dbType]).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]MigrationStatus)
+	if count > 0 {
+		applied, err = getAppliedMigrations(ctx, db, dbType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Description: m.description}
+		if appliedStatus, ok := applied[m.version]; ok {
+			status.AppliedAt = appliedStatus.AppliedAt
+			delete(applied, m.version)
+		}
+		statuses = append(statuses, status)
+	}
+	var unknown []MigrationStatus
+	for _, status := range applied {
+		status.Unknown = true
+		unknown = append(unknown, status)
+	}
+	sort.Slice(unknown, func(left, right int) bool {
+		return unknown[left].Version < unknown[right].Version
+	})
+	return append(statuses, unknown...), nil
+}
@@ -0,0 +1,381 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	dbChangesBatchSize        = 1000
+	dbChangesNotifyChannel    = "keymaster_profile_changes"
+	dbChangeGapTimeout        = time.Second * 10
+	dbChangeRetention         = time.Hour * 24
+	dbCleanupInterval         = time.Minute * 5
+	dbListenerMinReconnect    = time.Second
+	dbListenerMaxReconnect    = time.Minute
+	dbCacheVersionNeverSynced = -1
+	dbMaxMissingVersions      = 1000
+)
+
+// Each write to the profile DB records the username in the profile_changes
+// table, in the same transaction. The version column orders the changes, so
+// that replicas only need to refresh the users changed since the version
+// they last applied to their cache DB.
+var recordChangeStmt = map[string]string{
+	"sqlite":   "insert into profile_changes(username, change_epoch) values(?, ?)",
+	"postgres": "insert into profile_changes(username, change_epoch) values($1, $2)",
+}
+
+var getChangeVersionsStmt = map[string]string{
+	"sqlite":   "select coalesce(min(version), 0), coalesce(max(version), 0) from profile_changes",
+	"postgres": "select coalesce(min(version), 0), coalesce(max(version), 0) from profile_changes",
+}
+
+var getChangeStmt = map[string]string{
+	"sqlite":   "select username from profile_changes where version = ?",
+	"postgres": "select username from profile_changes where version = $1",
+}
+
+var getChangesStmt = map[string]string{
+	"sqlite":   "select version, username, change_epoch from profile_changes where version > ? order by version limit ?",
+	"postgres": "select version, username, change_epoch from profile_changes where version > $1 order by version limit $2",
+}
+
+// The latest change is always kept, so that a replica which is up to date
+// can tell that it has not missed any pruned changes.
+var pruneChangesStmt = map[string]string{
+	"sqlite":   "delete from profile_changes where change_epoch < ? and version < (select max(version) from profile_changes)",
+	"postgres": "delete from profile_changes where change_epoch < $1 and version < (select max(version) from profile_changes)",
+}
+
+var getUserSignedDataStmt = map[string]string{
+	"sqlite":   "select type, jws_data, expiration_epoch, update_epoch from expiring_signed_user_data where username = ? and expiration_epoch > ?",
+	"postgres": "select type, jws_data, expiration_epoch, update_epoch from expiring_signed_user_data where username = $1 and expiration_epoch > $2",
+}
+
+const (
+	deleteCachedUserSignedDataStmt = "delete from expiring_signed_user_data where username = ?"
+	getCacheVersionStmt            = "select version from cache_sync_state where id = 0"
+	setCacheVersionStmt            = "insert or replace into cache_sync_state(id, version) values(0, ?)"
+)
+
+type profileChange struct {
+	version     int64
+	username    string
+	changeEpoch int64
+}
+
+func recordChange(tx *sql.Tx, dbType string, username string) error {
+	_, err := tx.Exec(recordChangeStmt[dbType], username, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if dbType == "postgres" {
+		// Delivered to the listeners when the transaction commits.
+		_, err = tx.Exec("NOTIFY " + dbChangesNotifyChannel)
+	}
+	return err
+}
+
+// listenForDBChanges wakes up the cache sync when another replica commits a
+// change, so that the poll interval only matters when notifications are lost.
+func (s *Store) listenForDBChanges() {
+	listener := pq.NewListener(s.config.StorageUrl,
+		dbListenerMinReconnect, dbListenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				s.logger.Printf("profile change listener: %s\n", err)
+			}
+		})
+	if err := listener.Listen(dbChangesNotifyChannel); err != nil {
+		s.logger.Printf("cannot listen for profile changes: %s\n", err)
+		listener.Close()
+		return
+	}
+	s.listener = listener
+	go func() {
+		// A nil notification follows a reconnection, after which changes
+		// may have been missed, so it also triggers a sync.
+		for range listener.Notify {
+			select { // Non-blocking notification.
+			case s.dbChanged <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// backgroundDBSync keeps the cache DB up to date with the changes made to the
+// profile DB by any replica.
+func (s *Store) backgroundDBSync(initialSleep time.Duration,
+	done chan struct{}) {
+	logger := s.logger
+	select {
+	case <-done:
+		logger.Debugf(0, "Cancelled before first sync")
+		return
+	case <-time.After(initialSleep):
+		logger.Debugf(1, "backgroundDBSync, initial sleep done")
+	}
+	var lastCleanup time.Time
+	for {
+		if err := s.syncCacheDB(); err != nil {
+			logger.Printf("cache DB sync err='%s'", err)
+		}
+		if time.Since(lastCleanup) >= dbCleanupInterval {
+			if !s.config.ReadOnly {
+				cleanupDBData(s.db, logger)
+				s.pruneChanges()
+			}
+			cleanupDBData(s.cacheDB, logger)
+			lastCleanup = time.Now()
+		}
+		select {
+		case <-done:
+			logger.Debugf(0, "Cancelled after sync")
+			return
+		case <-s.dbChanged:
+			logger.Debugf(1, "backgroundDBSync, change notification")
+		case <-time.After(s.config.SyncInterval):
+		}
+	}
+}
+
+// syncCacheDB applies the changes made since the last sync to the cache DB.
+// The whole DB is copied when the cache has never been synced, when changes
+// it has not applied have been pruned or when too many versions are missing.
+func (s *Store) syncCacheDB() error {
+	cacheVersion, err := getCacheVersion(s.cacheDB)
+	if err != nil {
+		return err
+	}
+	var minVersion, maxVersion int64
+	err = s.db.QueryRow(getChangeVersionsStmt[s.dbType]).Scan(
+		&minVersion, &maxVersion)
+	if err != nil {
+		return err
+	}
+	if cacheVersion == dbCacheVersionNeverSynced ||
+		maxVersion < cacheVersion || minVersion > cacheVersion+1 ||
+		len(s.missingVersions) > dbMaxMissingVersions {
+		s.logger.Debugf(0, "copying whole DB, cache version: %d, changes: %d-%d, missing: %d",
+			cacheVersion, minVersion, maxVersion, len(s.missingVersions))
+		// Changes committed during the copy are applied by the next sync.
+		if err := copyDBIntoSQLite(s.db, s.cacheDB,
+			"sqlite"); err != nil {
+			return err
+		}
+		s.missingVersions = nil
+		return setCacheVersion(s.cacheDB, maxVersion)
+	}
+	if err := s.applyMissingVersions(minVersion); err != nil {
+		return err
+	}
+	for {
+		changes, err := getChanges(s.db, s.dbType, cacheVersion)
+		if err != nil {
+			return err
+		}
+		usernames := make(map[string]struct{})
+		version := cacheVersion
+		waitForGap := false
+		for _, change := range changes {
+			if change.version > version+1 &&
+				!s.skipMissingVersions(version+1, change.version) {
+				waitForGap = true
+				break
+			}
+			delete(s.missingVersions, change.version)
+			usernames[change.username] = struct{}{}
+			version = change.version
+		}
+		for username := range usernames {
+			if err := copyUserIntoCache(s.db, s.dbType,
+				s.cacheDB, username); err != nil {
+				return err
+			}
+		}
+		if version > cacheVersion {
+			if err := setCacheVersion(s.cacheDB, version); err != nil {
+				return err
+			}
+			s.logger.Debugf(1, "synced %d users to cache version: %d",
+				len(usernames), version)
+		}
+		if waitForGap || len(changes) < dbChangesBatchSize {
+			return nil
+		}
+		cacheVersion = version
+	}
+}
+
+// skipMissingVersions records the versions from first up to end as missing.
+// The transaction of a missing version may not have committed yet, so it
+// returns false until they have been missing for dbChangeGapTimeout, as
+// measured by this replica. The skipped versions are applied by later syncs
+// if they appear.
+func (s *Store) skipMissingVersions(first, end int64) bool {
+	if s.missingVersions == nil {
+		s.missingVersions = make(map[int64]time.Time)
+	}
+	skip := true
+	now := time.Now()
+	for version := first; version < end; version++ {
+		firstMissing, ok := s.missingVersions[version]
+		if !ok {
+			firstMissing = now
+			s.missingVersions[version] = now
+		}
+		if now.Sub(firstMissing) < dbChangeGapTimeout {
+			skip = false
+		}
+	}
+	return skip
+}
+
+// applyMissingVersions applies the skipped versions which have appeared since.
+// Versions which were pruned or missing for longer than the changes are kept
+// were rolled back, and are forgotten.
+func (s *Store) applyMissingVersions(minVersion int64) error {
+	for version, firstMissing := range s.missingVersions {
+		if version < minVersion ||
+			time.Since(firstMissing) > dbChangeRetention {
+			delete(s.missingVersions, version)
+			continue
+		}
+		var username string
+		err := s.db.QueryRow(getChangeStmt[s.dbType], version).Scan(&username)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := copyUserIntoCache(s.db, s.dbType, s.cacheDB,
+			username); err != nil {
+			return err
+		}
+		s.logger.Debugf(1, "synced %s from missing version: %d", username,
+			version)
+		delete(s.missingVersions, version)
+	}
+	return nil
+}
+
+func getChanges(db *sql.DB, dbType string, afterVersion int64) (
+	[]profileChange, error) {
+	rows, err := db.Query(getChangesStmt[dbType], afterVersion,
+		dbChangesBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var changes []profileChange
+	for rows.Next() {
+		var change profileChange
+		if err := rows.Scan(&change.version, &change.username,
+			&change.changeEpoch); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func getCacheVersion(cacheDB *sql.DB) (int64, error) {
+	var version int64
+	err := cacheDB.QueryRow(getCacheVersionStmt).Scan(&version)
+	if err == sql.ErrNoRows {
+		return dbCacheVersionNeverSynced, nil
+	}
+	return version, err
+}
+
+func setCacheVersion(cacheDB *sql.DB, version int64) error {
+	_, err := cacheDB.Exec(setCacheVersionStmt, version)
+	return err
+}
+
+// copyUserIntoCache replaces the cached data of a user with the data in the
+// profile DB.
+func copyUserIntoCache(source *sql.DB, sourceType string, cacheDB *sql.DB,
+	username string) error {
+	var profileBytes []byte
+	err := source.QueryRow(loadUserProfileStmt[sourceType], username).Scan(
+		&profileBytes)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	profileFound := err == nil
+	type signedData struct {
+		dataType        int
+		jwsData         string
+		expirationEpoch int64
+		updateEpoch     int64
+	}
+	var signedDataList []signedData
+	rows, err := source.Query(getUserSignedDataStmt[sourceType], username,
+		time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data signedData
+		if err := rows.Scan(&data.dataType, &data.jwsData,
+			&data.expirationEpoch, &data.updateEpoch); err != nil {
+			return err
+		}
+		signedDataList = append(signedDataList, data)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	tx, err := cacheDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if profileFound {
+		_, err = tx.Exec(saveUserProfileStmt["sqlite"], username, profileBytes)
+	} else {
+		_, err = tx.Exec(deleteUserProfileStmt["sqlite"], username)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteCachedUserSignedDataStmt, username); err != nil {
+		return err
+	}
+	for _, data := range signedDataList {
+		_, err := tx.Exec(saveSignedUserDataStmt["sqlite"], username,
+			data.dataType, data.jwsData, data.expirationEpoch, data.updateEpoch)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// updateCache applies a write to the cache DB, so that local reads which
+// fall back to the cache do not wait for the next sync. Failures are only
+// logged, since the sync repairs the cache.
+func (s *Store) updateCache(stmtText string, args ...interface{}) {
+	if s.cacheDB == nil {
+		return
+	}
+	if _, err := s.cacheDB.Exec(stmtText, args...); err != nil {
+		s.logger.Printf("cache DB update err='%s'", err)
+	}
+}
+
+func (s *Store) pruneChanges() error {
+	_, err := s.db.Exec(pruneChangesStmt[s.dbType],
+		time.Now().Add(-dbChangeRetention).Unix())
+	if err != nil {
+		s.logger.Printf("err='%s'", err)
+	}
+	return err
+}
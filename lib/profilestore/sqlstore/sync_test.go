@@ -0,0 +1,194 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+// newTestingReplica returns a store sharing the DB of s, with its own cache
+// DB.
+func newTestingReplica(t *testing.T, s *Store) *Store {
+	cacheDB, err := initFileDBSQLite(
+		filepath.Join(t.TempDir(), "cachedDB.sqlite3"), testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cacheDB.Close() })
+	return &Store{
+		logger:  testlogger.New(t),
+		db:      s.db,
+		dbType:  s.dbType,
+		cacheDB: cacheDB,
+	}
+}
+
+func newTestingSyncStore(t *testing.T) *Store {
+	// Delay the background sync, the tests sync explicitly.
+	return newTestingStore(t, Config{SyncDelay: dbSyncDelayMaximum})
+}
+
+func countCachedProfiles(t *testing.T, cacheDB *sql.DB, username string) int {
+	var count int
+	err := cacheDB.QueryRow(
+		"select count(*) from user_profile where username = ?",
+		username).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestSyncCacheDB(t *testing.T) {
+	s := newTestingSyncStore(t)
+	replica := newTestingReplica(t, s)
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := getCacheVersion(replica.cacheDB); err != nil {
+		t.Fatal(err)
+	} else if version != 0 {
+		t.Fatalf("expected cache version 0 after first sync, got %d", version)
+	}
+	if err := s.SaveProfile("alice", []byte("profile")); err != nil {
+		t.Fatal(err)
+	}
+	// Writes go through to the local cache immediately.
+	if count := countCachedProfiles(t, s.cacheDB, "alice"); count != 1 {
+		t.Fatalf("local cache has %d profiles for alice", count)
+	}
+	if count := countCachedProfiles(t, replica.cacheDB, "alice"); count != 0 {
+		t.Fatalf("replica cache has %d profiles before sync", count)
+	}
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if count := countCachedProfiles(t, replica.cacheDB, "alice"); count != 1 {
+		t.Fatalf("replica cache has %d profiles for alice", count)
+	}
+	if err := s.DeleteProfile("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if count := countCachedProfiles(t, replica.cacheDB, "alice"); count != 0 {
+		t.Fatalf("replica cache has %d profiles after delete", count)
+	}
+	if version, err := getCacheVersion(replica.cacheDB); err != nil {
+		t.Fatal(err)
+	} else if version != 2 {
+		t.Fatalf("expected cache version 2, got %d", version)
+	}
+}
+
+func TestSyncCacheDBPrunedChanges(t *testing.T) {
+	s := newTestingSyncStore(t)
+	replica := newTestingReplica(t, s)
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if err := s.SaveProfile(username, []byte("profile")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := replica.cacheDB.Exec(saveUserProfileStmt["sqlite"], "stale",
+		[]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Prune the change for alice, which the replica has not applied.
+	_, err = s.db.Exec(pruneChangesStmt["sqlite"],
+		time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	for username, expected := range map[string]int{
+		"alice": 1,
+		"bob":   1,
+		"stale": 0,
+	} {
+		count := countCachedProfiles(t, replica.cacheDB, username)
+		if count != expected {
+			t.Errorf("%s: expected %d profiles, got %d", username, expected,
+				count)
+		}
+	}
+}
+
+func TestSyncCacheDBWaitsForGap(t *testing.T) {
+	s := newTestingSyncStore(t)
+	replica := newTestingReplica(t, s)
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveProfile("alice", []byte("profile")); err != nil {
+		t.Fatal(err)
+	}
+	// Version 2 may still be uncommitted when version 3 is seen.
+	_, err := s.db.Exec("insert into profile_changes(version, username, "+
+		"change_epoch) values(3, ?, ?)", "bob", time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := getCacheVersion(replica.cacheDB); err != nil {
+		t.Fatal(err)
+	} else if version != 1 {
+		t.Fatalf("expected cache version 1 while waiting, got %d", version)
+	}
+	// Version 2 has been missing for longer than the timeout.
+	replica.missingVersions[2] = time.Now().Add(-time.Minute)
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := getCacheVersion(replica.cacheDB); err != nil {
+		t.Fatal(err)
+	} else if version != 3 {
+		t.Fatalf("expected cache version 3 after gap timeout, got %d", version)
+	}
+	// Version 2 commits late: it is still applied.
+	if err := s.SaveProfile("carol", []byte("profile")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.Exec("update profile_changes set version = 2 "+
+		"where username = ?", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if count := countCachedProfiles(t, replica.cacheDB, "carol"); count != 1 {
+		t.Fatalf("replica cache has %d profiles for carol", count)
+	}
+	if len(replica.missingVersions) != 0 {
+		t.Errorf("missing versions not cleared: %v", replica.missingVersions)
+	}
+}
+
+func TestSyncCacheDBForgetsRolledBackVersions(t *testing.T) {
+	s := newTestingSyncStore(t)
+	replica := newTestingReplica(t, s)
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	replica.missingVersions = map[int64]time.Time{
+		1: time.Now().Add(-2 * dbChangeRetention),
+	}
+	if err := replica.syncCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if len(replica.missingVersions) != 0 {
+		t.Errorf("missing versions not forgotten: %v", replica.missingVersions)
+	}
+}
@@ -0,0 +1,96 @@
+package pkcs11signer
+
+import (
+	"crypto"
+	"io"
+	"sync"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/miekg/pkcs11"
+)
+
+// Config describes where to find the signing key. Either Slot or TokenLabel
+// must be set.
+type Config struct {
+	ModulePath  string // Path to the PKCS#11 shared library.
+	Slot        *uint
+	TokenLabel  string
+	KeyLabel    string // CKA_LABEL of the private key.
+	PIN         string
+	MaxSessions int // Maximum concurrent Sign calls. Default is 4.
+}
+
+// This interface is only to abstract the pkcs11.Ctx so that we can write
+// tests without an HSM.
+type pkcs11Module interface {
+	Initialize(opts ...pkcs11.InitializeOption) error
+	Finalize() error
+	GetSlotList(tokenPresent bool) ([]uint, error)
+	GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error)
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	Login(sh pkcs11.SessionHandle, userType uint, pin string) error
+	FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error
+	FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle,
+		bool, error)
+	FindObjectsFinal(sh pkcs11.SessionHandle) error
+	GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle,
+		a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error)
+	SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism,
+		o pkcs11.ObjectHandle) error
+	Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error)
+}
+
+type pooledSession struct {
+	handle     pkcs11.SessionHandle
+	generation uint64
+}
+
+type Pkcs11Signer struct {
+	config    Config
+	module    pkcs11Module
+	logger    log.DebugLogger
+	publicKey crypto.PublicKey
+	semaphore chan struct{} // Limits the number of sessions in use.
+	mutex     sync.Mutex
+
+	// Shared with the other signers using the same module, nil if the module
+	// was not loaded by newPkcs11Signer.
+	moduleContext *moduleContext
+	// Protected by mutex. The generation increases on every reconnection
+	// and invalidates sessions and object handles of previous ones.
+	connected  bool
+	generation uint64
+	slot       uint
+	keyHandle  pkcs11.ObjectHandle
+	idle       []pooledSession
+}
+
+// NewPkcs11Signer loads the PKCS#11 module in config and returns a
+// crypto.Signer using the private key with label config.KeyLabel. RSA and
+// ECDSA keys are supported.
+func NewPkcs11Signer(config Config, logger log.DebugLogger) (
+	*Pkcs11Signer, error) {
+	return newPkcs11Signer(config, logger)
+}
+
+// ParsePKCS11URI parses a RFC 7512 PKCS#11 URI such as
+// pkcs11:token=keymaster;object=ca?module-path=/usr/lib/libsofthsm2.so&pin-source=/etc/keymaster/pin
+func ParsePKCS11URI(uri string) (*Config, error) {
+	return parsePKCS11URI(uri)
+}
+
+func (ps *Pkcs11Signer) Public() crypto.PublicKey {
+	return ps.publicKey
+}
+
+func (ps *Pkcs11Signer) Sign(reader io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	return ps.sign(reader, digest, opts)
+}
+
+// Close releases all sessions and unloads the module once no other signer
+// uses it.
+func (ps *Pkcs11Signer) Close() error {
+	return ps.close()
+}
@@ -0,0 +1,583 @@
+package pkcs11signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"github.com/miekg/pkcs11"
+)
+
+const defaultMaxSessions = 4
+
+// DigestInfo prefixes for PKCS#1 v1.5 signatures, from crypto/rsa.
+var rsaHashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+type pssParameters struct {
+	hashMechanism uint
+	mgf           uint
+}
+
+var rsaPSSParameters = map[crypto.Hash]pssParameters{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// loadModule is a variable so that tests can use a fake module.
+var loadModule = defaultLoadModule
+
+func defaultLoadModule(path string) (pkcs11Module, error) {
+	module := pkcs11.New(path)
+	if module == nil {
+		return nil, fmt.Errorf("cannot load PKCS#11 module %s", path)
+	}
+	return module, nil
+}
+
+var (
+	modulesMutex sync.Mutex
+	modules      = make(map[string]*moduleContext) // Key: module path.
+)
+
+// moduleContext is a PKCS#11 module shared by all the signers using it.
+// C_Initialize and C_Finalize are global to the process, so finalizing the
+// module for one signer would tear down the sessions of all the others.
+type moduleContext struct {
+	path   string
+	module pkcs11Module
+	refs   int // Protected by modulesMutex.
+}
+
+var (
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidNamedCurveP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+func acquireModule(path string) (*moduleContext, error) {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+	if mc, ok := modules[path]; ok {
+		mc.refs++
+		return mc, nil
+	}
+	module, err := loadModule(path)
+	if err != nil {
+		return nil, err
+	}
+	mc := &moduleContext{path: path, module: module, refs: 1}
+	modules[path] = mc
+	return mc, nil
+}
+
+// release finalizes and unloads the module once its last user is gone.
+func (mc *moduleContext) release() {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+	if mc.refs--; mc.refs > 0 {
+		return
+	}
+	delete(modules, mc.path)
+	mc.module.Finalize()
+	if destroyer, ok := mc.module.(interface{ Destroy() }); ok {
+		destroyer.Destroy()
+	}
+}
+
+func newPkcs11Signer(config Config, logger log.DebugLogger) (
+	*Pkcs11Signer, error) {
+	if config.ModulePath == "" {
+		return nil, errors.New("no PKCS#11 module path")
+	}
+	mc, err := acquireModule(config.ModulePath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newPkcs11SignerWithModule(config, mc.module, logger)
+	if err != nil {
+		mc.release()
+		return nil, err
+	}
+	signer.moduleContext = mc
+	return signer, nil
+}
+
+func newPkcs11SignerWithModule(config Config, module pkcs11Module,
+	logger log.DebugLogger) (*Pkcs11Signer, error) {
+	if config.Slot == nil && config.TokenLabel == "" {
+		return nil, errors.New("either slot or token label is required")
+	}
+	if config.KeyLabel == "" {
+		return nil, errors.New("no key label")
+	}
+	if config.MaxSessions < 1 {
+		config.MaxSessions = defaultMaxSessions
+	}
+	ps := &Pkcs11Signer{
+		config:    config,
+		module:    module,
+		logger:    logger,
+		semaphore: make(chan struct{}, config.MaxSessions),
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if err := ps.connect(); err != nil {
+		ps.disconnect()
+		return nil, err
+	}
+	return ps, nil
+}
+
+func parsePKCS11URI(uri string) (*Config, error) {
+	if !strings.HasPrefix(uri, "pkcs11:") {
+		return nil, errors.New("not a pkcs11 URI")
+	}
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, "pkcs11:"), "?")
+	var config Config
+	for _, attribute := range strings.Split(path, ";") {
+		if attribute == "" {
+			continue
+		}
+		name, rawValue, _ := strings.Cut(attribute, "=")
+		value, err := url.PathUnescape(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("bad value for %s: %s", name, err)
+		}
+		switch name {
+		case "token":
+			config.TokenLabel = value
+		case "object":
+			config.KeyLabel = value
+		case "slot-id":
+			slot, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad slot-id: %s", err)
+			}
+			slotID := uint(slot)
+			config.Slot = &slotID
+		case "type":
+			if value != "private" {
+				return nil, fmt.Errorf("unsupported object type: %s", value)
+			}
+		}
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	config.ModulePath = values.Get("module-path")
+	config.PIN = values.Get("pin-value")
+	if pinSource := values.Get("pin-source"); pinSource != "" {
+		pin, err := os.ReadFile(strings.TrimPrefix(pinSource, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read pin-source: %s", err)
+		}
+		config.PIN = strings.TrimSpace(string(pin))
+	}
+	if maxSessions := values.Get("x-max-sessions"); maxSessions != "" {
+		config.MaxSessions, err = strconv.Atoi(maxSessions)
+		if err != nil {
+			return nil, fmt.Errorf("bad x-max-sessions: %s", err)
+		}
+	}
+	return &config, nil
+}
+
+// isConnectionError returns true if err means the sessions or object handles
+// are no longer valid, usually because the HSM restarted.
+func isConnectionError(err error) bool {
+	var p11Error pkcs11.Error
+	if !errors.As(err, &p11Error) {
+		return false
+	}
+	switch p11Error {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_DEVICE_ERROR,
+		pkcs11.CKR_TOKEN_NOT_PRESENT, pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+		pkcs11.CKR_USER_NOT_LOGGED_IN, pkcs11.CKR_KEY_HANDLE_INVALID,
+		pkcs11.CKR_OBJECT_HANDLE_INVALID, pkcs11.CKR_GENERAL_ERROR:
+		return true
+	}
+	return false
+}
+
+// Must be called with the lock held.
+func (ps *Pkcs11Signer) findSlot() (uint, error) {
+	if ps.config.Slot != nil {
+		return *ps.config.Slot, nil
+	}
+	slots, err := ps.module.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		tokenInfo, err := ps.module.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+		if strings.TrimRight(tokenInfo.Label, " \x00") == ps.config.TokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("token '%s' not found", ps.config.TokenLabel)
+}
+
+func (ps *Pkcs11Signer) findObject(session pkcs11.SessionHandle,
+	class uint) ([]pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, ps.config.KeyLabel),
+	}
+	if err := ps.module.FindObjectsInit(session, template); err != nil {
+		return nil, err
+	}
+	objects, _, err := ps.module.FindObjects(session, 2)
+	if finalErr := ps.module.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	return objects, err
+}
+
+func bytesToUint(value []byte) uint {
+	switch len(value) {
+	case 4:
+		return uint(binary.NativeEndian.Uint32(value))
+	case 8:
+		return uint(binary.NativeEndian.Uint64(value))
+	}
+	return 0
+}
+
+func (ps *Pkcs11Signer) getAttributes(session pkcs11.SessionHandle,
+	object pkcs11.ObjectHandle, types ...uint) ([][]byte, error) {
+	template := make([]*pkcs11.Attribute, 0, len(types))
+	for _, attributeType := range types {
+		template = append(template, pkcs11.NewAttribute(attributeType, nil))
+	}
+	attributes, err := ps.module.GetAttributeValue(session, object, template)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(types))
+	for _, attribute := range attributes {
+		for index, attributeType := range types {
+			if attribute.Type == attributeType {
+				values[index] = attribute.Value
+			}
+		}
+	}
+	return values, nil
+}
+
+func parseECPublicKey(ecParams []byte, ecPoint []byte) (*ecdsa.PublicKey,
+	error) {
+	var curveOID asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(ecParams, &curveOID); err != nil {
+		return nil, fmt.Errorf("cannot parse EC params: %s", err)
+	}
+	var curve elliptic.Curve
+	switch {
+	case curveOID.Equal(oidNamedCurveP256):
+		curve = elliptic.P256()
+	case curveOID.Equal(oidNamedCurveP384):
+		curve = elliptic.P384()
+	case curveOID.Equal(oidNamedCurveP521):
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", curveOID)
+	}
+	// The point should be DER encoded but some modules return it raw.
+	var point []byte
+	if rest, err := asn1.Unmarshal(ecPoint, &point); err != nil ||
+		len(rest) > 0 {
+		point = ecPoint
+	}
+	return ecdsa.ParseUncompressedPublicKey(curve, point)
+}
+
+// Must be called with the lock held.
+func (ps *Pkcs11Signer) loadPublicKey(session pkcs11.SessionHandle,
+	privateKey pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	values, err := ps.getAttributes(session, privateKey, pkcs11.CKA_KEY_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	publicObjects, err := ps.findObject(session, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil, err
+	}
+	switch keyType := bytesToUint(values[0]); keyType {
+	case pkcs11.CKK_RSA:
+		// The modulus and exponent are usually readable from the private
+		// key object too.
+		object := privateKey
+		if len(publicObjects) == 1 {
+			object = publicObjects[0]
+		}
+		values, err := ps.getAttributes(session, object, pkcs11.CKA_MODULUS,
+			pkcs11.CKA_PUBLIC_EXPONENT)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(values[1])
+		if len(values[0]) == 0 || !exponent.IsInt64() {
+			return nil, errors.New("invalid RSA public key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(values[0]),
+			E: int(exponent.Int64())}, nil
+	case pkcs11.CKK_EC:
+		if len(publicObjects) != 1 {
+			return nil, fmt.Errorf("public key '%s' not found",
+				ps.config.KeyLabel)
+		}
+		values, err := ps.getAttributes(session, publicObjects[0],
+			pkcs11.CKA_EC_PARAMS, pkcs11.CKA_EC_POINT)
+		if err != nil {
+			return nil, err
+		}
+		return parseECPublicKey(values[0], values[1])
+	default:
+		return nil, fmt.Errorf("unsupported key type %d", keyType)
+	}
+}
+
+// connect initializes the module unless another signer already did so, logs
+// in and finds the key. Must be called with the lock held.
+func (ps *Pkcs11Signer) connect() error {
+	err := ps.module.Initialize()
+	if err != nil && !errors.Is(err,
+		pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		return fmt.Errorf("cannot initialize PKCS#11 module: %s", err)
+	}
+	slot, err := ps.findSlot()
+	if err != nil {
+		return err
+	}
+	session, err := ps.module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("cannot open session: %s", err)
+	}
+	// The login is shared by all the sessions of the application, this
+	// session keeps it alive.
+	ps.slot = slot
+	ps.connected = true
+	ps.generation++
+	ps.idle = append(ps.idle, pooledSession{session, ps.generation})
+	err = ps.module.Login(session, pkcs11.CKU_USER, ps.config.PIN)
+	if err != nil && !errors.Is(err,
+		pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return fmt.Errorf("cannot login: %s", err)
+	}
+	privateObjects, err := ps.findObject(session, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return err
+	}
+	if len(privateObjects) != 1 {
+		return fmt.Errorf("found %d private keys with label '%s'",
+			len(privateObjects), ps.config.KeyLabel)
+	}
+	publicKey, err := ps.loadPublicKey(session, privateObjects[0])
+	if err != nil {
+		return err
+	}
+	// The public key is only set once, so Public needs no locking.
+	if ps.publicKey == nil {
+		ps.publicKey = publicKey
+	} else {
+		equal, ok := publicKey.(interface {
+			Equal(crypto.PublicKey) bool
+		})
+		if !ok || !equal.Equal(ps.publicKey) {
+			return errors.New("key changed after reconnecting")
+		}
+	}
+	ps.keyHandle = privateObjects[0]
+	ps.logger.Debugf(1, "pkcs11: connected to slot %d, key '%s'", slot,
+		ps.config.KeyLabel)
+	return nil
+}
+
+// disconnect closes the sessions of this signer only, the module stays
+// initialized for the other signers using it. Must be called with the lock
+// held.
+func (ps *Pkcs11Signer) disconnect() {
+	for _, session := range ps.idle {
+		ps.module.CloseSession(session.handle)
+	}
+	ps.idle = nil
+	ps.connected = false
+}
+
+// reconnect starts over unless someone else already did so since
+// failedGeneration.
+func (ps *Pkcs11Signer) reconnect(failedGeneration uint64) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.connected && ps.generation != failedGeneration {
+		return nil
+	}
+	ps.disconnect()
+	if err := ps.connect(); err != nil {
+		ps.disconnect()
+		return err
+	}
+	return nil
+}
+
+func (ps *Pkcs11Signer) getSession() (pooledSession, pkcs11.ObjectHandle,
+	error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if !ps.connected {
+		if err := ps.connect(); err != nil {
+			ps.disconnect()
+			return pooledSession{}, 0, err
+		}
+	}
+	// Keep the first session (which holds the login) in the pool.
+	if numIdle := len(ps.idle); numIdle > 1 {
+		session := ps.idle[numIdle-1]
+		ps.idle = ps.idle[:numIdle-1]
+		return session, ps.keyHandle, nil
+	}
+	handle, err := ps.module.OpenSession(ps.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return pooledSession{generation: ps.generation}, 0, err
+	}
+	return pooledSession{handle, ps.generation}, ps.keyHandle, nil
+}
+
+func (ps *Pkcs11Signer) putSession(session pooledSession, healthy bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if healthy && session.generation == ps.generation && ps.connected {
+		ps.idle = append(ps.idle, session)
+		return
+	}
+	// Reconnecting does not finalize the module, so the sessions of previous
+	// connections may still be open.
+	ps.module.CloseSession(session.handle)
+}
+
+func (ps *Pkcs11Signer) signOnce(mechanism []*pkcs11.Mechanism,
+	input []byte) ([]byte, uint64, error) {
+	ps.semaphore <- struct{}{}
+	defer func() { <-ps.semaphore }()
+	session, keyHandle, err := ps.getSession()
+	if err != nil {
+		return nil, session.generation, err
+	}
+	if err := ps.module.SignInit(session.handle, mechanism,
+		keyHandle); err != nil {
+		ps.putSession(session, !isConnectionError(err))
+		return nil, session.generation, err
+	}
+	signature, err := ps.module.Sign(session.handle, input)
+	ps.putSession(session, !isConnectionError(err))
+	return signature, session.generation, err
+}
+
+func (ps *Pkcs11Signer) signWithRetry(mechanism []*pkcs11.Mechanism,
+	input []byte) ([]byte, error) {
+	signature, generation, err := ps.signOnce(mechanism, input)
+	if err == nil || !isConnectionError(err) {
+		return signature, err
+	}
+	ps.logger.Printf("pkcs11: sign failed, reconnecting: %s", err)
+	if err := ps.reconnect(generation); err != nil {
+		return nil, fmt.Errorf("pkcs11 reconnect failed: %s", err)
+	}
+	signature, _, err = ps.signOnce(mechanism, input)
+	return signature, err
+}
+
+func (ps *Pkcs11Signer) getMechanism(digest []byte,
+	opts crypto.SignerOpts) ([]*pkcs11.Mechanism, []byte, error) {
+	hash := opts.HashFunc()
+	if hash == 0 || len(digest) != hash.Size() {
+		return nil, nil, errors.New("a digest is required")
+	}
+	switch ps.publicKey.(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			params, ok := rsaPSSParameters[hash]
+			if !ok {
+				return nil, nil, fmt.Errorf("unsupported hash function %v",
+					hash)
+			}
+			saltLength := pssOpts.SaltLength
+			if saltLength == rsa.PSSSaltLengthAuto ||
+				saltLength == rsa.PSSSaltLengthEqualsHash {
+				saltLength = hash.Size()
+			}
+			return []*pkcs11.Mechanism{pkcs11.NewMechanism(
+				pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(
+					params.hashMechanism, params.mgf,
+					uint(saltLength)))}, digest, nil
+		}
+		prefix, ok := rsaHashPrefixes[hash]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported hash function %v", hash)
+		}
+		input := append(append([]byte{}, prefix...), digest...)
+		return []*pkcs11.Mechanism{
+			pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}, input, nil
+	case *ecdsa.PublicKey:
+		return []*pkcs11.Mechanism{
+			pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, digest, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key type %T", ps.publicKey)
+}
+
+func (ps *Pkcs11Signer) sign(_ io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	mechanism, input, err := ps.getMechanism(digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := ps.signWithRetry(mechanism, input)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 Sign failed err=%s", err)
+	}
+	if _, ok := ps.publicKey.(*ecdsa.PublicKey); !ok {
+		return signature, nil
+	}
+	// PKCS#11 returns r||s, Go expects ASN.1.
+	if len(signature)%2 != 0 {
+		return nil, errors.New("invalid ECDSA signature length")
+	}
+	half := len(signature) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(signature[:half]),
+		new(big.Int).SetBytes(signature[half:])})
+}
+
+func (ps *Pkcs11Signer) close() error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.disconnect()
+	if ps.moduleContext != nil {
+		ps.moduleContext.release()
+		ps.moduleContext = nil
+	}
+	return nil
+}
@@ -0,0 +1,691 @@
+package pkcs11signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/miekg/pkcs11"
+)
+
+const testKeyLabel = "keymaster-ca"
+
+// fakeModule is a minimal software token with a single key pair. Restarting
+// it invalidates every session and object handle, like an HSM reboot.
+type fakeModule struct {
+	mutex           sync.Mutex
+	key             crypto.Signer
+	initialized     bool
+	loggedIn        bool
+	restarts        uint
+	initializeCount int
+	finalizeCount   int
+	nextSession     pkcs11.SessionHandle
+	sessions        map[pkcs11.SessionHandle]*fakeSession
+	inFlight        int
+	maxInFlight     int
+}
+
+type fakeSession struct {
+	found     []pkcs11.ObjectHandle
+	mechanism uint
+	signing   bool
+}
+
+func newFakeModule(key crypto.Signer) *fakeModule {
+	return &fakeModule{key: key,
+		sessions: make(map[pkcs11.SessionHandle]*fakeSession)}
+}
+
+func (m *fakeModule) restart() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.initialized = false
+	m.loggedIn = false
+	m.restarts++
+	m.sessions = make(map[pkcs11.SessionHandle]*fakeSession)
+}
+
+func (m *fakeModule) privateHandle() pkcs11.ObjectHandle {
+	return pkcs11.ObjectHandle(100*m.restarts + 1)
+}
+
+func (m *fakeModule) publicHandle() pkcs11.ObjectHandle {
+	return pkcs11.ObjectHandle(100*m.restarts + 2)
+}
+
+func (m *fakeModule) getSession(sh pkcs11.SessionHandle) (*fakeSession,
+	error) {
+	if !m.initialized {
+		return nil, pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)
+	}
+	session, ok := m.sessions[sh]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	return session, nil
+}
+
+func (m *fakeModule) Initialize(opts ...pkcs11.InitializeOption) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.initialized {
+		return pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)
+	}
+	m.initialized = true
+	m.initializeCount++
+	return nil
+}
+
+func (m *fakeModule) Finalize() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.initialized {
+		return pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)
+	}
+	m.initialized = false
+	m.finalizeCount++
+	m.loggedIn = false
+	m.sessions = make(map[pkcs11.SessionHandle]*fakeSession)
+	return nil
+}
+
+func (m *fakeModule) GetSlotList(tokenPresent bool) ([]uint, error) {
+	return []uint{0, 7}, nil
+}
+
+func (m *fakeModule) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	if slotID == 7 {
+		return pkcs11.TokenInfo{Label: "keymaster                       "}, nil
+	}
+	return pkcs11.TokenInfo{Label: "other"}, nil
+}
+
+func (m *fakeModule) OpenSession(slotID uint, flags uint) (
+	pkcs11.SessionHandle, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.initialized {
+		return 0, pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)
+	}
+	if slotID != 7 {
+		return 0, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	m.nextSession++
+	m.sessions[m.nextSession] = &fakeSession{}
+	return m.nextSession, nil
+}
+
+func (m *fakeModule) CloseSession(sh pkcs11.SessionHandle) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, err := m.getSession(sh); err != nil {
+		return err
+	}
+	delete(m.sessions, sh)
+	if len(m.sessions) == 0 {
+		m.loggedIn = false
+	}
+	return nil
+}
+
+func (m *fakeModule) Login(sh pkcs11.SessionHandle, userType uint,
+	pin string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, err := m.getSession(sh); err != nil {
+		return err
+	}
+	if pin != "1234" {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	if m.loggedIn {
+		return pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)
+	}
+	m.loggedIn = true
+	return nil
+}
+
+func (m *fakeModule) FindObjectsInit(sh pkcs11.SessionHandle,
+	temp []*pkcs11.Attribute) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, err := m.getSession(sh)
+	if err != nil {
+		return err
+	}
+	session.found = nil
+	var class uint
+	var label string
+	for _, attribute := range temp {
+		switch attribute.Type {
+		case pkcs11.CKA_CLASS:
+			class = bytesToUint(attribute.Value)
+		case pkcs11.CKA_LABEL:
+			label = string(attribute.Value)
+		}
+	}
+	if label != testKeyLabel {
+		return nil
+	}
+	switch class {
+	case pkcs11.CKO_PRIVATE_KEY:
+		if m.loggedIn {
+			session.found = []pkcs11.ObjectHandle{m.privateHandle()}
+		}
+	case pkcs11.CKO_PUBLIC_KEY:
+		session.found = []pkcs11.ObjectHandle{m.publicHandle()}
+	}
+	return nil
+}
+
+func (m *fakeModule) FindObjects(sh pkcs11.SessionHandle, max int) (
+	[]pkcs11.ObjectHandle, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, err := m.getSession(sh)
+	if err != nil {
+		return nil, false, err
+	}
+	return session.found, false, nil
+}
+
+func (m *fakeModule) FindObjectsFinal(sh pkcs11.SessionHandle) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, err := m.getSession(sh)
+	return err
+}
+
+func (m *fakeModule) GetAttributeValue(sh pkcs11.SessionHandle,
+	o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute,
+	error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, err := m.getSession(sh); err != nil {
+		return nil, err
+	}
+	if o != m.privateHandle() && o != m.publicHandle() {
+		return nil, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	var result []*pkcs11.Attribute
+	for _, attribute := range a {
+		var value interface{}
+		switch pub := m.key.Public().(type) {
+		case *rsa.PublicKey:
+			switch attribute.Type {
+			case pkcs11.CKA_KEY_TYPE:
+				value = pkcs11.CKK_RSA
+			case pkcs11.CKA_MODULUS:
+				value = pub.N.Bytes()
+			case pkcs11.CKA_PUBLIC_EXPONENT:
+				value = []byte{1, 0, 1}
+			}
+		case *ecdsa.PublicKey:
+			switch attribute.Type {
+			case pkcs11.CKA_KEY_TYPE:
+				value = pkcs11.CKK_EC
+			case pkcs11.CKA_EC_PARAMS:
+				value, _ = asn1.Marshal(oidNamedCurveP256)
+			case pkcs11.CKA_EC_POINT:
+				point, _ := pub.Bytes()
+				value, _ = asn1.Marshal(point)
+			}
+		}
+		if value == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+		result = append(result, pkcs11.NewAttribute(attribute.Type, value))
+	}
+	return result, nil
+}
+
+func (m *fakeModule) SignInit(sh pkcs11.SessionHandle,
+	mechanisms []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, err := m.getSession(sh)
+	if err != nil {
+		return err
+	}
+	if !m.loggedIn {
+		return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	if o != m.privateHandle() {
+		return pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID)
+	}
+	session.mechanism = mechanisms[0].Mechanism
+	session.signing = true
+	m.inFlight++
+	if m.inFlight > m.maxInFlight {
+		m.maxInFlight = m.inFlight
+	}
+	return nil
+}
+
+func (m *fakeModule) Sign(sh pkcs11.SessionHandle, message []byte) ([]byte,
+	error) {
+	time.Sleep(time.Millisecond)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, err := m.getSession(sh)
+	if err != nil {
+		return nil, err
+	}
+	if !session.signing {
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	session.signing = false
+	m.inFlight--
+	switch session.mechanism {
+	case pkcs11.CKM_RSA_PKCS:
+		// Hash 0 signs the DigestInfo we were given as is.
+		return rsa.SignPKCS1v15(nil, m.key.(*rsa.PrivateKey), 0, message)
+	case pkcs11.CKM_RSA_PKCS_PSS:
+		return rsa.SignPSS(rand.Reader, m.key.(*rsa.PrivateKey),
+			crypto.SHA256, message,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case pkcs11.CKM_ECDSA:
+		r, s, err := ecdsa.Sign(rand.Reader, m.key.(*ecdsa.PrivateKey),
+			message)
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	}
+	return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+}
+
+func newTestSigner(t *testing.T, key crypto.Signer, maxSessions int) (
+	*Pkcs11Signer, *fakeModule) {
+	module := newFakeModule(key)
+	signer, err := newPkcs11SignerWithModule(Config{TokenLabel: "keymaster",
+		KeyLabel: testKeyLabel, PIN: "1234", MaxSessions: maxSessions},
+		module, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, module
+}
+
+func verifyTestSignature(t *testing.T, signer crypto.Signer,
+	opts crypto.SignerOpts) {
+	digest := sha256.Sum256([]byte("hello"))
+	signature, err := signer.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], signature,
+				pssOpts)
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			t.Fatal("bad ECDSA signature")
+		}
+	default:
+		t.Fatalf("unexpected public key type %T", pub)
+	}
+}
+
+func TestParsePKCS11URI(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(pinFile, []byte("5678\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParsePKCS11URI("pkcs11:token=key%20master;object=ca;" +
+		"type=private?module-path=/usr/lib/libsofthsm2.so&pin-source=file:" +
+		pinFile + "&x-max-sessions=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TokenLabel != "key master" || config.KeyLabel != "ca" ||
+		config.ModulePath != "/usr/lib/libsofthsm2.so" ||
+		config.PIN != "5678" || config.MaxSessions != 8 ||
+		config.Slot != nil {
+		t.Fatalf("bad config %+v", config)
+	}
+	config, err = ParsePKCS11URI("pkcs11:slot-id=3;object=ca?pin-value=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Slot == nil || *config.Slot != 3 || config.PIN != "1234" {
+		t.Fatalf("bad config %+v", config)
+	}
+	for _, bad := range []string{"http://example.com", "pkcs11:slot-id=x",
+		"pkcs11:object=ca;type=public"} {
+		if _, err := ParsePKCS11URI(bad); err == nil {
+			t.Fatalf("%s should fail", bad)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := newTestSigner(t, rsaKey, 0)
+	defer signer.Close()
+	if !rsaKey.PublicKey.Equal(signer.Public()) {
+		t.Fatal("public key mismatch")
+	}
+	verifyTestSignature(t, signer, crypto.SHA256)
+	verifyTestSignature(t, signer,
+		&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash: crypto.SHA256})
+	if _, err := signer.Sign(nil, []byte("short"), crypto.SHA256); err == nil {
+		t.Fatal("should fail with a bad digest")
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSigner, _ := newTestSigner(t, ecKey, 0)
+	defer ecSigner.Close()
+	if !ecKey.PublicKey.Equal(ecSigner.Public()) {
+		t.Fatal("public key mismatch")
+	}
+	verifyTestSignature(t, ecSigner, crypto.SHA256)
+}
+
+func TestBadConfig(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []Config{
+		{KeyLabel: testKeyLabel, PIN: "1234"},
+		{TokenLabel: "keymaster", PIN: "1234"},
+		{TokenLabel: "missing", KeyLabel: testKeyLabel, PIN: "1234"},
+		{TokenLabel: "keymaster", KeyLabel: "missing", PIN: "1234"},
+		{TokenLabel: "keymaster", KeyLabel: testKeyLabel, PIN: "0000"},
+	} {
+		_, err := newPkcs11SignerWithModule(config, newFakeModule(rsaKey),
+			testlogger.New(t))
+		if err == nil {
+			t.Fatalf("config %+v should fail", config)
+		}
+	}
+}
+
+func TestConcurrentSignLimitsSessions(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, module := newTestSigner(t, ecKey, 3)
+	defer signer.Close()
+	var wg sync.WaitGroup
+	errors := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			digest := sha256.Sum256([]byte(fmt.Sprintf("message %d", i)))
+			_, err := signer.Sign(nil, digest[:], crypto.SHA256)
+			errors <- err
+		}()
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if module.maxInFlight > 3 {
+		t.Fatalf("%d concurrent signatures with 3 sessions",
+			module.maxInFlight)
+	}
+	// The login session plus at most three signing sessions.
+	if len(module.sessions) > 4 {
+		t.Fatalf("%d sessions open", len(module.sessions))
+	}
+}
+
+func TestReconnectAfterRestart(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, module := newTestSigner(t, ecKey, 0)
+	defer signer.Close()
+	verifyTestSignature(t, signer, crypto.SHA256)
+	module.restart()
+	verifyTestSignature(t, signer, crypto.SHA256)
+	if module.initializeCount != 2 {
+		t.Fatalf("initialized %d times, expected 2", module.initializeCount)
+	}
+	// Concurrent signers after a restart must only reconnect once.
+	module.restart()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			verifyTestSignature(t, signer, crypto.SHA256)
+		}()
+	}
+	wg.Wait()
+	if module.initializeCount != 3 {
+		t.Fatalf("initialized %d times, expected 3", module.initializeCount)
+	}
+}
+
+func TestSharedModule(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	module := newFakeModule(ecKey)
+	numLoads := 0
+	loadModule = func(path string) (pkcs11Module, error) {
+		numLoads++
+		return module, nil
+	}
+	defer func() { loadModule = defaultLoadModule }()
+	config := Config{ModulePath: "/fake/module.so", TokenLabel: "keymaster",
+		KeyLabel: testKeyLabel, PIN: "1234"}
+	signer1, err := newPkcs11Signer(config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer2, err := newPkcs11Signer(config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numLoads != 1 {
+		t.Fatalf("module loaded %d times, expected 1", numLoads)
+	}
+	verifyTestSignature(t, signer1, crypto.SHA256)
+	verifyTestSignature(t, signer2, crypto.SHA256)
+	// Invalidate the sessions of the first signer only: reconnecting it must
+	// leave the module and the sessions of the second one alone.
+	module.mutex.Lock()
+	for _, session := range signer1.idle {
+		delete(module.sessions, session.handle)
+	}
+	module.mutex.Unlock()
+	verifyTestSignature(t, signer1, crypto.SHA256)
+	if module.finalizeCount != 0 {
+		t.Fatal("reconnecting finalized the module")
+	}
+	for _, session := range signer2.idle {
+		if _, ok := module.sessions[session.handle]; !ok {
+			t.Fatal("reconnecting closed the sessions of another signer")
+		}
+	}
+	verifyTestSignature(t, signer2, crypto.SHA256)
+	if err := signer1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if module.finalizeCount != 0 {
+		t.Fatal("module finalized while still in use")
+	}
+	verifyTestSignature(t, signer2, crypto.SHA256)
+	if err := signer2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if module.finalizeCount != 1 {
+		t.Fatalf("finalized %d times, expected 1", module.finalizeCount)
+	}
+	if len(modules) != 0 {
+		t.Fatalf("%d modules still loaded", len(modules))
+	}
+}
+
+var softHSMModulePaths = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+func findSoftHSMModule() string {
+	if path := os.Getenv("SOFTHSM2_MODULE"); path != "" {
+		return path
+	}
+	for _, path := range softHSMModulePaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// setupSoftHSMToken creates a token labeled keymaster with an RSA and an
+// ECDSA key pair in a fresh SoftHSM2 token directory.
+func setupSoftHSMToken(t *testing.T, modulePath string) {
+	directory := t.TempDir()
+	configFile := filepath.Join(directory, "softhsm2.conf")
+	err := os.WriteFile(configFile, []byte(fmt.Sprintf(
+		"directories.tokendir = %s\nobjectstore.backend = file\n",
+		directory)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", configFile)
+	module := pkcs11.New(modulePath)
+	if module == nil {
+		t.Fatalf("cannot load %s", modulePath)
+	}
+	defer module.Destroy()
+	if err := module.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer module.Finalize()
+	slots, err := module.GetSlotList(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := module.InitToken(slots[0], "so-pin", "keymaster"); err != nil {
+		t.Fatal(err)
+	}
+	session, err := module.OpenSession(slots[0],
+		pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.CloseSession(session)
+	if err := module.Login(session, pkcs11.CKU_SO, "so-pin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := module.InitPIN(session, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := module.Logout(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := module.Login(session, pkcs11.CKU_USER, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	ecParams, err := asn1.Marshal(oidNamedCurveP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for label, mechanism := range map[string]uint{
+		"rsa-ca": pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN,
+		"ec-ca":  pkcs11.CKM_EC_KEY_PAIR_GEN,
+	} {
+		publicTemplate := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		}
+		if mechanism == pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN {
+			publicTemplate = append(publicTemplate,
+				pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+				pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT,
+					[]byte{1, 0, 1}))
+		} else {
+			publicTemplate = append(publicTemplate,
+				pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParams))
+		}
+		privateTemplate := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		}
+		_, _, err := module.GenerateKeyPair(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)},
+			publicTemplate, privateTemplate)
+		if err != nil {
+			t.Fatalf("%s: %s", label, err)
+		}
+	}
+}
+
+func TestSoftHSM(t *testing.T) {
+	modulePath := findSoftHSMModule()
+	if modulePath == "" {
+		t.Skip("SoftHSM2 not found, set SOFTHSM2_MODULE to run this test")
+	}
+	setupSoftHSMToken(t, modulePath)
+	for _, keyLabel := range []string{"rsa-ca", "ec-ca"} {
+		signer, err := NewPkcs11Signer(Config{ModulePath: modulePath,
+			TokenLabel: "keymaster", KeyLabel: keyLabel, PIN: "1234"},
+			testlogger.New(t))
+		if err != nil {
+			t.Fatalf("%s: %s", keyLabel, err)
+		}
+		verifyTestSignature(t, signer, crypto.SHA256)
+		if _, ok := signer.Public().(*rsa.PublicKey); ok {
+			verifyTestSignature(t, signer,
+				&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash,
+					Hash: crypto.SHA256})
+		}
+		// Simulate an HSM restart by finalizing the module under the signer.
+		signer.mutex.Lock()
+		signer.module.Finalize()
+		signer.mutex.Unlock()
+		verifyTestSignature(t, signer, crypto.SHA256)
+		if err := signer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package remotesigner
+
+import (
+	"crypto"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"golang.org/x/time/rate"
+)
+
+// The protocol is JSON over HTTP. The signer exposes two paths:
+//
+//	GET  /v1/public  returns a PublicKeyResponse
+//	POST /v1/sign    takes a SignRequest and returns a SignResponse
+//
+// Errors are reported with a non 200 status code and a plain text body.
+const (
+	PublicKeyPath = "/v1/public"
+	SignPath      = "/v1/sign"
+)
+
+type PublicKeyResponse struct {
+	PublicKey []byte `json:"public_key"` // PKIX DER.
+}
+
+type SignRequest struct {
+	// Digest is the message digest, or the full message for Ed25519 keys.
+	Digest []byte `json:"digest"`
+	// Hash is the crypto.Hash name (e.g. "SHA-256"); empty for no hashing.
+	Hash string `json:"hash,omitempty"`
+	// PSSSaltLength is only used when PSS is true.
+	PSS           bool `json:"pss,omitempty"`
+	PSSSaltLength int  `json:"pss_salt_length,omitempty"`
+}
+
+type SignResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// ClientConfig describes how to reach a signer.
+type ClientConfig struct {
+	// Either unix:///path/to/socket or https://host:port.
+	URL string
+	// Client certificate and key. Mandatory for https.
+	CertFilename string
+	KeyFilename  string
+	// CA certificates used to verify the signer. The system roots are used
+	// if empty.
+	CAFilename string
+	Timeout    time.Duration // Default is 10 seconds.
+}
+
+type RemoteSigner struct {
+	client    *http.Client
+	baseURL   string
+	publicKey crypto.PublicKey
+	logger    log.DebugLogger
+}
+
+// NewRemoteSigner connects to the signer described in config and fetches
+// its public key.
+func NewRemoteSigner(config ClientConfig, logger log.DebugLogger) (
+	*RemoteSigner, error) {
+	return newRemoteSigner(config, logger)
+}
+
+// ParseRemoteSignerURL parses locations such as
+// unix:///run/keymaster-signerd/signer.sock or
+// https://signer.example.com:6930?client-cert=/etc/keymaster/signer.pem&client-key=/etc/keymaster/signer.key&ca=/etc/keymaster/signer-ca.pem
+func ParseRemoteSignerURL(location string) (*ClientConfig, error) {
+	return parseRemoteSignerURL(location)
+}
+
+func (rs *RemoteSigner) Public() crypto.PublicKey {
+	return rs.publicKey
+}
+
+func (rs *RemoteSigner) Sign(reader io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	return rs.sign(reader, digest, opts)
+}
+
+// HandlerConfig has the policy enforced by the signer.
+type HandlerConfig struct {
+	// Sign requests per second over all clients. No limit if zero.
+	RateLimit float64
+	Burst     int // Default is 1 if RateLimit is set.
+	// Common names of the client certificates allowed to sign. Any verified
+	// client is allowed if empty. Ignored for unix socket connections, which
+	// are protected by the socket permissions.
+	AllowedClients []string
+	// One JSON object is written per request. Can be nil.
+	AuditLog io.Writer
+}
+
+type Handler struct {
+	signer         crypto.Signer
+	derPublicKey   []byte
+	limiter        *rate.Limiter
+	allowedClients map[string]struct{}
+	logger         log.DebugLogger
+	auditMutex     sync.Mutex // Serializes writes to auditLog.
+	auditLog       io.Writer
+}
+
+// NewHandler returns a http.Handler that serves the signer protocol for
+// signer.
+func NewHandler(signer crypto.Signer, config HandlerConfig,
+	logger log.DebugLogger) (*Handler, error) {
+	return newHandler(signer, config, logger)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serveHTTP(w, r)
+}
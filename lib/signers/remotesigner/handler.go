@@ -0,0 +1,219 @@
+package remotesigner
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+	"golang.org/x/time/rate"
+)
+
+const maxSignRequestSize = 1 << 20
+
+var supportedHashes = []crypto.Hash{
+	crypto.SHA1,
+	crypto.SHA224,
+	crypto.SHA256,
+	crypto.SHA384,
+	crypto.SHA512,
+}
+
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Hash   string    `json:"hash,omitempty"`
+	// Hex encoded digest, or the SHA-256 of the message when not hashed.
+	Digest string `json:"digest,omitempty"`
+	Result string `json:"result"` // ok|denied|rate-limited|error
+	Error  string `json:"error,omitempty"`
+}
+
+func newHandler(signer crypto.Signer, config HandlerConfig,
+	logger log.DebugLogger) (*Handler, error) {
+	derPublicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	h := &Handler{
+		signer:       signer,
+		derPublicKey: derPublicKey,
+		logger:       logger,
+		auditLog:     config.AuditLog,
+	}
+	if config.RateLimit > 0 {
+		burst := config.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		h.limiter = rate.NewLimiter(rate.Limit(config.RateLimit), burst)
+	}
+	if len(config.AllowedClients) > 0 {
+		h.allowedClients = make(map[string]struct{})
+		for _, name := range config.AllowedClients {
+			h.allowedClients[name] = struct{}{}
+		}
+	}
+	return h, nil
+}
+
+func parseHash(name string) (crypto.Hash, error) {
+	if name == "" {
+		return 0, nil
+	}
+	for _, hash := range supportedHashes {
+		if hash.String() == name {
+			return hash, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash: %s", name)
+}
+
+// clientName returns the name of the client. Connections without TLS are
+// only expected on unix sockets.
+func (h *Handler) clientName(r *http.Request) (string, error) {
+	if r.TLS == nil {
+		return "local", nil
+	}
+	if len(r.TLS.VerifiedChains) < 1 {
+		return "", errors.New("no verified client certificate")
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if h.allowedClients == nil {
+		return name, nil
+	}
+	if _, ok := h.allowedClients[name]; !ok {
+		return name, fmt.Errorf("client %s is not allowed", name)
+	}
+	return name, nil
+}
+
+func (h *Handler) audit(record auditRecord) {
+	if record.Error != "" {
+		h.logger.Printf("sign request from %s: %s: %s", record.Client,
+			record.Result, record.Error)
+	} else {
+		h.logger.Debugf(1, "sign request from %s: %s", record.Client,
+			record.Result)
+	}
+	if h.auditLog == nil {
+		return
+	}
+	record.Time = time.Now().UTC()
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		h.logger.Println(err)
+		return
+	}
+	h.auditMutex.Lock()
+	defer h.auditMutex.Unlock()
+	if _, err := h.auditLog.Write(append(encoded, '\n')); err != nil {
+		h.logger.Printf("cannot write audit log: %s", err)
+	}
+}
+
+func (h *Handler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case PublicKeyPath:
+		h.publicKeyHandler(w, r)
+	case SignPath:
+		h.signHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (h *Handler) publicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := h.clientName(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	writeJSON(w, PublicKeyResponse{PublicKey: h.derPublicKey})
+}
+
+func (h *Handler) signHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	record := auditRecord{}
+	var err error
+	record.Client, err = h.clientName(r)
+	if err != nil {
+		record.Result = "denied"
+		record.Error = err.Error()
+		h.audit(record)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if h.limiter != nil && !h.limiter.Allow() {
+		record.Result = "rate-limited"
+		h.audit(record)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	var request SignRequest
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body,
+		maxSignRequestSize)).Decode(&request)
+	if err != nil {
+		record.Result = "error"
+		record.Error = "bad request: " + err.Error()
+		h.audit(record)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	record.Hash = request.Hash
+	hash, err := parseHash(request.Hash)
+	if err != nil {
+		record.Result = "error"
+		record.Error = err.Error()
+		h.audit(record)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hash == 0 {
+		messageHash := sha256.Sum256(request.Digest)
+		record.Digest = hex.EncodeToString(messageHash[:])
+	} else {
+		record.Digest = hex.EncodeToString(request.Digest)
+		if len(request.Digest) != hash.Size() {
+			record.Result = "error"
+			record.Error = "digest length does not match hash"
+			h.audit(record)
+			http.Error(w, record.Error, http.StatusBadRequest)
+			return
+		}
+	}
+	var opts crypto.SignerOpts = hash
+	if request.PSS {
+		opts = &rsa.PSSOptions{SaltLength: request.PSSSaltLength, Hash: hash}
+	}
+	signature, err := h.signer.Sign(rand.Reader, request.Digest, opts)
+	if err != nil {
+		record.Result = "error"
+		record.Error = err.Error()
+		h.audit(record)
+		http.Error(w, "signing failed", http.StatusInternalServerError)
+		return
+	}
+	record.Result = "ok"
+	h.audit(record)
+	writeJSON(w, SignResponse{Signature: signature})
+}
@@ -0,0 +1,195 @@
+package remotesigner
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const defaultClientTimeout = 10 * time.Second
+
+const maxResponseSize = 1 << 20
+
+func parseRemoteSignerURL(location string) (*ClientConfig, error) {
+	parsedURL, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	config := &ClientConfig{}
+	switch parsedURL.Scheme {
+	case "unix":
+		if parsedURL.Path == "" {
+			return nil, errors.New("missing socket path")
+		}
+		if len(parsedURL.RawQuery) > 0 {
+			return nil, errors.New("unix urls do not take parameters")
+		}
+		config.URL = "unix://" + parsedURL.Path
+		return config, nil
+	case "https":
+		if parsedURL.Host == "" {
+			return nil, errors.New("missing host")
+		}
+		query := parsedURL.Query()
+		config.CertFilename = query.Get("client-cert")
+		config.KeyFilename = query.Get("client-key")
+		config.CAFilename = query.Get("ca")
+		if config.CertFilename == "" || config.KeyFilename == "" {
+			return nil, errors.New("https urls require client-cert and client-key")
+		}
+		if timeout := query.Get("timeout"); timeout != "" {
+			config.Timeout, err = time.ParseDuration(timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout: %s", err)
+			}
+		}
+		parsedURL.RawQuery = ""
+		config.URL = parsedURL.String()
+		return config, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", parsedURL.Scheme)
+	}
+}
+
+func newTransport(config ClientConfig) (*http.Transport, string, error) {
+	parsedURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	switch parsedURL.Scheme {
+	case "unix":
+		socketPath := parsedURL.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (
+				net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		// The host is ignored by the dialer.
+		return transport, "http://signer", nil
+	case "https":
+		if config.CertFilename == "" || config.KeyFilename == "" {
+			return nil, "", errors.New("a client certificate is required")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFilename,
+			config.KeyFilename)
+		if err != nil {
+			return nil, "", err
+		}
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if config.CAFilename != "" {
+			caData, err := os.ReadFile(config.CAFilename)
+			if err != nil {
+				return nil, "", err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+				return nil, "", fmt.Errorf("no certificates found in %s",
+					config.CAFilename)
+			}
+		}
+		transport := &http.Transport{TLSClientConfig: tlsConfig}
+		return transport, strings.TrimSuffix(config.URL, "/"), nil
+	default:
+		return nil, "", fmt.Errorf("unsupported scheme: %s", parsedURL.Scheme)
+	}
+}
+
+func newRemoteSigner(config ClientConfig, logger log.DebugLogger) (
+	*RemoteSigner, error) {
+	transport, baseURL, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultClientTimeout
+	}
+	rs := &RemoteSigner{
+		client:  &http.Client{Transport: transport, Timeout: timeout},
+		baseURL: baseURL,
+		logger:  logger,
+	}
+	var response PublicKeyResponse
+	if err := rs.call(http.MethodGet, PublicKeyPath, nil,
+		&response); err != nil {
+		return nil, err
+	}
+	rs.publicKey, err = x509.ParsePKIXPublicKey(response.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key from signer: %s", err)
+	}
+	logger.Debugf(1, "connected to remote signer at %s", config.URL)
+	return rs, nil
+}
+
+func (rs *RemoteSigner) call(method string, path string, request interface{},
+	response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, rs.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	limitedBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(limitedBody, 1024))
+		return fmt.Errorf("remote signer error: %s: %s", resp.Status,
+			strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(limitedBody).Decode(response)
+}
+
+func (rs *RemoteSigner) sign(reader io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	request := SignRequest{Digest: digest}
+	if hash := opts.HashFunc(); hash != 0 {
+		request.Hash = hash.String()
+	}
+	if pssOptions, ok := opts.(*rsa.PSSOptions); ok {
+		request.PSS = true
+		request.PSSSaltLength = pssOptions.SaltLength
+	}
+	var response SignResponse
+	if err := rs.call(http.MethodPost, SignPath, request,
+		&response); err != nil {
+		return nil, err
+	}
+	if len(response.Signature) < 1 {
+		return nil, errors.New("remote signer returned an empty signature")
+	}
+	return response.Signature, nil
+}
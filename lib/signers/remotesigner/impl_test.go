@@ -0,0 +1,370 @@
+package remotesigner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func startUnixSigner(t *testing.T, signer crypto.Signer,
+	config HandlerConfig) string {
+	handler, err := NewHandler(signer, config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketPath := filepath.Join(t.TempDir(), "signer.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return "unix://" + socketPath
+}
+
+func TestParseRemoteSignerURL(t *testing.T) {
+	config, err := ParseRemoteSignerURL("unix:///run/signer.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.URL != "unix:///run/signer.sock" {
+		t.Fatalf("unexpected url: %s", config.URL)
+	}
+	config, err = ParseRemoteSignerURL("https://signer:6930?client-cert=/c.pem&client-key=/c.key&ca=/ca.pem&timeout=3s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ClientConfig{
+		URL:          "https://signer:6930",
+		CertFilename: "/c.pem",
+		KeyFilename:  "/c.key",
+		CAFilename:   "/ca.pem",
+		Timeout:      3 * time.Second,
+	}
+	if *config != expected {
+		t.Fatalf("unexpected config: %+v", *config)
+	}
+	badLocations := []string{
+		"unix://",
+		"unix:///run/signer.sock?ca=/ca.pem",
+		"https://signer:6930",
+		"https://signer:6930?client-cert=/c.pem",
+		"https://signer:6930?client-cert=/c.pem&client-key=/c.key&timeout=x",
+		"http://signer:6930",
+		"tcp://signer:6930",
+	}
+	for _, location := range badLocations {
+		if _, err := ParseRemoteSignerURL(location); err == nil {
+			t.Errorf("location %s should have failed", location)
+		}
+	}
+}
+
+func TestSignOverUnixSocket(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("keymaster remote signer")
+	digest := sha256.Sum256(message)
+	pssOptions := &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+		Hash:       crypto.SHA256,
+	}
+	for _, key := range []crypto.Signer{ecKey, rsaKey, edKey} {
+		location := startUnixSigner(t, key, HandlerConfig{})
+		config, err := ParseRemoteSignerURL(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := NewRemoteSigner(*config, testlogger.New(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch pub := signer.Public().(type) {
+		case *ecdsa.PublicKey:
+			signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+				t.Fatal("bad ecdsa signature")
+			}
+		case *rsa.PublicKey:
+			signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signature, err = signer.Sign(rand.Reader, digest[:], pssOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], signature,
+				pssOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case ed25519.PublicKey:
+			signature, err := signer.Sign(rand.Reader, message, crypto.Hash(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ed25519.Verify(pub, message, signature) {
+				t.Fatal("bad ed25519 signature")
+			}
+		default:
+			t.Fatalf("unexpected public key type %T", pub)
+		}
+	}
+}
+
+func TestSignRejectsBadDigest(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseRemoteSignerURL(startUnixSigner(t, key,
+		HandlerConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewRemoteSigner(*config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Sign(rand.Reader, []byte("short"),
+		crypto.SHA256); err == nil {
+		t.Fatal("short digest should have failed")
+	}
+	digest := sha256.Sum256([]byte("message"))
+	if _, err := signer.Sign(rand.Reader, digest[:],
+		crypto.MD5); err == nil {
+		t.Fatal("MD5 should have failed")
+	}
+}
+
+func TestRateLimitAndAudit(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := &bytes.Buffer{}
+	location := startUnixSigner(t, key, HandlerConfig{
+		RateLimit: 0.001,
+		Burst:     2,
+		AuditLog:  auditLog,
+	})
+	config, err := ParseRemoteSignerURL(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewRemoteSigner(*config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("message"))
+	for i := 0; i < 2; i++ {
+		if _, err := signer.Sign(rand.Reader, digest[:],
+			crypto.SHA256); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("expected rate limit error, got: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(auditLog.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 audit records, got %d", len(lines))
+	}
+	var results []string
+	for _, line := range lines {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Client != "local" {
+			t.Fatalf("unexpected client: %s", record.Client)
+		}
+		results = append(results, record.Result)
+	}
+	if strings.Join(results, ",") != "ok,ok,rate-limited" {
+		t.Fatalf("unexpected audit results: %v", results)
+	}
+}
+
+type testPKI struct {
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+	caPEM  []byte
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test signer CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPKI{
+		caCert: caCert,
+		caKey:  caKey,
+		caPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (pki *testPKI) issue(t *testing.T, commonName string,
+	usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.caCert,
+		key.Public(), pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writeKeyPair(t *testing.T, cert tls.Certificate) (string, string) {
+	dir := t.TempDir()
+	certFilename := filepath.Join(dir, "client.pem")
+	keyFilename := filepath.Join(dir, "client.key")
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFilename, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFilename, pem.EncodeToMemory(&pem.Block{
+		Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFilename, keyFilename
+}
+
+func TestSignOverMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewHandler(key, HandlerConfig{
+		AllowedClients: []string{"keymasterd"},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(pki.caCert)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{
+			pki.issue(t, "signer", x509.ExtKeyUsageServerAuth)},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+	caFilename := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFilename, pki.caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("message"))
+
+	certFilename, keyFilename := writeKeyPair(t,
+		pki.issue(t, "keymasterd", x509.ExtKeyUsageClientAuth))
+	signer, err := NewRemoteSigner(ClientConfig{
+		URL:          server.URL,
+		CertFilename: certFilename,
+		KeyFilename:  keyFilename,
+		CAFilename:   caFilename,
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature) {
+		t.Fatal("bad signature")
+	}
+
+	certFilename, keyFilename = writeKeyPair(t,
+		pki.issue(t, "intruder", x509.ExtKeyUsageClientAuth))
+	_, err = NewRemoteSigner(ClientConfig{
+		URL:          server.URL,
+		CertFilename: certFilename,
+		KeyFilename:  keyFilename,
+		CAFilename:   caFilename,
+	}, testlogger.New(t))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected forbidden, got: %v", err)
+	}
+}
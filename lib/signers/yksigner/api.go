@@ -26,6 +26,14 @@ func NewYkPivSigner(serial uint32, pivPIN string, pub crypto.PublicKey) (*YkSign
 	return newYkPivSigner(serial, pivPIN, pub)
 }
 
+// ParseYubiPIVURL parses a location such as yubipiv://<pubkey>:<pin>@<serial>
+// where the public key is base64url encoded PKIX DER. The public key and PIN
+// are optional; the PIN defaults to the PIV default PIN.
+func ParseYubiPIVURL(location string) (uint32, string, crypto.PublicKey,
+	error) {
+	return parseYubiPIVURL(location)
+}
+
 func (ks *YkSigner) Public() crypto.PublicKey {
 	return ks.public()
 }
@@ -2,13 +2,48 @@ package yksigner
 
 import (
 	"crypto"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/go-piv/piv-go/v2/piv"
 )
 
+const defaultPIVPin = "123456"
+
+func parseYubiPIVURL(location string) (uint32, string, crypto.PublicKey,
+	error) {
+	parsedYK, err := url.Parse(location)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("Cannot parse url for yubipiv")
+	}
+	serial, err := strconv.ParseUint(parsedYK.Host, 10, 32)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("Invalid Host name '%s' is not converable to serial", parsedYK.Host)
+	}
+	if parsedYK.User == nil {
+		return uint32(serial), defaultPIVPin, nil, nil
+	}
+	b64derPubKey := parsedYK.User.Username()
+	derPubKey, err := base64.URLEncoding.DecodeString(b64derPubKey)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("Invalid pub key encoding err=%s", err)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(derPubKey)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("Invalid pub key err=%s", err)
+	}
+	pivPin := defaultPIVPin
+	if pass, ok := parsedYK.User.Password(); ok {
+		pivPin = pass
+	}
+	return uint32(serial), pivPin, publicKey, nil
+}
+
 func newYkPivSigner(serial uint32, pivPIN string, pub crypto.PublicKey) (*YkSigner, error) {
 	ks := YkSigner{
 		ykSerial: serial,
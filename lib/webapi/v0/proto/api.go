@@ -19,3 +19,20 @@ type LoginResponse struct {
 	Message         string   `json:"message"`
 	CertAuthBackend []string `json:"auth_backend"`
 }
+
+// KubernetesClustersPath is public and lists the clusters that accept the
+// x509-kubernetes certificates.
+const KubernetesClustersPath = "/public/kubernetesClusters"
+
+type KubernetesCluster struct {
+	Name   string `json:"name"`
+	Server string `json:"server"`
+	// PEM encoded CA certificates of the API server. Empty to use the
+	// system roots.
+	CertificateAuthorityData []byte `json:"certificate_authority_data,omitempty"`
+	Namespace                string `json:"namespace,omitempty"`
+}
+
+type KubernetesClustersResponse struct {
+	Clusters []KubernetesCluster `json:"clusters"`
+}
@@ -0,0 +1,65 @@
+package eventmon
+
+var v0EventTypes = map[string]struct{}{
+	EventTypeAuth:                   {},
+	EventTypeServiceProviderConsent: {},
+	EventTypeServiceProviderLogin:   {},
+	EventTypeSSHCert:                {},
+	EventTypeWebLogin:               {},
+	EventTypeX509Cert:               {},
+}
+
+// v0AuthTypes are the authentication types EventV0 clients know about.
+var v0AuthTypes = map[string]struct{}{
+	AuthTypePassword:    {},
+	AuthTypeSymantecVIP: {},
+	AuthTypeU2F:         {},
+	AuthTypeWebAuthn:    {},
+}
+
+// V0 returns the EventV0 for the event. It returns false for failures and
+// event or authentication types which EventV0 does not have.
+func (event EventV1) V0() (EventV0, bool) {
+	if _, ok := v0EventTypes[event.Type]; !ok {
+		return EventV0{}, false
+	}
+	if event.Outcome != OutcomeSuccess {
+		return EventV0{}, false
+	}
+	eventV0 := EventV0{
+		Type:               event.Type,
+		CertData:           event.CertData,
+		ServiceProviderUrl: event.ServiceProviderUrl,
+		Username:           event.Username,
+	}
+	if event.Factor != nil {
+		if _, ok := v0AuthTypes[event.Factor.AuthType]; !ok {
+			return EventV0{}, false
+		}
+		eventV0.AuthType = event.Factor.AuthType
+		eventV0.VIPAuthType = event.Factor.VIPAuthType
+		// EventV0 has always reported WebAuthn as U2F.
+		if eventV0.AuthType == AuthTypeWebAuthn {
+			eventV0.AuthType = AuthTypeU2F
+		}
+	}
+	return eventV0, true
+}
+
+// V1 returns the event as an EventV1, without the fields EventV0 lacks.
+func (event EventV0) V1() EventV1 {
+	eventV1 := EventV1{
+		Type:               event.Type,
+		Outcome:            OutcomeSuccess,
+		Username:           event.Username,
+		CertData:           event.CertData,
+		ServiceProviderUrl: event.ServiceProviderUrl,
+	}
+	if event.AuthType != "" {
+		eventV1.Factor = &FactorV1{
+			AuthType:    event.AuthType,
+			VIPAuthType: event.VIPAuthType,
+		}
+	}
+	return eventV1
+}
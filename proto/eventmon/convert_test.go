@@ -0,0 +1,73 @@
+package eventmon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConvertRoundTrip(t *testing.T) {
+	for _, eventV0 := range []EventV0{
+		{Type: EventTypeAuth, AuthType: AuthTypeU2F, Username: "alice"},
+		{
+			Type:        EventTypeAuth,
+			AuthType:    AuthTypeSymantecVIP,
+			VIPAuthType: VIPAuthTypePush,
+			Username:    "alice",
+		},
+		{Type: EventTypeSSHCert, CertData: []byte("cert")},
+		{
+			Type:               EventTypeServiceProviderLogin,
+			ServiceProviderUrl: "https://sp.example.com/",
+			Username:           "alice",
+		},
+		{Type: EventTypeWebLogin, Username: "alice"},
+	} {
+		converted, ok := eventV0.V1().V0()
+		if !ok {
+			t.Errorf("%s event not converted back", eventV0.Type)
+			continue
+		}
+		if !reflect.DeepEqual(converted, eventV0) {
+			t.Errorf("expected %+v, got %+v", eventV0, converted)
+		}
+	}
+}
+
+func TestV0OmitsV1Events(t *testing.T) {
+	for _, event := range []EventV1{
+		{Type: EventTypeAuthFailure, Outcome: OutcomeFailure},
+		{Type: EventTypeUserAdd, Outcome: OutcomeSuccess},
+		{Type: EventTypeAuth, Outcome: OutcomeFailure},
+		{
+			Type:    EventTypeAuth,
+			Outcome: OutcomeSuccess,
+			Factor:  &FactorV1{AuthType: AuthTypeTOTP},
+		},
+		{
+			Type:    EventTypeAuth,
+			Outcome: OutcomeSuccess,
+			Factor:  &FactorV1{AuthType: AuthTypeOkta},
+		},
+		{
+			Type:    EventTypeAuth,
+			Outcome: OutcomeSuccess,
+			Factor:  &FactorV1{AuthType: AuthTypeBootstrapOTP},
+		},
+	} {
+		if _, ok := event.V0(); ok {
+			t.Errorf("%s %s event converted to v0", event.Type,
+				event.Outcome)
+		}
+	}
+}
+
+func TestV0WebAuthn(t *testing.T) {
+	event := EventV1{
+		Type:    EventTypeAuth,
+		Outcome: OutcomeSuccess,
+		Factor:  &FactorV1{AuthType: AuthTypeWebAuthn},
+	}
+	if eventV0, _ := event.V0(); eventV0.AuthType != AuthTypeU2F {
+		t.Errorf("expected %s, got %s", AuthTypeU2F, eventV0.AuthType)
+	}
+}
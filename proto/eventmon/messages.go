@@ -1,19 +1,52 @@
 package eventmon
 
+import (
+	"time"
+)
+
 const (
 	ConnectString = "200 Connected to keymaster eventmon service"
 	HttpPath      = "/eventmon/v0"
+	HttpPathV1    = "/eventmon/v1"
+
+	AuthTypeBootstrapOTP = "BootstrapOTP"
+	AuthTypeOkta         = "Okta"
+	AuthTypePassword     = "Password"
+	AuthTypeSymantecVIP  = "SymantecVIP"
+	AuthTypeU2F          = "U2F"
+	AuthTypeTOTP         = "TOTP"
+	AuthTypeWebAuthn     = "WebAuthn"
+
+	EventTypeAuth                   = "Auth"
+	EventTypeServiceProviderConsent = "ServiceProviderConsent"
+	EventTypeServiceProviderLogin   = "ServiceProviderLogin"
+	EventTypeSSHCert                = "SSHCert"
+	EventTypeWebLogin               = "WebLogin"
+	EventTypeX509Cert               = "X509Cert"
+
+	// Only sent in EventV1.
+	EventTypeAuthFailure            = "AuthFailure"
+	EventTypeBootstrapOTPGeneration = "BootstrapOTPGeneration"
+	EventTypeGap                    = "Gap"
+	EventTypeOIDCCodeIssue          = "OIDCCodeIssue"
+	EventTypeOIDCTokenIssue         = "OIDCTokenIssue"
+	EventTypeTokenDeletion          = "TokenDeletion"
+	EventTypeTokenRegistration      = "TokenRegistration"
+	EventTypeUnseal                 = "Unseal"
+	EventTypeUserAdd                = "UserAdd"
+	EventTypeUserDelete             = "UserDelete"
 
-	AuthTypePassword    = "Password"
-	AuthTypeSymantecVIP = "SymantecVIP"
-	AuthTypeU2F         = "U2F"
-	AuthTypeTOTP        = "TOTP"
+	// FailureReason codes: fixed so that clients can match on them.
+	FailureReasonBufferOverflow    = "BufferOverflow"
+	FailureReasonInvalidOTP        = "InvalidOTP"
+	FailureReasonInvalidPassword   = "InvalidPassword"
+	FailureReasonInvalidSignature  = "InvalidSignature"
+	FailureReasonPushRejected      = "PushRejected"
+	FailureReasonUnsealFailed      = "UnsealFailed"
+	FailureReasonVerificationError = "VerificationError"
 
-	EventTypeAuth                 = "Auth"
-	EventTypeServiceProviderLogin = "ServiceProviderLogin"
-	EventTypeSSHCert              = "SSHCert"
-	EventTypeWebLogin             = "WebLogin"
-	EventTypeX509Cert             = "X509Cert"
+	OutcomeFailure = "Failure"
+	OutcomeSuccess = "Success"
 
 	VIPAuthTypeOTP  = "VIPAuthOTP"
 	VIPAuthTypePush = "VIPAuthPush"
@@ -28,8 +61,56 @@ type EventV0 struct {
 	CertData []byte `json:",omitempty"`
 
 	AuthType           string `json:",omitempty"` // Present for Auth events.
-	ServiceProviderUrl string `json:",omitempty"` // Present for SPLogin events.
-	Username           string `json:",omitempty"` // Auth, SPLogin and WebLogin
+	ServiceProviderUrl string `json:",omitempty"` // SPLogin and SPConsent.
+	Username           string `json:",omitempty"` // Auth, SP* and WebLogin
 
 	VIPAuthType string `json:",omitempty"` // Present for VIP Auth events.
 }
+
+// Clients of HttpPathV1 may resume a stream by adding the StreamID and the
+// Sequence of the last event received as the "stream" and "after" query
+// parameters. The events after it which are still buffered are sent first.
+// If some were lost, a Gap event with the Sequence of the first one and
+// MissedEvents is sent before them. If the StreamID is that of the stream
+// before keymasterd was last restarted, the buffered events of the new stream
+// are sent. For other StreamIDs, only new events are sent.
+
+// EventV1 is sent on HttpPathV1. Successful events of the types in EventV0
+// are also sent on HttpPath.
+type EventV1 struct {
+	ID             string // Unique.
+	StreamID       string `json:",omitempty"` // Changes when keymasterd starts.
+	Sequence       uint64 `json:",omitempty"` // Increments in the stream.
+	Time           time.Time
+	Type           string
+	Outcome        string // OutcomeSuccess or OutcomeFailure.
+	FailureReason  string `json:",omitempty"` // A FailureReason* code.
+	ServerHostname string `json:",omitempty"`
+
+	// The client, present for events caused by a request.
+	SourceIP  string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+
+	// The user the event is about: the authenticated user, the certificate
+	// owner or the user added, deleted or given a token or bootstrap OTP.
+	Username string `json:",omitempty"`
+	// The authenticated user making the request, if not Username (such as an
+	// administrator).
+	RequestingUsername string `json:",omitempty"`
+
+	// Present for SSH and X509 certificate events.
+	CertData []byte `json:",omitempty"`
+
+	// Present for Auth, AuthFailure and Token* events.
+	Factor *FactorV1 `json:",omitempty"`
+
+	ServiceProviderUrl string `json:",omitempty"` // SPLogin and SPConsent.
+	ClientID           string `json:",omitempty"` // OIDC*.
+	MissedEvents       uint64 `json:",omitempty"` // Gap.
+}
+
+type FactorV1 struct {
+	AuthType    string
+	VIPAuthType string `json:",omitempty"`
+	TokenName   string `json:",omitempty"` // Token* events.
+}